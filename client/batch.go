@@ -0,0 +1,271 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Pipeline collects commands and sends them in one write, so n commands
+// cost one round trip rather than n. The server still applies them one by
+// one as it reads them: a pipeline isn't atomic, and each command succeeds
+// or fails on its own. Use Batch for all or nothing.
+type Pipeline struct {
+	c    *Client
+	cmds [][]string
+}
+
+// Result is the outcome of one pipelined command.
+type Result struct {
+	Reply string
+	Err   error
+}
+
+func (c *Client) Pipeline() *Pipeline {
+	return &Pipeline{c: c}
+}
+
+// Do adds a command, given as for Client.Do.
+func (p *Pipeline) Do(args ...string) *Pipeline {
+	p.cmds = append(p.cmds, args)
+	return p
+}
+
+func (p *Pipeline) Get(key string) *Pipeline {
+	return p.Do("GET", key)
+}
+
+func (p *Pipeline) Set(key, value string) *Pipeline {
+	return p.Do("SET", key, value)
+}
+
+func (p *Pipeline) Delete(key string) *Pipeline {
+	return p.Do("GETDEL", key)
+}
+
+func (p *Pipeline) Len() int {
+	return len(p.cmds)
+}
+
+// Send writes the commands collected so far and returns their futures in
+// order, leaving the pipeline empty for reuse.
+func (p *Pipeline) Send(ctx context.Context) []*Future {
+	if len(p.cmds) == 0 {
+		return nil
+	}
+	futures := p.c.send(ctx, p.cmds)
+	p.cmds = nil
+	return futures
+}
+
+// Exec sends the commands and waits for their replies. The error is set
+// only when ctx ended first; failed commands have their Err set instead,
+// and aren't retried.
+func (p *Pipeline) Exec(ctx context.Context) ([]Result, error) {
+	ctx, cancel := p.c.opts.callContext(ctx)
+	defer cancel()
+	futures := p.Send(ctx)
+	results := make([]Result, len(futures))
+	for i, f := range futures {
+		select {
+		case <-f.Done():
+			results[i] = Result{Reply: f.reply, Err: f.err}
+		case <-ctx.Done():
+			return results, context.Cause(ctx)
+		}
+	}
+	return results, nil
+}
+
+// MaxBatchOps is the most ops the server takes in one batch request. Exec
+// splits bigger batches that needn't be atomic.
+const MaxBatchOps = 1000
+
+// BatchOp is one write of a batch, as POST /kv/batch takes it.
+type BatchOp struct {
+	Op    string `json:"op"` // "put" or "delete"
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+	TTL   string `json:"ttl,omitempty"`
+}
+
+// BatchResult is the outcome of one op.
+type BatchResult struct {
+	Op        string `json:"op"`
+	Key       string `json:"key"`
+	OK        bool   `json:"ok"`
+	Existed   bool   `json:"existed"`
+	Revision  int    `json:"revision"` // the raft index of the op's entry, -1 unless it committed
+	ExpiresAt string `json:"expiresAt,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// BatchResponse is what the server answers a batch with.
+type BatchResponse struct {
+	Atomic   bool          `json:"atomic"`
+	Revision int           `json:"revision"` // the last entry that committed, -1 if none did
+	Results  []BatchResult `json:"results"`
+}
+
+// Batch collects puts and deletes and sends them as one request to the
+// HTTP API, which keeps values byte for byte. An atomic batch is one log
+// entry, applied all or nothing on every node; otherwise each op is applied
+// on its own.
+type Batch struct {
+	c      *Client
+	ops    []BatchOp
+	atomic bool
+	token  string
+}
+
+func (c *Client) Batch() *Batch {
+	return &Batch{c: c}
+}
+
+func (b *Batch) Put(key, value string) *Batch {
+	b.ops = append(b.ops, BatchOp{Op: "put", Key: key, Value: value})
+	return b
+}
+
+// PutTTL adds a put whose key expires ttl after the write.
+func (b *Batch) PutTTL(key, value string, ttl time.Duration) *Batch {
+	b.ops = append(b.ops, BatchOp{Op: "put", Key: key, Value: value, TTL: ttl.String()})
+	return b
+}
+
+func (b *Batch) Delete(key string) *Batch {
+	b.ops = append(b.ops, BatchOp{Op: "delete", Key: key})
+	return b
+}
+
+// Atomic makes the batch all or nothing.
+func (b *Batch) Atomic() *Batch {
+	b.atomic = true
+	return b
+}
+
+// IdempotencyKey tags the batch so that sending it again after an unclear
+// failure gets the first result back instead of applying it twice.
+func (b *Batch) IdempotencyKey(token string) *Batch {
+	b.token = token
+	return b
+}
+
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+// Exec sends the batch. A non-atomic batch of more than MaxBatchOps ops goes
+// as several requests, and its response covers them all.
+func (b *Batch) Exec(ctx context.Context) (*BatchResponse, error) {
+	ctx, cancel := b.c.opts.callContext(ctx)
+	defer cancel()
+	if b.atomic || len(b.ops) <= MaxBatchOps {
+		return b.c.batch(ctx, b.ops, b.atomic, b.token)
+	}
+	res := &BatchResponse{Revision: -1}
+	for i := 0; i < len(b.ops); i += MaxBatchOps {
+		token := b.token
+		if token != "" {
+			token += "." + strconv.Itoa(i/MaxBatchOps) // each request is retried on its own
+		}
+		part, err := b.c.batch(ctx, b.ops[i:min(i+MaxBatchOps, len(b.ops))], false, token)
+		if err != nil {
+			return nil, err
+		}
+		res.Results = append(res.Results, part.Results...)
+		res.Revision = max(res.Revision, part.Revision)
+	}
+	return res, nil
+}
+
+// httpBase is where the HTTP API of the node at addr is.
+func httpBase(addr string, opts Options) string {
+	scheme := "http"
+	if opts.TLS != nil {
+		scheme = "https"
+	}
+	if opts.HTTPAddr != "" {
+		return scheme + "://" + opts.HTTPAddr
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if p, perr := strconv.Atoi(port); err == nil && perr == nil {
+		return scheme + "://" + net.JoinHostPort(host, strconv.Itoa(p+1000))
+	}
+	return scheme + "://" + addr
+}
+
+// httpCodes map the HTTP API's statuses to the codes TCP replies carry.
+var httpCodes = map[int]string{
+	http.StatusBadRequest:            CodeSyntax,
+	http.StatusRequestEntityTooLarge: CodeTooLarge,
+	http.StatusGatewayTimeout:        CodeTimeout,
+	http.StatusServiceUnavailable:    CodeNotLeader,
+	http.StatusInsufficientStorage:   CodeQuota,
+	http.StatusTooManyRequests:       CodeRateLimit,
+	http.StatusInternalServerError:   CodeIO,
+}
+
+// batch sends one batch request, again as Options.Retry allows. With token
+// set that's safe whatever happened, since the server answers a repeat with
+// the first outcome.
+func (c *Client) batch(ctx context.Context, ops []BatchOp, atomic bool, token string) (*BatchResponse, error) {
+	for attempt := 1; ; attempt++ {
+		res, err := c.batchOnce(ctx, ops, atomic, token)
+		if err == nil || !c.opts.Retry.retry(ctx, attempt, err, token != "") {
+			return res, err
+		}
+	}
+}
+
+func (c *Client) batchOnce(ctx context.Context, ops []BatchOp, atomic bool, token string) (*BatchResponse, error) {
+	body, err := json.Marshal(struct {
+		Ops    []BatchOp `json:"ops"`
+		Atomic bool      `json:"atomic"`
+	}{ops, atomic})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, httpBase(c.addr, c.opts)+"/kv/batch", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.opts.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.opts.Token)
+	}
+	if token != "" {
+		req.Header.Set("Idempotency-Key", token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		if op := (*net.OpError)(nil); errors.As(err, &op) && op.Op == "dial" {
+			err = &notSent{err}
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		text, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		if code, ok := httpCodes[resp.StatusCode]; ok {
+			if code == CodeQuota && strings.HasPrefix(string(text), "disk nearly full:") {
+				code = CodeReadOnly // a full disk shares the status with quotas
+			}
+			return nil, &Error{Code: code, Text: strings.TrimSpace(string(text))}
+		}
+		return nil, fmt.Errorf("batch: %s: %s", resp.Status, strings.TrimSpace(string(text)))
+	}
+	var res BatchResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, fmt.Errorf("batch: reading the response: %w", err)
+	}
+	return &res, nil
+}
@@ -0,0 +1,467 @@
+// Package client is a Go client for KV-Store nodes. Commands go over the TCP
+// protocol, one line each, and a connection is pipelined: every call writes
+// its command right away and the replies are matched to the calls in the
+// order they come back, so many goroutines can share one Client and a slow
+// call never holds up the writes behind it. Batches that have to keep values
+// byte for byte, or be applied atomically, go over the HTTP API instead.
+//
+// The protocol splits commands on whitespace, so a value written with Set or
+// Do comes back with runs of spaces and tabs turned into single spaces, and
+// can't hold line breaks at all. Batch has neither limit.
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mathdee/KV-Store/internal/protocol"
+)
+
+// DefaultDialTimeout bounds connecting to a node.
+const DefaultDialTimeout = 5 * time.Second
+
+// protocolVersion is the client protocol version the client asks for, the
+// one with coded errors.
+const protocolVersion = 2
+
+// Options configure a Client; the zero value connects over plain TCP.
+type Options struct {
+	DialTimeout time.Duration // 0 for DefaultDialTimeout
+	TLS         *tls.Config   // nil for plain TCP
+	HTTPAddr    string        // the node's HTTP API, "" for its TCP port + 1000
+	Token       string        // bearer token for the HTTP API, the admin one when tokens are on
+	Timeout     time.Duration // bounds each call, retries included, whose ctx has no deadline; 0 for none
+	Retry       RetryPolicy   // the zero value for DefaultRetryPolicy
+}
+
+// Error codes the server replies with, see Error.
+const (
+	CodeNotLeader    = "NOTLEADER"
+	CodeTimeout      = "TIMEOUT"
+	CodeNotCommitted = "NOTCOMMITTED"
+	CodeIO           = "IO"
+	CodeTooLarge     = "TOOLARGE"
+	CodeSyntax       = "SYNTAX"
+	CodeUnknown      = "UNKNOWNCMD"
+	CodeNoKey        = "NOKEY"
+	CodeWitness      = "WITNESS"
+	CodeQuota        = "QUOTA"
+	CodeRateLimit    = "RATELIMIT"
+	CodeReadOnly     = "READONLY"
+	CodeScript       = "SCRIPT"
+	CodeLocked       = "LOCKED"
+)
+
+// Error is an error reply from the server.
+type Error struct {
+	Code string
+	Text string
+}
+
+func (e *Error) Error() string {
+	return e.Code + ": " + e.Text
+}
+
+// IsCode reports whether err is an error reply with the given code.
+func IsCode(err error, code string) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Code == code
+}
+
+// ErrClosed is returned by calls on a closed Client.
+var ErrClosed = errors.New("client closed")
+
+// multiLine are the commands that reply with a line count and then that
+// many lines, for the arguments each func accepts.
+var multiLine = map[string]func(args []string) bool{
+	"INFO":    func([]string) bool { return true },
+	"CLIENT":  func(args []string) bool { return len(args) > 1 && strings.EqualFold(args[1], "LIST") },
+	"SLOWLOG": func(args []string) bool { return len(args) == 1 || strings.EqualFold(args[1], "GET") },
+	"HOTKEYS": func(args []string) bool { return len(args) == 1 || !strings.EqualFold(args[1], "RESET") },
+	"TXN":     func([]string) bool { return true },
+	"HISTORY": func([]string) bool { return true },
+}
+
+// Client talks to one node. It is safe for concurrent use, and dials again
+// after the connection breaks.
+type Client struct {
+	addr string
+	opts Options
+	http *http.Client
+
+	mu     sync.Mutex // guards conn and closed, and keeps writes and pending in the same order
+	conn   *conn
+	closed bool
+}
+
+// conn is one connection and the calls waiting for its replies.
+type conn struct {
+	nc      net.Conn
+	w       *bufio.Writer
+	pending []*Future
+}
+
+// Dial connects to the node at addr (host:port of its TCP port).
+func Dial(ctx context.Context, addr string, opts Options) (*Client, error) {
+	if opts.DialTimeout <= 0 {
+		opts.DialTimeout = DefaultDialTimeout
+	}
+	opts.Retry = opts.Retry.orDefault()
+	c := &Client{addr: addr, opts: opts, http: newHTTPClient(opts)}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := c.connect(ctx); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func newHTTPClient(opts Options) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{TLSClientConfig: opts.TLS},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return errors.New("too many redirects")
+			}
+			req.Header.Set("Authorization", via[0].Header.Get("Authorization")) // followers redirect writes to the leader's port
+			return nil
+		},
+	}
+}
+
+// Addr is the node the client talks to.
+func (c *Client) Addr() string {
+	return c.addr
+}
+
+// connect returns the current connection, dialing one if there is none.
+// Callers hold c.mu.
+func (c *Client) connect(ctx context.Context) (*conn, error) {
+	if c.closed {
+		return nil, ErrClosed
+	}
+	if c.conn != nil {
+		return c.conn, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.opts.DialTimeout)
+	defer cancel()
+	var nc net.Conn
+	var err error
+	if c.opts.TLS != nil {
+		d := tls.Dialer{Config: c.opts.TLS}
+		nc, err = d.DialContext(ctx, "tcp", c.addr)
+	} else {
+		var d net.Dialer
+		nc, err = d.DialContext(ctx, "tcp", c.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Agree on coded errors before anything else is sent.
+	r := bufio.NewReader(nc)
+	if deadline, ok := ctx.Deadline(); ok {
+		nc.SetDeadline(deadline)
+	}
+	fmt.Fprintf(nc, "PROTOCOL %d\n", protocolVersion)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("negotiating the protocol with %s: %w", c.addr, err)
+	}
+	if line = strings.TrimSpace(line); line != "PROTOCOL "+strconv.Itoa(protocolVersion) {
+		nc.Close()
+		return nil, fmt.Errorf("%s speaks %q, this client needs protocol version %d", c.addr, line, protocolVersion)
+	}
+	nc.SetDeadline(time.Time{})
+
+	cn := &conn{nc: nc, w: bufio.NewWriter(nc)}
+	c.conn = cn
+	go c.readReplies(cn, r)
+	return cn, nil
+}
+
+// readReplies hands each reply on cn to the call that waits for it, oldest
+// first, until the connection breaks.
+func (c *Client) readReplies(cn *conn, r *bufio.Reader) {
+	for {
+		line, err := r.ReadString('\n')
+		var f *Future
+		if err == nil {
+			c.mu.Lock()
+			if len(cn.pending) > 0 {
+				f = cn.pending[0]
+				cn.pending = cn.pending[1:]
+			}
+			c.mu.Unlock()
+			if f == nil {
+				err = fmt.Errorf("reply %q to no command", strings.TrimSpace(line))
+			}
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if err == nil && f.lines > 0 {
+			line, err = readLines(r, line)
+		}
+		if err != nil {
+			c.broken(cn, err, f)
+			return
+		}
+		f.resolve(parseReply(line))
+	}
+}
+
+// readLines reads the lines a multi-line reply announced in count, its
+// first line.
+func readLines(r *bufio.Reader, count string) (string, error) {
+	if strings.HasPrefix(count, "ERR_") {
+		return count, nil // refused, there are no lines
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil {
+		return "", fmt.Errorf("bad line count %q", count)
+	}
+	lines := make([]string, n)
+	for i := range lines {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		lines[i] = strings.TrimRight(line, "\r\n")
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// broken drops cn after err and fails every call still waiting on it,
+// reading the first of them if reading is not nil. The next call dials
+// again.
+func (c *Client) broken(cn *conn, err error, reading *Future) {
+	c.mu.Lock()
+	if c.conn == cn {
+		c.conn = nil
+	}
+	pending := cn.pending
+	if reading != nil {
+		pending = append([]*Future{reading}, pending...)
+	}
+	cn.pending = nil
+	closed := c.closed
+	c.mu.Unlock()
+	cn.nc.Close()
+	if closed {
+		err = ErrClosed
+	}
+	for _, f := range pending {
+		f.resolve("", fmt.Errorf("connection to %s: %w", c.addr, err))
+	}
+}
+
+// parseReply turns an error reply into an *Error.
+func parseReply(line string) (string, error) {
+	if code, text, ok := protocol.ParseError(line); ok {
+		return "", &Error{Code: code, Text: text}
+	}
+	return line, nil
+}
+
+// commandLine renders args as a protocol line.
+func commandLine(args []string) (string, error) {
+	line, err := protocol.Format(args...)
+	switch {
+	case errors.Is(err, protocol.ErrEmpty):
+		return "", errors.New("no command")
+	case err != nil:
+		return "", fmt.Errorf("%w, use Batch for such values", err)
+	}
+	switch strings.ToUpper(args[0]) {
+	case "MONITOR", "PROTOCOL", "HELLO":
+		return "", fmt.Errorf("%s changes the connection and can't be sent through the client", args[0])
+	}
+	return line, nil
+}
+
+// Future is the result of a call that was sent without waiting for it.
+type Future struct {
+	done  chan struct{}
+	lines int // the reply is a line count and lines, see multiLine
+	reply string
+	err   error
+}
+
+func newFuture(args []string) *Future {
+	f := &Future{done: make(chan struct{})}
+	if isMulti, ok := multiLine[strings.ToUpper(args[0])]; ok && isMulti(args) {
+		f.lines = 1
+	}
+	return f
+}
+
+func failedFuture(err error) *Future {
+	f := &Future{done: make(chan struct{})}
+	f.resolve("", err)
+	return f
+}
+
+func (f *Future) resolve(reply string, err error) {
+	f.reply, f.err = reply, err
+	close(f.done)
+}
+
+// Done is closed once the reply is in.
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Wait returns the reply, waiting for it until ctx ends. Giving up doesn't
+// cancel the command, which the server may still apply.
+func (f *Future) Wait(ctx context.Context) (string, error) {
+	select {
+	case <-f.done:
+		return f.reply, f.err
+	case <-ctx.Done():
+		return "", context.Cause(ctx)
+	}
+}
+
+// send writes the commands as one write and returns their futures, in order.
+func (c *Client) send(ctx context.Context, cmds [][]string) []*Future {
+	futures := make([]*Future, len(cmds))
+	lines := make([]string, len(cmds))
+	for i, args := range cmds {
+		line, err := commandLine(args)
+		if err != nil {
+			for j := range futures {
+				futures[j] = failedFuture(err)
+			}
+			return futures
+		}
+		lines[i] = line
+		futures[i] = newFuture(args)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	err := context.Cause(ctx)
+	var cn *conn
+	if err == nil {
+		if cn, err = c.connect(ctx); err != nil && !errors.Is(err, ErrClosed) {
+			err = &notSent{err}
+		}
+	}
+	if err != nil {
+		for i := range futures {
+			futures[i] = failedFuture(err)
+		}
+		return futures
+	}
+	for _, line := range lines {
+		cn.w.WriteString(line)
+		cn.w.WriteByte('\n')
+	}
+	cn.pending = append(cn.pending, futures...)
+	if deadline, ok := ctx.Deadline(); ok {
+		cn.nc.SetWriteDeadline(deadline) // a node that stopped reading doesn't hold us past it
+		defer cn.nc.SetWriteDeadline(time.Time{})
+	}
+	if err := cn.w.Flush(); err != nil {
+		cn.nc.Close() // readReplies fails the pending calls, these with them
+	}
+	return futures
+}
+
+// DoAsync sends a command and returns without waiting for its reply. It
+// isn't retried, and isn't sent at all if ctx has already ended.
+func (c *Client) DoAsync(ctx context.Context, args ...string) *Future {
+	return c.send(ctx, [][]string{args})[0]
+}
+
+// Do sends a command, e.g. Do(ctx, "SETNX", "k", "v"), and returns its
+// reply. Error replies are returned as *Error. Commands that reply with
+// several lines (INFO, CLIENT LIST, SLOWLOG GET, HOTKEYS, TXN, HISTORY)
+// return them joined by newlines.
+//
+// A failed call is sent again as Options.Retry says. When ctx ends first
+// Do returns its cause, but a command already sent can't be called back:
+// the server may still apply it.
+func (c *Client) Do(ctx context.Context, args ...string) (string, error) {
+	ctx, cancel := c.opts.callContext(ctx)
+	defer cancel()
+	read := len(args) > 0 && readCommands[strings.ToUpper(args[0])]
+	for attempt := 1; ; attempt++ {
+		reply, err := c.DoAsync(ctx, args...).Wait(ctx)
+		if err == nil || !c.opts.Retry.retry(ctx, attempt, err, read) {
+			return reply, err
+		}
+	}
+}
+
+// Get returns the value of key, and false if it doesn't exist.
+func (c *Client) Get(ctx context.Context, key string) (string, bool, error) {
+	reply, err := c.Do(ctx, "GET", key)
+	if err != nil || reply == "(nil)" {
+		return "", false, err
+	}
+	return reply, true, nil
+}
+
+// Set writes value to key.
+func (c *Client) Set(ctx context.Context, key, value string) error {
+	_, err := c.Do(ctx, "SET", key, value)
+	return err
+}
+
+// Delete removes key, reporting whether it existed.
+func (c *Client) Delete(ctx context.Context, key string) (bool, error) {
+	reply, err := c.Do(ctx, "GETDEL", key)
+	return err == nil && reply != "(nil)", err
+}
+
+// Eval runs script on the leader with KEYS and ARGV set to keys and args,
+// and returns what it returned. The script is sent on one line, so it
+// can't contain line breaks, and keys and args can't hold whitespace. A
+// script that fails returns an *Error with CodeScript, and nothing it
+// wrote is kept.
+func (c *Client) Eval(ctx context.Context, script string, keys []string, args ...string) (string, error) {
+	cmd := append([]string{"EVAL", strconv.Itoa(len(keys))}, keys...)
+	cmd = append(cmd, strconv.Itoa(len(args)))
+	cmd = append(cmd, args...)
+	return c.Do(ctx, append(cmd, script)...)
+}
+
+// Acquire takes the lock on key for owner until ttl runs out, and returns
+// its fencing token, which grows with every new holder. It fails with
+// CodeLocked while another owner holds the lock; acquiring a lock owner
+// holds extends it and keeps the token.
+func (c *Client) Acquire(ctx context.Context, key, owner string, ttl time.Duration) (int, error) {
+	reply, err := c.Do(ctx, "ACQUIRE", key, owner, ttl.String())
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(reply)
+}
+
+// Release gives up owner's lock on key, and reports whether owner held it.
+func (c *Client) Release(ctx context.Context, key, owner string) (bool, error) {
+	reply, err := c.Do(ctx, "RELEASE", key, owner)
+	return err == nil && reply == "1", err
+}
+
+// Close closes the connection; calls still waiting fail with ErrClosed.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	cn := c.conn
+	c.mu.Unlock()
+	if cn != nil {
+		return cn.nc.Close()
+	}
+	return nil
+}
@@ -0,0 +1,417 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeNode answers the protocol the way a node does, from a map.
+type fakeNode struct {
+	ln       net.Listener
+	mu       sync.Mutex
+	data     map[string]string
+	follower bool // refuses writes with NOTLEADER
+	limited  int  // refuses the next commands with RATELIMIT
+	stalled  bool // holds every reply until it isn't
+}
+
+func newFakeNode(t *testing.T) *fakeNode {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &fakeNode{ln: ln, data: map[string]string{}}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go n.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return n
+}
+
+func (n *fakeNode) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewScanner(conn)
+	for r.Scan() {
+		parts := strings.Fields(r.Text())
+		n.mu.Lock()
+		for n.stalled {
+			n.mu.Unlock()
+			time.Sleep(time.Millisecond)
+			n.mu.Lock()
+		}
+		if n.limited > 0 && parts[0] != "PROTOCOL" {
+			n.limited--
+			fmt.Fprintln(conn, "ERR_RATELIMIT over the write rate")
+			n.mu.Unlock()
+			continue
+		}
+		switch parts[0] {
+		case "PROTOCOL":
+			fmt.Fprintln(conn, "PROTOCOL 2")
+		case "PING":
+			fmt.Fprintln(conn, "PONG")
+		case "SET":
+			if n.follower {
+				fmt.Fprintln(conn, "ERR_NOTLEADER not the leader")
+				break
+			}
+			n.data[parts[1]] = strings.Join(parts[2:], " ")
+			fmt.Fprintln(conn, "OK")
+		case "GET":
+			if v, ok := n.data[parts[1]]; ok {
+				fmt.Fprintln(conn, v)
+			} else {
+				fmt.Fprintln(conn, "(nil)")
+			}
+		case "SLEEP": // replies late, to show replies are matched in order
+			time.Sleep(50 * time.Millisecond)
+			fmt.Fprintln(conn, "AWAKE")
+		case "INFO":
+			fmt.Fprintf(conn, "2\n# Keyspace\nkeys:%d\n", len(n.data))
+		case "QUIT":
+			n.mu.Unlock()
+			return
+		default:
+			fmt.Fprintf(conn, "ERR_UNKNOWNCMD unknown command %s\n", parts[0])
+		}
+		n.mu.Unlock()
+	}
+}
+
+func TestClientPipelining(t *testing.T) {
+	node := newFakeNode(t)
+	ctx := context.Background()
+	c, err := Dial(ctx, node.ln.Addr().String(), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Set(ctx, "k", "v 1"); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok, err := c.Get(ctx, "k"); err != nil || !ok || v != "v 1" {
+		t.Fatalf("expected v 1, got %q %v %v", v, ok, err)
+	}
+	if _, ok, _ := c.Get(ctx, "missing"); ok {
+		t.Error("expected a missing key to be reported missing")
+	}
+	if _, err := c.Do(ctx, "NOPE"); !IsCode(err, CodeUnknown) {
+		t.Errorf("expected an UNKNOWNCMD error, got %v", err)
+	}
+
+	slow := c.DoAsync(ctx, "SLEEP")
+	fast := c.DoAsync(ctx, "GET", "k")
+	if v, _ := fast.Wait(ctx); v != "v 1" {
+		t.Errorf("expected the second reply to go to the second call, got %q", v)
+	}
+	if v, _ := slow.Wait(ctx); v != "AWAKE" {
+		t.Errorf("expected the first reply to go to the first call, got %q", v)
+	}
+
+	results, err := c.Pipeline().Set("a", "1").Do("INFO").Get("a").Do("NOPE").Exec(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[1].Reply != "# Keyspace\nkeys:2" || results[2].Reply != "1" || !IsCode(results[3].Err, CodeUnknown) {
+		t.Errorf("unexpected pipeline results %+v", results)
+	}
+
+	if _, err := c.Do(ctx, "SET", "k", "two\nlines"); err == nil {
+		t.Error("expected a value with a line break to be refused")
+	}
+	c.Do(ctx, "QUIT") // the node hangs up, the next call dials again
+	if v, _, err := c.Get(ctx, "a"); err != nil || v != "1" {
+		t.Errorf("expected to reconnect, got %q %v", v, err)
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	node := newFakeNode(t)
+	ctx := context.Background()
+	c, err := Dial(ctx, node.ln.Addr().String(), Options{
+		Timeout: 20 * time.Millisecond,
+		Retry:   RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond, On: RetryRefused},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	node.mu.Lock()
+	node.limited = 2
+	node.mu.Unlock()
+	if err := c.Set(ctx, "k", "v"); err != nil {
+		t.Errorf("expected the third try to go through, got %v", err)
+	}
+	node.mu.Lock()
+	node.limited = 3
+	node.mu.Unlock()
+	if err := c.Set(ctx, "k", "v"); !IsCode(err, CodeRateLimit) {
+		t.Errorf("expected RATELIMIT after three tries, got %v", err)
+	}
+
+	if _, err := c.Do(ctx, "SLEEP"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the call timeout to end a slow call, got %v", err)
+	}
+	done, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := c.Do(done, "SET", "k", "late"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected a cancelled call to fail, got %v", err)
+	}
+	time.Sleep(60 * time.Millisecond) // the SLEEP reply comes in and is dropped
+	if v, _, err := c.Get(ctx, "k"); err != nil || v != "v" {
+		t.Errorf("expected the cancelled write unsent, got %q %v", v, err)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	var got []int
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Ops    []BatchOp `json:"ops"`
+			Atomic bool      `json:"atomic"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Atomic {
+			http.Error(w, `namespace "t" is over its key quota (max=1, used=1)`, http.StatusInsufficientStorage)
+			return
+		}
+		if req.Ops[0].Key == "full" {
+			http.Error(w, "disk nearly full: 1.0 MiB free in . is under the 256.0 MiB minimum, writes resume once space frees up", http.StatusInsufficientStorage)
+			return
+		}
+		got = append(got, len(req.Ops))
+		res := BatchResponse{Revision: len(got)}
+		for _, op := range req.Ops {
+			res.Results = append(res.Results, BatchResult{Op: op.Op, Key: op.Key, OK: true, Revision: len(got)})
+		}
+		json.NewEncoder(w).Encode(res)
+	}))
+	defer api.Close()
+	node := newFakeNode(t)
+	c, err := Dial(context.Background(), node.ln.Addr().String(), Options{HTTPAddr: strings.TrimPrefix(api.URL, "http://")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	b := c.Batch()
+	for i := 0; i < MaxBatchOps+1; i++ {
+		b.Put(fmt.Sprint("t:", i), "v")
+	}
+	res, err := b.Exec(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || len(res.Results) != MaxBatchOps+1 || res.Revision != 2 {
+		t.Errorf("expected the batch split in two, got requests %v and %d results at %d", got, len(res.Results), res.Revision)
+	}
+	if _, err := c.Batch().Put("t:x", "v").Atomic().Exec(context.Background()); !IsCode(err, CodeQuota) {
+		t.Errorf("expected a QUOTA error, got %v", err)
+	}
+	if _, err := c.Batch().Put("full", "v").Exec(context.Background()); !IsCode(err, CodeReadOnly) {
+		t.Errorf("expected a READONLY error, got %v", err)
+	}
+}
+
+// newFakeCluster starts n fake nodes, the first one leading, each with a
+// /cluster endpoint on its TCP port + 1000. setLeader hands the lead to
+// another node.
+func newFakeCluster(t *testing.T, n int) (nodes []*fakeNode, setLeader func(i int)) {
+	leader := 0
+	var mu sync.Mutex
+	for len(nodes) < n {
+		node := newFakeNode(t)
+		_, port, _ := net.SplitHostPort(node.ln.Addr().String())
+		p, _ := strconv.Atoi(port)
+		hl, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(p+1000)))
+		if err != nil {
+			continue // taken, try another port
+		}
+		node.follower = len(nodes) != 0
+		id := ":" + port
+		srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			st := map[string]any{"id": id, "leader": ":" + portOf(nodes[leader])}
+			var peers []map[string]string
+			for _, other := range nodes {
+				if portOf(other) != port {
+					peers = append(peers, map[string]string{"peer": ":" + portOf(other)})
+				}
+			}
+			st["peers"] = peers
+			json.NewEncoder(w).Encode(st)
+		})}
+		go srv.Serve(hl)
+		t.Cleanup(func() { srv.Close() })
+		nodes = append(nodes, node)
+	}
+	return nodes, func(i int) {
+		mu.Lock()
+		defer mu.Unlock()
+		for j, n := range nodes {
+			n.mu.Lock()
+			n.follower = j != i
+			n.mu.Unlock()
+		}
+		leader = i
+	}
+}
+
+func portOf(n *fakeNode) string {
+	_, port, _ := net.SplitHostPort(n.ln.Addr().String())
+	return port
+}
+
+func TestClusterRouting(t *testing.T) {
+	nodes, setLeader := newFakeCluster(t, 3)
+	ctx := context.Background()
+	c, err := NewCluster(ctx, []string{nodes[2].ln.Addr().String()}, ClusterOptions{ReadPreference: ReadFollower})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if topo := c.Topology(); topo.Leader != nodes[0].ln.Addr().String() || len(topo.Nodes) != 3 {
+		t.Fatalf("expected node 0 to lead 3 nodes, got %+v", topo)
+	}
+
+	if err := c.Set(ctx, "k", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if nodes[0].data["k"] != "v" {
+		t.Error("expected the write at the leader")
+	}
+	for _, n := range nodes[1:] {
+		n.mu.Lock()
+		n.data["k"] = "from follower"
+		n.mu.Unlock()
+	}
+	for range 4 {
+		if v, _, err := c.Get(ctx, "k"); err != nil || v != "from follower" {
+			t.Errorf("expected reads at the followers, got %q %v", v, err)
+		}
+	}
+
+	// Node 0 steps down without the client hearing: the NOTLEADER it
+	// answers with sends the write on to the new leader.
+	c.mu.Lock()
+	c.topo.Fetched = time.Now() // so it isn't refreshed for being old
+	c.mu.Unlock()
+	setLeader(1)
+	if err := c.Set(ctx, "k2", "v2"); err != nil {
+		t.Fatal(err)
+	}
+	if nodes[1].data["k2"] != "v2" || c.Topology().Leader != nodes[1].ln.Addr().String() {
+		t.Errorf("expected the write at the new leader, topology %+v", c.Topology())
+	}
+}
+
+func TestWatchResumes(t *testing.T) {
+	var mu sync.Mutex
+	var asked []string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		from := r.URL.Query().Get("fromRevision")
+		asked = append(asked, from)
+		calls := len(asked)
+		mu.Unlock()
+		switch {
+		case calls == 2: // the node goes away mid-poll
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+		case from == "":
+			json.NewEncoder(w).Encode(watchResponse{Events: []Event{{Revision: 5, Op: "SET", Key: "p:a"}}, NextRevision: 6})
+		case from == "6":
+			json.NewEncoder(w).Encode(watchResponse{Events: []Event{{Revision: 6, Op: "DEL", Key: "p:a"}}, NextRevision: 7})
+		default:
+			http.Error(w, "compacted", http.StatusGone)
+		}
+	}))
+	defer api.Close()
+	node := newFakeNode(t)
+	c, err := Dial(context.Background(), node.ln.Addr().String(), Options{HTTPAddr: strings.TrimPrefix(api.URL, "http://")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var got []Event
+	for e := range c.Watch(ctx, "p:", -1) {
+		got = append(got, e)
+	}
+	if len(got) != 3 || got[0].Revision != 5 || got[1].Revision != 6 || !errors.Is(got[2].Err, ErrCompacted) {
+		t.Fatalf("expected revisions 5 and 6 then ErrCompacted, got %+v", got)
+	}
+	if asked[2] != "6" {
+		t.Errorf("expected the watch to resume from 6, asked for %q", asked)
+	}
+}
+
+func TestClusterHealth(t *testing.T) {
+	nodes, _ := newFakeCluster(t, 3)
+	ctx := context.Background()
+	c, err := NewCluster(ctx, []string{nodes[0].ln.Addr().String()}, ClusterOptions{ReadPreference: ReadFollower, HealthInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for _, n := range nodes {
+		n.data["k"] = "v"
+	}
+	waitFor := func(what string, ok func([]NodeStatus) bool) {
+		t.Helper()
+		for deadline := time.Now().Add(2 * time.Second); !ok(c.Status()); time.Sleep(5 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %s, status %+v", what, c.Status())
+			}
+		}
+	}
+	waitFor("every node checked and healthy", func(st []NodeStatus) bool {
+		for _, s := range st {
+			if !s.Healthy || s.Checked.IsZero() {
+				return false
+			}
+		}
+		return len(st) == 3 && st[0].Leader
+	})
+
+	// A follower stops answering: the reads waiting on it go to the other
+	// one once it is ejected.
+	nodes[1].mu.Lock()
+	nodes[1].stalled = true
+	nodes[1].mu.Unlock()
+	for range 4 {
+		if v, _, err := c.Get(ctx, "k"); err != nil || v != "v" {
+			t.Errorf("expected the read to fail over, got %q %v", v, err)
+		}
+	}
+	if st := c.Status(); st[1].Healthy || st[1].LastError == "" {
+		t.Errorf("expected node 1 ejected, status %+v", st)
+	}
+
+	nodes[1].mu.Lock()
+	nodes[1].stalled = false
+	nodes[1].mu.Unlock()
+	waitFor("node 1 back", func(st []NodeStatus) bool { return st[1].Healthy })
+}
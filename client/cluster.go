@@ -0,0 +1,439 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Cluster routes commands across the nodes of a cluster. It learns the
+// topology, which nodes there are and which one leads, from the /cluster
+// endpoint of any node it can reach, and caches it: writes go to the leader,
+// reads to the node the ReadPreference picks. A NOTLEADER reply or a broken
+// connection means the cache is out of date, so it is fetched again and the
+// command goes to the node it now names, if the RetryPolicy sends it again.
+// By default writes are only sent again after NOTLEADER, which the server
+// gives before applying anything.
+
+// ReadPreference says which nodes a Cluster reads from.
+type ReadPreference int
+
+const (
+	// ReadLeader reads at the leader, which has every acked write.
+	ReadLeader ReadPreference = iota
+	// ReadFollower spreads reads over the followers, falling back to the
+	// leader when none is up. A follower may not have applied the latest
+	// writes yet.
+	ReadFollower
+	// ReadAny spreads reads over every node.
+	ReadAny
+)
+
+// DefaultRefreshInterval is how old a cached topology gets before the next
+// command fetches it again.
+const DefaultRefreshInterval = 30 * time.Second
+
+// ClusterOptions configure a Cluster. Options.HTTPAddr is ignored, the HTTP
+// port of each node is its TCP port + 1000.
+type ClusterOptions struct {
+	Options
+	ReadPreference  ReadPreference
+	RefreshInterval time.Duration // 0 for DefaultRefreshInterval
+	HealthInterval  time.Duration // 0 for DefaultHealthInterval, < 0 to not PING at all
+	EjectAfter      int           // 0 for DefaultEjectAfter
+}
+
+// Topology is what a Cluster knows about the nodes, by TCP address.
+type Topology struct {
+	Leader  string    `json:"leader"` // "" while none is known
+	Nodes   []string  `json:"nodes"`
+	Fetched time.Time `json:"fetched"`
+}
+
+// clusterStatus is the part of /cluster a Cluster reads.
+type clusterStatus struct {
+	ID     string `json:"id"`
+	Leader string `json:"leader"`
+	Peers  []struct {
+		Peer string `json:"peer"`
+	} `json:"peers"`
+}
+
+// readCommands are routed by the ReadPreference, every other command goes
+// to the leader.
+var readCommands = map[string]bool{
+	"GET": true, "STRLEN": true, "GETBIT": true, "BITCOUNT": true, "STAT": true,
+}
+
+type Cluster struct {
+	seeds []string
+	opts  ClusterOptions
+	http  *http.Client
+
+	mu        sync.Mutex
+	topo      Topology
+	clients   map[string]*Client
+	witnesses map[string]bool // nodes that answered WITNESS, they hold no data
+	next      int             // round robin over the nodes reads may go to
+	refused   string          // the node that last answered NOTLEADER, until a refresh names another leader
+	health    map[string]*nodeHealth
+	stop      chan struct{} // closed by Close, ends checkHealth
+	closed    bool
+}
+
+// NewCluster fetches the topology from the first of seeds (TCP addresses of
+// any nodes) that answers.
+func NewCluster(ctx context.Context, seeds []string, opts ClusterOptions) (*Cluster, error) {
+	if len(seeds) == 0 {
+		return nil, errors.New("no seed nodes")
+	}
+	if opts.DialTimeout <= 0 {
+		opts.DialTimeout = DefaultDialTimeout
+	}
+	if opts.RefreshInterval <= 0 {
+		opts.RefreshInterval = DefaultRefreshInterval
+	}
+	if opts.HealthInterval == 0 {
+		opts.HealthInterval = DefaultHealthInterval
+	}
+	if opts.EjectAfter <= 0 {
+		opts.EjectAfter = DefaultEjectAfter
+	}
+	opts.HTTPAddr = ""
+	opts.Retry = opts.Retry.orDefault()
+	c := &Cluster{
+		seeds: seeds, opts: opts, http: newHTTPClient(opts.Options),
+		clients: map[string]*Client{}, witnesses: map[string]bool{}, health: map[string]*nodeHealth{}, stop: make(chan struct{}),
+	}
+	if err := c.Refresh(ctx); err != nil {
+		return nil, err
+	}
+	if opts.HealthInterval > 0 {
+		go c.checkHealth()
+	}
+	return c, nil
+}
+
+// Topology returns the cached topology.
+func (c *Cluster) Topology() Topology {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := c.topo
+	t.Nodes = append([]string(nil), t.Nodes...)
+	return t
+}
+
+// Refresh fetches the topology again, asking the nodes it knows, leader
+// first, and then the seeds, until one names a leader. A node that refused
+// a write as not the leader isn't believed when it names itself: paused or
+// cut off, it may not have heard of the election that replaced it.
+func (c *Cluster) Refresh(ctx context.Context) error {
+	c.mu.Lock()
+	refused := c.refused
+	candidates := []string{}
+	if c.topo.Leader != "" {
+		candidates = append(candidates, c.topo.Leader)
+	}
+	candidates = append(candidates, c.topo.Nodes...)
+	candidates = append(candidates, c.seeds...)
+	c.mu.Unlock()
+
+	var errs []error
+	var fallback *Topology // an answer without a leader, better than none
+	seen := map[string]bool{}
+	for _, addr := range candidates {
+		if seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		topo, err := c.fetch(ctx, addr)
+		if err != nil {
+			errs = append(errs, err)
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		if topo.Leader == refused {
+			topo.Leader = ""
+		}
+		if topo.Leader == "" {
+			if fallback == nil {
+				fallback = &topo
+			}
+			continue
+		}
+		c.mu.Lock()
+		c.topo, c.refused = topo, ""
+		c.mu.Unlock()
+		return nil
+	}
+	if fallback != nil {
+		c.mu.Lock()
+		c.topo = *fallback
+		c.mu.Unlock()
+		return nil
+	}
+	return fmt.Errorf("fetching the cluster topology: %w", errors.Join(errs...))
+}
+
+// fetch reads /cluster from the node at addr.
+func (c *Cluster) fetch(ctx context.Context, addr string) (Topology, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.opts.DialTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, httpBase(addr, c.opts.Options)+"/cluster", nil)
+	if err != nil {
+		return Topology{}, err
+	}
+	if c.opts.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.opts.Token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return Topology{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Topology{}, fmt.Errorf("%s: /cluster: %s", addr, resp.Status)
+	}
+	var st clusterStatus
+	if err := json.NewDecoder(resp.Body).Decode(&st); err != nil {
+		return Topology{}, fmt.Errorf("%s: /cluster: %w", addr, err)
+	}
+	topo := Topology{Nodes: []string{addr}, Fetched: time.Now()}
+	for _, p := range st.Peers {
+		if peer := resolveAddr(p.Peer, addr); peer != addr {
+			topo.Nodes = append(topo.Nodes, peer)
+		}
+	}
+	if st.Leader != "" {
+		topo.Leader = resolveAddr(st.Leader, addr)
+		if st.Leader == st.ID {
+			topo.Leader = addr // we know this node by the address we reached it at
+		}
+	}
+	return topo, nil
+}
+
+// resolveAddr fills in the host of a node address like ":8081", which
+// clusters started on one machine use, with the one via was reached at.
+func resolveAddr(node, via string) string {
+	host, port, err := net.SplitHostPort(node)
+	if err != nil || host != "" {
+		return node
+	}
+	if h, _, err := net.SplitHostPort(via); err == nil {
+		return net.JoinHostPort(h, port)
+	}
+	return node
+}
+
+// client returns the connection to addr, dialing it if needed.
+func (c *Cluster) client(ctx context.Context, addr string) (*Client, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, ErrClosed
+	}
+	if cl, ok := c.clients[addr]; ok {
+		c.mu.Unlock()
+		return cl, nil
+	}
+	c.mu.Unlock()
+	cl, err := Dial(ctx, addr, c.opts.Options)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if existing, ok := c.clients[addr]; ok || c.closed {
+		cl.Close() // lost a race with another dial, or with Close
+		if c.closed {
+			return nil, ErrClosed
+		}
+		return existing, nil
+	}
+	c.clients[addr] = cl
+	return cl, nil
+}
+
+// route picks the node a command goes to, fetching the topology first if
+// the cache is stale or names no leader. Reads skip ejected nodes, and the
+// nodes in skip, while others are left.
+func (c *Cluster) route(ctx context.Context, read bool, skip map[string]bool) (string, error) {
+	c.mu.Lock()
+	stale := time.Since(c.topo.Fetched) > c.opts.RefreshInterval || c.topo.Leader == ""
+	c.mu.Unlock()
+	if stale {
+		if err := c.Refresh(ctx); err != nil {
+			return "", err
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if read && c.opts.ReadPreference != ReadLeader {
+		var nodes, ejected []string
+		for _, n := range c.topo.Nodes {
+			if c.witnesses[n] || skip[n] || (c.opts.ReadPreference == ReadFollower && n == c.topo.Leader) {
+				continue
+			}
+			if c.healthy(n) {
+				nodes = append(nodes, n)
+			} else {
+				ejected = append(ejected, n)
+			}
+		}
+		if len(nodes) == 0 && (c.topo.Leader == "" || skip[c.topo.Leader] || !c.healthy(c.topo.Leader)) {
+			nodes = ejected // they may be back by now
+		}
+		if len(nodes) > 0 {
+			c.next++
+			return nodes[c.next%len(nodes)], nil
+		}
+	}
+	if read && skip[c.topo.Leader] {
+		return "", errors.New("every node failed this read")
+	}
+	if c.topo.Leader == "" {
+		return "", &Error{Code: CodeNotLeader, Text: "no leader known, the cluster may be electing one"}
+	}
+	return c.topo.Leader, nil
+}
+
+// forget drops the cached leader, so the next command fetches the topology.
+func (c *Cluster) forget(addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.topo.Leader == addr {
+		c.topo.Leader = ""
+	}
+	c.topo.Fetched = time.Time{}
+}
+
+// Do sends a command to the node it is routed to; see Client.Do. A
+// NOTLEADER reply or a node that can't be reached sends it through a fresh
+// topology on the next try, as ClusterOptions.Retry allows.
+func (c *Cluster) Do(ctx context.Context, args ...string) (string, error) {
+	if len(args) == 0 {
+		return "", errors.New("no command")
+	}
+	ctx, cancel := c.opts.callContext(ctx)
+	defer cancel()
+	read := readCommands[strings.ToUpper(args[0])]
+	for attempt := 1; ; attempt++ {
+		reply, err := c.do(ctx, read, args)
+		if err == nil || !c.opts.Retry.retry(ctx, attempt, err, read) {
+			return reply, err
+		}
+	}
+}
+
+// do is one try of Do. A read whose node breaks under it, or is ejected
+// while it waits, goes on to the next node right away.
+func (c *Cluster) do(ctx context.Context, read bool, args []string) (string, error) {
+	skip := map[string]bool{}
+	var last error // of the node a read left
+	for {
+		addr, err := c.route(ctx, read, skip)
+		if err != nil && last != nil {
+			return "", last
+		}
+		if err != nil {
+			if !errors.As(err, new(*Error)) && !errors.As(err, new(*notSent)) {
+				err = &notSent{err}
+			}
+			return "", err
+		}
+		cl, err := c.client(ctx, addr)
+		if err != nil {
+			if errors.Is(err, ErrClosed) {
+				return "", err
+			}
+			c.markDown(addr, err, true) // down, or not a node anymore
+			err = &notSent{err}
+			if read {
+				skip[addr], last = true, err
+				continue
+			}
+			return "", err
+		}
+		reply, err := c.wait(ctx, addr, cl.DoAsync(ctx, args...), read)
+		var reject *Error
+		switch {
+		case ctx.Err() != nil, errors.Is(err, ErrClosed):
+		case IsCode(err, CodeNotLeader):
+			c.forget(addr)
+			c.mu.Lock()
+			c.refused = addr
+			c.mu.Unlock()
+		case IsCode(err, CodeWitness):
+			c.mu.Lock()
+			c.witnesses[addr] = true
+			c.mu.Unlock()
+		case err != nil && !errors.As(err, &reject):
+			if !errors.Is(err, ErrUnhealthy) {
+				c.markDown(addr, err, true) // the topology is fetched again if it led
+			}
+			if read {
+				skip[addr], last = true, err
+				continue
+			}
+		}
+		return reply, err
+	}
+}
+
+// Leader returns the connection to the leader, for pipelines and batches.
+func (c *Cluster) Leader(ctx context.Context) (*Client, error) {
+	addr, err := c.route(ctx, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	cl, err := c.client(ctx, addr)
+	if err != nil {
+		c.forget(addr)
+	}
+	return cl, err
+}
+
+// Get returns the value of key from the node the ReadPreference picks.
+func (c *Cluster) Get(ctx context.Context, key string) (string, bool, error) {
+	reply, err := c.Do(ctx, "GET", key)
+	if err != nil || reply == "(nil)" {
+		return "", false, err
+	}
+	return reply, true, nil
+}
+
+func (c *Cluster) Set(ctx context.Context, key, value string) error {
+	_, err := c.Do(ctx, "SET", key, value)
+	return err
+}
+
+func (c *Cluster) Delete(ctx context.Context, key string) (bool, error) {
+	reply, err := c.Do(ctx, "GETDEL", key)
+	return err == nil && reply != "(nil)", err
+}
+
+// Close closes every connection.
+func (c *Cluster) Close() error {
+	c.mu.Lock()
+	if !c.closed {
+		close(c.stop)
+	}
+	c.closed = true
+	clients := c.clients
+	c.clients = map[string]*Client{}
+	c.mu.Unlock()
+	for _, cl := range clients {
+		cl.Close()
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// A Cluster PINGs every node in the background. A node that fails
+// EjectAfter PINGs in a row, or whose connection breaks under a call, is
+// ejected: reads stop going to it, and reads waiting on it give up and go
+// to another node, until a PING gets through again. Writes still go to the
+// leader, ejected or not, but ejecting it has the topology fetched again.
+
+// DefaultHealthInterval is how often a Cluster PINGs each node.
+const DefaultHealthInterval = time.Second
+
+// DefaultEjectAfter is how many PINGs in a row a node fails before it is
+// ejected.
+const DefaultEjectAfter = 2
+
+// ErrUnhealthy fails a read whose node was ejected while it waited.
+var ErrUnhealthy = errors.New("node failed its health checks")
+
+// NodeStatus is what a Cluster knows about one node.
+type NodeStatus struct {
+	Addr      string        `json:"addr"`
+	Leader    bool          `json:"leader"`
+	Witness   bool          `json:"witness,omitempty"`
+	Healthy   bool          `json:"healthy"`
+	Latency   time.Duration `json:"latency"`  // round trip of the last PING that got through
+	Failures  int           `json:"failures"` // failed PINGs in a row
+	LastError string        `json:"lastError,omitempty"`
+	Checked   time.Time     `json:"checked"` // zero until the first PING
+}
+
+// nodeHealth is the health of one node. Guarded by Cluster.mu.
+type nodeHealth struct {
+	NodeStatus
+	checking bool          // a PING is out
+	ejected  chan struct{} // closed when the node is ejected, made anew when it is back
+}
+
+// healthOf returns the health of addr, healthy until shown otherwise.
+// Callers hold c.mu.
+func (c *Cluster) healthOf(addr string) *nodeHealth {
+	h, ok := c.health[addr]
+	if !ok {
+		h = &nodeHealth{NodeStatus: NodeStatus{Addr: addr, Healthy: true}, ejected: make(chan struct{})}
+		c.health[addr] = h
+	}
+	return h
+}
+
+// healthy reports whether reads may go to addr. Callers hold c.mu.
+func (c *Cluster) healthy(addr string) bool {
+	h, ok := c.health[addr]
+	return !ok || h.Healthy
+}
+
+// markDown records a failed PING or call; eject takes the node out at
+// once rather than after EjectAfter of them.
+func (c *Cluster) markDown(addr string, err error, eject bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h := c.healthOf(addr)
+	h.Failures++
+	h.LastError = err.Error()
+	if h.Healthy && (eject || h.Failures >= c.opts.EjectAfter) {
+		h.Healthy = false
+		close(h.ejected)
+	}
+	if !h.Healthy && c.topo.Leader == addr {
+		c.topo.Fetched = time.Time{} // find out whether it still leads
+	}
+}
+
+func (c *Cluster) markUp(addr string, latency time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h := c.healthOf(addr)
+	h.Failures, h.LastError, h.Latency = 0, "", latency
+	if !h.Healthy {
+		h.Healthy = true
+		h.ejected = make(chan struct{})
+	}
+}
+
+// checkHealth PINGs every node each HealthInterval until Close.
+func (c *Cluster) checkHealth() {
+	t := time.NewTicker(c.opts.HealthInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-c.stop:
+			return
+		}
+		c.mu.Lock()
+		var due []string
+		for _, addr := range c.topo.Nodes {
+			if h := c.healthOf(addr); !h.checking {
+				h.checking = true
+				due = append(due, addr)
+			}
+		}
+		c.mu.Unlock()
+		for _, addr := range due {
+			go c.ping(addr)
+		}
+	}
+}
+
+// ping PINGs addr once, giving it one HealthInterval to answer.
+func (c *Cluster) ping(addr string) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.opts.HealthInterval)
+	defer cancel()
+	start := time.Now()
+	cl, err := c.client(ctx, addr)
+	if err == nil {
+		_, err = cl.DoAsync(ctx, "PING").Wait(ctx)
+	}
+	if errors.Is(err, ErrClosed) {
+		return
+	}
+	if err != nil {
+		c.markDown(addr, err, false)
+	} else {
+		c.markUp(addr, time.Since(start))
+	}
+	c.mu.Lock()
+	h := c.healthOf(addr)
+	h.checking, h.Checked = false, time.Now()
+	c.mu.Unlock()
+}
+
+// wait waits for the reply to a call to addr. A read whose node is ejected
+// meanwhile stops waiting: another node can answer it.
+func (c *Cluster) wait(ctx context.Context, addr string, f *Future, read bool) (string, error) {
+	if !read {
+		return f.Wait(ctx)
+	}
+	c.mu.Lock()
+	ejected := c.healthOf(addr).ejected
+	c.mu.Unlock()
+	select {
+	case <-f.Done():
+		return f.reply, f.err
+	case <-ejected:
+		return "", fmt.Errorf("%s: %w", addr, ErrUnhealthy)
+	case <-ctx.Done():
+		return "", context.Cause(ctx)
+	}
+}
+
+// Status returns the health of every node, in topology order.
+func (c *Cluster) Status() []NodeStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	status := make([]NodeStatus, 0, len(c.topo.Nodes))
+	for _, addr := range c.topo.Nodes {
+		st := c.healthOf(addr).NodeStatus
+		st.Leader = addr == c.topo.Leader
+		st.Witness = c.witnesses[addr]
+		status = append(status, st)
+	}
+	return status
+}
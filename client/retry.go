@@ -0,0 +1,133 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"time"
+)
+
+// A call that fails may be sent again, after a backoff, if its RetryPolicy
+// retries that class of failure. What is safe to retry depends on whether
+// the command could have been applied: a refusal says it wasn't, while a
+// broken connection or a TIMEOUT leave it open, and sending a write again
+// then could apply it twice. Reads, and batches with an idempotency key,
+// are safe either way.
+
+// RetryClass is a kind of failure; a RetryPolicy retries the classes it is
+// given.
+type RetryClass int
+
+const (
+	// RetryRefused is a command that wasn't applied: it was refused with
+	// NOTLEADER, WITNESS or RATELIMIT, or never sent because no node
+	// could be reached.
+	RetryRefused RetryClass = 1 << iota
+	// RetryUnavailable is a read, or a batch with an idempotency key, whose
+	// outcome is unknown: the connection broke or it came back TIMEOUT or
+	// NOTCOMMITTED.
+	RetryUnavailable
+	// RetryAmbiguousWrites is RetryUnavailable for every write. Only for
+	// writes that may be applied twice, like SET but not INCR.
+	RetryAmbiguousWrites
+)
+
+// RetryPolicy says which failed calls are sent again, and how often. The
+// backoff before each retry doubles from Backoff up to MaxBackoff, with
+// jitter, and a call gives up early rather than sleep past its deadline.
+type RetryPolicy struct {
+	MaxAttempts int // tries in all, 1 for no retries; 0 for DefaultRetryPolicy
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+	On          RetryClass
+}
+
+// DefaultRetryPolicy retries refusals, and reads that failed, twice.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	Backoff:     50 * time.Millisecond,
+	MaxBackoff:  time.Second,
+	On:          RetryRefused | RetryUnavailable,
+}
+
+// NoRetries sends every call once.
+var NoRetries = RetryPolicy{MaxAttempts: 1}
+
+func (p RetryPolicy) orDefault() RetryPolicy {
+	if p.MaxAttempts <= 0 {
+		return DefaultRetryPolicy
+	}
+	return p
+}
+
+// notSent marks a failure before the command left the client.
+type notSent struct{ err error }
+
+func (e *notSent) Error() string { return e.err.Error() }
+func (e *notSent) Unwrap() error { return e.err }
+
+// classify says what kind of failure err is for a call that is safe, or
+// isn't, to send twice; 0 for one that is never retried.
+func classify(err error, safe bool) RetryClass {
+	var ns *notSent
+	var reply *Error
+	switch {
+	case errors.Is(err, ErrClosed), errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return 0
+	case errors.As(err, &ns):
+		return RetryRefused
+	case errors.As(err, &reply):
+		switch reply.Code {
+		case CodeNotLeader, CodeWitness, CodeRateLimit:
+			return RetryRefused
+		case CodeTimeout, CodeNotCommitted:
+		default:
+			return 0 // the command itself is at fault
+		}
+	}
+	if safe {
+		return RetryUnavailable
+	}
+	return RetryAmbiguousWrites
+}
+
+// retry reports whether a call should be sent again after its attempt-th
+// try failed with err, having slept the backoff if so.
+func (p RetryPolicy) retry(ctx context.Context, attempt int, err error, safe bool) bool {
+	on := p.On
+	if on&RetryAmbiguousWrites != 0 {
+		on |= RetryUnavailable // sending writes again, reads go too
+	}
+	if attempt >= p.MaxAttempts || ctx.Err() != nil || on&classify(err, safe) == 0 {
+		return false
+	}
+	backoff := p.Backoff
+	for i := 1; i < attempt && backoff < p.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if p.MaxBackoff > 0 {
+		backoff = min(backoff, p.MaxBackoff)
+	}
+	if backoff > 0 {
+		backoff = backoff/2 + rand.N(backoff/2+1)
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < backoff {
+		return false // it would fail with the deadline anyway; keep err
+	}
+	t := time.NewTimer(backoff)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// callContext bounds ctx by Options.Timeout unless it has a deadline.
+func (o Options) callContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok || o.Timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, o.Timeout)
+}
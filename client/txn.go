@@ -0,0 +1,68 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// TxnGuard is a condition a transaction checks, see Client.Txn.
+type TxnGuard []string
+
+// ValueIs holds when key holds value.
+func ValueIs(key, value string) TxnGuard { return TxnGuard{"VALUE", key, value} }
+
+// RevisionBelow holds when key was last written before revision, the raft
+// index STAT and watches report. A missing key has revision 0.
+func RevisionBelow(key string, revision int) TxnGuard {
+	return TxnGuard{"REV", key, strconv.Itoa(revision)}
+}
+
+// Exists holds when key exists.
+func Exists(key string) TxnGuard { return TxnGuard{"EXISTS", key} }
+
+// Missing holds when key doesn't exist.
+func Missing(key string) TxnGuard { return TxnGuard{"MISSING", key} }
+
+// TxnOp is an operation a transaction runs.
+type TxnOp []string
+
+func TxnSet(key, value string) TxnOp { return TxnOp{"SET", key, value} }
+func TxnDelete(key string) TxnOp     { return TxnOp{"DEL", key} }
+func TxnGet(key string) TxnOp        { return TxnOp{"GET", key} }
+
+// TxnResponse is how a transaction went.
+type TxnResponse struct {
+	Succeeded bool     // every guard held and then ran, rather than els
+	Replies   []string // one per op that ran: OK for a set, 1 or 0 for a delete, the value or (nil) for a get
+}
+
+// Txn checks guards and runs then if they all hold, els if not, as one
+// write on every node. Values are sent as single words, so they can't hold
+// whitespace.
+func (c *Client) Txn(ctx context.Context, guards []TxnGuard, then, els []TxnOp) (*TxnResponse, error) {
+	cmd := []string{"TXN"}
+	for _, g := range guards {
+		cmd = append(cmd, g...)
+	}
+	cmd = append(cmd, "THEN")
+	for _, op := range then {
+		cmd = append(cmd, op...)
+	}
+	if len(els) > 0 {
+		cmd = append(cmd, "ELSE")
+		for _, op := range els {
+			cmd = append(cmd, op...)
+		}
+	}
+	reply, err := c.Do(ctx, cmd...)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(reply, "\n")
+	if lines[0] != "1" && lines[0] != "0" {
+		return nil, fmt.Errorf("unexpected TXN reply %q", reply)
+	}
+	return &TxnResponse{Succeeded: lines[0] == "1", Replies: lines[1:]}, nil
+}
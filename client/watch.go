@@ -0,0 +1,166 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A watch long-polls GET /watch and hands the changes it gets to a channel.
+// Revisions are raft log indexes, the same on every node, so when a poll
+// fails (the node went down, or a proxy cut the request) the watch polls
+// again, maybe another node, from the revision after the last change it
+// delivered: nothing is missed and nothing comes twice.
+
+const watchPollTimeout = 25 * time.Second
+
+// ErrCompacted ends a watch whose next revision the cluster has compacted
+// away: read what you need afresh and watch again from now.
+var ErrCompacted = errors.New("watch revision compacted")
+
+// Event is one change a watch delivers.
+type Event struct {
+	Revision int    `json:"index"` // raft log index of the change
+	Term     int    `json:"term"`
+	Node     string `json:"node"` // node that served it
+	Op       string `json:"op"`   // command name, e.g. "SET" or "BATCH"
+	Key      string `json:"key,omitempty"`
+	Command  string `json:"command"` // the command as the log holds it
+
+	// Err is set on the last event, and nothing else is, when the watch
+	// ends for a reason other than its ctx.
+	Err error `json:"-"`
+}
+
+type watchResponse struct {
+	Events       []Event `json:"events"`
+	NextRevision int     `json:"nextRevision"`
+}
+
+// watcher is one watch; next names the node to poll, given the one that
+// just failed ("" at first).
+type watcher struct {
+	http   *http.Client
+	opts   Options
+	next   func(failed string) string
+	prefix string
+	from   int // -1 until the first poll says where now is
+}
+
+// Watch returns the changes to keys starting with prefix ("" for every key)
+// from fromRevision on, or from now for a negative fromRevision, until ctx
+// ends. Polls that fail are retried, on the same node.
+func (c *Client) Watch(ctx context.Context, prefix string, fromRevision int) <-chan Event {
+	w := &watcher{http: c.http, opts: c.opts, next: func(string) string { return c.addr }, prefix: prefix, from: fromRevision}
+	return w.start(ctx)
+}
+
+// Watch is Client.Watch on whichever node is up: a failed poll moves on to
+// the next node of the topology.
+func (c *Cluster) Watch(ctx context.Context, prefix string, fromRevision int) <-chan Event {
+	next := func(failed string) string {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		nodes := c.topo.Nodes
+		if failed == "" && c.topo.Leader != "" {
+			return c.topo.Leader // the freshest node to start with
+		}
+		for i, n := range nodes {
+			if n == failed {
+				return nodes[(i+1)%len(nodes)]
+			}
+		}
+		return nodes[0]
+	}
+	w := &watcher{http: c.http, opts: c.opts.Options, next: next, prefix: prefix, from: fromRevision}
+	return w.start(ctx)
+}
+
+func (w *watcher) start(ctx context.Context) <-chan Event {
+	events := make(chan Event, 64)
+	go w.run(ctx, events)
+	return events
+}
+
+func (w *watcher) run(ctx context.Context, events chan<- Event) {
+	defer close(events)
+	addr := w.next("")
+	backoff := 100 * time.Millisecond
+	for ctx.Err() == nil {
+		res, err := w.poll(ctx, addr)
+		if err != nil {
+			var fatal *watchError
+			if errors.As(err, &fatal) || ctx.Err() != nil {
+				if ctx.Err() == nil {
+					events <- Event{Err: fatal.err}
+				}
+				return
+			}
+			addr = w.next(addr)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return
+			}
+			backoff = min(2*backoff, 2*time.Second)
+			continue
+		}
+		backoff = 100 * time.Millisecond
+		for _, e := range res.Events {
+			select {
+			case events <- e:
+			case <-ctx.Done():
+				return
+			}
+		}
+		w.from = res.NextRevision
+	}
+}
+
+// watchError is a poll failure that retrying won't fix.
+type watchError struct{ err error }
+
+func (e *watchError) Error() string { return e.err.Error() }
+
+func (w *watcher) poll(ctx context.Context, addr string) (watchResponse, error) {
+	q := url.Values{"timeout": {watchPollTimeout.String()}}
+	if w.prefix != "" {
+		q.Set("prefix", w.prefix)
+	}
+	if w.from >= 0 {
+		q.Set("fromRevision", strconv.Itoa(w.from))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, httpBase(addr, w.opts)+"/watch?"+q.Encode(), nil)
+	if err != nil {
+		return watchResponse{}, &watchError{err}
+	}
+	if w.opts.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+w.opts.Token)
+	}
+	resp, err := w.http.Do(req)
+	if err != nil {
+		return watchResponse{}, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusGone:
+		return watchResponse{}, &watchError{fmt.Errorf("%w: revision %d", ErrCompacted, w.from)}
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		text, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return watchResponse{}, &watchError{fmt.Errorf("watch: %s: %s", resp.Status, strings.TrimSpace(string(text)))}
+	case resp.StatusCode != http.StatusOK:
+		return watchResponse{}, fmt.Errorf("watch: %s", resp.Status)
+	}
+	var res watchResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return watchResponse{}, err
+	}
+	return res, nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// resync asks a follower to rebuild itself from the leader over POST
+// /resync: the two compare Merkle trees of their state and the follower
+// fetches only the ranges that differ. node is the follower's TCP address,
+// as in -peers; its HTTP API is on the port 1000 above. Exit status 1 means
+// the resync failed or the state still differs afterwards.
+func resync(args []string) int {
+	fs := flag.NewFlagSet("resync", flag.ContinueOnError)
+	token := fs.String("token", "", "admin token, if the node's HTTP API requires one")
+	timeout := fs.Duration("timeout", 2*time.Minute, "how long to wait for the resync")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "resync: exactly one node address is required")
+		return 2
+	}
+	url := "http://" + nodeHTTPAddr(fs.Arg(0)) + "/resync"
+
+	req, err := http.NewRequest(http.MethodPost, url, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "resync: %v\n", err)
+		return 2
+	}
+	if *token != "" {
+		req.Header.Set("Authorization", "Bearer "+*token)
+	}
+	resp, err := (&http.Client{Timeout: *timeout}).Do(req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "resync: %v\n", err)
+		return 2
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "resync: reading the answer: %v\n", err)
+		return 2
+	}
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintf(os.Stderr, "resync: %s: %s\n", resp.Status, strings.TrimSpace(string(body)))
+		if resp.StatusCode == http.StatusInternalServerError {
+			return 1
+		}
+		return 2
+	}
+	var out bytes.Buffer
+	if json.Indent(&out, body, "", "  ") != nil {
+		out.Write(body)
+	}
+	fmt.Println(strings.TrimSpace(out.String()))
+	return 0
+}
+
+// nodeHTTPAddr maps a node's TCP address to its HTTP address (TCP port + 1000).
+func nodeHTTPAddr(tcpAddr string) string {
+	host, port, err := net.SplitHostPort(tcpAddr)
+	if err != nil {
+		return tcpAddr
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return tcpAddr
+	}
+	return net.JoinHostPort(host, strconv.Itoa(p+1000))
+}
@@ -0,0 +1,312 @@
+package main // kv-bench: load generator that drives a cluster over the client protocol
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/mathdee/KV-Store/client"
+)
+
+// config is the workload, as the flags give it and the JSON report repeats it.
+type config struct {
+	Nodes          []string      `json:"nodes"`
+	Duration       time.Duration `json:"durationNs"`
+	Requests       int64         `json:"requests"` // stop after this many ops instead, 0 for no limit
+	Warmup         time.Duration `json:"warmupNs"`
+	Concurrency    int           `json:"concurrency"`
+	Conns          int           `json:"conns"` // connections per node, shared by the workers
+	ReadPercent    int           `json:"readPercent"`
+	ValueSize      int           `json:"valueSize"`
+	KeySpace       int           `json:"keySpace"`
+	KeyPrefix      string        `json:"keyPrefix"`
+	Distribution   string        `json:"distribution"` // uniform or zipfian
+	ReadPreference string        `json:"readPreference"`
+	Rate           float64       `json:"rate"` // ops/s over all workers, 0 for as fast as they go
+	Timeout        time.Duration `json:"timeoutNs"`
+	MaxAttempts    int           `json:"maxAttempts"`
+	Seed           uint64        `json:"seed"`
+}
+
+func main() {
+	var cfg config
+	nodes := flag.String("nodes", "127.0.0.1:8080", "comma-separated TCP addresses of any nodes of the cluster")
+	flag.DurationVar(&cfg.Duration, "duration", 10*time.Second, "how long to measure for, after the warmup")
+	flag.Int64Var(&cfg.Requests, "requests", 0, "stop after this many ops instead of after -duration (0 for no limit)")
+	flag.DurationVar(&cfg.Warmup, "warmup", 0, "run the workload this long before measuring")
+	flag.IntVar(&cfg.Concurrency, "concurrency", 16, "workers, each with one op in flight")
+	flag.IntVar(&cfg.Conns, "conns", 1, "connections to each node, the workers pipeline over them")
+	flag.IntVar(&cfg.ReadPercent, "reads", 50, "share of ops that are GETs (0-100), the rest are SETs")
+	flag.IntVar(&cfg.ValueSize, "value-size", 16, "bytes per value")
+	flag.IntVar(&cfg.KeySpace, "keyspace", 10000, "number of distinct keys")
+	flag.StringVar(&cfg.KeyPrefix, "key-prefix", "bench:", "prefix of every key, so a namespace quota can cover them")
+	flag.StringVar(&cfg.Distribution, "distribution", "uniform", "how keys are picked: uniform or zipfian")
+	flag.StringVar(&cfg.ReadPreference, "read-preference", "leader", "where GETs go: leader, follower or any")
+	flag.Float64Var(&cfg.Rate, "rate", 0, "cap on ops/s over all workers (0 for no cap)")
+	flag.DurationVar(&cfg.Timeout, "timeout", 5*time.Second, "give up on an op after this long")
+	flag.IntVar(&cfg.MaxAttempts, "max-attempts", client.DefaultRetryPolicy.MaxAttempts, "tries per op, 1 counts every NOTLEADER or dropped connection as an error")
+	flag.Uint64Var(&cfg.Seed, "seed", 0, "seed for the keys and the op mix (0 picks one)")
+	token := flag.String("token", "", "bearer token for the HTTP API the client fetches the topology from")
+	progress := flag.Duration("progress", time.Second, "print a progress line this often")
+	jsonOut := flag.String("json", "", "write the results as JSON to this file (\"-\" for stdout)")
+	csvOut := flag.String("csv", "", "write a CSV row per progress interval to this file (\"-\" for stdout)")
+	metricsAddr := flag.String("metrics-addr", "", "serve Prometheus metrics of the run at http://<addr>/metrics, e.g. :9100")
+	soak := flag.Duration("soak", 0, "soak mode: sample the goroutines, heap, open files and connections of every node this often, e.g. 1m with -duration 6h, and fail the run if one keeps growing")
+	flag.Parse()
+
+	cfg.Nodes = strings.Split(*nodes, ",")
+	if err := cfg.validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "kv-bench: %v\n", err)
+		os.Exit(2)
+	}
+	if cfg.Seed == 0 {
+		cfg.Seed = rand.Uint64()
+	}
+	if *progress <= 0 {
+		*progress = time.Second
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	clusters, err := connect(ctx, cfg, *token)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "kv-bench: %v\n", err)
+		os.Exit(1)
+	}
+	defer func() {
+		for _, c := range clusters {
+			c.Close()
+		}
+	}()
+
+	rep := newReporter(cfg, *progress)
+	if *soak > 0 {
+		rep.soak = newSoaker(*soak, clusters[0], client.Options{Token: *token})
+	}
+	if *metricsAddr != "" {
+		ln, err := net.Listen("tcp", *metricsAddr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "kv-bench: %v\n", err)
+			os.Exit(1)
+		}
+		go http.Serve(ln, http.HandlerFunc(rep.serveMetrics))
+		fmt.Fprintf(os.Stderr, "metrics at http://%s/metrics\n", ln.Addr())
+	}
+
+	res := run(ctx, cfg, clusters, rep)
+	fmt.Fprint(os.Stderr, res.text())
+	if err := res.write(*jsonOut, *csvOut); err != nil {
+		fmt.Fprintf(os.Stderr, "kv-bench: %v\n", err)
+		os.Exit(1)
+	}
+	if res.Ops == 0 || res.Soak != nil && len(res.Soak.Leaks) > 0 {
+		os.Exit(1)
+	}
+}
+
+func (c *config) validate() error {
+	switch {
+	case c.Concurrency <= 0:
+		return errors.New("-concurrency must be at least 1")
+	case c.Conns <= 0:
+		return errors.New("-conns must be at least 1")
+	case c.ReadPercent < 0 || c.ReadPercent > 100:
+		return fmt.Errorf("-reads must be 0-100, not %d", c.ReadPercent)
+	case c.KeySpace <= 0:
+		return errors.New("-keyspace must be at least 1")
+	case c.ValueSize <= 0:
+		return errors.New("-value-size must be at least 1")
+	case c.Duration <= 0 && c.Requests <= 0:
+		return errors.New("one of -duration or -requests is needed")
+	case c.Distribution != "uniform" && c.Distribution != "zipfian":
+		return fmt.Errorf("-distribution is uniform or zipfian, not %q", c.Distribution)
+	case c.MaxAttempts <= 0:
+		return errors.New("-max-attempts must be at least 1")
+	}
+	if _, ok := readPreferences[c.ReadPreference]; !ok {
+		return fmt.Errorf("-read-preference is leader, follower or any, not %q", c.ReadPreference)
+	}
+	return nil
+}
+
+var readPreferences = map[string]client.ReadPreference{
+	"leader":   client.ReadLeader,
+	"follower": client.ReadFollower,
+	"any":      client.ReadAny,
+}
+
+// connect opens cfg.Conns clusters; each has a connection per node.
+func connect(ctx context.Context, cfg config, token string) ([]*client.Cluster, error) {
+	retry := client.DefaultRetryPolicy
+	retry.MaxAttempts = cfg.MaxAttempts
+	opts := client.ClusterOptions{
+		Options:        client.Options{Token: token, Retry: retry},
+		ReadPreference: readPreferences[cfg.ReadPreference],
+	}
+	var clusters []*client.Cluster
+	for range cfg.Conns {
+		c, err := client.NewCluster(ctx, cfg.Nodes, opts)
+		if err != nil {
+			for _, c := range clusters {
+				c.Close()
+			}
+			return nil, err
+		}
+		clusters = append(clusters, c)
+	}
+	return clusters, nil
+}
+
+// worker runs ops one after another on its cluster.
+type worker struct {
+	cfg   config
+	c     *client.Cluster
+	rec   *recorder
+	rng   *rand.Rand
+	zipf  *rand.Zipf
+	value string
+	pace  time.Duration // between op starts, 0 for none
+}
+
+func newWorker(cfg config, id int, c *client.Cluster) *worker {
+	w := &worker{
+		cfg:   cfg,
+		c:     c,
+		rec:   &recorder{interval: newOpStats()},
+		rng:   rand.New(rand.NewPCG(cfg.Seed, uint64(id))),
+		value: strings.Repeat("x", cfg.ValueSize),
+	}
+	if cfg.Distribution == "zipfian" && cfg.KeySpace > 1 {
+		w.zipf = rand.NewZipf(w.rng, 1.1, 1, uint64(cfg.KeySpace-1))
+	}
+	if cfg.Rate > 0 {
+		w.pace = time.Duration(float64(time.Second) * float64(cfg.Concurrency) / cfg.Rate)
+	}
+	return w
+}
+
+func (w *worker) key() string {
+	if w.zipf != nil {
+		return w.cfg.KeyPrefix + strconv.FormatUint(w.zipf.Uint64(), 10)
+	}
+	return w.cfg.KeyPrefix + strconv.Itoa(w.rng.IntN(w.cfg.KeySpace))
+}
+
+// run does ops until ctx ends or ops runs out, recording them once
+// measuring is set.
+func (w *worker) run(ctx context.Context, measuring *atomic.Bool, ops *atomic.Int64) {
+	next := time.Now()
+	for ctx.Err() == nil {
+		if w.pace > 0 {
+			if wait := time.Until(next); wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-ctx.Done():
+					return
+				}
+			}
+			next = next.Add(w.pace)
+		}
+		measured := measuring.Load()
+		if measured && w.cfg.Requests > 0 && ops.Add(1) > w.cfg.Requests {
+			return
+		}
+		op, d, miss, err := w.op(ctx)
+		if ctx.Err() != nil && errors.Is(err, context.Canceled) {
+			return // cut short by the end of the run, not the cluster's doing
+		}
+		if measured {
+			w.rec.record(op, d, miss, err)
+		}
+	}
+}
+
+func (w *worker) op(ctx context.Context) (op int, d time.Duration, miss bool, err error) {
+	ctx, cancel := context.WithTimeout(ctx, w.cfg.Timeout)
+	defer cancel()
+	key := w.key()
+	start := time.Now()
+	if w.rng.IntN(100) < w.cfg.ReadPercent {
+		var found bool
+		_, found, err = w.c.Get(ctx, key)
+		return opGet, time.Since(start), !found, err
+	}
+	err = w.c.Set(ctx, key, w.value)
+	return opSet, time.Since(start), false, err
+}
+
+// run drives the workers through the warmup and the measured phase.
+func run(ctx context.Context, cfg config, clusters []*client.Cluster, rep *reporter) *result {
+	var measuring atomic.Bool
+	var ops atomic.Int64
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for id := range cfg.Concurrency {
+		w := newWorker(cfg, id, clusters[id%len(clusters)])
+		rep.add(w.rec)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.run(ctx, &measuring, &ops)
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait() // -requests ran out
+		close(done)
+	}()
+
+	if cfg.Warmup > 0 {
+		fmt.Fprintf(os.Stderr, "warming up for %s\n", cfg.Warmup)
+		select {
+		case <-time.After(cfg.Warmup):
+		case <-ctx.Done():
+		}
+	}
+	measuring.Store(true)
+	rep.start()
+	var sampling sync.WaitGroup
+	if rep.soak != nil {
+		sampling.Add(1)
+		go func() {
+			defer sampling.Done()
+			rep.soak.run(ctx)
+		}()
+	}
+	var deadline <-chan time.Time
+	if cfg.Duration > 0 {
+		deadline = time.After(cfg.Duration)
+	}
+	tick := time.NewTicker(rep.every)
+	defer tick.Stop()
+	for running := true; running; {
+		select {
+		case <-tick.C:
+			fmt.Fprintln(os.Stderr, rep.tick().line())
+		case <-deadline:
+			running = false
+		case <-done:
+			running = false
+		case <-ctx.Done():
+			running = false
+		}
+	}
+	cancel()
+	wg.Wait()
+	sampling.Wait()
+	return rep.finish()
+}
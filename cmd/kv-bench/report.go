@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// reporter gathers the workers' stats: into an interval each progress tick,
+// and into the totals the result and /metrics come from.
+type reporter struct {
+	cfg   config
+	every time.Duration
+	soak  *soaker // nil unless -soak
+
+	mu        sync.Mutex
+	recs      []*recorder
+	total     *opStats
+	pending   *opStats // since the last tick
+	started   time.Time
+	lastTick  time.Time
+	intervals []interval
+}
+
+func newReporter(cfg config, every time.Duration) *reporter {
+	return &reporter{cfg: cfg, every: every, total: newOpStats(), pending: newOpStats()}
+}
+
+func (r *reporter) add(rec *recorder) {
+	r.mu.Lock()
+	r.recs = append(r.recs, rec)
+	r.mu.Unlock()
+}
+
+// start marks the end of the warmup.
+func (r *reporter) start() {
+	r.mu.Lock()
+	r.started = time.Now()
+	r.lastTick = r.started
+	r.mu.Unlock()
+}
+
+// collect moves what the workers recorded into the totals. Callers hold r.mu.
+func (r *reporter) collect() {
+	for _, rec := range r.recs {
+		s := rec.take()
+		r.total.merge(s)
+		r.pending.merge(s)
+	}
+}
+
+// tick closes the current interval.
+func (r *reporter) tick() interval {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collect()
+	now := time.Now()
+	iv := newInterval(r.pending, now.Sub(r.started), now.Sub(r.lastTick))
+	r.intervals = append(r.intervals, iv)
+	r.pending, r.lastTick = newOpStats(), now
+	return iv
+}
+
+func (iv interval) line() string {
+	return fmt.Sprintf("%7.1fs %10.0f ops/s  p50 %7.3fms  p99 %7.3fms  max %7.3fms  errors %d",
+		iv.ElapsedSec, iv.Throughput, iv.P50Ms, iv.P99Ms, iv.MaxMs, iv.Errors)
+}
+
+// latencySummary are the latencies of one kind of op, in ms.
+type latencySummary struct {
+	Count  int64   `json:"count"`
+	AvgMs  float64 `json:"avgMs"`
+	P50Ms  float64 `json:"p50Ms"`
+	P90Ms  float64 `json:"p90Ms"`
+	P99Ms  float64 `json:"p99Ms"`
+	P999Ms float64 `json:"p999Ms"`
+	MaxMs  float64 `json:"maxMs"`
+}
+
+func summarize(h *histogram) latencySummary {
+	return latencySummary{
+		Count:  h.n,
+		AvgMs:  h.mean(),
+		P50Ms:  h.quantile(0.5),
+		P90Ms:  h.quantile(0.9),
+		P99Ms:  h.quantile(0.99),
+		P999Ms: h.quantile(0.999),
+		MaxMs:  ms(h.max),
+	}
+}
+
+// result is the report of a run.
+type result struct {
+	Config      config                    `json:"config"`
+	Started     time.Time                 `json:"started"`
+	DurationSec float64                   `json:"durationSec"`
+	Ops         int64                     `json:"ops"` // that succeeded
+	Errors      int64                     `json:"errors"`
+	Reads       int64                     `json:"reads"`
+	Writes      int64                     `json:"writes"`
+	Misses      int64                     `json:"misses"` // reads of keys nothing was written to yet
+	Throughput  float64                   `json:"throughput"`
+	Latency     map[string]latencySummary `json:"latency"` // "all", "get" and "set"
+	ErrorCounts map[string]int64          `json:"errorCounts"`
+	Intervals   []interval                `json:"intervals"`
+	Soak        *soakReport               `json:"soak,omitempty"`
+}
+
+// finish closes the last interval, if it has anything, and sums up the run.
+func (r *reporter) finish() *result {
+	r.mu.Lock()
+	r.collect()
+	last := time.Since(r.lastTick)
+	pending := r.pending
+	r.mu.Unlock()
+	if ok, failed := pending.total(); ok+failed > 0 && last > 0 {
+		r.tick()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	elapsed := time.Since(r.started)
+	ok, failed := r.total.total()
+	res := &result{
+		Config:      r.cfg,
+		Started:     r.started,
+		DurationSec: elapsed.Seconds(),
+		Ops:         ok,
+		Errors:      failed,
+		Reads:       r.total.ok[opGet],
+		Writes:      r.total.ok[opSet],
+		Misses:      r.total.misses,
+		Throughput:  float64(ok) / elapsed.Seconds(),
+		Latency:     map[string]latencySummary{"all": summarize(r.total.all())},
+		ErrorCounts: r.total.errors,
+		Intervals:   r.intervals,
+	}
+	for op := range numOps {
+		res.Latency[opNames[op]] = summarize(&r.total.lat[op])
+	}
+	if r.soak != nil {
+		res.Soak = r.soak.report()
+	}
+	return res
+}
+
+func (res *result) text() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "\n%d ops in %.1fs: %.0f ops/s, %d reads (%d misses), %d writes, %d errors\n",
+		res.Ops, res.DurationSec, res.Throughput, res.Reads, res.Misses, res.Writes, res.Errors)
+	for _, name := range []string{"all", "get", "set"} {
+		l := res.Latency[name]
+		if l.Count == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "  %-3s avg %.3fms  p50 %.3fms  p90 %.3fms  p99 %.3fms  p99.9 %.3fms  max %.3fms\n",
+			name, l.AvgMs, l.P50Ms, l.P90Ms, l.P99Ms, l.P999Ms, l.MaxMs)
+	}
+	classes := make([]string, 0, len(res.ErrorCounts))
+	for class := range res.ErrorCounts {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	for _, class := range classes {
+		fmt.Fprintf(&b, "  errors %s: %d\n", class, res.ErrorCounts[class])
+	}
+	if res.Soak != nil {
+		for _, l := range res.Soak.Leaks {
+			fmt.Fprintln(&b, l)
+		}
+		if len(res.Soak.Leaks) == 0 {
+			fmt.Fprintln(&b, "soak: nothing kept growing")
+		}
+	}
+	return b.String()
+}
+
+// write writes the JSON report and the CSV intervals where the flags say.
+func (res *result) write(jsonPath, csvPath string) error {
+	if jsonPath != "" {
+		if err := writeTo(jsonPath, func(w io.Writer) error {
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "  ")
+			return enc.Encode(res)
+		}); err != nil {
+			return err
+		}
+	}
+	if csvPath != "" {
+		return writeTo(csvPath, func(w io.Writer) error {
+			cw := csv.NewWriter(w)
+			cw.Write(csvHeader)
+			for _, iv := range res.Intervals {
+				cw.Write(iv.csv())
+			}
+			cw.Flush()
+			return cw.Error()
+		})
+	}
+	return nil
+}
+
+func writeTo(path string, write func(io.Writer) error) error {
+	if path == "-" {
+		return write(os.Stdout)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return fmt.Errorf("writing %s: %w", path, err)
+	}
+	return f.Close()
+}
+
+// serveMetrics writes the totals so far in the Prometheus text format.
+func (r *reporter) serveMetrics(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/metrics" {
+		http.NotFound(w, req)
+		return
+	}
+	r.mu.Lock()
+	r.collect()
+	s := r.total
+	var elapsed float64
+	if !r.started.IsZero() {
+		elapsed = time.Since(r.started).Seconds()
+	}
+	var b strings.Builder
+	b.WriteString("# HELP kvbench_ops_total Ops done since the warmup, by op and result.\n# TYPE kvbench_ops_total counter\n")
+	for op := range numOps {
+		fmt.Fprintf(&b, "kvbench_ops_total{op=%q,result=\"ok\"} %d\n", opNames[op], s.ok[op])
+		fmt.Fprintf(&b, "kvbench_ops_total{op=%q,result=\"error\"} %d\n", opNames[op], s.failed[op])
+	}
+	b.WriteString("# HELP kvbench_errors_total Failed ops by error code, or timeout or conn.\n# TYPE kvbench_errors_total counter\n")
+	for class, n := range s.errors {
+		fmt.Fprintf(&b, "kvbench_errors_total{class=%q} %d\n", class, n)
+	}
+	b.WriteString("# HELP kvbench_get_misses_total GETs of keys that weren't there.\n# TYPE kvbench_get_misses_total counter\n")
+	fmt.Fprintf(&b, "kvbench_get_misses_total %d\n", s.misses)
+	b.WriteString("# HELP kvbench_op_duration_seconds Latency of the ops that succeeded.\n# TYPE kvbench_op_duration_seconds histogram\n")
+	for op := range numOps {
+		var cum int64
+		for i, c := range s.prom[op] {
+			cum += c
+			le := "+Inf"
+			if i < len(promBounds) {
+				le = strconv.FormatFloat(promBounds[i], 'g', -1, 64)
+			}
+			fmt.Fprintf(&b, "kvbench_op_duration_seconds_bucket{op=%q,le=%q} %d\n", opNames[op], le, cum)
+		}
+		fmt.Fprintf(&b, "kvbench_op_duration_seconds_sum{op=%q} %g\n", opNames[op], s.lat[op].sum.Seconds())
+		fmt.Fprintf(&b, "kvbench_op_duration_seconds_count{op=%q} %d\n", opNames[op], s.lat[op].n)
+	}
+	fmt.Fprintf(&b, "# HELP kvbench_workers Workers driving the load.\n# TYPE kvbench_workers gauge\nkvbench_workers %d\n", r.cfg.Concurrency)
+	fmt.Fprintf(&b, "# HELP kvbench_elapsed_seconds Time measured so far.\n# TYPE kvbench_elapsed_seconds gauge\nkvbench_elapsed_seconds %g\n", elapsed)
+	r.mu.Unlock()
+	if r.soak != nil {
+		last := r.soak.last()
+		nodes := make([]string, 0, len(last))
+		for node := range last {
+			nodes = append(nodes, node)
+		}
+		sort.Strings(nodes)
+		for _, metric := range soakMetrics {
+			fmt.Fprintf(&b, "# HELP kvbench_soak_%s Last soak sample, by node.\n# TYPE kvbench_soak_%s gauge\n", metric, metric)
+			for _, node := range nodes {
+				if v := last[node].Values[metric]; v >= 0 {
+					fmt.Fprintf(&b, "kvbench_soak_%s{node=%q} %d\n", metric, node, v)
+				}
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	io.WriteString(w, b.String())
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mathdee/KV-Store/client"
+)
+
+// A soak run holds a steady workload for hours and samples, every -soak,
+// what each node (from INFO) and kv-bench itself hold: goroutines, heap,
+// open files and client connections. A leak shows as a floor that keeps
+// rising: the run is cut into quarters, and a metric whose lowest sample
+// rose from each quarter to the next, by more than its rule allows in all,
+// is flagged. Taking the lowest sample of each quarter keeps a GC cycle or
+// a burst of connections from looking like growth.
+
+// soakMetrics are the sampled metrics, in report order.
+var soakMetrics = []string{"goroutines", "heap_bytes", "open_fds", "clients"}
+
+// leakRules say how much a metric must grow over a run to be flagged: by
+// at least min, and by ratio of where it started.
+var leakRules = map[string]struct {
+	min   int64
+	ratio float64
+}{
+	"goroutines": {min: 20, ratio: 0.2},
+	"heap_bytes": {min: 16 << 20, ratio: 0.5},
+	"open_fds":   {min: 10, ratio: 0.2},
+	"clients":    {min: 5, ratio: 0.2},
+}
+
+// soakMinSamples is how many samples a series needs before it is judged.
+const soakMinSamples = 8
+
+// selfNode names kv-bench's own series.
+const selfNode = "kv-bench"
+
+type soakSample struct {
+	ElapsedSec float64          `json:"elapsedSec"`
+	Values     map[string]int64 `json:"values"` // by soakMetrics name, -1 where unknown
+}
+
+// leak is a metric that kept growing.
+type leak struct {
+	Node   string  `json:"node"`
+	Metric string  `json:"metric"`
+	From   int64   `json:"from"` // floor of the first quarter
+	To     int64   `json:"to"`   // floor of the last
+	Floors []int64 `json:"floors"`
+	PerHr  float64 `json:"perHour"` // growth from the first floor to the last, per hour
+}
+
+func (l leak) String() string {
+	return fmt.Sprintf("LEAK %s on %s: floor grew %d -> %d (quarters %v, %+.0f/h)", l.Metric, l.Node, l.From, l.To, l.Floors, l.PerHr)
+}
+
+// soakReport is the soak part of the JSON report.
+type soakReport struct {
+	IntervalNs time.Duration           `json:"intervalNs"`
+	Samples    map[string][]soakSample `json:"samples"` // by node
+	SampleErrs map[string]int          `json:"sampleErrors,omitempty"`
+	Leaks      []leak                  `json:"leaks"`
+}
+
+// soaker samples the nodes of the cluster.
+type soaker struct {
+	every   time.Duration
+	cluster *client.Cluster
+	opts    client.Options
+
+	mu      sync.Mutex
+	started time.Time
+	conns   map[string]*client.Client
+	samples map[string][]soakSample
+	errs    map[string]int
+}
+
+func newSoaker(every time.Duration, c *client.Cluster, opts client.Options) *soaker {
+	return &soaker{every: every, cluster: c, opts: opts, conns: map[string]*client.Client{}, samples: map[string][]soakSample{}, errs: map[string]int{}}
+}
+
+// run samples once now and then every s.every until ctx ends.
+func (s *soaker) run(ctx context.Context) {
+	s.mu.Lock()
+	s.started = time.Now()
+	s.mu.Unlock()
+	t := time.NewTicker(s.every)
+	defer t.Stop()
+	for {
+		s.sample(ctx)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *soaker) sample(ctx context.Context) {
+	s.mu.Lock()
+	elapsed := time.Since(s.started).Seconds()
+	s.mu.Unlock()
+
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	s.add(selfNode, soakSample{ElapsedSec: elapsed, Values: map[string]int64{
+		"goroutines": int64(runtime.NumGoroutine()),
+		"heap_bytes": int64(m.HeapAlloc),
+		"open_fds":   openFDs(),
+		"clients":    -1,
+	}})
+
+	for _, addr := range s.cluster.Topology().Nodes {
+		values, err := s.info(ctx, addr)
+		if err != nil {
+			if ctx.Err() == nil {
+				s.mu.Lock()
+				s.errs[addr]++
+				s.mu.Unlock()
+				fmt.Fprintf(os.Stderr, "soak: sampling %s: %v\n", addr, err)
+			}
+			continue
+		}
+		s.add(addr, soakSample{ElapsedSec: elapsed, Values: values})
+	}
+}
+
+// info reads the sampled metrics from the INFO of the node at addr.
+func (s *soaker) info(ctx context.Context, addr string) (map[string]int64, error) {
+	s.mu.Lock()
+	c, ok := s.conns[addr]
+	s.mu.Unlock()
+	if !ok {
+		var err error
+		if c, err = client.Dial(ctx, addr, s.opts); err != nil {
+			return nil, err
+		}
+		s.mu.Lock()
+		s.conns[addr] = c
+		s.mu.Unlock()
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	reply, err := c.Do(ctx, "INFO")
+	if err != nil {
+		return nil, err
+	}
+	fields := map[string]string{}
+	for _, line := range strings.Split(reply, "\n") {
+		if k, v, ok := strings.Cut(line, ":"); ok {
+			fields[k] = v
+		}
+	}
+	values := map[string]int64{}
+	for metric, field := range map[string]string{"goroutines": "goroutines", "heap_bytes": "heap_alloc_bytes", "open_fds": "open_fds", "clients": "connected_clients"} {
+		n, err := strconv.ParseInt(fields[field], 10, 64)
+		if err != nil {
+			n = -1 // a node too old to report it
+		}
+		values[metric] = n
+	}
+	return values, nil
+}
+
+func (s *soaker) add(node string, sample soakSample) {
+	s.mu.Lock()
+	s.samples[node] = append(s.samples[node], sample)
+	s.mu.Unlock()
+}
+
+// last returns the latest sample of every node, for /metrics.
+func (s *soaker) last() map[string]soakSample {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	last := map[string]soakSample{}
+	for node, samples := range s.samples {
+		last[node] = samples[len(samples)-1]
+	}
+	return last
+}
+
+// report judges every series and closes the connections.
+func (s *soaker) report() *soakReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		c.Close()
+	}
+	rep := &soakReport{IntervalNs: s.every, Samples: s.samples, SampleErrs: s.errs, Leaks: []leak{}}
+	nodes := make([]string, 0, len(s.samples))
+	for node := range s.samples {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	for _, node := range nodes {
+		for _, metric := range soakMetrics {
+			if l, ok := findLeak(s.samples[node], metric); ok {
+				l.Node = node
+				rep.Leaks = append(rep.Leaks, l)
+			}
+		}
+	}
+	return rep
+}
+
+// findLeak reports whether metric kept growing over samples.
+func findLeak(samples []soakSample, metric string) (leak, bool) {
+	var values []int64
+	var times []float64
+	for _, s := range samples {
+		if v := s.Values[metric]; v >= 0 {
+			values = append(values, v)
+			times = append(times, s.ElapsedSec)
+		}
+	}
+	if len(values) < soakMinSamples {
+		return leak{}, false
+	}
+	floors := make([]int64, 4)
+	for q := range floors {
+		part := values[q*len(values)/4 : (q+1)*len(values)/4]
+		floors[q] = part[0]
+		for _, v := range part {
+			floors[q] = min(floors[q], v)
+		}
+		if q > 0 && floors[q] <= floors[q-1] {
+			return leak{}, false
+		}
+	}
+	rule := leakRules[metric]
+	growth := floors[3] - floors[0]
+	if growth < rule.min || float64(growth) < rule.ratio*float64(floors[0]) {
+		return leak{}, false
+	}
+	l := leak{Metric: metric, From: floors[0], To: floors[3], Floors: floors}
+	if span := times[len(times)-1] - times[0]; span > 0 {
+		l.PerHr = float64(growth) / span * 3600
+	}
+	return l, true
+}
+
+// openFDs counts kv-bench's open files and sockets, -1 where there is no
+// /proc to count them in.
+func openFDs() int64 {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	return int64(len(entries) - 1) // ReadDir's own
+}
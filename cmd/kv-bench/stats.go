@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/bits"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mathdee/KV-Store/client"
+)
+
+// Op kinds, indexes into the per-kind arrays.
+const (
+	opGet = iota
+	opSet
+	numOps
+)
+
+var opNames = [numOps]string{"get", "set"}
+
+// histogram counts latencies in microseconds: exactly below 32µs, then in
+// 16 buckets per power of two, so any quantile it reports is within 1/32 of
+// the real one. It never grows, however long the run.
+type histogram struct {
+	counts [1024]int64
+	n      int64
+	sum    time.Duration
+	max    time.Duration
+}
+
+func bucketOf(us uint64) int {
+	if us < 32 {
+		return int(us)
+	}
+	shift := bits.Len64(us) - 5
+	return 32 + (shift-1)*16 + int(us>>shift) - 16
+}
+
+// bucketMid is the middle of bucket i, in microseconds.
+func bucketMid(i int) float64 {
+	if i < 32 {
+		return float64(i)
+	}
+	shift := (i-32)/16 + 1
+	m := uint64((i-32)%16 + 16)
+	return float64(m<<shift+(m+1)<<shift) / 2
+}
+
+func (h *histogram) add(d time.Duration) {
+	h.counts[bucketOf(uint64(max(d.Microseconds(), 0)))]++
+	h.n++
+	h.sum += d
+	h.max = max(h.max, d)
+}
+
+func (h *histogram) merge(o *histogram) {
+	for i, c := range o.counts {
+		h.counts[i] += c
+	}
+	h.n += o.n
+	h.sum += o.sum
+	h.max = max(h.max, o.max)
+}
+
+// quantile returns the latency q (0-1) of the ops are at or under, in ms.
+func (h *histogram) quantile(q float64) float64 {
+	if h.n == 0 {
+		return 0
+	}
+	rank := int64(q*float64(h.n-1)) + 1
+	var seen int64
+	for i, c := range h.counts {
+		if seen += c; seen >= rank {
+			return min(bucketMid(i)/1000, ms(h.max))
+		}
+	}
+	return ms(h.max)
+}
+
+func (h *histogram) mean() float64 {
+	if h.n == 0 {
+		return 0
+	}
+	return ms(h.sum) / float64(h.n)
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// promBounds are the bucket bounds of the Prometheus histograms, in
+// seconds, the same as the server's /benchmark histogram.
+var promBounds = []float64{0.00005, 0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+
+// opStats are the counts of one worker, or of several merged.
+type opStats struct {
+	ok     [numOps]int64
+	failed [numOps]int64
+	misses int64 // GETs of keys not there
+	lat    [numOps]histogram
+	prom   [numOps][]int64 // per bucket of promBounds, not cumulative, then +Inf
+	errors map[string]int64
+}
+
+func newOpStats() *opStats {
+	s := &opStats{errors: map[string]int64{}}
+	for i := range s.prom {
+		s.prom[i] = make([]int64, len(promBounds)+1)
+	}
+	return s
+}
+
+func (s *opStats) record(op int, d time.Duration, miss bool, err error) {
+	if err != nil {
+		s.failed[op]++
+		s.errors[errorClass(err)]++
+		return
+	}
+	s.ok[op]++
+	if miss {
+		s.misses++
+	}
+	s.lat[op].add(d)
+	s.prom[op][sort.SearchFloat64s(promBounds, d.Seconds())]++
+}
+
+func (s *opStats) merge(o *opStats) {
+	for op := range numOps {
+		s.ok[op] += o.ok[op]
+		s.failed[op] += o.failed[op]
+		s.lat[op].merge(&o.lat[op])
+		for i, c := range o.prom[op] {
+			s.prom[op][i] += c
+		}
+	}
+	s.misses += o.misses
+	for class, n := range o.errors {
+		s.errors[class] += n
+	}
+}
+
+func (s *opStats) total() (ok, failed int64) {
+	for op := range numOps {
+		ok += s.ok[op]
+		failed += s.failed[op]
+	}
+	return ok, failed
+}
+
+// all returns the latencies of every kind of op together.
+func (s *opStats) all() *histogram {
+	var h histogram
+	for op := range numOps {
+		h.merge(&s.lat[op])
+	}
+	return &h
+}
+
+// errorClass is how a failure is counted: its error code, or "timeout" or
+// "conn" for calls that got no reply.
+func errorClass(err error) string {
+	var reply *client.Error
+	switch {
+	case errors.As(err, &reply):
+		return reply.Code
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	default:
+		return "conn"
+	}
+}
+
+// recorder collects the stats of one worker; the reporter takes the
+// interval's away each tick and keeps the totals.
+type recorder struct {
+	mu       sync.Mutex
+	interval *opStats
+}
+
+func (r *recorder) record(op int, d time.Duration, miss bool, err error) {
+	r.mu.Lock()
+	r.interval.record(op, d, miss, err)
+	r.mu.Unlock()
+}
+
+func (r *recorder) take() *opStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.interval
+	r.interval = newOpStats()
+	return s
+}
+
+// interval is one progress line, also a CSV row.
+type interval struct {
+	ElapsedSec float64 `json:"elapsedSec"`
+	Ops        int64   `json:"ops"`
+	Errors     int64   `json:"errors"`
+	Throughput float64 `json:"throughput"` // ops/s
+	P50Ms      float64 `json:"p50Ms"`
+	P99Ms      float64 `json:"p99Ms"`
+	MaxMs      float64 `json:"maxMs"`
+}
+
+func newInterval(s *opStats, elapsed, length time.Duration) interval {
+	ok, failed := s.total()
+	h := s.all()
+	return interval{
+		ElapsedSec: elapsed.Seconds(),
+		Ops:        ok,
+		Errors:     failed,
+		Throughput: float64(ok) / length.Seconds(),
+		P50Ms:      h.quantile(0.5),
+		P99Ms:      h.quantile(0.99),
+		MaxMs:      ms(h.max),
+	}
+}
+
+func (iv interval) csv() []string {
+	f := func(v float64) string { return strconv.FormatFloat(v, 'f', 3, 64) }
+	return []string{f(iv.ElapsedSec), strconv.FormatInt(iv.Ops, 10), strconv.FormatInt(iv.Errors, 10), f(iv.Throughput), f(iv.P50Ms), f(iv.P99Ms), f(iv.MaxMs)}
+}
+
+var csvHeader = []string{"elapsed_s", "ops", "errors", "ops_per_s", "p50_ms", "p99_ms", "max_ms"}
@@ -1,17 +1,35 @@
 package main // program entry point
 
 import (
+	"bufio"
+	"context"
 	"flag"
 	"fmt" // print messages to screen
 	"log" // record errors and events
+	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
 	_ "strconv"
 	"strings"
+	"syscall"
+	"time"
 
+	"github.com/mathdee/KV-Store/internal/cache" // upstream backends for cache mode
+	"github.com/mathdee/KV-Store/internal/cdc"
+	"github.com/mathdee/KV-Store/internal/certs" // TLS certificates, reloaded in place
+	"github.com/mathdee/KV-Store/internal/compress"
+	"github.com/mathdee/KV-Store/internal/config" // -config file and SIGHUP reloads
+	"github.com/mathdee/KV-Store/internal/crash"
+	"github.com/mathdee/KV-Store/internal/durability"
+	"github.com/mathdee/KV-Store/internal/failpoint" // crash and stall points for tests, with -tags failpoints
+	"github.com/mathdee/KV-Store/internal/history"
 	"github.com/mathdee/KV-Store/internal/raft"
-	"github.com/mathdee/KV-Store/internal/server" // handles network connections
-	"github.com/mathdee/KV-Store/internal/store"  // manages data storage
-	"github.com/mathdee/KV-Store/internal/wal"    // backup log for safety
+	"github.com/mathdee/KV-Store/internal/server"  // handles network connections
+	"github.com/mathdee/KV-Store/internal/storage" // pluggable in-memory engines
+	"github.com/mathdee/KV-Store/internal/store"   // manages data storage
+	"github.com/mathdee/KV-Store/internal/tracing" // optional OpenTelemetry spans
+	"github.com/mathdee/KV-Store/internal/wal"     // backup log for safety
 )
 
 func main() { // program starts here
@@ -21,20 +39,104 @@ func main() { // program starts here
 
 	replica := flag.String("replica", "", "Primary or secondary server") // Define a flag for the replica
 	peersFlag := flag.String("peers", "", "Comma-separated list of peer addresses")
-	flag.Parse() // parses the flags and sets their values to the variables.
+	historyFile := flag.String("history-file", "", "record every client GET/SET here for kv-admin check-linearizability")
+	walFaults := flag.String("wal-faults", "", "simulate disk failures for testing, e.g. sync-error=10,partial=5,delay=20ms")
+	failpoints := flag.String("failpoints", "", "set failpoints from the start, e.g. wal/before-fsync=crash;raft/after-append=sleep(10ms) (needs a build with -tags failpoints)")
+	recoveryWorkers := flag.Int("recovery-workers", 0, "goroutines parsing the WAL at startup (0 uses every CPU)")
+	walMode := flag.String("wal-mode", "sync", "sync acks writes once fsynced; async acks them once queued, losing up to one flush interval of acked writes on a crash (for benchmarking only)")
+	walFlushInterval := flag.Duration("wal-flush-interval", wal.DefaultCommitOptions.Interval, "group commit whatever writes are queued this often")
+	walFlushEntries := flag.Int("wal-flush-max-entries", wal.DefaultCommitOptions.MaxEntries, "group commit early once this many writes are queued, and never more per batch (0 for no limit)")
+	walFlushBytes := flag.Int("wal-flush-max-bytes", wal.DefaultCommitOptions.MaxBytes, "group commit early once queued writes add up to this many bytes (0 for no limit)")
+	walPrealloc := flag.Int64("wal-prealloc-bytes", 64<<20, "reserve disk space for the WAL this many bytes at a time, so fsyncs don't also allocate blocks (0 disables, Linux only)")
+	walRecycle := flag.Bool("wal-recycle", true, "keep the WAL file compaction retires and overwrite it on the next compaction instead of creating a new one")
+	dataDir := flag.String("data-dir", ".", "directory for the WAL and other node files")
+	fsck := flag.Bool("fsck", false, "check the WAL, raft log and SAVE snapshot before serving, and refuse to start if any is damaged")
+	repair := flag.Bool("repair", false, "with -fsck, offer to truncate damaged log tails, asking on stdin before changing anything (implies -fsck)")
+	maxKeySize := flag.Int("max-key-size", server.DefaultLimits.MaxKeyLen, "longest key clients may write, in bytes")
+	maxValueSize := flag.Int("max-value-size", server.DefaultLimits.MaxValueSize, "largest value clients may write, in bytes")
+	slowlogThreshold := flag.Duration("slowlog-threshold", 10*time.Millisecond, "log client commands slower than this (0 logs every command, negative disables)")
+	requestTimeout := flag.Duration("request-timeout", server.DefaultRequestTimeout, "how long a write may wait for the WAL and a majority before the client gets an error")
+	idempotencyTTL := flag.Duration("idempotency-ttl", server.DefaultIdempotencyTTL, "how long the result of a write with an idempotency token is kept for retries")
+	slowlogLen := flag.Int("slowlog-max-len", 128, "number of slow commands to keep")
+	hotkeysSampleRate := flag.Int("hotkeys-sample-rate", server.DefaultHotKeysSampleRate, "count one client access in this many towards HOTKEYS (1 counts every access, 0 disables)")
+	quotas := flag.String("quotas", "", "per-namespace write quotas, e.g. acme:keys=10000,bytes=67108864,qps=500;*:qps=1000 (* for namespaces without one)")
+	cdcSink := flag.String("cdc", "", "stream applied writes to a sink: file:<path> or webhook:<url>")
+	cdcBatch := flag.Int("cdc-batch", 100, "max changes per CDC delivery")
+	cacheUpstream := flag.String("cache-upstream", "", "run as a cache in front of a backend, reading misses from it and flushing writes to it behind: http:<base url>")
+	cacheTTL := flag.Duration("cache-ttl", server.DefaultCacheOptions.TTL, "how long a key read from the upstream stays cached (0 keeps it for good)")
+	cacheFlushInterval := flag.Duration("cache-flush-interval", server.DefaultCacheOptions.FlushInterval, "how often the leader flushes writes to the upstream")
+	cacheFlushBatch := flag.Int("cache-flush-batch", server.DefaultCacheOptions.FlushBatch, "max log entries per flush to the upstream")
+	electionPriority := flag.Int("election-priority", raft.MaxElectionPriority, "0-10, lower values wait longer before standing for election, so higher-priority nodes usually lead")
+	clusterID := flag.String("cluster-id", "", "name of the cluster; peers that handshake with another name are reported as misconfigured")
+	witness := flag.Bool("witness", false, "vote and ack entries without storing data or ever leading, a cheap third node for two data nodes")
+	snapshotThreshold := flag.Int("snapshot-threshold", raft.DefaultSnapshotThreshold, "send followers further behind than this many entries a snapshot instead")
+	windowEntries := flag.Int("replication-window-entries", raft.DefaultWindowEntries, "most log entries the leader sends a follower in one round (0 for no limit)")
+	windowBytes := flag.Int64("replication-window-bytes", raft.DefaultWindowBytes, "most command bytes the leader sends a follower in one round (0 for no limit)")
+	applyBatch := flag.Int("apply-batch", server.DefaultApplyBatch, "most committed entries a follower applies under one lock and WAL wait")
+	antiEntropyInterval := flag.Duration("anti-entropy-interval", server.DefaultAntiEntropyInterval, "how often a follower compares its state with the leader's and repairs what differs (0 disables)")
+	compactInterval := flag.Duration("compact-interval", server.DefaultCompactionOptions.Interval, "how often to check whether the WAL and raft log need compacting (0 disables)")
+	compactEntries := flag.Int("compact-max-entries", server.DefaultCompactionOptions.MaxEntries, "compact once the raft log holds more entries than this")
+	compactBytes := flag.Int64("compact-max-wal-bytes", server.DefaultCompactionOptions.MaxWALBytes, "compact once the WAL is bigger than this many bytes")
+	diskInterval := flag.Duration("disk-check-interval", server.DefaultDiskOptions.Interval, "how often to check free space in the data directory (0 disables)")
+	diskMinFree := flag.Int64("disk-min-free-bytes", server.DefaultDiskOptions.MinFreeBytes, "refuse writes with READONLY while the data directory has less free space than this")
+	storageEngine := flag.String("storage-engine", "map", "how values are kept in memory: map (one lock) or sharded (a lock per shard)")
+	compactValues := flag.Bool("compact-values", false, "keep values of up to 15 bytes inside the engine's entries instead of allocating each one, at the cost of an allocation per read")
+	compression := flag.String("compression", "none", "compress large values in memory and in the WAL: none, snappy or zstd")
+	compressionThreshold := flag.Int("compression-threshold", 1024, "only compress values of at least this many bytes")
+	internValues := flag.Int("intern-values", 0, "keep one shared copy of each value of up to this many bytes, for many keys with the same few values (0 disables)")
+	keyHistory := flag.Int("key-history", 0, "keep the last this many revisions of every key in memory for HISTORY (0 disables)")
+	traceExporter := flag.String("trace", "", "OpenTelemetry trace exporter: \"\" (off) or \"stdout\"")
+	historyWindow := flag.Duration("metrics-history", 10*time.Minute, "how much metrics history to keep in memory (0 disables)")
+	historyResolution := flag.Duration("metrics-history-resolution", 5*time.Second, "interval between metrics history samples")
+	tlsCert := flag.String("tls-cert", "", "serve the client and peer port over TLS with this PEM certificate (and dial peers over TLS)")
+	tlsKey := flag.String("tls-key", "", "PEM private key for -tls-cert")
+	tlsCA := flag.String("tls-ca", "", "verify peers against this PEM CA bundle instead of the system roots")
+	tlsWatch := flag.Duration("tls-watch-interval", 30*time.Second, "how often to check the TLS files for a rotated certificate (0 only reloads on SIGHUP or POST /config/reload)")
+	monitorOn := flag.Bool("monitor", false, "answer MONITOR, which streams every client command and its values in the clear to whoever connects (debugging only)")
+	accessLogFile := flag.String("access-log", "", "append a JSON line per client command and HTTP request to this file (\"-\" for stdout)")
+	corsOrigins := flag.String("cors-origins", strings.Join(server.DefaultCORSOptions.AllowedOrigins, ","), "comma-separated origins browsers may call the HTTP API from, \"*\" for any, \"\" for none")
+	corsMethods := flag.String("cors-methods", strings.Join(server.DefaultCORSOptions.AllowedMethods, ","), "comma-separated HTTP methods allowed cross-origin")
+	corsHeaders := flag.String("cors-headers", strings.Join(server.DefaultCORSOptions.AllowedHeaders, ","), "comma-separated request headers allowed cross-origin")
+	corsCredentials := flag.Bool("cors-allow-credentials", false, "let pages from origins listed in -cors-origins send cookies and Authorization headers")
+	corsMaxAge := flag.Duration("cors-max-age", server.DefaultCORSOptions.MaxAge, "how long browsers may cache a CORS preflight answer")
+	readToken := flag.String("http-read-token", "", "require this bearer token (or basic auth password) on every HTTP endpoint; best set in the -config file")
+	adminToken := flag.String("http-admin-token", "", "require this token on HTTP endpoints that change the node (pause, clear, chaos, benchmarks); it also works for reads")
+	configFile := flag.String("config", "", "read flags from this file, one \"name = value\" per line; SIGHUP or POST /config/reload re-reads it")
+	flag.Parse()                                           // parses the flags and sets their values to the variables.
+	cfg, err := config.Load(flag.CommandLine, *configFile) // command-line flags win over the file
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
 
 	id := ":" + *port
 
+	shutdownTracing, err := tracing.Init(*traceExporter, id) // no-op unless -trace is set
+	if err != nil {
+		log.Fatalf("Failed to init tracing: %v", err)
+	}
+	defer shutdownTracing(context.Background()) // flush buffered spans on exit
+
 	var peers []string
 	if *peersFlag != "" {
 		peers = strings.Split(*peersFlag, ",")
 	}
+	if err := raft.CheckPeers(id, peers); err != nil {
+		log.Fatalf("Invalid -peers: %v", err) // a quorum that can't be reached would only flap through elections
+	}
 	var logFile string // variable stores log file name & value in empty string.
 	if *replica != "" {
 		logFile = fmt.Sprintf("server_%s.log", *replica)
 	} else {
 		logFile = fmt.Sprintf("server_%s.log", *port)
 	}
+	if err := os.MkdirAll(*dataDir, 0755); err != nil {
+		log.Fatalf("Failed to create data dir: %v", err)
+	}
+	logFile = filepath.Join(*dataDir, logFile)                       // WAL lives in the data directory
+	raftLogFile := strings.TrimSuffix(logFile, ".log") + ".raft.log" // raft log next to it
+	if *fsck || *repair {
+		runFsck(durability.FsckFiles{WAL: logFile, RaftLog: raftLogFile, Snapshot: strings.TrimSuffix(logFile, ".log") + ".snap"}, *repair)
+	}
 
 	// Intialize the Write-Ahead Log
 	w, err := wal.NewWAL(logFile) // create backup log file
@@ -42,26 +144,371 @@ func main() { // program starts here
 		log.Fatalf("Failed to init WAL: %v", err) // show error and stop
 	}
 	defer w.Close() // close file when done
+	w.SetPrealloc(*walPrealloc)
+	w.SetRecycle(*walRecycle)
+	w.SetCommitOptions(wal.CommitOptions{Interval: *walFlushInterval, MaxEntries: *walFlushEntries, MaxBytes: *walFlushBytes})
+	if mode, err := wal.ParseMode(*walMode); err != nil {
+		log.Fatal(err)
+	} else if mode == wal.ModeAsync {
+		fmt.Println("WARNING: WAL in async mode, acked writes from the last flush interval are lost on a crash")
+		w.SetMode(mode)
+	}
+	if *failpoints != "" {
+		actions, err := failpoint.ParseList(*failpoints)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for name, a := range actions {
+			if err := failpoint.Enable(name, a); err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("WARNING: failpoint %s set to %s\n", name, a)
+		}
+	}
+	if faults, err := wal.ParseFaults(*walFaults); err != nil {
+		log.Fatal(err)
+	} else if faults != (wal.Faults{}) {
+		fmt.Printf("WARNING: injecting WAL faults %+v\n", faults)
+		w.SetFaults(faults)
+	}
+
+	// Creates data storage system
+	engine, err := storage.Open(*storageEngine, storage.Options{CompactValues: *compactValues})
+	if err != nil {
+		log.Fatal(err)
+	}
+	s := store.NewStoreWithEngine(w, engine) // create data storage system
+	codec, err := compress.Parse(*compression)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s.SetCompression(codec, *compressionThreshold) // before recovery, so recovered values are compressed too
+	s.SetInterning(*internValues)                  // and interned
+	s.SetHistory(*keyHistory)
 
 	// Part that recovers the data from the disk
-	fmt.Printf("Recovering data from disk %s\n", logFile) // notify user of recovery
-	data, err := wal.Recover(logFile)                     // load saved data from backup
-	if err != nil {                                       // if recovery failed
+	fmt.Printf("Recovering data from disk %s\n", logFile)    // notify user of recovery
+	recovered, err := s.Recover(logFile, wal.RecoverOptions{ // replay the backup straight into the store
+		Workers: *recoveryWorkers,
+		Progress: func(p wal.RecoverStats) {
+			fmt.Printf("Recovering: %d of %d bytes, %d records in %v\n", p.Bytes, p.TotalBytes, p.Records, p.Elapsed.Round(time.Millisecond))
+		},
+	})
+	if err != nil { // if recovery failed
 		log.Fatalf("Failed to recover WAL: %v", err) // show error and stop
 	}
+	fmt.Printf("Recovered %d keys from %d records in %v\n", s.Len(), recovered.Records, recovered.Elapsed.Round(time.Millisecond))
 
-	// Creates data storage system
-	s := store.NewStore(w) // create data storage system
-	s.Restore(data)        // restore saved data
+	var tlsCerts *certs.Reloader
+	if *tlsCert != "" || *tlsKey != "" {
+		tlsCerts, err = certs.New(*tlsCert, *tlsKey, *tlsCA)
+		if err != nil {
+			log.Fatalf("Failed to load TLS certificate: %v", err)
+		}
+		if *tlsWatch > 0 {
+			go tlsCerts.Watch(context.Background(), *tlsWatch, func(err error) {
+				if err != nil {
+					log.Printf("TLS certificate reload failed, keeping the old one: %v", err)
+					return
+				}
+				log.Printf("TLS certificate reloaded, valid until %v", tlsCerts.Status().NotAfter)
+			})
+		}
+	}
 
 	// Starts the server
 	consensus := raft.NewConsensus(id, peers)
+	if tlsCerts != nil {
+		consensus.SetTransport(tlsCerts) // peers listen on the TLS port too
+	}
+	raftLog, err := durability.ReadLog(raftLogFile) // the log, term and vote of the last run
+	if err != nil {
+		log.Fatalf("Failed to read raft log: %v", err)
+	}
+	// The WAL's APPLIED markers say how far the store got, so nothing up to
+	// there is applied twice.
+	consensus.Restore(raftLog.Offset, raftLog.Term, raftLog.Entries, raftLog.State, s.Applied())
+	fmt.Printf("Restored raft log %d to %d at term %d, applied up to %d\n", raftLog.Offset, raftLog.Offset+len(raftLog.Entries)-1, raftLog.State.Term, s.Applied())
+	durable, err := durability.Open(raftLogFile, w) // synced ahead of the WAL
+	if err != nil {
+		log.Fatalf("Failed to open raft log: %v", err)
+	}
+	durable.SetPrealloc(*walPrealloc)
+	durable.SetRecycle(*walRecycle)
+	defer durable.Close()
+	crash.SetShutdown(func() { // a panic that can't be restarted from: leave the logs whole
+		durable.Close() // in the order the defers above would
+		w.Close()
+	})
+	consensus.SetLogStore(durable)
+	consensus.SetElectionPriority(*electionPriority)
+	consensus.SetWitness(*witness)
+	consensus.SetClusterID(*clusterID)
+	consensus.SetReplicationWindow(*windowEntries, *windowBytes)
 	consensus.Start()
 	tcpPort, _ := strconv.Atoi(*port)
 	httpPort := fmt.Sprintf(":%d", tcpPort+1000)
-	srv := server.NewServer(s, consensus)                              // Create network server
+	srv := server.NewServer(s, consensus) // Create network server
+	srv.SetLimits(server.Limits{MaxKeyLen: *maxKeySize, MaxValueSize: *maxValueSize})
+	srv.SetSlowlog(server.NewSlowlog(*slowlogThreshold, *slowlogLen))
+	srv.SetHotKeys(server.NewHotKeys(*hotkeysSampleRate))
+	srv.SetRequestTimeout(*requestTimeout)
+	srv.SetApplyBatch(*applyBatch)
+	srv.SetIdempotencyTTL(*idempotencyTTL)
+	srv.SetMonitor(*monitorOn)
+	if q, err := server.ParseQuotas(*quotas); err != nil {
+		log.Fatal(err)
+	} else {
+		srv.SetQuotas(q)
+	}
+	srv.SetWAL(w)
+	if tlsCerts != nil {
+		srv.SetTLS(tlsCerts)
+	}
+	consensus.SetSnapshotter(srv, *snapshotThreshold)
+	consensus.SetDigestSource(srv) // followers check their state against the leader's
+	if *historyFile != "" {
+		rec, err := history.NewRecorder(*historyFile)
+		if err != nil {
+			log.Fatalf("Failed to open history file: %v", err)
+		}
+		defer rec.Close()
+		srv.SetHistoryRecorder(rec)
+	}
+	srv.GetMetrics().StartHistory(*historyWindow, *historyResolution)  // sample metrics for /metrics/history
+	server.PublishExpvar(srv.GetMetrics(), consensus, w)               // counters on /debug/vars
 	httpServer := server.NewHTTPServer(consensus, srv.GetMetrics(), s) // Create HTTP server and pass the store
-	go httpServer.Start(httpPort)                                      // Start HTTP server in background
+	httpServer.SetDataDir(*dataDir)                                    // benchmark history goes next to the WAL
+	httpServer.SetSlowlog(srv.GetSlowlog())                            // same slowlog as SLOWLOG
+	httpServer.SetHotKeys(srv.GetHotKeys())                            // same counts as HOTKEYS
+	httpServer.SetInfo(srv.Info)                                       // same sections as INFO
+	httpServer.SetClients(srv.Clients)                                 // same connections as CLIENT LIST
+	httpServer.SetTenants(srv.Tenants)                                 // same namespaces as INFO tenants
+	httpServer.SetDigests(srv.DigestStatus)                            // state digest checks on /metrics
+	httpServer.SetApplyStats(srv.ApplyStats)                           // apply lag and batches on /metrics
+	httpServer.SetSnapshot(srv.Save)                                   // POST /snapshot is SAVE
+	httpServer.SetResync(srv.Resync)                                   // POST /resync, for kv-admin resync
+	httpServer.SetChangeFeed(srv)                                      // /watch reads the applied log
+	httpServer.SetSessions(srv.WaitIndex)                              // ?minIndex= waits like MININDEX
+	httpServer.SetBatch(srv.Batch)                                     // POST /kv/batch writes through the TCP server's raft path
+	setCORS := func() error {
+		httpServer.SetCORS(server.CORSOptions{
+			AllowedOrigins:   splitList(*corsOrigins),
+			AllowedMethods:   splitList(*corsMethods),
+			AllowedHeaders:   splitList(*corsHeaders),
+			AllowCredentials: *corsCredentials,
+			MaxAge:           *corsMaxAge,
+		})
+		return nil
+	}
+	setCORS()
+	setAuth := func() error {
+		httpServer.SetAuth(server.AuthOptions{ReadToken: *readToken, AdminToken: *adminToken})
+		return nil
+	}
+	setAuth()
+	if *accessLogFile != "" {
+		out := os.Stdout
+		if *accessLogFile != "-" {
+			if out, err = os.OpenFile(*accessLogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644); err != nil {
+				log.Fatalf("Failed to open access log: %v", err)
+			}
+			defer out.Close()
+		}
+		accessLog := server.NewAccessLog(out)
+		srv.SetAccessLog(accessLog)
+		httpServer.SetAccessLog(accessLog) // one log, told apart by "proto"
+	}
+	if tlsCerts != nil {
+		httpServer.SetTLS(tlsCerts) // the network benchmark is a TLS client
+	}
+	compactor := server.NewCompactor(srv, server.CompactionOptions{
+		Interval:    *compactInterval,
+		MaxEntries:  *compactEntries,
+		MaxWALBytes: *compactBytes,
+	})
+	httpServer.SetCompactor(compactor) // progress shows up on /status
+	disk := server.NewDiskWatchdog(*dataDir, server.DiskOptions{Interval: *diskInterval, MinFreeBytes: *diskMinFree})
+	srv.SetDiskWatchdog(disk)
+	httpServer.SetDiskWatchdog(disk)
+	if *cdcSink != "" {
+		sink, err := cdc.ParseSink(*cdcSink)
+		if err != nil {
+			log.Fatal(err)
+		}
+		pipeline, err := cdc.NewPipeline(srv, sink, cdc.Options{
+			BatchSize:  *cdcBatch,
+			CursorFile: filepath.Join(*dataDir, "cdc.cursor"), // raft index of the last delivered change
+			Node:       id,
+		})
+		if err != nil {
+			log.Fatalf("Failed to start CDC: %v", err)
+		}
+		defer pipeline.Close()
+		go pipeline.Run(context.Background())
+		httpServer.SetCDC(pipeline)
+		compactor.Hold(func() int { return pipeline.Status().Cursor }) // keep undelivered changes in the log
+	}
+	if *cacheUpstream != "" {
+		upstream, err := cache.ParseUpstream(*cacheUpstream)
+		if err != nil {
+			log.Fatal(err)
+		}
+		c, err := server.NewCache(srv, upstream, server.CacheOptions{
+			TTL:           *cacheTTL,
+			FlushInterval: *cacheFlushInterval,
+			FlushBatch:    *cacheFlushBatch,
+			CursorFile:    filepath.Join(*dataDir, "cache.cursor"), // raft index of the last write flushed upstream
+		})
+		if err != nil {
+			log.Fatalf("Failed to start cache mode: %v", err)
+		}
+		defer c.Close()
+		srv.SetCache(c)
+		httpServer.SetCache(c)
+		compactor.Hold(c.Cursor) // keep unflushed writes in the log
+		go c.Run(context.Background())
+	}
+	go compactor.Run(context.Background())
+	go disk.Run(context.Background())                                 // writes stop before the disk fills, and resume when it frees up
+	go srv.RunApply(context.Background())                             // committed entries reach the store
+	go srv.RunExpiry(context.Background())                            // the leader removes keys whose ttl ran out
+	go srv.RunAntiEntropy(context.Background(), *antiEntropyInterval) // followers repair state that drifted from the leader's
+
+	// Settings a reload may change while the node runs; every other flag in
+	// the file is reported as needing a restart.
+	cfg.OnReload("slowlog-threshold", func() error {
+		srv.GetSlowlog().SetThreshold(*slowlogThreshold)
+		return nil
+	})
+	cfg.OnReload("hotkeys-sample-rate", func() error {
+		srv.GetHotKeys().SetSampleRate(*hotkeysSampleRate)
+		return nil
+	})
+	cfg.OnReload("request-timeout", func() error {
+		srv.SetRequestTimeout(*requestTimeout)
+		return nil
+	})
+	cfg.OnReload("monitor", func() error {
+		srv.SetMonitor(*monitorOn) // attached monitors stay until they detach
+		return nil
+	})
+	cfg.OnReload("idempotency-ttl", func() error {
+		srv.SetIdempotencyTTL(*idempotencyTTL)
+		return nil
+	})
+	cfg.OnReload("quotas", func() error {
+		q, err := server.ParseQuotas(*quotas)
+		if err != nil {
+			return err
+		}
+		srv.SetQuotas(q)
+		return nil
+	})
+	setLimits := func() error {
+		srv.SetLimits(server.Limits{MaxKeyLen: *maxKeySize, MaxValueSize: *maxValueSize})
+		return nil
+	}
+	for _, name := range []string{"cors-origins", "cors-methods", "cors-headers", "cors-allow-credentials", "cors-max-age"} {
+		cfg.OnReload(name, setCORS)
+	}
+	cfg.OnReload("http-read-token", setAuth) // rotate tokens without a restart
+	cfg.OnReload("http-admin-token", setAuth)
+	cfg.OnReload("max-key-size", setLimits)
+	cfg.OnReload("max-value-size", setLimits)
+	setCompaction := func() error {
+		compactor.SetOptions(server.CompactionOptions{Interval: *compactInterval, MaxEntries: *compactEntries, MaxWALBytes: *compactBytes})
+		return nil
+	}
+	cfg.OnReload("compact-interval", setCompaction)
+	cfg.OnReload("compact-max-entries", setCompaction)
+	cfg.OnReload("compact-max-wal-bytes", setCompaction)
+	setDisk := func() error {
+		disk.SetOptions(server.DiskOptions{Interval: *diskInterval, MinFreeBytes: *diskMinFree})
+		return nil
+	}
+	cfg.OnReload("disk-check-interval", setDisk)
+	cfg.OnReload("disk-min-free-bytes", setDisk)
+	setCommit := func() error {
+		w.SetCommitOptions(wal.CommitOptions{Interval: *walFlushInterval, MaxEntries: *walFlushEntries, MaxBytes: *walFlushBytes})
+		return nil
+	}
+	cfg.OnReload("wal-flush-interval", setCommit)
+	cfg.OnReload("wal-flush-max-entries", setCommit)
+	cfg.OnReload("wal-flush-max-bytes", setCommit)
+	cfg.OnReload("wal-mode", func() error {
+		mode, err := wal.ParseMode(*walMode)
+		if err != nil {
+			return err
+		}
+		w.SetMode(mode)
+		return nil
+	})
+	cfg.OnReload("wal-prealloc-bytes", func() error {
+		w.SetPrealloc(*walPrealloc)
+		durable.SetPrealloc(*walPrealloc)
+		return nil
+	})
+	cfg.OnReload("wal-recycle", func() error {
+		w.SetRecycle(*walRecycle)
+		durable.SetRecycle(*walRecycle)
+		return nil
+	})
+	setCompression := func() error {
+		codec, err := compress.Parse(*compression)
+		if err != nil {
+			return err
+		}
+		s.SetCompression(codec, *compressionThreshold) // existing keys keep their codec
+		return nil
+	}
+	cfg.OnReload("compression", setCompression)
+	cfg.OnReload("compression-threshold", setCompression)
+	cfg.OnReload("intern-values", func() error {
+		s.SetInterning(*internValues) // interns or lets go of what is stored now
+		return nil
+	})
+	cfg.OnReload("election-priority", func() error {
+		consensus.SetElectionPriority(*electionPriority)
+		return nil
+	})
+	cfg.OnReload("snapshot-threshold", func() error {
+		consensus.SetSnapshotter(srv, *snapshotThreshold)
+		return nil
+	})
+	if tlsCerts != nil {
+		setCerts := func() error { return tlsCerts.SetFiles(*tlsCert, *tlsKey, *tlsCA) }
+		cfg.OnReload("tls-cert", setCerts)
+		cfg.OnReload("tls-key", setCerts)
+		cfg.OnReload("tls-ca", setCerts)
+	}
+	reload := func() (config.Result, error) {
+		res, err := cfg.Reload()
+		if tlsCerts != nil { // the same paths may hold new files
+			if *configFile == "" {
+				err = nil // the certificates are all there is to reload
+			}
+			if err := tlsCerts.Reload(); err != nil {
+				res.Errors["tls-cert"] = err.Error() // the old certificate stays in use
+			}
+		}
+		if err != nil {
+			log.Printf("Config reload failed: %v", err)
+			return res, err
+		}
+		log.Printf("Config reloaded: applied %v, requires restart %v, overridden by command line %v, errors %v",
+			res.Applied, res.RequiresRestart, res.Overridden, res.Errors)
+		return res, nil
+	}
+	httpServer.SetConfigReload(reload)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reload()
+		}
+	}()
+	go httpServer.Start(httpPort) // Start HTTP server in background
 
 	if *replica != "" {
 		fmt.Printf("I am a replica of port %s\n: ", *replica) // prints the port of replica
@@ -74,3 +521,62 @@ func main() { // program starts here
 		log.Fatal(err)
 	}
 }
+
+// runFsck checks the node's files and exits unless they are intact. With
+// repair it offers to truncate each damaged one, one confirmation each.
+func runFsck(files durability.FsckFiles, repair bool) {
+	report, err := durability.Fsck(files)
+	if err != nil {
+		log.Fatalf("fsck: %v", err)
+	}
+	for _, c := range report.Files {
+		switch {
+		case c.Missing:
+			fmt.Printf("fsck: %s %s: none yet\n", c.Kind, c.Path)
+		case c.Problem != "":
+			fmt.Printf("fsck: %s %s: DAMAGED: %s\n", c.Kind, c.Path, c.Problem)
+		default:
+			fmt.Printf("fsck: %s %s: ok, %d records in %d bytes\n", c.Kind, c.Path, c.Records, c.Bytes)
+		}
+	}
+	if report.OK {
+		return
+	}
+	if !repair {
+		log.Fatal("fsck: not starting with damaged files; -fsck -repair offers to truncate the damage")
+	}
+
+	answers := bufio.NewReader(os.Stdin)
+	for _, c := range report.Damaged() {
+		if !c.Repairable {
+			log.Fatalf("fsck: %s can't be repaired by truncating it, fix it by hand", c.Path)
+		}
+		if c.Kind == "snapshot" {
+			fmt.Printf("fsck: move %s aside to %s.damaged? [y/N] ", c.Path, c.Path)
+		} else {
+			fmt.Printf("fsck: truncate %s at byte %d, cutting %d bytes (kept in %s.damaged)? [y/N] ", c.Path, c.DamageAt, c.Bytes-c.DamageAt, c.Path)
+		}
+		answer, _ := answers.ReadString('\n')
+		if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" && a != "yes" {
+			log.Fatalf("fsck: %s left as it is, not starting", c.Path)
+		}
+		if err := durability.Repair(c); err != nil {
+			log.Fatalf("fsck: repairing %s: %v", c.Path, err)
+		}
+	}
+	if report, err = durability.Fsck(files); err != nil || !report.OK {
+		log.Fatalf("fsck: still damaged after the repair: %v %+v", err, report.Damaged())
+	}
+	fmt.Println("fsck: repaired, starting")
+}
+
+// splitList parses a comma-separated flag, dropping blanks.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
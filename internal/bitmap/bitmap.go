@@ -0,0 +1,82 @@
+// Package bitmap implements bit operations on string values. Bits are
+// numbered from the most significant bit of the first byte, as in Redis, so a
+// bitmap written here reads the same from any Redis-compatible client.
+package bitmap
+
+import (
+	"errors"
+	"math/bits"
+	"strconv"
+)
+
+// MaxOffset caps SETBIT so a single command can't allocate an enormous value.
+const MaxOffset = 1<<32 - 1
+
+var ErrOffset = errors.New("bit offset is not an integer or out of range")
+var ErrBit = errors.New("bit is not an integer or out of range")
+
+// ParseOffset parses a SETBIT/GETBIT offset.
+func ParseOffset(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 || n > MaxOffset {
+		return 0, ErrOffset
+	}
+	return n, nil
+}
+
+// ParseBit parses the 0/1 argument of SETBIT.
+func ParseBit(s string) (int, error) {
+	if s != "0" && s != "1" {
+		return 0, ErrBit
+	}
+	return int(s[0] - '0'), nil
+}
+
+// Get returns the bit at offset, 0 past the end of the value.
+func Get(value string, offset int) int {
+	i := offset / 8
+	if i >= len(value) {
+		return 0
+	}
+	return int(value[i]>>(7-uint(offset%8))) & 1
+}
+
+// Set returns value with the bit at offset set to bit, zero-padding it if
+// needed, along with the bit's previous value.
+func Set(value string, offset int, bit int) (string, int) {
+	i := offset / 8
+	b := []byte(value)
+	if i >= len(b) {
+		b = append(b, make([]byte, i-len(b)+1)...)
+	}
+	mask := byte(1) << (7 - uint(offset%8))
+	old := 0
+	if b[i]&mask != 0 {
+		old = 1
+	}
+	if bit == 1 {
+		b[i] |= mask
+	} else {
+		b[i] &^= mask
+	}
+	return string(b), old
+}
+
+// Count returns the number of set bits in bytes start..end (inclusive).
+// Negative indexes count from the end, -1 being the last byte.
+func Count(value string, start, end int) int {
+	n := len(value)
+	if start < 0 {
+		start += n
+	}
+	if end < 0 {
+		end += n
+	}
+	start = max(start, 0)
+	end = min(end, n-1)
+	count := 0
+	for i := start; i <= end; i++ {
+		count += bits.OnesCount8(value[i])
+	}
+	return count
+}
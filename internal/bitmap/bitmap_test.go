@@ -0,0 +1,20 @@
+package bitmap
+
+import "testing"
+
+func TestSetGetCount(t *testing.T) {
+	v, old := Set("", 9, 1)
+	if v != "\x00\x40" || old != 0 {
+		t.Fatalf("Expected bit 9 in the second byte, got %q (old %d)", v, old)
+	}
+	if Get(v, 9) != 1 || Get(v, 8) != 0 || Get(v, 100) != 0 {
+		t.Errorf("Unexpected GETBIT results on %q", v)
+	}
+	v, old = Set(v, 0, 1)
+	if old != 0 || Count(v, 0, -1) != 2 || Count(v, -1, -1) != 1 {
+		t.Errorf("Expected 2 bits total and 1 in the last byte, got %q", v)
+	}
+	if v, old = Set(v, 9, 0); old != 1 || Count(v, 0, -1) != 1 {
+		t.Errorf("Expected clearing bit 9 to report 1, got %d on %q", old, v)
+	}
+}
@@ -0,0 +1,111 @@
+// Package cache is what a node talks to when it runs as a cache in front of
+// another store: the upstream that misses are read from and writes are
+// flushed to. The server package does the caching itself.
+package cache
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Upstream is the backend a cache node sits in front of. Get reports a
+// missing key as found == false with a nil error; errors are for an upstream
+// that couldn't answer. Put and Delete must only return nil once the write
+// is stored upstream, as a failed flush is retried.
+type Upstream interface {
+	Get(ctx context.Context, key string) (value string, found bool, err error)
+	Put(ctx context.Context, key, value string) error
+	Delete(ctx context.Context, key string) error
+	Close() error
+}
+
+// ParseUpstream builds an upstream from a -cache-upstream flag value:
+//
+//	http:https://db-gateway.internal/kv
+func ParseUpstream(spec string) (Upstream, error) {
+	kind, target, ok := strings.Cut(spec, ":")
+	if !ok || target == "" {
+		return nil, fmt.Errorf("bad cache upstream %q, want http:<base url>", spec)
+	}
+	switch kind {
+	case "http":
+		return NewHTTPUpstream(target)
+	}
+	return nil, fmt.Errorf("unknown cache upstream %q, want http", kind)
+}
+
+// HTTPUpstream keeps each key at <base>/<key>: GET reads it, 404 meaning
+// missing, PUT writes the body as its value and DELETE removes it. Any 2xx
+// response acks a write, and so does a 404 for a delete.
+type HTTPUpstream struct {
+	base   string
+	client *http.Client
+}
+
+func NewHTTPUpstream(base string) (*HTTPUpstream, error) {
+	u, err := url.Parse(base)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("bad cache upstream url %q", base)
+	}
+	return &HTTPUpstream{base: strings.TrimSuffix(base, "/"), client: &http.Client{Timeout: 10 * time.Second}}, nil
+}
+
+func (u *HTTPUpstream) do(ctx context.Context, method, key string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u.base+"/"+url.PathEscape(key), body)
+	if err != nil {
+		return nil, err
+	}
+	return u.client.Do(req)
+}
+
+func (u *HTTPUpstream) Get(ctx context.Context, key string) (string, bool, error) {
+	resp, err := u.do(ctx, http.MethodGet, key, nil)
+	if err != nil {
+		return "", false, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return "", false, nil
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return "", false, fmt.Errorf("upstream GET %s: %s", key, resp.Status)
+	}
+	value, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", false, err
+	}
+	return string(value), true, nil
+}
+
+func (u *HTTPUpstream) Put(ctx context.Context, key, value string) error {
+	resp, err := u.do(ctx, http.MethodPut, key, strings.NewReader(value))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("upstream PUT %s: %s", key, resp.Status)
+	}
+	return nil
+}
+
+func (u *HTTPUpstream) Delete(ctx context.Context, key string) error {
+	resp, err := u.do(ctx, http.MethodDelete, key, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound && (resp.StatusCode < 200 || resp.StatusCode > 299) {
+		return fmt.Errorf("upstream DELETE %s: %s", key, resp.Status)
+	}
+	return nil
+}
+
+func (u *HTTPUpstream) Close() error {
+	return nil
+}
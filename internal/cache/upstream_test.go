@@ -0,0 +1,84 @@
+package cache
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeBackend keeps keys the way HTTPUpstream expects them to be kept.
+type fakeBackend struct {
+	mu   sync.Mutex
+	data map[string]string
+}
+
+func (b *fakeBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	key := strings.TrimPrefix(r.URL.Path, "/kv/")
+	switch r.Method {
+	case http.MethodGet:
+		v, ok := b.data[key]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, v)
+	case http.MethodPut:
+		v, _ := io.ReadAll(r.Body)
+		b.data[key] = string(v)
+	case http.MethodDelete:
+		if _, ok := b.data[key]; !ok {
+			http.NotFound(w, r)
+			return
+		}
+		delete(b.data, key)
+	}
+}
+
+func TestHTTPUpstream(t *testing.T) {
+	backend := &fakeBackend{data: map[string]string{"user:1": "ada"}}
+	ts := httptest.NewServer(backend)
+	defer ts.Close()
+	u, err := ParseUpstream("http:" + ts.URL + "/kv/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	if v, found, err := u.Get(ctx, "user:1"); err != nil || !found || v != "ada" {
+		t.Fatalf("expected ada, got %q %v %v", v, found, err)
+	}
+	if _, found, err := u.Get(ctx, "user:2"); err != nil || found {
+		t.Fatalf("expected a miss without an error, got %v %v", found, err)
+	}
+	if err := u.Put(ctx, "a key/with slash", "v 1\n"); err != nil {
+		t.Fatal(err)
+	}
+	if v, found, _ := u.Get(ctx, "a key/with slash"); !found || v != "v 1\n" {
+		t.Errorf("expected the value back byte for byte, got %q %v", v, found)
+	}
+	if err := u.Delete(ctx, "user:1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.Delete(ctx, "user:1"); err != nil {
+		t.Errorf("expected deleting a missing key to succeed, got %v", err)
+	}
+	if len(backend.data) != 1 {
+		t.Errorf("expected only the new key upstream, got %v", backend.data)
+	}
+
+	ts.Close()
+	if _, _, err := u.Get(ctx, "user:2"); err == nil {
+		t.Error("expected an error once the upstream is down")
+	}
+	for _, bad := range []string{"http", "http:", "redis:localhost:6379", "http:ftp://x"} {
+		if _, err := ParseUpstream(bad); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
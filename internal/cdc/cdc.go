@@ -0,0 +1,192 @@
+// Package cdc streams the writes a node has applied to an external sink.
+//
+// Changes are read straight from the raft log, so the only state the
+// pipeline keeps is a cursor: the raft index of the last change the sink
+// acknowledged, saved to disk after every batch. A restarted node resumes
+// after the cursor, and a batch that failed is retried until it goes
+// through, which makes delivery at-least-once.
+package cdc
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mathdee/KV-Store/internal/raft"
+)
+
+// Event is one applied write.
+type Event struct {
+	Index   int    `json:"index"` // raft log index, increases by one per change
+	Term    int    `json:"term"`
+	Node    string `json:"node"` // node that delivered it
+	Op      string `json:"op"`   // command name, e.g. "SET"
+	Key     string `json:"key,omitempty"`
+	Command string `json:"command"` // full command as it appears in the log
+}
+
+// Source is where the pipeline reads changes from.
+type Source interface {
+	Applied() int                          // highest log index applied to the store, -1 if none
+	Entries(from, max int) []raft.LogEntry // up to max entries starting at index from
+}
+
+type Options struct {
+	BatchSize    int
+	PollInterval time.Duration
+	CursorFile   string
+	Node         string
+}
+
+type Pipeline struct {
+	source Source
+	sink   Sink
+	opts   Options
+
+	mu        sync.Mutex
+	cursor    int // last acknowledged index
+	delivered int64
+	failures  int64
+	lastErr   string
+}
+
+func NewPipeline(source Source, sink Sink, opts Options) (*Pipeline, error) {
+	if opts.BatchSize < 1 {
+		opts.BatchSize = 100
+	}
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = 100 * time.Millisecond
+	}
+	cursor, err := LoadCursor(opts.CursorFile)
+	if err != nil {
+		return nil, err
+	}
+	return &Pipeline{source: source, sink: sink, opts: opts, cursor: cursor}, nil
+}
+
+// Run delivers changes until ctx is cancelled.
+func (p *Pipeline) Run(ctx context.Context) {
+	backoff := p.opts.PollInterval
+	for {
+		n, err := p.deliverBatch(ctx)
+		wait := p.opts.PollInterval
+		if err != nil {
+			fmt.Printf("[cdc] delivery failed, retrying in %v: %v\n", backoff, err)
+			wait = backoff
+			backoff = min(2*backoff, 5*time.Second)
+		} else {
+			backoff = p.opts.PollInterval
+			if n == p.opts.BatchSize {
+				wait = 0 // more may be waiting, go again right away
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (p *Pipeline) deliverBatch(ctx context.Context) (int, error) {
+	p.mu.Lock()
+	from := p.cursor + 1
+	p.mu.Unlock()
+
+	applied := p.source.Applied()
+	if applied < from {
+		return 0, nil
+	}
+	entries := p.source.Entries(from, min(p.opts.BatchSize, applied-from+1))
+	if len(entries) == 0 {
+		return 0, nil
+	}
+	batch := make([]Event, len(entries))
+	for i, e := range entries {
+		batch[i] = NewEvent(from+i, e, p.opts.Node)
+	}
+
+	err := p.sink.Deliver(ctx, batch)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil {
+		p.failures++
+		p.lastErr = err.Error()
+		return 0, err
+	}
+	p.cursor = from + len(batch) - 1
+	p.delivered += int64(len(batch))
+	p.lastErr = ""
+	if err := SaveCursor(p.opts.CursorFile, p.cursor); err != nil {
+		// The batch is delivered, so keep going; a restart may resend it.
+		fmt.Printf("[cdc] saving cursor: %v\n", err)
+	}
+	return len(batch), nil
+}
+
+// NewEvent describes the log entry e at index as a change.
+func NewEvent(index int, e raft.LogEntry, node string) Event {
+	ev := Event{Index: index, Term: e.Term, Node: node, Command: e.Command}
+	command := e.Command
+	if strings.HasPrefix(command, "IDEM ") { // IDEM token expiry command: a write with an idempotency token
+		if f := strings.SplitN(command, " ", 4); len(f) == 4 {
+			command = f[3]
+		}
+	}
+	parts := strings.Fields(command)
+	if len(parts) > 0 {
+		ev.Op = parts[0]
+	}
+	if len(parts) > 1 && ev.Op != "FLUSHNS" && ev.Op != "BATCH" && ev.Op != "CACHEFLUSHED" && ev.Op != "EVAL" && ev.Op != "TXN" { // FLUSHNS takes a namespace, BATCH a list of ops, CACHEFLUSHED an index, EVAL a key count, TXN several keys
+		ev.Key = parts[1]
+	}
+	return ev
+}
+
+// Status is what /cdc reports.
+type Status struct {
+	Cursor    int    `json:"cursor"`
+	Applied   int    `json:"applied"`
+	Delivered int64  `json:"delivered"`
+	Failures  int64  `json:"failures"`
+	LastError string `json:"lastError,omitempty"`
+}
+
+func (p *Pipeline) Status() Status {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return Status{Cursor: p.cursor, Applied: p.source.Applied(), Delivered: p.delivered, Failures: p.failures, LastError: p.lastErr}
+}
+
+func (p *Pipeline) Close() error {
+	return p.sink.Close()
+}
+
+// LoadCursor reads a cursor SaveCursor wrote, -1 if there is none yet.
+func LoadCursor(path string) (int, error) {
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return -1, nil // nothing delivered yet
+	}
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0, fmt.Errorf("cursor %s: %w", path, err)
+	}
+	return n, nil
+}
+
+// SaveCursor replaces the cursor file atomically so a crash never leaves a torn one.
+func SaveCursor(path string, cursor int) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.Itoa(cursor)+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
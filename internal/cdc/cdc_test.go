@@ -0,0 +1,65 @@
+package cdc
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/mathdee/KV-Store/internal/raft"
+)
+
+type fakeSource []raft.LogEntry
+
+func (f fakeSource) Applied() int { return len(f) - 1 }
+
+func (f fakeSource) Entries(from, max int) []raft.LogEntry {
+	return f[from:min(from+max, len(f))]
+}
+
+type flakySink struct {
+	failNext bool
+	got      []Event
+}
+
+func (s *flakySink) Deliver(ctx context.Context, batch []Event) error {
+	if s.failNext {
+		s.failNext = false
+		return errors.New("sink down")
+	}
+	s.got = append(s.got, batch...)
+	return nil
+}
+
+func (s *flakySink) Close() error { return nil }
+
+func TestPipelineRetriesAndResumes(t *testing.T) {
+	source := fakeSource{{Term: 1, Command: "SET a 1"}, {Term: 1, Command: "APPEND a 2"}, {Term: 2, Command: "FLUSHNS tenant"}}
+	opts := Options{BatchSize: 2, CursorFile: filepath.Join(t.TempDir(), "cdc.cursor")}
+	sink := &flakySink{failNext: true}
+	p, err := NewPipeline(source[:2], sink, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.deliverBatch(context.Background()); err == nil {
+		t.Fatal("expected the first delivery to fail")
+	}
+	if n, err := p.deliverBatch(context.Background()); err != nil || n != 2 {
+		t.Fatalf("expected the retry to deliver 2 changes, got %d %v", n, err)
+	}
+	if sink.got[0].Op != "SET" || sink.got[0].Key != "a" || sink.got[1].Index != 1 {
+		t.Errorf("unexpected events %+v", sink.got)
+	}
+
+	// A new pipeline (a restarted node) starts after the saved cursor.
+	resumed := &flakySink{}
+	p, err = NewPipeline(source, resumed, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.deliverBatch(context.Background())
+	if len(resumed.got) != 1 || resumed.got[0].Index != 2 || resumed.got[0].Key != "" {
+		t.Errorf("expected only the FLUSHNS change after resuming, got %+v", resumed.got)
+	}
+}
@@ -0,0 +1,216 @@
+// Package certs holds the TLS certificate a node serves and dials with, and
+// swaps in a new one when the files on disk change.
+//
+// Handshakes read the current certificate through tls.Config callbacks, so a
+// rotation only affects connections made after it: open client and peer
+// connections keep the session they negotiated and are not dropped. A file
+// that fails to load (say, a key written before its certificate) leaves the
+// old certificate in use and is retried on the next check.
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Status is what INFO reports about the certificate in use.
+type Status struct {
+	Subject   string    `json:"subject"`
+	NotAfter  time.Time `json:"notAfter"`
+	LoadedAt  time.Time `json:"loadedAt"`
+	Reloads   int64     `json:"reloads"`             // successful loads after the first
+	LastError string    `json:"lastError,omitempty"` // from the latest failed load, cleared by a good one
+}
+
+// Reloader serves the certificate and key from two files, and verifies peers
+// against an optional CA file.
+type Reloader struct {
+	mu                        sync.Mutex // one load at a time
+	certFile, keyFile, caFile string
+	modTimes                  [3]time.Time // of the files as last loaded
+
+	cert   atomic.Pointer[tls.Certificate]
+	pool   atomic.Pointer[x509.CertPool] // nil verifies peers against the system roots
+	status atomic.Pointer[Status]
+}
+
+// New loads the files once; it fails if they don't make a valid pair.
+// caFile may be empty.
+func New(certFile, keyFile, caFile string) (*Reloader, error) {
+	r := &Reloader{}
+	if err := r.SetFiles(certFile, keyFile, caFile); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// SetFiles switches to different files and loads them. On error the old
+// files and certificate stay in use.
+func (r *Reloader) SetFiles(certFile, keyFile, caFile string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.load(certFile, keyFile, caFile); err != nil {
+		return err
+	}
+	r.certFile, r.keyFile, r.caFile = certFile, keyFile, caFile
+	return nil
+}
+
+// Reload re-reads the files whether or not they changed.
+func (r *Reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.load(r.certFile, r.keyFile, r.caFile)
+}
+
+// Watch checks the files every interval and reloads them when one of them
+// changed, until ctx is done. onReload, if not nil, hears about every load
+// Watch attempts, with its error.
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration, onReload func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		r.mu.Lock()
+		var err error
+		changed := r.changed()
+		if changed {
+			err = r.load(r.certFile, r.keyFile, r.caFile)
+		}
+		r.mu.Unlock()
+		if changed && onReload != nil {
+			onReload(err)
+		}
+	}
+}
+
+// changed reports whether a file's modification time moved since the last
+// successful load. Callers hold r.mu.
+func (r *Reloader) changed() bool {
+	for i, name := range []string{r.certFile, r.keyFile, r.caFile} {
+		if name == "" {
+			continue
+		}
+		if info, err := os.Stat(name); err == nil && !info.ModTime().Equal(r.modTimes[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// load reads all three files and publishes them together. Callers hold r.mu.
+func (r *Reloader) load(certFile, keyFile, caFile string) error {
+	var modTimes [3]time.Time
+	for i, name := range []string{certFile, keyFile, caFile} {
+		if name == "" {
+			continue
+		}
+		// Stat before reading: a write landing in between is seen next time.
+		info, err := os.Stat(name)
+		if err != nil {
+			return r.failed(err)
+		}
+		modTimes[i] = info.ModTime()
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return r.failed(err)
+	}
+	leaf := cert.Leaf // parsed by LoadX509KeyPair
+	var pool *x509.CertPool
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return r.failed(err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return r.failed(fmt.Errorf("%s: no certificates found", caFile))
+		}
+	}
+
+	r.cert.Store(&cert)
+	r.pool.Store(pool)
+	r.modTimes = modTimes
+	next := Status{Subject: leaf.Subject.String(), NotAfter: leaf.NotAfter, LoadedAt: time.Now()}
+	if old := r.status.Load(); old != nil {
+		next.Reloads = old.Reloads + 1
+	}
+	r.status.Store(&next)
+	return nil
+}
+
+func (r *Reloader) failed(err error) error {
+	if old := r.status.Load(); old != nil {
+		next := *old
+		next.LastError = err.Error()
+		r.status.Store(&next)
+	}
+	return err
+}
+
+// Status describes the certificate in use.
+func (r *Reloader) Status() Status {
+	return *r.status.Load()
+}
+
+// ServerConfig is for listeners; every handshake gets the current certificate.
+func (r *Reloader) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return r.cert.Load(), nil
+		},
+	}
+}
+
+// ClientConfig is for dialing another node, verifying it against the current
+// CA. Make a new one per connection so rotations are picked up.
+func (r *Reloader) ClientConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		RootCAs:    r.pool.Load(),
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return r.cert.Load(), nil
+		},
+	}
+}
+
+// Listen is net.Listen serving TLS with the current certificate.
+func (r *Reloader) Listen(addr string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(ln, r.ServerConfig()), nil
+}
+
+// Dial connects to another node over TLS, which makes a Reloader a
+// raft.Transport.
+func (r *Reloader) Dial(addr string) (net.Conn, error) {
+	return r.DialTimeout(addr, 0)
+}
+
+// DialTimeout is Dial giving up after timeout, 0 meaning no limit. Node
+// addresses like ":8081" have no host, so those are verified as localhost.
+func (r *Reloader) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	cfg := r.ClientConfig()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		cfg.ServerName = host
+		if host == "" {
+			cfg.ServerName = "localhost"
+		}
+	}
+	return tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", addr, cfg)
+}
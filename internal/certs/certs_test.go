@@ -0,0 +1,201 @@
+package certs
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// ca signs the test certificates, like an operator's internal CA would.
+type ca struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newCA(t *testing.T) ca {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create CA: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return ca{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue writes a localhost certificate with the given serial, and its key.
+func (c ca) issue(t *testing.T, serial int64, certFile, keyFile string) {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: fmt.Sprintf("node %d", serial)},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, c.cert, &key.PublicKey, c.key)
+	if err != nil {
+		t.Fatalf("Failed to issue certificate: %v", err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	write(t, certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	write(t, keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+}
+
+// write replaces a file and moves its mtime forward, so a rotation within
+// the filesystem's timestamp granularity is still noticed.
+func write(t *testing.T, name string, data []byte) {
+	t.Helper()
+	mtime := time.Now()
+	if info, err := os.Stat(name); err == nil {
+		mtime = info.ModTime().Add(time.Second)
+	}
+	if err := os.WriteFile(name, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(name, mtime, mtime)
+}
+
+// echo accepts connections and echoes lines back.
+func echo(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			r := bufio.NewReader(conn)
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				conn.Write([]byte(line))
+			}
+		}()
+	}
+}
+
+func servedSerial(t *testing.T, conn net.Conn) int64 {
+	t.Helper()
+	tc := conn.(*tls.Conn)
+	if err := tc.Handshake(); err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+	return tc.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+}
+
+func TestRotationKeepsOpenConnections(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, caFile := filepath.Join(dir, "node.crt"), filepath.Join(dir, "node.key"), filepath.Join(dir, "ca.crt")
+	authority := newCA(t)
+	write(t, caFile, authority.pem)
+	authority.issue(t, 100, certFile, keyFile)
+
+	r, err := New(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatalf("Failed to load: %v", err)
+	}
+	ln, err := r.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go echo(ln)
+	addr := ":" + fmt.Sprint(ln.Addr().(*net.TCPAddr).Port) // the way nodes name each other
+
+	before, err := r.Dial(addr)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer before.Close()
+	if got := servedSerial(t, before); got != 100 {
+		t.Fatalf("Expected certificate 100, got %d", got)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reloaded := make(chan error, 1)
+	go r.Watch(ctx, 10*time.Millisecond, func(err error) { reloaded <- err })
+	authority.issue(t, 200, certFile, keyFile)
+	select {
+	case err := <-reloaded:
+		if err != nil {
+			t.Fatalf("Reload failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Watch never noticed the new certificate")
+	}
+
+	after, err := r.Dial(addr)
+	if err != nil {
+		t.Fatalf("Failed to dial after rotation: %v", err)
+	}
+	defer after.Close()
+	if got := servedSerial(t, after); got != 200 {
+		t.Errorf("Expected new connections to get certificate 200, got %d", got)
+	}
+	fmt.Fprintln(before, "still here")
+	if line, err := bufio.NewReader(before).ReadString('\n'); err != nil || line != "still here\n" {
+		t.Errorf("Expected the connection from before the rotation to keep working, got %q, %v", line, err)
+	}
+	if s := r.Status(); s.Reloads != 1 || s.Subject != "CN=node 200" {
+		t.Errorf("Unexpected status %+v", s)
+	}
+}
+
+func TestBadFilesKeepTheOldCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "node.crt"), filepath.Join(dir, "node.key")
+	authority := newCA(t)
+	authority.issue(t, 100, certFile, keyFile)
+	r, err := New(certFile, keyFile, "")
+	if err != nil {
+		t.Fatalf("Failed to load: %v", err)
+	}
+
+	// Halfway through a rotation: the new certificate is there, its key isn't.
+	other := filepath.Join(dir, "other.key")
+	authority.issue(t, 200, certFile, other)
+	if err := r.Reload(); err == nil {
+		t.Fatal("Expected a certificate that doesn't match its key to fail")
+	}
+	if s := r.Status(); s.Subject != "CN=node 100" || s.LastError == "" {
+		t.Errorf("Expected certificate 100 still in use with the error recorded, got %+v", s)
+	}
+
+	key, _ := os.ReadFile(other)
+	write(t, keyFile, key)
+	if err := r.Reload(); err != nil {
+		t.Fatalf("Failed to reload the finished rotation: %v", err)
+	}
+	if s := r.Status(); s.Subject != "CN=node 200" || s.LastError != "" {
+		t.Errorf("Expected certificate 200 with no error, got %+v", s)
+	}
+}
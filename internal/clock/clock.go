@@ -0,0 +1,60 @@
+// Package clock is where raft timeouts, TTLs, locks and metrics get the
+// time, so a test can hold it still or move it by hand with a Fake instead
+// of sleeping.
+//
+// System is the real clock. The times its Now returns carry Go's monotonic
+// reading, so durations between them, through Since or Time.Sub, are
+// unaffected when the wall clock is stepped: an election timeout or the
+// age of the last heartbeat never jumps with NTP. Only what has to mean the
+// same instant on every node, like a key's expiry in unix milliseconds, is
+// read off the wall clock, and that is explicit at the call site.
+package clock
+
+import "time"
+
+// Clock tells the time and makes timers running on it.
+type Clock interface {
+	Now() time.Time
+	Since(t time.Time) time.Duration
+	Sleep(d time.Duration)
+	NewTimer(d time.Duration) Timer
+	NewTicker(d time.Duration) Ticker
+	After(d time.Duration) <-chan time.Time
+}
+
+// Timer is a time.Timer running on a Clock.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// Ticker is a time.Ticker running on a Clock.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// System is the real, monotonic clock, the default everywhere.
+var System Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) Since(t time.Time) time.Duration        { return time.Since(t) }
+func (systemClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+func (systemClock) NewTimer(d time.Duration) Timer   { return systemTimer{time.NewTimer(d)} }
+func (systemClock) NewTicker(d time.Duration) Ticker { return systemTicker{time.NewTicker(d)} }
+
+type systemTimer struct{ t *time.Timer }
+
+func (t systemTimer) C() <-chan time.Time        { return t.t.C }
+func (t systemTimer) Stop() bool                 { return t.t.Stop() }
+func (t systemTimer) Reset(d time.Duration) bool { return t.t.Reset(d) }
+
+type systemTicker struct{ t *time.Ticker }
+
+func (t systemTicker) C() <-chan time.Time { return t.t.C }
+func (t systemTicker) Stop()               { t.t.Stop() }
@@ -0,0 +1,52 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeFiresOnlyWhenAdvanced(t *testing.T) {
+	start := time.Unix(1000, 0)
+	f := NewFake(start)
+	timer := f.NewTimer(time.Second)
+	ticker := f.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	f.Advance(999 * time.Millisecond)
+	select {
+	case <-timer.C():
+		t.Fatal("timer fired early")
+	default:
+	}
+	<-ticker.C() // one tick for the nine that were due
+	select {
+	case <-ticker.C():
+		t.Fatal("expected missed ticks dropped")
+	default:
+	}
+
+	f.Advance(time.Millisecond)
+	if got := <-timer.C(); !got.Equal(start.Add(time.Second)) {
+		t.Errorf("timer fired at %v", got)
+	}
+	if f.Since(start) != time.Second {
+		t.Errorf("expected a second gone, got %v", f.Since(start))
+	}
+	if timer.Stop() {
+		t.Error("expected a fired timer to be stopped already")
+	}
+	if f.Timers() != 1 {
+		t.Errorf("expected only the ticker armed, got %d", f.Timers())
+	}
+
+	slept := make(chan struct{})
+	go func() {
+		f.Sleep(time.Minute)
+		close(slept)
+	}()
+	for f.Timers() != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	f.Advance(time.Minute)
+	<-slept
+}
@@ -0,0 +1,117 @@
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Fake is a Clock that only moves when Advance is called, for tests.
+// Timers and tickers on it fire during the Advance that reaches them; a
+// ticker passed over several times fires once, as a time.Ticker whose
+// reader is slow would.
+type Fake struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers map[*fakeTimer]bool // the ones armed
+}
+
+// NewFake returns a Fake reading start.
+func NewFake(start time.Time) *Fake {
+	return &Fake{now: start, timers: make(map[*fakeTimer]bool)}
+}
+
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *Fake) Since(t time.Time) time.Duration { return f.Now().Sub(t) }
+
+// Sleep returns once the clock has been advanced by d.
+func (f *Fake) Sleep(d time.Duration) { <-f.After(d) }
+
+func (f *Fake) After(d time.Duration) <-chan time.Time { return f.NewTimer(d).C() }
+
+func (f *Fake) NewTimer(d time.Duration) Timer { return f.arm(d, 0) }
+
+func (f *Fake) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("clock: non-positive interval for NewTicker")
+	}
+	return fakeTicker{f.arm(d, d)}
+}
+
+// Advance moves the clock on by d and fires what came due.
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+	for t := range f.timers {
+		if t.at.After(f.now) {
+			continue
+		}
+		select {
+		case t.c <- f.now:
+		default: // the last tick hasn't been read
+		}
+		if t.period == 0 {
+			delete(f.timers, t)
+			continue
+		}
+		for !t.at.After(f.now) {
+			t.at = t.at.Add(t.period)
+		}
+	}
+}
+
+// Timers is how many timers and tickers are armed, so a test can wait for
+// the code under it to start waiting before it advances.
+func (f *Fake) Timers() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.timers)
+}
+
+func (f *Fake) arm(d, period time.Duration) *fakeTimer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t := &fakeTimer{f: f, at: f.now.Add(d), period: period, c: make(chan time.Time, 1)}
+	if d <= 0 {
+		t.c <- f.now
+		return t
+	}
+	f.timers[t] = true
+	return t
+}
+
+// fakeTimer is a Timer on a Fake, and under a fakeTicker a Ticker.
+type fakeTimer struct {
+	f      *Fake
+	at     time.Time     // when it fires next
+	period time.Duration // 0 for a timer
+	c      chan time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.c }
+
+func (t *fakeTimer) Stop() bool {
+	t.f.mu.Lock()
+	defer t.f.mu.Unlock()
+	armed := t.f.timers[t]
+	delete(t.f.timers, t)
+	return armed
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.f.mu.Lock()
+	defer t.f.mu.Unlock()
+	armed := t.f.timers[t]
+	t.at = t.f.now.Add(d)
+	t.f.timers[t] = true
+	return armed
+}
+
+type fakeTicker struct{ *fakeTimer }
+
+func (t fakeTicker) Stop() { t.fakeTimer.Stop() }
@@ -0,0 +1,71 @@
+package clustertest
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// The request loop from end to end, line in to reply out, on a one-node
+// cluster so a SET commits without waiting on a follower. The allocations
+// are the whole process's, server and in-memory network alike, e.g.
+//
+//	go test -run '^$' -bench . -benchmem ./internal/clustertest
+
+// benchConn dials the leader of a new one-node cluster with key set.
+func benchConn(b *testing.B) (net.Conn, *bufio.Reader) {
+	c := New(b, Options{Nodes: 1})
+	leader := c.WaitLeader(5 * time.Second)
+	if leader < 0 {
+		b.Fatal("no leader")
+	}
+	if err := c.Write(context.Background(), "bench:key", "initial-value"); err != nil {
+		b.Fatal(err)
+	}
+	conn, err := c.Net.Dial(c.Nodes[leader].ID)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { conn.Close() })
+	return conn, bufio.NewReader(conn)
+}
+
+// roundTrip sends line and reads the reply, which has to be want.
+func roundTrip(b *testing.B, conn net.Conn, r *bufio.Reader, line []byte, want string) {
+	if _, err := conn.Write(line); err != nil {
+		b.Fatal(err)
+	}
+	reply, err := r.ReadSlice('\n')
+	if err != nil {
+		b.Fatal(err)
+	}
+	if string(reply[:len(reply)-1]) != want {
+		b.Fatalf("%q answered %q, expected %q", line, reply, want)
+	}
+}
+
+func BenchmarkGet(b *testing.B) {
+	conn, r := benchConn(b)
+	line := []byte("GET bench:key\n")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		roundTrip(b, conn, r, line, "initial-value")
+	}
+}
+
+func BenchmarkSet(b *testing.B) {
+	conn, r := benchConn(b)
+	lines := make([][]byte, 64) // built up front, so formatting them isn't measured
+	for i := range lines {
+		lines[i] = fmt.Appendf(nil, "SET bench:key value %d\n", i)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		roundTrip(b, conn, r, lines[i%len(lines)], "OK")
+	}
+}
@@ -0,0 +1,95 @@
+package clustertest
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ChaosOptions shape a Chaos run.
+type ChaosOptions struct {
+	Duration time.Duration // how long to keep killing nodes
+	Writers  int           // goroutines writing meanwhile, 4 if 0
+	Seed     uint64        // picks the victims and the timing; the run logs it
+	MaxDown  time.Duration // longest a node stays down once it may restart, 200ms if 0
+	Timeout  time.Duration // for elections and catching up, 10s if 0
+}
+
+// Chaos writes fresh keys from several goroutines while it kills random
+// nodes, the leader as often as not, at random moments and restarts them,
+// checking the logs after every round. Once the time is up it lets the
+// cluster converge and checks every acked write survived.
+//
+// One node is down at a time, and it only comes back once the others have
+// a leader. A restarted node rejoins with an empty raft log and only its
+// data WAL replayed, so if it came back mid-election it could vote for a
+// node missing entries the old leader committed. Before the next kill it
+// has to catch up, for the same reason.
+func (c *Cluster) Chaos(opts ChaosOptions) {
+	c.t.Helper()
+	if opts.Writers == 0 {
+		opts.Writers = 4
+	}
+	if opts.MaxDown == 0 {
+		opts.MaxDown = 200 * time.Millisecond
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	c.t.Logf("Chaos seed %d", opts.Seed)
+	rng := rand.New(rand.NewPCG(opts.Seed, opts.Seed))
+	jitter := func(d time.Duration) time.Duration { return time.Duration(rng.Int64N(int64(d) + 1)) }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var (
+		wg     sync.WaitGroup
+		next   atomic.Int64
+		failed atomic.Int64
+	)
+	for range opts.Writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				n := next.Add(1)
+				wctx, done := context.WithTimeout(ctx, 2*c.opts.RequestTimeout)
+				err := c.Write(wctx, fmt.Sprintf("key-%d", n), fmt.Sprintf("value-%d", n))
+				done()
+				if err != nil {
+					failed.Add(1)
+					time.Sleep(5 * time.Millisecond) // no leader yet, most likely
+				}
+			}
+		}()
+	}
+
+	c.WaitLeader(opts.Timeout)
+	kills := 0
+	for end := time.Now().Add(opts.Duration); time.Now().Before(end); kills++ {
+		time.Sleep(jitter(opts.MaxDown))
+		victim := rng.IntN(len(c.Nodes))
+		if rng.IntN(2) == 0 {
+			victim = max(c.Leader(), 0)
+		}
+		c.Kill(victim)
+		c.CheckLogs()
+
+		c.WaitLeader(opts.Timeout) // among the survivors
+		time.Sleep(jitter(opts.MaxDown))
+		leader := c.WaitLeader(opts.Timeout)
+		target := c.Nodes[leader].Raft.GetCommitIndex()
+		c.Restart(victim)
+		c.WaitCommitted(victim, target, opts.Timeout)
+		c.CheckLogs()
+	}
+	cancel()
+	wg.Wait()
+
+	c.WaitConverged(opts.Timeout)
+	c.CheckLogs()
+	c.CheckWrites()
+	c.t.Logf("Chaos: %d kills, %d writes acked, %d failed", kills, c.Acked(), failed.Load())
+}
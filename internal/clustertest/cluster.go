@@ -0,0 +1,395 @@
+// Package clustertest runs whole clusters inside a test: every node has its
+// real WAL, raft log and server, but they talk over an in-memory network so
+// nodes can be killed and restarted at any moment without ports or
+// processes. The checks then hold the cluster to Raft's promises: a write a
+// client got OK for is never lost, and an entry a node committed is never
+// replaced on any node.
+//
+// All the nodes share one process, so failpoints apply to all of them.
+package clustertest
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mathdee/KV-Store/internal/clock"
+	"github.com/mathdee/KV-Store/internal/durability"
+	"github.com/mathdee/KV-Store/internal/raft"
+	"github.com/mathdee/KV-Store/internal/server"
+	"github.com/mathdee/KV-Store/internal/store"
+	"github.com/mathdee/KV-Store/internal/wal"
+)
+
+// Options tune a cluster; the zero value gives three nodes.
+type Options struct {
+	Nodes             int           // 3 if 0
+	SnapshotThreshold int           // raft.DefaultSnapshotThreshold if 0
+	WindowEntries     int           // most entries per APPENDENTRIES, raft.DefaultWindowEntries if 0
+	RequestTimeout    time.Duration // how long a write waits for a majority, 1s if 0
+	Clock             clock.Clock   // what stores and servers read the time from, clock.System if nil; raft keeps the real one so elections go on
+}
+
+// Cluster is a set of nodes on one Network.
+type Cluster struct {
+	t     testing.TB
+	opts  Options
+	dir   string
+	Net   *Network
+	Nodes []*Node
+
+	mu        sync.Mutex            // guards the maps below and each node's up, Raft, Store and Server
+	acked     map[string]string     // every write a client got OK for
+	committed map[int]raft.LogEntry // entries seen committed on some node, by index
+	firstSeen map[int]string        // node each of those was first seen on
+}
+
+// Node is one member of the cluster. Its fields belong to the current
+// incarnation and are replaced by Restart, under the cluster's lock:
+// goroutines other than the one killing and restarting nodes go through
+// Leader and Up.
+type Node struct {
+	ID     string
+	Raft   *raft.Consensus
+	Store  *store.Store
+	Server *server.Server
+
+	walPath string
+	wal     *wal.WAL
+	durable *durability.Layer
+	host    *Host
+	up      bool
+	stop    context.CancelFunc // ends the node's RunApply
+}
+
+// New starts a cluster whose files live in a temporary directory; it is
+// shut down when the test ends.
+func New(t testing.TB, opts Options) *Cluster {
+	if opts.Nodes == 0 {
+		opts.Nodes = 3
+	}
+	if opts.SnapshotThreshold == 0 {
+		opts.SnapshotThreshold = raft.DefaultSnapshotThreshold
+	}
+	if opts.WindowEntries == 0 {
+		opts.WindowEntries = raft.DefaultWindowEntries
+	}
+	if opts.RequestTimeout == 0 {
+		opts.RequestTimeout = time.Second
+	}
+	c := &Cluster{
+		t:         t,
+		opts:      opts,
+		dir:       t.TempDir(),
+		Net:       NewNetwork(),
+		acked:     make(map[string]string),
+		committed: make(map[int]raft.LogEntry),
+		firstSeen: make(map[int]string),
+	}
+	for i := range opts.Nodes {
+		id := fmt.Sprintf("node-%d", i+1)
+		c.Nodes = append(c.Nodes, &Node{ID: id, walPath: filepath.Join(c.dir, "server_"+id+".log")})
+	}
+	for _, n := range c.Nodes {
+		c.start(n)
+	}
+	t.Cleanup(c.Close)
+	return c
+}
+
+// start brings up a new incarnation of n from its files, the way
+// cmd/server does: the data WAL is replayed into the store, and raft picks
+// up its log, term and vote where they were, past the entries the store
+// had applied.
+func (c *Cluster) start(n *Node) {
+	c.t.Helper()
+	w, err := wal.NewWAL(n.walPath)
+	if err != nil {
+		c.t.Fatalf("%s: failed to open WAL: %v", n.ID, err)
+	}
+	s := store.NewStore(w)
+	if c.opts.Clock != nil {
+		s.SetClock(c.opts.Clock)
+	}
+	if _, err := s.Recover(n.walPath, wal.RecoverOptions{}); err != nil {
+		c.t.Fatalf("%s: failed to recover WAL: %v", n.ID, err)
+	}
+	var peers []string
+	for _, other := range c.Nodes {
+		if other != n {
+			peers = append(peers, other.ID)
+		}
+	}
+	host, err := c.Net.Host(n.ID)
+	if err != nil {
+		c.t.Fatalf("%s: %v", n.ID, err)
+	}
+	consensus := raft.NewConsensus(n.ID, peers)
+	consensus.SetTransport(host)
+	raftPath := strings.TrimSuffix(n.walPath, ".log") + ".raft.log"
+	l, err := durability.ReadLog(raftPath)
+	if err != nil {
+		c.t.Fatalf("%s: failed to read raft log: %v", n.ID, err)
+	}
+	consensus.Restore(l.Offset, l.Term, l.Entries, l.State, s.Applied())
+	durable, err := durability.Open(raftPath, w)
+	if err != nil {
+		c.t.Fatalf("%s: failed to open raft log: %v", n.ID, err)
+	}
+	consensus.SetLogStore(durable)
+	consensus.SetReplicationWindow(c.opts.WindowEntries, raft.DefaultWindowBytes)
+	consensus.Start()
+	srv := server.NewServer(s, consensus)
+	srv.SetRequestTimeout(c.opts.RequestTimeout)
+	if c.opts.Clock != nil {
+		srv.SetClock(c.opts.Clock)
+	}
+	srv.SetWAL(w)
+	consensus.SetSnapshotter(srv, c.opts.SnapshotThreshold)
+	consensus.SetDigestSource(srv)
+	go srv.Serve(host)
+	ctx, stop := context.WithCancel(context.Background())
+	go srv.RunApply(ctx)
+
+	c.mu.Lock() // Leader reads them from the writers' goroutines
+	n.Raft, n.Store, n.Server = consensus, s, srv
+	n.wal, n.durable, n.host, n.up, n.stop = w, durable, host, true, stop
+	c.mu.Unlock()
+}
+
+// Kill crashes node i: its connections drop, its raft loop stops and its
+// files are closed with whatever reached them. Writes it hadn't synced yet
+// fail, so nobody gets an OK for them.
+func (c *Cluster) Kill(i int) {
+	n := c.Nodes[i]
+	c.mu.Lock()
+	up := n.up
+	n.up = false
+	c.mu.Unlock()
+	if !up {
+		return
+	}
+	n.host.Crash()
+	n.stop()
+	n.Raft.Stop()
+	n.durable.Close()
+	n.wal.Close()
+}
+
+// Restart brings a killed node i back from its files.
+func (c *Cluster) Restart(i int) {
+	c.t.Helper()
+	if !c.Up(i) {
+		c.start(c.Nodes[i])
+	}
+}
+
+// Up reports whether node i is running.
+func (c *Cluster) Up(i int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Nodes[i].up
+}
+
+// Close kills every node.
+func (c *Cluster) Close() {
+	for i := range c.Nodes {
+		c.Kill(i)
+	}
+}
+
+// Partition splits the running nodes into groups of node indexes that only
+// reach each other. Clients still reach every node.
+func (c *Cluster) Partition(groups ...[]int) {
+	ids := make([][]string, len(groups))
+	for g, group := range groups {
+		for _, i := range group {
+			ids[g] = append(ids[g], c.Nodes[i].ID)
+		}
+	}
+	for _, n := range c.Nodes {
+		n.Raft.Faults().Partition(ids)
+	}
+}
+
+// Heal undoes Partition.
+func (c *Cluster) Heal() {
+	for _, n := range c.Nodes {
+		n.Raft.Faults().Heal()
+	}
+}
+
+// Leader returns the index of the running leader with the newest term, or
+// -1 if there is none.
+func (c *Cluster) Leader() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	leader, term := -1, -1
+	for i, n := range c.Nodes {
+		if n.up && n.Raft.GetState() == raft.Leader && n.Raft.GetTerm() > term {
+			leader, term = i, n.Raft.GetTerm()
+		}
+	}
+	return leader
+}
+
+// WaitLeader waits for a running node to lead and returns its index.
+func (c *Cluster) WaitLeader(timeout time.Duration) int {
+	c.t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if l := c.Leader(); l >= 0 {
+			return l
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.t.Fatalf("No leader elected within %v", timeout)
+	return -1
+}
+
+// WaitCommitted waits until node i has committed index and applied it to
+// its store. Followers raise their commit index before applying.
+func (c *Cluster) WaitCommitted(i, index int, timeout time.Duration) {
+	c.t.Helper()
+	deadline := time.Now().Add(timeout)
+	n := c.Nodes[i]
+	for n.Raft.GetCommitIndex() < index || n.Server.Applied() < index {
+		if time.Now().After(deadline) {
+			c.t.Fatalf("%s committed %d and applied %d within %v, expected %d", n.ID, n.Raft.GetCommitIndex(), n.Server.Applied(), timeout, index)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// WaitConverged waits until every running node has committed everything
+// the leader has, with no writes coming in.
+func (c *Cluster) WaitConverged(timeout time.Duration) {
+	c.t.Helper()
+	deadline := time.Now().Add(timeout)
+	leader := c.WaitLeader(timeout)
+	for i := range c.Nodes {
+		if c.Up(i) {
+			c.WaitCommitted(i, c.Nodes[leader].Raft.GetLogLength()-1, time.Until(deadline))
+		}
+	}
+}
+
+// Do sends one command to node i and returns its reply line.
+func (c *Cluster) Do(ctx context.Context, i int, args ...string) (string, error) {
+	conn, err := c.Net.Dial(c.Nodes[i].ID)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := fmt.Fprintln(conn, strings.Join(args, " ")); err != nil {
+		return "", err
+	}
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	return strings.TrimSpace(reply), err
+}
+
+// Write sets key to value through the leader and remembers it if the
+// leader says OK.
+func (c *Cluster) Write(ctx context.Context, key, value string) error {
+	leader := c.Leader()
+	if leader < 0 {
+		return fmt.Errorf("no leader")
+	}
+	reply, err := c.Do(ctx, leader, "SET", key, value)
+	if err != nil {
+		return err
+	}
+	if reply != "OK" {
+		return fmt.Errorf("%s: %s", c.Nodes[leader].ID, reply)
+	}
+	c.mu.Lock()
+	c.acked[key] = value
+	c.mu.Unlock()
+	return nil
+}
+
+// Acked is the number of writes that got an OK.
+func (c *Cluster) Acked() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.acked)
+}
+
+// CheckLogs compares what every running node has committed against every
+// committed entry seen so far, on any node and at any earlier check. An
+// entry that differs means two nodes committed different things at the
+// same index, or one took back an entry it had committed.
+func (c *Cluster) CheckLogs() {
+	c.t.Helper()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, n := range c.Nodes {
+		if !n.up {
+			continue
+		}
+		commit := n.Raft.GetCommitIndex() // read first: anything up to it stays committed
+		first := n.Raft.FirstIndex()
+		for i, e := range n.Raft.EntriesFrom(first, commit-first+1) {
+			index := first + i
+			seen, ok := c.committed[index]
+			if !ok {
+				c.committed[index], c.firstSeen[index] = e, n.ID
+				continue
+			}
+			if seen != e {
+				c.t.Errorf("Logs diverged at index %d: %s has %+v, %s committed %+v", index, n.ID, e, c.firstSeen[index], seen)
+			}
+		}
+	}
+}
+
+// CheckWrites makes sure every running node holds every acked write.
+// Call it once the cluster has converged. A follower applies the entries
+// of concurrent APPENDENTRIES in parallel, so its applied index can pass
+// an entry still being applied; a missing write gets a few seconds to
+// show up before it counts as lost.
+func (c *Cluster) CheckWrites() {
+	c.t.Helper()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	deadline := time.Now().Add(5 * time.Second)
+	for _, n := range c.Nodes {
+		if !n.up {
+			continue
+		}
+		missing := c.missing(n)
+		for len(missing) > 0 && time.Now().Before(deadline) {
+			time.Sleep(50 * time.Millisecond)
+			missing = c.missing(n)
+		}
+		for i, key := range missing {
+			if i == 5 {
+				c.t.Errorf("%s lost %d acked writes in all", n.ID, len(missing))
+				break
+			}
+			got, err := n.Store.Get(key)
+			c.t.Errorf("%s lost acked write %s=%s (has %q, %v)", n.ID, key, c.acked[key], got, err)
+		}
+	}
+}
+
+// missing lists the acked writes n doesn't hold. Callers hold c.mu.
+func (c *Cluster) missing(n *Node) []string {
+	var keys []string
+	for key, want := range c.acked {
+		if got, err := n.Store.Get(key); err != nil || got != want {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,651 @@
+package clustertest
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mathdee/KV-Store/internal/clock"
+	"github.com/mathdee/KV-Store/internal/protocol"
+	"github.com/mathdee/KV-Store/internal/raft"
+	"github.com/mathdee/KV-Store/internal/server"
+	"github.com/mathdee/KV-Store/internal/store"
+	"github.com/mathdee/KV-Store/internal/wal"
+)
+
+func TestWritesSurviveRestarts(t *testing.T) {
+	c := New(t, Options{})
+	ctx := context.Background()
+	c.WaitLeader(5 * time.Second)
+	if err := c.Write(ctx, "before", "1"); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	leader := c.Leader()
+	c.Kill(leader)
+	c.WaitLeader(5 * time.Second)
+	if err := c.Write(ctx, "during", "2"); err != nil {
+		t.Fatalf("Write with one node down failed: %v", err)
+	}
+	c.Restart(leader)
+
+	c.WaitConverged(5 * time.Second)
+	c.CheckLogs()
+	c.CheckWrites()
+	if got, err := c.Do(ctx, leader, "GET", "during"); err != nil || got != "2" {
+		t.Errorf("Restarted node answered %q, %v", got, err)
+	}
+}
+
+func TestChaos(t *testing.T) {
+	duration := 4 * time.Second
+	if testing.Short() {
+		duration = time.Second
+	}
+	c := New(t, Options{SnapshotThreshold: 200}) // restarted nodes often catch up by snapshot
+	c.Chaos(ChaosOptions{Duration: duration, Seed: uint64(time.Now().UnixNano())})
+	if c.Acked() == 0 {
+		t.Error("No write was acked")
+	}
+}
+
+func TestDigestsCatchDivergence(t *testing.T) {
+	c := New(t, Options{})
+	ctx := context.Background()
+	leader := c.WaitLeader(5 * time.Second)
+	if err := c.Write(ctx, "a", "1"); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	c.WaitConverged(5 * time.Second)
+	follower := (leader + 1) % len(c.Nodes)
+	waitDigests(t, c, func() bool { return c.Nodes[follower].Server.DigestStatus().Checks > 0 })
+	if st := c.Nodes[follower].Server.DigestStatus(); st.Mismatches != 0 {
+		t.Fatalf("Expected matching digests before the damage, got %+v", st)
+	}
+
+	c.Nodes[follower].Store.Set("a", "damaged") // behind raft's back
+	if err := c.Write(ctx, "b", "2"); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	waitDigests(t, c, func() bool { return c.Nodes[follower].Server.DigestStatus().Mismatches > 0 })
+	st := c.Nodes[follower].Server.DigestStatus()
+	if m := st.LastMismatch; m == nil || m.Leader != c.Nodes[leader].ID || len(m.Shards) != 1 || m.Shards[0] != store.DigestShard("a") {
+		t.Errorf("Expected a mismatch in a's shard reported against the leader, got %+v", st.LastMismatch)
+	}
+	if other := c.Nodes[(leader+2)%len(c.Nodes)].Server.DigestStatus(); other.Mismatches != 0 {
+		t.Errorf("Expected the undamaged follower to match, got %+v", other)
+	}
+}
+
+func waitDigests(t *testing.T, c *Cluster, done func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Digests weren't compared in time")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestAntiEntropyRepairsFollower(t *testing.T) {
+	c := New(t, Options{})
+	ctx := context.Background()
+	leader := c.WaitLeader(5 * time.Second)
+	for _, k := range []string{"a", "b", "c"} {
+		if err := c.Write(ctx, k, "1"); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	c.WaitConverged(5 * time.Second)
+
+	follower := c.Nodes[(leader+1)%len(c.Nodes)]
+	follower.Store.Set("a", "damaged") // behind raft's back
+	follower.Store.Set("extra", "x")
+	follower.Store.GetDel(ctx, "b")
+	if err := follower.Server.AntiEntropy(ctx, c.Nodes[leader].ID); err != nil {
+		t.Fatalf("Anti-entropy failed: %v", err)
+	}
+	if got, err := follower.Store.Get("a"); err != nil || got != "1" {
+		t.Errorf("Expected a repaired to 1, got %q %v", got, err)
+	}
+	if got, err := follower.Store.Get("b"); err != nil || got != "1" {
+		t.Errorf("Expected b restored, got %q %v", got, err)
+	}
+	if _, err := follower.Store.Get("extra"); err == nil {
+		t.Error("Expected the extra key removed")
+	}
+	if follower.Store.Digest() != c.Nodes[leader].Store.Digest() {
+		t.Error("Expected the digests to match after the repair")
+	}
+	if st := follower.Server.DigestStatus(); st.Repairs != 1 || st.RepairedKeys != 3 {
+		t.Errorf("Expected one repair of 3 keys, got %+v", st)
+	}
+}
+
+func TestResyncTransfersOnlyDifferingRanges(t *testing.T) {
+	c := New(t, Options{})
+	ctx := context.Background()
+	leader := c.WaitLeader(5 * time.Second)
+	for i := range 300 {
+		if err := c.Write(ctx, fmt.Sprintf("key-%d", i), "1"); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	c.WaitConverged(5 * time.Second)
+
+	follower := c.Nodes[(leader+1)%len(c.Nodes)]
+	follower.Store.Set("key-1", "damaged") // behind raft's back
+	follower.Store.Set("extra", "x")
+	follower.Store.GetDel(ctx, "key-2")
+
+	// Writes keep coming while it runs; the follower holds them back.
+	writes := make(chan error, 1)
+	go func() {
+		for i := range 20 {
+			if err := c.Write(ctx, fmt.Sprintf("during-%d", i), "1"); err != nil {
+				writes <- err
+				return
+			}
+		}
+		writes <- nil
+	}()
+	report, err := follower.Server.Resync(ctx)
+	if err != nil {
+		t.Fatalf("Resync failed: %v (%+v)", err, report)
+	}
+	if err := <-writes; err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if !report.RootMatch || report.KeysChanged != 3 {
+		t.Errorf("Expected 3 keys changed and matching roots, got %+v", report)
+	}
+	if report.KeysTransferred >= report.LeaderKeys {
+		t.Errorf("Expected only the differing ranges transferred, got %+v", report)
+	}
+	c.WaitConverged(5 * time.Second)
+	waitDigests(t, c, func() bool { return follower.Store.Digest() == c.Nodes[leader].Store.Digest() })
+}
+
+// incrBy is INCRBY key n, a command added with server.RegisterCommand.
+func incrBy(ctx context.Context, st server.Store, parts protocol.Command) (string, error) {
+	by, err := parts.Int(2)
+	if len(parts) != 3 || err != nil {
+		return "", &server.Error{Code: server.CodeSyntax, Text: "usage: INCRBY key n"}
+	}
+	n := 0
+	if v, err := st.Get(parts[1]); err == nil {
+		if n, err = strconv.Atoi(v); err != nil {
+			return "", &server.Error{Code: server.CodeSyntax, Text: "value is not an integer"}
+		}
+	}
+	n += by
+	return strconv.Itoa(n), st.SetContext(ctx, parts[1], strconv.Itoa(n))
+}
+
+var registerIncrBy = sync.OnceValue(func() error { return server.RegisterCommand("INCRBY", incrBy) })
+
+func TestRegisteredCommandReplicates(t *testing.T) {
+	if err := registerIncrBy(); err != nil {
+		t.Fatalf("RegisterCommand failed: %v", err)
+	}
+	if err := server.RegisterCommand("SET", incrBy); err == nil {
+		t.Error("Expected registering over SET to fail")
+	}
+	c := New(t, Options{})
+	ctx := context.Background()
+	leader := c.WaitLeader(5 * time.Second)
+	if got, err := c.Do(ctx, leader, "INCRBY", "counter", "2"); err != nil || got != "2" {
+		t.Fatalf("INCRBY answered %q, %v", got, err)
+	}
+	if got, err := c.Do(ctx, leader, "INCRBY", "counter", "3"); err != nil || got != "5" {
+		t.Fatalf("INCRBY answered %q, %v", got, err)
+	}
+	if got, _ := c.Do(ctx, leader, "INCRBY", "counter"); got != "ERR usage: INCRBY key n" {
+		t.Errorf("Expected the usage error, got %q", got)
+	}
+
+	c.WaitConverged(5 * time.Second)
+	c.CheckLogs()
+	for _, n := range c.Nodes {
+		if got, err := n.Store.Get("counter"); err != nil || got != "5" {
+			t.Errorf("%s has counter %q %v, want 5", n.ID, got, err)
+		}
+	}
+
+	// What a follower applied from the log went through its WAL.
+	follower := c.Nodes[(leader+1)%len(c.Nodes)]
+	c.Kill((leader + 1) % len(c.Nodes))
+	w, err := wal.NewWAL(follower.walPath)
+	if err != nil {
+		t.Fatalf("Failed to open the WAL: %v", err)
+	}
+	defer w.Close()
+	recovered := store.NewStore(w)
+	if _, err := recovered.Recover(follower.walPath, wal.RecoverOptions{}); err != nil {
+		t.Fatalf("Failed to recover the WAL: %v", err)
+	}
+	if got, err := recovered.Get("counter"); err != nil || got != "5" {
+		t.Errorf("%s recovered counter %q %v, want 5", follower.ID, got, err)
+	}
+}
+
+func TestEvalIsAtomic(t *testing.T) {
+	c := New(t, Options{})
+	ctx := context.Background()
+	leader := c.WaitLeader(5 * time.Second)
+	const incr = "local n = tonumber(get(KEYS[1])) or 0 set(KEYS[1], n + ARGV[1]) return n + ARGV[1]"
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.Do(ctx, leader, "EVAL", "1", "counter", "1", "1", incr); err != nil {
+				t.Errorf("EVAL failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if got, _ := c.Do(ctx, leader, "EVAL", "1", "counter", "0", "set(KEYS[1], 'lost') error('stop')"); got != "ERR script at 21: stop" {
+		t.Errorf("Expected the script's error, got %q", got)
+	}
+	if got, _ := c.Do(ctx, leader, "EVAL", "1", "counter", "0", "return"); got != "(nil)" {
+		t.Errorf("Expected nil, got %q", got)
+	}
+	if got, _ := c.Do(ctx, leader, "EVAL", "1", "counter", "0", "return ("); !strings.HasPrefix(got, "ERR script at") {
+		t.Errorf("Expected a syntax error, got %q", got)
+	}
+
+	c.WaitConverged(5 * time.Second)
+	c.CheckLogs()
+	for _, n := range c.Nodes {
+		if got, err := n.Store.Get("counter"); err != nil || got != "20" {
+			t.Errorf("%s has counter %q %v, want 20", n.ID, got, err)
+		}
+	}
+}
+
+// doLines sends a command with a multi-line reply to node i and returns
+// the lines after the count, or the error reply.
+func doLines(t *testing.T, c *Cluster, i int, command string) []string {
+	t.Helper()
+	conn, err := c.Net.Dial(c.Nodes[i].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintln(conn, command)
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line))
+	if err != nil {
+		return []string{strings.TrimSpace(line)} // an error
+	}
+	lines := make([]string, n)
+	for j := range lines {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines[j] = strings.TrimSpace(line)
+	}
+	return lines
+}
+
+func TestTxn(t *testing.T) {
+	c := New(t, Options{})
+	leader := c.WaitLeader(5 * time.Second)
+	for _, tc := range []struct {
+		args string
+		want string
+	}{
+		{"MISSING lock THEN SET lock a SET owner a GET lock ELSE GET lock", "1 OK OK a"},
+		{"MISSING lock THEN SET lock b ELSE GET lock", "0 a"},
+		{"VALUE lock a EXISTS owner THEN DEL lock DEL nothing GET lock", "1 1 0 (nil)"},
+		{"REV missing 1 THEN", "1"},
+		{"THEN SET x 1", "1 OK"},
+		{"VALUE x", "ERR TXN: VALUE takes 2 arguments"},
+		{"GET x THEN", `ERR TXN: unexpected "GET" at argument 1`},
+		{"EXISTS x", "ERR usage: TXN guard... THEN op... [ELSE op...]"},
+	} {
+		if got := strings.Join(doLines(t, c, leader, "TXN "+tc.args), " "); got != tc.want {
+			t.Errorf("TXN %s = %q, want %q", tc.args, got, tc.want)
+		}
+	}
+	meta, _ := c.Nodes[leader].Store.Stat("owner")
+	for _, tc := range []struct {
+		args string
+		want string
+	}{
+		{fmt.Sprintf("REV owner %d THEN SET owner stale ELSE SET owner c", meta.RaftIndex), "0 OK"},
+		{fmt.Sprintf("REV owner %d THEN SET owner d", meta.RaftIndex+1), "0"}, // the ELSE above wrote owner again
+	} {
+		if got := strings.Join(doLines(t, c, leader, "TXN "+tc.args), " "); got != tc.want {
+			t.Errorf("TXN %s = %q, want %q", tc.args, got, tc.want)
+		}
+	}
+
+	c.WaitConverged(5 * time.Second)
+	c.CheckLogs()
+	for _, n := range c.Nodes {
+		if _, err := n.Store.Get("lock"); err == nil {
+			t.Errorf("%s still has the lock", n.ID)
+		}
+		if got, _ := n.Store.Get("owner"); got != "c" {
+			t.Errorf("%s has owner %q, want c", n.ID, got)
+		}
+	}
+}
+
+func TestLocks(t *testing.T) {
+	c := New(t, Options{})
+	ctx := context.Background()
+	leader := c.WaitLeader(5 * time.Second)
+	do := func(args ...string) string {
+		t.Helper()
+		reply, err := c.Do(ctx, leader, args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return reply
+	}
+
+	token := do("ACQUIRE", "jobs", "a", "10s")
+	if _, err := strconv.Atoi(token); err != nil {
+		t.Fatalf("Expected a fencing token, got %q", token)
+	}
+	if got := do("ACQUIRE", "jobs", "b", "10s"); !strings.HasPrefix(got, "ERR jobs is held by a until") {
+		t.Errorf("Expected b to be refused, got %q", got)
+	}
+	if got := do("ACQUIRE", "jobs", "a", "10s"); got != token {
+		t.Errorf("Expected a to extend its lock with token %s, got %q", token, got)
+	}
+	if got := do("RELEASE", "jobs", "b"); got != "0" {
+		t.Errorf("Expected b's release to do nothing, got %q", got)
+	}
+	if got := do("RELEASE", "jobs", "a"); got != "1" {
+		t.Errorf("Expected a to release its lock, got %q", got)
+	}
+
+	short := do("ACQUIRE", "jobs", "b", "50ms")
+	time.Sleep(100 * time.Millisecond) // b's lock runs out, whether or not it has been expired yet
+	last := do("ACQUIRE", "jobs", "a", "10s")
+	if a, b, c := parseInt(t, token), parseInt(t, short), parseInt(t, last); !(a < b && b < c) {
+		t.Errorf("Expected fencing tokens to grow, got %d %d %d", a, b, c)
+	}
+
+	c.WaitConverged(5 * time.Second)
+	for _, n := range c.Nodes {
+		if got, _ := n.Store.Get("lock:jobs"); got != last+" a" {
+			t.Errorf("%s has lock %q, want %q", n.ID, got, last+" a")
+		}
+	}
+}
+
+func TestFakeClockDrivesLocksAndExpiry(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	c := New(t, Options{Clock: clk})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	leader := c.WaitLeader(5 * time.Second)
+
+	first, _ := c.Do(ctx, leader, "ACQUIRE", "jobs", "a", "1m")
+	if got, _ := c.Do(ctx, leader, "ACQUIRE", "jobs", "b", "1m"); !strings.HasPrefix(got, "ERR jobs is held by a") {
+		t.Fatalf("Expected b to be refused, got %q", got)
+	}
+	clk.Advance(time.Minute) // a's lock runs out without anyone sleeping
+	if got, _ := c.Do(ctx, leader, "ACQUIRE", "jobs", "b", "1m"); parseInt(t, got) <= parseInt(t, first) {
+		t.Fatalf("Expected b to get the lock with a newer token than %s, got %q", first, got)
+	}
+
+	// Only the leader's expiry round removes b's lock, everywhere.
+	go c.Nodes[leader].Server.RunExpiry(ctx)
+	for clk.Timers() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	clk.Advance(time.Minute)
+	deadline := time.Now().Add(5 * time.Second)
+	for _, n := range c.Nodes {
+		for _, held := n.Store.Peek("lock:jobs"); held; _, held = n.Store.Peek("lock:jobs") {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s still has the expired lock", n.ID)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	c.CheckLogs()
+}
+
+func parseInt(t *testing.T, s string) int {
+	t.Helper()
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		t.Fatalf("Expected a number, got %q", s)
+	}
+	return n
+}
+
+func TestKeyHistory(t *testing.T) {
+	c := New(t, Options{})
+	ctx := context.Background()
+	for _, n := range c.Nodes {
+		n.Store.SetHistory(2)
+	}
+	leader := c.WaitLeader(5 * time.Second)
+	for _, cmd := range []string{"SET k 1", "SET k 2", "APPEND k 3", "GETDEL k"} {
+		if _, err := c.Do(ctx, leader, strings.Fields(cmd)...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.WaitConverged(5 * time.Second)
+	for i, n := range c.Nodes {
+		lines := doLines(t, c, i, "HISTORY k")
+		if len(lines) != 2 || !strings.HasSuffix(lines[0], " value=23") || !strings.HasSuffix(lines[1], " deleted") {
+			t.Errorf("%s has history %q, want the APPEND and the GETDEL", n.ID, lines)
+		}
+	}
+	if lines := doLines(t, c, leader, "HISTORY missing"); len(lines) != 0 {
+		t.Errorf("Expected no history for a key never written, got %q", lines)
+	}
+}
+
+func TestPeersHandshakeOnBoot(t *testing.T) {
+	c := New(t, Options{})
+	deadline := time.Now().Add(5 * time.Second)
+	for _, n := range c.Nodes {
+		for {
+			checks := n.Raft.PeerChecks()
+			ok := len(checks) == len(c.Nodes)-1
+			for _, check := range checks {
+				ok = ok && check.State == raft.HandshakeOK && check.Version == raft.ProtocolVersion
+			}
+			if ok {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s never completed its handshakes: %+v", n.ID, checks)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestLaggingFollowerCatchesUpAWindowAtATime(t *testing.T) {
+	c := New(t, Options{WindowEntries: 4, SnapshotThreshold: 1 << 20}) // no snapshots, only windows
+	ctx := context.Background()
+	leader := c.WaitLeader(5 * time.Second)
+	lagging := (leader + 1) % len(c.Nodes)
+	c.Kill(lagging)
+	for i := range 50 {
+		if err := c.Write(ctx, fmt.Sprintf("k%d", i), "v"); err != nil {
+			t.Fatalf("Write with one node down failed: %v", err)
+		}
+	}
+	c.Restart(lagging)
+	c.WaitConverged(10 * time.Second)
+	c.CheckLogs()
+	c.CheckWrites()
+
+	for _, st := range c.Nodes[c.Leader()].Raft.FlowStats() {
+		if st.Peer == c.Nodes[lagging].ID && st.Throttled == 0 {
+			t.Errorf("Expected the window to hold back replication to %s, got %+v", st.Peer, st)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	st := c.Nodes[lagging].Server.ApplyStats()
+	for st.Entries < 50 && time.Now().Before(deadline) { // the last commit index comes with a heartbeat
+		time.Sleep(10 * time.Millisecond)
+		st = c.Nodes[lagging].Server.ApplyStats()
+	}
+	if st.Entries < 50 || st.Batches >= st.Entries {
+		t.Errorf("Expected the restarted node to apply the writes it missed in batches, got %+v", st)
+	}
+}
+
+func TestPartitionedLeaderAppliesNothingUncommitted(t *testing.T) {
+	c := New(t, Options{RequestTimeout: 300 * time.Millisecond})
+	ctx := context.Background()
+	old := c.WaitLeader(5 * time.Second)
+	if err := c.Write(ctx, "x", "before"); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	c.WaitConverged(5 * time.Second)
+
+	var rest []int
+	for i := range c.Nodes {
+		if i != old {
+			rest = append(rest, i)
+		}
+	}
+	c.Partition([]int{old}, rest)
+	if reply, _ := c.Do(ctx, old, "SET", "x", "lost"); reply == "OK" {
+		t.Fatal("Expected the cut off leader not to ack")
+	}
+	if got, _ := c.Nodes[old].Store.Get("x"); got != "before" {
+		t.Fatalf("Expected the cut off leader to leave x alone, got %q", got)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for c.Leader() == old || c.Leader() < 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("The majority elected no leader")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := c.Write(ctx, "y", "new"); err != nil {
+		t.Fatalf("Write on the majority side failed: %v", err)
+	}
+	c.Heal()
+	c.WaitConverged(5 * time.Second)
+	c.CheckLogs()
+	c.CheckWrites()
+	for k, want := range map[string]string{"x": "before", "y": "new"} {
+		if got, _ := c.Nodes[old].Store.Get(k); got != want {
+			t.Errorf("Expected the old leader to hold %s=%q after healing, got %q", k, want, got)
+		}
+	}
+}
+
+// expectEverywhere fails unless every running node's store holds key=want.
+func expectEverywhere(t *testing.T, c *Cluster, key, want string) {
+	t.Helper()
+	c.WaitConverged(5 * time.Second)
+	for i, n := range c.Nodes {
+		if !c.Up(i) {
+			continue
+		}
+		if got, _ := n.Store.Get(key); got != want {
+			t.Errorf("%s holds %s=%q, want %q", n.ID, key, got, want)
+		}
+	}
+}
+
+func TestRestartedNodesApplyNothingTwice(t *testing.T) {
+	c := New(t, Options{})
+	ctx := context.Background()
+	leader := c.WaitLeader(5 * time.Second)
+	for range 3 {
+		if reply, err := c.Do(ctx, leader, "APPEND", "k", "x"); err != nil || strings.HasPrefix(reply, "ERR") {
+			t.Fatalf("APPEND failed: %q %v", reply, err)
+		}
+	}
+	expectEverywhere(t, c, "k", "xxx")
+
+	follower := (leader + 1) % len(c.Nodes)
+	c.Kill(follower)
+	c.Restart(follower)
+	expectEverywhere(t, c, "k", "xxx")
+
+	leader = c.Leader()
+	term := c.Nodes[leader].Raft.GetTerm()
+	c.Kill(leader)
+	c.Restart(leader)
+	expectEverywhere(t, c, "k", "xxx")
+
+	for i := range c.Nodes {
+		c.Kill(i)
+	}
+	for i := range c.Nodes {
+		c.Restart(i)
+	}
+	leader = c.WaitLeader(5 * time.Second)
+	if got := c.Nodes[leader].Raft.GetTerm(); got <= term {
+		t.Errorf("Expected the restarted cluster past term %d, it leads in %d", term, got)
+	}
+	expectEverywhere(t, c, "k", "xxx")
+	c.CheckLogs()
+	if reply, err := c.Do(ctx, leader, "APPEND", "k", "x"); err != nil || reply != "4" {
+		t.Errorf("Expected an APPEND after the restarts to make k 4 long, got %q %v", reply, err)
+	}
+}
+
+func TestAppendsSurviveAFollowerRestart(t *testing.T) {
+	c := New(t, Options{})
+	ctx := context.Background()
+	leader := c.WaitLeader(5 * time.Second)
+	follower := (leader + 1) % len(c.Nodes)
+	for _, part := range []string{"a", "b", "c"} {
+		if reply, err := c.Do(ctx, leader, "APPEND", "log", part); err != nil || strings.HasPrefix(reply, "ERR") {
+			t.Fatalf("APPEND failed: %q %v", reply, err)
+		}
+		if part == "b" { // the follower applied "a" and "b", and misses the rest
+			c.WaitConverged(5 * time.Second)
+			c.Kill(follower)
+		}
+	}
+	c.Restart(follower)
+	expectEverywhere(t, c, "log", "abc")
+}
+
+func TestSetBitsSurviveRestarts(t *testing.T) {
+	c := New(t, Options{})
+	ctx := context.Background()
+	leader := c.WaitLeader(5 * time.Second)
+	// SETBIT grows the value a byte at a time, so every bit lands at a
+	// different place if the APPENDs around it are applied twice.
+	for _, cmd := range []string{"APPEND bits A", "SETBIT bits 15 1", "APPEND bits B", "SETBIT bits 31 1"} {
+		if reply, err := c.Do(ctx, leader, strings.Fields(cmd)...); err != nil || strings.HasPrefix(reply, "ERR") {
+			t.Fatalf("%s failed: %q %v", cmd, reply, err)
+		}
+	}
+	want := "A\x01B\x01"
+	expectEverywhere(t, c, "bits", want)
+	for i := range c.Nodes {
+		c.Kill(i)
+		c.Restart(i)
+		expectEverywhere(t, c, "bits", want)
+	}
+	leader = c.WaitLeader(5 * time.Second)
+	if reply, err := c.Do(ctx, leader, "BITCOUNT", "bits"); err != nil || reply != "6" {
+		t.Errorf("Expected 6 bits set after the restarts, got %q %v", reply, err)
+	}
+}
@@ -0,0 +1,174 @@
+package clustertest
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// Network connects the nodes of a cluster in memory. Every address is a
+// Host; dialing an address nobody listens on is refused at once.
+type Network struct {
+	mu    sync.Mutex
+	hosts map[string]*Host
+}
+
+func NewNetwork() *Network {
+	return &Network{hosts: make(map[string]*Host)}
+}
+
+// Host is one incarnation of a node on the network. It is the listener the
+// node's server accepts on and the raft transport it dials peers with, and
+// it tracks every connection it opened or accepted so Crash can cut them
+// all, the way the process dying would.
+type Host struct {
+	net    *Network
+	addr   string
+	accept chan net.Conn
+	closed chan struct{} // closed once the host stops accepting
+
+	mu      sync.Mutex
+	conns   map[*conn]bool
+	crashed bool
+	once    sync.Once
+}
+
+// Host starts listening on addr. The address is free again once the host
+// is closed or has crashed.
+func (n *Network) Host(addr string) (*Host, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, taken := n.hosts[addr]; taken {
+		return nil, fmt.Errorf("listen %s: address already in use", addr)
+	}
+	h := &Host{net: n, addr: addr, accept: make(chan net.Conn), closed: make(chan struct{}), conns: make(map[*conn]bool)}
+	n.hosts[addr] = h
+	return h, nil
+}
+
+// Dial connects to addr from outside the cluster, like a client would.
+func (n *Network) Dial(addr string) (net.Conn, error) {
+	return n.dial(nil, addr)
+}
+
+func (n *Network) dial(from *Host, addr string) (net.Conn, error) {
+	n.mu.Lock()
+	to := n.hosts[addr]
+	n.mu.Unlock()
+	if to == nil {
+		return nil, &net.OpError{Op: "dial", Net: "mem", Addr: memAddr(addr), Err: errRefused}
+	}
+	local := "client"
+	if from != nil {
+		local = from.addr
+	}
+	a, b := net.Pipe()
+	ours := &conn{Conn: a, local: local, remote: addr, host: from}
+	theirs := &conn{Conn: b, local: addr, remote: local, host: to}
+	if from != nil && !from.track(ours) {
+		a.Close()
+		b.Close()
+		return nil, &net.OpError{Op: "dial", Net: "mem", Addr: memAddr(addr), Err: errCrashed}
+	}
+	select {
+	case to.accept <- theirs:
+		return ours, nil
+	case <-to.closed:
+		ours.Close()
+		b.Close()
+		return nil, &net.OpError{Op: "dial", Net: "mem", Addr: memAddr(addr), Err: errRefused}
+	}
+}
+
+var (
+	errRefused = errors.New("connection refused")
+	errCrashed = errors.New("host crashed")
+)
+
+// Dial makes h a raft.Transport.
+func (h *Host) Dial(peer string) (net.Conn, error) {
+	return h.net.dial(h, peer)
+}
+
+func (h *Host) Accept() (net.Conn, error) {
+	select {
+	case c := <-h.accept:
+		if h.track(c.(*conn)) {
+			return c, nil
+		}
+		c.Close()
+		return nil, net.ErrClosed
+	case <-h.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting connections and frees the address; open
+// connections stay up.
+func (h *Host) Close() error {
+	h.once.Do(func() {
+		close(h.closed)
+		h.net.mu.Lock()
+		if h.net.hosts[h.addr] == h {
+			delete(h.net.hosts, h.addr)
+		}
+		h.net.mu.Unlock()
+	})
+	return nil
+}
+
+func (h *Host) Addr() net.Addr { return memAddr(h.addr) }
+
+// Crash closes the host and every connection it has, and refuses whatever
+// it dials from now on.
+func (h *Host) Crash() {
+	h.Close()
+	h.mu.Lock()
+	h.crashed = true
+	conns := h.conns
+	h.conns = nil
+	h.mu.Unlock()
+	for c := range conns {
+		c.Conn.Close()
+	}
+}
+
+// track adds c to the host's connections, unless it has crashed.
+func (h *Host) track(c *conn) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.crashed {
+		return false
+	}
+	h.conns[c] = true
+	return true
+}
+
+func (h *Host) untrack(c *conn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.conns, c)
+}
+
+// conn is one end of an in-memory connection.
+type conn struct {
+	net.Conn
+	local, remote string
+	host          *Host // that holds this end, nil for clients
+}
+
+func (c *conn) Close() error {
+	if c.host != nil {
+		c.host.untrack(c)
+	}
+	return c.Conn.Close()
+}
+
+func (c *conn) LocalAddr() net.Addr  { return memAddr(c.local) }
+func (c *conn) RemoteAddr() net.Addr { return memAddr(c.remote) }
+
+type memAddr string
+
+func (a memAddr) Network() string { return "mem" }
+func (a memAddr) String() string  { return string(a) }
@@ -0,0 +1,70 @@
+// Package compress holds the value codecs the store can use. A codec is
+// recorded per key, so values written under different settings (or before
+// compression was turned on) keep working side by side.
+package compress
+
+import (
+	"fmt"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+type Codec byte
+
+const (
+	None Codec = iota
+	Snappy
+	Zstd
+)
+
+// Encoders are safe for concurrent EncodeAll/DecodeAll, so one of each is shared.
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// Parse maps a -compression flag value to a codec.
+func Parse(name string) (Codec, error) {
+	switch name {
+	case "", "none":
+		return None, nil
+	case "snappy":
+		return Snappy, nil
+	case "zstd":
+		return Zstd, nil
+	}
+	return None, fmt.Errorf("unknown compression %q (want none, snappy or zstd)", name)
+}
+
+func (c Codec) String() string {
+	switch c {
+	case Snappy:
+		return "snappy"
+	case Zstd:
+		return "zstd"
+	}
+	return "none"
+}
+
+func (c Codec) Encode(raw string) string {
+	switch c {
+	case Snappy:
+		return string(snappy.Encode(nil, []byte(raw)))
+	case Zstd:
+		return string(zstdEncoder.EncodeAll([]byte(raw), nil))
+	}
+	return raw
+}
+
+func (c Codec) Decode(packed string) (string, error) {
+	switch c {
+	case Snappy:
+		b, err := snappy.Decode(nil, []byte(packed))
+		return string(b), err
+	case Zstd:
+		b, err := zstdDecoder.DecodeAll([]byte(packed), nil)
+		return string(b), err
+	}
+	return packed, nil
+}
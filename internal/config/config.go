@@ -0,0 +1,182 @@
+// Package config lets a node read its flags from a file and re-read a
+// subset of them while it runs.
+//
+// The file holds one flag per line, "name = value", with # comments:
+//
+//	# slower than this goes in the slowlog
+//	slowlog-threshold = 50ms
+//	max-value-size = 4194304
+//
+// Flags given on the command line win over the file, at startup and on
+// every reload. A reload re-reads the file and, for each flag whose value
+// changed, either applies it (if something registered with OnReload) or
+// reports that it only takes effect after a restart, leaving the running
+// value alone. A flag removed from the file goes back to its default.
+package config
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Result says what a reload did.
+type Result struct {
+	Applied         []string          `json:"applied"`         // changed and now in effect
+	RequiresRestart []string          `json:"requiresRestart"` // changed in the file, still running the old value
+	Overridden      []string          `json:"overridden"`      // in the file but set on the command line
+	Errors          map[string]string `json:"errors,omitempty"`
+}
+
+// Config ties a flag set to its file.
+type Config struct {
+	mu       sync.Mutex
+	fs       *flag.FlagSet
+	path     string
+	explicit map[string]bool // set on the command line
+	fromFile map[string]bool // current value came from the file
+	reload   map[string]func() error
+}
+
+// Load reads path into fs, after fs has parsed the command line. An empty
+// path gives a Config with nothing to reload.
+func Load(fs *flag.FlagSet, path string) (*Config, error) {
+	c := &Config{fs: fs, path: path, explicit: make(map[string]bool),
+		fromFile: make(map[string]bool), reload: make(map[string]func() error)}
+	fs.Visit(func(f *flag.Flag) { c.explicit[f.Name] = true })
+	if path == "" {
+		return c, nil
+	}
+	values, err := c.read()
+	if err != nil {
+		return nil, err
+	}
+	for name, v := range values {
+		if c.explicit[name] {
+			continue
+		}
+		if err := fs.Set(name, v); err != nil {
+			return nil, fmt.Errorf("%s: %s: %v", path, name, err)
+		}
+		c.fromFile[name] = true
+	}
+	return c, nil
+}
+
+// OnReload marks flag name as reloadable: after a reload sets it, apply is
+// called to put the new value (read from the flag's variable) into effect.
+func (c *Config) OnReload(name string, apply func() error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reload[name] = apply
+}
+
+// Reloadable lists the flags OnReload registered, sorted.
+func (c *Config) Reloadable() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	names := make([]string, 0, len(c.reload))
+	for name := range c.reload {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Reload re-reads the file and applies what it can. The error is for a file
+// that can't be read at all; per-flag problems go in Result.Errors.
+func (c *Config) Reload() (Result, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	res := Result{Applied: []string{}, RequiresRestart: []string{}, Overridden: []string{}, Errors: map[string]string{}}
+	if c.path == "" {
+		return res, fmt.Errorf("no -config file to reload")
+	}
+	values, err := c.read()
+	if err != nil {
+		return res, err
+	}
+	// Flags that left the file go back to their defaults.
+	inFile := make(map[string]bool, len(values))
+	for name := range values {
+		inFile[name] = true
+	}
+	for name := range c.fromFile {
+		if !inFile[name] {
+			values[name] = c.fs.Lookup(name).DefValue
+		}
+	}
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		v := values[name]
+		if c.explicit[name] {
+			res.Overridden = append(res.Overridden, name)
+			continue
+		}
+		// Set the new value before comparing, so "1m" and "1m0s" are the same.
+		f := c.fs.Lookup(name)
+		old := f.Value.String()
+		if err := c.fs.Set(name, v); err != nil {
+			c.fs.Set(name, old) // some flag types store a zero value before failing
+			res.Errors[name] = err.Error()
+			continue
+		}
+		if f.Value.String() == old {
+			continue
+		}
+		apply, ok := c.reload[name]
+		if !ok {
+			c.fs.Set(name, old) // keep reporting what is actually running
+			res.RequiresRestart = append(res.RequiresRestart, name)
+			continue
+		}
+		if err := apply(); err != nil {
+			c.fs.Set(name, old)
+			res.Errors[name] = err.Error()
+			continue
+		}
+		if inFile[name] {
+			c.fromFile[name] = true
+		} else {
+			delete(c.fromFile, name)
+		}
+		res.Applied = append(res.Applied, name)
+	}
+	return res, nil
+}
+
+// read parses the file into flag name -> value, rejecting unknown flags.
+func (c *Config) read() (map[string]string, error) {
+	f, err := os.Open(c.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("%s:%d: want name = value", c.path, n)
+		}
+		if c.fs.Lookup(name) == nil {
+			return nil, fmt.Errorf("%s:%d: unknown flag %q", c.path, n, name)
+		}
+		values[name] = value
+	}
+	return values, scanner.Err()
+}
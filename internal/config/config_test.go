@@ -0,0 +1,104 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+type flags struct {
+	fs        *flag.FlagSet
+	threshold *time.Duration
+	maxValue  *int
+	dataDir   *string
+}
+
+func newFlags(args ...string) (flags, error) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	f := flags{
+		fs:        fs,
+		threshold: fs.Duration("slowlog-threshold", 10*time.Millisecond, ""),
+		maxValue:  fs.Int("max-value-size", 1024, ""),
+		dataDir:   fs.String("data-dir", ".", ""),
+	}
+	return f, fs.Parse(args)
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+}
+
+func TestLoadAndReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.conf")
+	writeFile(t, path, "# comment\nslowlog-threshold = 50ms\nmax-value-size = 2048\ndata-dir = /a\n")
+
+	f, err := newFlags("-max-value-size=4096")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := Load(f.fs, path)
+	if err != nil {
+		t.Fatalf("Failed to load: %v", err)
+	}
+	if *f.threshold != 50*time.Millisecond || *f.dataDir != "/a" || *f.maxValue != 4096 {
+		t.Fatalf("Expected the file's values except where the command line set them, got threshold=%v dir=%q max=%d",
+			*f.threshold, *f.dataDir, *f.maxValue)
+	}
+
+	var applied time.Duration
+	c.OnReload("slowlog-threshold", func() error {
+		applied = *f.threshold
+		return nil
+	})
+	writeFile(t, path, "slowlog-threshold = 1s\nmax-value-size = 1\ndata-dir = /b\n")
+	res, err := c.Reload()
+	if err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+	if !slices.Equal(res.Applied, []string{"slowlog-threshold"}) || applied != time.Second {
+		t.Errorf("Expected slowlog-threshold applied as 1s, got %+v and %v", res, applied)
+	}
+	if !slices.Equal(res.RequiresRestart, []string{"data-dir"}) || *f.dataDir != "/a" {
+		t.Errorf("Expected data-dir to need a restart and stay /a, got %+v and %q", res, *f.dataDir)
+	}
+	if !slices.Equal(res.Overridden, []string{"max-value-size"}) || *f.maxValue != 4096 {
+		t.Errorf("Expected the command line to keep max-value-size at 4096, got %+v and %d", res, *f.maxValue)
+	}
+
+	// Dropping a reloadable flag from the file puts its default back.
+	writeFile(t, path, "data-dir = /a\n")
+	if res, err = c.Reload(); err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+	if !slices.Equal(res.Applied, []string{"slowlog-threshold"}) || applied != 10*time.Millisecond {
+		t.Errorf("Expected slowlog-threshold back at its default, got %+v and %v", res, applied)
+	}
+}
+
+func TestReloadReportsBadValues(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.conf")
+	writeFile(t, path, "slowlog-threshold = 50ms\n")
+	f, _ := newFlags()
+	c, err := Load(f.fs, path)
+	if err != nil {
+		t.Fatalf("Failed to load: %v", err)
+	}
+	c.OnReload("slowlog-threshold", func() error { return nil })
+
+	writeFile(t, path, "slowlog-threshold = soon\n")
+	res, err := c.Reload()
+	if err != nil || res.Errors["slowlog-threshold"] == "" || *f.threshold != 50*time.Millisecond {
+		t.Errorf("Expected a per-flag error leaving 50ms in place, got %+v, %v, %v", res, err, *f.threshold)
+	}
+
+	writeFile(t, path, "no-such-flag = 1\n")
+	if _, err := c.Reload(); err == nil {
+		t.Error("Expected an unknown flag to fail the reload")
+	}
+}
@@ -0,0 +1,203 @@
+// Package crash keeps a panic in one goroutine from quietly taking part of
+// a node down with it. A goroutine that dies leaves whatever waits on it
+// waiting: a dead WAL flusher hangs every write, a dead raft loop stops
+// elections. Supervise runs such a goroutine again after a panic, and
+// Recover turns a panic in a goroutine nobody restarts, a client
+// connection, into a report instead of a dead process.
+//
+// Restarting is only safe while the state a goroutine shares is still
+// whole. Where it can't be, say a command that panicked halfway through
+// being applied, the caller hands the report to Fatal instead, which
+// shuts the node down cleanly: crash-only, recovery on the next start
+// is the one path that has to be right.
+//
+// Every panic is logged to stderr as one CRASH line holding a JSON Report,
+// and the latest are kept for GET /crashes.
+package crash
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// Report describes one panic.
+type Report struct {
+	Subsystem string    `json:"subsystem"` // e.g. "raft", "wal flusher", "connection 10.0.0.2:51234"
+	Panic     string    `json:"panic"`
+	Stack     string    `json:"stack"`
+	Time      time.Time `json:"time"`
+	Restarts  int       `json:"restarts,omitempty"` // of the subsystem within RestartWindow, this one included
+	Fatal     bool      `json:"fatal,omitempty"`    // the node shut down instead of going on
+}
+
+const (
+	// MaxRestarts is how many times Supervise restarts a subsystem within
+	// RestartWindow; one more panic and it calls Fatal, since a goroutine
+	// that keeps panicking isn't going to stop.
+	MaxRestarts   = 5
+	RestartWindow = time.Minute
+
+	// ExitCode is what Fatal exits with (EX_SOFTWARE), so a supervisor
+	// can tell a crash from a clean stop.
+	ExitCode = 70
+
+	maxBackoff      = 5 * time.Second
+	shutdownTimeout = 10 * time.Second
+	keepReports     = 32
+)
+
+var (
+	mu       sync.Mutex
+	reports  []Report                   // the latest keepReports, oldest first
+	restarts = map[string][]time.Time{} // by subsystem, within RestartWindow
+	shutdown func()                     // SetShutdown, run once by Fatal
+	stopping bool                       // Fatal has been called
+
+	exit = os.Exit // tests replace it
+)
+
+// SetShutdown makes Fatal call f before exiting, to flush and close what
+// the node has open.
+func SetShutdown(f func()) {
+	mu.Lock()
+	defer mu.Unlock()
+	shutdown = f
+}
+
+// Reports returns the latest panics, oldest first.
+func Reports() []Report {
+	mu.Lock()
+	defer mu.Unlock()
+	return append([]Report(nil), reports...)
+}
+
+// Recover, deferred, recovers a panic in the calling goroutine, logs it
+// and passes the report to then, if that isn't nil.
+//
+//	defer crash.Recover("apply", crash.Fatal)
+func Recover(subsystem string, then func(Report)) {
+	p := recover()
+	if p == nil {
+		return
+	}
+	r := newReport(subsystem, p, 0)
+	record(r)
+	if then != nil {
+		then(r)
+	}
+}
+
+// Supervise runs fn until it returns, running it again each time it
+// panics, after a backoff that doubles from 100ms. It calls Fatal instead
+// after MaxRestarts panics within RestartWindow, or when whole, if it
+// isn't nil, says the panic left shared state broken; a lock the panic
+// skipped unlocking would hang the restarted goroutine for good.
+func Supervise(subsystem string, fn func(), whole func() bool) {
+	backoff := 100 * time.Millisecond
+	for {
+		p, panicked := run(fn)
+		if !panicked {
+			return
+		}
+		r := newReport(subsystem, p, restarted(subsystem))
+		record(r)
+		if r.Restarts > MaxRestarts || (whole != nil && !whole()) {
+			Fatal(r)
+			return
+		}
+		fmt.Fprintf(os.Stderr, "Crash: restarting %s in %v (%d of %d within %v)\n", subsystem, backoff, r.Restarts, MaxRestarts, RestartWindow)
+		time.Sleep(backoff)
+		backoff = min(2*backoff, maxBackoff)
+	}
+}
+
+// Fatal shuts the node down after r: it runs the SetShutdown function,
+// giving it shutdownTimeout, and exits with ExitCode. Only the first call
+// does; any other caller blocks until the process exits.
+func Fatal(r Report) {
+	mu.Lock()
+	if stopping {
+		mu.Unlock()
+		select {} // the first caller is shutting down
+	}
+	stopping = true
+	f := shutdown
+	mu.Unlock()
+
+	markFatal(r)
+	fmt.Fprintf(os.Stderr, "Crash: %s can't carry on after panicking, shutting down\n", r.Subsystem)
+	if f != nil {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			defer Recover("shutdown", nil)
+			f()
+		}()
+		select {
+		case <-done:
+		case <-time.After(shutdownTimeout):
+			fmt.Fprintf(os.Stderr, "Crash: shutdown still running after %v, exiting anyway\n", shutdownTimeout)
+		}
+	}
+	exit(ExitCode)
+}
+
+// run calls fn and reports whether it panicked, with what.
+func run(fn func()) (p any, panicked bool) {
+	defer func() {
+		if panicked {
+			p = recover()
+		}
+	}()
+	panicked = true
+	fn()
+	return nil, false
+}
+
+// restarted notes a restart of subsystem and returns how many it has had
+// within RestartWindow.
+func restarted(subsystem string) int {
+	mu.Lock()
+	defer mu.Unlock()
+	now := time.Now()
+	recent := restarts[subsystem][:0]
+	for _, t := range restarts[subsystem] {
+		if now.Sub(t) < RestartWindow {
+			recent = append(recent, t)
+		}
+	}
+	restarts[subsystem] = append(recent, now)
+	return len(restarts[subsystem])
+}
+
+// markFatal flags the kept copy of r, which was logged when it was recovered.
+func markFatal(r Report) {
+	mu.Lock()
+	defer mu.Unlock()
+	for i := len(reports) - 1; i >= 0; i-- {
+		if reports[i].Subsystem == r.Subsystem && reports[i].Time.Equal(r.Time) {
+			reports[i].Fatal = true
+			return
+		}
+	}
+}
+
+func newReport(subsystem string, p any, restarts int) Report {
+	return Report{Subsystem: subsystem, Panic: fmt.Sprint(p), Stack: string(debug.Stack()), Time: time.Now(), Restarts: restarts}
+}
+
+// record logs r and keeps it for Reports.
+func record(r Report) {
+	line, _ := json.Marshal(r)
+	fmt.Fprintf(os.Stderr, "CRASH %s\n", line)
+	mu.Lock()
+	defer mu.Unlock()
+	reports = append(reports, r)
+	if len(reports) > keepReports {
+		reports = reports[len(reports)-keepReports:]
+	}
+}
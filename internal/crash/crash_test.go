@@ -0,0 +1,81 @@
+package crash
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// reset puts the package back the way it starts, exiting into exits.
+func reset(t *testing.T, exits *[]int) {
+	mu.Lock()
+	reports, restarts, shutdown, stopping = nil, map[string][]time.Time{}, nil, false
+	mu.Unlock()
+	exit = func(code int) { *exits = append(*exits, code) }
+	t.Cleanup(func() { exit = os.Exit })
+}
+
+func TestSuperviseRestartsUntilItReturns(t *testing.T) {
+	var exits []int
+	reset(t, &exits)
+	calls := 0
+	Supervise("flusher", func() {
+		calls++
+		if calls < 3 {
+			panic("bad batch")
+		}
+	}, nil)
+	if calls != 3 || len(exits) != 0 {
+		t.Fatalf("expected 3 calls and no exit, got %d calls and exits %v", calls, exits)
+	}
+	got := Reports()
+	if len(got) != 2 || got[1].Restarts != 2 || got[1].Panic != "bad batch" || !strings.Contains(got[1].Stack, "crash_test.go") {
+		t.Errorf("expected two reports with the panic and its stack, got %+v", got)
+	}
+}
+
+func TestFatalAfterTooManyRestarts(t *testing.T) {
+	var exits []int
+	reset(t, &exits)
+	for range MaxRestarts {
+		restarted("raft") // as if it had already been restarted, skipping the backoff
+	}
+	shutdowns := 0
+	SetShutdown(func() { shutdowns++ })
+	Supervise("raft", func() { panic("again") }, nil)
+	got := Reports()
+	if len(exits) != 1 || exits[0] != ExitCode || shutdowns != 1 {
+		t.Fatalf("expected one shutdown and exit %d, got %d and %v", ExitCode, shutdowns, exits)
+	}
+	if len(got) != 1 || !got[0].Fatal || got[0].Restarts != MaxRestarts+1 {
+		t.Errorf("expected the report marked fatal, got %+v", got)
+	}
+}
+
+func TestFatalWhenStateIsBroken(t *testing.T) {
+	var exits []int
+	reset(t, &exits)
+	calls := 0
+	Supervise("raft", func() {
+		calls++
+		panic("holding the lock")
+	}, func() bool { return false })
+	if calls != 1 || len(exits) != 1 {
+		t.Errorf("expected no restart and one exit, got %d calls and exits %v", calls, exits)
+	}
+}
+
+func TestRecover(t *testing.T) {
+	var exits []int
+	reset(t, &exits)
+	var handed Report
+	func() {
+		defer Recover("connection", func(r Report) { handed = r })
+		var m map[string]int
+		m["x"]++
+	}()
+	if handed.Subsystem != "connection" || !strings.Contains(handed.Panic, "nil map") || len(Reports()) != 1 {
+		t.Errorf("expected the panic recovered and reported, got %+v", handed)
+	}
+}
@@ -0,0 +1,245 @@
+// Package durability ties a node's two logs together.
+//
+// The raft log records what the cluster agreed on; the data WAL records what
+// the store applied. Recovery is only sound if the data WAL never gets ahead
+// of the raft log, so a Layer makes every data WAL group commit sync the raft
+// log first. A write is acked only after its data record is on disk, which
+// means its raft entry is too.
+//
+// The raft log file holds one record per entry, in the same quoted op
+// format as the data WAL:
+//
+//	!ENTRY "<index>" "<term>" "<command>" "<crc>"   (replaces anything from index on)
+//	!OFFSET "<index>" "<term>" "<crc>"              (log restarts at index after a snapshot)
+//	!STATE "<term>" "<votedFor>" "<crc>"            (the node's term and vote, the last one counts)
+//
+// crc is the CRC-32C of the other fields, in hex. Logs written before it
+// existed lack it, and their records are read unchecked.
+package durability
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mathdee/KV-Store/internal/raft"
+	"github.com/mathdee/KV-Store/internal/wal"
+)
+
+// Layer persists the raft log and orders it ahead of the data WAL. It
+// implements raft.LogStore.
+type Layer struct {
+	raftLog *wal.WAL
+	data    *wal.WAL
+
+	mu    sync.Mutex
+	state raft.HardState // the last one saved, which Reset writes again
+}
+
+// Open opens (or creates) the raft log at raftPath and puts it in front of data.
+func Open(raftPath string, data *wal.WAL) (*Layer, error) {
+	raftLog, err := wal.NewWAL(raftPath)
+	if err != nil {
+		return nil, err
+	}
+	l := &Layer{raftLog: raftLog, data: data}
+	data.SetBarrier(raftLog.Sync)
+	return l, nil
+}
+
+// SetPrealloc and SetRecycle tune the raft log's file the way the WAL's
+// setters of the same name do.
+func (l *Layer) SetPrealloc(n int64) { l.raftLog.SetPrealloc(n) }
+func (l *Layer) SetRecycle(on bool)  { l.raftLog.SetRecycle(on) }
+
+// Append queues entries starting at index as one group commit unit.
+func (l *Layer) Append(index int, entries []raft.LogEntry) <-chan error {
+	records := make([]string, len(entries))
+	for i, e := range entries {
+		records[i] = entryRecord(index+i, e)
+	}
+	return l.raftLog.QueueBatch(records)
+}
+
+// Reset rewrites the raft log to hold just entries, starting at offset,
+// and the last saved state.
+func (l *Layer) Reset(offset, term int, entries []raft.LogEntry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.raftLog.BeginCompaction()
+	records := make([]string, 0, len(entries)+2)
+	records = append(records, checksummed("OFFSET", strconv.Itoa(offset), strconv.Itoa(term)))
+	if l.state != (raft.HardState{}) {
+		records = append(records, stateRecord(l.state))
+	}
+	for i, e := range entries {
+		records = append(records, entryRecord(offset+i, e))
+	}
+	return l.raftLog.FinishCompaction(records)
+}
+
+// SaveState appends a STATE record and waits for it to be on disk.
+func (l *Layer) SaveState(st raft.HardState) error {
+	l.mu.Lock()
+	l.state = st
+	done := l.raftLog.QueueBatch([]string{stateRecord(st)})
+	l.mu.Unlock()
+	return wal.Wait(context.Background(), done)
+}
+
+// Sync is the barrier for both logs: once it returns nil, every raft entry
+// and every data record queued before the call is on disk, raft log first.
+func (l *Layer) Sync() error {
+	if err := l.raftLog.Sync(); err != nil {
+		return err
+	}
+	return l.data.Sync()
+}
+
+// Close syncs both logs and closes the raft log; the data WAL stays open.
+func (l *Layer) Close() error {
+	l.Sync()
+	l.data.SetBarrier(nil)
+	return l.raftLog.Close()
+}
+
+func entryRecord(index int, e raft.LogEntry) string {
+	return checksummed("ENTRY", strconv.Itoa(index), strconv.Itoa(e.Term), e.Command)
+}
+
+func stateRecord(st raft.HardState) string {
+	return checksummed("STATE", strconv.Itoa(st.Term), st.VotedFor)
+}
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var errChecksum = errors.New("checksum mismatch")
+
+// checksum covers a record's fields; NUL can't be in a command, which is
+// one line of text.
+func checksum(fields []string) string {
+	return fmt.Sprintf("%08x", crc32.Checksum([]byte(strings.Join(fields, "\x00")), crcTable))
+}
+
+func checksummed(op string, fields ...string) string {
+	return wal.FormatOp(op, append(fields, checksum(fields))...)
+}
+
+// verifyChecksum strips the checksum from a record with want fields and
+// checks it. checked is false for records written without one.
+func verifyChecksum(r wal.Record, want int) (fields []string, checked bool, err error) {
+	switch len(r.Args) {
+	case want:
+		return r.Args, false, nil
+	case want + 1:
+		fields = r.Args[:want]
+		if sum := r.Args[want]; sum != checksum(fields) {
+			return nil, true, fmt.Errorf("%s record %q: %w %s", r.Op, fields, errChecksum, sum)
+		}
+		return fields, true, nil
+	}
+	return nil, false, fmt.Errorf("malformed %s record %q", r.Op, r.Args)
+}
+
+// parseOffset reads an OFFSET record.
+func parseOffset(r wal.Record) (offset, term int, checked bool, err error) {
+	fields, checked, err := verifyChecksum(r, 2)
+	if err != nil {
+		return 0, 0, checked, err
+	}
+	offset, err1 := strconv.Atoi(fields[0])
+	term, err2 := strconv.Atoi(fields[1])
+	if err1 != nil || err2 != nil {
+		return 0, 0, checked, fmt.Errorf("malformed OFFSET record %q", fields)
+	}
+	return offset, term, checked, nil
+}
+
+// parseState reads a STATE record.
+func parseState(r wal.Record) (st raft.HardState, checked bool, err error) {
+	fields, checked, err := verifyChecksum(r, 2)
+	if err != nil {
+		return st, checked, err
+	}
+	term, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return st, checked, fmt.Errorf("malformed STATE record %q", fields)
+	}
+	return raft.HardState{Term: term, VotedFor: fields[1]}, checked, nil
+}
+
+// parseEntry reads an ENTRY record.
+func parseEntry(r wal.Record) (index int, e raft.LogEntry, checked bool, err error) {
+	fields, checked, err := verifyChecksum(r, 3)
+	if err != nil {
+		return 0, e, checked, err
+	}
+	index, err1 := strconv.Atoi(fields[0])
+	term, err2 := strconv.Atoi(fields[1])
+	if err1 != nil || err2 != nil {
+		return 0, e, checked, fmt.Errorf("malformed ENTRY record %q", fields)
+	}
+	return index, raft.LogEntry{Term: term, Command: fields[2]}, checked, nil
+}
+
+// Log is a raft log as read back from its file.
+type Log struct {
+	Offset  int // index of Entries[0]
+	Term    int // term of entry Offset-1, 0 if unknown
+	Entries []raft.LogEntry
+	State   raft.HardState // the node's term and vote, zero in logs written before they were kept
+}
+
+// ReadLog reads the raft log a Layer wrote at path, applying each record's
+// replacement in order. A missing file is an empty log. A record that
+// would leave a gap or fails its checksum stops the read; what came before
+// it is returned along with the error.
+func ReadLog(path string) (Log, error) {
+	var l Log
+	var bad error
+	_, err := wal.RecoverInto(path, wal.RecoverOptions{}, func(records []wal.Record) {
+		for _, r := range records {
+			if bad != nil {
+				return
+			}
+			bad = l.apply(r)
+		}
+	})
+	if err != nil {
+		return l, err
+	}
+	return l, bad
+}
+
+func (l *Log) apply(r wal.Record) error {
+	switch r.Op {
+	case "OFFSET":
+		offset, term, _, err := parseOffset(r)
+		if err != nil {
+			return err
+		}
+		*l = Log{Offset: offset, Term: term, State: l.State}
+	case "STATE":
+		st, _, err := parseState(r)
+		if err != nil {
+			return err
+		}
+		l.State = st
+	case "ENTRY":
+		index, e, _, err := parseEntry(r)
+		if err != nil {
+			return err
+		}
+		if next := l.Offset + len(l.Entries); index < l.Offset || index > next {
+			return fmt.Errorf("entry %d doesn't follow the log, which holds %d to %d", index, l.Offset, next-1)
+		}
+		l.Entries = append(l.Entries[:index-l.Offset], e)
+	default:
+		return fmt.Errorf("unexpected %s record in a raft log", r.Op)
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+package durability
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/mathdee/KV-Store/internal/raft"
+	"github.com/mathdee/KV-Store/internal/wal"
+)
+
+func TestDataWALWaitsForRaftLog(t *testing.T) {
+	dataFile, raftFile := "test_durability_data.log", "test_durability_raft.log"
+	for _, f := range []string{dataFile, raftFile} {
+		os.Remove(f)
+		defer os.Remove(f)
+	}
+
+	data, err := wal.NewWAL(dataFile)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	l, err := Open(raftFile, data)
+	if err != nil {
+		t.Fatalf("Failed to open raft log: %v", err)
+	}
+
+	l.Append(0, []raft.LogEntry{{Term: 1, Command: "SET a 1"}})
+	if err := data.WriteEntry("a", "1"); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+
+	// A raft log that can't sync must stop data records from reaching disk.
+	l.raftLog.SetFaults(wal.Faults{SyncErrorPercent: 100})
+	l.Append(1, []raft.LogEntry{{Term: 1, Command: "SET b 2"}})
+	if err := data.WriteEntry("b", "2"); err == nil {
+		t.Fatalf("Expected the data write to fail with the raft log down")
+	}
+	l.raftLog.SetFaults(wal.Faults{})
+	if err := l.Sync(); err == nil {
+		t.Fatalf("Expected Sync to report the lost batch")
+	}
+	if err := l.Sync(); err != nil {
+		t.Fatalf("Failed to sync after clearing faults: %v", err)
+	}
+	l.Close()
+	data.Close()
+
+	got, err := wal.Recover(dataFile)
+	if err != nil {
+		t.Fatalf("Failed to recover: %v", err)
+	}
+	if got["a"] != "1" || len(got) != 1 {
+		t.Errorf("Expected only a=1 in the data WAL, got %v", got)
+	}
+	raw, _ := os.ReadFile(raftFile)
+	if !strings.Contains(string(raw), `"SET a 1"`) || strings.Contains(string(raw), `"SET b 2"`) {
+		t.Errorf("Unexpected raft log contents:\n%s", raw)
+	}
+}
+
+func TestReadLogAppliesReplacements(t *testing.T) {
+	dataFile, raftFile := "test_readlog_data.log", "test_readlog_raft.log"
+	for _, f := range []string{dataFile, raftFile} {
+		os.Remove(f)
+		defer os.Remove(f)
+	}
+	data, err := wal.NewWAL(dataFile)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	l, err := Open(raftFile, data)
+	if err != nil {
+		t.Fatalf("Failed to open raft log: %v", err)
+	}
+	if err := l.Reset(5, 2, []raft.LogEntry{{Term: 2, Command: "SET a 1"}, {Term: 2, Command: "SET b 2"}}); err != nil {
+		t.Fatalf("Reset failed: %v", err)
+	}
+	<-l.Append(7, []raft.LogEntry{{Term: 2, Command: "SET c 3"}})
+	<-l.Append(6, []raft.LogEntry{{Term: 3, Command: "SET b 20"}}) // a new leader replaced 6 and 7
+	l.Close()
+	data.Close()
+
+	got, err := ReadLog(raftFile)
+	if err != nil {
+		t.Fatalf("ReadLog failed: %v", err)
+	}
+	want := []raft.LogEntry{{Term: 2, Command: "SET a 1"}, {Term: 3, Command: "SET b 20"}}
+	if got.Offset != 5 || got.Term != 2 || len(got.Entries) != 2 || got.Entries[0] != want[0] || got.Entries[1] != want[1] {
+		t.Errorf("ReadLog = %+v, want offset 5 term 2 entries %+v", got, want)
+	}
+}
+
+func TestVerifyFindsFirstViolation(t *testing.T) {
+	dataFile, raftFile := "test_verify_data.log", "test_verify_raft.log"
+	for _, f := range []string{dataFile, raftFile} {
+		os.Remove(f)
+		defer os.Remove(f)
+	}
+	data, err := wal.NewWAL(dataFile)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	l, err := Open(raftFile, data)
+	if err != nil {
+		t.Fatalf("Failed to open raft log: %v", err)
+	}
+	if err := l.Reset(5, 2, []raft.LogEntry{{Term: 2, Command: "SET a 1"}, {Term: 2, Command: "SET b 2"}}); err != nil {
+		t.Fatalf("Reset failed: %v", err)
+	}
+	<-l.Append(6, []raft.LogEntry{{Term: 3, Command: "SET b 20"}, {Term: 3, Command: "SET c 3"}})
+	l.Close()
+	data.Close()
+	good, _ := os.ReadFile(raftFile)
+
+	v, err := Verify(raftFile, &SnapshotPoint{Index: 4, Term: 2})
+	if err != nil || v.Violation != nil {
+		t.Fatalf("Expected a clean log, got %+v %v", v.Violation, err)
+	}
+	if v.Records != 5 || v.Checksummed != 5 || v.LastIndex != 7 || v.LastTerm != 3 || v.Replaced != 1 {
+		t.Errorf("Unexpected verification %+v", v)
+	}
+
+	for name, tc := range map[string]struct {
+		damage func(string) string
+		check  string
+		line   int
+	}{
+		"flipped byte":   {func(s string) string { return strings.Replace(s, "SET c 3", "SET c 4", 1) }, "checksum", 5},
+		"gap":            {func(s string) string { return s + entryRecord(10, raft.LogEntry{Term: 3, Command: "SET d 4"}) }, "index", 6},
+		"term goes down": {func(s string) string { return s + entryRecord(8, raft.LogEntry{Term: 1, Command: "SET d 4"}) }, "term", 6},
+		"other command":  {func(s string) string { return s + entryRecord(7, raft.LogEntry{Term: 3, Command: "SET c 30"}) }, "term", 6},
+		"garbage":        {func(s string) string { return s + "not a record\n" }, "record", 6},
+	} {
+		os.WriteFile(raftFile, []byte(tc.damage(string(good))), 0644)
+		v, err := Verify(raftFile, nil)
+		if err != nil || v.Violation == nil || v.Violation.Check != tc.check || v.Violation.Line != tc.line {
+			t.Errorf("%s: expected a %s violation on line %d, got %+v %v", name, tc.check, tc.line, v.Violation, err)
+		}
+	}
+
+	os.WriteFile(raftFile, append(good, `!ENTRY "8" "3`...), 0644) // torn by a crash
+	if v, err := Verify(raftFile, nil); err != nil || v.Violation != nil || !v.TornTail {
+		t.Errorf("Expected a torn tail and no violation, got %+v %v", v, err)
+	}
+	os.WriteFile(raftFile, good, 0644)
+	if v, _ := Verify(raftFile, &SnapshotPoint{Index: 2, Term: 1}); v.Violation == nil || v.Violation.Check != "snapshot" {
+		t.Errorf("Expected a snapshot that ends before the log to be reported, got %+v", v.Violation)
+	}
+	if v, _ := Verify(raftFile, &SnapshotPoint{Index: 7, Term: 2}); v.Violation == nil || v.Violation.Check != "snapshot" {
+		t.Errorf("Expected a snapshot term the log disagrees with to be reported, got %+v", v.Violation)
+	}
+}
+
+func TestFsckRepairsDamagedTails(t *testing.T) {
+	walFile, raftFile := "test_fsck_data.log", "test_fsck_raft.log"
+	for _, f := range []string{walFile, raftFile, walFile + ".damaged", raftFile + ".damaged"} {
+		os.Remove(f)
+		defer os.Remove(f)
+	}
+	good := "a,1\n" + wal.FormatOp("DEL", "a")
+	os.WriteFile(walFile, []byte(good+"b,2\n\x00\x00\x00"), 0644) // a crash mid-write
+	raftLog := entryRecord(0, raft.LogEntry{Term: 1, Command: "SET a 1"})
+	os.WriteFile(raftFile, []byte(raftLog+`!ENTRY "1" "1`), 0644)
+	files := FsckFiles{WAL: walFile, RaftLog: raftFile, Snapshot: "test_fsck_missing.snap"}
+
+	report, err := Fsck(files)
+	if err != nil || report.OK || len(report.Damaged()) != 2 {
+		t.Fatalf("Expected both logs damaged, got %+v %v", report, err)
+	}
+	for _, c := range report.Damaged() {
+		if !c.Repairable {
+			t.Fatalf("Expected %s to be repairable: %+v", c.Path, c)
+		}
+		if err := Repair(c); err != nil {
+			t.Fatalf("Repair failed: %v", err)
+		}
+	}
+	if report, err := Fsck(files); err != nil || !report.OK {
+		t.Fatalf("Expected the repaired files to pass, got %+v %v", report, err)
+	}
+	if got, _ := os.ReadFile(walFile); string(got) != good+"b,2\n" {
+		t.Errorf("Expected only the damage cut, got %q", got)
+	}
+	if got, _ := os.ReadFile(walFile + ".damaged"); string(got) != "\x00\x00\x00" {
+		t.Errorf("Expected the damage kept aside, got %q", got)
+	}
+
+	os.WriteFile(walFile, []byte("garbage\n"+good), 0644) // good records after it
+	report, _ = Fsck(files)
+	if c := report.Damaged(); len(c) != 1 || c[0].Repairable || c[0].GoodAfter != 2 {
+		t.Errorf("Expected damage before good records to be left alone, got %+v", c)
+	}
+}
+
+func TestStateSurvivesReset(t *testing.T) {
+	dataFile, raftFile := "test_state_data.log", "test_state_raft.log"
+	for _, f := range []string{dataFile, raftFile} {
+		os.Remove(f)
+		defer os.Remove(f)
+	}
+	data, err := wal.NewWAL(dataFile)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	l, err := Open(raftFile, data)
+	if err != nil {
+		t.Fatalf("Failed to open raft log: %v", err)
+	}
+	<-l.Append(0, []raft.LogEntry{{Term: 1, Command: "SET a 1"}})
+	if err := l.SaveState(raft.HardState{Term: 2, VotedFor: "n2"}); err != nil {
+		t.Fatalf("SaveState failed: %v", err)
+	}
+	if err := l.SaveState(raft.HardState{Term: 3, VotedFor: "n1"}); err != nil {
+		t.Fatalf("SaveState failed: %v", err)
+	}
+	want := raft.HardState{Term: 3, VotedFor: "n1"}
+	if got, err := ReadLog(raftFile); err != nil || got.State != want || len(got.Entries) != 1 {
+		t.Errorf("ReadLog = %+v %v, want state %+v and one entry", got, err, want)
+	}
+
+	// Compaction rewrites the log but must keep the vote.
+	if err := l.Reset(1, 1, []raft.LogEntry{{Term: 3, Command: "SET b 2"}}); err != nil {
+		t.Fatalf("Reset failed: %v", err)
+	}
+	l.Close()
+	data.Close()
+	if got, err := ReadLog(raftFile); err != nil || got.State != want || got.Offset != 1 || len(got.Entries) != 1 {
+		t.Errorf("ReadLog after Reset = %+v %v, want state %+v", got, err, want)
+	}
+	if v, err := Verify(raftFile, nil); err != nil || v.Violation != nil || v.Term != 3 || v.VotedFor != "n1" {
+		t.Errorf("Expected a clean log at term 3, got %+v %v", v, err)
+	}
+}
@@ -0,0 +1,239 @@
+package durability
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/mathdee/KV-Store/internal/snapshot"
+	"github.com/mathdee/KV-Store/internal/wal"
+)
+
+// Fsck checks a node's files before it serves anything: the SAVE snapshot
+// must pass every block checksum, the raft log must pass Verify against
+// the snapshot's index and term, and every line of the data WAL must
+// decode. Data WAL records carry no checksum, so a record damaged into
+// another valid one isn't caught there; the raft log's records are.
+//
+// Damage at the end of a log, which is what a crash or a full disk leaves,
+// can be repaired by truncating the log where it starts. A torn last line
+// counts too: the WAL appends after it, which would glue the next record
+// onto it and lose that as well. The raft log is cut at its first
+// violation, since nothing after it can be trusted; the data WAL only when
+// nothing after the damage decodes, so repairs never drop good records.
+// What is cut is kept next to the log with a .damaged suffix, and a damaged
+// snapshot, which recovery doesn't read, is moved aside the same way.
+//
+// A snapshot older than the start of the raft log isn't a problem here:
+// the data WAL holds the node's state, not the snapshot, and compaction
+// moves the log's start past every SAVE taken before it.
+
+// FsckFiles names a node's files; any may be missing.
+type FsckFiles struct {
+	WAL      string
+	RaftLog  string
+	Snapshot string
+}
+
+// FileCheck is what Fsck found in one file.
+type FileCheck struct {
+	Path       string           `json:"path"`
+	Kind       string           `json:"kind"` // wal, raft or snapshot
+	Missing    bool             `json:"missing,omitempty"`
+	Records    int              `json:"records"`
+	Bytes      int64            `json:"bytes"`
+	Problem    string           `json:"problem,omitempty"`
+	DamageAt   int64            `json:"damageAt"`             // byte offset repairs truncate at, -1 if none
+	GoodAfter  int              `json:"goodAfter,omitempty"`  // records that decode after the damage
+	Repairable bool             `json:"repairable,omitempty"` // by truncating at DamageAt
+	Raft       *Verification    `json:"raft,omitempty"`
+	Header     *snapshot.Header `json:"header,omitempty"`
+}
+
+// FsckReport is every file Fsck checked.
+type FsckReport struct {
+	Files []FileCheck `json:"files"`
+	OK    bool        `json:"ok"`
+}
+
+// Damaged returns the checks that found a problem.
+func (r FsckReport) Damaged() []FileCheck {
+	var damaged []FileCheck
+	for _, c := range r.Files {
+		if c.Problem != "" {
+			damaged = append(damaged, c)
+		}
+	}
+	return damaged
+}
+
+// Fsck checks files; the error is for files it couldn't read at all.
+func Fsck(files FsckFiles) (FsckReport, error) {
+	var r FsckReport
+	var point *SnapshotPoint
+	if files.Snapshot != "" {
+		c, err := checkSnapshotFile(files.Snapshot)
+		if err != nil {
+			return r, err
+		}
+		if c.Header != nil && c.Problem == "" && c.Header.Index >= 0 {
+			point = &SnapshotPoint{Index: c.Header.Index, Term: c.Header.Term}
+		}
+		r.Files = append(r.Files, c)
+	}
+	if files.RaftLog != "" {
+		c, err := checkRaftLog(files.RaftLog, point)
+		if err != nil {
+			return r, err
+		}
+		r.Files = append(r.Files, c)
+	}
+	if files.WAL != "" {
+		c, err := checkWAL(files.WAL)
+		if err != nil {
+			return r, err
+		}
+		r.Files = append(r.Files, c)
+	}
+	r.OK = len(r.Damaged()) == 0
+	return r, nil
+}
+
+func newCheck(path, kind string) (FileCheck, bool, error) {
+	c := FileCheck{Path: path, Kind: kind, DamageAt: -1}
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		c.Missing = true
+		return c, false, nil
+	}
+	if err != nil {
+		return c, false, err
+	}
+	c.Bytes = info.Size()
+	return c, true, nil
+}
+
+func checkSnapshotFile(path string) (FileCheck, error) {
+	c, ok, err := newCheck(path, "snapshot")
+	if !ok {
+		return c, err
+	}
+	h, err := snapshot.ReadFile(path, func(key, value string) error {
+		c.Records++
+		return nil
+	})
+	if err != nil {
+		c.Problem = err.Error() // a snapshot is rewritten whole, there's no tail to cut
+		c.DamageAt, c.Repairable = 0, true
+		return c, nil
+	}
+	c.Header = &h
+	return c, nil
+}
+
+func checkRaftLog(path string, point *SnapshotPoint) (FileCheck, error) {
+	c, ok, err := newCheck(path, "raft")
+	if !ok {
+		return c, err
+	}
+	v, err := Verify(path, point)
+	if err != nil {
+		return c, err
+	}
+	if v.Violation != nil && v.Violation.Check == "snapshot" && point.Index < v.Offset-1 {
+		v.Violation = nil // an old SAVE, see above
+	}
+	c.Raft, c.Records = &v, v.Records
+	switch {
+	case v.Violation != nil:
+		c.Problem = fmt.Sprintf("%s: %s", v.Violation.Check, v.Violation.Message)
+		if v.Violation.Line > 0 {
+			c.DamageAt, c.Repairable = v.Violation.Offset, true
+		}
+	case v.TornTail:
+		c.Problem, c.DamageAt, c.Repairable = "the last line is torn", v.TornAt, true
+	}
+	return c, nil
+}
+
+func checkWAL(path string) (FileCheck, error) {
+	c, ok, err := newCheck(path, "wal")
+	if !ok {
+		return c, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return c, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	var offset int64
+	for line := 1; ; line++ {
+		start := offset
+		text, err := r.ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return c, err
+		}
+		if text == "" {
+			break
+		}
+		offset += int64(len(text))
+		torn := !strings.HasSuffix(text, "\n")
+		text = strings.TrimSuffix(strings.TrimSuffix(text, "\n"), "\r")
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		_, decodes := wal.ParseLine(text)
+		switch {
+		case c.DamageAt >= 0 && decodes:
+			c.GoodAfter++
+		case c.DamageAt >= 0:
+		case !decodes:
+			c.DamageAt, c.Problem = start, fmt.Sprintf("line %d doesn't decode: %q", line, clip(text))
+		case torn:
+			c.DamageAt, c.Problem = start, fmt.Sprintf("the last line, %d, has no newline", line)
+		default:
+			c.Records++
+		}
+	}
+	if c.DamageAt >= 0 {
+		c.Repairable = c.GoodAfter == 0
+		if !c.Repairable {
+			c.Problem += fmt.Sprintf(", and %d records after it do", c.GoodAfter)
+		}
+	}
+	return c, nil
+}
+
+// Repair truncates c's file at c.DamageAt, keeping what it cuts in
+// c.Path+".damaged". Snapshots are moved there whole.
+func Repair(c FileCheck) error {
+	if !c.Repairable {
+		return fmt.Errorf("%s can't be repaired by truncating it", c.Path)
+	}
+	if c.Kind == "snapshot" {
+		return os.Rename(c.Path, c.Path+".damaged")
+	}
+	f, err := os.OpenFile(c.Path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Seek(c.DamageAt, io.SeekStart); err != nil {
+		return err
+	}
+	tail, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(c.Path+".damaged", tail, 0644); err != nil {
+		return fmt.Errorf("keeping the damaged tail: %w", err)
+	}
+	if err := f.Truncate(c.DamageAt); err != nil {
+		return err
+	}
+	return f.Sync()
+}
@@ -0,0 +1,232 @@
+package durability
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/mathdee/KV-Store/internal/wal"
+)
+
+// Verify reads a raft log the way ReadLog does but checks what ReadLog
+// trusts: every line is a well formed record that passes its checksum,
+// indexes follow on from the log without gaps, terms never go down, an
+// entry only replaces one from an older term (or repeats it exactly), a
+// STATE never goes back a term, and an OFFSET agrees with the entry it
+// compacted away. Given the metadata of
+// a snapshot, it also checks that the log picks up where the snapshot
+// ends. The first violation stops it.
+
+// SnapshotPoint is the last index and term a snapshot covers.
+type SnapshotPoint struct {
+	Index int `json:"index"`
+	Term  int `json:"term"`
+}
+
+// Violation is the first thing Verify found wrong with a log.
+type Violation struct {
+	Line    int      `json:"line"`            // 1-based, 0 for the log as a whole
+	Offset  int64    `json:"offset"`          // of the start of the line, in bytes
+	Index   int      `json:"index,omitempty"` // raft index of the entry, if it has one
+	Check   string   `json:"check"`           // record, checksum, index, term or snapshot
+	Message string   `json:"message"`
+	Context []string `json:"context"` // the lines before it and the line itself
+}
+
+// Verification is what Verify read and found.
+type Verification struct {
+	Path        string     `json:"path"`
+	Records     int        `json:"records"`
+	Checksummed int        `json:"checksummed"` // records carrying a checksum, the rest predate them
+	Offset      int        `json:"offset"`      // first index the log holds
+	OffsetTerm  int        `json:"offsetTerm"`  // term of the entry before it, 0 if unknown
+	Entries     int        `json:"entries"`
+	LastIndex   int        `json:"lastIndex"` // -1 for an empty log
+	LastTerm    int        `json:"lastTerm"`
+	Replaced    int        `json:"replaced"`           // entries a later record overwrote
+	Term        int        `json:"term"`               // the node's term in its last STATE, 0 without one
+	VotedFor    string     `json:"votedFor,omitempty"` // and whom it voted for in it
+	TornTail    bool       `json:"tornTail,omitempty"` // the last line was cut short, as a crash leaves it
+	TornAt      int64      `json:"tornAt,omitempty"`   // where that line starts
+	Violation   *Violation `json:"violation,omitempty"`
+}
+
+// verifyContext is how many lines before a violation it reports.
+const verifyContext = 3
+
+// maxContextLine bounds each line of context.
+const maxContextLine = 200
+
+// maxLogLine bounds one line, as recovery does.
+const maxLogLine = 64 << 20
+
+// Verify checks the raft log at path, and its start against snap if that
+// isn't nil. The error is for logs it couldn't read at all.
+func Verify(path string, snap *SnapshotPoint) (Verification, error) {
+	v := Verification{Path: path, LastIndex: -1}
+	f, err := os.Open(path)
+	if err != nil {
+		return v, err
+	}
+	defer f.Close()
+
+	var l Log
+	var recent []string
+	var offset int64
+	r := bufio.NewReader(f)
+	for line := 1; ; line++ {
+		start := offset
+		text, err := r.ReadString('\n')
+		offset += int64(len(text))
+		if err != nil && !errors.Is(err, io.EOF) {
+			return v, err
+		}
+		if text == "" {
+			break
+		}
+		if len(text) > maxLogLine {
+			return v, fmt.Errorf("line %d is longer than %d bytes", line, maxLogLine)
+		}
+		torn := !strings.HasSuffix(text, "\n")
+		text = strings.TrimSuffix(strings.TrimSuffix(text, "\n"), "\r")
+		recent = append(recent, clip(text))
+		if len(recent) > verifyContext+1 {
+			recent = recent[1:]
+		}
+		fail := func(index int, check, format string, args ...any) {
+			v.Violation = &Violation{Line: line, Offset: start, Index: index, Check: check, Message: fmt.Sprintf(format, args...), Context: recent}
+		}
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+
+		rec, ok := wal.ParseLine(text)
+		if !ok || (rec.Op != "ENTRY" && rec.Op != "OFFSET" && rec.Op != "STATE") {
+			if torn {
+				v.TornTail, v.TornAt = true, start // recovery drops it too
+				break
+			}
+			fail(0, "record", "not an ENTRY, OFFSET or STATE record")
+			break
+		}
+		v.Records++
+		if rec.Op == "STATE" {
+			st, checked, err := parseState(rec)
+			if checked {
+				v.Checksummed++
+			}
+			if err != nil {
+				fail(0, checkOf(err), "%v", err)
+				break
+			}
+			if st.Term < l.State.Term {
+				fail(0, "term", "STATE goes back from term %d to %d", l.State.Term, st.Term)
+				break
+			}
+			l.State = st
+			continue
+		}
+		if rec.Op == "OFFSET" {
+			offset, term, checked, err := parseOffset(rec)
+			if checked {
+				v.Checksummed++
+			}
+			if err != nil {
+				fail(0, checkOf(err), "%v", err)
+				break
+			}
+			if prev := offset - 1; prev >= l.Offset && prev < l.Offset+len(l.Entries) && l.Entries[prev-l.Offset].Term != term {
+				fail(offset, "term", "OFFSET says entry %d has term %d, the log had it at term %d", prev, term, l.Entries[prev-l.Offset].Term)
+				break
+			}
+			l = Log{Offset: offset, Term: term, State: l.State}
+			continue
+		}
+
+		index, e, checked, err := parseEntry(rec)
+		if checked {
+			v.Checksummed++
+		}
+		if err != nil {
+			fail(0, checkOf(err), "%v", err)
+			break
+		}
+		next := l.Offset + len(l.Entries)
+		if index < l.Offset || index > next {
+			fail(index, "index", "entry %d doesn't follow the log, which holds %d to %d", index, l.Offset, next-1)
+			break
+		}
+		prevTerm := l.Term
+		if index > l.Offset {
+			prevTerm = l.Entries[index-1-l.Offset].Term
+		}
+		if e.Term < prevTerm {
+			fail(index, "term", "entry %d has term %d, below the %d of the entry before it", index, e.Term, prevTerm)
+			break
+		}
+		if index < next {
+			old := l.Entries[index-l.Offset]
+			if e.Term < old.Term {
+				fail(index, "term", "entry %d at term %d replaces one from the later term %d", index, e.Term, old.Term)
+				break
+			}
+			if e.Term == old.Term && e.Command != old.Command {
+				fail(index, "term", "entry %d at term %d replaces a different command from the same term", index, e.Term)
+				break
+			}
+			v.Replaced += next - index
+		}
+		l.Entries = append(l.Entries[:index-l.Offset], e)
+	}
+
+	v.Offset, v.OffsetTerm, v.Entries = l.Offset, l.Term, len(l.Entries)
+	v.Term, v.VotedFor = l.State.Term, l.State.VotedFor
+	if len(l.Entries) > 0 {
+		v.LastIndex = l.Offset + len(l.Entries) - 1
+		v.LastTerm = l.Entries[len(l.Entries)-1].Term
+	}
+	if v.Violation == nil && snap != nil {
+		v.Violation = checkSnapshot(l, *snap)
+	}
+	return v, nil
+}
+
+// checkSnapshot checks that the log carries on from snap: it must start no
+// later than the entry after the snapshot, and agree on that entry's term.
+func checkSnapshot(l Log, snap SnapshotPoint) *Violation {
+	fail := func(format string, args ...any) *Violation {
+		return &Violation{Index: snap.Index, Check: "snapshot", Message: fmt.Sprintf(format, args...)}
+	}
+	switch last := l.Offset + len(l.Entries) - 1; {
+	case snap.Index < l.Offset-1:
+		return fail("the log starts at %d but the snapshot ends at %d, entries %d to %d are in neither", l.Offset, snap.Index, snap.Index+1, l.Offset-1)
+	case snap.Index == l.Offset-1:
+		if l.Term != 0 && l.Term != snap.Term {
+			return fail("the snapshot ends at term %d, the log's OFFSET says %d", snap.Term, l.Term)
+		}
+	case snap.Index <= last:
+		if term := l.Entries[snap.Index-l.Offset].Term; term != snap.Term {
+			return fail("the snapshot ends at term %d, the log has entry %d at term %d", snap.Term, snap.Index, term)
+		}
+	default:
+		return fail("the snapshot ends at %d, past the log's last entry %d", snap.Index, last)
+	}
+	return nil
+}
+
+func checkOf(err error) string {
+	if errors.Is(err, errChecksum) {
+		return "checksum"
+	}
+	return "record"
+}
+
+func clip(line string) string {
+	if len(line) > maxContextLine {
+		return line[:maxContextLine] + "..."
+	}
+	return line
+}
@@ -0,0 +1,14 @@
+//go:build !failpoints
+
+package failpoint
+
+// Enabled reports whether failpoints are compiled in.
+const Enabled = false
+
+func Enable(name string, a Action) error { return ErrNotBuilt }
+func Disable(name string)                {}
+func Reset()                             {}
+func List() []Status                     { return nil }
+
+// Inject does nothing without -tags failpoints.
+func Inject(name string) error { return nil }
@@ -0,0 +1,110 @@
+//go:build failpoints
+
+package failpoint
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"sync"
+	"time"
+)
+
+// Enabled reports whether failpoints are compiled in.
+const Enabled = true
+
+type point struct {
+	action  Action
+	hits    int64
+	changed chan struct{} // closed when the action is replaced, ends a pause
+}
+
+var (
+	mu     sync.Mutex
+	points = map[string]*point{}
+)
+
+// Enable sets the action of the failpoint name.
+func Enable(name string, a Action) error {
+	if !known(name) {
+		return fmt.Errorf("unknown failpoint %q", name)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	p, ok := points[name]
+	if !ok {
+		p = &point{changed: make(chan struct{})}
+		points[name] = p
+	} else {
+		close(p.changed)
+		p.changed = make(chan struct{})
+	}
+	p.action = a
+	return nil
+}
+
+// Disable turns the failpoint name off.
+func Disable(name string) {
+	Enable(name, Action{Kind: "off"})
+}
+
+// Reset turns every failpoint off and forgets their hits.
+func Reset() {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, p := range points {
+		close(p.changed)
+	}
+	points = map[string]*point{}
+}
+
+// List returns every failpoint that was set.
+func List() []Status {
+	mu.Lock()
+	defer mu.Unlock()
+	var list []Status
+	for _, name := range Points {
+		if p, ok := points[name]; ok {
+			list = append(list, Status{Name: name, Action: p.action.String(), Hits: p.hits})
+		}
+	}
+	return list
+}
+
+// Inject runs the action of the failpoint name, returning the error an
+// error action makes the caller fail with.
+func Inject(name string) error {
+	mu.Lock()
+	p, ok := points[name]
+	if !ok || p.action.Kind == "off" || p.action.Percent > 0 && rand.IntN(100) >= p.action.Percent {
+		mu.Unlock()
+		return nil
+	}
+	a, changed := p.action, p.changed
+	p.hits++
+	if a.Count > 0 {
+		if p.action.Count--; p.action.Count == 0 {
+			p.action = Action{Kind: "off"}
+		}
+	}
+	mu.Unlock()
+
+	switch a.Kind {
+	case "error":
+		text := a.Arg
+		if text == "" {
+			text = "injected error"
+		}
+		return fmt.Errorf("failpoint %s: %s", name, text)
+	case "panic":
+		panic(fmt.Sprintf("failpoint %s: %s", name, a.Arg))
+	case "crash":
+		fmt.Fprintf(os.Stderr, "failpoint %s: crashing\n", name)
+		os.Exit(CrashExitCode)
+	case "sleep":
+		time.Sleep(a.Delay)
+	case "pause":
+		<-changed
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+//go:build failpoints
+
+package failpoint
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInjectCountsDown(t *testing.T) {
+	defer Reset()
+	if err := Inject(ServerBeforeApply); err != nil {
+		t.Fatalf("Unset failpoint fired: %v", err)
+	}
+	if err := Enable(ServerBeforeApply, Action{Kind: "error", Arg: "no", Count: 2}); err != nil {
+		t.Fatal(err)
+	}
+	for i := range 2 {
+		if err := Inject(ServerBeforeApply); err == nil {
+			t.Fatalf("Fire %d: expected an error", i+1)
+		}
+	}
+	if err := Inject(ServerBeforeApply); err != nil {
+		t.Fatalf("Failpoint fired after its count ran out: %v", err)
+	}
+	list := List()
+	if len(list) != 1 || list[0].Hits != 2 || list[0].Action != "off" {
+		t.Errorf("Unexpected status: %+v", list)
+	}
+	if err := Enable("no/such-point", Action{Kind: "crash"}); err == nil {
+		t.Error("Unknown failpoint was accepted")
+	}
+}
+
+func TestPauseEndsWhenDisabled(t *testing.T) {
+	defer Reset()
+	Enable(RaftAfterAppend, Action{Kind: "pause"})
+	done := make(chan error)
+	go func() { done <- Inject(RaftAfterAppend) }()
+
+	select {
+	case <-done:
+		t.Fatal("Paused failpoint returned before it was turned off")
+	case <-time.After(50 * time.Millisecond):
+	}
+	Disable(RaftAfterAppend)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Pause returned %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Pause didn't end when the failpoint was turned off")
+	}
+}
@@ -0,0 +1,147 @@
+// Package failpoint lets tests and the chaos API make a node fail at a
+// precise point of its write path: crash before the WAL fsync, stall after
+// an entry reaches the raft log, error out before a command is applied.
+//
+// Failpoints cost nothing unless the binary is built with -tags failpoints;
+// without the tag Inject is an empty function and Enable fails with
+// ErrNotBuilt. An action is one of
+//
+//	off          do nothing
+//	error(text)  make the point fail with an error, the text is optional
+//	panic(text)  panic
+//	crash        exit at once with CrashExitCode, like a kill -9 would
+//	sleep(d)     wait d, e.g. sleep(200ms)
+//	pause        wait until the failpoint is changed or turned off
+//
+// optionally after "N*" to fire N times only, or "P%" to fire with
+// probability P, in that order: "2*10%error" fires twice, each time with
+// one chance in ten.
+package failpoint
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The points the code injects at.
+const (
+	WALBeforeFsync    = "wal/before-fsync"    // a group commit is written but not fsynced
+	RaftAfterAppend   = "raft/after-append"   // entries are in the raft log, not yet on disk
+	ServerBeforeApply = "server/before-apply" // a command is about to hit the store
+)
+
+// Points lists every failpoint, for validating names.
+var Points = []string{WALBeforeFsync, RaftAfterAppend, ServerBeforeApply}
+
+// CrashExitCode is what the crash action exits with, so a harness can tell
+// a crash it asked for from any other exit.
+const CrashExitCode = 86
+
+// ErrNotBuilt is returned by Enable in binaries built without failpoints.
+var ErrNotBuilt = errors.New("failpoints are not compiled in, build with -tags failpoints")
+
+// Action is a parsed failpoint action.
+type Action struct {
+	Kind    string        `json:"kind"` // off, error, panic, crash, sleep or pause
+	Arg     string        `json:"arg,omitempty"`
+	Delay   time.Duration `json:"delayNs,omitempty"` // sleep's
+	Count   int           `json:"count,omitempty"`   // fires left, 0 for no limit
+	Percent int           `json:"percent,omitempty"` // chance of firing, 0 for always
+}
+
+// Parse reads an action like "error(disk full)" or "3*sleep(50ms)".
+func Parse(spec string) (Action, error) {
+	var a Action
+	rest := strings.TrimSpace(spec)
+	if n, after, ok := strings.Cut(rest, "*"); ok {
+		count, err := strconv.Atoi(n)
+		if err != nil || count <= 0 {
+			return a, fmt.Errorf("failpoint %q: bad count %q", spec, n)
+		}
+		a.Count, rest = count, after
+	}
+	if p, after, ok := strings.Cut(rest, "%"); ok {
+		pct, err := strconv.Atoi(p)
+		if err != nil || pct <= 0 || pct > 100 {
+			return a, fmt.Errorf("failpoint %q: bad percent %q", spec, p)
+		}
+		a.Percent, rest = pct, after
+	}
+	a.Kind = rest
+	if open := strings.IndexByte(rest, '('); open >= 0 {
+		if !strings.HasSuffix(rest, ")") {
+			return a, fmt.Errorf("failpoint %q: unclosed (", spec)
+		}
+		a.Kind, a.Arg = rest[:open], rest[open+1:len(rest)-1]
+	}
+	switch a.Kind {
+	case "off", "error", "panic", "crash", "pause":
+	case "sleep":
+		d, err := time.ParseDuration(a.Arg)
+		if err != nil || d < 0 {
+			return a, fmt.Errorf("failpoint %q: sleep needs a duration, e.g. sleep(100ms)", spec)
+		}
+		a.Delay = d
+	default:
+		return a, fmt.Errorf("failpoint %q: unknown action %q (off, error, panic, crash, sleep or pause)", spec, a.Kind)
+	}
+	return a, nil
+}
+
+func (a Action) String() string {
+	var b strings.Builder
+	if a.Count > 0 {
+		fmt.Fprintf(&b, "%d*", a.Count)
+	}
+	if a.Percent > 0 {
+		fmt.Fprintf(&b, "%d%%", a.Percent)
+	}
+	b.WriteString(a.Kind)
+	if a.Arg != "" {
+		b.WriteString("(" + a.Arg + ")")
+	}
+	return b.String()
+}
+
+// ParseList reads the -failpoints flag: name=action pairs separated by
+// semicolons, e.g. "wal/before-fsync=crash;raft/after-append=sleep(10ms)".
+func ParseList(spec string) (map[string]Action, error) {
+	actions := map[string]Action{}
+	for _, part := range strings.Split(spec, ";") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		name, action, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("failpoints: %q is not name=action", part)
+		}
+		if !known(name) {
+			return nil, fmt.Errorf("failpoints: unknown failpoint %q (one of %s)", name, strings.Join(Points, ", "))
+		}
+		a, err := Parse(action)
+		if err != nil {
+			return nil, err
+		}
+		actions[name] = a
+	}
+	return actions, nil
+}
+
+func known(name string) bool {
+	for _, p := range Points {
+		if p == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Status is one failpoint as List reports it.
+type Status struct {
+	Name   string `json:"name"`
+	Action string `json:"action"`
+	Hits   int64  `json:"hits"` // times it fired
+}
@@ -0,0 +1,54 @@
+package failpoint
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		spec string
+		want Action
+	}{
+		{"off", Action{Kind: "off"}},
+		{"crash", Action{Kind: "crash"}},
+		{"error(disk full)", Action{Kind: "error", Arg: "disk full"}},
+		{"3*sleep(50ms)", Action{Kind: "sleep", Arg: "50ms", Delay: 50 * time.Millisecond, Count: 3}},
+		{"2*10%error", Action{Kind: "error", Count: 2, Percent: 10}},
+		{" pause ", Action{Kind: "pause"}},
+	}
+	for _, c := range cases {
+		got, err := Parse(c.spec)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", c.spec, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("Parse(%q) = %+v, want %+v", c.spec, got, c.want)
+		}
+		if again, err := Parse(got.String()); err != nil || again != got {
+			t.Errorf("Parse(%q.String()) = %+v, %v", c.spec, again, err)
+		}
+	}
+	for _, bad := range []string{"", "boom", "0*crash", "x*crash", "200%crash", "sleep", "sleep(soon)", "error(oops"} {
+		if _, err := Parse(bad); err == nil {
+			t.Errorf("Parse(%q) should fail", bad)
+		}
+	}
+}
+
+func TestParseList(t *testing.T) {
+	actions, err := ParseList("wal/before-fsync=crash; raft/after-append=sleep(10ms);")
+	if err != nil {
+		t.Fatalf("ParseList: %v", err)
+	}
+	if len(actions) != 2 || actions[WALBeforeFsync].Kind != "crash" || actions[RaftAfterAppend].Delay != 10*time.Millisecond {
+		t.Errorf("Unexpected actions: %+v", actions)
+	}
+	if _, err := ParseList("wal/after-fsync=crash"); err == nil {
+		t.Error("Unknown failpoint was accepted")
+	}
+	if _, err := ParseList("crash"); err == nil {
+		t.Error("Missing name was accepted")
+	}
+}
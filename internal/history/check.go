@@ -0,0 +1,202 @@
+package history
+
+import (
+	"hash/fnv"
+	"sort"
+)
+
+// Check decides whether a history is linearizable for a key-value register,
+// using the Wing & Gong / Lowe search porcupine is built on. Keys are
+// independent, so each key's operations are checked on their own.
+
+type CheckResult struct {
+	Linearizable bool   `json:"linearizable"`
+	Operations   int    `json:"operations"`
+	Keys         int    `json:"keys"`
+	FailedKey    string `json:"failedKey,omitempty"` // first key with no valid ordering
+}
+
+func Check(ops []Operation) CheckResult {
+	byKey := make(map[string][]Operation)
+	for _, op := range ops {
+		byKey[op.Input.Key] = append(byKey[op.Input.Key], op)
+	}
+
+	keys := make([]string, 0, len(byKey))
+	for k := range byKey {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	res := CheckResult{Linearizable: true, Operations: len(ops), Keys: len(keys)}
+	for _, k := range keys {
+		if !checkKey(byKey[k]) {
+			res.Linearizable = false
+			res.FailedKey = k
+			return res
+		}
+	}
+	return res
+}
+
+// register is the model state for one key.
+type register struct {
+	value  string
+	exists bool
+}
+
+func step(s register, op Operation) (register, bool) {
+	switch op.Input.Op {
+	case "SET":
+		return register{value: op.Input.Value, exists: true}, true
+	case "GET":
+		if op.Output.Found != s.exists {
+			return s, false
+		}
+		return s, !s.exists || op.Output.Value == s.value
+	}
+	return s, true // operations the model doesn't know don't constrain it
+}
+
+// event is a call or return in the doubly linked list the search walks.
+type event struct {
+	id         int
+	isCall     bool
+	time       int64
+	match      *event // call -> its return
+	prev, next *event
+}
+
+type bitset []uint64
+
+func (b bitset) set(i int)   { b[i/64] |= 1 << (uint(i) % 64) }
+func (b bitset) clear(i int) { b[i/64] &^= 1 << (uint(i) % 64) }
+func (b bitset) clone() bitset {
+	c := make(bitset, len(b))
+	copy(c, b)
+	return c
+}
+func (b bitset) equals(o bitset) bool {
+	for i := range b {
+		if b[i] != o[i] {
+			return false
+		}
+	}
+	return true
+}
+func (b bitset) hash() uint64 {
+	h := fnv.New64a()
+	var buf [8]byte
+	for _, w := range b {
+		for i := 0; i < 8; i++ {
+			buf[i] = byte(w >> (8 * i))
+		}
+		h.Write(buf[:])
+	}
+	return h.Sum64()
+}
+
+type cacheEntry struct {
+	linearized bitset
+	state      register
+}
+
+func checkKey(ops []Operation) bool {
+	events := make([]*event, 0, 2*len(ops))
+	for i, op := range ops {
+		call := &event{id: i, isCall: true, time: op.Call}
+		ret := &event{id: i, time: op.Return}
+		call.match = ret
+		events = append(events, call, ret)
+	}
+	// Calls sort before returns at the same instant, the more permissive choice.
+	sort.SliceStable(events, func(i, j int) bool {
+		if events[i].time != events[j].time {
+			return events[i].time < events[j].time
+		}
+		return events[i].isCall && !events[j].isCall
+	})
+
+	head := &event{}
+	prev := head
+	for _, e := range events {
+		prev.next = e
+		e.prev = prev
+		prev = e
+	}
+
+	lift := func(e *event) {
+		e.prev.next = e.next
+		if e.next != nil {
+			e.next.prev = e.prev
+		}
+		r := e.match
+		r.prev.next = r.next
+		if r.next != nil {
+			r.next.prev = r.prev
+		}
+	}
+	unlift := func(e *event) {
+		r := e.match
+		r.prev.next = r
+		if r.next != nil {
+			r.next.prev = r
+		}
+		e.prev.next = e
+		if e.next != nil {
+			e.next.prev = e
+		}
+	}
+
+	type frame struct {
+		call  *event
+		state register
+	}
+	var stack []frame
+	linearized := make(bitset, (len(ops)+63)/64)
+	cache := make(map[uint64][]cacheEntry)
+	seen := func(b bitset, s register) bool {
+		h := b.hash()
+		for _, c := range cache[h] {
+			if c.state == s && c.linearized.equals(b) {
+				return true
+			}
+		}
+		cache[h] = append(cache[h], cacheEntry{linearized: b, state: s})
+		return false
+	}
+
+	state := register{}
+	e := head.next
+	for head.next != nil {
+		if e.isCall {
+			next, ok := step(state, ops[e.id])
+			if ok {
+				candidate := linearized.clone()
+				candidate.set(e.id)
+				if !seen(candidate, next) {
+					stack = append(stack, frame{call: e, state: state})
+					state = next
+					linearized.set(e.id)
+					lift(e)
+					e = head.next
+					continue
+				}
+			}
+			e = e.next
+			continue
+		}
+
+		// Reached a return whose call isn't linearized yet: backtrack.
+		if len(stack) == 0 {
+			return false
+		}
+		top := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		state = top.state
+		linearized.clear(top.call.id)
+		unlift(top.call)
+		e = top.call.next
+	}
+	return true
+}
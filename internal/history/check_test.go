@@ -0,0 +1,38 @@
+package history
+
+import "testing"
+
+func set(client, key, value string, call, ret int64) Operation {
+	return Operation{ClientID: client, Input: Input{Op: "SET", Key: key, Value: value}, Call: call, Return: ret}
+}
+
+func get(client, key, value string, found bool, call, ret int64) Operation {
+	return Operation{ClientID: client, Input: Input{Op: "GET", Key: key}, Output: Output{Value: value, Found: found}, Call: call, Return: ret}
+}
+
+func TestCheckLinearizable(t *testing.T) {
+	// The read overlaps the write, so it may see either the old or the new value.
+	ops := []Operation{
+		set("c1", "x", "1", 0, 10),
+		set("c1", "x", "2", 20, 40),
+		get("c2", "x", "1", true, 25, 30),
+		get("c2", "x", "2", true, 45, 50),
+		get("c3", "y", "", false, 0, 5),
+	}
+	if res := Check(ops); !res.Linearizable {
+		t.Fatalf("expected linearizable history, got %+v", res)
+	}
+}
+
+func TestCheckStaleRead(t *testing.T) {
+	// The read starts after the write of 2 finished, so seeing 1 is a stale read.
+	ops := []Operation{
+		set("c1", "x", "1", 0, 10),
+		set("c1", "x", "2", 20, 30),
+		get("c2", "x", "1", true, 40, 50),
+	}
+	res := Check(ops)
+	if res.Linearizable || res.FailedKey != "x" {
+		t.Fatalf("expected stale read on x to be caught, got %+v", res)
+	}
+}
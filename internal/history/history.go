@@ -0,0 +1,93 @@
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Operation is one client operation as seen by the server, in the same
+// shape porcupine uses: an input, an output and the call/return timestamps.
+type Operation struct {
+	ClientID string `json:"clientId"`
+	Input    Input  `json:"input"`
+	Call     int64  `json:"call"` // unix nanoseconds when the command was read
+	Output   Output `json:"output"`
+	Return   int64  `json:"return"` // unix nanoseconds when the reply was written
+}
+
+type Input struct {
+	Op    string `json:"op"` // "GET" or "SET"
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+}
+
+type Output struct {
+	Value string `json:"value,omitempty"`
+	Found bool   `json:"found"` // GET: false means the key was missing
+}
+
+// Recorder appends operations as JSON lines to a history file.
+type Recorder struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+func NewRecorder(path string) (*Recorder, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &Recorder{file: f, enc: json.NewEncoder(f)}, nil
+}
+
+// Record writes one finished operation; call is when the command was received.
+func (r *Recorder) Record(clientID string, in Input, out Output, call time.Time) {
+	op := Operation{
+		ClientID: clientID,
+		Input:    in,
+		Call:     call.UnixNano(),
+		Output:   out,
+		Return:   time.Now().UnixNano(),
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.enc.Encode(op)
+}
+
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.file.Close()
+}
+
+// Load reads and merges history files (one per node), ordered by call time.
+func Load(paths ...string) ([]Operation, error) {
+	var ops []Operation
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var op Operation
+			if err := json.Unmarshal(scanner.Bytes(), &op); err != nil {
+				continue // torn line from a crash
+			}
+			ops = append(ops, op)
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(ops, func(i, j int) bool { return ops[i].Call < ops[j].Call })
+	return ops, nil
+}
@@ -0,0 +1,162 @@
+// Package merkle builds hash trees over a key/value state so two replicas
+// can find where they differ by comparing a few hashes instead of every
+// key. Keys are placed in leaves by a fixed hash, the same on every node;
+// a leaf's hash covers every key, value and expiry in it regardless of
+// order, and each inner node hashes its Fanout children. Comparing from the
+// root down only visits the subtrees whose hashes differ.
+package merkle
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+)
+
+// Fanout is how many children every inner node has.
+const Fanout = 16
+
+// MaxDepth bounds trees to 16^6 (about 16 million) leaves.
+const MaxDepth = 6
+
+// Tree is a hash tree of a given depth: level 0 is the root, level Depth
+// holds the Fanout^Depth leaves.
+type Tree struct {
+	depth  int
+	levels [][]uint64
+	sealed bool
+}
+
+// New returns an empty tree with depth levels below the root.
+func New(depth int) *Tree {
+	depth = min(max(depth, 1), MaxDepth)
+	t := &Tree{depth: depth, levels: make([][]uint64, depth+1)}
+	for l := range t.levels {
+		t.levels[l] = make([]uint64, pow(l))
+	}
+	return t
+}
+
+// DepthFor picks a depth that puts about perLeaf keys in each leaf.
+func DepthFor(keys, perLeaf int) int {
+	depth := 1
+	for depth < MaxDepth && pow(depth)*max(perLeaf, 1) < keys {
+		depth++
+	}
+	return depth
+}
+
+// Depth is the number of levels below the root.
+func (t *Tree) Depth() int { return t.depth }
+
+// Leaf is the leaf key belongs to.
+func (t *Tree) Leaf(key string) int {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return int(h.Sum64() >> (64 - 4*t.depth)) // Fanout 16 is 4 bits a level
+}
+
+// Add puts a key with its value and expiry (0 for none) into its leaf.
+// Every key is added once, before Seal.
+func (t *Tree) Add(key, value string, expiry int64) {
+	leaves := t.levels[t.depth]
+	leaves[t.Leaf(key)] ^= entryHash(key, value, expiry)
+}
+
+// Seal computes the inner nodes from the leaves.
+func (t *Tree) Seal() {
+	var buf [Fanout * 8]byte
+	for l := t.depth - 1; l >= 0; l-- {
+		below := t.levels[l+1]
+		for i := range t.levels[l] {
+			for c, h := range below[i*Fanout : (i+1)*Fanout] {
+				binary.LittleEndian.PutUint64(buf[c*8:], h)
+			}
+			t.levels[l][i] = mix(fnv64(buf[:]))
+		}
+	}
+	t.sealed = true
+}
+
+// Root is the hash of the whole tree.
+func (t *Tree) Root() uint64 { return t.Node(0, 0) }
+
+// Node is the hash of node i at level.
+func (t *Tree) Node(level, i int) uint64 {
+	if !t.sealed {
+		panic("merkle: tree read before Seal")
+	}
+	return t.levels[level][i]
+}
+
+// Children returns the hashes of node i's children, which are at level+1.
+func (t *Tree) Children(level, i int) []uint64 {
+	if level >= t.depth {
+		return nil
+	}
+	child := t.levels[level+1][i*Fanout : (i+1)*Fanout]
+	return append([]uint64(nil), child...)
+}
+
+// DiffChildren returns which children of node i at level differ from
+// theirs, as indexes at level+1.
+func (t *Tree) DiffChildren(level, i int, theirs []uint64) []int {
+	var differ []int
+	for c, h := range t.Children(level, i) {
+		if c >= len(theirs) || h != theirs[c] {
+			differ = append(differ, i*Fanout+c)
+		}
+	}
+	return differ
+}
+
+// FormatHashes writes hashes as comma separated hex, what ParseHashes reads.
+func FormatHashes(hashes []uint64) string {
+	parts := make([]string, len(hashes))
+	for i, h := range hashes {
+		parts[i] = strconv.FormatUint(h, 16)
+	}
+	return strings.Join(parts, ",")
+}
+
+// ParseHashes reads what FormatHashes wrote.
+func ParseHashes(text string) ([]uint64, error) {
+	parts := strings.Split(text, ",")
+	hashes := make([]uint64, len(parts))
+	for i, p := range parts {
+		h, err := strconv.ParseUint(p, 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad hash %q", p)
+		}
+		hashes[i] = h
+	}
+	return hashes, nil
+}
+
+func pow(level int) int { return 1 << (4 * level) }
+
+func entryHash(key, value string, expiry int64) uint64 {
+	h := fnv.New64a()
+	var n [binary.MaxVarintLen64]byte
+	h.Write(n[:binary.PutUvarint(n[:], uint64(len(key)))])
+	h.Write([]byte(key))
+	h.Write(n[:binary.PutVarint(n[:], expiry)])
+	h.Write([]byte(value))
+	return mix(h.Sum64())
+}
+
+func fnv64(b []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(b)
+	return h.Sum64()
+}
+
+// mix is murmur3's finalizer: FNV on its own is close to linear under XOR.
+func mix(x uint64) uint64 {
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	return x ^ x>>33
+}
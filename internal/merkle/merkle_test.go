@@ -0,0 +1,69 @@
+package merkle
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func build(depth int, data map[string]string) *Tree {
+	t := New(depth)
+	for k, v := range data {
+		t.Add(k, v, 0)
+	}
+	t.Seal()
+	return t
+}
+
+func TestDiffFindsOnlyChangedLeaves(t *testing.T) {
+	ours := make(map[string]string)
+	for i := range 1000 {
+		ours[fmt.Sprintf("key-%d", i)] = "v"
+	}
+	theirs := make(map[string]string)
+	for k, v := range ours {
+		theirs[k] = v
+	}
+	if a, b := build(2, ours), build(2, theirs); a.Root() != b.Root() {
+		t.Fatal("Expected equal states to have equal roots")
+	}
+
+	theirs["key-7"] = "changed"
+	delete(theirs, "key-500")
+	a, b := build(2, ours), build(2, theirs)
+	if a.Root() == b.Root() {
+		t.Fatal("Expected the roots to differ")
+	}
+	var leaves []int
+	for _, mid := range a.DiffChildren(0, 0, b.Children(0, 0)) {
+		leaves = append(leaves, a.DiffChildren(1, mid, b.Children(1, mid))...)
+	}
+	want := []int{a.Leaf("key-7"), a.Leaf("key-500")}
+	slices.Sort(want)
+	want = slices.Compact(want)
+	if !slices.Equal(leaves, want) {
+		t.Errorf("Expected leaves %v to differ, got %v", want, leaves)
+	}
+}
+
+func TestExpiryCounts(t *testing.T) {
+	a, b := New(1), New(1)
+	a.Add("k", "v", 0)
+	b.Add("k", "v", 1700000000000)
+	a.Seal()
+	b.Seal()
+	if a.Root() == b.Root() {
+		t.Error("Expected an expiry to change the hash")
+	}
+}
+
+func TestHashesRoundTrip(t *testing.T) {
+	in := []uint64{0, 1, 1<<64 - 1}
+	out, err := ParseHashes(FormatHashes(in))
+	if err != nil || !slices.Equal(in, out) {
+		t.Errorf("Expected %v back, got %v %v", in, out, err)
+	}
+	if DepthFor(10, 64) != 1 || DepthFor(1_000_000, 64) != 4 {
+		t.Errorf("Unexpected depths %d %d", DepthFor(10, 64), DepthFor(1_000_000, 64))
+	}
+}
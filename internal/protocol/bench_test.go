@@ -0,0 +1,38 @@
+package protocol
+
+import "testing"
+
+// Parsing the lines the command loop sees most, the old way and with a
+// Parser, e.g.
+//
+//	go test -run '^$' -bench . -benchmem ./internal/protocol
+
+var benchLines = [][]byte{
+	[]byte("GET user:1234"),
+	[]byte("SET user:1234 a value of a few words"),
+}
+
+// BenchmarkParse is Parse with the line copied out of the read buffer first,
+// as the command loop did.
+func BenchmarkParse(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		c, err := Parse(string(benchLines[i%len(benchLines)]))
+		if err != nil {
+			b.Fatal(err)
+		}
+		_ = c.Rest(2)
+	}
+}
+
+func BenchmarkParser(b *testing.B) {
+	var p Parser
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		c, err := p.Parse(benchLines[i%len(benchLines)])
+		if err != nil {
+			b.Fatal(err)
+		}
+		_ = p.Rest(c, 2)
+	}
+}
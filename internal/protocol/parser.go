@@ -0,0 +1,74 @@
+package protocol
+
+import (
+	"bytes"
+	"slices"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Parser is Parse for a connection's command loop, which reads line after
+// line into the same buffer. It splits the bytes as they are, reuses one
+// Command's slice from line to line, and keeps the line, so Rest is a slice
+// of it rather than a join when the words are one space apart, the way
+// clients send them. What an allocation is left is the line's one copy,
+// which the words share: they outlive the buffer.
+//
+// A Command from Parse is good until the next Parse.
+type Parser struct {
+	line   string
+	words  Command
+	starts []int // where each word begins in line
+	spaced int   // words from this one on are one space apart
+}
+
+// Parse splits line, without its "\n", the way the package's Parse does.
+func (p *Parser) Parse(line []byte) (Command, error) {
+	if bytes.IndexByte(line, '\n') >= 0 {
+		return nil, ErrLineBreak
+	}
+	p.line = string(line)
+	p.words, p.starts, p.spaced = p.words[:0], p.starts[:0], 0
+	s, start := p.line, -1
+	for i := 0; i < len(s); {
+		r, size := rune(s[i]), 1
+		if r >= utf8.RuneSelf {
+			r, size = utf8.DecodeRuneInString(s[i:])
+		}
+		switch {
+		case unicode.IsSpace(r):
+			if start >= 0 {
+				p.words = append(p.words, s[start:i])
+				start = -1
+			}
+		case start < 0:
+			if n := len(p.words); n > 0 && (i != p.starts[n-1]+len(p.words[n-1])+1 || s[i-1] != ' ') {
+				p.spaced = n
+			}
+			start = i
+			p.starts = append(p.starts, i)
+		}
+		i += size
+	}
+	if start >= 0 {
+		p.words = append(p.words, s[start:])
+	}
+	if len(p.words) == 0 {
+		return nil, ErrEmpty
+	}
+	return p.words, nil
+}
+
+// Rest is c.Rest(i) for c the last Command Parse returned, or the front of
+// it, as a middleware leaves it after taking trailing words off. Any other
+// Command gets its words joined.
+func (p *Parser) Rest(c Command, i int) string {
+	if i < 0 || i >= len(c) {
+		return ""
+	}
+	if i < p.spaced || len(c) > len(p.words) || !slices.Equal(c[i:], p.words[i:len(c)]) {
+		return c.Rest(i)
+	}
+	last := len(c) - 1
+	return p.line[p.starts[i] : p.starts[last]+len(c[last])]
+}
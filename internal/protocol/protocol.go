@@ -0,0 +1,132 @@
+// Package protocol reads and writes the line protocol clients and nodes
+// speak over TCP, and that raft log entries are written in.
+//
+// A request is one line of words separated by whitespace, the command name
+// first: "SET user alice". Words can't be empty or hold whitespace, so a
+// value is whatever follows its position and is read back with Rest, which
+// joins the words with single spaces: "SET k hello  world" sets "hello
+// world". The one thing a line can't carry is a line break.
+//
+// An error reply is "ERR_<CODE> <text>", from protocol version 2 on.
+//
+// Parse and Command.String round-trip: whatever Parse returns, parsing its
+// String again gives the same Command, and nothing Parse is given makes it
+// or the accessors panic. The fuzz tests hold them to that.
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+var (
+	// ErrEmpty is a line with no words, which the server skips.
+	ErrEmpty = errors.New("empty command")
+	// ErrLineBreak is an argument the line protocol can't carry.
+	ErrLineBreak = errors.New("arguments can't contain line breaks")
+)
+
+// Command is a parsed request line: the name, then its arguments. It is a
+// plain slice, so c[1] is the first argument and len(c) counts the name.
+type Command []string
+
+// Parse splits one request line, without its "\n", into a Command. A
+// trailing "\r" is whitespace like any other.
+func Parse(line string) (Command, error) {
+	if strings.IndexByte(line, '\n') >= 0 {
+		return nil, ErrLineBreak
+	}
+	words := strings.FieldsFunc(line, unicode.IsSpace)
+	if len(words) == 0 {
+		return nil, ErrEmpty
+	}
+	return Command(words), nil
+}
+
+// Format renders words as a request line for Parse. A word holding
+// whitespace arrives as several, which Rest puts back together for a
+// value, and an empty word doesn't arrive at all. Line breaks can't be
+// sent.
+func Format(words ...string) (string, error) {
+	if len(words) == 0 {
+		return "", ErrEmpty
+	}
+	for _, w := range words {
+		if strings.ContainsAny(w, "\r\n") {
+			return "", ErrLineBreak
+		}
+	}
+	line := strings.Join(words, " ")
+	if strings.TrimSpace(line) == "" {
+		return "", ErrEmpty
+	}
+	return line, nil
+}
+
+// Name is the command name, "" for an empty Command.
+func (c Command) Name() string {
+	return c.Arg(0)
+}
+
+// Arg is word i, 0 being the name, or "" if there are fewer words.
+func (c Command) Arg(i int) string {
+	if i < 0 || i >= len(c) {
+		return ""
+	}
+	return c[i]
+}
+
+// Rest joins the words from i on, the value of SET and its kind.
+func (c Command) Rest(i int) string {
+	if i < 0 || i >= len(c) {
+		return ""
+	}
+	return strings.Join(c[i:], " ")
+}
+
+// RestLen is len(c.Rest(i)), without joining the words.
+func (c Command) RestLen(i int) int {
+	if i < 0 || i >= len(c) {
+		return 0
+	}
+	n := len(c) - i - 1 // the spaces
+	for _, w := range c[i:] {
+		n += len(w)
+	}
+	return n
+}
+
+// Int reads word i as a decimal integer.
+func (c Command) Int(i int) (int, error) {
+	if i < 0 || i >= len(c) {
+		return 0, fmt.Errorf("%s: missing argument %d", c.Name(), i)
+	}
+	n, err := strconv.Atoi(c[i])
+	if err != nil {
+		return 0, fmt.Errorf("%s: argument %d is not an integer: %q", c.Name(), i, c[i])
+	}
+	return n, nil
+}
+
+// String renders c as a request line, the inverse of Parse.
+func (c Command) String() string {
+	return strings.Join(c, " ")
+}
+
+// ErrorReply renders an error reply.
+func ErrorReply(code, text string) string {
+	return "ERR_" + code + " " + text
+}
+
+// ParseError reads an error reply, ok is false for any other line.
+func ParseError(line string) (code, text string, ok bool) {
+	rest, ok := strings.CutPrefix(line, "ERR_")
+	if !ok {
+		return "", "", false
+	}
+	code, text, _ = strings.Cut(rest, " ")
+	return code, text, true
+}
@@ -0,0 +1,161 @@
+package protocol
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"unicode"
+)
+
+func TestParse(t *testing.T) {
+	for _, tc := range []struct {
+		line string
+		want Command
+		err  error
+	}{
+		{"SET user alice", Command{"SET", "user", "alice"}, nil},
+		{"  SET\tk  hello   world \r", Command{"SET", "k", "hello", "world"}, nil},
+		{"PING", Command{"PING"}, nil},
+		{"", nil, ErrEmpty},
+		{" \t\r", nil, ErrEmpty},
+		{"SET k a\nb", nil, ErrLineBreak},
+		{"SET k \xff\xfe", Command{"SET", "k", "\xff\xfe"}, nil}, // bytes pass through
+	} {
+		got, err := Parse(tc.line)
+		if !errors.Is(err, tc.err) || !slices.Equal(got, tc.want) {
+			t.Errorf("Parse(%q) = %q, %v, expected %q, %v", tc.line, got, err, tc.want, tc.err)
+		}
+	}
+
+	c, _ := Parse("SET k hello  world")
+	if c.Name() != "SET" || c.Arg(1) != "k" || c.Rest(2) != "hello world" || c.Arg(9) != "" || c.Rest(9) != "" {
+		t.Errorf("unexpected accessors on %q", c)
+	}
+	if _, err := c.Int(1); err == nil {
+		t.Error("expected k not to read as an integer")
+	}
+	if n, err := (Command{"GETBIT", "k", "42"}).Int(2); n != 42 || err != nil {
+		t.Errorf("expected 42, got %d, %v", n, err)
+	}
+}
+
+func TestErrorReply(t *testing.T) {
+	code, text, ok := ParseError(ErrorReply("NOTLEADER", "not the leader"))
+	if !ok || code != "NOTLEADER" || text != "not the leader" {
+		t.Errorf("expected the reply back, got %q %q %v", code, text, ok)
+	}
+	if _, _, ok := ParseError("OK"); ok {
+		t.Error("expected OK not to be an error")
+	}
+}
+
+// FuzzParse holds Parse to the package's promises on any line: no panics,
+// no empty or whitespace words, and String round-trips.
+func FuzzParse(f *testing.F) {
+	for _, seed := range []string{"SET user alice", "  GET\tk\r", "", "APPEND k a  b", "APPENDENTRIES 3 :8080 10 2 9 v3", "SET k \x00\xff", " SET k v"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, line string) {
+		c, err := Parse(line)
+		if err != nil {
+			if c != nil {
+				t.Fatalf("Parse(%q) returned %q with %v", line, c, err)
+			}
+			return
+		}
+		for i, w := range c {
+			if w == "" || strings.IndexFunc(w, unicode.IsSpace) >= 0 {
+				t.Fatalf("Parse(%q) word %d is %q", line, i, w)
+			}
+		}
+		again, err := Parse(c.String())
+		if err != nil || !slices.Equal(again, c) {
+			t.Fatalf("Parse(%q) = %q, which parses back as %q, %v", line, c, again, err)
+		}
+		for i := -1; i <= len(c); i++ { // none of these may panic
+			c.Arg(i)
+			c.Rest(i)
+			c.Int(i)
+		}
+	})
+}
+
+// FuzzFormat checks what Format writes parses back: every word that holds
+// no whitespace as itself, and a value as its words joined by Rest.
+func FuzzFormat(f *testing.F) {
+	f.Add("SET", "k", "hello world")
+	f.Add("GET", "", "")
+	f.Add("SET", "k", "a\nb")
+	f.Fuzz(func(t *testing.T, name, key, value string) {
+		line, err := Format(name, key, value)
+		if strings.ContainsAny(name+key+value, "\r\n") {
+			if !errors.Is(err, ErrLineBreak) {
+				t.Fatalf("Format(%q, %q, %q) = %q, %v, expected ErrLineBreak", name, key, value, line, err)
+			}
+			return
+		}
+		c, perr := Parse(line)
+		if err != nil {
+			if !errors.Is(err, ErrEmpty) || !errors.Is(perr, ErrEmpty) {
+				t.Fatalf("Format(%q, %q, %q) failed with %v, Parse says %v", name, key, value, err, perr)
+			}
+			return
+		}
+		want := strings.Fields(name + " " + key + " " + value)
+		if !slices.Equal(c, want) {
+			t.Fatalf("Format(%q, %q, %q) = %q parses as %q, expected %q", name, key, value, line, c, want)
+		}
+		canonical := func(s string) bool { return s != "" && strings.IndexFunc(s, unicode.IsSpace) < 0 }
+		if canonical(name) && canonical(key) && value == strings.Join(strings.Fields(value), " ") && c.Rest(2) != value {
+			t.Fatalf("value %q came back as %q", value, c.Rest(2))
+		}
+	})
+}
+
+func TestParserRest(t *testing.T) {
+	var p Parser
+	c, err := p.Parse([]byte("SET k hello world ID tok"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := p.Rest(c, 2); got != "hello world ID tok" {
+		t.Errorf("expected the value and token, got %q", got)
+	}
+	if got := p.Rest(c[:4], 2); got != "hello world" {
+		t.Errorf("expected the value without the token, got %q", got)
+	}
+	if got := p.Rest(Command{"SET", "k", "other", "words"}, 2); got != "other words" {
+		t.Errorf("expected another Command's words joined, got %q", got)
+	}
+	if c, _ = p.Parse([]byte("SET k  hello\tworld")); p.Rest(c, 2) != "hello world" || p.Rest(c, 9) != "" {
+		t.Errorf("expected the words joined with single spaces, got %q", p.Rest(c, 2))
+	}
+	if n := c.RestLen(2); n != len("hello world") {
+		t.Errorf("expected RestLen %d, got %d", len("hello world"), n)
+	}
+}
+
+// FuzzParser holds Parser to Parse on any line, reusing one Parser the way
+// a connection does.
+func FuzzParser(f *testing.F) {
+	for _, seed := range []string{"SET user alice", "  GET\tk\r", "", "SET k a  b c", "SET k v w", "SET k \x00\xff"} {
+		f.Add(seed)
+	}
+	var p Parser
+	f.Fuzz(func(t *testing.T, line string) {
+		want, wantErr := Parse(line)
+		c, err := p.Parse([]byte(line))
+		if !errors.Is(err, wantErr) || !slices.Equal(c, want) {
+			t.Fatalf("Parser.Parse(%q) = %q, %v, Parse gives %q, %v", line, c, err, want, wantErr)
+		}
+		for i := -1; i <= len(c); i++ {
+			if got := p.Rest(c, i); got != c.Rest(i) || c.RestLen(i) != len(got) {
+				t.Fatalf("Rest(%d) of %q = %q, expected %q", i, line, got, c.Rest(i))
+			}
+			if i > 0 && p.Rest(c[:i], 0) != c[:i].Rest(0) {
+				t.Fatalf("Rest(0) of the first %d words of %q = %q, expected %q", i, line, p.Rest(c[:i], 0), c[:i].Rest(0))
+			}
+		}
+	})
+}
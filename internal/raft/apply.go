@@ -0,0 +1,37 @@
+package raft
+
+import "slices"
+
+// The state machine takes entries with TakeCommitted, woken by ApplyReady.
+// Every node, the leader included, takes only what has committed, in log
+// order, so nothing it applies can be undone by a later leader's log.
+
+// ApplyReady is signalled when TakeCommitted may have more to return.
+func (c *Consensus) ApplyReady() <-chan struct{} {
+	return c.applyCh
+}
+
+// notifyApply wakes whoever waits on ApplyReady. It never blocks. Callers
+// hold c.mu.
+func (c *Consensus) notifyApply() {
+	select {
+	case c.applyCh <- struct{}{}:
+	default:
+	}
+}
+
+// TakeCommitted returns up to n entries ready to apply and the index of
+// the first, and counts them as applied. They are a copy: appends rewrite
+// the log's array in place.
+func (c *Consensus) TakeCommitted(n int) (int, []LogEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	limit := min(c.CommitIndex, c.lastIndex())
+	start := max(c.lastApplied+1, c.logOffset) // entries before the offset came in with a snapshot
+	if start > limit {
+		return start, nil
+	}
+	end := min(limit, start+n-1)
+	c.lastApplied = end
+	return start, slices.Clone(c.Log[start-c.logOffset : end-c.logOffset+1])
+}
@@ -0,0 +1,118 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// The leader dials every follower each heartbeat. Once a dial fails the
+// peer is left alone for a while before the next one, twice as long after
+// each failure in a row up to dialBackoffMax, less a random part of it so
+// followers that went down together aren't redialed in step. After
+// circuitThreshold failures in a row the circuit opens: the peer is logged
+// as down, and what gets through is one probe per interval, so a dead node
+// costs a dial every couple of seconds instead of ten a second. The first
+// dial that works closes the circuit and clears the backoff.
+//
+// Only replication and snapshots go through this. Votes and handshakes
+// keep their own pace, and the server's own requests of its peers, see
+// DialPeer, are made when asked for.
+
+const (
+	dialBackoffBase  = heartbeatInterval
+	dialBackoffMax   = 2 * time.Second
+	circuitThreshold = 5
+)
+
+// Dial states, see PeerStatus.
+const (
+	DialOK      = "ok"      // the last dial worked, or none failed yet
+	DialBackoff = "backoff" // dials failed, the next waits until RetryAt
+	DialOpen    = "open"    // failed circuitThreshold times in a row, probed once per interval
+)
+
+// ErrBackingOff is returned instead of dialing a peer whose backoff hasn't
+// run out.
+var ErrBackingOff = errors.New("backing off")
+
+// dialBackoff is how dialing one peer has been going. Only peers whose
+// last dial failed have one.
+type dialBackoff struct {
+	failures int
+	retryAt  time.Time
+	lastErr  string
+}
+
+// state is the dial state the failures add up to.
+func (b *dialBackoff) state() string {
+	switch {
+	case b == nil:
+		return DialOK
+	case b.failures >= circuitThreshold:
+		return DialOpen
+	default:
+		return DialBackoff
+	}
+}
+
+// backoffDelay is how long to wait after the given number of failures in a
+// row, jittered over its upper half.
+func backoffDelay(failures int) time.Duration {
+	d := dialBackoffMax
+	if failures < 16 { // beyond this the shift only overflows
+		d = min(dialBackoffBase<<(failures-1), dialBackoffMax)
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// dial connects to peer unless it is backing off. While it is, one caller
+// at a time gets through once retryAt has passed: the others see the
+// retry pushed out by another delay.
+func (c *Consensus) dial(peer string) (net.Conn, error) {
+	c.mu.Lock()
+	b := c.dialBackoff[peer]
+	if b != nil {
+		now := c.clock.Now()
+		if retryAt := b.retryAt; now.Before(retryAt) {
+			c.mu.Unlock()
+			return nil, fmt.Errorf("dial %s: %w until %s", peer, ErrBackingOff, retryAt.Format(time.StampMilli))
+		}
+		b.retryAt = now.Add(backoffDelay(b.failures))
+	}
+	c.mu.Unlock()
+
+	conn, err := c.transport.Dial(peer)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		c.dialFailed(peer, err)
+		return nil, err
+	}
+	if b := c.dialBackoff[peer]; b != nil {
+		if b.state() == DialOpen {
+			fmt.Printf("[%s] %s is reachable again after %d failed dials\n", c.ID, peer, b.failures)
+		}
+		delete(c.dialBackoff, peer)
+	}
+	return conn, nil
+}
+
+// dialFailed counts a failed dial of peer and sets when to try again.
+// Callers hold c.mu.
+func (c *Consensus) dialFailed(peer string, err error) {
+	b := c.dialBackoff[peer]
+	if b == nil {
+		b = &dialBackoff{}
+		c.dialBackoff[peer] = b
+	}
+	b.failures++
+	b.lastErr = err.Error()
+	b.retryAt = c.clock.Now().Add(backoffDelay(b.failures))
+	if b.failures == circuitThreshold {
+		fmt.Printf("[%s] %s is unreachable after %d dials, probing it about every %v: %v\n", c.ID, peer, b.failures, dialBackoffMax, err)
+	}
+}
@@ -0,0 +1,126 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/mathdee/KV-Store/internal/tracing"
+)
+
+// An entry is committed once a majority of the cluster holds it; from then
+// on no future leader can be elected without it. The leader tracks that
+// from its followers' matchIndex and tells whoever proposed the entry.
+
+var (
+	ErrNotLeader      = errors.New("raft: not the leader")
+	ErrLostLeadership = errors.New("raft: lost leadership before the entry committed")
+	ErrLogCleared     = errors.New("raft: log cleared before the entry committed")
+	ErrNotPersisted   = errors.New("raft: the leader couldn't write the entry to its log")
+)
+
+// Propose appends command to the leader's log and returns its index, along
+// with a channel that receives nil once the entry is committed, or an error
+// if we stop leading first. Off the leader the index is -1 and the channel
+// already holds ErrNotLeader; if ctx has already ended it holds ctx's error.
+// Once ctx ends the channel gets ctx's error instead of waiting on, though
+// the entry stays in the log and may still commit.
+func (c *Consensus) Propose(ctx context.Context, command string) (int, <-chan error) {
+	done := make(chan error, 1)
+	if err := ctx.Err(); err != nil {
+		done <- err // nobody is left to answer
+		return -1, done
+	}
+	c.mu.Lock()
+	if c.State != Leader || c.paused {
+		c.mu.Unlock()
+		done <- ErrNotLeader
+		return -1, done
+	}
+	entry := LogEntry{Term: c.CurrentTerm, Command: command}
+	c.Log = append(c.Log, entry)
+	index := c.lastIndex()
+	c.commitWaiters[index] = done
+	// We count toward the entry's majority once it is on our disk, see
+	// notePersisted. Without a log store that is right away, and a cluster
+	// of one commits.
+	persisted := c.persist(index, []LogEntry{entry})
+	if persisted == nil {
+		c.notePersisted(index, nil)
+	} else {
+		go c.awaitPersisted(entry.Term, index, persisted)
+	}
+	c.mu.Unlock()
+	if ctx.Done() != nil {
+		context.AfterFunc(ctx, func() { c.abandon(ctx, index, done) })
+	}
+
+	fmt.Printf("[%s] Leader queued entry %d: %s%s\n", c.ID, index, command, tracing.LogTag(ctx))
+	c.broadcastHeartbeat() // sends heartbeat to all followers to replicate the data.
+	return index, done
+}
+
+// advanceCommit moves CommitIndex to the newest entry of our term that a
+// majority holds. Older terms' entries commit along with it, never by
+// counting replicas on their own (Raft §5.4.2). Callers hold c.mu.
+func (c *Consensus) advanceCommit() {
+	if c.State != Leader {
+		return
+	}
+	quorum := c.quorum()
+	for n := c.lastIndex(); n > c.CommitIndex && n >= c.logOffset; n-- {
+		if c.Log[n-c.logOffset].Term != c.CurrentTerm {
+			return
+		}
+		count := 0
+		if c.durableIndex >= n {
+			count++ // ourselves
+		}
+		for _, p := range c.Peers {
+			if m, ok := c.matchIndex[p]; ok && m >= n {
+				count++
+			}
+		}
+		if count >= quorum {
+			c.CommitIndex = n
+			c.notifyApply()
+			for i, done := range c.commitWaiters {
+				if i <= n {
+					done <- nil
+					delete(c.commitWaiters, i)
+				}
+			}
+			return
+		}
+	}
+}
+
+// abandon stops waiting for index on behalf of a caller whose context
+// ended, if the entry hasn't committed or failed already.
+func (c *Consensus) abandon(ctx context.Context, index int, done chan error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.commitWaiters[index] == done {
+		delete(c.commitWaiters, index)
+		done <- ctx.Err()
+		fmt.Printf("[%s] Stopped waiting for entry %d to commit: %v%s\n", c.ID, index, ctx.Err(), tracing.LogTag(ctx))
+	}
+}
+
+// failCommitWaiters tells everyone still waiting that their entry won't be
+// committed by us. Callers hold c.mu.
+func (c *Consensus) failCommitWaiters(err error) {
+	for i, done := range c.commitWaiters {
+		done <- err
+		delete(c.commitWaiters, i)
+	}
+}
+
+// followCommit adopts the leader's commit index, capped at lastNew, the
+// last entry the leader's message vouched for. Callers hold c.mu.
+func (c *Consensus) followCommit(leaderCommit, lastNew int) {
+	if n := min(leaderCommit, lastNew); n > c.CommitIndex {
+		c.CommitIndex = n
+		c.notifyApply()
+	}
+}
@@ -0,0 +1,21 @@
+package raft
+
+// A leader sends the latest digest of its applied state with every
+// APPENDENTRIES, so a follower can check that applying the same log got it
+// to the same state. Raft doesn't look inside: whatever the DigestSource
+// returns, one field without spaces, goes after LeaderCommit to peers
+// speaking version 3.
+
+// DigestSource provides the digest the leader sends, see SetDigestSource.
+type DigestSource interface {
+	// LatestDigest returns the newest digest of the applied state, "" if
+	// there is none yet.
+	LatestDigest() string
+}
+
+// SetDigestSource makes the leader send d's digest with every APPENDENTRIES.
+func (c *Consensus) SetDigestSource(d DigestSource) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.digests = d
+}
@@ -0,0 +1,84 @@
+package raft
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// Every node used to time out after the same 500-1000ms, so whichever node
+// happened to be unlucky first took over, and a node that missed a couple of
+// heartbeats could start an election and depose a healthy leader. Priority
+// makes some nodes wait longer before standing, and the pre-vote keeps a node
+// from disrupting a leader the rest of the cluster still hears from.
+
+const (
+	MaxElectionPriority = 10 // the default: stand as soon as the leader goes quiet
+
+	minElectionTimeout = 500 * time.Millisecond
+	priorityStep       = 250 * time.Millisecond // extra wait per priority point below the max
+)
+
+// SetElectionPriority sets how eagerly this node stands for election, from 0
+// to MaxElectionPriority. Lower priorities wait longer after the leader goes
+// quiet, so a higher-priority node normally wins first.
+func (c *Consensus) SetElectionPriority(priority int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.priority = min(max(priority, 0), MaxElectionPriority)
+}
+
+func (c *Consensus) ElectionPriority() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.priority
+}
+
+// electionTimeout is how long a follower waits for a leader before standing:
+// 500-1000ms at full priority, plus priorityStep for each point below it.
+func (c *Consensus) electionTimeout() time.Duration {
+	c.mu.Lock()
+	penalty := time.Duration(MaxElectionPriority-c.priority) * priorityStep
+	c.mu.Unlock()
+	return minElectionTimeout + time.Duration(rand.Int63n(int64(minElectionTimeout))) + penalty
+}
+
+// preVote asks the peers whether they would vote for us in the next term,
+// without changing any term. It reports whether a majority said yes.
+func (c *Consensus) preVote(currentTerm int) bool {
+	term := currentTerm + 1
+	c.mu.Lock()
+	c.election = ElectionRecord{Term: term, Votes: 1, PreVote: true, Denials: map[string]string{}}
+	c.mu.Unlock()
+
+	voteCh := make(chan vote, len(c.Peers))
+	for _, peer := range c.Peers {
+		go c.requestVoteFromPeer(peer, "PREVOTE", term, voteCh)
+	}
+	votes, outcome := c.tally(currentTerm, voteCh)
+	if outcome != electionWon {
+		fmt.Printf("[%s] Pre-vote for term %d failed with %d votes, staying Follower.\n", c.ID, term, votes)
+		return false
+	}
+	return true
+}
+
+// HandlePreVote answers a PREVOTE: would we grant a VOTEREQUEST with these
+// arguments? Nothing changes on our side, and we say no while we're leading
+// or still hearing from a leader, so leadership sticks with a live leader.
+func (c *Consensus) HandlePreVote(term int, candidateID string, lastLogIndex, lastLogTerm int) (bool, int, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if term < c.CurrentTerm {
+		return false, c.CurrentTerm, DeniedStaleTerm
+	}
+	if (c.State == Leader && !c.paused) || c.clock.Since(c.leaderSeen) < minElectionTimeout {
+		return false, c.CurrentTerm, DeniedLeaderAlive
+	}
+	ourTerm := c.lastLogTerm()
+	if lastLogTerm < ourTerm || (lastLogTerm == ourTerm && lastLogIndex < c.lastIndex()) {
+		return false, c.CurrentTerm, DeniedLogBehind
+	}
+	return true, c.CurrentTerm, ""
+}
@@ -0,0 +1,77 @@
+package raft
+
+// An APPENDENTRIES carries at most a window of entries, counted both in
+// entries and in command bytes, however far behind the follower is: the
+// leader sends the rest in later rounds as the follower acks. So a slow
+// follower, with a round or more in flight all the time, holds at most a
+// window or two of the leader's buffers rather than everything it misses.
+// A follower behind by more than the snapshot threshold gets a snapshot
+// instead, see wantsSnapshot; without a Snapshotter it is walked through
+// the log a window at a time. The first entry of a round is always sent,
+// however large, or a big command would never get through.
+
+const (
+	DefaultWindowEntries = 256
+	DefaultWindowBytes   = 4 << 20
+)
+
+// FlowStats is how replication to one follower has been paced since this
+// node started.
+type FlowStats struct {
+	Peer      string `json:"peer"`
+	Rounds    int64  `json:"rounds"`          // APPENDENTRIES sent with entries in them
+	Throttled int64  `json:"throttledRounds"` // of those, rounds the window cut short
+	Entries   int64  `json:"entriesSent"`
+	Bytes     int64  `json:"bytesSent"` // command bytes, as counted against the window
+}
+
+// SetReplicationWindow bounds what one APPENDENTRIES carries; 0 leaves that
+// measure unbounded. Call it before Start.
+func (c *Consensus) SetReplicationWindow(entries int, bytes int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.windowEntries, c.windowBytes = entries, bytes
+}
+
+// window cuts entries for peer down to the replication window and counts
+// the round. Callers hold c.mu.
+func (c *Consensus) window(peer string, entries []LogEntry) []LogEntry {
+	if len(entries) == 0 {
+		return entries
+	}
+	n, size := 0, int64(0)
+	for n < len(entries) {
+		if c.windowEntries > 0 && n >= c.windowEntries {
+			break
+		}
+		next := int64(len(entries[n].Command))
+		if c.windowBytes > 0 && n > 0 && size+next > c.windowBytes {
+			break
+		}
+		n++
+		size += next
+	}
+
+	f := c.flow[peer]
+	f.Rounds++
+	f.Entries += int64(n)
+	f.Bytes += size
+	if n < len(entries) {
+		f.Throttled++
+	}
+	c.flow[peer] = f
+	return entries[:n]
+}
+
+// FlowStats returns the pacing of replication to every peer, in peer order.
+func (c *Consensus) FlowStats() []FlowStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make([]FlowStats, 0, len(c.Peers))
+	for _, p := range c.Peers {
+		st := c.flow[p]
+		st.Peer = p
+		out = append(out, st)
+	}
+	return out
+}
@@ -0,0 +1,194 @@
+package raft
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// On Start every node greets each of its peers once:
+//
+//	HANDSHAKE <ID> <ClusterID> v<Version>
+//	replies:  HANDSHAKE <ID> <ClusterID> v<Version> | ERR <Code> <message>
+//
+// where "-" stands for an empty cluster ID. A peer that can't be reached is
+// greeted again every handshakeRetry until it answers, so nodes booted one
+// after another all end up checked. Whatever a greeting finds is logged once
+// and kept for /status; a peer that answers but is misconfigured isn't
+// asked again, as nothing on our side would change its answer.
+
+const (
+	handshakeRetry   = time.Second
+	handshakeTimeout = 2 * time.Second // per attempt, dial to reply
+)
+
+// Handshake states, see PeerCheck.
+const (
+	HandshakePending       = "pending"       // not answered yet
+	HandshakeOK            = "ok"            // the peer is who its address says, in our cluster, speaking our protocol
+	HandshakeUnreachable   = "unreachable"   // dialing or reading the reply failed; retried
+	HandshakeMisconfigured = "misconfigured" // it answered, wrongly; see Problem
+	HandshakeUnsupported   = "unsupported"   // it answered with an error, e.g. a node from before HANDSHAKE
+)
+
+// PeerCheck is what greeting one peer found.
+type PeerCheck struct {
+	Peer      string    `json:"peer"`
+	State     string    `json:"state"`
+	ID        string    `json:"id,omitempty"`        // what the peer says it is
+	ClusterID string    `json:"clusterId,omitempty"` // the cluster the peer says it is in
+	Version   int       `json:"protocolVersion,omitempty"`
+	Problem   string    `json:"problem,omitempty"` // why it isn't ok
+	Checked   time.Time `json:"checked,omitzero"`  // last attempt
+}
+
+// SetClusterID names the cluster this node belongs to. Peers that name a
+// different one are reported as misconfigured; an empty ID matches any.
+// Call it before Start.
+func (c *Consensus) SetClusterID(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.clusterID = id
+}
+
+// HandleHandshake answers a peer's greeting with our ID and cluster ID. A
+// peer in another cluster is logged here too, but it is the greeter that
+// judges the answer.
+func (c *Consensus) HandleHandshake(from, clusterID string) (string, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if clusterID != "" && c.clusterID != "" && clusterID != c.clusterID {
+		fmt.Printf("[%s] Handshake from %s, which is in cluster %q; we are in %q\n", c.ID, from, clusterID, c.clusterID)
+	}
+	return c.ID, c.clusterID
+}
+
+// PeerChecks returns what greeting each peer found, in peer order.
+func (c *Consensus) PeerChecks() []PeerCheck {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make([]PeerCheck, 0, len(c.Peers))
+	for _, p := range c.Peers {
+		check, ok := c.handshakes[p]
+		if !ok {
+			check = PeerCheck{Peer: p, State: HandshakePending}
+		}
+		out = append(out, check)
+	}
+	return out
+}
+
+// greetPeers handshakes with every peer, retrying the unreachable ones
+// until they answer or Stop is called.
+func (c *Consensus) greetPeers() {
+	pending := append([]string(nil), c.Peers...)
+	for len(pending) > 0 {
+		var retry []string
+		for _, p := range pending {
+			if c.greet(p).State == HandshakeUnreachable {
+				retry = append(retry, p)
+			}
+		}
+		pending = retry
+		if len(pending) == 0 {
+			return
+		}
+		select {
+		case <-c.stop:
+			return
+		case <-time.After(handshakeRetry):
+		}
+	}
+}
+
+// greet handshakes with peer once and records the outcome, logging it if it
+// differs from the last one.
+func (c *Consensus) greet(peer string) PeerCheck {
+	c.mu.Lock()
+	clusterID := c.clusterID
+	c.mu.Unlock()
+
+	check := c.handshake(peer, clusterID)
+	check.Checked = c.clock.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if last, ok := c.handshakes[peer]; !ok || last.State != check.State || last.Problem != check.Problem {
+		if check.State == HandshakeOK {
+			fmt.Printf("[%s] Handshake with %s: ok (%s, protocol version %d)\n", c.ID, peer, check.ID, check.Version)
+		} else {
+			fmt.Printf("[%s] Handshake with %s: %s: %s\n", c.ID, peer, check.State, check.Problem)
+		}
+	}
+	c.handshakes[peer] = check
+	return check
+}
+
+// handshake sends our greeting to peer and judges the reply.
+func (c *Consensus) handshake(peer, clusterID string) PeerCheck {
+	check := PeerCheck{Peer: peer}
+	conn, err := c.transport.Dial(peer)
+	if err != nil {
+		check.State, check.Problem = HandshakeUnreachable, err.Error()
+		return check
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+
+	fmt.Fprintf(conn, "HANDSHAKE %s %s %s\n", c.ID, orDash(clusterID), versionTag)
+	buf := make([]byte, 512)
+	n, err := conn.Read(buf)
+	if err != nil {
+		check.State, check.Problem = HandshakeUnreachable, err.Error()
+		return check
+	}
+	reply := strings.TrimSpace(string(buf[:n]))
+	fields, version := SplitVersion(strings.Fields(reply))
+	if len(fields) != 3 || fields[0] != "HANDSHAKE" {
+		check.State, check.Problem = HandshakeUnsupported, reply
+		return check
+	}
+	check.ID, check.ClusterID, check.Version = fields[1], fromDash(fields[2]), version
+	switch {
+	case check.ID == c.ID:
+		check.State, check.Problem = HandshakeMisconfigured, "it has our id, "+c.ID
+	case !sameNode(peer, check.ID):
+		check.State, check.Problem = HandshakeMisconfigured, fmt.Sprintf("it answered as %s", check.ID)
+	case clusterID != "" && check.ClusterID != "" && clusterID != check.ClusterID:
+		check.State, check.Problem = HandshakeMisconfigured, fmt.Sprintf("it is in cluster %q, we are in %q", check.ClusterID, clusterID)
+	case CheckVersion(version) != nil:
+		check.State, check.Problem = HandshakeMisconfigured, CheckVersion(version).Error()
+	default:
+		check.State = HandshakeOK
+	}
+	return check
+}
+
+// sameNode reports whether the node with id is the one at addr. A node's id
+// is usually just its port, which matches addr on any host.
+func sameNode(addr, id string) bool {
+	if addr == id {
+		return true
+	}
+	idHost, idPort, err := net.SplitHostPort(id)
+	if err != nil || idHost != "" {
+		return false
+	}
+	_, port, err := net.SplitHostPort(addr)
+	return err == nil && port == idPort
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func fromDash(s string) string {
+	if s == "-" {
+		return ""
+	}
+	return s
+}
@@ -0,0 +1,162 @@
+package raft
+
+import (
+	"fmt"
+
+	"github.com/mathdee/KV-Store/internal/failpoint"
+)
+
+// LogStore makes log entries durable. A node without one keeps its log in
+// memory only, as before.
+type LogStore interface {
+	// Append persists entries starting at index, replacing anything logged
+	// from index on. The channel reports when they are on disk.
+	Append(index int, entries []LogEntry) <-chan error
+	// Reset replaces the whole persisted log: entries start at offset and
+	// term is the term of entry offset-1 (0 if unknown).
+	Reset(offset, term int, entries []LogEntry) error
+	// SaveState persists the term and vote, returning once they are on disk.
+	SaveState(HardState) error
+}
+
+// HardState is what a node must remember across restarts besides its log:
+// a node that forgets its term or vote in a crash can vote twice in a term.
+type HardState struct {
+	Term     int
+	VotedFor string
+}
+
+// Restore puts back what an earlier run left on disk: the log, starting at
+// offset after a snapshot whose last entry had offsetTerm, the term and
+// vote, and applied, the last entry the state machine had applied. Those
+// are committed, so nothing up to applied is handed to TakeCommitted
+// again. Call it before SetLogStore and Start.
+func (c *Consensus) Restore(offset, offsetTerm int, entries []LogEntry, state HardState, applied int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Log = entries
+	c.logOffset, c.offsetTerm = offset, offsetTerm
+	c.CurrentTerm, c.VotedFor = state.Term, state.VotedFor
+	c.savedState = state
+	if applied < offset-1 {
+		fmt.Printf("[%s] The state machine applied up to %d but the log starts at %d, entries in between are lost\n", c.ID, applied, offset)
+	}
+	c.lastApplied = applied
+	c.CommitIndex = max(c.CommitIndex, min(applied, c.lastIndex()))
+	c.durableIndex = c.lastIndex()
+}
+
+// SetLogStore persists the log from now on.
+func (c *Consensus) SetLogStore(s LogStore) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.logStore = s
+	c.savedState = HardState{}
+	c.saveState() // Reset writes the state again, whatever store s saved last
+	if err := s.Reset(c.logOffset, c.offsetTerm, c.Log); err != nil {
+		fmt.Printf("[%s] Failed to persist log: %v\n", c.ID, err)
+	}
+}
+
+// saveState persists the term and vote if either changed since they were
+// last saved, and reports whether they are on disk. It waits for the disk
+// with c.mu held, but only when the term moves on or we vote. Callers hold
+// c.mu.
+func (c *Consensus) saveState() bool {
+	state := HardState{Term: c.CurrentTerm, VotedFor: c.VotedFor}
+	if c.logStore == nil || state == c.savedState {
+		return true
+	}
+	if err := c.logStore.SaveState(state); err != nil {
+		fmt.Printf("[%s] Failed to persist term %d and vote %q: %v\n", c.ID, state.Term, state.VotedFor, err)
+		return false
+	}
+	c.savedState = state
+	return true
+}
+
+// persist queues entries for the log store; nil without one. The
+// raft/after-append failpoint fails it like a disk would. Callers hold c.mu.
+func (c *Consensus) persist(index int, entries []LogEntry) <-chan error {
+	if len(entries) == 0 {
+		return nil
+	}
+	if err := failpoint.Inject(failpoint.RaftAfterAppend); err != nil {
+		failed := make(chan error, 1)
+		failed <- err
+		return failed
+	}
+	if c.logStore == nil {
+		return nil
+	}
+	return c.logStore.Append(index, entries)
+}
+
+// A leader counts itself toward an entry's majority only once the entry is
+// on its own disk. Its entries are persisted in log order, but the results
+// can reach us in any order, so they are put together here and durableIndex
+// moves over them one by one.
+
+// awaitPersisted waits for the write of the leader's entry at index, which
+// it added in term.
+func (c *Consensus) awaitPersisted(term, index int, persisted <-chan error) {
+	err := <-persisted
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.State != Leader || c.CurrentTerm != term {
+		return // whoever leads now brings our log in line with theirs
+	}
+	c.notePersisted(index, err)
+}
+
+// notePersisted records how the write of the entry at index came out and
+// moves durableIndex as far as the writes went through. Callers hold c.mu.
+func (c *Consensus) notePersisted(index int, err error) {
+	c.persisted[index] = err
+	for {
+		next := c.durableIndex + 1
+		err, ok := c.persisted[next]
+		if !ok {
+			break
+		}
+		delete(c.persisted, next)
+		if err != nil {
+			c.failPersist(next, err)
+			return
+		}
+		c.durableIndex = next
+	}
+	c.advanceCommit()
+}
+
+// failPersist steps down after our entry at index didn't make it to disk,
+// rather than lead with a log we can't keep. Nothing from index on has
+// committed unless the followers' majority got there without us, so the
+// uncommitted part goes and its writers hear why; a later leader may still
+// commit it from a follower. Callers hold c.mu.
+func (c *Consensus) failPersist(index int, err error) {
+	fmt.Printf("[%s] Failed to persist entry %d, stepping down: %v\n", c.ID, index, err)
+	from := max(index, c.CommitIndex+1)
+	for i, done := range c.commitWaiters {
+		if i >= from {
+			done <- fmt.Errorf("%w: entry %d: %v", ErrNotPersisted, index, err)
+			delete(c.commitWaiters, i)
+		}
+	}
+	if from >= c.logOffset && from <= c.lastIndex() {
+		c.Log = c.Log[:from-c.logOffset]
+	}
+	c.resetPersisted() // the log store has the entries after the failed one, not the failed one
+	c.becomeFollower()
+}
+
+// resetPersisted rewrites the persisted log after the in-memory one was
+// trimmed or replaced. Callers hold c.mu.
+func (c *Consensus) resetPersisted() {
+	if c.logStore == nil {
+		return
+	}
+	if err := c.logStore.Reset(c.logOffset, c.offsetTerm, c.Log); err != nil {
+		fmt.Printf("[%s] Failed to rewrite persisted log: %v\n", c.ID, err)
+	}
+}
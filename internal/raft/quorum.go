@@ -0,0 +1,76 @@
+package raft
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// QuorumStatus is how many votes the cluster has, how many it takes to
+// elect a leader or commit an entry, and how many this node can reach now.
+type QuorumStatus struct {
+	Voters    int `json:"voters"`    // ourselves and every peer
+	Quorum    int `json:"quorum"`    // votes needed to elect a leader or commit an entry
+	Reachable int `json:"reachable"` // voters we heard from within the minimum election timeout, ourselves included
+}
+
+// CheckPeers reports a peer list that can't form the cluster it describes:
+// an empty address, ourselves, or an address listed twice. Each would make
+// the voter count, and so the quorum, bigger than the nodes that can vote.
+func CheckPeers(id string, peers []string) error {
+	seen := make(map[string]bool, len(peers))
+	for _, p := range peers {
+		switch {
+		case strings.TrimSpace(p) == "":
+			return fmt.Errorf("empty peer address in %q", strings.Join(peers, ","))
+		case isSelf(id, p):
+			return fmt.Errorf("peer %s is this node", p)
+		case seen[p]:
+			return fmt.Errorf("peer %s is listed twice", p)
+		}
+		seen[p] = true
+	}
+	return nil
+}
+
+// isSelf reports whether peer is id's own address. A node's id is usually
+// just its port, so a peer on the same port of this host counts too.
+func isSelf(id, peer string) bool {
+	if peer == id {
+		return true
+	}
+	idHost, idPort, err := net.SplitHostPort(id)
+	if err != nil || idHost != "" {
+		return false
+	}
+	host, port, err := net.SplitHostPort(peer)
+	if err != nil || port != idPort {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return host == "localhost" || (ip != nil && ip.IsLoopback())
+}
+
+// quorum is the majority of the cluster, ourselves included.
+func (c *Consensus) quorum() int {
+	return (len(c.Peers)+1)/2 + 1
+}
+
+// QuorumStatus counts the voters reachable from here. Only the leader hears
+// from every peer; a follower counts itself, the leader while it keeps in
+// touch, and any peer that answered it recently, e.g. during a vote.
+func (c *Consensus) QuorumStatus() QuorumStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st := QuorumStatus{Voters: len(c.Peers) + 1, Quorum: c.quorum(), Reachable: 1}
+	for _, p := range c.Peers {
+		recent := c.clock.Since(c.lastContact[p]) < minElectionTimeout
+		if p == c.leader && c.leaderTerm == c.CurrentTerm && c.clock.Since(c.leaderSeen) < minElectionTimeout {
+			recent = true
+		}
+		if recent {
+			st.Reachable++
+		}
+	}
+	return st
+}
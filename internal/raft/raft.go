@@ -1,12 +1,15 @@
 package raft
 
 import (
+	"bufio"
 	"fmt"
-	"math/rand"
-	"net"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/mathdee/KV-Store/internal/clock"
+	"github.com/mathdee/KV-Store/internal/crash"
 )
 
 const (
@@ -26,7 +29,7 @@ type Consensus struct {
 	ID          string     // ID of curr server
 	Peers       []string   // list of all server addresses
 	VotedFor    string     // ID of the server the current server voted for
-	heartbeatCh chan bool  // channel to send and receive heartbeat messages
+	heartbeatCh chan bool  // election timer resets, see resetElectionTimer
 	Log         []LogEntry
 	CommitIndex int  // index of commited log entries
 	lastApplied int  // index of last applied log entry
@@ -34,82 +37,179 @@ type Consensus struct {
 
 	nextIndex  map[string]int // nextIndex for each peer
 	matchIndex map[string]int // matchIndex for each peer
+
+	transport *FaultTransport // every peer connection goes through here, so faults can be injected
+	clock     clock.Clock     // election timeouts, heartbeats and contact times, see SetClock
+
+	// Log[0] is entry logOffset; everything before it is covered by a snapshot.
+	logOffset     int
+	offsetTerm    int             // term of entry logOffset-1, 0 if unknown
+	snapshots     Snapshotter     // nil means followers always catch up entry by entry
+	snapshotAfter int             // send a snapshot to followers further behind than this
+	needSnapshot  map[string]bool // peers whose last snapshot transfer failed
+	snapshotting  map[string]bool // peers with a snapshot transfer in flight
+
+	logStore     LogStore      // nil keeps the log in memory only
+	savedState   HardState     // the term and vote logStore holds, see saveState
+	durableIndex int           // as leader, our newest entry known to be on disk, see notePersisted
+	persisted    map[int]error // as leader, how writes past durableIndex came out
+
+	election ElectionRecord // how our latest candidacy went
+
+	stepDownCh   chan struct{}   // wakes the leader loop when we stop leading, see wakeLeader
+	heartbeating map[string]bool // peers with a round in flight, see replicateTo
+	roundAgain   map[string]bool // busy peers owed another round once theirs is answered
+
+	commitWaiters map[int]chan error // Propose callers waiting for their entry to commit
+	applyCh       chan struct{}      // see ApplyReady
+
+	lastContact map[string]time.Time    // when each peer last answered us
+	inFlight    map[string]int64        // bytes sent to each peer and not yet answered
+	dialBackoff map[string]*dialBackoff // peers whose last dial failed, see dial
+
+	windowEntries int                  // most entries per APPENDENTRIES, 0 for no limit
+	windowBytes   int64                // most command bytes per APPENDENTRIES, 0 for no limit
+	flow          map[string]FlowStats // how replication to each peer has been paced
+
+	priority   int       // election priority, see SetElectionPriority
+	leaderSeen time.Time // when a leader last reached us
+	leader     string    // who led leaderTerm: the last leader to reach us, or ourselves
+	leaderTerm int       // once CurrentTerm moves past it, we don't know the leader yet
+	witness    bool      // votes and acks entries but keeps no data, see SetWitness
+
+	peerVersion map[string]int // protocol version each peer last answered in
+	digests     DigestSource   // what the leader sends along with APPENDENTRIES, nil for nothing
+
+	clusterID  string               // see SetClusterID
+	handshakes map[string]PeerCheck // what greeting each peer found, see greetPeers
+
+	stop     chan struct{} // closed by Stop, ends the loop Start runs
+	stopOnce sync.Once
 }
 
 func NewConsensus(id string, peers []string) *Consensus { // create Consensus struct for Raft node
 	return &Consensus{
-		State:       Follower,        // set initial state to Follower
-		CurrentTerm: 0,               // term starts at zero, Raft default
-		ID:          id,              // set this node's unique ID
-		Peers:       peers,           // assign peer server addresses list
-		heartbeatCh: make(chan bool), // create channel for heartbeat signals
-		Log:         []LogEntry{},    // initialize empty log.
-		CommitIndex: -1,              // -1 means no commits yet.
-		lastApplied: -1,
-		paused:      false,                // node starts active, not paused
-		nextIndex:   make(map[string]int), // nextIndex for each peer
-		matchIndex:  make(map[string]int), // matchIndex for each peer
+		State:        Follower,           // set initial state to Follower
+		CurrentTerm:  0,                  // term starts at zero, Raft default
+		ID:           id,                 // set this node's unique ID
+		Peers:        peers,              // assign peer server addresses list
+		heartbeatCh:  make(chan bool, 1), // one pending reset is as good as many
+		Log:          []LogEntry{},       // initialize empty log.
+		CommitIndex:  -1,                 // -1 means no commits yet.
+		lastApplied:  -1,
+		durableIndex: -1,
+		persisted:    make(map[int]error),
+		paused:       false,                // node starts active, not paused
+		nextIndex:    make(map[string]int), // nextIndex for each peer
+		matchIndex:   make(map[string]int), // matchIndex for each peer
+		transport:    NewFaultTransport(id, TCPTransport{}),
+		clock:        clock.System,
+
+		snapshotAfter: DefaultSnapshotThreshold,
+		needSnapshot:  make(map[string]bool),
+		snapshotting:  make(map[string]bool),
+		stepDownCh:    make(chan struct{}, 1),
+		heartbeating:  make(map[string]bool),
+		roundAgain:    make(map[string]bool),
+		commitWaiters: make(map[int]chan error),
+		applyCh:       make(chan struct{}, 1),
+		lastContact:   make(map[string]time.Time),
+		inFlight:      make(map[string]int64),
+		dialBackoff:   make(map[string]*dialBackoff),
+		windowEntries: DefaultWindowEntries,
+		windowBytes:   DefaultWindowBytes,
+		flow:          make(map[string]FlowStats),
+		priority:      MaxElectionPriority,
+		peerVersion:   make(map[string]int),
+		handshakes:    make(map[string]PeerCheck),
+		stop:          make(chan struct{}),
 	}
 }
 
+// SetTransport replaces how peers are dialed, fault injection stays in front of it.
+func (c *Consensus) SetTransport(t Transport) {
+	c.transport.SetInner(t)
+}
+
+// SetClock replaces the clock election timeouts and heartbeats run on,
+// clock.System by default. Call it before Start.
+func (c *Consensus) SetClock(clk clock.Clock) {
+	c.clock = clk
+}
+
+// Faults gives access to the fault injector for the chaos API.
+func (c *Consensus) Faults() *FaultTransport {
+	return c.transport
+}
+
 func (c *Consensus) GetLogLength() int { //Gets the length of log to know nb of entries.
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	return len(c.Log)
+	return c.logOffset + len(c.Log) // log indexes keep counting across snapshots
 }
 
 // Start of Raft Election Processss
 
 func (c *Consensus) Start() {
-	go func() {
-		for {
-			c.mu.Lock()
-			state := c.State
-			c.mu.Unlock()
+	go crash.Supervise("raft", c.run, c.unlocked) // a panic restarts the loop in whatever state it left
+	go c.greetPeers()
+}
 
-			switch state {
-			case Follower:
-				c.runFollower()
-			case Candidate:
-				c.runCandidate()
-			case Leader:
-				c.runLeader()
-			default:
-				fmt.Println("Unknown state")
-			}
+// unlocked reports whether c.mu can be taken. After a panic in the loop it
+// tells a lock the loop still held, which no restart gets past, from one
+// held for a moment elsewhere.
+func (c *Consensus) unlocked() bool {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if c.mu.TryLock() {
+			c.mu.Unlock()
+			return true
 		}
-	}()
+	}
+	return false
 }
 
-func (c *Consensus) GetUnappliedEntries() []LogEntry {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+// run steps through the states until Stop.
+func (c *Consensus) run() {
+	for {
+		select {
+		case <-c.stop:
+			return
+		default:
+		}
+		c.mu.Lock()
+		state := c.State
+		c.mu.Unlock()
 
-	if c.lastApplied >= len(c.Log)-1 { // if last applies >=  then length of log entries -1, return nill.
-		return nil
+		switch state {
+		case Follower:
+			c.runFollower()
+		case Candidate:
+			c.runCandidate()
+		case Leader:
+			c.runLeader()
+		default:
+			fmt.Println("Unknown state")
+		}
 	}
-
-	start := c.lastApplied + 1
-	entries := c.Log[start:]
-	c.lastApplied = len(c.Log) - 1
-	return entries
 }
 
 // Follower logic, runFollower() method
 func (c *Consensus) runFollower() {
 	if c.IsPaused() { // check if node is paused
-		time.Sleep(100 * time.Millisecond) // sleep to avoid busy spinning
-		return                             // exit early, skip Raft logic
+		c.clock.Sleep(100 * time.Millisecond) // sleep to avoid busy spinning
+		return                                // exit early, skip Raft logic
 	}
 
-	timeout := time.Duration(500+rand.Intn(500)) * time.Millisecond // 500-1000ms timeout
-	timer := time.NewTimer(timeout)
+	timer := c.clock.NewTimer(c.electionTimeout())
 
 	select {
 	case <-c.heartbeatCh:
 		timer.Stop()
 		return
-	case <-timer.C:
+	case <-timer.C():
+		if c.IsWitness() {
+			return // a witness never stands, it waits for a data node to
+		}
 		fmt.Printf("[%s] Timeout! Starting Election -> \n", c.ID)
 		c.mu.Lock()
 		c.State = Candidate
@@ -121,223 +221,527 @@ func (c *Consensus) runFollower() {
 
 func (c *Consensus) runCandidate() {
 	if c.IsPaused() {
-		time.Sleep(100 * time.Millisecond)
+		c.clock.Sleep(100 * time.Millisecond)
 		return
 	}
 
+	// A pre-vote first, so a node that merely lost touch for a moment can't
+	// bump the term and depose a leader everyone else still hears from.
 	c.mu.Lock()
+	preTerm := c.CurrentTerm
+	c.mu.Unlock()
+	if !c.preVote(preTerm) {
+		c.endCandidacy(preTerm)
+		return
+	}
+
+	c.mu.Lock()
+	if c.State != Candidate || c.CurrentTerm != preTerm {
+		c.mu.Unlock()
+		return // a leader turned up while we were asking
+	}
 	c.CurrentTerm++
 	c.VotedFor = c.ID
-	votes := 1
+	if !c.saveState() {
+		c.State = Follower // a vote for ourselves we might forget isn't one to ask others to match
+		c.mu.Unlock()
+		return
+	}
 	term := c.CurrentTerm
+	c.election = ElectionRecord{Term: term, Votes: 1, Denials: map[string]string{}}
 	c.mu.Unlock()
 
 	fmt.Printf("[%s] Candidate Election term %d\n", c.ID, term)
 
-	voteCh := make(chan bool, len(c.Peers))
+	voteCh := make(chan vote, len(c.Peers))
 	for _, peer := range c.Peers {
-		go c.requestVoteFromPeer(peer, term, voteCh)
+		go c.requestVoteFromPeer(peer, "VOTEREQUEST", term, voteCh)
 	}
 
-	timeout := time.After(500 * time.Millisecond) // Timeout BEFORE the loop
+	votes, outcome := c.tally(term, voteCh)
+	switch outcome {
+	case electionWon:
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.State != Candidate || c.CurrentTerm != term {
+			return // a newer term got here first
+		}
+		fmt.Printf("[%s] Won the Election! with %d votes\n", c.ID, votes)
+		c.State = Leader
+		c.leader, c.leaderTerm = c.ID, term
+		c.election.Won = true
+
+		// Whatever we hold was on disk before we acked it as a follower.
+		c.durableIndex = c.lastIndex()
+		clear(c.persisted)
+
+		// Initialize nextIndex for all peers
+		for _, peer := range c.Peers {
+			c.nextIndex[peer] = c.lastIndex() + 1
+			c.matchIndex[peer] = -1 // -1 means no entries matched yet
+		}
+	case electionLost:
+		fmt.Printf("[%s] Election lost with %d votes, back to Follower.\n", c.ID, votes)
+		c.endCandidacy(term)
+	case electionTimedOut:
+		fmt.Printf("[%s] Election failed! Timeout, back to Follower.\n", c.ID)
+		c.endCandidacy(term)
+	case electionAbandoned:
+		fmt.Printf("[%s] Saw a newer term, abandoning election for term %d\n", c.ID, term)
+	}
+}
+
+// Ways a round of voting can end, see tally.
+const (
+	electionWon = iota
+	electionLost
+	electionTimedOut
+	electionAbandoned
+)
+
+// tally counts the replies on voteCh until a majority is reached or ruled
+// out, the round times out, or we stop being a candidate in currentTerm.
+func (c *Consensus) tally(currentTerm int, voteCh <-chan vote) (int, int) {
+	quorum := c.quorum()
+	votes := 1                                       // our own
+	replied := map[string]bool{}                     // each peer gets one say per election
+	timeout := c.clock.After(500 * time.Millisecond) // Timeout BEFORE the loop
 
 	for {
+		// Checked before waiting, so a node without peers wins straight away.
+		if votes >= quorum {
+			return votes, electionWon
+		}
+		if votes+len(c.Peers)-len(replied) < quorum {
+			return votes, electionLost
+		}
+
 		select {
-		case granted := <-voteCh:
-			if granted {
+		case v := <-voteCh:
+			if replied[v.peer] {
+				continue
+			}
+			replied[v.peer] = true
+			if v.granted {
 				votes++
 			}
-			quorum := (len(c.Peers)+1)/2 + 1
-
-			if votes >= quorum {
-				fmt.Printf("[%s] Won the Election! with %d votes\n", c.ID, votes)
-				c.mu.Lock()
-				c.State = Leader
-
-				// Initialize nextIndex for all peers
-				for _, peer := range c.Peers {
-					c.nextIndex[peer] = len(c.Log)
-					c.matchIndex[peer] = -1 // -1 means no entries matched yet
-				}
-
-				c.mu.Unlock()
-				return
+			c.mu.Lock()
+			stillCandidate := c.State == Candidate && c.CurrentTerm == currentTerm
+			c.mu.Unlock()
+			if !stillCandidate {
+				return votes, electionAbandoned
 			}
 
 		case <-timeout:
-			fmt.Printf("[%s] Election failed! Timeout, back to Follower.\n", c.ID)
-			c.mu.Lock()
-			c.State = Follower
-			c.mu.Unlock()
-			return
+			return votes, electionTimedOut
 		}
 	}
 }
 
+// vote is one peer's answer to our VOTEREQUEST.
+type vote struct {
+	peer    string
+	granted bool
+}
+
+// endCandidacy goes back to following unless something already moved us on from term.
+func (c *Consensus) endCandidacy(term int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.State == Candidate && c.CurrentTerm == term {
+		c.State = Follower
+	}
+}
+
 // Leader logic, runLeader() method
 
 func (c *Consensus) runLeader() {
 	if c.IsPaused() { // check if node is paused
-		time.Sleep(100 * time.Millisecond) // sleep to avoid busy spinning
-		return                             // exit early, skip Raft logic
+		c.clock.Sleep(100 * time.Millisecond) // sleep to avoid busy spinning
+		return                                // exit early, skip Raft logic
 	}
 
-	ticker := time.NewTicker(100 * time.Millisecond)
+	ticker := c.clock.NewTicker(heartbeatInterval)
 	defer ticker.Stop()
+	select {
+	case <-c.stepDownCh: // left over from an earlier leadership
+	default:
+	}
 
-	for {
+	// Announce ourselves straight away, then once per interval. Losing
+	// leadership or being paused wakes us at once instead of at the next tick.
+	for c.stillLeader() {
+		c.heartbeatRound()
 		select {
-		case <-ticker.C:
-			go c.broadcastHeartbeat()
+		case <-ticker.C():
+		case <-c.stepDownCh:
 		}
-		c.mu.Lock()
+	}
+}
 
-		if c.State != "Leader" || c.paused {
-			c.mu.Unlock()
-			return
-		}
-		c.mu.Unlock()
+const heartbeatInterval = 100 * time.Millisecond
+
+func (c *Consensus) stillLeader() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.State == Leader && !c.paused
+}
 
+// becomeFollower drops us to follower, waking the leader loop if we were
+// leading. Callers hold c.mu.
+func (c *Consensus) becomeFollower() {
+	if c.State == Leader {
+		c.wakeLeader()
+		c.failCommitWaiters(ErrLostLeadership)
 	}
+	c.State = Follower
+}
 
+// wakeLeader makes the leader loop re-check its state now. It never blocks.
+func (c *Consensus) wakeLeader() {
+	select {
+	case c.stepDownCh <- struct{}{}:
+	default:
+	}
 }
 
 // Request Vote from Peer, requestVoteFromPeer() method.
 
-func (c *Consensus) requestVoteFromPeer(peer string, term int, voteCh chan bool) {
-	conn, err := net.Dial("tcp", peer)
+func (c *Consensus) requestVoteFromPeer(peer, kind string, term int, voteCh chan<- vote) {
+	preVote := kind == "PREVOTE"
+	c.mu.Lock()
+	lastIndex, lastTerm := c.lastIndex(), c.lastLogTerm()
+	skip := preVote && !c.peerSpeaks(peer, 2)
+	c.mu.Unlock()
+	if skip {
+		// Older nodes don't know PREVOTE; they have no objection until the real vote.
+		c.recordVote(term, preVote, peer, true, "")
+		voteCh <- vote{peer, true}
+		return
+	}
+
+	conn, err := c.transport.Dial(peer)
 	if err != nil {
-		voteCh <- false
+		c.recordVote(term, preVote, peer, false, "unreachable")
+		voteCh <- vote{peer, false}
 		return
 	}
 
 	defer conn.Close()
 
-	fmt.Fprintf(conn, "VOTEREQUEST %d %s\n", term, c.ID)
+	// Protocol: VOTEREQUEST|PREVOTE <Term> <CandidateID> <LastLogIndex> <LastLogTerm> v<Version>
+	// Replies:  VOTEGRANTED <Term> | VOTEDENIED <Term> <Reason>
+	fmt.Fprintf(conn, "%s %d %s %d %d %s\n", kind, term, c.ID, lastIndex, lastTerm, versionTag)
 
 	// implementing the request to the peer.
 	buf := make([]byte, 1024) // stores the response from the peer.
 	n, _ := conn.Read(buf)
-	response := strings.TrimSpace(string(buf[:n])) // converts response to string so we can parse it.
+	reply := string(buf[:n])
+	status, voterTerm, rest, version := parseReply(reply)
 
-	if response == "VOTEGRANTED" {
-		voteCh <- true
-	} else {
-		voteCh <- false
+	if status == "ERR" && preVote && strings.Contains(reply, "unknown command") {
+		c.mu.Lock()
+		c.peerVersion[peer] = 1
+		c.mu.Unlock()
+		fmt.Printf("[%s] %s predates PREVOTE, counting it as a yes\n", c.ID, peer)
+		c.recordVote(term, preVote, peer, true, "")
+		voteCh <- vote{peer, true}
+		return
 	}
+
+	granted := status == "VOTEGRANTED"
+	reason := ""
+	if !granted {
+		reason = "no reply"
+		if status == "ERR" {
+			reason = strings.TrimSpace(strings.TrimPrefix(reply, "ERR"))
+		} else if len(rest) > 0 {
+			reason = rest[0]
+		}
+		fmt.Printf("[%s] %s denied %s for term %d: %s (their term %d)\n", c.ID, peer, strings.ToLower(kind), term, reason, voterTerm)
+	}
+	c.recordVote(term, preVote, peer, granted, reason)
+
+	c.mu.Lock()
+	if status == "VOTEGRANTED" || status == "VOTEDENIED" {
+		c.peerVersion[peer] = version
+	}
+	c.stepDown(voterTerm) // a newer term ends our candidacy right away
+	c.mu.Unlock()
+
+	voteCh <- vote{peer, granted}
 }
 
+// broadcastHeartbeat sends every peer the entries it is missing (or just a
+// heartbeat) without waiting for the replies. A peer still busy with the
+// previous round gets another as soon as that one is answered, carrying
+// whatever has been proposed meanwhile, so a peer never has two rounds in
+// flight and can't see them arrive out of order.
 func (c *Consensus) broadcastHeartbeat() {
+	c.broadcast(false)
+}
+
+// heartbeatRound is the leader loop's broadcast: a peer still busy with the
+// previous round is skipped, so a slow peer costs one goroutine, not one per
+// tick.
+func (c *Consensus) heartbeatRound() {
+	c.broadcast(true)
+}
+
+func (c *Consensus) broadcast(skipBusy bool) {
+	for _, peer := range c.Peers {
+		c.mu.Lock()
+		busy := c.heartbeating[peer]
+		if !busy {
+			c.heartbeating[peer] = true
+		} else if !skipBusy {
+			c.roundAgain[peer] = true
+		}
+		c.mu.Unlock()
+		if !busy {
+			go c.replicateTo(peer)
+		}
+	}
+}
+
+// replicateTo runs rounds to p until none has been asked for since the last
+// one started, then marks p idle.
+func (c *Consensus) replicateTo(p string) {
+	for {
+		c.round(p)
+		c.mu.Lock()
+		again := c.roundAgain[p] && c.State == Leader
+		delete(c.roundAgain, p)
+		if !again {
+			delete(c.heartbeating, p)
+		}
+		c.mu.Unlock()
+		if !again {
+			return
+		}
+	}
+}
+
+// round sends p one APPENDENTRIES and handles the reply.
+func (c *Consensus) round(p string) {
 	c.mu.Lock()
 	term := c.CurrentTerm
 	leaderID := c.ID
-	logLen := len(c.Log)
+	logLen := c.lastIndex() + 1
+	digests := c.digests
 	c.mu.Unlock()
+	digest := ""
+	if digests != nil {
+		digest = digests.LatestDigest() // not under c.mu, the source has locks of its own
+	}
 
-	for _, peer := range c.Peers {
-		go func(p string) {
-			c.mu.Lock()
+	c.mu.Lock()
 
-			if _, exists := c.nextIndex[p]; !exists {
-				c.nextIndex[p] = logLen // set nextIndex to log length for new peers
-				c.matchIndex[p] = 0     // set matchIndex to 0 for new peers
-			}
+	if _, exists := c.nextIndex[p]; !exists {
+		c.nextIndex[p] = logLen // set nextIndex to log length for new peers
+		c.matchIndex[p] = 0     // set matchIndex to 0 for new peers
+	}
 
-			nextIdx := c.nextIndex[p]
+	// While a snapshot is on its way only keep the follower's election timer quiet.
+	heartbeatOnly := c.snapshotting[p]
+	if !heartbeatOnly && c.wantsSnapshot(p, logLen) {
+		c.snapshotting[p] = true
+		delete(c.needSnapshot, p)
+		c.mu.Unlock()
+		go c.sendSnapshot(p) // can take a while, heartbeats carry on meanwhile
+		return
+	}
 
-			// Determine what entries to send
-			var entriesToSend []LogEntry
-			if nextIdx < logLen {
-				// Follower is behind - send only missing entries
-				entriesToSend = c.Log[nextIdx:]
-			}
-			// else: follower is up-to-date, send empty (pure heartbeat)
+	nextIdx := c.nextIndex[p]
+	commitIndex := c.CommitIndex
+	digestField := ""
+	if digest != "" && c.peerSpeaks(p, 3) {
+		digestField = " " + digest
+	}
 
-			c.mu.Unlock()
+	// Determine what entries to send
+	var entriesToSend []LogEntry
+	sentUpTo := logLen // what a SUCCESS says the follower holds, short of index sentUpTo
+	if heartbeatOnly {
+		nextIdx = 0 // prevLogIndex -1 matches any log
+	} else if nextIdx < logLen {
+		// Follower is behind - send only missing entries, a window at a time
+		first := max(nextIdx, c.logOffset)
+		entriesToSend = c.window(p, c.Log[first-c.logOffset:])
+		sentUpTo = first + len(entriesToSend)
+	}
+	// else: follower is up-to-date, send empty (pure heartbeat)
+
+	prevLogIndex := nextIdx - 1
+	prevTermField := "" // from version 5 on, see appendEntries
+	if c.peerSpeaks(p, 5) {
+		prevLogTerm := 0
+		if prevLogIndex >= 0 {
+			prevLogTerm = c.termAt(prevLogIndex)
+		}
+		prevTermField = " " + strconv.Itoa(prevLogTerm)
+	}
 
-			conn, err := net.Dial("tcp", p)
-			if err != nil {
-				return
-			}
-			defer conn.Close()
+	c.mu.Unlock()
 
-			// Protocol: APPENDENTRIES <Term> <LeaderID> <PrevLogIndex> <EntryCount>
-			prevLogIndex := nextIdx - 1
-			fmt.Fprintf(conn, "APPENDENTRIES %d %s %d %d\n", term, leaderID, prevLogIndex, len(entriesToSend))
+	conn, err := c.dial(p)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	out := c.trackInFlight(conn, p)
+	defer out.done()
+	w := bufio.NewWriter(out)
 
-			// Send only the NEW entries (not the full log!)
-			for _, entry := range entriesToSend {
-				fmt.Fprintf(conn, "%d,%s\n", entry.Term, entry.Command)
-			}
+	// Protocol: APPENDENTRIES <Term> <LeaderID> <PrevLogIndex> <EntryCount> <LeaderCommit> [<PrevLogTerm>] [<Digest>] v<Version>
+	fmt.Fprintf(w, "APPENDENTRIES %d %s %d %d %d%s%s %s\n", term, leaderID, prevLogIndex, len(entriesToSend), commitIndex, prevTermField, digestField, versionTag)
 
-			// Read response
-			buf := make([]byte, 64)
-			n, err := conn.Read(buf)
-			if err != nil {
-				return
-			}
-			response := strings.TrimSpace(string(buf[:n]))
+	// Send only the NEW entries (not the full log!)
+	for _, entry := range entriesToSend {
+		fmt.Fprintf(w, "%d,%s\n", entry.Term, entry.Command)
+	}
+	if err := w.Flush(); err != nil {
+		return
+	}
 
-			c.mu.Lock()
-			defer c.mu.Unlock()
-
-			if response == "SUCCESS" {
-				// Follower accepted - update tracking
-				c.nextIndex[p] = logLen
-				c.matchIndex[p] = logLen - 1
-			} else if response == "CONFLICT" {
-				// Log mismatch - back up and retry next time
-				if c.nextIndex[p] > 0 {
-					c.nextIndex[p]--
-				}
+	// Read response
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return
+	}
+	status, replyTerm, rest, version := parseReply(string(buf[:n]))
+	if status == "ERR" {
+		fmt.Printf("[%s] %s rejected APPENDENTRIES: %s", c.ID, p, buf[:n])
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.contacted(p, version)
+	if c.stepDown(replyTerm) || c.CurrentTerm != term || c.State != Leader {
+		return // this reply was for a leadership we no longer hold
+	}
+	if heartbeatOnly {
+		return // sendSnapshot sets nextIndex when it's done
+	}
+	if status == "SUCCESS" {
+		// Follower accepted - update tracking. A snapshot install can have
+		// moved nextIndex past this round meanwhile, so only move forward.
+		c.nextIndex[p] = max(c.nextIndex[p], sentUpTo)
+		c.matchIndex[p] = max(c.matchIndex[p], sentUpTo-1)
+		c.advanceCommit()
+	} else if status == "CONFLICT" {
+		// Log mismatch - back up and retry next time. Followers report
+		// their log length, so we can jump straight to it.
+		if c.nextIndex[p] > 0 {
+			c.nextIndex[p]--
+		}
+		if len(rest) == 1 {
+			if followerLen, err := strconv.Atoi(rest[0]); err == nil && followerLen < c.nextIndex[p] {
+				c.nextIndex[p] = followerLen
 			}
-		}(peer)
+		}
 	}
 }
 
-func (c *Consensus) Replicate(command string) bool {
-	c.mu.Lock()
-	if c.State != Leader {
-		c.mu.Unlock()
-		return false //Only leader can replicate data.
+// parseReply splits a peer's reply to APPENDENTRIES or INSTALLSNAPSHOT,
+// "<STATUS> <term> [details...] [v<version>]", into its parts. A missing or
+// malformed term comes back as 0, which never makes us step down, and a
+// missing version as 1.
+func parseReply(reply string) (status string, term int, rest []string, version int) {
+	fields, version := SplitVersion(strings.Fields(reply))
+	if len(fields) == 0 {
+		return "", 0, nil, version
 	}
-	entry := LogEntry{Term: c.CurrentTerm, Command: command}
-	c.Log = append(c.Log, entry)
-	c.mu.Unlock()
+	if len(fields) > 1 {
+		term, _ = strconv.Atoi(fields[1])
+		rest = fields[2:]
+	}
+	return fields[0], term, rest, version
+}
 
-	fmt.Printf("[%s] Leader queued entry: %s\n", c.ID, command)
-	c.broadcastHeartbeat() // sends heartbeat to all followers to replicate the data.
+// stepDown turns us into a follower of term if it is newer than ours and
+// reports whether it was. A leader hears about a newer term from its
+// followers' replies, which is how a deposed leader learns it is stale.
+// Callers hold c.mu.
+func (c *Consensus) stepDown(term int) bool {
+	if term <= c.CurrentTerm {
+		return false
+	}
+	if c.State == Leader {
+		fmt.Printf("[%s] Saw term %d (ours is %d), stepping down\n", c.ID, term, c.CurrentTerm)
+	}
+	c.CurrentTerm = term
+	c.becomeFollower()
+	c.VotedFor = ""
+	c.saveState()
 	return true
-
 }
 
 // handle requestvote from peer, handleRequestVoteFromPeer() method.
 // (Reads request from peer and sends response.)
 
-func (c *Consensus) HandleRequestVote(term int, candidateID string) bool {
+// Reasons a vote is denied, sent back to the candidate in VOTEDENIED.
+const (
+	DeniedStaleTerm    = "stale-term"    // the candidate's term is older than ours
+	DeniedAlreadyVoted = "already-voted" // we voted for someone else this term
+	DeniedLogBehind    = "log-behind"    // the candidate's log is missing entries we have
+	DeniedLeaderAlive  = "leader-alive"  // pre-vote only: we still hear from a leader
+	DeniedDiskError    = "disk-error"    // we couldn't persist the vote
+)
+
+// HandleRequestVote decides on a vote and returns our term along with the
+// reason when the vote is denied. lastLogIndex and lastLogTerm describe the
+// candidate's log.
+func (c *Consensus) HandleRequestVote(term int, candidateID string, lastLogIndex, lastLogTerm int) (bool, int, string) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
 	if term < c.CurrentTerm { // if the term is older than current -> reject.
-		return false
+		return false, c.CurrentTerm, DeniedStaleTerm
 	}
 
-	if term > c.CurrentTerm { // if the term is newer than current -> update current term and become follower.
-		c.CurrentTerm = term
-		c.State = Follower
+	c.stepDown(term) // a newer term makes us a follower without a vote
+
+	if c.VotedFor != "" && c.VotedFor != candidateID {
+		return false, c.CurrentTerm, DeniedAlreadyVoted
+	}
+
+	// Only vote for a log at least as up to date as ours, or a leader could
+	// be elected without entries we already hold.
+	ourTerm := c.lastLogTerm()
+	if lastLogTerm < ourTerm || (lastLogTerm == ourTerm && lastLogIndex < c.lastIndex()) {
+		return false, c.CurrentTerm, DeniedLogBehind
+	}
+
+	c.VotedFor = candidateID
+	if !c.saveState() {
 		c.VotedFor = ""
+		return false, c.CurrentTerm, DeniedDiskError
 	}
 
-	if c.VotedFor == "" || c.VotedFor == candidateID { // if not voted for anyone or voted for the candidate -> grant vote.
-		c.VotedFor = candidateID
+	c.resetElectionTimer() // we're a follower now
+	return true, c.CurrentTerm, ""
+}
 
-		// this go func() is used to reset the heartbeat timer because we're a follower now.
-		go func() {
-			c.heartbeatCh <- true
-		}()
-		return true
+// lastLogTerm is the term of the newest entry, or of the snapshot before an empty log.
+func (c *Consensus) lastLogTerm() int {
+	if len(c.Log) > 0 {
+		return c.Log[len(c.Log)-1].Term
+	}
+	return c.offsetTerm
+}
+
+// resetElectionTimer tells the follower loop we heard from a leader or
+// candidate. It never blocks: if a reset is already pending, or nobody is
+// waiting because we aren't a follower, there's nothing more to say.
+func (c *Consensus) resetElectionTimer() {
+	select {
+	case c.heartbeatCh <- true:
+	default:
 	}
-	return false
 }
 
 func (c *Consensus) HandleHeartbeat(term int) {
@@ -345,13 +749,23 @@ func (c *Consensus) HandleHeartbeat(term int) {
 	defer c.mu.Unlock()
 
 	if term >= c.CurrentTerm {
-		c.CurrentTerm = term
-		c.State = Follower
-		// this go func() is used to reset the heartbeat timer because we're a follower now.
-		go func() {
-			c.heartbeatCh <- true
-		}()
+		if !c.stepDown(term) {
+			c.becomeFollower()
+		}
+		c.leaderSeen = c.clock.Now()
+		c.resetElectionTimer() // we're a follower now
+	}
+}
+
+// Leader returns the ID of the node leading the current term, or "" until
+// one has reached us. A paused leader doesn't count.
+func (c *Consensus) Leader() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.leaderTerm != c.CurrentTerm || (c.leader == c.ID && (c.State != Leader || c.paused)) {
+		return ""
 	}
+	return c.leader
 }
 
 func (c *Consensus) GetState() string {
@@ -364,6 +778,20 @@ func (c *Consensus) GetTerm() int {
 	defer c.mu.Unlock()
 	return c.CurrentTerm
 }
+
+// EntriesFrom returns a copy of up to max log entries starting at index from.
+func (c *Consensus) EntriesFrom(from, max int) []LogEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if from < c.logOffset || from > c.lastIndex() {
+		return nil
+	}
+	end := min(from+max, c.lastIndex()+1)
+	out := make([]LogEntry, end-from)
+	copy(out, c.Log[from-c.logOffset:end-c.logOffset])
+	return out
+}
+
 func (c *Consensus) GetCommitIndex() int {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -374,6 +802,8 @@ func (c *Consensus) Pause() { // stops node from cluster participation
 	c.mu.Lock()         // lock mutex for thread-safe access
 	defer c.mu.Unlock() // unlock when function returns safely
 	c.paused = true     // set paused flag to true
+	c.wakeLeader()      // a paused leader stops heartbeating right away
+	c.failCommitWaiters(ErrLostLeadership)
 	fmt.Printf("[%s] Node PAUSED - simulating failure\n", c.ID)
 }
 
@@ -383,9 +813,17 @@ func (c *Consensus) Resume() { // restarts node to rejoin cluster
 	c.paused = false    // set paused flag to false
 	c.State = Follower  // rejoin cluster as a follower
 	c.VotedFor = ""     // reset vote for new elections
+	c.saveState()
 	fmt.Printf("[%s] Node RESUMED - rejoining cluster\n", c.ID)
 }
 
+// Stop pauses the node for good and ends its raft loop, as if the process
+// had died. Bringing the node back takes a new Consensus.
+func (c *Consensus) Stop() {
+	c.Pause()
+	c.stopOnce.Do(func() { close(c.stop) })
+}
+
 func (c *Consensus) IsPaused() bool { // checks if node is paused
 	c.mu.Lock()         // lock mutex for thread-safe access
 	defer c.mu.Unlock() // unlock when function returns safely
@@ -397,64 +835,169 @@ func (c *Consensus) ClearLog() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	c.Log = []LogEntry{}
+	c.logOffset = 0
+	c.offsetTerm = 0
 	c.CommitIndex = 0
 	c.lastApplied = 0
+	c.durableIndex = -1
+	clear(c.persisted)
+	c.failCommitWaiters(ErrLogCleared)
+	c.resetPersisted()
 	fmt.Printf("[%s] Log cleared\n", c.ID)
 }
 
-// AddLogEntry adds to log without triggering heartbeat (for benchmarks)
-func (c *Consensus) AddLogEntry(command string) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	if c.paused {
-		return // don't add entries if node is paused
+// HandleAppendEntriesIncremental handles incremental log replication (proper
+// Raft). prevLogTerm is the term of the leader's entry at prevLogIndex, -1 if
+// the leader is too old to send it. On a refusal it also returns where the
+// leader should resume sending from.
+func (c *Consensus) HandleAppendEntriesIncremental(term int, leaderID string, prevLogIndex, prevLogTerm int, entries []LogEntry, leaderCommit int) (bool, int) {
+	ok, insertPoint, durable := c.appendEntries(term, leaderID, prevLogIndex, prevLogTerm, entries, leaderCommit)
+	if durable == nil {
+		return ok, insertPoint
+	}
+	// The leader counts our SUCCESS as the entries being safe, so they have
+	// to be on disk first. The wait happens without c.mu held.
+	if err := <-durable; err != nil {
+		fmt.Printf("[%s] Failed to persist entries from %s: %v\n", c.ID, leaderID, err)
+		c.mu.Lock()
+		if c.lastIndex() >= insertPoint && insertPoint >= c.logOffset {
+			c.Log = c.Log[:insertPoint-c.logOffset] // the leader will send them again
+		}
+		c.mu.Unlock()
+		return false, insertPoint
 	}
-	entry := LogEntry{Term: c.CurrentTerm, Command: command}
-	c.Log = append(c.Log, entry)
+	return ok, insertPoint
 }
 
-// HandleAppendEntriesIncremental handles incremental log replication (proper Raft)
-func (c *Consensus) HandleAppendEntriesIncremental(term int, leaderID string, prevLogIndex int, entries []LogEntry) bool {
+// appendEntries updates the log in memory and returns where the new entries
+// start along with their pending write to the log store, if any. On a
+// refusal the index is where the leader should resume.
+func (c *Consensus) appendEntries(term int, leaderID string, prevLogIndex, prevLogTerm int, entries []LogEntry, leaderCommit int) (bool, int, <-chan error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
 	if c.paused {
-		return false // don't process entries if node is paused
+		return false, c.lastIndex() + 1, nil // don't process entries if node is paused
 	}
 	// Reject if term is old
 	if term < c.CurrentTerm {
-		return false
+		return false, c.lastIndex() + 1, nil
 	}
 
-	// Update term and become follower
-	c.CurrentTerm = term
-	c.State = Follower
-	c.VotedFor = ""
+	// Update term and become follower. A vote of this term stays: clearing it
+	// would let us vote again in a term that has a leader.
+	if !c.stepDown(term) {
+		c.becomeFollower()
+	}
+	c.leaderSeen = c.clock.Now()
+	c.leader, c.leaderTerm = leaderID, term
 
-	// Reset election timer
-	go func() { c.heartbeatCh <- true }()
+	c.resetElectionTimer()
+
+	// Log matching: we need the leader's entry at prevLogIndex, same term.
+	if prevLogIndex > c.lastIndex() {
+		return false, c.lastIndex() + 1, nil // gap: the leader has to back up (or send a snapshot)
+	}
+	if ours, known := c.knownTerm(prevLogIndex); known && prevLogTerm >= 0 && ours != prevLogTerm {
+		return false, c.termStart(prevLogIndex), nil // a different history from here on
+	}
+
+	c.followCommit(leaderCommit, prevLogIndex+len(entries))
 
 	// If this is a pure heartbeat (no entries), just accept
 	if len(entries) == 0 {
-		return true
+		return true, 0, nil
 	}
 
-	// Log matching: check if we have the entry at prevLogIndex
-	// (Simplified: we trust leader for now, proper impl would check term match)
-
 	// Append new entries starting at prevLogIndex + 1
 	insertPoint := prevLogIndex + 1
 
-	if insertPoint < 0 {
-		insertPoint = 0
+	if insertPoint < c.logOffset {
+		// Part of this batch is already covered by our snapshot.
+		skip := min(c.logOffset-insertPoint, len(entries))
+		entries = entries[skip:]
+		insertPoint = c.logOffset
 	}
 
-	// Truncate conflicting entries and append new ones
-	if insertPoint <= len(c.Log) {
-		c.Log = c.Log[:insertPoint]
+	// Skip what we already hold. Only an entry whose term differs from ours
+	// truncates the log, so a late or repeated message can't cut off entries
+	// that arrived after it.
+	for len(entries) > 0 && insertPoint <= c.lastIndex() && c.Log[insertPoint-c.logOffset].Term == entries[0].Term {
+		entries = entries[1:]
+		insertPoint++
+	}
+	if len(entries) == 0 {
+		return true, 0, nil // nothing new, and nothing to truncate either
+	}
+
+	if c.witness {
+		entries = withoutCommands(entries)
 	}
+
+	// Truncate conflicting entries and append new ones
+	c.Log = c.Log[:insertPoint-c.logOffset]
 	c.Log = append(c.Log, entries...)
 
-	return true
+	return true, insertPoint, c.persist(insertPoint, entries)
+}
+
+// knownTerm is the term of the entry at index, if our log or the snapshot
+// still knows it. Callers hold c.mu.
+func (c *Consensus) knownTerm(index int) (int, bool) {
+	switch {
+	case index >= c.logOffset && index <= c.lastIndex():
+		return c.Log[index-c.logOffset].Term, true
+	case index >= 0 && index == c.logOffset-1 && c.offsetTerm > 0:
+		return c.offsetTerm, true
+	}
+	return 0, false // before the snapshot, committed and so the leader's too
+}
+
+// termStart is where a leader whose entry at index has another term should
+// back up to: the first uncommitted entry of ours with the term at index, so
+// it gets past a whole term of diverged entries in one round. Any of them it
+// does hold are kept when it sends them again. Callers hold c.mu.
+func (c *Consensus) termStart(index int) int {
+	if index < c.logOffset {
+		return index // only the snapshot knows it
+	}
+	term := c.Log[index-c.logOffset].Term
+	for index > c.logOffset && index > c.CommitIndex+1 && c.Log[index-1-c.logOffset].Term == term {
+		index--
+	}
+	return index
+}
+
+// ElectionRecord is how a node's latest candidacy went, for /status.
+type ElectionRecord struct {
+	Term    int               `json:"term"`
+	Votes   int               `json:"votes"` // including our own
+	Won     bool              `json:"won"`
+	PreVote bool              `json:"preVote,omitempty"` // we never got past asking whether we could win
+	Denials map[string]string `json:"denials,omitempty"` // peer -> reason it said no
+}
+
+func (c *Consensus) recordVote(term int, preVote bool, peer string, granted bool, reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.election.Term != term || c.election.PreVote != preVote {
+		return // a reply from an earlier election
+	}
+	if granted {
+		c.election.Votes++
+	} else {
+		c.election.Denials[peer] = reason
+	}
+}
+
+// LastElection returns a copy of our latest candidacy; Term is 0 if we never stood.
+func (c *Consensus) LastElection() ElectionRecord {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.election
+	e.Denials = make(map[string]string, len(c.election.Denials))
+	for p, r := range c.election.Denials {
+		e.Denials[p] = r
+	}
+	return e
 }
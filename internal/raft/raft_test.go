@@ -0,0 +1,817 @@
+package raft
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mathdee/KV-Store/internal/clock"
+)
+
+// replyTransport answers every APPENDENTRIES with a fixed reply.
+type replyTransport struct {
+	reply string
+}
+
+func (r replyTransport) Dial(peer string) (net.Conn, error) {
+	client, server := net.Pipe()
+	go func() {
+		defer server.Close()
+		bufio.NewReader(server).ReadString('\n') // heartbeats carry no entries
+		fmt.Fprintln(server, r.reply)
+	}()
+	return client, nil
+}
+
+func TestStaleLeaderStepsDown(t *testing.T) {
+	c := NewConsensus(":1", []string{":2"})
+	c.SetTransport(replyTransport{reply: "CONFLICT 5 0"})
+	c.mu.Lock()
+	c.State = Leader
+	c.CurrentTerm = 3
+	c.mu.Unlock()
+
+	c.broadcastHeartbeat()
+	deadline := time.Now().Add(time.Second)
+	for c.GetState() == Leader && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if c.GetState() != Follower || c.GetTerm() != 5 {
+		t.Fatalf("expected follower at term 5, got %s at term %d", c.GetState(), c.GetTerm())
+	}
+}
+
+func TestVoteDenialReasons(t *testing.T) {
+	c := NewConsensus(":1", []string{":2", ":3"})
+	c.mu.Lock()
+	c.CurrentTerm = 2
+	c.Log = []LogEntry{{Term: 1, Command: "SET a 1"}, {Term: 2, Command: "SET a 2"}}
+	c.mu.Unlock()
+
+	cases := []struct {
+		term, lastIndex, lastTerm int
+		candidate, reason         string
+	}{
+		{1, 5, 2, ":2", DeniedStaleTerm},
+		{3, 5, 1, ":2", DeniedLogBehind}, // longer, but an older last term
+		{3, 0, 2, ":2", DeniedLogBehind}, // same last term, shorter
+		{3, 1, 2, ":2", ""},
+		{3, 9, 3, ":3", DeniedAlreadyVoted},
+	}
+	for _, tc := range cases {
+		granted, term, reason := c.HandleRequestVote(tc.term, tc.candidate, tc.lastIndex, tc.lastTerm)
+		if granted != (tc.reason == "") || reason != tc.reason {
+			t.Errorf("vote %+v: got granted=%v reason=%q", tc, granted, reason)
+		}
+		if term != max(tc.term, 2) {
+			t.Errorf("vote %+v: expected our term %d, got %d", tc, max(tc.term, 2), term)
+		}
+	}
+}
+
+func TestHeartbeatsDontPileUpGoroutines(t *testing.T) {
+	c := NewConsensus(":1", []string{":2"})
+	before := runtime.NumGoroutine()
+	for i := 0; i < 1000; i++ { // nobody runs the follower loop, so nothing reads the resets
+		c.HandleHeartbeat(1)
+		c.HandleAppendEntriesIncremental(1, ":2", -1, 0, nil, -1)
+	}
+	if after := runtime.NumGoroutine(); after > before+5 {
+		t.Fatalf("expected no leaked goroutines, went from %d to %d", before, after)
+	}
+}
+
+func TestCandidateStopsOnceOutcomeIsKnown(t *testing.T) {
+	c := NewConsensus(":1", []string{":2", ":3"})
+	c.SetTransport(replyTransport{reply: "VOTEDENIED 0 already-voted"})
+	c.mu.Lock()
+	c.State = Candidate
+	c.mu.Unlock()
+
+	start := time.Now()
+	c.runCandidate()
+	if elapsed := time.Since(start); elapsed >= 400*time.Millisecond {
+		t.Fatalf("expected the election to end once every peer said no, took %v", elapsed)
+	}
+	if c.GetState() != Follower {
+		t.Fatalf("expected follower after losing, got %s", c.GetState())
+	}
+	if denials := c.LastElection().Denials; len(denials) != 2 || denials[":2"] != DeniedAlreadyVoted {
+		t.Fatalf("expected both denials recorded, got %v", denials)
+	}
+
+	// Without peers our own vote is a majority.
+	solo := NewConsensus(":1", nil)
+	solo.mu.Lock()
+	solo.State = Candidate
+	solo.mu.Unlock()
+	solo.runCandidate()
+	if solo.GetState() != Leader {
+		t.Fatalf("expected a single node to elect itself, got %s", solo.GetState())
+	}
+}
+
+// hangingTransport accepts connections that never answer.
+type hangingTransport struct {
+	dials *atomic.Int32
+}
+
+func (h hangingTransport) Dial(peer string) (net.Conn, error) {
+	h.dials.Add(1)
+	client, server := net.Pipe()
+	go io.Copy(io.Discard, server)
+	return client, nil
+}
+
+func TestLeaderLoopSkipsBusyPeersAndStopsOnPause(t *testing.T) {
+	var dials atomic.Int32
+	c := NewConsensus(":1", []string{":2"})
+	c.SetTransport(hangingTransport{&dials})
+	c.mu.Lock()
+	c.State = Leader
+	c.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		c.runLeader()
+		close(done)
+	}()
+	time.Sleep(5 * heartbeatInterval)
+	if n := dials.Load(); n != 1 {
+		t.Errorf("expected one connection to the stuck peer, got %d", n)
+	}
+
+	c.Pause()
+	select {
+	case <-done:
+	case <-time.After(heartbeatInterval / 2):
+		t.Fatal("expected the leader loop to stop right after Pause")
+	}
+}
+
+// ackTransport answers every APPENDENTRIES with SUCCESS at term 1.
+type ackTransport struct{}
+
+func (ackTransport) Dial(peer string) (net.Conn, error) {
+	client, server := net.Pipe()
+	go func() {
+		defer server.Close()
+		r := bufio.NewReader(server)
+		var term, prev, count, commit int
+		var leader string
+		line, _ := r.ReadString('\n')
+		fmt.Sscanf(line, "APPENDENTRIES %d %s %d %d %d", &term, &leader, &prev, &count, &commit)
+		for i := 0; i < count; i++ {
+			r.ReadString('\n')
+		}
+		fmt.Fprintln(server, "SUCCESS 1")
+	}()
+	return client, nil
+}
+
+func TestProposeWaitsForMajority(t *testing.T) {
+	c := NewConsensus(":1", []string{":2", ":3"})
+	c.SetTransport(ackTransport{})
+	c.mu.Lock()
+	c.State = Leader
+	c.CurrentTerm = 1
+	c.mu.Unlock()
+
+	index, done := c.Propose(context.Background(), "SET a 1")
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("expected the entry to commit, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the commit")
+	}
+	if index != 0 || c.GetCommitIndex() != 0 {
+		t.Fatalf("expected entry 0 committed, got index %d commit %d", index, c.GetCommitIndex())
+	}
+
+	// Waiters are told when we stop leading before their entry commits.
+	c.SetTransport(hangingTransport{new(atomic.Int32)})
+	_, done = c.Propose(context.Background(), "SET a 2")
+	c.mu.Lock()
+	c.stepDown(2)
+	c.mu.Unlock()
+	if err := <-done; err != ErrLostLeadership {
+		t.Fatalf("expected ErrLostLeadership, got %v", err)
+	}
+	if _, done := c.Propose(context.Background(), "SET a 3"); <-done != ErrNotLeader {
+		t.Fatal("expected a follower to refuse proposals")
+	}
+}
+
+func TestProposeGivesUpWithItsContext(t *testing.T) {
+	c := NewConsensus(":1", []string{":2", ":3"})
+	c.SetTransport(hangingTransport{new(atomic.Int32)}) // no majority, ever
+	c.mu.Lock()
+	c.State = Leader
+	c.CurrentTerm = 1
+	c.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	index, done := c.Propose(ctx, "SET a 1")
+	select {
+	case err := <-done:
+		if err != context.DeadlineExceeded {
+			t.Fatalf("expected the deadline to end the wait, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("still waiting after the deadline")
+	}
+	c.mu.Lock()
+	_, waiting := c.commitWaiters[index]
+	c.mu.Unlock()
+	if index != 0 || waiting {
+		t.Errorf("expected entry 0 proposed and no longer waited on, got index %d, waiting %v", index, waiting)
+	}
+
+	if index, done := c.Propose(ctx, "SET a 2"); index != -1 || <-done != context.DeadlineExceeded {
+		t.Error("expected nothing proposed for a context that already ended")
+	}
+}
+
+func TestReplicationStatus(t *testing.T) {
+	c := NewConsensus(":1", []string{":2", ":3"})
+	if st := c.ReplicationStatus(); len(st) != 2 || st[0].NextIndex != -1 {
+		t.Fatalf("expected untracked peers off the leader, got %+v", st)
+	}
+
+	c.SetTransport(ackTransport{})
+	c.mu.Lock()
+	c.State = Leader
+	c.CurrentTerm = 1
+	c.mu.Unlock()
+	_, done := c.Propose(context.Background(), "SET a 1")
+	<-done
+	c.Propose(context.Background(), "SET a 2") // may or may not be acked yet, but the first one was
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		st := c.ReplicationStatus()
+		ok := true
+		for _, p := range st {
+			ok = ok && p.MatchIndex == 1 && p.Lag == 0 && p.BytesInFlight == 0 && !p.LastContact.IsZero()
+		}
+		if ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected both peers caught up, got %+v", st)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPreVoteSticksWithLiveLeader(t *testing.T) {
+	c := NewConsensus(":1", []string{":2", ":3"})
+	clk := clock.NewFake(time.Now())
+	c.SetClock(clk)
+	c.HandleHeartbeat(2)
+
+	if granted, _, reason := c.HandlePreVote(3, ":2", 0, 0); granted || reason != DeniedLeaderAlive {
+		t.Fatalf("expected pre-vote denied while the leader is alive, got granted=%v reason=%q", granted, reason)
+	}
+	if c.GetTerm() != 2 || c.GetState() != Follower {
+		t.Fatalf("a pre-vote must not change our state, got %s at term %d", c.GetState(), c.GetTerm())
+	}
+
+	clk.Advance(minElectionTimeout)
+	if granted, _, reason := c.HandlePreVote(3, ":2", 0, 0); !granted {
+		t.Fatalf("expected pre-vote granted once the leader went quiet, got %q", reason)
+	}
+
+	// The candidate never gets to bump its term while the others say no.
+	cand := NewConsensus(":2", []string{":1", ":3"})
+	cand.SetTransport(replyTransport{reply: "VOTEDENIED 2 leader-alive"})
+	cand.mu.Lock()
+	cand.State = Candidate
+	cand.CurrentTerm = 2
+	cand.mu.Unlock()
+	cand.runCandidate()
+	if cand.GetTerm() != 2 || cand.GetState() != Follower {
+		t.Fatalf("expected a follower still at term 2, got %s at term %d", cand.GetState(), cand.GetTerm())
+	}
+	if e := cand.LastElection(); !e.PreVote || e.Denials[":1"] != DeniedLeaderAlive {
+		t.Fatalf("expected the failed pre-vote recorded, got %+v", e)
+	}
+}
+
+func TestFollowerStandsOnlyAfterItsTimeout(t *testing.T) {
+	c := NewConsensus(":1", []string{":2", ":3"})
+	clk := clock.NewFake(time.Now())
+	c.SetClock(clk)
+	done := make(chan struct{})
+	go func() {
+		c.runFollower()
+		close(done)
+	}()
+	for clk.Timers() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	clk.Advance(minElectionTimeout - time.Millisecond) // the shortest timeout, less a little
+	select {
+	case <-done:
+		t.Fatal("follower stood before its election timeout")
+	case <-time.After(20 * time.Millisecond):
+	}
+	clk.Advance(minElectionTimeout) // past the longest one
+	<-done
+	if c.GetState() != Candidate {
+		t.Fatalf("expected a candidate once the timeout passed, got %s", c.GetState())
+	}
+}
+
+func TestElectionPriorityStretchesTimeout(t *testing.T) {
+	c := NewConsensus(":1", nil)
+	for i := 0; i < 100; i++ {
+		if d := c.electionTimeout(); d < minElectionTimeout || d >= 2*minElectionTimeout {
+			t.Fatalf("full priority timeout out of range: %v", d)
+		}
+	}
+	c.SetElectionPriority(-3)
+	if c.ElectionPriority() != 0 {
+		t.Fatalf("expected priority clamped to 0, got %d", c.ElectionPriority())
+	}
+	if d := c.electionTimeout(); d < minElectionTimeout+MaxElectionPriority*priorityStep {
+		t.Fatalf("expected a low priority node to wait longer, got %v", d)
+	}
+}
+
+func TestWitnessKeepsTermsOnlyAndNeverStands(t *testing.T) {
+	w := NewConsensus(":3", []string{":1", ":2"})
+	w.SetWitness(true)
+	if ok, _ := w.HandleAppendEntriesIncremental(1, ":1", -1, 0, []LogEntry{{Term: 1, Command: "SET a 1"}}, 0); !ok {
+		t.Fatal("expected the witness to accept entries")
+	}
+	if log := w.EntriesFrom(0, 10); len(log) != 1 || log[0].Term != 1 || log[0].Command != "" {
+		t.Fatalf("expected a single term-only entry, got %+v", log)
+	}
+
+	// It still votes, and judges candidates' logs by term.
+	if granted, _, reason := w.HandleRequestVote(2, ":2", -1, 0); granted || reason != DeniedLogBehind {
+		t.Fatalf("expected an empty log to be denied, got granted=%v reason=%q", granted, reason)
+	}
+	if granted, _, reason := w.HandleRequestVote(2, ":2", 0, 1); !granted {
+		t.Fatalf("expected an up to date candidate to get the vote, got %q", reason)
+	}
+
+	select {
+	case <-w.heartbeatCh: // drop the pending reset so the timer runs out
+	default:
+	}
+	w.runFollower()
+	if w.GetState() != Follower {
+		t.Fatalf("expected a witness to stay a follower, got %s", w.GetState())
+	}
+}
+
+// v1Transport answers like a node from before protocol versions.
+type v1Transport struct{}
+
+func (v1Transport) Dial(peer string) (net.Conn, error) {
+	client, server := net.Pipe()
+	go func() {
+		defer server.Close()
+		line, _ := bufio.NewReader(server).ReadString('\n')
+		if strings.HasPrefix(line, "PREVOTE") {
+			fmt.Fprintln(server, "ERR unknown command")
+		} else {
+			fmt.Fprintln(server, "VOTEGRANTED 1")
+		}
+	}()
+	return client, nil
+}
+
+func TestRollingUpgradeWithOldPeers(t *testing.T) {
+	if parts, v := SplitVersion(strings.Fields("VOTEREQUEST 3 :1 4 2 v7")); v != 7 || len(parts) != 5 {
+		t.Fatalf("expected version 7 and five fields, got %d %v", v, parts)
+	}
+	if parts, v := SplitVersion(strings.Fields("APPENDENTRIES 3 :1 4 0 2")); v != 1 || len(parts) != 6 {
+		t.Fatalf("expected an untagged message to be version 1, got %d %v", v, parts)
+	}
+
+	c := NewConsensus(":1", []string{":2", ":3"})
+	c.SetTransport(v1Transport{})
+	c.mu.Lock()
+	c.State = Candidate
+	c.mu.Unlock()
+	c.runCandidate()
+	if c.GetState() != Leader {
+		t.Fatalf("expected old peers not to block the pre-vote, got %s", c.GetState())
+	}
+	deadline := time.Now().Add(time.Second) // the election can end before the last reply
+	for len(c.PeerVersions()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if v := c.PeerVersions(); v[":2"] != 1 || v[":3"] != 1 {
+		t.Fatalf("expected both peers marked as version 1, got %v", v)
+	}
+}
+
+func TestFollowerKnowsItsLeaderForTheTerm(t *testing.T) {
+	c := NewConsensus(":1", []string{":2", ":3"})
+	if got := c.Leader(); got != "" {
+		t.Fatalf("expected no leader before anyone reached us, got %q", got)
+	}
+	if ok, _ := c.HandleAppendEntriesIncremental(1, ":2", -1, 0, nil, -1); !ok {
+		t.Fatal("expected the heartbeat to be accepted")
+	}
+	if got := c.Leader(); got != ":2" {
+		t.Fatalf("expected :2 to lead term 1, got %q", got)
+	}
+
+	// A vote for a newer term means :2 no longer leads, and nobody does yet.
+	c.HandleRequestVote(2, ":3", 0, 0)
+	if got := c.Leader(); got != "" {
+		t.Fatalf("expected no known leader in term 2, got %q", got)
+	}
+}
+
+// terms lists the terms in c's log, to compare with what it should hold.
+func terms(c *Consensus) []int {
+	var out []int
+	for _, e := range c.EntriesFrom(0, 100) {
+		out = append(out, e.Term)
+	}
+	return out
+}
+
+func TestAppendEntriesChecksThePreviousTerm(t *testing.T) {
+	c := NewConsensus(":1", []string{":2", ":3"})
+	c.mu.Lock()
+	c.CurrentTerm = 2
+	c.CommitIndex = 0
+	c.Log = []LogEntry{{Term: 1, Command: "SET a 1"}, {Term: 2, Command: "SET x lost"}, {Term: 2, Command: "SET x gone"}}
+	c.mu.Unlock()
+
+	// The term 3 leader never had our term 2 entries: refuse, and send it
+	// back to the first of them.
+	ok, resume := c.HandleAppendEntriesIncremental(3, ":2", 2, 3, []LogEntry{{Term: 3, Command: "SET y new"}}, 1)
+	if ok || resume != 1 {
+		t.Fatalf("expected a refusal resuming at 1, got %v %d", ok, resume)
+	}
+	if got := c.GetCommitIndex(); got != 0 {
+		t.Fatalf("expected a refused message not to move the commit index, got %d", got)
+	}
+
+	// From where the logs agree the leader's entries replace ours.
+	entries := []LogEntry{{Term: 3, Command: "SET y new"}, {Term: 3, Command: "SET z new"}}
+	if ok, _ := c.HandleAppendEntriesIncremental(3, ":2", 0, 1, entries, 2); !ok {
+		t.Fatal("expected entries after a matching one to be accepted")
+	}
+	if got := terms(c); fmt.Sprint(got) != "[1 3 3]" {
+		t.Fatalf("expected terms [1 3 3], got %v", got)
+	}
+
+	// A leader too old to send the term isn't checked.
+	if ok, _ := c.HandleAppendEntriesIncremental(3, ":2", 2, -1, nil, 2); !ok {
+		t.Fatal("expected an unchecked heartbeat to be accepted")
+	}
+}
+
+func TestAppendEntriesTruncatesOnlyAtAConflict(t *testing.T) {
+	c := NewConsensus(":1", []string{":2", ":3"})
+	batch := []LogEntry{{Term: 1, Command: "SET a 1"}, {Term: 1, Command: "SET a 2"}, {Term: 1, Command: "SET a 3"}}
+	if ok, _ := c.HandleAppendEntriesIncremental(1, ":2", -1, 0, batch, -1); !ok {
+		t.Fatal("expected the batch to be accepted")
+	}
+
+	// A late copy of an earlier message must not cut off what came after it.
+	if ok, _ := c.HandleAppendEntriesIncremental(1, ":2", -1, 0, batch[:1], -1); !ok {
+		t.Fatal("expected the repeat to be accepted")
+	}
+	if got := c.GetLogLength(); got != 3 {
+		t.Fatalf("expected all three entries kept, got %d", got)
+	}
+
+	// A new leader's entry that differs replaces ours from there on.
+	if ok, _ := c.HandleAppendEntriesIncremental(2, ":3", -1, 0, []LogEntry{batch[0], {Term: 2, Command: "SET b 1"}}, -1); !ok {
+		t.Fatal("expected the new leader's entries to be accepted")
+	}
+	if got := terms(c); fmt.Sprint(got) != "[1 2]" {
+		t.Fatalf("expected terms [1 2], got %v", got)
+	}
+}
+
+// gatedTransport holds every APPENDENTRIES until release is closed and
+// records the most connections it had open at once.
+type gatedTransport struct {
+	release chan struct{}
+	mu      sync.Mutex
+	open    int
+	most    int
+}
+
+func (g *gatedTransport) Dial(peer string) (net.Conn, error) {
+	g.mu.Lock()
+	g.open++
+	g.most = max(g.most, g.open)
+	g.mu.Unlock()
+	client, server := net.Pipe()
+	go func() {
+		defer server.Close()
+		r := bufio.NewReader(server)
+		var term, prev, count int
+		var leader string
+		line, _ := r.ReadString('\n')
+		fmt.Sscanf(line, "APPENDENTRIES %d %s %d %d", &term, &leader, &prev, &count)
+		for i := 0; i < count; i++ {
+			r.ReadString('\n')
+		}
+		<-g.release
+		g.mu.Lock()
+		g.open-- // before the reply, so the leader's next round can't beat it
+		g.mu.Unlock()
+		fmt.Fprintln(server, "SUCCESS 1")
+	}()
+	return client, nil
+}
+
+func TestProposeKeepsOneRoundInFlightPerPeer(t *testing.T) {
+	g := &gatedTransport{release: make(chan struct{})}
+	c := NewConsensus(":1", []string{":2"})
+	c.SetTransport(g)
+	c.mu.Lock()
+	c.State = Leader
+	c.CurrentTerm = 1
+	c.mu.Unlock()
+
+	var last <-chan error
+	for i := 0; i < 5; i++ {
+		_, last = c.Propose(context.Background(), fmt.Sprintf("SET a %d", i))
+	}
+	close(g.release)
+	select {
+	case err := <-last:
+		if err != nil {
+			t.Fatalf("expected the last entry to commit, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the proposals made during a round to go out once it was answered")
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.most != 1 {
+		t.Fatalf("expected one round at a time, saw %d at once", g.most)
+	}
+}
+
+func TestCheckPeers(t *testing.T) {
+	for _, peers := range [][]string{nil, {"localhost:8081", "localhost:8082"}, {"10.0.0.2:8080"}} {
+		if err := CheckPeers(":8080", peers); err != nil {
+			t.Fatalf("expected %q to be fine, got %v", peers, err)
+		}
+	}
+	for _, peers := range [][]string{
+		{"localhost:8081", "localhost:8081"},
+		{"localhost:8081", ""},
+		{"localhost:8081", "127.0.0.1:8080"},
+		{":8080"},
+	} {
+		if err := CheckPeers(":8080", peers); err == nil {
+			t.Fatalf("expected %q to be refused", peers)
+		}
+	}
+}
+
+func TestQuorumStatusCountsRecentContact(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	c := NewConsensus(":1", []string{":2", ":3", ":4", ":5"})
+	c.SetClock(clk)
+	if st := c.QuorumStatus(); st != (QuorumStatus{Voters: 5, Quorum: 3, Reachable: 1}) {
+		t.Fatalf("expected only ourselves reachable, got %+v", st)
+	}
+
+	c.mu.Lock()
+	c.contacted(":2", ProtocolVersion)
+	c.leader, c.leaderTerm, c.leaderSeen = ":3", c.CurrentTerm, clk.Now()
+	c.mu.Unlock()
+	if st := c.QuorumStatus(); st.Reachable != 3 {
+		t.Fatalf("expected ourselves, a peer and the leader, got %+v", st)
+	}
+	clk.Advance(minElectionTimeout)
+	if st := c.QuorumStatus(); st.Reachable != 1 {
+		t.Fatalf("expected contact to go stale, got %+v", st)
+	}
+}
+
+func TestHandshakeJudgesPeers(t *testing.T) {
+	c := NewConsensus(":1", []string{":2"})
+	c.SetClusterID("prod")
+	for reply, want := range map[string]string{
+		"HANDSHAKE :2 prod v4":          HandshakeOK,
+		"HANDSHAKE :2 - v4":             HandshakeOK, // a peer without a cluster ID matches any
+		"HANDSHAKE :3 prod v4":          HandshakeMisconfigured,
+		"HANDSHAKE :1 prod v4":          HandshakeMisconfigured,
+		"HANDSHAKE :2 staging v4":       HandshakeMisconfigured,
+		"ERR UNKNOWN unknown command":   HandshakeUnsupported,
+		"HANDSHAKE :2 prod extra field": HandshakeUnsupported,
+	} {
+		c.SetTransport(replyTransport{reply: reply})
+		if got := c.greet(":2"); got.State != want {
+			t.Fatalf("expected %q to be %s, got %+v", reply, want, got)
+		}
+	}
+	if checks := c.PeerChecks(); len(checks) != 1 || checks[0].Peer != ":2" || checks[0].Checked.IsZero() {
+		t.Fatalf("expected the last check to be kept, got %+v", checks)
+	}
+}
+
+// flakyTransport fails every dial while down, counting them.
+type flakyTransport struct {
+	down  atomic.Bool
+	dials atomic.Int32
+}
+
+func (f *flakyTransport) Dial(peer string) (net.Conn, error) {
+	f.dials.Add(1)
+	if f.down.Load() {
+		return nil, fmt.Errorf("dial %s: connection refused", peer)
+	}
+	return ackTransport{}.Dial(peer)
+}
+
+func TestDialBacksOffAndOpensTheCircuit(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	c := NewConsensus(":1", []string{":2"})
+	c.SetClock(clk)
+	flaky := &flakyTransport{}
+	flaky.down.Store(true)
+	c.SetTransport(flaky)
+
+	for i := 1; i <= circuitThreshold; i++ {
+		if _, err := c.dial(":2"); err == nil || errors.Is(err, ErrBackingOff) {
+			t.Fatalf("dial %d: expected the transport's error, got %v", i, err)
+		}
+		if _, err := c.dial(":2"); !errors.Is(err, ErrBackingOff) {
+			t.Fatalf("dial %d: expected to back off, got %v", i, err)
+		}
+		clk.Advance(dialBackoffMax)
+	}
+	if got := flaky.dials.Load(); got != circuitThreshold {
+		t.Fatalf("expected %d dials to reach the transport, got %d", circuitThreshold, got)
+	}
+	if st := c.ReplicationStatus()[0]; st.DialState != DialOpen || st.DialFailures != circuitThreshold || st.DialError == "" {
+		t.Fatalf("expected an open circuit, got %+v", st)
+	}
+
+	flaky.down.Store(false)
+	conn, err := c.dial(":2")
+	if err != nil {
+		t.Fatalf("expected the probe to get through, got %v", err)
+	}
+	conn.Close()
+	if st := c.ReplicationStatus()[0]; st.DialState != DialOK || st.DialFailures != 0 || !st.RetryAt.IsZero() {
+		t.Fatalf("expected the circuit closed again, got %+v", st)
+	}
+}
+
+// TestConcurrentDialsWhileBackingOff has many senders at the backoff of
+// one dead peer at once, for -race: refusals report the retry time that
+// failing dials keep moving, and status readers read it too.
+func TestConcurrentDialsWhileBackingOff(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	c := NewConsensus(":1", []string{":2"})
+	c.SetClock(clk)
+	flaky := &flakyTransport{}
+	flaky.down.Store(true)
+	c.SetTransport(flaky)
+
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(max(runtime.GOMAXPROCS(0), 4))) // the senders have to overlap, even on one core
+	const senders, dials = 8, 2000
+	var wg sync.WaitGroup
+	var refused atomic.Int32
+	for range senders {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range dials {
+				if _, err := c.dial(":2"); errors.Is(err, ErrBackingOff) {
+					refused.Add(1)
+				}
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() { // lets a dial through now and then, which moves the retry time
+		defer close(done)
+		for range 200 {
+			clk.Advance(dialBackoffMax)
+			c.ReplicationStatus()
+			runtime.Gosched()
+		}
+	}()
+	wg.Wait()
+	<-done
+	if refused.Load() == 0 || flaky.dials.Load()+refused.Load() != senders*dials {
+		t.Fatalf("expected every dial to fail or be refused, got %d dials and %d refusals", flaky.dials.Load(), refused.Load())
+	}
+}
+
+func TestBackoffDelayGrowsToItsCap(t *testing.T) {
+	for failures, want := range map[int]time.Duration{1: dialBackoffBase, 3: 4 * dialBackoffBase, 10: dialBackoffMax, 100: dialBackoffMax} {
+		for range 20 {
+			if d := backoffDelay(failures); d < want/2 || d > want {
+				t.Fatalf("after %d failures expected a delay in [%v, %v], got %v", failures, want/2, want, d)
+			}
+		}
+	}
+}
+
+func TestWindowBoundsEntriesAndBytes(t *testing.T) {
+	c := NewConsensus(":1", []string{":2"})
+	entries := []LogEntry{{Term: 1, Command: "SET a 1234"}, {Term: 1, Command: "SET b 1234"}, {Term: 1, Command: "SET c 1234"}}
+
+	c.SetReplicationWindow(2, 0)
+	if got := c.window(":2", entries); len(got) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(got))
+	}
+	c.SetReplicationWindow(0, 15)
+	if got := c.window(":2", entries); len(got) != 1 {
+		t.Fatalf("expected the byte window to send 1 entry, got %d", len(got))
+	}
+	c.SetReplicationWindow(0, 1)
+	if got := c.window(":2", entries); len(got) != 1 {
+		t.Fatalf("expected an entry bigger than the window to go alone, got %d", len(got))
+	}
+	c.SetReplicationWindow(0, 0)
+	if got := c.window(":2", entries); len(got) != 3 {
+		t.Fatalf("expected no limit, got %d", len(got))
+	}
+	if st := c.FlowStats()[0]; st.Rounds != 4 || st.Throttled != 3 || st.Entries != 7 || st.Bytes != 70 {
+		t.Fatalf("expected 4 rounds, 3 of them throttled, got %+v", st)
+	}
+}
+
+// heldLogStore hands back the channels its appends report on, for the test
+// to answer.
+type heldLogStore struct {
+	appends chan chan error
+}
+
+func (s heldLogStore) Append(index int, entries []LogEntry) <-chan error {
+	ch := make(chan error, 1)
+	s.appends <- ch
+	return ch
+}
+
+func (heldLogStore) Reset(offset, term int, entries []LogEntry) error { return nil }
+func (heldLogStore) SaveState(HardState) error                        { return nil }
+
+func TestLeaderCountsItselfOnceOnDisk(t *testing.T) {
+	c := NewConsensus(":1", []string{":2"}) // the follower's ack alone is no majority
+	c.SetTransport(ackTransport{})
+	store := heldLogStore{make(chan chan error, 4)}
+	c.SetLogStore(store)
+	c.mu.Lock()
+	c.State = Leader
+	c.CurrentTerm = 1
+	c.mu.Unlock()
+
+	_, done := c.Propose(context.Background(), "SET a 1")
+	persisted := <-store.appends
+	select {
+	case err := <-done:
+		t.Fatalf("expected no commit before the leader's write, got %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	persisted <- nil
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("expected the entry to commit, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the commit")
+	}
+
+	// A write that fails doesn't count, and the leader steps down.
+	_, done = c.Propose(context.Background(), "SET a 2")
+	(<-store.appends) <- errors.New("disk full")
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrNotPersisted) {
+			t.Fatalf("expected ErrNotPersisted, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the failed write")
+	}
+	if c.GetState() == Leader || c.GetCommitIndex() != 0 || c.GetLogLength() != 1 {
+		t.Errorf("expected a follower holding only the committed entry, got %v commit %d length %d", c.GetState(), c.GetCommitIndex(), c.GetLogLength())
+	}
+}
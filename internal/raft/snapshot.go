@@ -0,0 +1,308 @@
+package raft
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A brand-new or long-offline follower used to be caught up one log entry
+// at a time. With a Snapshotter attached, a follower more than
+// snapshotAfter entries behind instead gets the leader's whole store in one
+// INSTALLSNAPSHOT message, so catching up costs the size of the data rather
+// than the length of the history:
+//
+//	INSTALLSNAPSHOT <term> <leaderID> <lastIndex> <lastTerm> <count>
+//	<base64 key> <base64 value> [<expires at, unix ms>]     (count lines)
+//
+// Only keys written with a TTL have the third field. Followers from before
+// TTLs refuse a snapshot holding one, and the leader retries until they
+// are upgraded.
+//
+// The follower replies "SUCCESS <term>" (or "FAILED <term>") and continues
+// the log at lastIndex+1.
+
+const DefaultSnapshotThreshold = 1000
+
+// Snapshotter is the state machine side of snapshot transfer.
+type Snapshotter interface {
+	// Snapshot returns a view of the state with every entry up to index
+	// applied. It has to stay valid while it is streamed to a follower.
+	Snapshot() (index int, data SnapshotData)
+	// InstallSnapshot replaces the state with data, which covers entries up
+	// to index. The keys in expires expire at the given unix millisecond.
+	InstallSnapshot(index int, data map[string]string, expires map[string]int64) error
+}
+
+// SnapshotData is a point-in-time view of the state machine. Close it once
+// it has been sent.
+type SnapshotData interface {
+	Len() int
+	Range(fn func(key, value string) bool)
+	Close()
+}
+
+// ExpiringData is SnapshotData whose keys can expire. Expiry returns when,
+// in unix milliseconds, or 0 for a key that doesn't.
+type ExpiringData interface {
+	SnapshotData
+	Expiry(key string) int64
+}
+
+// MapData is SnapshotData over a plain map, e.g. one that was just received.
+type MapData map[string]string
+
+func (m MapData) Len() int { return len(m) }
+
+func (m MapData) Range(fn func(key, value string) bool) {
+	for k, v := range m {
+		if !fn(k, v) {
+			return
+		}
+	}
+}
+
+func (MapData) Close() {}
+
+// SetSnapshotter enables snapshot transfer to followers more than threshold entries behind.
+func (c *Consensus) SetSnapshotter(s Snapshotter, threshold int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.snapshots = s
+	c.snapshotAfter = threshold
+}
+
+// lastIndex is the index of the newest log entry, or of the snapshot if the log is empty.
+func (c *Consensus) lastIndex() int {
+	return c.logOffset + len(c.Log) - 1
+}
+
+func (c *Consensus) termAt(index int) int {
+	if index >= c.logOffset && index <= c.lastIndex() {
+		return c.Log[index-c.logOffset].Term
+	}
+	if index == c.logOffset-1 && c.offsetTerm > 0 {
+		return c.offsetTerm
+	}
+	return c.CurrentTerm
+}
+
+// TermAt returns the term of the entry at index, for labelling snapshots.
+func (c *Consensus) TermAt(index int) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.termAt(index)
+}
+
+// CompactLog drops the entries up to and including index, which the caller
+// has made durable in a snapshot of its own. Followers that need them get a
+// snapshot instead.
+func (c *Consensus) CompactLog(index int) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if index < c.logOffset || index > c.lastIndex() {
+		return 0
+	}
+	n := index + 1 - c.logOffset
+	c.offsetTerm = c.Log[n-1].Term
+	c.Log = append([]LogEntry(nil), c.Log[n:]...) // let the old array go
+	c.logOffset = index + 1
+	c.resetPersisted()
+	return n
+}
+
+// FirstIndex is the oldest index still in the log; a snapshot covers the
+// ones before it.
+func (c *Consensus) FirstIndex() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.logOffset
+}
+
+// RetainedEntries is the number of entries still held in memory.
+func (c *Consensus) RetainedEntries() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.Log)
+}
+
+// wantsSnapshot reports whether peer should get a snapshot rather than
+// entries: it is more than snapshotAfter entries behind, our log no longer
+// holds what it needs, or the last transfer failed. Callers hold c.mu.
+func (c *Consensus) wantsSnapshot(peer string, logLen int) bool {
+	if c.snapshots == nil {
+		return false
+	}
+	next := c.nextIndex[peer]
+	return c.needSnapshot[peer] || next < c.logOffset || logLen-next > c.snapshotAfter
+}
+
+func (c *Consensus) sendSnapshot(peer string) {
+	defer func() {
+		c.mu.Lock()
+		delete(c.snapshotting, peer)
+		c.mu.Unlock()
+	}()
+
+	c.mu.Lock()
+	snapshots := c.snapshots
+	term := c.CurrentTerm
+	c.mu.Unlock()
+	if snapshots == nil {
+		return
+	}
+
+	// Dial first: copying the store for a peer that is down would be wasted work.
+	conn, err := c.dial(peer)
+	if err != nil {
+		c.retrySnapshot(peer)
+		return
+	}
+	defer conn.Close()
+
+	start := c.clock.Now()
+	index, data := snapshots.Snapshot()
+	defer data.Close()
+	count := data.Len()
+	c.mu.Lock()
+	lastTerm := c.termAt(index)
+	c.mu.Unlock()
+
+	out := c.trackInFlight(conn, peer)
+	defer out.done()
+	w := bufio.NewWriter(out)
+	c.mu.Lock()
+	tag := ""
+	if v, ok := c.peerVersion[peer]; ok && v >= 2 { // version 1 wants exactly six fields
+		tag = " " + versionTag
+	}
+	c.mu.Unlock()
+	fmt.Fprintf(w, "INSTALLSNAPSHOT %d %s %d %d %d%s\n", term, c.ID, index, lastTerm, count, tag)
+	expiring, _ := data.(ExpiringData)
+	data.Range(func(k, v string) bool {
+		fmt.Fprintf(w, "%s %s", base64.StdEncoding.EncodeToString([]byte(k)), base64.StdEncoding.EncodeToString([]byte(v)))
+		if expiring != nil {
+			if at := expiring.Expiry(k); at != 0 {
+				fmt.Fprintf(w, " %d", at)
+			}
+		}
+		w.WriteString("\n")
+		return true
+	})
+	if err := w.Flush(); err != nil {
+		c.retrySnapshot(peer)
+		return
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		c.retrySnapshot(peer)
+		return
+	}
+	status, replyTerm, _, version := parseReply(reply)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.contacted(peer, version)
+	if c.stepDown(replyTerm) || c.CurrentTerm != term {
+		return
+	}
+	if status != "SUCCESS" {
+		c.needSnapshot[peer] = true
+		return
+	}
+	fmt.Printf("[%s] Sent snapshot to %s: %d keys up to index %d in %v\n", c.ID, peer, count, index, c.clock.Since(start))
+	c.nextIndex[peer] = index + 1
+	c.matchIndex[peer] = index
+	c.advanceCommit()
+}
+
+func (c *Consensus) retrySnapshot(peer string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.needSnapshot[peer] = true
+}
+
+// ReadSnapshotData reads the count key/value lines that follow an
+// INSTALLSNAPSHOT header, and the expiries of the keys that have one.
+func ReadSnapshotData(scanner *bufio.Scanner, count int) (map[string]string, map[string]int64, error) {
+	data := make(map[string]string, count)
+	expires := make(map[string]int64)
+	for i := 0; i < count; i++ {
+		if !scanner.Scan() {
+			return nil, nil, fmt.Errorf("snapshot ended after %d of %d keys", i, count)
+		}
+		k64, rest, ok := strings.Cut(scanner.Text(), " ")
+		if !ok {
+			return nil, nil, fmt.Errorf("malformed snapshot line %d", i)
+		}
+		v64, expiry, expiring := strings.Cut(rest, " ")
+		k, err := base64.StdEncoding.DecodeString(k64)
+		if err != nil {
+			return nil, nil, fmt.Errorf("snapshot line %d: %w", i, err)
+		}
+		v, err := base64.StdEncoding.DecodeString(v64)
+		if err != nil {
+			return nil, nil, fmt.Errorf("snapshot line %d: %w", i, err)
+		}
+		data[string(k)] = string(v)
+		if expiring {
+			at, err := strconv.ParseInt(expiry, 10, 64)
+			if err != nil {
+				return nil, nil, fmt.Errorf("snapshot line %d: bad expiry %q", i, expiry)
+			}
+			expires[string(k)] = at
+		}
+	}
+	return data, expires, nil
+}
+
+// HandleInstallSnapshot accepts a snapshot from the leader: the log restarts
+// after lastIndex and the state machine is replaced with data.
+func (c *Consensus) HandleInstallSnapshot(term int, leaderID string, lastIndex, lastTerm int, data map[string]string, expires map[string]int64) bool {
+	c.mu.Lock()
+	if c.paused || term < c.CurrentTerm {
+		c.mu.Unlock()
+		return false
+	}
+	if !c.stepDown(term) {
+		c.becomeFollower()
+	}
+	c.leaderSeen = c.clock.Now()
+	c.leader, c.leaderTerm = leaderID, term
+	snapshots := c.snapshots
+	stale := lastIndex <= c.lastApplied
+	witness := c.witness
+	c.mu.Unlock()
+	c.resetElectionTimer()
+
+	if snapshots == nil && !witness {
+		return false
+	}
+	if stale {
+		return true // we have applied at least this much already
+	}
+	if witness {
+		data = nil // only the log position matters to a witness
+	} else if err := snapshots.InstallSnapshot(lastIndex, data, expires); err != nil {
+		fmt.Printf("[%s] Failed to install snapshot from %s: %v\n", c.ID, leaderID, err)
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if lastIndex <= c.lastIndex() && c.termAt(lastIndex) == lastTerm {
+		// We already have this part of the log; keep whatever follows it.
+		c.Log = c.Log[lastIndex+1-c.logOffset:]
+	} else {
+		c.Log = nil
+	}
+	c.logOffset = lastIndex + 1
+	c.offsetTerm = lastTerm
+	c.lastApplied = lastIndex
+	c.resetPersisted()
+	fmt.Printf("[%s] Installed snapshot from %s up to index %d (%d keys)\n", c.ID, leaderID, lastIndex, len(data))
+	return true
+}
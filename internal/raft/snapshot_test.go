@@ -0,0 +1,66 @@
+package raft
+
+import (
+	"bufio"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+type fakeState struct {
+	index int
+	data  map[string]string
+}
+
+func (f *fakeState) Snapshot() (int, SnapshotData) { return f.index, MapData(f.data) }
+
+func (f *fakeState) InstallSnapshot(index int, data map[string]string, _ map[string]int64) error {
+	f.index, f.data = index, data
+	return nil
+}
+
+func TestInstallSnapshotMovesLogOffset(t *testing.T) {
+	c := NewConsensus(":1", nil)
+	state := &fakeState{}
+	c.SetSnapshotter(state, 10)
+
+	// A gap must be refused so the leader backs up instead of us appending at the wrong index.
+	if ok, _ := c.HandleAppendEntriesIncremental(1, ":2", 4, 1, []LogEntry{{Term: 1, Command: "SET a 1"}}, -1); ok {
+		t.Fatal("expected a gap to be refused")
+	}
+
+	if !c.HandleInstallSnapshot(1, ":2", 9, 1, map[string]string{"a": "1"}, nil) {
+		t.Fatal("expected snapshot to be installed")
+	}
+	if state.index != 9 || c.GetLogLength() != 10 {
+		t.Fatalf("expected state at 9 and log length 10, got %d and %d", state.index, c.GetLogLength())
+	}
+
+	// The leader resends 8..10; only 10 is new.
+	entries := []LogEntry{{Term: 1, Command: "SET x 8"}, {Term: 1, Command: "SET x 9"}, {Term: 1, Command: "SET b 2"}}
+	if ok, _ := c.HandleAppendEntriesIncremental(1, ":2", 7, 1, entries, 10); !ok {
+		t.Fatal("expected entries overlapping the snapshot to be accepted")
+	}
+	start, unapplied := c.TakeCommitted(10)
+	if start != 10 || len(unapplied) != 1 || unapplied[0].Command != "SET b 2" {
+		t.Fatalf("expected only index 10 to be unapplied, got start %d %+v", start, unapplied)
+	}
+	if got := c.EntriesFrom(10, 5); len(got) != 1 || got[0].Command != "SET b 2" {
+		t.Errorf("EntriesFrom(10) = %+v", got)
+	}
+	if got := c.EntriesFrom(9, 5); got != nil {
+		t.Errorf("expected nothing before the offset, got %+v", got)
+	}
+}
+
+func TestSnapshotLinesCarryExpiries(t *testing.T) {
+	lines := base64.StdEncoding.EncodeToString([]byte("a")) + " " + base64.StdEncoding.EncodeToString([]byte("1")) + "\n" +
+		base64.StdEncoding.EncodeToString([]byte("b")) + " " + base64.StdEncoding.EncodeToString([]byte("2")) + " 1700000000000\n"
+	data, expires, err := ReadSnapshotData(bufio.NewScanner(strings.NewReader(lines)), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data["a"] != "1" || data["b"] != "2" || len(expires) != 1 || expires["b"] != 1700000000000 {
+		t.Fatalf("expected a permanent and b expiring, got %v %v", data, expires)
+	}
+}
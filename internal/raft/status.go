@@ -0,0 +1,90 @@
+package raft
+
+import (
+	"io"
+	"time"
+)
+
+// PeerStatus is the leader's view of one follower.
+type PeerStatus struct {
+	Peer          string    `json:"peer"`
+	NextIndex     int       `json:"nextIndex"`
+	MatchIndex    int       `json:"matchIndex"`
+	Lag           int       `json:"lag"`                  // entries the follower is missing
+	LastContact   time.Time `json:"lastContact,omitzero"` // last reply we got, zero if none yet
+	BytesInFlight int64     `json:"bytesInFlight"`        // sent but not yet answered
+	Snapshotting  bool      `json:"snapshotting"`
+	Version       int       `json:"protocolVersion,omitempty"` // what the peer last answered in, 0 if unknown
+	DialState     string    `json:"dialState"`                 // ok, backoff or open, see dial
+	DialFailures  int       `json:"dialFailures,omitempty"`    // failed dials in a row
+	RetryAt       time.Time `json:"retryAt,omitzero"`          // no dial before then
+	DialError     string    `json:"dialError,omitempty"`       // why the last dial failed
+}
+
+// ReplicationStatus is a consistent snapshot of how replication to every
+// peer is going. Only the leader tracks this; elsewhere the indexes are -1.
+func (c *Consensus) ReplicationStatus() []PeerStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make([]PeerStatus, 0, len(c.Peers))
+	for _, p := range c.Peers {
+		st := PeerStatus{
+			Peer:          p,
+			NextIndex:     -1,
+			MatchIndex:    -1,
+			LastContact:   c.lastContact[p],
+			BytesInFlight: c.inFlight[p],
+			Snapshotting:  c.snapshotting[p],
+			Version:       c.peerVersion[p],
+			DialState:     c.dialBackoff[p].state(),
+		}
+		if b := c.dialBackoff[p]; b != nil {
+			st.DialFailures, st.RetryAt, st.DialError = b.failures, b.retryAt, b.lastErr
+		}
+		if next, ok := c.nextIndex[p]; ok && c.State == Leader {
+			st.NextIndex = next
+			st.MatchIndex = c.matchIndex[p]
+			st.Lag = c.lastIndex() - st.MatchIndex
+		}
+		out = append(out, st)
+	}
+	return out
+}
+
+// contacted records a reply from peer, given in version. Callers hold c.mu.
+func (c *Consensus) contacted(peer string, version int) {
+	c.lastContact[peer] = c.clock.Now()
+	c.peerVersion[peer] = version
+}
+
+// inFlightWriter counts what is written to a peer as in flight until done
+// is called.
+type inFlightWriter struct {
+	w       io.Writer
+	c       *Consensus
+	peer    string
+	written int64
+}
+
+func (c *Consensus) trackInFlight(w io.Writer, peer string) *inFlightWriter {
+	return &inFlightWriter{w: w, c: c, peer: peer}
+}
+
+func (f *inFlightWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	f.c.mu.Lock()
+	f.c.inFlight[f.peer] += int64(n)
+	f.c.mu.Unlock()
+	f.written += int64(n)
+	return n, err
+}
+
+// done takes everything written back out of flight, answered or not.
+func (f *inFlightWriter) done() {
+	f.c.mu.Lock()
+	defer f.c.mu.Unlock()
+	f.c.inFlight[f.peer] -= f.written
+	if f.c.inFlight[f.peer] == 0 {
+		delete(f.c.inFlight, f.peer)
+	}
+}
@@ -0,0 +1,183 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Transport opens the connections raft uses to reach its peers.
+type Transport interface {
+	Dial(peer string) (net.Conn, error)
+}
+
+// TCPTransport dials peers over plain TCP.
+type TCPTransport struct{}
+
+func (TCPTransport) Dial(peer string) (net.Conn, error) {
+	return net.Dial("tcp", peer)
+}
+
+var ErrInjectedFault = errors.New("injected network fault")
+
+// FaultRule describes what happens to messages sent to one peer.
+type FaultRule struct {
+	DropPercent int           `json:"dropPercent"` // share of messages that fail (0-100)
+	Delay       time.Duration `json:"delayNs"`     // added before each message is sent
+	MessageType string        `json:"messageType"` // e.g. "APPENDENTRIES", "" means every message
+}
+
+// FaultTransport wraps a Transport and injects drops, delays and partitions
+// into outbound raft traffic. It only affects messages this node sends, so a
+// symmetric partition has to be applied on every node involved. Drops draw
+// from a seeded RNG, so the same seed gives the same sequence of faults.
+type FaultTransport struct {
+	mu     sync.Mutex
+	inner  Transport
+	self   string
+	rules  map[string]FaultRule // peer -> rule
+	groups [][]string           // partition: nodes can only reach their own group
+	rng    *rand.Rand
+}
+
+func NewFaultTransport(self string, inner Transport) *FaultTransport {
+	return &FaultTransport{
+		inner: inner,
+		self:  self,
+		rules: make(map[string]FaultRule),
+		rng:   rand.New(rand.NewSource(1)),
+	}
+}
+
+// FaultState is what /chaos reports.
+type FaultState struct {
+	Rules     map[string]FaultRule `json:"rules"`
+	Partition [][]string           `json:"partition"`
+}
+
+func (f *FaultTransport) SetInner(inner Transport) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.inner = inner
+}
+
+// SetRule installs (or with a zero rule, removes) the fault for one peer.
+func (f *FaultTransport) SetRule(peer string, rule FaultRule) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if rule == (FaultRule{}) {
+		delete(f.rules, peer)
+		return
+	}
+	f.rules[peer] = rule
+}
+
+// Partition splits the cluster into groups; peers outside our group are unreachable.
+func (f *FaultTransport) Partition(groups [][]string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.groups = groups
+}
+
+// Seed resets the RNG used for drops.
+func (f *FaultTransport) Seed(seed int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rng = rand.New(rand.NewSource(seed))
+}
+
+// Heal removes every fault.
+func (f *FaultTransport) Heal() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rules = make(map[string]FaultRule)
+	f.groups = nil
+}
+
+func (f *FaultTransport) State() FaultState {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	rules := make(map[string]FaultRule, len(f.rules))
+	for p, r := range f.rules {
+		rules[p] = r
+	}
+	return FaultState{Rules: rules, Partition: f.groups}
+}
+
+func (f *FaultTransport) partitioned(peer string) bool {
+	if len(f.groups) == 0 {
+		return false
+	}
+	for _, g := range f.groups {
+		hasSelf, hasPeer := false, false
+		for _, n := range g {
+			hasSelf = hasSelf || n == f.self
+			hasPeer = hasPeer || n == peer
+		}
+		if hasSelf {
+			return !hasPeer
+		}
+	}
+	return false // we're in no group, leave our traffic alone
+}
+
+func (f *FaultTransport) Dial(peer string) (net.Conn, error) {
+	f.mu.Lock()
+	if f.partitioned(peer) {
+		f.mu.Unlock()
+		return nil, fmt.Errorf("dial %s: %w (partitioned)", peer, ErrInjectedFault)
+	}
+	rule, hasRule := f.rules[peer]
+	inner := f.inner
+	f.mu.Unlock()
+
+	conn, err := inner.Dial(peer)
+	if err != nil || !hasRule {
+		return conn, err
+	}
+	return &faultConn{Conn: conn, rule: rule, transport: f}, nil
+}
+
+func (f *FaultTransport) roll(percent int) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.rng.Intn(100) < percent
+}
+
+// faultConn applies a rule when the first message line is written, which is
+// where raft puts the message type.
+type faultConn struct {
+	net.Conn
+	rule      FaultRule
+	transport *FaultTransport
+	decided   bool
+	dropped   bool
+}
+
+func (c *faultConn) Write(p []byte) (int, error) {
+	if !c.decided {
+		c.decided = true
+		if c.rule.MessageType == "" || strings.HasPrefix(string(p), c.rule.MessageType) {
+			if c.rule.Delay > 0 {
+				time.Sleep(c.rule.Delay)
+			}
+			c.dropped = c.rule.DropPercent > 0 && c.transport.roll(c.rule.DropPercent)
+		}
+	}
+	if c.dropped {
+		c.Conn.Close()
+		return 0, ErrInjectedFault
+	}
+	return c.Conn.Write(p)
+}
+
+// DialPeer connects to peer through the same transport and faults as raft
+// traffic, for requests the server makes of its peers itself, like
+// anti-entropy.
+func (c *Consensus) DialPeer(peer string) (net.Conn, error) {
+	return c.transport.Dial(peer)
+}
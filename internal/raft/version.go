@@ -0,0 +1,87 @@
+package raft
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Raft messages carry the sender's protocol version as a trailing "v<N>"
+// field, so nodes can be upgraded one at a time:
+//
+//   - a request without the field is version 1, the protocol before versions;
+//   - a receiver answers in the requester's dialect, tagging its reply only if
+//     the request was tagged, so a version 1 node never sees a field it
+//     doesn't expect;
+//   - each side remembers what its peers speak and leaves out what they
+//     don't understand, e.g. PREVOTE and the tag on INSTALLSNAPSHOT, whose
+//     version 1 parser wants an exact field count;
+//   - anything older than MinProtocolVersion gets an ERR and the connection
+//     is closed, rather than having its frames guessed at.
+//
+// Version 2 added the version field itself and PREVOTE, version 3 the
+// leader's state digest on APPENDENTRIES, version 4 HANDSHAKE, version 5 the
+// term of the entry before an APPENDENTRIES' first, ahead of the digest.
+const (
+	ProtocolVersion    = 5
+	MinProtocolVersion = 1
+)
+
+// SplitVersion removes the version field from a message's fields and
+// returns it, 1 if the sender didn't say.
+func SplitVersion(parts []string) ([]string, int) {
+	if n := len(parts); n > 1 {
+		if v, ok := parseVersion(parts[n-1]); ok {
+			return parts[:n-1], v
+		}
+	}
+	return parts, 1
+}
+
+func parseVersion(field string) (int, bool) {
+	digits, ok := strings.CutPrefix(field, "v")
+	if !ok {
+		return 0, false
+	}
+	v, err := strconv.Atoi(digits)
+	return v, err == nil && v > 0
+}
+
+// CheckVersion reports whether we can talk to a peer speaking version.
+// Newer peers are fine: they downgrade to us once they see our replies.
+func CheckVersion(version int) error {
+	if version < MinProtocolVersion {
+		return fmt.Errorf("protocol version %d not supported, this node speaks %d-%d", version, MinProtocolVersion, ProtocolVersion)
+	}
+	return nil
+}
+
+// ReplyTag is what to append to a reply to a request from version: our own
+// version for tagged requests, nothing for version 1.
+func ReplyTag(version int) string {
+	if version < 2 {
+		return ""
+	}
+	return " " + versionTag
+}
+
+var versionTag = "v" + strconv.Itoa(ProtocolVersion)
+
+// peerSpeaks reports whether peer is known to speak at least version.
+// Peers we haven't heard from yet are assumed to be up to date. Callers
+// hold c.mu.
+func (c *Consensus) peerSpeaks(peer string, version int) bool {
+	v, ok := c.peerVersion[peer]
+	return !ok || v >= version
+}
+
+// PeerVersions returns the protocol version each peer last answered in.
+func (c *Consensus) PeerVersions() map[string]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make(map[string]int, len(c.peerVersion))
+	for p, v := range c.peerVersion {
+		out[p] = v
+	}
+	return out
+}
@@ -0,0 +1,29 @@
+package raft
+
+// A witness lets two data nodes form a three-vote cluster without paying for
+// a third copy of the data. It votes and acks entries like any follower, so
+// it counts toward election and commit quorums, but it never stands for
+// election and keeps only each entry's term: that is all the vote's
+// up-to-date check needs.
+
+// SetWitness makes this node a witness. Call it before Start.
+func (c *Consensus) SetWitness(witness bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.witness = witness
+}
+
+func (c *Consensus) IsWitness() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.witness
+}
+
+// withoutCommands copies entries keeping only their terms.
+func withoutCommands(entries []LogEntry) []LogEntry {
+	out := make([]LogEntry, len(entries))
+	for i, e := range entries {
+		out[i] = LogEntry{Term: e.Term}
+	}
+	return out
+}
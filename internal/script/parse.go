@@ -0,0 +1,463 @@
+package script
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// maxDepth bounds how deeply expressions and blocks nest, so no script
+// can run the parser or the evaluator out of stack.
+const maxDepth = 100
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokName
+	tokNumber
+	tokString
+	tokOp      // punctuation, e.g. "==" or "("
+	tokKeyword // if, then, local, ...
+)
+
+var keywords = map[string]bool{
+	"and": true, "else": true, "elseif": true, "end": true, "false": true, "if": true,
+	"local": true, "nil": true, "not": true, "or": true, "return": true, "then": true, "true": true,
+}
+
+// Longest first, so "==" isn't read as "=" "=".
+var operators = []string{"..", "==", "~=", "<=", ">=", "+", "-", "*", "/", "%", "<", ">", "=", "(", ")", "[", "]", ",", ";", "#"}
+
+type token struct {
+	kind tokenKind
+	text string // a string token's value, escapes resolved
+	num  int64
+	pos  int // byte offset in the source
+}
+
+func lex(src string) ([]token, error) {
+	var toks []token
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+		case strings.HasPrefix(src[i:], "--"): // a comment runs to the end of the script, there are no lines
+			i = len(src)
+		case isLetter(c):
+			j := i + 1
+			for j < len(src) && (isLetter(src[j]) || isDigit(src[j])) {
+				j++
+			}
+			kind := tokName
+			if keywords[src[i:j]] {
+				kind = tokKeyword
+			}
+			toks = append(toks, token{kind: kind, text: src[i:j], pos: i})
+			i = j
+		case isDigit(c):
+			j := i + 1
+			for j < len(src) && isDigit(src[j]) {
+				j++
+			}
+			if j < len(src) && isLetter(src[j]) {
+				return nil, errorAt(i, "malformed number %q", src[i:j+1])
+			}
+			n, err := strconv.ParseInt(src[i:j], 10, 64)
+			if err != nil {
+				return nil, errorAt(i, "number %s is too large", src[i:j])
+			}
+			toks = append(toks, token{kind: tokNumber, num: n, pos: i})
+			i = j
+		case c == '"' || c == '\'':
+			s, n, err := lexString(src[i:])
+			if err != nil {
+				return nil, errorAt(i, "%v", err)
+			}
+			toks = append(toks, token{kind: tokString, text: s, pos: i})
+			i += n
+		default:
+			op := ""
+			for _, o := range operators {
+				if strings.HasPrefix(src[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, errorAt(i, "unexpected %q", src[i:i+1])
+			}
+			toks = append(toks, token{kind: tokOp, text: op, pos: i})
+			i += len(op)
+		}
+	}
+	return append(toks, token{kind: tokEOF, pos: len(src)}), nil
+}
+
+// lexString reads the quoted string src starts with, returning its value
+// and how many bytes it took. \\ and the quotes are the only escapes,
+// since a value can't hold a line break.
+func lexString(src string) (string, int, error) {
+	quote := src[0]
+	var b strings.Builder
+	for i := 1; i < len(src); i++ {
+		switch c := src[i]; {
+		case c == quote:
+			return b.String(), i + 1, nil
+		case c == '\\':
+			if i+1 == len(src) || !strings.ContainsRune(`\"'`, rune(src[i+1])) {
+				return "", 0, fmt.Errorf("unknown escape in string")
+			}
+			i++
+			b.WriteByte(src[i])
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", 0, fmt.Errorf("unfinished string")
+}
+
+func isLetter(c byte) bool { return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' }
+func isDigit(c byte) bool  { return '0' <= c && c <= '9' }
+
+// The syntax tree.
+
+type (
+	expr interface{}
+	stmt interface{}
+
+	literal  struct{ v value }
+	variable struct {
+		name string
+		pos  int
+	}
+	index struct {
+		table expr
+		key   expr
+		pos   int
+	}
+	call struct {
+		fn   string
+		args []expr
+		pos  int
+	}
+	unary struct {
+		op  string
+		x   expr
+		pos int
+	}
+	binary struct {
+		op   string
+		x, y expr
+		pos  int
+	}
+
+	local struct {
+		name string
+		x    expr
+	}
+	assign struct {
+		name string
+		x    expr
+		pos  int
+	}
+	ifStmt struct {
+		conds  []expr
+		blocks [][]stmt // one per cond
+		els    []stmt
+	}
+	returnStmt struct{ x expr } // nil x returns nil
+	callStmt   struct{ c *call }
+)
+
+// Binary operators by precedence, lowest first, as in Lua. Concatenation
+// binds tighter than comparison and looser than arithmetic.
+var precedence = [][]string{
+	{"or"},
+	{"and"},
+	{"==", "~=", "<", "<=", ">", ">="},
+	{".."},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+type parser struct {
+	toks  []token
+	i     int
+	depth int
+}
+
+func parse(src string) ([]stmt, error) {
+	toks, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{toks: toks}
+	body, err := p.block()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, errorAt(t.pos, "unexpected %s", describe(t))
+	}
+	return body, nil
+}
+
+func (p *parser) peek() token { return p.toks[p.i] }
+
+func (p *parser) next() token {
+	t := p.toks[p.i]
+	if t.kind != tokEOF {
+		p.i++
+	}
+	return t
+}
+
+// is reports whether the next token is the keyword or operator text.
+func (p *parser) is(text string) bool {
+	t := p.peek()
+	return (t.kind == tokKeyword || t.kind == tokOp) && t.text == text
+}
+
+func (p *parser) expect(text string) error {
+	if !p.is(text) {
+		t := p.peek()
+		return errorAt(t.pos, "expected %q, got %s", text, describe(t))
+	}
+	p.next()
+	return nil
+}
+
+func (p *parser) enter() error {
+	p.depth++
+	if p.depth > maxDepth {
+		return errorAt(p.peek().pos, "nested too deeply")
+	}
+	return nil
+}
+
+// block reads statements up to the end of the script or a keyword that
+// closes the block.
+func (p *parser) block() ([]stmt, error) {
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer func() { p.depth-- }()
+	var body []stmt
+	for {
+		switch {
+		case p.peek().kind == tokEOF, p.is("end"), p.is("else"), p.is("elseif"):
+			return body, nil
+		case p.is(";"):
+			p.next()
+			continue
+		}
+		s, err := p.statement()
+		if err != nil {
+			return nil, err
+		}
+		body = append(body, s)
+		if _, ok := s.(returnStmt); ok { // as in Lua, nothing can follow a return in its block
+			if p.is(";") {
+				p.next()
+			}
+			return body, nil
+		}
+	}
+}
+
+func (p *parser) statement() (stmt, error) {
+	t := p.peek()
+	switch {
+	case p.is("local"):
+		p.next()
+		name := p.next()
+		if name.kind != tokName {
+			return nil, errorAt(name.pos, "expected a name after local, got %s", describe(name))
+		}
+		if err := p.expect("="); err != nil {
+			return nil, err
+		}
+		x, err := p.expr()
+		return local{name: name.text, x: x}, err
+
+	case p.is("if"):
+		return p.ifStatement()
+
+	case p.is("return"):
+		p.next()
+		if p.peek().kind == tokEOF || p.is("end") || p.is("else") || p.is("elseif") || p.is(";") {
+			return returnStmt{}, nil
+		}
+		x, err := p.expr()
+		return returnStmt{x: x}, err
+
+	case t.kind == tokName && p.toks[p.i+1].kind == tokOp && p.toks[p.i+1].text == "=":
+		p.i += 2
+		x, err := p.expr()
+		return assign{name: t.text, x: x, pos: t.pos}, err
+	}
+	x, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	c, ok := x.(*call)
+	if !ok {
+		return nil, errorAt(t.pos, "expected a statement, got an expression")
+	}
+	return callStmt{c: c}, nil
+}
+
+func (p *parser) ifStatement() (stmt, error) {
+	var s ifStmt
+	for p.is("if") || p.is("elseif") {
+		p.next()
+		cond, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("then"); err != nil {
+			return nil, err
+		}
+		body, err := p.block()
+		if err != nil {
+			return nil, err
+		}
+		s.conds, s.blocks = append(s.conds, cond), append(s.blocks, body)
+	}
+	if p.is("else") {
+		p.next()
+		body, err := p.block()
+		if err != nil {
+			return nil, err
+		}
+		s.els = body
+	}
+	return s, p.expect("end")
+}
+
+func (p *parser) expr() (expr, error) {
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer func() { p.depth-- }()
+	return p.binary(0)
+}
+
+func (p *parser) binary(level int) (expr, error) {
+	if level == len(precedence) {
+		return p.unary()
+	}
+	x, err := p.binary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		if t.kind != tokOp && t.kind != tokKeyword || !slices.Contains(precedence[level], t.text) {
+			return x, nil
+		}
+		p.next()
+		// Concatenation is right-associative in Lua, the rest left.
+		next := level + 1
+		if t.text == ".." {
+			next = level
+		}
+		y, err := p.binary(next)
+		if err != nil {
+			return nil, err
+		}
+		x = &binary{op: t.text, x: x, y: y, pos: t.pos}
+		if t.text == ".." {
+			return x, nil
+		}
+	}
+}
+
+func (p *parser) unary() (expr, error) {
+	t := p.peek()
+	if p.is("not") || p.is("-") || p.is("#") {
+		p.next()
+		if err := p.enter(); err != nil {
+			return nil, err
+		}
+		defer func() { p.depth-- }()
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &unary{op: t.text, x: x, pos: t.pos}, nil
+	}
+	return p.primary()
+}
+
+func (p *parser) primary() (expr, error) {
+	t := p.next()
+	var x expr
+	switch {
+	case t.kind == tokNumber:
+		x = literal{v: t.num}
+	case t.kind == tokString:
+		x = literal{v: t.text}
+	case t.kind == tokKeyword && t.text == "nil":
+		x = literal{v: nil}
+	case t.kind == tokKeyword && (t.text == "true" || t.text == "false"):
+		x = literal{v: t.text == "true"}
+	case t.kind == tokOp && t.text == "(":
+		inner, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		x = inner
+	case t.kind == tokName && p.is("("):
+		p.next()
+		c := &call{fn: t.text, pos: t.pos}
+		for !p.is(")") {
+			if len(c.args) > 0 {
+				if err := p.expect(","); err != nil {
+					return nil, err
+				}
+			}
+			arg, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			c.args = append(c.args, arg)
+		}
+		p.next()
+		x = c
+	case t.kind == tokName:
+		x = &variable{name: t.text, pos: t.pos}
+	default:
+		return nil, errorAt(t.pos, "unexpected %s", describe(t))
+	}
+	for p.is("[") {
+		pos := p.next().pos
+		key, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("]"); err != nil {
+			return nil, err
+		}
+		x = &index{table: x, key: key, pos: pos}
+	}
+	return x, nil
+}
+
+func describe(t token) string {
+	switch t.kind {
+	case tokEOF:
+		return "end of script"
+	case tokNumber:
+		return strconv.FormatInt(t.num, 10)
+	case tokString:
+		return "a string"
+	}
+	return strconv.Quote(t.text)
+}
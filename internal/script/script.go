@@ -0,0 +1,476 @@
+// Package script runs the small scripts of EVAL: read-modify-write logic
+// that runs against the store in one step on every node.
+//
+// The language is a subset of Lua:
+//
+//	local n = tonumber(get(KEYS[1])) or 0
+//	if n + ARGV[1] > 100 then error("over the limit") end
+//	set(KEYS[1], n + ARGV[1])
+//	return n + ARGV[1]
+//
+// There are locals, assignment, if/elseif/else, return, the operators of
+// Lua (and, or, not, == ~= < <= > >=, .., + - * / %, unary - and #), and
+// no loops or function definitions, so a script always finishes, in time
+// proportional to its length. KEYS and ARGV hold the keys and arguments
+// EVAL was given, from 1. Values are nil, booleans, strings and 64-bit
+// integers; arithmetic turns strings holding integers into numbers, as Lua
+// does, and / and % round towards negative infinity.
+//
+// The store is reached through
+//
+//	get(key)         the value, or nil
+//	set(key, value)  value a string or a number
+//	del(key)         true if it existed
+//	exists(key)      true if it exists
+//
+// and only for keys in KEYS, so every key a script touches is known before
+// it runs. tonumber, tostring and error(message), which stops the script
+// with nothing it wrote kept, are the other functions.
+//
+// Every node runs the script from the raft log and has to get the same
+// answer, so nothing reads a clock or anything else outside the store.
+package script
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+)
+
+// MaxString is the longest string a script can build, so a line of
+// concatenations can't take up all of a node's memory.
+const MaxString = 1 << 20
+
+// Store is what a script reads and writes, a store.Tx under EVAL.
+type Store interface {
+	Get(key string) (string, bool)
+	Set(key, value string)
+	Delete(key string)
+}
+
+// Script is a compiled script, which can be run any number of times.
+type Script struct {
+	body []stmt
+}
+
+// Error is a script that doesn't compile or failed running, with where in
+// the source.
+type Error struct {
+	Pos int // byte offset
+	Msg string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("script at %d: %s", e.Pos, e.Msg)
+}
+
+func errorAt(pos int, format string, args ...any) *Error {
+	return &Error{Pos: pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+// Compile parses src.
+func Compile(src string) (*Script, error) {
+	body, err := parse(src)
+	if err != nil {
+		return nil, err
+	}
+	return &Script{body: body}, nil
+}
+
+// Run runs the script against st and returns the reply: "(nil)" for nil
+// or no return, 1 and 0 for booleans. The caller keeps what it wrote only
+// if err is nil.
+func (s *Script) Run(st Store, keys, args []string) (string, error) {
+	r := &run{st: st, keys: keys, args: args}
+	v, _, err := r.block(s.body, &scope{})
+	if err != nil {
+		return "", err
+	}
+	switch v := v.(type) {
+	case nil:
+		return "(nil)", nil
+	case bool:
+		if v {
+			return "1", nil
+		}
+		return "0", nil
+	case table:
+		return "", errorAt(0, "a script can't return a table")
+	}
+	return toString(v), nil
+}
+
+// A value is nil, bool, int64, string or table.
+type value any
+
+// table is KEYS or ARGV, which only # and indexing can use.
+type table []string
+
+type scope struct {
+	vars   map[string]value
+	parent *scope
+}
+
+func (sc *scope) lookup(name string) (*scope, bool) {
+	for ; sc != nil; sc = sc.parent {
+		if _, ok := sc.vars[name]; ok {
+			return sc, true
+		}
+	}
+	return nil, false
+}
+
+type run struct {
+	st         Store
+	keys, args []string
+}
+
+// block runs body in a scope of its own; returned is true once a return ran.
+func (r *run) block(body []stmt, parent *scope) (v value, returned bool, err error) {
+	sc := &scope{vars: map[string]value{}, parent: parent}
+	for _, s := range body {
+		switch s := s.(type) {
+		case local:
+			v, err := r.eval(s.x, sc)
+			if err != nil {
+				return nil, false, err
+			}
+			sc.vars[s.name] = v
+		case assign:
+			owner, ok := sc.lookup(s.name)
+			if !ok {
+				return nil, false, errorAt(s.pos, "assignment to undeclared variable %s, declare it with local", s.name)
+			}
+			v, err := r.eval(s.x, sc)
+			if err != nil {
+				return nil, false, err
+			}
+			owner.vars[s.name] = v
+		case ifStmt:
+			body := s.els
+			for i, cond := range s.conds {
+				v, err := r.eval(cond, sc)
+				if err != nil {
+					return nil, false, err
+				}
+				if truthy(v) {
+					body = s.blocks[i]
+					break
+				}
+			}
+			if v, returned, err := r.block(body, sc); err != nil || returned {
+				return v, returned, err
+			}
+		case returnStmt:
+			if s.x == nil {
+				return nil, true, nil
+			}
+			v, err := r.eval(s.x, sc)
+			return v, err == nil, err
+		case callStmt:
+			if _, err := r.call(s.c, sc); err != nil {
+				return nil, false, err
+			}
+		}
+	}
+	return nil, false, nil
+}
+
+func (r *run) eval(x expr, sc *scope) (value, error) {
+	switch x := x.(type) {
+	case literal:
+		return x.v, nil
+	case *variable:
+		switch x.name {
+		case "KEYS":
+			return table(r.keys), nil
+		case "ARGV":
+			return table(r.args), nil
+		}
+		owner, ok := sc.lookup(x.name)
+		if !ok {
+			return nil, errorAt(x.pos, "undefined variable %s", x.name)
+		}
+		return owner.vars[x.name], nil
+	case *index:
+		t, err := r.eval(x.table, sc)
+		if err != nil {
+			return nil, err
+		}
+		list, ok := t.(table)
+		if !ok {
+			return nil, errorAt(x.pos, "only KEYS and ARGV can be indexed, not a %s", typeName(t))
+		}
+		k, err := r.eval(x.key, sc)
+		if err != nil {
+			return nil, err
+		}
+		i, ok := toInt(k)
+		if !ok {
+			return nil, errorAt(x.pos, "index is a %s, not a number", typeName(k))
+		}
+		if i < 1 || i > int64(len(list)) {
+			return nil, nil
+		}
+		return list[i-1], nil
+	case *call:
+		return r.call(x, sc)
+	case *unary:
+		v, err := r.eval(x.x, sc)
+		if err != nil {
+			return nil, err
+		}
+		switch x.op {
+		case "not":
+			return !truthy(v), nil
+		case "#":
+			switch v := v.(type) {
+			case string:
+				return int64(len(v)), nil
+			case table:
+				return int64(len(v)), nil
+			}
+			return nil, errorAt(x.pos, "can't take the length of a %s", typeName(v))
+		}
+		n, ok := toInt(v)
+		if !ok {
+			return nil, errorAt(x.pos, "can't negate a %s", typeName(v))
+		}
+		return -n, nil
+	case *binary:
+		return r.binary(x, sc)
+	}
+	panic(fmt.Sprintf("script: unknown expression %T", x))
+}
+
+func (r *run) binary(x *binary, sc *scope) (value, error) {
+	a, err := r.eval(x.x, sc)
+	if err != nil {
+		return nil, err
+	}
+	switch x.op { // and and or only evaluate what they need, and yield an operand
+	case "and":
+		if !truthy(a) {
+			return a, nil
+		}
+		return r.eval(x.y, sc)
+	case "or":
+		if truthy(a) {
+			return a, nil
+		}
+		return r.eval(x.y, sc)
+	}
+	b, err := r.eval(x.y, sc)
+	if err != nil {
+		return nil, err
+	}
+	switch x.op {
+	case "==":
+		return equal(a, b), nil
+	case "~=":
+		return !equal(a, b), nil
+	case "<", "<=", ">", ">=":
+		c, err := compare(a, b)
+		if err != nil {
+			return nil, errorAt(x.pos, "%v", err)
+		}
+		switch x.op {
+		case "<":
+			return c < 0, nil
+		case "<=":
+			return c <= 0, nil
+		case ">":
+			return c > 0, nil
+		}
+		return c >= 0, nil
+	case "..":
+		if !concatenable(a) || !concatenable(b) {
+			return nil, errorAt(x.pos, "can't concatenate a %s and a %s", typeName(a), typeName(b))
+		}
+		s := toString(a) + toString(b)
+		if len(s) > MaxString {
+			return nil, errorAt(x.pos, "string longer than %d bytes", MaxString)
+		}
+		return s, nil
+	}
+	m, ok1 := toInt(a)
+	n, ok2 := toInt(b)
+	if !ok1 || !ok2 {
+		return nil, errorAt(x.pos, "can't do arithmetic on a %s and a %s", typeName(a), typeName(b))
+	}
+	switch x.op {
+	case "+":
+		return m + n, nil
+	case "-":
+		return m - n, nil
+	case "*":
+		return m * n, nil
+	}
+	if n == 0 {
+		return nil, errorAt(x.pos, "division by zero")
+	}
+	q, rem := m/n, m%n
+	if rem != 0 && (rem < 0) != (n < 0) { // round towards negative infinity, as Lua's // does
+		q, rem = q-1, rem+n
+	}
+	if x.op == "/" {
+		return q, nil
+	}
+	return rem, nil
+}
+
+// storeFunctions take a key first, which has to be in KEYS.
+var storeFunctions = map[string]int{"get": 1, "set": 2, "del": 1, "exists": 1}
+
+func (r *run) call(c *call, sc *scope) (value, error) {
+	args := make([]value, len(c.args))
+	for i, a := range c.args {
+		v, err := r.eval(a, sc)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+	want, isStore := storeFunctions[c.fn]
+	switch {
+	case isStore:
+	case c.fn == "tonumber", c.fn == "tostring", c.fn == "error":
+		want = 1
+	default:
+		return nil, errorAt(c.pos, "unknown function %s", c.fn)
+	}
+	if len(args) != want {
+		return nil, errorAt(c.pos, "%s takes %d arguments, got %d", c.fn, want, len(args))
+	}
+
+	switch c.fn {
+	case "tonumber":
+		if n, ok := toInt(args[0]); ok {
+			return n, nil
+		}
+		return nil, nil
+	case "tostring":
+		if _, ok := args[0].(table); ok {
+			return nil, errorAt(c.pos, "can't convert a table to a string")
+		}
+		return toString(args[0]), nil
+	case "error":
+		if !concatenable(args[0]) {
+			return nil, errorAt(c.pos, "error wants a message, got a %s", typeName(args[0]))
+		}
+		return nil, errorAt(c.pos, "%s", toString(args[0]))
+	}
+
+	key, ok := args[0].(string)
+	if !ok {
+		return nil, errorAt(c.pos, "%s wants a key, got a %s", c.fn, typeName(args[0]))
+	}
+	if !slices.Contains(r.keys, key) {
+		return nil, errorAt(c.pos, "key %q isn't in KEYS", key)
+	}
+	switch c.fn {
+	case "get":
+		if v, ok := r.st.Get(key); ok {
+			return v, nil
+		}
+		return nil, nil
+	case "exists":
+		_, ok := r.st.Get(key)
+		return ok, nil
+	case "del":
+		_, ok := r.st.Get(key)
+		r.st.Delete(key)
+		return ok, nil
+	}
+	if !concatenable(args[1]) {
+		return nil, errorAt(c.pos, "set wants a string or a number, got a %s", typeName(args[1]))
+	}
+	r.st.Set(key, toString(args[1]))
+	return nil, nil
+}
+
+func truthy(v value) bool {
+	return v != nil && v != false
+}
+
+func equal(a, b value) bool {
+	if _, ok := a.(table); ok {
+		return false
+	}
+	if _, ok := b.(table); ok {
+		return false
+	}
+	return a == b
+}
+
+func compare(a, b value) (int, error) {
+	switch a := a.(type) {
+	case int64:
+		if b, ok := b.(int64); ok {
+			return cmp(a, b), nil
+		}
+	case string:
+		if b, ok := b.(string); ok {
+			return cmp(a, b), nil
+		}
+	}
+	return 0, fmt.Errorf("can't compare a %s with a %s", typeName(a), typeName(b))
+}
+
+func cmp[T int64 | string](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func concatenable(v value) bool {
+	switch v.(type) {
+	case string, int64:
+		return true
+	}
+	return false
+}
+
+// toInt reads v as an integer, converting strings as arithmetic does.
+func toInt(v value) (int64, bool) {
+	switch v := v.(type) {
+	case int64:
+		return v, true
+	case string:
+		n, err := strconv.ParseInt(v, 10, 64)
+		return n, err == nil
+	}
+	return 0, false
+}
+
+func toString(v value) string {
+	switch v := v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return strconv.FormatBool(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case string:
+		return v
+	}
+	return "table"
+}
+
+func typeName(v value) string {
+	switch v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return "boolean"
+	case int64:
+		return "number"
+	case string:
+		return "string"
+	}
+	return "table"
+}
@@ -0,0 +1,118 @@
+package script
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// mapStore is a Store over a map.
+type mapStore map[string]string
+
+func (m mapStore) Get(key string) (string, bool) { v, ok := m[key]; return v, ok }
+func (m mapStore) Set(key, value string)         { m[key] = value }
+func (m mapStore) Delete(key string)             { delete(m, key) }
+
+func TestRun(t *testing.T) {
+	for _, tc := range []struct {
+		src  string
+		want string
+	}{
+		{"return 1 + 2 * 3", "7"},
+		{"return (1 + 2) * 3", "9"},
+		{"return -7 / 2 .. ' ' .. -7 % 2", "-4 1"},
+		{"return 'a' .. 'b' .. 1", "ab1"},
+		{"return '10' + 1", "11"}, // strings holding integers do arithmetic
+		{"return '10' == 10", "0"},
+		{"return 1 < 2 and 'yes' or 'no'", "yes"},
+		{"return nil or false", "0"},
+		{"return not nil", "1"},
+		{"return #KEYS .. #ARGV .. #'abc'", "213"},
+		{"return ARGV[5]", "(nil)"},
+		{"", "(nil)"},
+		{"local x = 1; if x > 1 then return 'big' elseif x == 1 then return 'one' else return 'small' end", "one"},
+		{"local x = 1 if true then local x = 2 end return x", "1"},          // locals are scoped to their block
+		{"local x = 1 if true then x = 2 end return x -- the outer x", "2"}, // assignment reaches outer locals
+		{`return "it's \"quoted\""`, `it's "quoted"`},
+
+		// The store.
+		{"return get(KEYS[1])", "5"},
+		{"return get(KEYS[2])", "(nil)"},
+		{"return exists(KEYS[1]) and not exists(KEYS[2])", "1"},
+		{"local n = tonumber(get(KEYS[1])) or 0 set(KEYS[1], n + ARGV[1]) return get(KEYS[1])", "7"},
+		{"set(KEYS[2], 'x') return get(KEYS[2])", "x"},
+		{"return del(KEYS[1]) and not exists(KEYS[1])", "1"},
+	} {
+		s, err := Compile(tc.src)
+		if err != nil {
+			t.Errorf("Compile(%q) failed: %v", tc.src, err)
+			continue
+		}
+		got, err := s.Run(mapStore{"counter": "5"}, []string{"counter", "missing"}, []string{"2"})
+		if err != nil || got != tc.want {
+			t.Errorf("%q = %q, %v, expected %q", tc.src, got, err, tc.want)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	for _, tc := range []struct {
+		src  string
+		want string
+	}{
+		{"return 1 +", "unexpected end of script"},
+		{"if true then return 1", `expected "end"`},
+		{"return 'open", "unfinished string"},
+		{"x = 1", "undeclared variable x"},
+		{"1 + 1", "expected a statement"},
+		{"return 1 return 2", "unexpected \"return\""},
+		{strings.Repeat("(", 200) + "1" + strings.Repeat(")", 200), "nested too deeply"},
+		{"return y", "undefined variable y"},
+		{"return 1 / 0", "division by zero"},
+		{"return 'a' + 1", "arithmetic on a string"},
+		{"return 1 < 'a'", "can't compare"},
+		{"return KEYS", "can't return a table"},
+		{"return get('other')", `key "other" isn't in KEYS`},
+		{"return set(KEYS[1])", "set takes 2 arguments"},
+		{"return now()", "unknown function now"},
+		{"set(KEYS[1], 'x') error('stop')", "stop"},
+		{"local s = '" + strings.Repeat("x", 1<<19) + "' return s .. s .. s", "longer than"},
+	} {
+		s, err := Compile(tc.src)
+		if err == nil {
+			_, err = s.Run(mapStore{}, []string{"k"}, nil)
+		}
+		var serr *Error
+		if !errors.As(err, &serr) || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%.40q: expected an error with %q, got %v", tc.src, tc.want, err)
+		}
+	}
+}
+
+// FuzzScript runs whatever compiles against a small store: no script may
+// panic, and one that fails has to fail with an *Error.
+func FuzzScript(f *testing.F) {
+	for _, seed := range []string{
+		"return 1 + 2",
+		"local n = tonumber(get(KEYS[1])) or 0 set(KEYS[1], n + ARGV[1]) return n",
+		"if exists(KEYS[1]) then return del(KEYS[1]) elseif #ARGV > 1 then error('x') else return nil end",
+		"return 'a' .. -9223372036854775807 - 2 .. #KEYS",
+		"return (((1)))",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, src string) {
+		s, err := Compile(src)
+		if err != nil {
+			if _, ok := err.(*Error); !ok {
+				t.Fatalf("Compile(%q) failed with %T: %v", src, err, err)
+			}
+			return
+		}
+		if _, err := s.Run(mapStore{"k": "1"}, []string{"k"}, []string{"2", "x"}); err != nil {
+			if _, ok := err.(*Error); !ok {
+				t.Fatalf("Run(%q) failed with %T: %v", src, err, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,235 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mathdee/KV-Store/internal/raft"
+	"github.com/mathdee/KV-Store/internal/store"
+)
+
+// Anti-entropy is the safety net under replication: every interval a
+// follower asks the leader for its digest (see digest.go), compares it with
+// its own at the same index, and asks again for the contents of the
+// digest shards that differ, which it then makes its own:
+//
+//	SYNCSHARDS <shard,shard,...|->
+//	SHARDS <index> <digest> <count>, then count key/value lines as in INSTALLSNAPSHOT
+//
+// Both sides answer for the state at exactly one index, so the follower
+// only compares or repairs once it has applied that index and nothing
+// after it. If writes carry it past the index first, the round is skipped
+// and the next one tries again. Repairs go to the store and its WAL
+// directly, not through the log, so watches and CDC don't see them.
+
+// DefaultAntiEntropyInterval is how often a follower checks its state
+// against the leader's.
+const DefaultAntiEntropyInterval = 30 * time.Second
+
+// antiEntropyWait bounds how long a round waits to catch up with the
+// leader's index.
+const antiEntropyWait = 2 * time.Second
+
+// DigestRepair is an anti-entropy round that changed something.
+type DigestRepair struct {
+	Index  int       `json:"index"`
+	Leader string    `json:"leader"`
+	Shards []int     `json:"shards"`
+	Keys   int       `json:"keys"` // keys rewritten or removed
+	At     time.Time `json:"at"`
+}
+
+// RunAntiEntropy checks this node's state against the leader's every
+// interval while it follows, until ctx ends. An interval of 0 disables it.
+func (s *Server) RunAntiEntropy(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		leader := s.raft.Leader()
+		if s.raft.GetState() != raft.Follower || s.raft.IsPaused() || s.raft.IsWitness() || leader == "" {
+			continue
+		}
+		if err := s.AntiEntropy(ctx, leader); err != nil {
+			s.digests.failed(err)
+			fmt.Printf("[%s] Anti-entropy with %s: %v\n", s.raft.ID, leader, err)
+		}
+	}
+}
+
+// AntiEntropy runs one round against leader: compare digests, then fetch
+// and install the shards that differ.
+func (s *Server) AntiEntropy(ctx context.Context, leader string) error {
+	index, theirs, _, _, err := s.fetchShards(leader, nil)
+	if err != nil {
+		return err
+	}
+	var shards []int
+	if !s.atIndex(ctx, index, func() { shards = s.store.Digest().Diff(theirs) }) {
+		return nil // we moved past the leader's index, next round
+	}
+	s.digests.synced()
+	if len(shards) == 0 {
+		return nil
+	}
+	fmt.Printf("[%s] Anti-entropy: digest shards %v differ from %s's at index %d, fetching them\n", s.raft.ID, shards, leader, index)
+
+	index, theirs, data, expires, err := s.fetchShards(leader, shards)
+	if err != nil {
+		return err
+	}
+	var keys int
+	var repairErr error
+	var still []int
+	done := s.atIndex(ctx, index, func() {
+		keys, repairErr = s.store.RepairShards(ctx, shards, data, expires)
+		for _, shard := range s.store.Digest().Diff(theirs) {
+			if slices.Contains(shards, shard) {
+				still = append(still, shard)
+			}
+		}
+	})
+	if !done {
+		return nil
+	}
+	if repairErr != nil {
+		return fmt.Errorf("repairing shards %v: %w", shards, repairErr)
+	}
+	s.digests.repaired(DigestRepair{Index: index, Leader: leader, Shards: shards, Keys: keys, At: time.Now()})
+	fmt.Printf("[%s] Anti-entropy: repaired %d keys in digest shards %v from %s at index %d\n", s.raft.ID, keys, shards, leader, index)
+	if len(still) > 0 {
+		return fmt.Errorf("digest shards %v still differ after the repair", still)
+	}
+	return nil
+}
+
+// atIndex runs fn with applyMu held exclusively once exactly index has
+// been applied, and reports whether it did. It gives up once we apply past
+// index or after antiEntropyWait.
+func (s *Server) atIndex(ctx context.Context, index int, fn func()) bool {
+	deadline := time.Now().Add(antiEntropyWait)
+	for ctx.Err() == nil && time.Now().Before(deadline) {
+		if s.Applied() > index {
+			return false
+		}
+		if s.Applied() == index && s.applyMu.TryLock() {
+			ok := s.Applied() == index
+			if ok {
+				fn()
+			}
+			s.applyMu.Unlock()
+			return ok
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return false
+}
+
+// fetchShards asks leader for its digest and the contents of shards.
+func (s *Server) fetchShards(leader string, shards []int) (int, store.Digest, map[string]string, map[string]int64, error) {
+	var d store.Digest
+	conn, err := s.raft.DialPeer(leader)
+	if err != nil {
+		return 0, d, nil, nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(s.RequestTimeout()))
+	list := "-"
+	if len(shards) > 0 {
+		list = joinInts(shards)
+	}
+	if _, err := fmt.Fprintf(conn, "SYNCSHARDS %s v%d\n", list, raft.ProtocolVersion); err != nil {
+		return 0, d, nil, nil, err
+	}
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 64*1024), s.limits.Load().lineLimit())
+	if !scanner.Scan() {
+		return 0, d, nil, nil, fmt.Errorf("no answer: %v", scanner.Err())
+	}
+	header, _ := raft.SplitVersion(strings.Fields(scanner.Text()))
+	if len(header) != 4 || header[0] != "SHARDS" {
+		return 0, d, nil, nil, fmt.Errorf("unexpected answer %q", scanner.Text())
+	}
+	index, err := strconv.Atoi(header[1])
+	if err != nil {
+		return 0, d, nil, nil, fmt.Errorf("bad index %q", header[1])
+	}
+	if d, err = store.ParseDigest(header[2]); err != nil {
+		return 0, d, nil, nil, err
+	}
+	count, err := strconv.Atoi(header[3])
+	if err != nil {
+		return 0, d, nil, nil, fmt.Errorf("bad key count %q", header[3])
+	}
+	data, expires, err := raft.ReadSnapshotData(scanner, count)
+	return index, d, data, expires, err
+}
+
+// handleSyncShards answers a follower's SYNCSHARDS with our digest and the
+// keys of the shards it asked for, both as of Applied().
+func (s *Server) handleSyncShards(w *bufio.Writer, list string, replyTag string) {
+	if s.raft.GetState() != raft.Leader {
+		fmt.Fprintf(w, "ERR not the leader%s\n", replyTag)
+		return
+	}
+	want := make(map[int]bool)
+	if list != "-" {
+		for _, field := range strings.Split(list, ",") {
+			shard, err := strconv.Atoi(field)
+			if err != nil || shard < 0 || shard >= store.DigestShards {
+				fmt.Fprintf(w, "ERR bad shard %q%s\n", field, replyTag)
+				return
+			}
+			want[shard] = true
+		}
+	}
+
+	s.applyMu.Lock() // the store matches the log up to Applied()
+	index := s.Applied()
+	d := s.store.Digest()
+	var snap *store.Snapshot
+	if len(want) > 0 {
+		snap = s.store.Snapshot()
+	}
+	s.applyMu.Unlock()
+
+	var keys []string
+	var values []string
+	if snap != nil {
+		defer snap.Close()
+		snap.Range(func(k, v string) bool {
+			if want[store.DigestShard(k)] {
+				keys = append(keys, k)
+				values = append(values, v)
+			}
+			return true
+		})
+	}
+	fmt.Fprintf(w, "SHARDS %d %s %d%s\n", index, d, len(keys), replyTag)
+	for i, k := range keys {
+		writeKeyLine(w, k, values[i], snap.Expiry(k))
+	}
+}
+
+// writeKeyLine writes a key as INSTALLSNAPSHOT does, for ReadSnapshotData.
+func writeKeyLine(w *bufio.Writer, key, value string, expiry int64) {
+	fmt.Fprintf(w, "%s %s", base64.StdEncoding.EncodeToString([]byte(key)), base64.StdEncoding.EncodeToString([]byte(value)))
+	if expiry != 0 {
+		fmt.Fprintf(w, " %d", expiry)
+	}
+	w.WriteString("\n")
+}
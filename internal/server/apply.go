@@ -0,0 +1,158 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/mathdee/KV-Store/internal/store"
+	"github.com/mathdee/KV-Store/internal/wal"
+)
+
+// Every node applies committed entries from RunApply, the leader its own
+// writes included, and nothing else applies them: the APPENDENTRIES handler
+// only appends and answers, and a write only proposes and waits. Each round
+// takes up to applyBatch entries, applies them in log order under one hold
+// of applyMu, then waits for their WAL group commits together, so catching
+// up pays for one lock and one fsync wait a batch rather than one of each
+// an entry. A write waiting on one of the entries gets its reply then, see
+// write.
+
+const DefaultApplyBatch = 256
+
+// applyResult is what applying an entry came to, for the write waiting on it.
+type applyResult struct {
+	reply   string
+	refused *Error // the command's answer was an error, e.g. NOKEY
+	err     error  // it didn't make it to the store or the disk
+}
+
+// applyWaiters are the writes waiting on their entries, by index. mu is
+// held from proposing an entry to registering its wait, so RunApply can't
+// answer before anyone waits.
+type applyWaiters struct {
+	mu      sync.Mutex
+	byIndex map[int]chan applyResult
+}
+
+// ApplyStats is what /metrics reports about RunApply.
+type ApplyStats struct {
+	Lag      int   `json:"lag"`      // committed entries not applied yet
+	Batches  int64 `json:"batches"`  // rounds that applied anything
+	Entries  int64 `json:"entries"`  // entries those rounds applied
+	MaxBatch int   `json:"maxBatch"` // the most a round takes
+}
+
+// SetApplyBatch sets the most entries RunApply applies in a round,
+// DefaultApplyBatch by default. Call it before RunApply.
+func (s *Server) SetApplyBatch(n int) {
+	s.applyBatch = max(n, 1)
+}
+
+// RunApply applies committed entries as they come, until ctx ends.
+func (s *Server) RunApply(ctx context.Context) {
+	for {
+		for s.applyCommitted() {
+			// a batch went through, more may have committed meanwhile
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.raft.ApplyReady():
+		}
+	}
+}
+
+// applyCommitted applies one batch and reports whether there was one.
+func (s *Server) applyCommitted() bool {
+	ctx, flushed := wal.DeferWaits(context.Background())
+	s.applyMu.RLock() // taken first, so a snapshot installed meanwhile can't be overwritten by older entries
+	start, entries := s.raft.TakeCommitted(s.applyBatch)
+	if len(entries) == 0 {
+		s.applyMu.RUnlock()
+		return false
+	}
+	taken := len(entries)
+	if s.raft.IsWitness() { // a witness keeps terms only, there's nothing to apply
+		s.markApplied(start + taken - 1)
+		entries = nil
+	}
+	results := make([]applyResult, len(entries))
+	for i, entry := range entries {
+		s.waitHold(start + i)
+		ctx := store.WithIndex(ctx, start+i)
+		res := &results[i]
+		if res.reply, res.err = s.applyCommand(ctx, entry.Command); errors.As(res.err, &res.refused) {
+			res.err = nil // the command's answer, nothing failed here
+		} else if res.err != nil {
+			fmt.Printf("Failed to apply %q: %v\n", entry.Command, res.err)
+		}
+		s.cache.noteApplied(start+i, entry.Command)
+		s.markApplied(start + i)
+	}
+	// The marker follows the batch's records, so a restart resumes after them
+	// rather than applying them again. Its wait is deferred with theirs.
+	s.store.MarkApplied(ctx, start+taken-1)
+	s.applyMu.RUnlock()
+	err := flushed()
+	if err != nil {
+		fmt.Printf("Failed to apply entries %d to %d: %v\n", start, start+taken-1, err)
+	}
+	s.answerWaiters(start, results, err)
+	s.applyBatches.Add(1)
+	s.applyEntries.Add(int64(taken))
+	s.sampleDigest()
+	return true
+}
+
+// answerWaiters hands the writes waiting on entries from start on what
+// applying them came to, once their WAL writes are on disk or flushErr
+// says they aren't.
+func (s *Server) answerWaiters(start int, results []applyResult, flushErr error) {
+	w := &s.waiters
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.byIndex) == 0 {
+		return // a follower's, or nobody waits on this batch
+	}
+	for i, res := range results {
+		ch, ok := w.byIndex[start+i]
+		if !ok {
+			continue
+		}
+		delete(w.byIndex, start+i)
+		if res.err == nil && flushErr != nil {
+			res.err = flushErr
+		}
+		ch <- res
+	}
+}
+
+// wait registers a wait for the entry at index to be applied. Callers hold
+// w.mu.
+func (w *applyWaiters) wait(index int) chan applyResult {
+	ch := make(chan applyResult, 1)
+	w.byIndex[index] = ch
+	return ch
+}
+
+// stop drops a wait RunApply hasn't answered, e.g. because the entry never
+// committed.
+func (w *applyWaiters) stop(index int, ch chan applyResult) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.byIndex[index] == ch {
+		delete(w.byIndex, index)
+	}
+}
+
+// ApplyStats reports how far behind the commit index applying is.
+func (s *Server) ApplyStats() ApplyStats {
+	return ApplyStats{
+		Lag:      max(s.raft.GetCommitIndex()-s.Applied(), 0),
+		Batches:  s.applyBatches.Load(),
+		Entries:  s.applyEntries.Load(),
+		MaxBatch: s.applyBatch,
+	}
+}
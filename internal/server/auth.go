@@ -0,0 +1,162 @@
+package server
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mathdee/KV-Store/internal/tracing"
+)
+
+// The HTTP API is open unless tokens are configured. A read token guards
+// every endpoint; an admin token guards the ones that change the node
+// (pause, clear, chaos, benchmarks, ...) and also works for reads. Callers
+// send "Authorization: Bearer <token>", or basic auth with the token as the
+// password and a name of their choosing, which the audit log records.
+
+// AuthOptions hold the tokens. Either may be empty: without an admin token
+// the read token also guards admin endpoints, without any both are open.
+type AuthOptions struct {
+	ReadToken  string
+	AdminToken string
+}
+
+type accessLevel int
+
+const (
+	accessNone accessLevel = iota
+	accessRead
+	accessAdmin
+)
+
+// adminEndpoints need the admin token, keyed by the pattern they are
+// registered under. Every other endpoint is a read.
+var adminEndpoints = map[string]bool{
+	"/pause": true, "/resume": true, "/clear": true, "/metrics/reset": true, "/slowlog/reset": true,
+	"POST /config/reload": true, "/benchmark": true, "/benchmark/cluster": true,
+	"/chaos/fault": true, "/chaos/partition": true, "/chaos/seed": true, "/chaos/heal": true, "/chaos/failpoints": true,
+	"POST /snapshot": true, "POST /compact": true, "POST /resync": true, "/audit": true, "POST /kv/batch": true, "PUT /kv/{key}": true,
+	"/hotkeys": true, "/hotkeys/reset": true, "GET /crashes": true,
+}
+
+// SetAuth replaces the tokens, for requests from then on.
+func (h *HTTPServer) SetAuth(o AuthOptions) {
+	h.authOptions.Store(&o)
+}
+
+// required is the access an endpoint needs under o.
+func (o AuthOptions) required(endpoint accessLevel) accessLevel {
+	if endpoint == accessAdmin && o.AdminToken != "" {
+		return accessAdmin
+	}
+	if o.ReadToken != "" {
+		return accessRead
+	}
+	return accessNone
+}
+
+// granted is the access a presented token gives.
+func (o AuthOptions) granted(token string) accessLevel {
+	switch {
+	case token == "":
+		return accessNone
+	case o.AdminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(o.AdminToken)) == 1:
+		return accessAdmin
+	case o.ReadToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(o.ReadToken)) == 1:
+		return accessRead
+	}
+	return accessNone
+}
+
+// credentials returns the token r carries and who to record as its sender.
+func credentials(r *http.Request) (token, actor string) {
+	if user, pass, ok := r.BasicAuth(); ok {
+		return pass, user
+	}
+	if t, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(t), "bearer"
+	}
+	return "", "anonymous"
+}
+
+// auth checks each request against the endpoint mux would route it to and
+// records admin requests, allowed or not, in the audit log.
+func (h *HTTPServer) auth(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		o := *h.authOptions.Load()
+		_, pattern := mux.Handler(r)
+		endpoint := accessRead
+		if adminEndpoints[pattern] {
+			endpoint = accessAdmin
+		}
+		token, actor := credentials(r)
+		need, have := o.required(endpoint), o.granted(token)
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		switch {
+		case have >= need:
+			next.ServeHTTP(rec, r)
+		case have == accessNone:
+			w.Header().Set("WWW-Authenticate", `Bearer realm="kv-store"`)
+			http.Error(rec, "missing or invalid token", http.StatusUnauthorized)
+		default:
+			http.Error(rec, "this endpoint needs the admin token", http.StatusForbidden)
+		}
+		if endpoint == accessAdmin {
+			h.audit.record(AuditEntry{
+				Time:   start.UTC().Format(time.RFC3339Nano),
+				ID:     tracing.RequestID(r.Context()),
+				Actor:  actor,
+				Client: r.RemoteAddr,
+				Action: r.Method + " " + r.URL.RequestURI(),
+				Status: rec.status,
+			}, h.raft.ID)
+		}
+	})
+}
+
+// AuditEntry is one admin request as GET /audit reports it.
+type AuditEntry struct {
+	Time   string `json:"time"`
+	ID     string `json:"id"` // request ID, as in the access log
+	Actor  string `json:"actor"`
+	Client string `json:"client"`
+	Action string `json:"action"` // method, path and query
+	Status int    `json:"status"` // 401 and 403 for refused requests
+}
+
+// auditLog keeps the latest admin requests and prints each one as it happens.
+type auditLog struct {
+	mu      sync.Mutex
+	entries []AuditEntry
+	max     int
+}
+
+func newAuditLog(max int) *auditLog {
+	return &auditLog{max: max}
+}
+
+func (l *auditLog) record(e AuditEntry, node string) {
+	fmt.Printf("[%s] AUDIT %s by %s from %s: %d req=%s\n", node, e.Action, e.Actor, e.Client, e.Status, e.ID)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.entries) == l.max {
+		l.entries = append(l.entries[:0], l.entries[1:]...)
+	}
+	l.entries = append(l.entries, e)
+}
+
+// list returns the entries newest first.
+func (l *auditLog) list() []AuditEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := make([]AuditEntry, len(l.entries))
+	for i, e := range l.entries {
+		out[len(out)-1-i] = e
+	}
+	return out
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+)
+
+func bearer(token string) func(*http.Request) {
+	return func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) }
+}
+
+func TestAuthChecksTokensPerEndpoint(t *testing.T) {
+	h := testHTTP()
+	h.SetAuth(AuthOptions{ReadToken: "reader", AdminToken: "admin"})
+	api := h.Handler()
+
+	cases := []struct {
+		name, method, path string
+		prepare            func(*http.Request)
+		want               int
+	}{
+		{"read without a token", "GET", "/cluster", nil, http.StatusUnauthorized},
+		{"read with a bad token", "GET", "/cluster", bearer("guess"), http.StatusUnauthorized},
+		{"read with the read token", "GET", "/cluster", bearer("reader"), http.StatusOK},
+		{"read with the admin token", "GET", "/cluster", bearer("admin"), http.StatusOK},
+		{"admin without a token", "GET", "/audit", nil, http.StatusUnauthorized},
+		{"admin with a bad token", "GET", "/audit", bearer("guess"), http.StatusUnauthorized},
+		{"admin with the read token", "GET", "/audit", bearer("reader"), http.StatusForbidden},
+		{"admin with the admin token", "GET", "/audit", bearer("admin"), http.StatusOK},
+		{"admin with basic auth", "GET", "/audit", func(r *http.Request) { r.SetBasicAuth("ops", "admin") }, http.StatusOK},
+	}
+	for _, tc := range cases {
+		w := serveHTTP(api, tc.method, tc.path, tc.prepare)
+		if w.Code != tc.want {
+			t.Errorf("%s: expected %d, got %d", tc.name, tc.want, w.Code)
+		}
+		if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: expected a WWW-Authenticate challenge with the 401", tc.name)
+		}
+	}
+}
+
+func TestAuthFallsBackToTheReadToken(t *testing.T) {
+	h := testHTTP()
+	api := h.Handler()
+	if w := serveHTTP(api, "GET", "/audit", nil); w.Code != http.StatusOK {
+		t.Fatalf("expected the API open without tokens, got %d", w.Code)
+	}
+
+	// Without an admin token the read token guards admin endpoints too.
+	h.SetAuth(AuthOptions{ReadToken: "reader"})
+	if w := serveHTTP(api, "GET", "/audit", nil); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected a token needed once set, got %d", w.Code)
+	}
+	if w := serveHTTP(api, "GET", "/audit", bearer("reader")); w.Code != http.StatusOK {
+		t.Fatalf("expected the read token to open admin endpoints, got %d", w.Code)
+	}
+}
+
+func TestAuthAuditsAdminRequests(t *testing.T) {
+	h := testHTTP()
+	h.SetAuth(AuthOptions{ReadToken: "reader", AdminToken: "admin"})
+	api := h.Handler()
+	serveHTTP(api, "GET", "/cluster", bearer("reader")) // a read, not audited
+	serveHTTP(api, "GET", "/audit?from=anonymous", nil)
+	serveHTTP(api, "GET", "/audit", bearer("reader"))
+	serveHTTP(api, "GET", "/audit", func(r *http.Request) { r.SetBasicAuth("ops", "admin") })
+
+	got := h.audit.list()
+	want := []struct {
+		actor, action string
+		status        int
+	}{
+		{"ops", "GET /audit", http.StatusOK},
+		{"bearer", "GET /audit", http.StatusForbidden},
+		{"anonymous", "GET /audit?from=anonymous", http.StatusUnauthorized},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d audit entries, got %+v", len(want), got)
+	}
+	for i, w := range want {
+		if e := got[i]; e.Actor != w.actor || e.Action != w.action || e.Status != w.status || e.Client == "" {
+			t.Errorf("entry %d: expected %s %s %d, got %+v", i, w.actor, w.action, w.status, e)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mathdee/KV-Store/internal/store"
+)
+
+// POST /kv/batch writes several keys in one request, in order. The ops
+// travel through the log as a BATCH command holding them as JSON, which
+// keeps values byte for byte, and are applied by store.Batch under one lock
+// and one WAL record. An atomic batch is a single entry: every node applies
+// all of it or none, and no reader sees half. Otherwise each op is an entry
+// of its own and gets its own result, so some may fail where others
+// succeed.
+//
+// A put with a ttl expires that long after the leader proposes it: the
+// entry records the absolute time, so every node agrees on it, and a later
+// write without a ttl makes the key permanent again (see store/ttl.go).
+
+const maxBatchOps = 1000
+
+// BatchOp is one write of a batch.
+type BatchOp struct {
+	Op        string `json:"op"` // "put" or "delete"; log entries also hold "expire" (expire.go) and "fill" (cache.go)
+	Key       string `json:"key"`
+	Value     string `json:"value,omitempty"`     // puts only
+	TTL       string `json:"ttl,omitempty"`       // puts only: e.g. "30s", the key expires that long after the write
+	ExpiresAt int64  `json:"expiresAt,omitempty"` // unix ms, what the log holds instead of TTL
+}
+
+// BatchRequest is what POST /kv/batch takes.
+type BatchRequest struct {
+	Ops    []BatchOp `json:"ops"`
+	Atomic bool      `json:"atomic"`
+}
+
+// BatchResult is the outcome of one op.
+type BatchResult struct {
+	Op        string `json:"op"`
+	Key       string `json:"key"`
+	OK        bool   `json:"ok"`
+	Existed   bool   `json:"existed"`             // the key had a value just before the op
+	Revision  int    `json:"revision"`            // the entry that holds the op, -1 unless it committed
+	ExpiresAt string `json:"expiresAt,omitempty"` // puts with a ttl
+	Error     string `json:"error,omitempty"`
+}
+
+// BatchResponse is what POST /kv/batch returns.
+type BatchResponse struct {
+	Atomic   bool          `json:"atomic"`
+	Revision int           `json:"revision"` // the last entry that committed, -1 if none did
+	Results  []BatchResult `json:"results"`
+}
+
+// BatchFunc applies a batch, returning an error only when the batch is
+// refused as a whole.
+type BatchFunc func(context.Context, BatchRequest) (BatchResponse, *Error)
+
+// SetBatch enables POST /kv/batch, usually with Server.Batch.
+func (h *HTTPServer) SetBatch(batch BatchFunc) {
+	h.batch = batch
+}
+
+// checkBatch rejects batches that break the limits or that followers
+// couldn't apply. Keys follow the TCP protocol's rules, so every batch-
+// written key can be read and written there too.
+func (s *Server) checkBatch(ops []BatchOp) *Error {
+	if len(ops) == 0 {
+		return newError(CodeSyntax, "no ops")
+	}
+	if len(ops) > maxBatchOps {
+		return newError(CodeTooLarge, "too many ops (max=%d)", maxBatchOps)
+	}
+	limits := s.Limits()
+	for i, op := range ops {
+		switch {
+		case op.Op != "put" && op.Op != "delete":
+			return newError(CodeSyntax, "op %d: unknown op %q, want put or delete", i, op.Op)
+		case op.Key == "" || strings.ContainsAny(op.Key, " \t\r\n"):
+			return newError(CodeSyntax, "op %d: keys must be non-empty and contain no whitespace", i)
+		case strings.ContainsAny(op.Value, "\r\n"):
+			return newError(CodeSyntax, "op %d: values can't contain line breaks", i)
+		case len(op.Key) > limits.MaxKeyLen:
+			return newError(CodeTooLarge, "op %d: key too large (max=%d)", i, limits.MaxKeyLen)
+		case len(op.Value) > limits.MaxValueSize:
+			return newError(CodeTooLarge, "op %d: value too large (max=%d)", i, limits.MaxValueSize)
+		case op.ExpiresAt != 0:
+			return newError(CodeSyntax, "op %d: give a ttl, not expiresAt", i)
+		case op.TTL != "" && op.Op != "put":
+			return newError(CodeSyntax, "op %d: only puts take a ttl", i)
+		}
+		if op.TTL != "" {
+			if _, err := parseTTL(op.TTL); err != nil {
+				return newError(CodeSyntax, "op %d: %v", i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// parseTTL reads a ttl such as "30s" or "250ms".
+func parseTTL(raw string) (time.Duration, error) {
+	d, err := time.ParseDuration(raw)
+	if err != nil || d < time.Millisecond {
+		return 0, fmt.Errorf("invalid ttl %q, want a duration of at least 1ms such as 30s", raw)
+	}
+	return d, nil
+}
+
+// batchCommand is the log entry for ops. Followers read entries a line at a
+// time, so it can't be longer than a command line.
+func (s *Server) batchCommand(ops []BatchOp) (string, *Error) {
+	data, err := json.Marshal(ops)
+	if err != nil {
+		return "", newError(CodeSyntax, "%v", err)
+	}
+	command := "BATCH " + string(data)
+	if limit := s.Limits().lineLimit(); len(command) > limit {
+		return "", newError(CodeTooLarge, "batch too large (max=%d bytes encoded), split it up", limit)
+	}
+	return command, nil
+}
+
+// decodeBatch turns a BATCH entry back into store ops.
+func decodeBatch(command string) ([]store.BatchOp, error) {
+	var ops []BatchOp
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(command, "BATCH ")), &ops); err != nil {
+		return nil, fmt.Errorf("malformed BATCH: %v", err)
+	}
+	out := make([]store.BatchOp, len(ops))
+	for i, op := range ops {
+		out[i] = store.BatchOp{Delete: op.Op == "delete" || op.Op == "expire", Key: op.Key, Value: op.Value, ExpiresAt: op.ExpiresAt, IfAbsent: op.Op == "fill"}
+	}
+	return out, nil
+}
+
+// Batch applies req through raft, see POST /kv/batch. The error is for a
+// batch that was refused as a whole; an atomic batch that fails to commit
+// is one.
+func (s *Server) Batch(ctx context.Context, req BatchRequest) (BatchResponse, *Error) {
+	if err := s.checkBatch(req.Ops); err != nil {
+		return BatchResponse{}, err
+	}
+	quota := newQuotaDelta(s.store)
+	quota.addBatch(req.Ops)
+	if err := s.checkQuota(quota); err != nil {
+		return BatchResponse{}, err // whole batches, so a tenant never gets half of one in
+	}
+	if err := s.disk.refuse(); err != nil {
+		return BatchResponse{}, err // rather than a READONLY for every op
+	}
+	for _, op := range req.Ops {
+		s.hotkeys.Observe(op.Key, true)
+	}
+	res := BatchResponse{Atomic: req.Atomic, Revision: -1, Results: make([]BatchResult, len(req.Ops))}
+	ops := make([]BatchOp, len(req.Ops))
+	now := s.clock.Now()
+	for i, op := range req.Ops {
+		res.Results[i] = BatchResult{Op: op.Op, Key: op.Key, Revision: -1}
+		if op.TTL != "" {
+			ttl, _ := parseTTL(op.TTL)
+			op.TTL, op.ExpiresAt = "", now.Add(ttl).UnixMilli()
+			res.Results[i].ExpiresAt = time.UnixMilli(op.ExpiresAt).UTC().Format(time.RFC3339Nano)
+		}
+		ops[i] = op
+	}
+
+	groups := [][]BatchOp{ops}
+	if !req.Atomic {
+		groups = make([][]BatchOp, len(ops))
+		for i := range ops {
+			groups[i] = ops[i : i+1]
+		}
+	}
+	token, idempotent := idempotencyToken(ctx)
+	next := 0 // first result of the current group
+	for i, ops := range groups {
+		results := res.Results[next : next+len(ops)]
+		next += len(ops)
+		command, err := s.batchCommand(ops)
+		if err != nil {
+			return BatchResponse{}, err
+		}
+		start := time.Now()
+		wctx, cancel := context.WithTimeout(ctx, s.RequestTimeout())
+		if idempotent && !req.Atomic {
+			wctx = withIdempotencyToken(wctx, token+"/"+strconv.Itoa(i)) // one per op, each is an entry of its own
+		}
+		reply, index, _, err := s.write(wctx, command)
+		cancel()
+		if err != nil {
+			if req.Atomic {
+				return BatchResponse{}, err
+			}
+			results[0].Error, results[0].ExpiresAt = err.Error(), ""
+			continue
+		}
+		s.metrics.RecordSuccess(time.Since(start))
+		res.Revision = index
+		for i := range results {
+			results[i].OK, results[i].Existed, results[i].Revision = true, i < len(reply) && reply[i] == '1', index
+		}
+	}
+	return res, nil
+}
+
+// existedReply is a BATCH entry's reply: one 1 or 0 per op.
+func existedReply(existed []bool) string {
+	b := make([]byte, len(existed))
+	for i, e := range existed {
+		b[i] = '0'
+		if e {
+			b[i] = '1'
+		}
+	}
+	return string(b)
+}
+
+// httpStatus is the status code an error reply maps to over HTTP.
+func httpStatus(e *Error) int {
+	switch e.Code {
+	case CodeSyntax:
+		return http.StatusBadRequest
+	case CodeTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case CodeTimeout:
+		return http.StatusGatewayTimeout
+	case CodeQuota, CodeReadOnly:
+		return http.StatusInsufficientStorage
+	case CodeRateLimit:
+		return http.StatusTooManyRequests
+	case CodeNotLeader, CodeNotCommitted, CodeWitness:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
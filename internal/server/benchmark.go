@@ -0,0 +1,478 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mathdee/KV-Store/internal/tracing"
+)
+
+type BenchmarkResult struct {
+	TotalRequests int64   `json:"totalRequests"`
+	Successful    int64   `json:"successful"`
+	Failed        int64   `json:"failed"`
+	Reads         int64   `json:"reads"`
+	Writes        int64   `json:"writes"`
+	DurationMs    float64 `json:"durationMs"`
+	Throughput    float64 `json:"throughput"`
+	LatencyAvgMs  float64 `json:"latencyAvgMs"`
+	LatencyP50Ms  float64 `json:"latencyP50Ms"`
+	LatencyP95Ms  float64 `json:"latencyP95Ms"`
+	LatencyP99Ms  float64 `json:"latencyP99Ms"`
+	WarmupMs      float64 `json:"warmupMs"`
+	WALMode       string  `json:"walMode,omitempty"` // sync or async, runs in different modes show the fsync cost
+
+	Histogram []HistogramBucket `json:"histogram"` // per-bucket (not cumulative) counts
+}
+
+// BenchmarkOptions describes the workload, read from the /benchmark query string.
+type BenchmarkOptions struct {
+	Requests     int           `json:"requests"`
+	Concurrency  int           `json:"concurrency"`
+	ReadPercent  int           `json:"readPercent"`  // share of operations that are GETs (0-100)
+	ValueSize    int           `json:"valueSize"`    // bytes per value, 0 keeps the short "value_<w>_<i>" values
+	KeySpace     int           `json:"keySpace"`     // number of distinct keys, 0 means every write uses a new key
+	Distribution string        `json:"distribution"` // "uniform" or "zipfian", only used when KeySpace > 0
+	Mode         string        `json:"mode"`         // "direct" (in-process) or "network" (real client protocol)
+	Target       string        `json:"target"`       // network mode: "local" (this node) or "cluster" (all nodes)
+	Warmup       time.Duration `json:"warmupNs"`     // run the workload this long before measuring
+}
+
+func parseBenchmarkOptions(r *http.Request) (BenchmarkOptions, error) {
+	q := r.URL.Query()
+	opts := BenchmarkOptions{Distribution: "uniform", Mode: "direct", Target: "local"}
+
+	ints := []struct {
+		name string
+		dst  *int
+	}{
+		{"requests", &opts.Requests},
+		{"concurrency", &opts.Concurrency},
+		{"readPercent", &opts.ReadPercent},
+		{"valueSize", &opts.ValueSize},
+		{"keySpace", &opts.KeySpace},
+	}
+	for _, p := range ints {
+		raw := q.Get(p.name)
+		if raw == "" {
+			continue
+		}
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			return opts, fmt.Errorf("invalid %s: %q", p.name, raw)
+		}
+		*p.dst = n
+	}
+	if opts.Requests <= 0 {
+		opts.Requests = 10000
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 100
+	}
+	if opts.ReadPercent > 100 {
+		return opts, fmt.Errorf("invalid readPercent: %d (must be 0-100)", opts.ReadPercent)
+	}
+	if d := q.Get("distribution"); d != "" {
+		if d != "uniform" && d != "zipfian" {
+			return opts, fmt.Errorf("invalid distribution: %q (uniform or zipfian)", d)
+		}
+		opts.Distribution = d
+	}
+	if wu := q.Get("warmup"); wu != "" {
+		d, err := time.ParseDuration(wu)
+		if err != nil || d < 0 {
+			return opts, fmt.Errorf("invalid warmup: %q (e.g. 2s)", wu)
+		}
+		opts.Warmup = d
+	}
+	if m := q.Get("mode"); m != "" {
+		if m != "direct" && m != "network" {
+			return opts, fmt.Errorf("invalid mode: %q (direct or network)", m)
+		}
+		opts.Mode = m
+	}
+	if t := q.Get("target"); t != "" {
+		if t != "local" && t != "cluster" {
+			return opts, fmt.Errorf("invalid target: %q (local or cluster)", t)
+		}
+		opts.Target = t
+	}
+	return opts, nil
+}
+
+// keyChooser picks the key for each operation of one worker.
+type keyChooser struct {
+	opts     BenchmarkOptions
+	workerID int
+	rng      *rand.Rand
+	zipf     *rand.Zipf
+	written  int // unique-key mode: how many keys this worker has written
+}
+
+func newKeyChooser(opts BenchmarkOptions, workerID int) *keyChooser {
+	kc := &keyChooser{
+		opts:     opts,
+		workerID: workerID,
+		rng:      rand.New(rand.NewSource(time.Now().UnixNano() + int64(workerID))),
+	}
+	if opts.KeySpace > 1 && opts.Distribution == "zipfian" {
+		kc.zipf = rand.NewZipf(kc.rng, 1.1, 1, uint64(opts.KeySpace-1))
+	}
+	return kc
+}
+
+func (kc *keyChooser) next(read bool) string {
+	if kc.opts.KeySpace == 0 {
+		if read && kc.written > 0 {
+			return fmt.Sprintf("bench_%d_%d", kc.workerID, kc.rng.Intn(kc.written))
+		}
+		key := fmt.Sprintf("bench_%d_%d", kc.workerID, kc.written)
+		kc.written++
+		return key
+	}
+	if kc.zipf != nil {
+		return fmt.Sprintf("bench_%d", kc.zipf.Uint64())
+	}
+	return fmt.Sprintf("bench_%d", kc.rng.Intn(kc.opts.KeySpace))
+}
+
+func (kc *keyChooser) isRead() bool {
+	if kc.opts.ReadPercent == 0 || (kc.opts.KeySpace == 0 && kc.written == 0) {
+		return false // nothing to read yet
+	}
+	return kc.rng.Intn(100) < kc.opts.ReadPercent
+}
+
+// benchWorker runs the operations of one benchmark goroutine.
+type benchWorker interface {
+	op(i int) (read bool, err error)
+	close()
+}
+
+// runWorkload drives concurrency workers through the warmup and the measured
+// phase. stillValid is polled every 100 ops; once it reports false the
+// remaining ops are counted as failed.
+func runWorkload(opts BenchmarkOptions, newWorker func(workerID int) benchWorker, stillValid func() bool) BenchmarkResult {
+	var wg sync.WaitGroup
+	var successCount int64
+	var failCount int64
+	var readCount int64
+	var writeCount int64
+	var latencies []time.Duration
+	var latencyMu sync.Mutex
+	var stopped int32 // Atomic flag to stop workers
+
+	requestsPerWorker := opts.Requests / opts.Concurrency
+	warmupUntil := time.Now().Add(opts.Warmup) // ops before this aren't recorded
+	start := warmupUntil
+
+	for w := 0; w < opts.Concurrency; w++ {
+		wg.Add(1)
+		go func(workerID int) {
+			defer wg.Done()
+			worker := newWorker(workerID)
+			defer worker.close()
+
+			// Warmup: same operations, results thrown away.
+			warm := 0
+			for ; time.Now().Before(warmupUntil); warm++ {
+				if warm%100 == 0 && !stillValid() {
+					break
+				}
+				worker.op(warm)
+			}
+
+			for i := 0; i < requestsPerWorker; i++ {
+				// Check if we should stop (no longer leader or paused)
+				if atomic.LoadInt32(&stopped) == 1 {
+					atomic.AddInt64(&failCount, int64(requestsPerWorker-i))
+					return
+				}
+
+				// Periodically check the workload can still run (every 100 ops)
+				if i%100 == 0 && !stillValid() {
+					atomic.StoreInt32(&stopped, 1)
+					atomic.AddInt64(&failCount, int64(requestsPerWorker-i))
+					return
+				}
+
+				opStart := time.Now()
+				read, err := worker.op(warm + i)
+				latency := time.Since(opStart)
+
+				if err != nil {
+					atomic.AddInt64(&failCount, 1)
+					continue
+				}
+				if read {
+					atomic.AddInt64(&readCount, 1)
+				} else {
+					atomic.AddInt64(&writeCount, 1)
+				}
+				atomic.AddInt64(&successCount, 1)
+				latencyMu.Lock()
+				latencies = append(latencies, latency)
+				latencyMu.Unlock()
+			}
+		}(w)
+	}
+
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	// Build result with whatever we completed
+	result := BenchmarkResult{
+		TotalRequests: int64(opts.Requests),
+		Successful:    successCount,
+		Failed:        failCount,
+		Reads:         readCount,
+		Writes:        writeCount,
+		WarmupMs:      float64(opts.Warmup.Milliseconds()),
+		DurationMs:    float64(elapsed.Milliseconds()),
+		Throughput:    float64(successCount) / elapsed.Seconds(),
+	}
+
+	summarizeLatencies(&result, latencies)
+	return result
+}
+
+// benchValue returns the value written by op i of a worker.
+func benchValue(opts BenchmarkOptions, fixed string, workerID, i int) string {
+	if opts.ValueSize > 0 {
+		return fixed
+	}
+	return fmt.Sprintf("value_%d_%d", workerID, i)
+}
+
+// directWorker reads the store and writes through the TCP server's Batch
+// in-process, the raft and apply path PUT /kv takes, with no TCP overhead.
+type directWorker struct {
+	h        *HTTPServer
+	opts     BenchmarkOptions
+	keys     *keyChooser
+	workerID int
+	value    string
+}
+
+func (d *directWorker) op(i int) (bool, error) {
+	read := d.keys.isRead()
+	key := d.keys.next(read)
+	if read {
+		d.h.store.Get(key) // a miss is still a completed read
+		return true, nil
+	}
+	value := benchValue(d.opts, d.value, d.workerID, i)
+	res, err := d.h.batch(context.Background(), BatchRequest{Ops: []BatchOp{{Op: "put", Key: key, Value: value}}})
+	if err != nil {
+		return false, err
+	}
+	if r := res.Results[0]; !r.OK {
+		return false, errors.New(r.Error)
+	}
+	return false, nil
+}
+
+func (d *directWorker) close() {}
+
+func (h *HTTPServer) runDirectBenchmark(ctx context.Context, opts BenchmarkOptions) BenchmarkResult {
+	_, span := tracing.Start(ctx, "benchmark.direct")
+	defer span.End()
+
+	// Must be leader to run benchmark, unless it only reads
+	needsLeader := opts.ReadPercent < 100
+	if needsLeader && (h.batch == nil || h.raft.GetState() != "Leader") {
+		return BenchmarkResult{
+			TotalRequests: int64(opts.Requests),
+			Failed:        int64(opts.Requests),
+			Histogram:     newHistogram(nil),
+		}
+	}
+
+	fixedValue := strings.Repeat("x", opts.ValueSize)
+	return runWorkload(opts, func(workerID int) benchWorker {
+		return &directWorker{h: h, opts: opts, keys: newKeyChooser(opts, workerID), workerID: workerID, value: fixedValue}
+	}, func() bool {
+		return !needsLeader || (!h.raft.IsPaused() && h.raft.GetState() == "Leader")
+	})
+}
+
+// summarizeLatencies fills in the latency fields from the successful ops.
+func summarizeLatencies(result *BenchmarkResult, latencies []time.Duration) {
+	result.Histogram = newHistogram(latencies)
+	if len(latencies) == 0 {
+		return
+	}
+	sort.Slice(latencies, func(i, j int) bool {
+		return latencies[i] < latencies[j]
+	})
+
+	var total time.Duration
+	for _, l := range latencies {
+		total += l
+	}
+	result.LatencyAvgMs = float64(total.Microseconds()) / float64(len(latencies)) / 1000.0
+	result.LatencyP50Ms = float64(latencies[len(latencies)*50/100].Microseconds()) / 1000.0
+	result.LatencyP95Ms = float64(latencies[len(latencies)*95/100].Microseconds()) / 1000.0
+	p99Idx := len(latencies) * 99 / 100
+	if p99Idx >= len(latencies) {
+		p99Idx = len(latencies) - 1
+	}
+	result.LatencyP99Ms = float64(latencies[p99Idx].Microseconds()) / 1000.0
+}
+
+// histogramBoundsMs are the upper bounds of the latency buckets; anything
+// slower lands in a final "+Inf" bucket.
+var histogramBoundsMs = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 25, 50, 100, 250, 500, 1000}
+
+// HistogramBucket counts ops with latency <= Le (and above the previous bucket).
+type HistogramBucket struct {
+	Le    string `json:"le"` // upper bound in ms, "+Inf" for the last bucket
+	Count int64  `json:"count"`
+}
+
+func newHistogram(latencies []time.Duration) []HistogramBucket {
+	buckets := make([]HistogramBucket, len(histogramBoundsMs)+1)
+	for i, b := range histogramBoundsMs {
+		buckets[i].Le = strconv.FormatFloat(b, 'f', -1, 64)
+	}
+	buckets[len(histogramBoundsMs)].Le = "+Inf"
+
+	for _, l := range latencies {
+		ms := float64(l.Microseconds()) / 1000.0
+		idx := sort.SearchFloat64s(histogramBoundsMs, ms) // first bound >= ms
+		buckets[idx].Count++
+	}
+	return buckets
+}
+
+// runNetworkBenchmark drives the real TCP protocol, so each op goes through the
+// same handler, raft and WAL path a client request does, and its latency is
+// whatever the client would see before the OK.
+// With target=cluster, reads are spread over every node and writes follow
+// NOTLEADER replies until they reach the leader.
+func (h *HTTPServer) runNetworkBenchmark(ctx context.Context, opts BenchmarkOptions) BenchmarkResult {
+	_, span := tracing.Start(ctx, "benchmark.network")
+	defer span.End()
+
+	nodes := []string{h.raft.ID}
+	if opts.Target == "cluster" {
+		nodes = append(nodes, h.raft.Peers...)
+	}
+
+	fixedValue := strings.Repeat("x", opts.ValueSize)
+	return runWorkload(opts, func(workerID int) benchWorker {
+		return &networkWorker{
+			opts:     opts,
+			keys:     newKeyChooser(opts, workerID),
+			conns:    newBenchConns(nodes, h.dialNode),
+			workerID: workerID,
+			reader:   workerID % len(nodes), // each worker reads from one node
+			value:    fixedValue,
+		}
+	}, func() bool { return true })
+}
+
+// networkWorker sends commands over its own client connections.
+type networkWorker struct {
+	opts     BenchmarkOptions
+	keys     *keyChooser
+	conns    *benchConns
+	workerID int
+	leader   int // index into nodes we currently send writes to
+	reader   int
+	value    string
+}
+
+func (n *networkWorker) op(i int) (bool, error) {
+	read := n.keys.isRead()
+	key := n.keys.next(read)
+	if read {
+		_, err := n.conns.do(n.reader, "GET "+key)
+		return true, err
+	}
+	var err error
+	n.leader, err = n.conns.set(n.leader, key, benchValue(n.opts, n.value, n.workerID, i))
+	return false, err
+}
+
+func (n *networkWorker) close() { n.conns.close() }
+
+// benchConns holds one lazily dialed client connection per node for a worker.
+type benchConns struct {
+	nodes   []string
+	dial    func(addr string) (net.Conn, error)
+	conns   []net.Conn
+	readers []*bufio.Reader
+}
+
+func newBenchConns(nodes []string, dial func(addr string) (net.Conn, error)) *benchConns {
+	return &benchConns{
+		nodes:   nodes,
+		dial:    dial,
+		conns:   make([]net.Conn, len(nodes)),
+		readers: make([]*bufio.Reader, len(nodes)),
+	}
+}
+
+// do sends one command line to node i and returns the one-line reply.
+func (b *benchConns) do(i int, line string) (string, error) {
+	if b.conns[i] == nil {
+		conn, err := b.dial(b.nodes[i])
+		if err != nil {
+			return "", err
+		}
+		b.conns[i] = conn
+		b.readers[i] = bufio.NewReader(conn)
+	}
+	if _, err := fmt.Fprintln(b.conns[i], line); err != nil {
+		b.drop(i)
+		return "", err
+	}
+	reply, err := b.readers[i].ReadString('\n')
+	if err != nil {
+		b.drop(i)
+		return "", err
+	}
+	return strings.TrimSpace(reply), nil
+}
+
+// set writes through the leader, starting at node i and moving on after
+// NOTLEADER. It returns where the write landed so the next one starts there.
+func (b *benchConns) set(i int, key, value string) (int, error) {
+	for tries := 0; tries < len(b.nodes); tries++ {
+		reply, err := b.do(i, "SET "+key+" "+value)
+		if err == nil && reply == "OK" {
+			return i, nil
+		}
+		if err == nil && reply != "NOTLEADER" {
+			return i, fmt.Errorf("SET failed: %s", reply)
+		}
+		i = (i + 1) % len(b.nodes)
+	}
+	return i, fmt.Errorf("no leader reachable")
+}
+
+func (b *benchConns) drop(i int) {
+	b.conns[i].Close()
+	b.conns[i] = nil
+	b.readers[i] = nil
+}
+
+func (b *benchConns) close() {
+	for i, c := range b.conns {
+		if c != nil {
+			b.drop(i)
+		}
+	}
+}
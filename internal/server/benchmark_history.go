@@ -0,0 +1,138 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Every benchmark run is appended as one JSON line to benchmarks.jsonl in the
+// data directory, so results survive restarts and can be compared later.
+
+const benchmarkHistoryFile = "benchmarks.jsonl"
+
+type BenchmarkRecord struct {
+	ID        int              `json:"id"`
+	Timestamp int64            `json:"timestamp"` // unix milliseconds
+	Kind      string           `json:"kind"`      // "node" or "cluster"
+	Node      string           `json:"node"`
+	Options   BenchmarkOptions `json:"options"`
+	Result    BenchmarkResult  `json:"result"`
+}
+
+type BenchmarkHistory struct {
+	mu   sync.Mutex
+	path string
+}
+
+func NewBenchmarkHistory(path string) *BenchmarkHistory {
+	return &BenchmarkHistory{path: path}
+}
+
+// Append stores a run and returns it with its assigned ID.
+func (b *BenchmarkHistory) Append(kind, node string, opts BenchmarkOptions, result BenchmarkResult) (BenchmarkRecord, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	records, err := b.load()
+	if err != nil {
+		return BenchmarkRecord{}, err
+	}
+	rec := BenchmarkRecord{
+		ID:        len(records) + 1,
+		Timestamp: time.Now().UnixMilli(),
+		Kind:      kind,
+		Node:      node,
+		Options:   opts,
+		Result:    result,
+	}
+
+	f, err := os.OpenFile(b.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return rec, err
+	}
+	defer f.Close()
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return rec, err
+	}
+	_, err = f.Write(append(line, '\n'))
+	return rec, err
+}
+
+// All returns every stored run, oldest first.
+func (b *BenchmarkHistory) All() ([]BenchmarkRecord, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.load()
+}
+
+// Get returns the run with the given ID.
+func (b *BenchmarkHistory) Get(id int) (BenchmarkRecord, error) {
+	records, err := b.All()
+	if err != nil {
+		return BenchmarkRecord{}, err
+	}
+	if id < 1 || id > len(records) {
+		return BenchmarkRecord{}, fmt.Errorf("benchmark %d not found", id)
+	}
+	return records[id-1], nil
+}
+
+func (b *BenchmarkHistory) load() ([]BenchmarkRecord, error) {
+	records := []BenchmarkRecord{}
+	f, err := os.Open(b.path)
+	if os.IsNotExist(err) {
+		return records, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var rec BenchmarkRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			continue // skip a torn last line
+		}
+		records = append(records, rec)
+	}
+	return records, scanner.Err()
+}
+
+// BenchmarkComparison reports how run B moved relative to run A.
+type BenchmarkComparison struct {
+	A BenchmarkRecord `json:"a"`
+	B BenchmarkRecord `json:"b"`
+
+	ThroughputChangePct float64 `json:"throughputChangePct"`
+	LatencyAvgDeltaMs   float64 `json:"latencyAvgDeltaMs"`
+	LatencyP50DeltaMs   float64 `json:"latencyP50DeltaMs"`
+	LatencyP95DeltaMs   float64 `json:"latencyP95DeltaMs"`
+	LatencyP99DeltaMs   float64 `json:"latencyP99DeltaMs"`
+	SameOptions         bool    `json:"sameOptions"` // false means the runs used different workloads
+	SameWALMode         bool    `json:"sameWalMode"` // false means one run acked writes before fsync
+}
+
+func compareBenchmarks(a, b BenchmarkRecord) BenchmarkComparison {
+	c := BenchmarkComparison{
+		A:                 a,
+		B:                 b,
+		LatencyAvgDeltaMs: b.Result.LatencyAvgMs - a.Result.LatencyAvgMs,
+		LatencyP50DeltaMs: b.Result.LatencyP50Ms - a.Result.LatencyP50Ms,
+		LatencyP95DeltaMs: b.Result.LatencyP95Ms - a.Result.LatencyP95Ms,
+		LatencyP99DeltaMs: b.Result.LatencyP99Ms - a.Result.LatencyP99Ms,
+		SameOptions:       a.Kind == b.Kind && a.Options == b.Options,
+		SameWALMode:       a.Result.WALMode == b.Result.WALMode,
+	}
+	if a.Result.Throughput > 0 {
+		c.ThroughputChangePct = (b.Result.Throughput - a.Result.Throughput) / a.Result.Throughput * 100
+	}
+	return c
+}
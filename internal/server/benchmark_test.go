@@ -0,0 +1,38 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/mathdee/KV-Store/internal/store"
+)
+
+func TestDirectBenchmarkWritesThroughTheLog(t *testing.T) {
+	srv, _ := testServer(t)
+	srv.store.(*store.Store).SetHistory(4)
+	h := NewHTTPServer(srv.raft, srv.metrics, srv.store)
+	h.SetBatch(srv.Batch)
+
+	before := srv.raft.GetLogLength()
+	res := h.runDirectBenchmark(context.Background(), BenchmarkOptions{Requests: 20, Concurrency: 2, Distribution: "uniform", Mode: "direct"})
+	if res.Successful != 20 || res.Writes != 20 {
+		t.Fatalf("expected 20 successful writes, got %+v", res)
+	}
+	if got := srv.raft.GetLogLength() - before; got != 20 {
+		t.Errorf("expected an entry per write, got %d", got)
+	}
+	for w := range 2 {
+		for i := range 10 {
+			key := fmt.Sprintf("bench_%d_%d", w, i)
+			if revs := srv.store.History(key); len(revs) != 1 || revs[0].Revision < 0 || revs[0].Value != fmt.Sprintf("value_%d_%d", w, i) {
+				t.Errorf("expected %s written once, by applying its entry, got %+v", key, revs)
+			}
+		}
+	}
+
+	h.SetBatch(nil) // nothing to write through
+	if res := h.runDirectBenchmark(context.Background(), BenchmarkOptions{Requests: 4, Concurrency: 1, Mode: "direct"}); res.Failed != 4 {
+		t.Errorf("expected every write to fail without a write path, got %+v", res)
+	}
+}
@@ -0,0 +1,345 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mathdee/KV-Store/internal/cache"
+	"github.com/mathdee/KV-Store/internal/cdc"
+	"github.com/mathdee/KV-Store/internal/protocol"
+	"github.com/mathdee/KV-Store/internal/raft"
+)
+
+// Cache mode puts the cluster in front of an upstream store, see the cache
+// package. A GET that misses reads the key from upstream, and the leader
+// also writes the value through the log as a fill: a put that only lands if
+// the key is still missing and that expires after the cache ttl, so reads on
+// every node hit until upstream may have changed.
+//
+// Client writes are flushed behind. The leader walks the log from a cursor,
+// writes the current value of every key the entries touched upstream (or
+// deletes it, if it is gone) and then proposes CACHEFLUSHED <index>, which
+// moves the cursor on every node, so a new leader carries on where the old
+// one stopped. A failed flush is retried from the same cursor, which makes
+// upstream see every write at least once. Until a key's write is flushed, a
+// miss on it isn't read from upstream, which still holds what the write
+// replaced. Fills and expiries aren't flushed, and neither are FLUSHALL and
+// FLUSHNS: they only empty the cache.
+
+type CacheOptions struct {
+	TTL           time.Duration // how long a filled key lives before upstream is asked again, 0 for forever
+	FlushInterval time.Duration
+	FlushBatch    int    // most log entries per flush
+	CursorFile    string // where the cursor survives restarts
+}
+
+var DefaultCacheOptions = CacheOptions{TTL: 5 * time.Minute, FlushInterval: time.Second, FlushBatch: 100}
+
+// CacheStatus is what /cache reports.
+type CacheStatus struct {
+	Cursor    int    `json:"cursor"` // last log index whose writes are upstream
+	Applied   int    `json:"applied"`
+	Pending   int    `json:"pending"` // keys written since the cursor
+	Fills     int64  `json:"fills"`   // misses upstream had
+	Misses    int64  `json:"misses"`  // misses upstream didn't have either
+	Flushed   int64  `json:"flushed"` // keys written or deleted upstream
+	Failures  int64  `json:"failures"`
+	LastError string `json:"lastError,omitempty"`
+}
+
+type Cache struct {
+	srv      *Server
+	upstream cache.Upstream
+	opts     CacheOptions
+
+	mu       sync.Mutex
+	cursor   int
+	pending  map[string]int // keys written after the cursor, to the index of their latest write
+	fills    int64
+	misses   int64
+	flushed  int64
+	failures int64
+	lastErr  string
+}
+
+func NewCache(s *Server, u cache.Upstream, opts CacheOptions) (*Cache, error) {
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = DefaultCacheOptions.FlushInterval
+	}
+	if opts.FlushBatch < 1 {
+		opts.FlushBatch = DefaultCacheOptions.FlushBatch
+	}
+	cursor, err := cdc.LoadCursor(opts.CursorFile)
+	if err != nil {
+		return nil, err
+	}
+	return &Cache{srv: s, upstream: u, opts: opts, cursor: cursor, pending: map[string]int{}}, nil
+}
+
+// SetCache turns on cache mode: GET misses are read through c and writes
+// are noted for c's flusher.
+func (s *Server) SetCache(c *Cache) {
+	s.cache = c
+}
+
+// writtenKeys are the keys an entry writes that upstream has to hear about.
+func (s *Server) writtenKeys(command string) []string {
+	parts, err := protocol.Parse(command)
+	if err != nil {
+		return nil
+	}
+	if parts[0] == "IDEM" {
+		return s.writtenKeys(innerCommand(command))
+	}
+	if parts[0] == "BATCH" {
+		ops, _ := decodeBatch(command)
+		var keys []string
+		for _, op := range ops {
+			if !op.IfAbsent && !(op.Delete && op.ExpiresAt != 0) { // not a fill or an expire
+				keys = append(keys, op.Key)
+			}
+		}
+		return keys
+	}
+	if (parts[0] == "ACQUIRE" || parts[0] == "RELEASE") && len(parts) > 1 {
+		return []string{lockKey(parts[1])}
+	}
+	c, ok := s.commands[parts[0]]
+	if !ok || c.kind != writeCommand {
+		return nil
+	}
+	var keys []string
+	for _, i := range c.keyArgs(parts) {
+		if i < len(parts) {
+			keys = append(keys, parts[i])
+		}
+	}
+	return keys
+}
+
+// noteApplied records the keys the entry at index wrote as not yet
+// upstream. Callers hold applyMu, so the flusher sees the note and the write
+// together.
+func (c *Cache) noteApplied(index int, command string) {
+	if c == nil {
+		return
+	}
+	keys := c.srv.writtenKeys(command)
+	if len(keys) == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, k := range keys {
+		c.pending[k] = index
+	}
+}
+
+// markFlushed moves the cursor to through, the index a CACHEFLUSHED entry
+// names.
+func (c *Cache) markFlushed(through int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if through <= c.cursor {
+		return
+	}
+	c.cursor = through
+	for k, index := range c.pending {
+		if index <= through {
+			delete(c.pending, k)
+		}
+	}
+	if err := cdc.SaveCursor(c.opts.CursorFile, c.cursor); err != nil {
+		fmt.Printf("[cache] saving cursor: %v\n", err) // a restart flushes some writes again
+	}
+}
+
+// Cursor is the last log index whose writes are upstream; compaction keeps
+// the entries after it.
+func (c *Cache) Cursor() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cursor
+}
+
+func (c *Cache) failed(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failures++
+	c.lastErr = err.Error()
+}
+
+// Fill reads key from upstream after a miss. found is false when upstream
+// doesn't have it either, or when a write to it is still to be flushed.
+func (c *Cache) Fill(ctx context.Context, key string) (value string, found bool, err *Error) {
+	c.mu.Lock()
+	_, dirty := c.pending[key]
+	c.mu.Unlock()
+	if dirty {
+		return "", false, nil // deleted here, upstream just hasn't heard yet
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.srv.RequestTimeout())
+	defer cancel()
+	value, found, uerr := c.upstream.Get(ctx, key)
+	if uerr != nil {
+		c.failed(uerr)
+		return "", false, newError(CodeIO, "upstream: %v", uerr)
+	}
+	c.mu.Lock()
+	if found {
+		c.fills++
+	} else {
+		c.misses++
+	}
+	c.mu.Unlock()
+	if found && c.srv.raft.GetState() == raft.Leader {
+		go c.fill(key, value) // the reader has its value either way
+	}
+	return value, found, nil
+}
+
+// fill writes a value read from upstream into the cache.
+func (c *Cache) fill(key, value string) {
+	if c.srv.checkBatch([]BatchOp{{Op: "put", Key: key, Value: value}}) != nil {
+		return // too big or not a key the log can carry, it stays upstream only
+	}
+	op := BatchOp{Op: "fill", Key: key, Value: value}
+	if c.opts.TTL > 0 {
+		op.ExpiresAt = c.srv.clock.Now().Add(c.opts.TTL).UnixMilli()
+	}
+	command, err := c.srv.batchCommand([]BatchOp{op})
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.srv.RequestTimeout())
+	defer cancel()
+	if _, _, _, err := c.srv.write(ctx, command); err != nil {
+		fmt.Printf("[%s] Filling %s from upstream: %v\n", c.srv.raft.ID, key, err)
+	}
+}
+
+// Run flushes writes upstream while this node leads, until ctx ends.
+func (c *Cache) Run(ctx context.Context) {
+	c.recoverPending()
+	backoff := c.opts.FlushInterval
+	for {
+		wait := c.opts.FlushInterval
+		if c.srv.raft.GetState() == raft.Leader && !c.srv.raft.IsPaused() {
+			n, err := c.flush(ctx)
+			if err != nil {
+				c.failed(err)
+				fmt.Printf("[cache] flush failed, retrying in %v: %v\n", backoff, err)
+				wait = backoff
+				backoff = min(2*backoff, 5*time.Second)
+			} else {
+				backoff = c.opts.FlushInterval
+				if n == c.opts.FlushBatch {
+					wait = 0 // more may be waiting, go again right away
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// recoverPending notes the writes after the cursor that a restart forgot.
+func (c *Cache) recoverPending() {
+	from := c.Cursor() + 1
+	for i, e := range c.srv.raft.EntriesFrom(from, c.srv.raft.GetLogLength()-from) {
+		c.noteApplied(from+i, e.Command)
+	}
+}
+
+// flush writes the keys of up to FlushBatch applied entries after the
+// cursor upstream and proposes the cursor past them. It returns how many
+// entries it covered.
+func (c *Cache) flush(ctx context.Context) (int, error) {
+	from := c.Cursor() + 1
+	if first := c.srv.raft.FirstIndex(); from < first {
+		// Only a node that installed a snapshot gets here, the leader's
+		// compaction waits for the cursor.
+		fmt.Printf("[cache] entries %d to %d were compacted away, writes in them may not have reached upstream\n", from, first-1)
+		c.markFlushed(first - 1)
+		from = first
+	}
+
+	// With applyMu held exclusively, as for a snapshot, the store matches
+	// the log up to Applied(), so the values read here are no older than
+	// the entries.
+	c.srv.applyMu.Lock()
+	to := min(c.srv.Applied(), from+c.opts.FlushBatch-1)
+	var entries []raft.LogEntry
+	if to >= from {
+		entries = c.srv.raft.EntriesFrom(from, to-from+1)
+	}
+	var keys []string
+	values := map[string]string{} // missing keys are deleted upstream
+	seen := map[string]bool{}
+	for _, e := range entries {
+		for _, k := range c.srv.writtenKeys(e.Command) {
+			if !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+				if v, err := c.srv.store.Get(k); err == nil {
+					values[k] = v
+				}
+			}
+		}
+	}
+	c.srv.applyMu.Unlock()
+	if len(entries) == 0 {
+		return 0, nil
+	}
+	to = from + len(entries) - 1
+	if len(keys) == 0 {
+		// Fills, expires and earlier CACHEFLUSHED entries. Proposing for
+		// those would only make another entry to skip, so just this node
+		// moves on; the next flush with keys moves everyone.
+		c.markFlushed(to)
+		return len(entries), nil
+	}
+
+	for _, k := range keys {
+		uctx, cancel := context.WithTimeout(ctx, c.srv.RequestTimeout())
+		var err error
+		if v, ok := values[k]; ok {
+			err = c.upstream.Put(uctx, k, v)
+		} else {
+			err = c.upstream.Delete(uctx, k)
+		}
+		cancel()
+		if err != nil {
+			return 0, err
+		}
+	}
+	c.mu.Lock()
+	c.flushed += int64(len(keys))
+	c.lastErr = ""
+	c.mu.Unlock()
+
+	wctx, cancel := context.WithTimeout(ctx, c.srv.RequestTimeout())
+	defer cancel()
+	if _, _, _, err := c.srv.write(wctx, "CACHEFLUSHED "+strconv.Itoa(to)); err != nil {
+		return 0, err // upstream is written again next time, which is harmless
+	}
+	return len(entries), nil
+}
+
+func (c *Cache) Status() CacheStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStatus{Cursor: c.cursor, Applied: c.srv.Applied(), Pending: len(c.pending), Fills: c.fills, Misses: c.misses,
+		Flushed: c.flushed, Failures: c.failures, LastError: c.lastErr}
+}
+
+func (c *Cache) Close() error {
+	return c.upstream.Close()
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// A write runs under a context that ends at the request deadline or when
+// the client hangs up, whichever comes first. The WAL and commit waits give
+// up on it, so a write whose client is gone doesn't hold its goroutine (and
+// the snapshot lock) until the cluster recovers. Giving up doesn't undo
+// anything: the entry is already in the raft log and the WAL queue and may
+// still commit, which is why the client is told the outcome is unknown.
+
+// DefaultRequestTimeout bounds how long a write waits for the WAL and a
+// majority, e.g. while most of the cluster is down.
+const DefaultRequestTimeout = 2 * time.Second
+
+var errCommitTimeout = errors.New("timed out waiting for a majority")
+
+// SetRequestTimeout changes the deadline of each write. Values of 0 or less
+// mean DefaultRequestTimeout.
+func (s *Server) SetRequestTimeout(d time.Duration) {
+	if d <= 0 {
+		d = DefaultRequestTimeout
+	}
+	s.requestTimeout.Store(int64(d))
+}
+
+// RequestTimeout returns the deadline of each write.
+func (s *Server) RequestTimeout() time.Duration {
+	return time.Duration(s.requestTimeout.Load())
+}
+
+// commandContext gives a write its deadline and, on a client connection,
+// cancels it if the client hangs up. stop must be called before the
+// connection is read again.
+func (s *Server) commandContext(ctx context.Context, conn net.Conn) (context.Context, func()) {
+	ctx, cancel := context.WithTimeout(ctx, s.RequestTimeout())
+	cc, ok := conn.(*clientConn)
+	if !ok {
+		return ctx, cancel
+	}
+	stopWatch := cc.watch(cancel)
+	return ctx, func() {
+		stopWatch()
+		cancel()
+	}
+}
+
+// A clientConn notices the client hanging up while a command runs: the
+// command loop never reads while it waits on a write, so a watcher
+// goroutine reads ahead in the meantime, the same trick net/http uses to
+// cancel a request's context. What it reads goes in c.ahead for the next
+// Read.
+
+func (c *clientConn) Read(p []byte) (int, error) {
+	if len(c.ahead) > 0 {
+		n := copy(p, c.ahead)
+		c.ahead = c.ahead[n:]
+		c.bytesIn.Add(int64(n))
+		return n, nil
+	}
+	if c.err != nil {
+		err := c.err
+		c.err = nil
+		return 0, err
+	}
+	n, err := c.Conn.Read(p)
+	c.bytesIn.Add(int64(n))
+	return n, err
+}
+
+// watch reads until the client sends something (a pipelined command, kept
+// for the next Read) or the connection fails, which calls hangup. The
+// returned stop ends the read and waits for the goroutine to be done with c.
+func (c *clientConn) watch(hangup func()) (stop func()) {
+	if len(c.ahead) > 0 || c.err != nil {
+		return func() {} // already have the client's next bytes
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, 512)
+		n, err := c.Conn.Read(buf)
+		c.ahead = buf[:n]
+		if err == nil {
+			return
+		}
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return // stop interrupted us, the client is still there
+		}
+		c.err = err
+		hangup()
+	}()
+	return func() {
+		c.Conn.SetReadDeadline(time.Now()) // wakes the read above
+		<-done
+		c.Conn.SetReadDeadline(time.Time{})
+	}
+}
@@ -0,0 +1,213 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Every open connection, clients and peers alike, is tracked so CLIENT LIST
+// and /clients can show which one is stuck or hammering the node, and
+// CLIENT KILL can close it.
+
+// ClientInfo is one connection as CLIENT LIST and /clients report it.
+type ClientInfo struct {
+	ID          int64  `json:"id"`
+	Addr        string `json:"addr"`
+	Kind        string `json:"kind"` // client, peer (sends raft messages) or monitor
+	Protocol    int    `json:"protocol"`
+	AgeSeconds  int64  `json:"ageSeconds"`
+	IdleSeconds int64  `json:"idleSeconds"` // since the last command started
+	LastCommand string `json:"lastCommand"` // name only, arguments may be large or sensitive
+	Commands    int64  `json:"commands"`    // handled so far
+	Pending     int64  `json:"pending"`     // read and not answered yet, 0 or 1 as commands run one at a time
+	BytesIn     int64  `json:"bytesIn"`
+	BytesOut    int64  `json:"bytesOut"`
+}
+
+// clientConn is a connection with its per-client state.
+type clientConn struct {
+	net.Conn
+	id       int64
+	addr     string
+	created  time.Time
+	protocol atomic.Int32 // client protocol version, see negotiateClientProtocol
+	session  atomic.Int64 // highest raft index written or read at, see SESSION
+
+	bytesIn, bytesOut atomic.Int64
+	commands, pending atomic.Int64
+
+	mu         sync.Mutex
+	kind       string
+	lastCmd    string
+	lastActive time.Time
+
+	ahead []byte // read by the watcher, returned by the next Read
+	err   error  // the watcher's read error, returned once ahead is drained
+
+	scratch *connScratch // the command loop's buffers, see writeLine
+
+	// The command being handled, for the access log. Only the command loop
+	// touches these.
+	reqID       string // "" for raft messages
+	reqCmd      string
+	reqStart    time.Time
+	reqBytesOut int64
+	failure     Code // of the error reply the command got, if any
+}
+
+func (c *clientConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.bytesOut.Add(int64(n))
+	return n, err
+}
+
+func (c *clientConn) protocolVersion() int {
+	return int(c.protocol.Load())
+}
+
+// started records that the command loop took cmd off the connection at
+// start, as request id. A raft message marks the connection as a peer's.
+func (c *clientConn) started(cmd, id string, start time.Time, peer bool) {
+	c.commands.Add(1)
+	c.pending.Store(1)
+	c.reqID, c.reqCmd, c.reqStart, c.reqBytesOut, c.failure = id, cmd, start, c.bytesOut.Load(), ""
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastCmd = cmd
+	c.lastActive = time.Now()
+	switch {
+	case peer:
+		c.kind = "peer"
+	case cmd == "MONITOR":
+		c.kind = "monitor"
+	}
+}
+
+// finished records that the command's reply has been written.
+func (c *clientConn) finished() {
+	c.pending.Store(0)
+}
+
+// finished ends the command conn was handling, once its reply is written.
+func (s *Server) finished(conn *clientConn) {
+	conn.finished()
+	s.logCommand(conn)
+}
+
+func (c *clientConn) info() ClientInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	idle := c.lastActive
+	if idle.IsZero() {
+		idle = c.created
+	}
+	return ClientInfo{
+		ID:          c.id,
+		Addr:        c.addr,
+		Kind:        c.kind,
+		Protocol:    c.protocolVersion(),
+		AgeSeconds:  int64(now.Sub(c.created).Seconds()),
+		IdleSeconds: int64(now.Sub(idle).Seconds()),
+		LastCommand: c.lastCmd,
+		Commands:    c.commands.Load(),
+		Pending:     c.pending.Load(),
+		BytesIn:     c.bytesIn.Load(),
+		BytesOut:    c.bytesOut.Load(),
+	}
+}
+
+type clientRegistry struct {
+	mu     sync.Mutex
+	conns  map[int64]*clientConn
+	nextID int64
+}
+
+func newClientRegistry() *clientRegistry {
+	return &clientRegistry{conns: make(map[int64]*clientConn)}
+}
+
+// add starts tracking conn, until remove.
+func (r *clientRegistry) add(conn net.Conn) *clientConn {
+	c := &clientConn{Conn: conn, addr: conn.RemoteAddr().String(), created: time.Now(), kind: "client"}
+	c.protocol.Store(1)
+	c.session.Store(-1)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nextID++
+	c.id = r.nextID
+	r.conns[c.id] = c
+	return c
+}
+
+func (r *clientRegistry) remove(c *clientConn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.conns, c.id)
+}
+
+func (r *clientRegistry) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.conns)
+}
+
+// list returns every connection, oldest first.
+func (r *clientRegistry) list() []ClientInfo {
+	r.mu.Lock()
+	conns := make([]*clientConn, 0, len(r.conns))
+	for _, c := range r.conns {
+		conns = append(conns, c)
+	}
+	r.mu.Unlock()
+	infos := make([]ClientInfo, len(conns))
+	for i, c := range conns {
+		infos[i] = c.info()
+	}
+	slices.SortFunc(infos, func(a, b ClientInfo) int { return int(a.ID - b.ID) })
+	return infos
+}
+
+// kill closes every connection from addr and reports how many there were.
+func (r *clientRegistry) kill(addr string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for _, c := range r.conns {
+		if c.addr == addr {
+			c.Conn.Close() // its command loop sees the error and cleans up
+			n++
+		}
+	}
+	return n
+}
+
+// Clients lists the open connections, for /clients.
+func (s *Server) Clients() []ClientInfo {
+	return s.clients.list()
+}
+
+// handleClient serves CLIENT LIST and CLIENT KILL addr.
+func (s *Server) handleClient(conn net.Conn, parts []string) {
+	switch {
+	case len(parts) == 2 && parts[1] == "LIST":
+		clients := s.clients.list()
+		fmt.Fprintln(conn, len(clients))
+		for _, c := range clients {
+			fmt.Fprintf(conn, "id=%d addr=%s kind=%s protocol=%d age=%d idle=%d cmd=%s commands=%d pending=%d in=%d out=%d\n",
+				c.ID, c.Addr, c.Kind, c.Protocol, c.AgeSeconds, c.IdleSeconds, c.LastCommand, c.Commands, c.Pending, c.BytesIn, c.BytesOut)
+		}
+	case len(parts) == 3 && parts[1] == "KILL":
+		if s.clients.kill(parts[2]) == 0 {
+			writeError(conn, newError(CodeNoClient, "no client at %s", parts[2]))
+			return
+		}
+		fmt.Fprintln(conn, "OK")
+	default:
+		writeError(conn, newError(CodeSyntax, "usage: CLIENT LIST | KILL addr"))
+	}
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clientList sends CLIENT LIST on c and returns its lines by address.
+func clientList(t *testing.T, c *testConn) map[string]string {
+	t.Helper()
+	n, err := strconv.Atoi(c.do("CLIENT LIST"))
+	if err != nil {
+		t.Fatalf("expected a count first: %v", err)
+	}
+	lines := make(map[string]string, n)
+	for range n {
+		line := c.read()
+		for _, field := range strings.Fields(line) {
+			if addr, ok := strings.CutPrefix(field, "addr="); ok {
+				lines[addr] = line
+			}
+		}
+	}
+	return lines
+}
+
+func TestClientList(t *testing.T) {
+	_, addr := testServer(t)
+	a := dialTest(t, addr)
+	b := dialTest(t, addr)
+	if reply := a.do("SET k v"); reply != "OK" {
+		t.Fatalf("SET: %q", reply)
+	}
+
+	lines := clientList(t, b)
+	if len(lines) != 2 {
+		t.Fatalf("expected both connections listed, got %v", lines)
+	}
+	line := lines[a.conn.LocalAddr().String()]
+	for _, field := range []string{"kind=client", "cmd=SET", "commands=1", "pending=0", "in=8", "out=3"} {
+		if !strings.Contains(" "+line+" ", " "+field+" ") {
+			t.Errorf("expected %s for the writer, got %q", field, line)
+		}
+	}
+	// The listing connection is in the middle of CLIENT LIST.
+	line = lines[b.conn.LocalAddr().String()]
+	for _, field := range []string{"cmd=CLIENT", "pending=1"} {
+		if !strings.Contains(" "+line+" ", " "+field+" ") {
+			t.Errorf("expected %s for the lister, got %q", field, line)
+		}
+	}
+}
+
+func TestClientKill(t *testing.T) {
+	srv, addr := testServer(t)
+	a := dialTest(t, addr)
+	b := dialTest(t, addr)
+	b.do("PROTOCOL 2")
+	a.do("PING")
+	victim := a.conn.LocalAddr().String()
+
+	if reply := b.do("CLIENT KILL " + victim); reply != "OK" {
+		t.Fatalf("CLIENT KILL: %q", reply)
+	}
+	if _, err := a.r.ReadString('\n'); err == nil {
+		t.Fatal("expected the killed connection closed")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(srv.Clients()) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected only the killer left, got %+v", srv.Clients())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if reply := b.do("CLIENT KILL " + victim); !strings.HasPrefix(reply, "ERR_NOCLIENT ") {
+		t.Errorf("expected nobody left at %s, got %q", victim, reply)
+	}
+	for _, line := range []string{"CLIENT", "CLIENT KILL", "CLIENT PAUSE 10"} {
+		if reply := b.do(line); !strings.HasPrefix(reply, "ERR_SYNTAX ") {
+			t.Errorf("%s: expected a usage error, got %q", line, reply)
+		}
+	}
+}
+
+func TestClientsEndpoint(t *testing.T) {
+	srv, addr := testServer(t)
+	c := dialTest(t, addr)
+	c.do("PING")
+
+	h := testHTTP()
+	if w := serveHTTP(h.Handler(), "GET", "/clients", nil); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 before SetClients, got %d", w.Code)
+	}
+	h.SetClients(srv.Clients)
+	w := serveHTTP(h.Handler(), "GET", "/clients", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	var clients []ClientInfo
+	if err := json.NewDecoder(w.Body).Decode(&clients); err != nil {
+		t.Fatal(err)
+	}
+	if len(clients) != 1 {
+		t.Fatalf("expected the one connection, got %+v", clients)
+	}
+	got := clients[0]
+	if got.Addr != c.conn.LocalAddr().String() || got.LastCommand != "PING" || got.Commands != 1 || got.BytesOut != 5 {
+		t.Errorf("expected the PING connection, got %+v", got)
+	}
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// A cluster benchmark is coordinated by whichever node receives the request:
+// the leader runs the writes, every follower runs reads, and the per-node
+// results are merged into one report.
+
+type NodeBenchmarkResult struct {
+	Node   string          `json:"node"`
+	Role   string          `json:"role"` // "writer" or "reader"
+	Result BenchmarkResult `json:"result"`
+	Error  string          `json:"error,omitempty"`
+}
+
+type ClusterBenchmarkReport struct {
+	Nodes    []NodeBenchmarkResult `json:"nodes"`
+	Combined BenchmarkResult       `json:"combined"`
+}
+
+var benchmarkClient = &http.Client{Timeout: 5 * time.Minute}
+
+// runClusterBenchmark sends authorization, the caller's Authorization header,
+// along to every node.
+func (h *HTTPServer) runClusterBenchmark(opts BenchmarkOptions, authorization string) (ClusterBenchmarkReport, error) {
+	nodes := append([]string{h.raft.ID}, h.raft.Peers...)
+
+	leader := ""
+	for _, node := range nodes {
+		status, err := fetchStatus(node, authorization)
+		if err == nil && status.State == "Leader" && !status.Paused {
+			leader = node
+			break
+		}
+	}
+	if leader == "" {
+		return ClusterBenchmarkReport{}, fmt.Errorf("no leader found")
+	}
+
+	// Reads need existing keys to hit, so readers always work over a fixed key space.
+	if opts.KeySpace == 0 {
+		opts.KeySpace = opts.Requests
+	}
+
+	report := ClusterBenchmarkReport{Nodes: make([]NodeBenchmarkResult, len(nodes))}
+	var wg sync.WaitGroup
+	for i, node := range nodes {
+		nodeOpts := opts
+		role := "reader"
+		nodeOpts.ReadPercent = 100
+		nodeOpts.Mode = "direct"
+		if node == leader {
+			role = "writer"
+			nodeOpts.ReadPercent = 0
+		}
+
+		wg.Add(1)
+		go func(i int, node, role string, nodeOpts BenchmarkOptions) {
+			defer wg.Done()
+			res := NodeBenchmarkResult{Node: node, Role: role}
+			result, err := fetchBenchmark(node, nodeOpts, authorization)
+			if err != nil {
+				res.Error = err.Error()
+			}
+			res.Result = result
+			report.Nodes[i] = res
+		}(i, node, role, nodeOpts)
+	}
+	wg.Wait()
+
+	report.Combined = combineResults(report.Nodes)
+	return report, nil
+}
+
+// combineResults sums counts, throughput and histogram buckets. Percentiles
+// from different nodes can't be merged exactly, so the combined ones are the
+// worst node's values. The WAL mode is the writer's, the one that acks writes.
+func combineResults(nodes []NodeBenchmarkResult) BenchmarkResult {
+	c := BenchmarkResult{Histogram: newHistogram(nil)}
+	var weightedAvg float64
+	for _, n := range nodes {
+		r := n.Result
+		for i := range r.Histogram {
+			if i < len(c.Histogram) {
+				c.Histogram[i].Count += r.Histogram[i].Count
+			}
+		}
+		c.WarmupMs = max(c.WarmupMs, r.WarmupMs)
+		c.TotalRequests += r.TotalRequests
+		c.Successful += r.Successful
+		c.Failed += r.Failed
+		c.Reads += r.Reads
+		c.Writes += r.Writes
+		c.Throughput += r.Throughput
+		weightedAvg += r.LatencyAvgMs * float64(r.Successful)
+		c.DurationMs = max(c.DurationMs, r.DurationMs)
+		c.LatencyP50Ms = max(c.LatencyP50Ms, r.LatencyP50Ms)
+		c.LatencyP95Ms = max(c.LatencyP95Ms, r.LatencyP95Ms)
+		c.LatencyP99Ms = max(c.LatencyP99Ms, r.LatencyP99Ms)
+		if n.Role == "writer" {
+			c.WALMode = r.WALMode
+		}
+	}
+	if c.Successful > 0 {
+		c.LatencyAvgMs = weightedAvg / float64(c.Successful)
+	}
+	return c
+}
+
+// getNode is a GET of path on node's HTTP port.
+func getNode(ctx context.Context, node, path, authorization string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+httpAddr(node)+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	return benchmarkClient.Do(req)
+}
+
+// fetchJSON decodes the JSON answer to a GET of path on node into v.
+func fetchJSON(ctx context.Context, node, path, authorization string, v any) error {
+	resp, err := getNode(ctx, node, path, authorization)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s on %s: %s", path, node, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func fetchStatus(node, authorization string) (StatusResponse, error) {
+	var status StatusResponse
+	err := fetchJSON(context.Background(), node, "/status", authorization, &status)
+	return status, err
+}
+
+func fetchBenchmark(node string, opts BenchmarkOptions, authorization string) (BenchmarkResult, error) {
+	q := url.Values{}
+	q.Set("requests", fmt.Sprint(opts.Requests))
+	q.Set("concurrency", fmt.Sprint(opts.Concurrency))
+	q.Set("readPercent", fmt.Sprint(opts.ReadPercent))
+	q.Set("valueSize", fmt.Sprint(opts.ValueSize))
+	q.Set("keySpace", fmt.Sprint(opts.KeySpace))
+	q.Set("distribution", opts.Distribution)
+	q.Set("mode", opts.Mode)
+	q.Set("warmup", opts.Warmup.String())
+
+	var result BenchmarkResult
+	resp, err := getNode(context.Background(), node, "/benchmark?"+q.Encode(), authorization)
+	if err != nil {
+		return result, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return result, fmt.Errorf("benchmark on %s: %s", node, resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	return result, err
+}
@@ -0,0 +1,351 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/mathdee/KV-Store/internal/bitmap"
+	"github.com/mathdee/KV-Store/internal/crash"
+	"github.com/mathdee/KV-Store/internal/failpoint"
+	"github.com/mathdee/KV-Store/internal/protocol"
+	"github.com/mathdee/KV-Store/internal/raft"
+	"github.com/mathdee/KV-Store/internal/tracing"
+)
+
+// Write commands travel through the raft log as the same text the client
+// sent ("SETNX key value"). Every node applies them once they commit, from
+// RunApply, and through applyCommand, so every node computes the same
+// result from the same log.
+
+// replicateWrite proposes command through raft and waits for it to be
+// applied, writing the reply to conn. It returns false when nothing was.
+func (s *Server) replicateWrite(ctx context.Context, conn net.Conn, command string) (string, bool) {
+	ctx, stop := s.commandContext(ctx, conn) // ends at the deadline or when the client hangs up
+	defer stop()
+
+	reply, index, refused, err := s.write(ctx, command)
+	if err != nil {
+		writeError(conn, err)
+		return "", false
+	}
+	if cc, ok := conn.(*clientConn); ok {
+		cc.sawIndex(index) // the client's token for reading this write elsewhere
+	}
+	if refused != nil {
+		writeError(conn, refused)
+		return refused.Text, true
+	}
+	writeLine(conn, reply)
+	return reply, true
+}
+
+// write proposes command, waits for a majority to hold it and for RunApply
+// to apply it, and returns the reply and the entry's index. A command can
+// refuse (NOKEY) and still be applied and committed, its answer is then
+// refused; err is set when the write wasn't acked.
+func (s *Server) write(ctx context.Context, command string) (reply string, index int, refused, err *Error) {
+	// Check if the server is the leader.
+	if s.raft.GetState() != "Leader" {
+		// The client must find the leader and retry.
+		return "", -1, nil, errNotLeader
+	}
+	if err := s.disk.refuse(); err != nil {
+		return "", -1, nil, err // refused before proposing, rather than failing in the fsync
+	}
+
+	command, werr := s.idempotent(ctx, command)
+	if werr != nil {
+		return "", -1, nil, werr
+	}
+
+	s.waiters.mu.Lock()
+	_, proposeSpan := tracing.Start(ctx, "raft.propose")
+	index, committed := s.raft.Propose(ctx, command)
+	proposeSpan.End()
+	if index < 0 {
+		s.waiters.mu.Unlock()
+		if err := <-committed; err != raft.ErrNotLeader {
+			s.metrics.RecordFailure()
+			return "", -1, nil, newError(CodeTimeout, "not proposed: %v", err) // the client went away or ran out of time first
+		}
+		return "", -1, nil, errNotLeader // lost leadership since the check above
+	}
+	applied := s.waiters.wait(index)
+	s.waiters.mu.Unlock()
+
+	// Only answer once a majority holds the entry, so an acked write
+	// survives losing this node.
+	if err := waitCommitted(ctx, committed); err != nil {
+		s.waiters.stop(index, applied)
+		s.metrics.RecordFailure()
+		return "", index, nil, commitFailure(err)
+	}
+
+	var res applyResult
+	select {
+	case res = <-applied:
+	case <-ctx.Done():
+		s.waiters.stop(index, applied)
+		s.metrics.RecordFailure()
+		return "", index, nil, newError(CodeTimeout, "committed but not applied yet, the write will still be applied: %v", context.Cause(ctx))
+	}
+	if res.err != nil {
+		// The WAL didn't make it to disk, so the write must not be acked.
+		s.metrics.RecordFailure()
+		return "", index, nil, newError(CodeIO, "write failed: %v", res.err)
+	}
+	return res.reply, index, res.refused, nil
+}
+
+// waitCommitted waits for a proposed entry to commit, or for ctx to end.
+func waitCommitted(ctx context.Context, committed <-chan error) error {
+	_, span := tracing.Start(ctx, "raft.commit_wait")
+	defer span.End()
+	select {
+	case err := <-committed:
+		return commitError(ctx, err)
+	case <-ctx.Done():
+		return commitError(ctx, ctx.Err())
+	}
+}
+
+// commitError names a deadline for what it means here.
+func commitError(ctx context.Context, err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return errCommitTimeout
+	}
+	if errors.Is(err, context.Canceled) {
+		return context.Cause(ctx)
+	}
+	return err
+}
+
+// applyCommand runs one replicated write against the store and returns the client reply.
+// A panic shuts the node down: the store would be missing an entry the log
+// has, and the apply lock would stay held, so nothing after it could apply.
+func (s *Server) applyCommand(ctx context.Context, command string) (string, error) {
+	defer crash.Recover("apply", crash.Fatal)
+	if err := failpoint.Inject(failpoint.ServerBeforeApply); err != nil {
+		return "", err
+	}
+	return s.apply(ctx, command)
+}
+
+// apply is applyCommand past the failpoint, for the writes an entry carries.
+func (s *Server) apply(ctx context.Context, command string) (string, error) {
+	parts, err := protocol.Parse(command)
+	if err != nil {
+		return "", err
+	}
+
+	switch parts[0] {
+	case "SET":
+		if len(parts) < 3 {
+			return "", fmt.Errorf("malformed SET")
+		}
+		if err := s.store.SetContext(ctx, parts[1], parts.Rest(2)); err != nil {
+			return "", err
+		}
+		return "OK", nil
+
+	case "SETNX":
+		if len(parts) < 3 {
+			return "", fmt.Errorf("malformed SETNX")
+		}
+		set, err := s.store.SetNX(ctx, parts[1], parts.Rest(2))
+		if err != nil {
+			return "", err
+		}
+		if set {
+			return "1", nil
+		}
+		return "0", nil
+
+	case "GETSET":
+		if len(parts) < 3 {
+			return "", fmt.Errorf("malformed GETSET")
+		}
+		old, existed, err := s.store.GetSet(ctx, parts[1], parts.Rest(2))
+		if err != nil {
+			return "", err
+		}
+		if !existed {
+			return "(nil)", nil
+		}
+		return old, nil
+
+	case "APPEND":
+		if len(parts) < 3 {
+			return "", fmt.Errorf("malformed APPEND")
+		}
+		n, err := s.store.Append(ctx, parts[1], parts.Rest(2))
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(n), nil
+
+	case "SETBIT":
+		if len(parts) != 4 {
+			return "", fmt.Errorf("malformed SETBIT")
+		}
+		offset, err := bitmap.ParseOffset(parts[2])
+		if err != nil {
+			return "", err
+		}
+		bit, err := bitmap.ParseBit(parts[3])
+		if err != nil {
+			return "", err
+		}
+		old, err := s.store.SetBit(ctx, parts[1], offset, bit)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(old), nil
+
+	case "GETDEL":
+		if len(parts) != 2 {
+			return "", fmt.Errorf("malformed GETDEL")
+		}
+		val, existed, err := s.store.GetDel(ctx, parts[1])
+		if err != nil {
+			return "", err
+		}
+		if !existed {
+			return "(nil)", nil
+		}
+		return val, nil
+
+	case "RENAME":
+		if len(parts) != 3 {
+			return "", fmt.Errorf("malformed RENAME")
+		}
+		renamed, err := s.store.Rename(ctx, parts[1], parts[2])
+		if err != nil {
+			return "", err
+		}
+		if !renamed {
+			return "", errNoSuchKey
+		}
+		return "OK", nil
+
+	case "COPY":
+		if len(parts) < 3 || len(parts) > 4 {
+			return "", fmt.Errorf("malformed COPY")
+		}
+		copied, err := s.store.Copy(ctx, parts[1], parts[2], len(parts) == 4 && parts[3] == "REPLACE")
+		if err != nil {
+			return "", err
+		}
+		if copied {
+			return "1", nil
+		}
+		return "0", nil
+
+	case "BATCH": // BATCH <ops as JSON>, see batch.go
+		ops, err := decodeBatch(command)
+		if err != nil {
+			return "", err
+		}
+		existed, err := s.store.Batch(ctx, ops)
+		if err != nil {
+			return "", err
+		}
+		return existedReply(existed), nil
+
+	case "EVAL": // EVAL numkeys key... numargs arg... script, see eval.go
+		return s.applyEval(ctx, parts)
+
+	case "TXN": // TXN guard... THEN op... [ELSE op...], see txn.go
+		return s.applyTxn(ctx, parts)
+
+	case "ACQUIRE": // ACQUIRE key owner expires now, see locks.go
+		return s.applyAcquire(ctx, parts)
+
+	case "RELEASE": // RELEASE key owner
+		return s.applyRelease(ctx, parts)
+
+	case "IDEM": // IDEM token expiry command, see idempotency.go
+		return s.applyIdempotent(ctx, command)
+
+	case "CACHEFLUSHED": // CACHEFLUSHED index, see cache.go
+		if len(parts) != 2 {
+			return "", fmt.Errorf("malformed CACHEFLUSHED")
+		}
+		if s.cache != nil {
+			s.cache.markFlushed(parseInt(parts[1]))
+		}
+		return "OK", nil
+
+	case "FLUSHALL":
+		n, err := s.store.FlushAll(ctx)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(n), nil
+
+	case "FLUSHNS":
+		if len(parts) != 2 {
+			return "", fmt.Errorf("malformed FLUSHNS")
+		}
+		n, err := s.store.FlushNamespace(ctx, parts[1])
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(n), nil
+	}
+	if reply, ok, err := s.applyPlugin(ctx, parts); ok {
+		return reply, err
+	}
+	return "", fmt.Errorf("unknown write command %q", parts[0])
+}
+
+// markApplied records that the log entry at index has been applied. It only
+// ever moves forward.
+func (s *Server) markApplied(index int) {
+	for {
+		cur := s.applied.Load()
+		if int64(index) <= cur {
+			return
+		}
+		if s.applied.CompareAndSwap(cur, int64(index)) {
+			s.appliedSignal.notify()
+			return
+		}
+	}
+}
+
+// Applied and Entries let a cdc.Pipeline read the changes this node has applied.
+func (s *Server) Applied() int {
+	return int(s.applied.Load())
+}
+
+func (s *Server) Entries(from, max int) []raft.LogEntry {
+	return s.raft.EntriesFrom(from, max)
+}
+
+// Snapshot and InstallSnapshot implement raft.Snapshotter. Holding applyMu
+// exclusively means RunApply is between batches, so the store reflects
+// exactly the log up to Applied(). The store snapshot is copy-on-write, so applyMu is only
+// held while it is taken.
+func (s *Server) Snapshot() (int, raft.SnapshotData) {
+	s.applyMu.Lock()
+	defer s.applyMu.Unlock()
+	return s.Applied(), s.store.Snapshot()
+}
+
+func (s *Server) InstallSnapshot(index int, data map[string]string, expires map[string]int64) error {
+	s.applyMu.Lock()
+	defer s.applyMu.Unlock()
+	if err := s.store.InstallSnapshot(context.Background(), data, expires); err != nil {
+		return err
+	}
+	if err := s.store.MarkApplied(context.Background(), index); err != nil {
+		return err
+	}
+	s.applied.Store(int64(index))
+	s.appliedSignal.notify()
+	return nil
+}
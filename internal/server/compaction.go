@@ -0,0 +1,207 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Without compaction the raft log and the WAL only ever grow, and the only
+// way to shrink them was /clear, which throws the log away. The Compactor
+// watches both and, once either passes its threshold, snapshots the store
+// into a fresh WAL and drops the log entries the snapshot covers.
+
+// CompactionOptions configures the background compactor.
+type CompactionOptions struct {
+	Interval    time.Duration // how often to check the thresholds, 0 disables the job
+	MaxEntries  int           // compact once the raft log holds more entries than this
+	MaxWALBytes int64         // or once the WAL is bigger than this
+}
+
+var DefaultCompactionOptions = CompactionOptions{
+	Interval:    30 * time.Second,
+	MaxEntries:  10000,
+	MaxWALBytes: 64 << 20,
+}
+
+// CompactionStatus is what /status reports about the compactor.
+type CompactionStatus struct {
+	Enabled        bool      `json:"enabled"`
+	IntervalMs     int64     `json:"intervalMs"`
+	MaxEntries     int       `json:"maxEntries"`
+	MaxWALBytes    int64     `json:"maxWalBytes"`
+	Phase          string    `json:"phase"` // idle, snapshot, rewriting or trimming
+	Runs           int64     `json:"runs"`
+	LastStart      time.Time `json:"lastStart,omitzero"`
+	LastDurationMs int64     `json:"lastDurationMs"`
+	LastIndex      int       `json:"lastIndex"`   // raft index the last snapshot covered
+	LastTrimmed    int       `json:"lastTrimmed"` // log entries dropped by the last run
+	WALBytesBefore int64     `json:"walBytesBefore"`
+	WALBytesAfter  int64     `json:"walBytesAfter"`
+	LastError      string    `json:"lastError,omitempty"`
+}
+
+type Compactor struct {
+	srv   *Server
+	holds []func() int // each returns the newest index that may be dropped
+
+	run     sync.Mutex // one compaction at a time
+	mu      sync.Mutex
+	opts    CompactionOptions
+	status  CompactionStatus
+	changed chan struct{} // SetOptions wakes Run to pick up a new interval
+}
+
+func NewCompactor(srv *Server, opts CompactionOptions) *Compactor {
+	c := &Compactor{srv: srv, changed: make(chan struct{}, 1), status: CompactionStatus{
+		Phase:     "idle",
+		LastIndex: -1,
+	}}
+	c.setOptions(opts)
+	return c
+}
+
+// SetOptions changes the thresholds and interval of a running compactor.
+func (c *Compactor) SetOptions(opts CompactionOptions) {
+	c.setOptions(opts)
+	select {
+	case c.changed <- struct{}{}:
+	default:
+	}
+}
+
+func (c *Compactor) setOptions(opts CompactionOptions) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.opts = opts
+	c.status.Enabled = opts.Interval > 0
+	c.status.IntervalMs = opts.Interval.Milliseconds()
+	c.status.MaxEntries = opts.MaxEntries
+	c.status.MaxWALBytes = opts.MaxWALBytes
+}
+
+func (c *Compactor) options() CompactionOptions {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.opts
+}
+
+// Hold keeps log entries newer than f() from being dropped, e.g. changes a
+// CDC pipeline hasn't delivered yet.
+func (c *Compactor) Hold(f func() int) {
+	c.holds = append(c.holds, f)
+}
+
+// Run checks the thresholds every interval until ctx is done. While the
+// interval is 0 it only waits for SetOptions to set one.
+func (c *Compactor) Run(ctx context.Context) {
+	var tick <-chan time.Time
+	var ticker *time.Ticker
+	reset := func() {
+		if ticker != nil {
+			ticker.Stop()
+			ticker, tick = nil, nil
+		}
+		if interval := c.options().Interval; interval > 0 {
+			ticker = time.NewTicker(interval)
+			tick = ticker.C
+		}
+	}
+	reset()
+	defer func() {
+		if ticker != nil {
+			ticker.Stop()
+		}
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.changed:
+			reset()
+		case <-tick:
+			if c.due() {
+				if err := c.Compact(); err != nil {
+					fmt.Printf("Compaction failed: %v\n", err)
+				}
+			}
+		}
+	}
+}
+
+func (c *Compactor) due() bool {
+	opts := c.options()
+	if opts.MaxEntries > 0 && c.srv.raft.RetainedEntries() > opts.MaxEntries {
+		return true
+	}
+	return opts.MaxWALBytes > 0 && c.srv.store.WALSize() > opts.MaxWALBytes
+}
+
+// Compact snapshots the store into a new WAL and trims the raft log up to
+// the snapshot, whatever the thresholds say.
+func (c *Compactor) Compact() error {
+	c.run.Lock()
+	defer c.run.Unlock()
+
+	start := time.Now()
+	before := c.srv.store.WALSize()
+	c.update(func(st *CompactionStatus) {
+		st.Phase = "snapshot"
+		st.LastStart = start
+		st.WALBytesBefore = before
+	})
+
+	// With applyMu held RunApply is between batches, so the store matches
+	// the log up to Applied().
+	c.srv.applyMu.Lock()
+	index := c.srv.Applied()
+	snap := c.srv.store.BeginCompaction()
+	c.srv.applyMu.Unlock()
+
+	c.update(func(st *CompactionStatus) { st.Phase = "rewriting" })
+	keys := snap.Len()
+	if err := c.srv.store.FinishCompaction(snap); err != nil {
+		c.finish(start, func(st *CompactionStatus) { st.LastError = err.Error() })
+		return err
+	}
+
+	c.update(func(st *CompactionStatus) { st.Phase = "trimming" })
+	upTo := index
+	for _, hold := range c.holds {
+		upTo = min(upTo, hold())
+	}
+	trimmed := c.srv.raft.CompactLog(upTo)
+
+	c.finish(start, func(st *CompactionStatus) {
+		st.LastIndex = index
+		st.LastTrimmed = trimmed
+		st.WALBytesAfter = c.srv.store.WALSize()
+		st.LastError = ""
+	})
+	fmt.Printf("Compacted WAL %d -> %d bytes (%d keys), trimmed %d log entries up to index %d in %v\n",
+		before, c.srv.store.WALSize(), keys, trimmed, upTo, time.Since(start))
+	return nil
+}
+
+func (c *Compactor) update(f func(*CompactionStatus)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f(&c.status)
+}
+
+func (c *Compactor) finish(start time.Time, f func(*CompactionStatus)) {
+	c.update(func(st *CompactionStatus) {
+		f(st)
+		st.Phase = "idle"
+		st.Runs++
+		st.LastDurationMs = time.Since(start).Milliseconds()
+	})
+}
+
+// Status returns a copy of the compactor's progress and last result.
+func (c *Compactor) Status() CompactionStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.status
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSOptions say which web pages may call the HTTP API from a browser. The
+// defaults let any origin in, which is what the dashboard on another port
+// needs in development; deployments should list their dashboard's origin.
+type CORSOptions struct {
+	AllowedOrigins   []string // scheme://host[:port], or "*" for any; empty allows none
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	AllowCredentials bool          // lets pages send cookies and Authorization, for listed origins only
+	MaxAge           time.Duration // how long browsers may cache a preflight answer, 0 for not at all
+}
+
+var DefaultCORSOptions = CORSOptions{
+	AllowedOrigins: []string{"*"},
+	AllowedMethods: []string{"GET", "POST", "PUT", "DELETE"},
+	AllowedHeaders: []string{"Content-Type", "Authorization", requestIDHeader, idempotencyHeader},
+	MaxAge:         10 * time.Minute,
+}
+
+// SetCORS replaces DefaultCORSOptions, for requests from then on.
+func (h *HTTPServer) SetCORS(o CORSOptions) {
+	h.corsOptions.Store(&o)
+}
+
+func (o CORSOptions) allows(origin string) bool {
+	return slices.Contains(o.AllowedOrigins, "*") || slices.Contains(o.AllowedOrigins, origin)
+}
+
+// cors adds the CORS headers every handler used to set by hand and answers
+// preflight requests itself. Requests from origins that aren't allowed are
+// still served, without the headers: the browser is what stops the page from
+// reading the answer. Credentials are only allowed for origins listed by
+// name, never through "*".
+func (h *HTTPServer) cors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		o := *h.corsOptions.Load()
+		origin := r.Header.Get("Origin")
+		header := w.Header()
+		if origin != "" && o.allows(origin) {
+			if slices.Contains(o.AllowedOrigins, origin) {
+				// Answers now differ by origin, so caches must keep them apart.
+				header.Set("Access-Control-Allow-Origin", origin)
+				header.Add("Vary", "Origin")
+				if o.AllowCredentials {
+					header.Set("Access-Control-Allow-Credentials", "true")
+				}
+			} else {
+				header.Set("Access-Control-Allow-Origin", "*")
+			}
+			header.Set("Access-Control-Expose-Headers", requestIDHeader)
+		}
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			if origin != "" && o.allows(origin) {
+				header.Set("Access-Control-Allow-Methods", strings.Join(o.AllowedMethods, ", "))
+				header.Set("Access-Control-Allow-Headers", strings.Join(o.AllowedHeaders, ", "))
+				if o.MaxAge > 0 {
+					header.Set("Access-Control-Max-Age", strconv.Itoa(int(o.MaxAge.Seconds())))
+				}
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func preflight(origin string) func(*http.Request) {
+	return func(r *http.Request) {
+		r.Header.Set("Origin", origin)
+		r.Header.Set("Access-Control-Request-Method", "PUT")
+	}
+}
+
+func TestCORSPreflight(t *testing.T) {
+	h := testHTTP()
+	h.SetCORS(CORSOptions{
+		AllowedOrigins:   []string{"https://dash.example"},
+		AllowedMethods:   []string{"GET", "PUT"},
+		AllowedHeaders:   []string{"Content-Type", "Authorization"},
+		AllowCredentials: true,
+		MaxAge:           time.Minute,
+	})
+	// Browsers send preflights without credentials, so they must get
+	// through even with tokens set.
+	h.SetAuth(AuthOptions{ReadToken: "reader"})
+	api := h.Handler()
+
+	w := serveHTTP(api, "OPTIONS", "/cluster", preflight("https://dash.example"))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204 for an allowed preflight, got %d", w.Code)
+	}
+	want := map[string]string{
+		"Access-Control-Allow-Origin":      "https://dash.example",
+		"Access-Control-Allow-Credentials": "true",
+		"Access-Control-Allow-Methods":     "GET, PUT",
+		"Access-Control-Allow-Headers":     "Content-Type, Authorization",
+		"Access-Control-Max-Age":           "60",
+		"Access-Control-Expose-Headers":    requestIDHeader,
+		"Vary":                             "Origin",
+	}
+	for name, v := range want {
+		if got := w.Header().Get(name); got != v {
+			t.Errorf("allowed preflight: expected %s %q, got %q", name, v, got)
+		}
+	}
+
+	w = serveHTTP(api, "OPTIONS", "/cluster", preflight("https://evil.example"))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204 for a disallowed preflight, got %d", w.Code)
+	}
+	for name := range want {
+		if name == "Vary" {
+			continue
+		}
+		if got := w.Header().Get(name); got != "" {
+			t.Errorf("disallowed preflight: expected no %s, got %q", name, got)
+		}
+	}
+}
+
+func TestCORSWildcard(t *testing.T) {
+	h := testHTTP() // DefaultCORSOptions let any origin in
+	api := h.Handler()
+
+	w := serveHTTP(api, "OPTIONS", "/cluster", preflight("https://anywhere.example"))
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("expected Allow-Origin *, got %q", got)
+	}
+	if got := w.Header().Get("Access-Control-Max-Age"); got != "600" {
+		t.Errorf("expected the default Max-Age of 600, got %q", got)
+	}
+
+	// Credentials are for origins listed by name, never through "*".
+	h.SetCORS(CORSOptions{AllowedOrigins: []string{"*"}, AllowCredentials: true})
+	w = serveHTTP(api, "GET", "/cluster", func(r *http.Request) { r.Header.Set("Origin", "https://anywhere.example") })
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the request served, got %d", w.Code)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Credentials"); got != "" {
+		t.Errorf("expected no Allow-Credentials through \"*\", got %q", got)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("expected Allow-Origin * on a plain request, got %q", got)
+	}
+}
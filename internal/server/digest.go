@@ -0,0 +1,258 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mathdee/KV-Store/internal/store"
+)
+
+// Nodes that apply the same log should hold the same state, but a bug in
+// apply or a damaged WAL can make a follower drift without raft noticing.
+// So every node samples its store's digest (see store.Digest) whenever it
+// can briefly hold applyMu exclusively, when the store matches the log up
+// to Applied() exactly, and keeps its latest samples. The leader sends its
+// newest one with APPENDENTRIES as "<index>:<digest>", and a follower
+// compares it with its own sample at that index once both exist. Samples
+// are taken after applying and on every heartbeat, so the indexes line up
+// at least whenever writes pause; under a steady stream of writes some of
+// the leader's digests are never compared.
+//
+// A node that restarts with data re-applies the log over what it
+// recovered, so until it has caught up with the commit index the first
+// leader told it about it doesn't sample at all.
+
+// digestSamples is how many of our own digests, and of the leader's, are
+// kept to be matched up.
+const digestSamples = 128
+
+// DigestStatus is what /metrics reports about state digests.
+type DigestStatus struct {
+	Index        int             `json:"index"`            // of our newest sample, -1 if none yet
+	Digest       string          `json:"digest,omitempty"` // our newest sample
+	Checks       int64           `json:"checks"`           // leader digests compared with ours
+	Mismatches   int64           `json:"mismatches"`       // and found different
+	LastMismatch *DigestMismatch `json:"lastMismatch,omitempty"`
+
+	Syncs        int64         `json:"syncs"`        // anti-entropy rounds that compared with the leader
+	Repairs      int64         `json:"repairs"`      // and found shards to fix
+	RepairedKeys int64         `json:"repairedKeys"` // keys rewritten or removed by them
+	LastRepair   *DigestRepair `json:"lastRepair,omitempty"`
+	LastError    string        `json:"lastError,omitempty"` // of the latest anti-entropy round that failed
+}
+
+// DigestMismatch is a leader digest that differed from ours.
+type DigestMismatch struct {
+	Index  int       `json:"index"`
+	Leader string    `json:"leader"`
+	Shards []int     `json:"shards"` // store.DigestShard of the keys that differ
+	At     time.Time `json:"at"`
+}
+
+// leaderDigest is a digest a leader sent us, compared once we have ours.
+type leaderDigest struct {
+	from    string
+	digest  store.Digest
+	checked bool
+}
+
+type digestTracker struct {
+	id string // our node ID, for the log
+
+	ready atomic.Bool // we may sample, see above
+
+	mu          sync.Mutex
+	catchUp     int // until Applied() reaches it, -2 before a leader told us
+	own         map[int]store.Digest
+	ownOrder    []int // oldest first, for evicting
+	latest      int   // index of our newest sample, -1 if none
+	leader      map[int]*leaderDigest
+	leaderOrder []int
+	checks      int64
+	mismatches  int64
+	last        *DigestMismatch
+
+	syncs, repairs, repairedKeys int64 // anti-entropy, see antientropy.go
+	lastRepair                   *DigestRepair
+	lastError                    string
+}
+
+func newDigestTracker(id string, ready bool) *digestTracker {
+	t := &digestTracker{id: id, catchUp: -2, latest: -1, own: make(map[int]store.Digest), leader: make(map[int]*leaderDigest)}
+	t.ready.Store(ready)
+	return t
+}
+
+// sampleDigest records the store's digest at Applied(), unless a write is
+// between being proposed and applied, in which case the next call will.
+func (s *Server) sampleDigest() {
+	if s.raft.IsWitness() || !s.digests.canSample(s.Applied()) {
+		return
+	}
+	if !s.applyMu.TryLock() {
+		return
+	}
+	index := s.Applied()
+	if index == s.digests.latestIndex() {
+		s.applyMu.Unlock()
+		return // nothing applied since, the state can't have changed
+	}
+	d := s.store.Digest()
+	s.applyMu.Unlock()
+	s.digests.sampled(index, d)
+}
+
+// LatestDigest implements raft.DigestSource.
+func (s *Server) LatestDigest() string {
+	t := s.digests
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.latest < 0 {
+		return ""
+	}
+	return strconv.Itoa(t.latest) + ":" + t.own[t.latest].String()
+}
+
+// DigestStatus reports our digests and how comparing them went.
+func (s *Server) DigestStatus() DigestStatus {
+	t := s.digests
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	st := DigestStatus{Index: t.latest, Checks: t.checks, Mismatches: t.mismatches}
+	if t.latest >= 0 {
+		st.Digest = t.own[t.latest].String()
+	}
+	if t.last != nil {
+		last := *t.last
+		st.LastMismatch = &last
+	}
+	st.Syncs, st.Repairs, st.RepairedKeys, st.LastError = t.syncs, t.repairs, t.repairedKeys, t.lastError
+	if t.lastRepair != nil {
+		r := *t.lastRepair
+		st.LastRepair = &r
+	}
+	return st
+}
+
+func (t *digestTracker) synced() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.syncs++
+}
+
+func (t *digestTracker) repaired(r DigestRepair) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.repairs++
+	t.repairedKeys += int64(r.Keys)
+	t.lastRepair = &r
+}
+
+func (t *digestTracker) failed(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lastError = err.Error()
+}
+
+// canSample reports whether the store is past re-applying the log over
+// recovered data, once applied has reached what the first leader had committed.
+func (t *digestTracker) canSample(applied int) bool {
+	if t.ready.Load() {
+		return true // every write asks, so this is kept off t.mu
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.catchUp > -2 && applied >= t.catchUp {
+		t.ready.Store(true)
+	}
+	return t.ready.Load()
+}
+
+func (t *digestTracker) latestIndex() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.latest
+}
+
+func (t *digestTracker) sampled(index int, d store.Digest) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.own[index]; !ok {
+		t.ownOrder = append(t.ownOrder, index)
+		if len(t.ownOrder) > digestSamples {
+			delete(t.own, t.ownOrder[0])
+			t.ownOrder = t.ownOrder[1:]
+		}
+	}
+	t.own[index] = d
+	t.latest = max(t.latest, index)
+	if l, ok := t.leader[index]; ok {
+		t.compare(index, l)
+	}
+}
+
+// heard takes note of an APPENDENTRIES from leader: its commit index and,
+// from version 3 leaders, its digest field ("" if there was none).
+func (t *digestTracker) heard(leader string, field string, leaderCommit int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.catchUp == -2 {
+		t.catchUp = leaderCommit
+	}
+	if field == "" {
+		return
+	}
+	index, d, err := parseDigestField(field)
+	if err != nil {
+		fmt.Printf("[%s] Ignoring digest from %s: %v\n", t.id, leader, err)
+		return
+	}
+	if _, ok := t.leader[index]; ok {
+		return // the leader resends its newest digest until it takes another
+	}
+	l := &leaderDigest{from: leader, digest: d}
+	t.leader[index] = l
+	t.leaderOrder = append(t.leaderOrder, index)
+	if len(t.leaderOrder) > digestSamples {
+		delete(t.leader, t.leaderOrder[0])
+		t.leaderOrder = t.leaderOrder[1:]
+	}
+	if _, ok := t.own[index]; ok {
+		t.compare(index, l)
+	}
+}
+
+// compare checks our sample at index against the leader's. Callers hold t.mu.
+func (t *digestTracker) compare(index int, l *leaderDigest) {
+	if l.checked {
+		return
+	}
+	l.checked = true
+	t.checks++
+	shards := t.own[index].Diff(l.digest)
+	if len(shards) == 0 {
+		return
+	}
+	t.mismatches++
+	t.last = &DigestMismatch{Index: index, Leader: l.from, Shards: shards, At: time.Now()}
+	fmt.Printf("[%s] STATE DIVERGENCE: at index %d our state differs from leader %s's in digest shards %v (mismatch #%d)\n",
+		t.id, index, l.from, shards, t.mismatches)
+}
+
+// parseDigestField reads what LatestDigest formats.
+func parseDigestField(field string) (int, store.Digest, error) {
+	indexText, digestText, ok := strings.Cut(field, ":")
+	if !ok {
+		return 0, store.Digest{}, fmt.Errorf("malformed digest %q", field)
+	}
+	index, err := strconv.Atoi(indexText)
+	if err != nil {
+		return 0, store.Digest{}, fmt.Errorf("malformed digest index %q", indexText)
+	}
+	d, err := store.ParseDigest(digestText)
+	return index, d, err
+}
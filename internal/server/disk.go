@@ -0,0 +1,169 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// A full disk used to show up as a write failing halfway through an fsync
+// with ENOSPC, after the entry was already proposed. The DiskWatchdog
+// checks the free space in the data directory every interval instead, and
+// while it is under the minimum the node is read-only: writes are refused
+// up front with READONLY, reads carry on. Writes resume on their own once
+// there is a tenth more than the minimum free again, so a node hovering at
+// the line doesn't flip on every check.
+//
+// Only the leader takes writes, so it is the leader's disk that decides.
+// Followers keep appending what it sends them.
+
+// DiskOptions configures the watchdog.
+type DiskOptions struct {
+	Interval     time.Duration // how often to check, 0 disables the watchdog
+	MinFreeBytes int64         // refuse writes below this much free space
+}
+
+var DefaultDiskOptions = DiskOptions{
+	Interval:     5 * time.Second,
+	MinFreeBytes: 256 << 20,
+}
+
+// DiskStatus is what /status reports about the data directory's disk.
+type DiskStatus struct {
+	Dir          string    `json:"dir"`
+	Enabled      bool      `json:"enabled"`
+	FreeBytes    int64     `json:"freeBytes"`
+	TotalBytes   int64     `json:"totalBytes"`
+	MinFreeBytes int64     `json:"minFreeBytes"`
+	ReadOnly     bool      `json:"readOnly"`
+	Since        time.Time `json:"since,omitzero"` // when it last went read-only or writable
+	LastCheck    time.Time `json:"lastCheck,omitzero"`
+	LastError    string    `json:"lastError,omitempty"`
+}
+
+type DiskWatchdog struct {
+	mu      sync.Mutex
+	opts    DiskOptions
+	status  DiskStatus
+	changed chan struct{} // SetOptions wakes Run to check again
+}
+
+func NewDiskWatchdog(dir string, opts DiskOptions) *DiskWatchdog {
+	d := &DiskWatchdog{changed: make(chan struct{}, 1), status: DiskStatus{Dir: dir}}
+	d.setOptions(opts)
+	return d
+}
+
+// SetOptions changes the minimum and interval of a running watchdog.
+func (d *DiskWatchdog) SetOptions(opts DiskOptions) {
+	d.setOptions(opts)
+	select {
+	case d.changed <- struct{}{}:
+	default:
+	}
+}
+
+func (d *DiskWatchdog) setOptions(opts DiskOptions) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.opts = opts
+	d.status.Enabled = opts.Interval > 0
+	d.status.MinFreeBytes = opts.MinFreeBytes
+	if !d.status.Enabled && d.status.ReadOnly {
+		d.status.ReadOnly, d.status.Since = false, time.Now() // nothing would ever lift it
+	}
+}
+
+// Run checks the disk now and every interval until ctx is done. While the
+// interval is 0 it only waits for SetOptions to set one.
+func (d *DiskWatchdog) Run(ctx context.Context) {
+	for {
+		d.mu.Lock()
+		interval := d.opts.Interval
+		d.mu.Unlock()
+		var tick <-chan time.Time
+		if interval > 0 {
+			d.Check()
+			tick = time.After(interval)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-d.changed:
+		case <-tick:
+		}
+	}
+}
+
+// Check reads the free space and switches read-only on or off.
+func (d *DiskWatchdog) Check() {
+	free, total, err := diskSpace(d.status.Dir)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	st := &d.status
+	st.LastCheck = time.Now()
+	if err != nil {
+		if errors.Is(err, errors.ErrUnsupported) {
+			st.Enabled = false
+		}
+		st.LastError = err.Error() // keep the last verdict, a failed check says nothing about space
+		return
+	}
+	st.FreeBytes, st.TotalBytes, st.LastError = free, total, ""
+	minFree := d.opts.MinFreeBytes
+	switch {
+	case !st.ReadOnly && free < minFree:
+		st.ReadOnly, st.Since = true, st.LastCheck
+		fmt.Printf("Disk: %s free in %s, under the %s minimum, refusing writes until it frees up\n", formatBytes(free), st.Dir, formatBytes(minFree))
+	case st.ReadOnly && free >= minFree+minFree/10:
+		st.ReadOnly, st.Since = false, st.LastCheck
+		fmt.Printf("Disk: %s free in %s again, accepting writes\n", formatBytes(free), st.Dir)
+	}
+}
+
+// Status reports the last check.
+func (d *DiskWatchdog) Status() DiskStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.status
+}
+
+// refuse is the error for a write while the node is read-only, nil otherwise.
+func (d *DiskWatchdog) refuse() *Error {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.status.ReadOnly {
+		return nil
+	}
+	return newError(CodeReadOnly, "disk nearly full: %s free in %s is under the %s minimum, writes resume once space frees up",
+		formatBytes(d.status.FreeBytes), d.status.Dir, formatBytes(d.opts.MinFreeBytes))
+}
+
+// ReadOnly reports whether writes are being refused.
+func (d *DiskWatchdog) ReadOnly() bool {
+	return d.refuse() != nil
+}
+
+// SetDiskWatchdog makes writes fail with READONLY while w says the disk is
+// too full.
+func (s *Server) SetDiskWatchdog(w *DiskWatchdog) {
+	s.disk = w
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
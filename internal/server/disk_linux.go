@@ -0,0 +1,13 @@
+package server
+
+import "syscall"
+
+// diskSpace reports the bytes free to unprivileged writers and the size of
+// the filesystem holding dir.
+func diskSpace(dir string) (free, total int64, err error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, 0, err
+	}
+	return int64(st.Bavail) * st.Bsize, int64(st.Blocks) * st.Bsize, nil
+}
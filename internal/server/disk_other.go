@@ -0,0 +1,9 @@
+//go:build !linux
+
+package server
+
+import "errors"
+
+func diskSpace(dir string) (free, total int64, err error) {
+	return 0, 0, errors.ErrUnsupported
+}
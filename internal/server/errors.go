@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/mathdee/KV-Store/internal/protocol"
+	"github.com/mathdee/KV-Store/internal/raft"
+)
+
+// Error replies carry a code clients can branch on instead of matching
+// text. A connection that negotiated PROTOCOL 2 or later gets
+//
+//	ERR_<CODE> <text>
+//
+// while older clients keep getting what they always did, "NOTLEADER" or
+// "ERR <text>", so none of them mistakes the new form for a value.
+type Code string
+
+const (
+	CodeNotLeader    Code = "NOTLEADER"    // writes go to the leader, which this node isn't (anymore)
+	CodeTimeout      Code = "TIMEOUT"      // gave up at the request deadline, the write may still be applied
+	CodeNotCommitted Code = "NOTCOMMITTED" // lost leadership or the log was cleared before a majority had the entry
+	CodeIO           Code = "IO"           // the WAL or a snapshot couldn't be written
+	CodeTooLarge     Code = "TOOLARGE"     // key, value or command line over the limits
+	CodeSyntax       Code = "SYNTAX"       // wrong arguments for the command
+	CodeUnknown      Code = "UNKNOWNCMD"   // no such command
+	CodeNoKey        Code = "NOKEY"        // the command needs a key that doesn't exist
+	CodeWitness      Code = "WITNESS"      // a witness holds no data to read or write
+	CodeBadToken     Code = "BADTOKEN"     // FLUSHALL/FLUSHNS confirmation token invalid or expired
+	CodeNoClient     Code = "NOCLIENT"     // CLIENT KILL found no connection from that address
+	CodeProtocol     Code = "PROTOCOL"     // protocol version not supported
+	CodeQuota        Code = "QUOTA"        // the write would take a namespace over its key or byte quota
+	CodeRateLimit    Code = "RATELIMIT"    // the namespace is writing faster than its quota allows, retry later
+	CodeReadOnly     Code = "READONLY"     // the node's disk is nearly full, writes resume once space frees up
+	CodeScript       Code = "SCRIPT"       // an EVAL script failed, nothing it wrote was kept
+	CodeLocked       Code = "LOCKED"       // ACQUIRE found the lock held by another owner
+	CodeDisabled     Code = "DISABLED"     // the command is turned off on this node
+)
+
+// errorCodesVersion is the client protocol version that introduced codes.
+const errorCodesVersion = 2
+
+// Error is an error reply.
+type Error struct {
+	Code Code
+	Text string
+}
+
+func newError(code Code, format string, args ...any) *Error {
+	return &Error{Code: code, Text: fmt.Sprintf(format, args...)}
+}
+
+func (e *Error) Error() string {
+	return e.Text
+}
+
+// reply renders e for a connection speaking the given client protocol version.
+func (e *Error) reply(version int) string {
+	if version >= errorCodesVersion {
+		return protocol.ErrorReply(string(e.Code), e.Text)
+	}
+	if e.Code == CodeNotLeader {
+		return "NOTLEADER"
+	}
+	return "ERR " + e.Text
+}
+
+var (
+	errNotLeader = newError(CodeNotLeader, "not the leader")
+	errNoSuchKey = newError(CodeNoKey, "no such key")
+)
+
+// writeError sends e in the protocol version conn negotiated.
+func writeError(conn net.Conn, e *Error) {
+	version := 1
+	if cc, ok := conn.(*clientConn); ok {
+		version = cc.protocolVersion()
+		cc.failure = e.Code
+	}
+	fmt.Fprintln(conn, e.reply(version))
+}
+
+// commitFailure classifies why a proposed write wasn't acked.
+func commitFailure(err error) *Error {
+	switch {
+	case errors.Is(err, errCommitTimeout), errors.Is(err, context.DeadlineExceeded):
+		return newError(CodeTimeout, "not committed: %v", err)
+	case errors.Is(err, raft.ErrNotLeader):
+		return errNotLeader
+	case errors.Is(err, raft.ErrNotPersisted):
+		return newError(CodeIO, "not committed: %v", err)
+	default:
+		return newError(CodeNotCommitted, "not committed: %v", err)
+	}
+}
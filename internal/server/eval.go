@@ -0,0 +1,87 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	"github.com/mathdee/KV-Store/internal/protocol"
+	"github.com/mathdee/KV-Store/internal/script"
+	"github.com/mathdee/KV-Store/internal/store"
+)
+
+// EVAL runs a script against the store in one step:
+//
+//	EVAL numkeys key... numargs arg... script
+//
+// The script, see the script package, comes last so it can hold spaces.
+// The entry in the raft log is the command itself, so every node compiles
+// and runs the script, under the store lock, and arrives at the same
+// writes, which go to the WAL as one unit. A script that doesn't compile
+// is refused before it is proposed, one that fails running is committed
+// without having written anything and answers SCRIPT.
+
+// evalCommand is an EVAL line taken apart.
+type evalCommand struct {
+	keys, args []string
+	script     *script.Script
+}
+
+// evalKeyArgs are the positions of EVAL's keys, none if the line is malformed.
+func evalKeyArgs(parts protocol.Command) []int {
+	n, err := parts.Int(1)
+	if err != nil || n < 0 || n > len(parts)-2 {
+		return nil
+	}
+	keys := make([]int, n)
+	for i := range keys {
+		keys[i] = 2 + i
+	}
+	return keys
+}
+
+func parseEval(parts protocol.Command) (evalCommand, *Error) {
+	usage := newError(CodeSyntax, "usage: EVAL numkeys key... numargs arg... script")
+	numKeys, err := parts.Int(1)
+	if err != nil || numKeys < 0 || 2+numKeys >= len(parts) {
+		return evalCommand{}, usage
+	}
+	at := 2 + numKeys
+	numArgs, err := strconv.Atoi(parts[at])
+	if err != nil || numArgs < 0 || at+1+numArgs >= len(parts) {
+		return evalCommand{}, usage
+	}
+	e := evalCommand{keys: parts[2:at], args: parts[at+1 : at+1+numArgs]}
+	if e.script, err = script.Compile(parts.Rest(at + 1 + numArgs)); err != nil {
+		return evalCommand{}, newError(CodeSyntax, "%v", err)
+	}
+	return e, nil
+}
+
+func (s *Server) handleEval(r *request) outcome {
+	if _, err := parseEval(r.parts); err != nil {
+		writeError(r.conn, err)
+		return answered
+	}
+	return s.replicate(r, r.parts.String())
+}
+
+// applyEval runs an EVAL entry. A script that fails is the command's
+// answer, not a failed write.
+func (s *Server) applyEval(ctx context.Context, parts protocol.Command) (string, error) {
+	e, perr := parseEval(parts)
+	if perr != nil {
+		return "", perr
+	}
+	var reply string
+	err := s.store.Update(ctx, func(tx *store.Tx) error {
+		var err error
+		reply, err = e.script.Run(tx, e.keys, e.args)
+		return err
+	})
+	var serr *script.Error
+	if errors.As(err, &serr) {
+		return "", newError(CodeScript, "%v", serr)
+	}
+	return reply, err
+}
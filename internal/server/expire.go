@@ -0,0 +1,72 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/mathdee/KV-Store/internal/raft"
+)
+
+// Keys whose TTL ran out are removed by the leader, through the log like
+// any write: every expireInterval it proposes one BATCH of expire ops for
+// the keys that are due. An expire only deletes a key that still has the
+// expiry it was proposed for, so a key rewritten in the meantime survives.
+// Until the entry is applied, reads already treat an expired key as gone.
+// Followers never remove a key by their own clock, only by applying the
+// leader's entries, so every node deletes the same keys at the same index.
+// The store keeps expiries in time order (see Store.Expired), so a round
+// costs about as much as the keys it expires, and a full batch is followed
+// by the next one straight away rather than a second later.
+
+const expireInterval = time.Second
+
+// RunExpiry expires keys while this node leads, until ctx ends.
+func (s *Server) RunExpiry(ctx context.Context) {
+	ticker := s.clock.NewTicker(expireInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+		for s.expireDue(ctx) && ctx.Err() == nil {
+			// a full batch went through, more may be due already
+		}
+	}
+}
+
+// expireDue proposes one BATCH expiring keys that are due, and reports
+// whether it was full, so there may be more.
+func (s *Server) expireDue(ctx context.Context) bool {
+	if s.raft.GetState() != raft.Leader || s.raft.IsPaused() || s.disk.ReadOnly() {
+		return false
+	}
+	due := s.store.Expired(s.clock.Now(), maxBatchOps)
+	if len(due) == 0 {
+		return false
+	}
+	ops := make([]BatchOp, len(due))
+	for i, e := range due {
+		ops[i] = BatchOp{Op: "expire", Key: e.Key, ExpiresAt: e.At}
+	}
+	command, cerr := s.batchCommand(ops)
+	for cerr != nil && cerr.Code == CodeTooLarge && len(ops) > 1 {
+		ops = ops[:len(ops)/2] // long keys, the rest go next round
+		command, cerr = s.batchCommand(ops)
+	}
+	if cerr != nil {
+		fmt.Printf("[%s] Expiring %d keys: %v\n", s.raft.ID, len(due), cerr)
+		return false
+	}
+	wctx, cancel := context.WithTimeout(ctx, s.RequestTimeout())
+	defer cancel()
+	_, index, _, err := s.write(wctx, command)
+	if err != nil {
+		fmt.Printf("[%s] Expiring %d keys: %v\n", s.raft.ID, len(due), err)
+		return false
+	}
+	fmt.Printf("[%s] Expired %d keys at index %d\n", s.raft.ID, len(ops), index)
+	return len(due) == maxBatchOps
+}
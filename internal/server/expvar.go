@@ -0,0 +1,34 @@
+package server
+
+import (
+	"expvar"
+
+	"github.com/mathdee/KV-Store/internal/raft"
+	"github.com/mathdee/KV-Store/internal/wal"
+)
+
+// PublishExpvar exposes the core counters under the "kvstore" expvar map, so
+// /debug/vars can be read by existing Go tooling. Call it once per process.
+func PublishExpvar(m *Metrics, r *raft.Consensus, w *wal.WAL) {
+	vars := expvar.NewMap("kvstore")
+
+	vars.Set("requests_total", expvar.Func(func() any {
+		total, _, _ := m.Counts()
+		return total
+	}))
+	vars.Set("requests_success", expvar.Func(func() any {
+		_, success, _ := m.Counts()
+		return success
+	}))
+	vars.Set("requests_failed", expvar.Func(func() any {
+		_, _, fail := m.Counts()
+		return fail
+	}))
+	vars.Set("raft_state", expvar.Func(func() any { return r.GetState() }))
+	vars.Set("raft_term", expvar.Func(func() any { return r.GetTerm() }))
+	vars.Set("raft_commit_index", expvar.Func(func() any { return r.GetCommitIndex() }))
+	vars.Set("raft_log_length", expvar.Func(func() any { return r.GetLogLength() }))
+	vars.Set("raft_replication", expvar.Func(func() any { return r.ReplicationStatus() }))
+	vars.Set("wal_flushes", expvar.Func(func() any { return w.Flushes() }))
+	vars.Set("wal_batches", expvar.Func(func() any { return w.CommitStats() }))
+}
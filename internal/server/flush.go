@@ -0,0 +1,95 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// FLUSHALL and FLUSHNS wipe data, so they need a second step: the first call
+// returns "CONFIRM <token>" and only repeating the command with that token
+// (or with --force) runs it. Tokens expire after confirmTTL.
+
+const confirmTTL = 30 * time.Second
+
+type pendingConfirm struct {
+	command string
+	expires time.Time
+}
+
+type confirmTokens struct {
+	mu     sync.Mutex
+	tokens map[string]pendingConfirm
+}
+
+func newConfirmTokens() *confirmTokens {
+	return &confirmTokens{tokens: make(map[string]pendingConfirm)}
+}
+
+// issue returns a token that confirms exactly this command.
+func (c *confirmTokens) issue(command string) string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	token := hex.EncodeToString(buf)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for t, p := range c.tokens {
+		if now.After(p.expires) {
+			delete(c.tokens, t)
+		}
+	}
+	c.tokens[token] = pendingConfirm{command: command, expires: now.Add(confirmTTL)}
+	return token
+}
+
+// redeem consumes a token, true only if it was issued for this command and is still valid.
+func (c *confirmTokens) redeem(token, command string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, ok := c.tokens[token]
+	if !ok {
+		return false
+	}
+	delete(c.tokens, token)
+	return p.command == command && time.Now().Before(p.expires)
+}
+
+// handleFlush runs FLUSHALL [token|--force] and FLUSHNS ns [token|--force].
+func (s *Server) handleFlush(ctx context.Context, conn net.Conn, parts []string) bool {
+	command, confirm := parts[0], ""
+	switch {
+	case parts[0] == "FLUSHALL" && len(parts) <= 2:
+		if len(parts) == 2 {
+			confirm = parts[1]
+		}
+	case parts[0] == "FLUSHNS" && (len(parts) == 2 || len(parts) == 3):
+		command = "FLUSHNS " + parts[1]
+		if len(parts) == 3 {
+			confirm = parts[2]
+		}
+	default:
+		writeError(conn, newError(CodeSyntax, "usage: FLUSHALL [token|--force] or FLUSHNS namespace [token|--force]"))
+		return false
+	}
+
+	if s.raft.GetState() != "Leader" {
+		writeError(conn, errNotLeader) // tokens are only issued where they can be used
+		return false
+	}
+	if confirm == "" {
+		fmt.Fprintf(conn, "CONFIRM %s\n", s.confirms.issue(command))
+		return false
+	}
+	if confirm != "--force" && !s.confirms.redeem(confirm, command) {
+		writeError(conn, newError(CodeBadToken, "invalid or expired confirmation token"))
+		return false
+	}
+	_, ok := s.replicateWrite(ctx, conn, command)
+	return ok
+}
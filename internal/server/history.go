@@ -0,0 +1,100 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// MetricsHistory keeps the last few minutes of snapshots in a fixed-size ring,
+// so the dashboard can redraw its charts after a reload without any external storage.
+
+type HistorySample struct {
+	Timestamp int64 `json:"timestamp"` // unix milliseconds
+	MetricsSnapshot
+}
+
+type MetricsHistory struct {
+	mu         sync.Mutex
+	samples    []HistorySample
+	next       int  // slot the next sample goes into
+	full       bool // true once the ring has wrapped
+	resolution time.Duration
+	stopCh     chan struct{}
+}
+
+func newMetricsHistory(window, resolution time.Duration) *MetricsHistory {
+	size := int(window / resolution)
+	if size < 1 {
+		size = 1
+	}
+	return &MetricsHistory{
+		samples:    make([]HistorySample, size),
+		resolution: resolution,
+		stopCh:     make(chan struct{}),
+	}
+}
+
+func (h *MetricsHistory) add(sample HistorySample) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.samples[h.next] = sample
+	h.next = (h.next + 1) % len(h.samples)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// Samples returns the recorded snapshots, oldest first.
+func (h *MetricsHistory) Samples() []HistorySample {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.full {
+		out := make([]HistorySample, h.next)
+		copy(out, h.samples[:h.next])
+		return out
+	}
+	out := make([]HistorySample, 0, len(h.samples))
+	out = append(out, h.samples[h.next:]...)
+	return append(out, h.samples[:h.next]...)
+}
+
+// StartHistory samples the metrics every resolution and keeps window worth of them.
+func (m *Metrics) StartHistory(window, resolution time.Duration) {
+	if resolution <= 0 || window <= 0 {
+		return
+	}
+	h := newMetricsHistory(window, resolution)
+
+	m.mu.Lock()
+	if m.history != nil {
+		close(m.history.stopCh) // restart with the new settings
+	}
+	m.history = h
+	clk := m.clock
+	m.mu.Unlock()
+
+	go func() {
+		ticker := clk.NewTicker(resolution)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C():
+				h.add(HistorySample{Timestamp: now.UnixMilli(), MetricsSnapshot: m.GetSnapshot()})
+			case <-h.stopCh:
+				return
+			}
+		}
+	}()
+}
+
+// History returns the recorded samples, or nil when history is off.
+func (m *Metrics) History() []HistorySample {
+	m.mu.Lock()
+	h := m.history
+	m.mu.Unlock()
+	if h == nil {
+		return nil
+	}
+	return h.Samples()
+}
@@ -0,0 +1,220 @@
+package server
+
+import (
+	"cmp"
+	"fmt"
+	"hash/maphash"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Hot-key detection finds the few keys a skewed workload keeps hitting
+// without a counter per key: one client access in the sample rate feeds a
+// count-min sketch, one for reads and one for writes, and next to each sits
+// a small table of the keys with the highest estimates. Every
+// hotKeysHalfLife all counts are halved, so the tables follow the current
+// load rather than the whole uptime. Estimates are scaled by the sample
+// rate, and can only be too high, by about the traffic of the keys that
+// share counters with a key.
+
+const (
+	hotKeysDepth    = 4    // counters per key, one in each row
+	hotKeysWidth    = 2048 // counters per row
+	hotKeysTracked  = 128  // keys in each table, the most HOTKEYS returns
+	hotKeysHalfLife = time.Minute
+)
+
+// DefaultHotKeysSampleRate samples one client access in 16.
+const DefaultHotKeysSampleRate = 16
+
+type HotKey struct {
+	Key   string `json:"key"`
+	Count uint64 `json:"count"` // estimated accesses, halved every minute
+}
+
+// HotKeysReport is what HOTKEYS and /hotkeys return.
+type HotKeysReport struct {
+	SampleRate int      `json:"sampleRate"` // one access in this many is counted, 0 while disabled
+	Reads      []HotKey `json:"reads"`      // hottest first
+	Writes     []HotKey `json:"writes"`
+}
+
+type HotKeys struct {
+	rate    atomic.Int64 // sample one access in rate, 0 disables
+	seed    maphash.Seed
+	mu      sync.Mutex
+	reads   *sketch
+	writes  *sketch
+	decayed time.Time // when counts were last halved
+}
+
+// sketch is a count-min sketch plus the keys it estimates highest.
+type sketch struct {
+	counts [hotKeysDepth][hotKeysWidth]uint64
+	top    map[string]uint64
+}
+
+func NewHotKeys(sampleRate int) *HotKeys {
+	h := &HotKeys{seed: maphash.MakeSeed(), reads: newSketch(), writes: newSketch(), decayed: time.Now()}
+	h.SetSampleRate(sampleRate)
+	return h
+}
+
+func newSketch() *sketch {
+	return &sketch{top: make(map[string]uint64, hotKeysTracked)}
+}
+
+// SetSampleRate counts one access in rate from now on; 0 or less disables
+// sampling and 1 counts every access.
+func (h *HotKeys) SetSampleRate(rate int) {
+	h.rate.Store(int64(max(rate, 0)))
+}
+
+// Observe counts an access to key, if it is sampled.
+func (h *HotKeys) Observe(key string, write bool) {
+	rate := h.rate.Load()
+	if rate <= 0 || (rate > 1 && rand.Int64N(rate) != 0) {
+		return
+	}
+	sum := maphash.String(h.seed, key) // outside the lock, it is the expensive part
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if now := time.Now(); now.Sub(h.decayed) >= hotKeysHalfLife {
+		h.reads.halve()
+		h.writes.halve()
+		h.decayed = now
+	}
+	s := h.reads
+	if write {
+		s = h.writes
+	}
+	s.add(key, sum, uint64(rate)) // one sample stands for rate accesses
+}
+
+// observeCommand counts the keys a client command touches, the arguments
+// at positions keys.
+func (h *HotKeys) observeCommand(parts []string, keys []int, write bool) {
+	for _, i := range keys {
+		if i < len(parts) {
+			h.Observe(parts[i], write)
+		}
+	}
+}
+
+func (s *sketch) add(key string, sum uint64, n uint64) {
+	// Each row's counter comes from the one hash, h1 + i*h2, which is as
+	// good as independent hashes for a sketch.
+	h1, h2 := uint32(sum), uint32(sum>>32)|1
+	estimate := ^uint64(0)
+	for i := range s.counts {
+		c := &s.counts[i][(h1+uint32(i)*h2)%hotKeysWidth]
+		*c += n
+		estimate = min(estimate, *c)
+	}
+	if _, ok := s.top[key]; ok || len(s.top) < hotKeysTracked {
+		s.top[key] = estimate
+		return
+	}
+	coldest, least := "", estimate
+	for k, c := range s.top {
+		if c < least {
+			coldest, least = k, c
+		}
+	}
+	if coldest != "" { // key is now hotter than the coldest tracked one
+		delete(s.top, coldest)
+		s.top[key] = estimate
+	}
+}
+
+func (s *sketch) halve() {
+	for i := range s.counts {
+		for j := range s.counts[i] {
+			s.counts[i][j] >>= 1
+		}
+	}
+	for k, c := range s.top {
+		if c >>= 1; c == 0 {
+			delete(s.top, k)
+		} else {
+			s.top[k] = c
+		}
+	}
+}
+
+// hottest returns up to n tracked keys, highest estimate first.
+func (s *sketch) hottest(n int) []HotKey {
+	out := make([]HotKey, 0, len(s.top))
+	for k, c := range s.top {
+		out = append(out, HotKey{Key: k, Count: c})
+	}
+	slices.SortFunc(out, func(a, b HotKey) int {
+		return cmp.Or(cmp.Compare(b.Count, a.Count), strings.Compare(a.Key, b.Key))
+	})
+	return out[:min(n, len(out))]
+}
+
+// Top returns up to n of the hottest keys by reads and by writes; n <= 0
+// returns every tracked key.
+func (h *HotKeys) Top(n int) HotKeysReport {
+	if n <= 0 {
+		n = hotKeysTracked
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return HotKeysReport{SampleRate: int(h.rate.Load()), Reads: h.reads.hottest(n), Writes: h.writes.hottest(n)}
+}
+
+// Reset forgets every count.
+func (h *HotKeys) Reset() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.reads, h.writes, h.decayed = newSketch(), newSketch(), time.Now()
+}
+
+// SetHotKeys replaces the default tracker (one access in
+// DefaultHotKeysSampleRate).
+func (s *Server) SetHotKeys(h *HotKeys) {
+	s.hotkeys = h
+}
+
+func (s *Server) GetHotKeys() *HotKeys {
+	return s.hotkeys
+}
+
+// handleHotKeys serves HOTKEYS [n] | RESET. The reply is the number of keys
+// on one line followed by one line per key, reads first, hottest first:
+// "read|write estimated-count key".
+func (s *Server) handleHotKeys(conn net.Conn, parts []string) {
+	switch {
+	case len(parts) == 2 && strings.ToUpper(parts[1]) == "RESET":
+		s.hotkeys.Reset()
+		fmt.Fprintln(conn, "OK")
+	case len(parts) <= 2:
+		n := 10 // same default as SLOWLOG GET
+		if len(parts) == 2 {
+			var err error
+			if n, err = strconv.Atoi(parts[1]); err != nil || n < 1 {
+				writeError(conn, newError(CodeSyntax, "usage: HOTKEYS [n] | RESET"))
+				return
+			}
+		}
+		top := s.hotkeys.Top(n)
+		fmt.Fprintln(conn, len(top.Reads)+len(top.Writes))
+		for _, k := range top.Reads {
+			fmt.Fprintf(conn, "read %d %s\n", k.Count, k.Key)
+		}
+		for _, k := range top.Writes {
+			fmt.Fprintf(conn, "write %d %s\n", k.Count, k.Key)
+		}
+	default:
+		writeError(conn, newError(CodeSyntax, "usage: HOTKEYS [n] | RESET"))
+	}
+}
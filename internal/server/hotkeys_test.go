@@ -0,0 +1,121 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHotKeysFindTheHottest(t *testing.T) {
+	h := NewHotKeys(1) // every access counts
+	for range 1000 {
+		h.Observe("hot", false)
+	}
+	for range 100 {
+		h.Observe("warm", false)
+	}
+	for i := range 200 {
+		h.Observe(fmt.Sprintf("cold%d", i), false)
+	}
+	for range 5 {
+		h.Observe("written", true)
+	}
+
+	top := h.Top(2)
+	if len(top.Reads) != 2 || top.Reads[0].Key != "hot" || top.Reads[1].Key != "warm" {
+		t.Fatalf("expected hot then warm, got %+v", top.Reads)
+	}
+	// A count-min sketch only ever overestimates.
+	if top.Reads[0].Count < 1000 || top.Reads[1].Count < 100 {
+		t.Errorf("expected estimates of at least the true counts, got %+v", top.Reads)
+	}
+	if len(top.Writes) != 1 || top.Writes[0].Key != "written" || top.Writes[0].Count < 5 {
+		t.Errorf("expected writes counted apart from reads, got %+v", top.Writes)
+	}
+	if all := h.Top(0); len(all.Reads) != hotKeysTracked {
+		t.Errorf("expected the table to hold %d keys, got %d", hotKeysTracked, len(all.Reads))
+	}
+}
+
+func TestHotKeysTableEvictsTheColdest(t *testing.T) {
+	h := NewHotKeys(1)
+	for i := range hotKeysTracked {
+		h.Observe(fmt.Sprintf("k%d", i), false)
+		h.Observe(fmt.Sprintf("k%d", i), false)
+	}
+	for range 10 {
+		h.Observe("newcomer", false)
+	}
+	all := h.Top(0).Reads
+	if len(all) != hotKeysTracked || all[0].Key != "newcomer" {
+		t.Fatalf("expected the newcomer to take a cold key's place, got %d keys, hottest %+v", len(all), all[0])
+	}
+}
+
+func TestHotKeysDecay(t *testing.T) {
+	h := NewHotKeys(1)
+	for range 1000 {
+		h.Observe("hot", false)
+	}
+	h.Observe("once", false)
+
+	h.decayed = time.Now().Add(-hotKeysHalfLife) // a half-life has passed
+	h.Observe("hot", false)
+	top := h.Top(0).Reads
+	if len(top) != 1 || top[0].Key != "hot" {
+		t.Fatalf("expected a key halved to nothing to drop out, got %+v", top)
+	}
+	if c := top[0].Count; c < 501 || c > 600 {
+		t.Errorf("expected hot's count halved to about 501, got %d", c)
+	}
+}
+
+func TestHotKeysSampling(t *testing.T) {
+	h := NewHotKeys(0)
+	h.Observe("k", false)
+	if top := h.Top(0); top.SampleRate != 0 || len(top.Reads) != 0 {
+		t.Fatalf("expected nothing counted while disabled, got %+v", top)
+	}
+	h.SetSampleRate(4)
+	for range 400 {
+		h.Observe("k", false)
+	}
+	top := h.Top(0)
+	if len(top.Reads) != 1 || top.Reads[0].Count%4 != 0 || top.Reads[0].Count == 0 {
+		t.Errorf("expected each sample to stand for 4 accesses, got %+v", top.Reads)
+	}
+}
+
+func TestHotKeysCommand(t *testing.T) {
+	srv, addr := testServer(t)
+	srv.SetHotKeys(NewHotKeys(1))
+	c := dialTest(t, addr)
+	c.do("PROTOCOL 2")
+	c.do("SET w v")
+	for range 3 {
+		c.do("GET r")
+	}
+
+	if n := c.do("HOTKEYS 1"); n != "2" {
+		t.Fatalf("expected a read and a write, got %q", n)
+	}
+	if line := c.read(); line != "read 3 r" {
+		t.Errorf("expected the read line, got %q", line)
+	}
+	if line := c.read(); line != "write 1 w" {
+		t.Errorf("expected the write line, got %q", line)
+	}
+
+	if reply := c.do("HOTKEYS RESET"); reply != "OK" {
+		t.Fatalf("expected OK, got %q", reply)
+	}
+	if n := c.do("HOTKEYS"); n != "0" {
+		t.Errorf("expected nothing after a reset, got %q", n)
+	}
+	for _, bad := range []string{"HOTKEYS 0", "HOTKEYS many", "HOTKEYS 1 2"} {
+		if reply := c.do(bad); !strings.HasPrefix(reply, "ERR_SYNTAX ") {
+			t.Errorf("%s: expected a syntax error, got %q", bad, reply)
+		}
+	}
+}
@@ -1,218 +1,810 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
-	"sort"
+	"path/filepath"
 	"strconv"
-	"sync"
+	"strings"
 	"sync/atomic"
 	"time"
 
+	"github.com/mathdee/KV-Store/internal/cdc"
+	"github.com/mathdee/KV-Store/internal/certs"
+	"github.com/mathdee/KV-Store/internal/config"
+	"github.com/mathdee/KV-Store/internal/crash"
+	"github.com/mathdee/KV-Store/internal/failpoint"
 	"github.com/mathdee/KV-Store/internal/raft"
 	"github.com/mathdee/KV-Store/internal/store"
+	"github.com/mathdee/KV-Store/internal/tracing"
 )
 
 type HTTPServer struct {
-	raft    *raft.Consensus // this turns into a pointer to the consensus struct in the file raft.go
-	metrics *Metrics
-	store   *store.Store
+	raft        *raft.Consensus // this turns into a pointer to the consensus struct in the file raft.go
+	metrics     *Metrics
+	store       Store
+	history     *BenchmarkHistory                  // past benchmark runs, kept in the data directory
+	slowlog     *Slowlog                           // shared with the TCP server, nil until SetSlowlog
+	info        func(section string) []InfoSection // the TCP server's INFO, nil until SetInfo
+	cdc         *cdc.Pipeline                      // change data capture, nil unless -cdc is set
+	compact     *Compactor                         // background WAL compaction, nil until SetCompactor
+	disk        *DiskWatchdog                      // free space in the data directory, nil until SetDiskWatchdog
+	reload      func() (config.Result, error)      // re-reads the -config file, nil until SetConfigReload
+	tls         *certs.Reloader                    // how the network benchmark dials nodes, nil for plain TCP
+	clients     func() []ClientInfo                // the TCP server's connections, nil until SetClients
+	accessLog   *AccessLog                         // nil unless -access-log is set
+	corsOptions atomic.Pointer[CORSOptions]        // DefaultCORSOptions unless SetCORS is called
+	authOptions atomic.Pointer[AuthOptions]        // no tokens, everything open, unless SetAuth is called
+	audit       *auditLog                          // the latest admin requests
+	save        func() (SaveResult, error)         // the TCP server's SAVE, nil until SetSnapshot
+	changes     ChangeFeed                         // what /watch reads, nil until SetChangeFeed
+	batch       BatchFunc                          // the TCP server's Batch, nil until SetBatch
+	hotkeys     *HotKeys                           // shared with the TCP server, nil until SetHotKeys
+	cache       *Cache                             // cache mode, nil unless SetCache is called
+	waitIndex   func(context.Context, int) *Error  // the TCP server's WaitIndex, nil until SetSessions
+	tenants     func() []TenantStatus              // the TCP server's Tenants, nil until SetTenants
+	digests     func() DigestStatus                // the TCP server's DigestStatus, nil until SetDigests
+	apply       func() ApplyStats                  // the TCP server's ApplyStats, nil until SetApplyStats
+	resync      ResyncFunc                         // the TCP server's Resync, nil until SetResync
 }
 
+// KVResponse is what GET /kv/{key} returns: the value plus its metadata.
+type KVResponse struct {
+	Key       string        `json:"key"`
+	Value     string        `json:"value"`
+	Meta      store.KeyMeta `json:"meta"`
+	ExpiresAt string        `json:"expiresAt,omitempty"` // keys written with a ttl
+	TTLMs     int64         `json:"ttlMs,omitempty"`     // time left until then
+}
+
+// ttlHeader carries a PUT's ttl when it isn't in the query.
+const ttlHeader = "X-KV-TTL"
+
+// maxPutBytes bounds the body of a PUT, the value limit is checked after.
+const maxPutBytes = 64 << 20
+
 type StatusResponse struct {
-	State       string `json:"state"`       //leader, follower, candidate
-	Term        int    `json:"term"`        // current term number
-	ID          string `json:"id"`          // ID of curr server
-	LogLength   int    `json:"logLength"`   // number of log entries
-	CommitIndex int    `json:"commitIndex"` // index of commited entries
-	Paused      bool   `json:"paused"`      // true if node is paused
+	State       string `json:"state"`             //leader, follower, candidate
+	Term        int    `json:"term"`              // current term number
+	ID          string `json:"id"`                // ID of curr server
+	LogLength   int    `json:"logLength"`         // number of log entries
+	CommitIndex int    `json:"commitIndex"`       // index of commited entries
+	Paused      bool   `json:"paused"`            // true if node is paused
+	Witness     bool   `json:"witness,omitempty"` // votes but stores no data and never leads
+	Leader      string `json:"leader,omitempty"`  // who leads the current term, if we know
+
+	Quorum raft.QuorumStatus `json:"quorum"`          // voters, the majority they need, and how many we reach
+	Peers  []raft.PeerCheck  `json:"peers,omitempty"` // what the boot handshake with each peer found
+
+	Compaction *CompactionStatus    `json:"compaction,omitempty"` // background compaction progress
+	Disk       *DiskStatus          `json:"disk,omitempty"`       // free space, and whether writes are refused for lack of it
+	Election   *raft.ElectionRecord `json:"election,omitempty"`   // our latest candidacy, with who voted no and why
+}
+
+// ClusterResponse is what /cluster returns: this node's raft position and,
+// on the leader, how replication to each follower is going.
+type ClusterResponse struct {
+	ID          string            `json:"id"`
+	State       string            `json:"state"`
+	Term        int               `json:"term"`
+	LogLength   int               `json:"logLength"`
+	CommitIndex int               `json:"commitIndex"`
+	Leader      string            `json:"leader,omitempty"` // who leads the current term, if we know
+	Peers       []raft.PeerStatus `json:"peers"`
+}
+
+// httpAddr maps a node's TCP address to its HTTP address (TCP port + 1000).
+func httpAddr(tcpAddr string) string {
+	host, port, err := net.SplitHostPort(tcpAddr)
+	if err != nil {
+		return tcpAddr
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return tcpAddr
+	}
+	return net.JoinHostPort(host, strconv.Itoa(p+1000))
+}
+
+func NewHTTPServer(r *raft.Consensus, m *Metrics, s Store) *HTTPServer {
+	h := &HTTPServer{raft: r, metrics: m, store: s, history: NewBenchmarkHistory(benchmarkHistoryFile), audit: newAuditLog(256)}
+	h.SetCORS(DefaultCORSOptions)
+	h.SetAuth(AuthOptions{})
+	return h
+}
+
+// SetDataDir moves files the HTTP server keeps (benchmark history) into dir.
+func (h *HTTPServer) SetDataDir(dir string) {
+	h.history = NewBenchmarkHistory(filepath.Join(dir, benchmarkHistoryFile))
+}
+
+// SetSlowlog serves the TCP server's slowlog on /slowlog.
+func (h *HTTPServer) SetSlowlog(l *Slowlog) {
+	h.slowlog = l
+}
+
+// SetHotKeys counts reads through GET /kv in the TCP server's tracker and
+// serves it on /hotkeys.
+func (h *HTTPServer) SetHotKeys(k *HotKeys) {
+	h.hotkeys = k
+}
+
+// SetCache reads GET /kv misses through c and reports it on /cache.
+func (h *HTTPServer) SetCache(c *Cache) {
+	h.cache = c
+}
+
+// SetInfo serves the TCP server's INFO sections on /info.
+func (h *HTTPServer) SetInfo(info func(section string) []InfoSection) {
+	h.info = info
+}
+
+// SetCDC reports the change data capture pipeline on /cdc.
+func (h *HTTPServer) SetCDC(p *cdc.Pipeline) {
+	h.cdc = p
+}
+
+// SetCompactor reports background compaction on /status.
+func (h *HTTPServer) SetCompactor(c *Compactor) {
+	h.compact = c
 }
 
-type BenchmarkResult struct {
-	TotalRequests int64   `json:"totalRequests"`
-	Successful    int64   `json:"successful"`
-	Failed        int64   `json:"failed"`
-	DurationMs    float64 `json:"durationMs"`
-	Throughput    float64 `json:"throughput"`
-	LatencyAvgMs  float64 `json:"latencyAvgMs"`
-	LatencyP50Ms  float64 `json:"latencyP50Ms"`
-	LatencyP95Ms  float64 `json:"latencyP95Ms"`
-	LatencyP99Ms  float64 `json:"latencyP99Ms"`
+// SetDiskWatchdog reports free disk space on /status.
+func (h *HTTPServer) SetDiskWatchdog(d *DiskWatchdog) {
+	h.disk = d
 }
 
-func NewHTTPServer(r *raft.Consensus, m *Metrics, s *store.Store) *HTTPServer {
-	return &HTTPServer{raft: r, metrics: m, store: s}
+// SetSnapshot enables POST /snapshot, usually with Server.Save.
+func (h *HTTPServer) SetSnapshot(save func() (SaveResult, error)) {
+	h.save = save
 }
 
+// SetClients enables /clients, usually with Server.Clients.
+func (h *HTTPServer) SetClients(clients func() []ClientInfo) {
+	h.clients = clients
+}
+
+// SetDigests reports state digest checks on /metrics, usually with
+// Server.DigestStatus.
+func (h *HTTPServer) SetDigests(status func() DigestStatus) {
+	h.digests = status
+}
+
+// SetApplyStats reports apply lag and batches on /metrics, usually with
+// Server.ApplyStats.
+func (h *HTTPServer) SetApplyStats(stats func() ApplyStats) {
+	h.apply = stats
+}
+
+// SetResync enables POST /resync, usually with Server.Resync.
+func (h *HTTPServer) SetResync(resync ResyncFunc) {
+	h.resync = resync
+}
+
+// SetConfigReload enables POST /config/reload.
+func (h *HTTPServer) SetConfigReload(reload func() (config.Result, error)) {
+	h.reload = reload
+}
+
+// status is what /status returns.
+func (h *HTTPServer) status() StatusResponse {
+	status := StatusResponse{
+		State:       h.raft.GetState(),
+		Term:        h.raft.GetTerm(),
+		ID:          h.raft.ID,
+		LogLength:   h.raft.GetLogLength(),
+		CommitIndex: h.raft.GetCommitIndex(),
+		Paused:      h.raft.IsPaused(), // include paused state in response
+		Witness:     h.raft.IsWitness(),
+		Leader:      h.raft.Leader(),
+		Quorum:      h.raft.QuorumStatus(),
+		Peers:       h.raft.PeerChecks(),
+	}
+	if h.compact != nil {
+		st := h.compact.Status()
+		status.Compaction = &st
+	}
+	if h.disk != nil {
+		st := h.disk.Status()
+		status.Disk = &st
+	}
+	if e := h.raft.LastElection(); e.Term > 0 {
+		status.Election = &e
+	}
+	return status
+}
+
+// metricsSnapshot is what /metrics returns.
+func (h *HTTPServer) metricsSnapshot() MetricsSnapshot {
+	snapshot := h.metrics.GetSnapshot()
+	compression := h.store.CompressionStats()
+	snapshot.Compression = &compression
+	interning := h.store.InternStats()
+	snapshot.Interning = &interning
+	batches := h.store.CommitStats()
+	snapshot.WAL = &batches
+	memory := h.store.MemoryStats()
+	snapshot.Memory = &memory
+	snapshot.Replication = h.raft.FlowStats()
+	if h.apply != nil {
+		apply := h.apply()
+		snapshot.Apply = &apply
+	}
+	if h.digests != nil {
+		digests := h.digests()
+		snapshot.Digest = &digests
+	}
+	return snapshot
+}
+
+// Start serves the HTTP API on port.
 func (h *HTTPServer) Start(port string) {
+	handler := h.Handler()
+	fmt.Printf("HTTP status server on %s\n", port)
+	http.ListenAndServe(port, handler) // listens on port and serves requests using the handler.
+}
+
+// Handler is the HTTP API with its middleware, what Start serves.
+func (h *HTTPServer) Handler() http.Handler {
 	mux := http.NewServeMux()
 
 	// GET /status - returns node status in a json.
 	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(h.status())
+	})
 
-		status := StatusResponse{
+	// GET /cluster - per-follower replication progress, for spotting lagging or stalled peers
+	mux.HandleFunc("/cluster", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ClusterResponse{
+			ID:          h.raft.ID,
 			State:       h.raft.GetState(),
 			Term:        h.raft.GetTerm(),
-			ID:          h.raft.ID,
 			LogLength:   h.raft.GetLogLength(),
 			CommitIndex: h.raft.GetCommitIndex(),
-			Paused:      h.raft.IsPaused(), // include paused state in response
-		}
-		json.NewEncoder(w).Encode(status)
+			Leader:      h.raft.Leader(),
+			Peers:       h.raft.ReplicationStatus(),
+		})
+	})
 
+	// GET /cluster/overview - every node's status and metrics plus replication lag, in one answer.
+	mux.HandleFunc("/cluster/overview", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(h.overview(r.Context(), r.Header.Get("Authorization")))
 	})
 
 	// GET /pause - pauses node for failover demo
 	mux.HandleFunc("/pause", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*") // allow dashboard cross-origin requests
-		h.raft.Pause()                                     // call Pause method on raft
-		w.Write([]byte("Node paused"))                     // send confirmation to client response
+		h.raft.Pause()                 // call Pause method on raft
+		w.Write([]byte("Node paused")) // send confirmation to client response
 	})
 
 	// GET /resume - resumes paused node operation
 	mux.HandleFunc("/resume", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*") // allow dashboard cross-origin requests
-		h.raft.Resume()                                    // call Resume method on raft
-		w.Write([]byte("Node resumed"))                    // send confirmation to client response
+		h.raft.Resume()                 // call Resume method on raft
+		w.Write([]byte("Node resumed")) // send confirmation to client response
 	})
 
 	// GET /metrics - returns performance metrics in json.
 	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(h.metricsSnapshot())
+	})
 
-		snapshot := h.metrics.GetSnapshot()
-		json.NewEncoder(w).Encode(snapshot)
+	// GET /metrics/history - returns recent metric snapshots, oldest first.
+	mux.HandleFunc("/metrics/history", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		samples := h.metrics.History()
+		if samples == nil {
+			samples = []HistorySample{} // encode as [] rather than null
+		}
+		json.NewEncoder(w).Encode(samples)
 	})
 
+	// GET /debug/vars - expvar counters for standard Go tooling.
+	mux.Handle("/debug/vars", expvar.Handler())
+
 	// POST /metrics/reset - clears metrics for fresh benchmark
 	mux.HandleFunc("/metrics/reset", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
 		h.metrics.Reset()
 		w.Write([]byte("Metrics reset"))
 	})
 
 	// POST /clear - clears data and metrics for fresh benchmark
 	mux.HandleFunc("/clear", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
 		h.raft.ClearLog() // Clear Raft log
 		h.metrics.Reset() // Reset metrics
 		w.Write([]byte("Data cleared"))
 	})
 
-	mux.HandleFunc("/benchmark", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
+	// GET /kv/{key}?minIndex= - reads a key from this node along with its
+	// metadata, once the node has applied minIndex.
+	mux.HandleFunc("GET /kv/{key}", func(w http.ResponseWriter, r *http.Request) {
+		if h.raft.IsWitness() {
+			http.Error(w, "witness node stores no data", http.StatusServiceUnavailable)
+			return
+		}
+		if !h.waitMinIndex(w, r) {
+			return
+		}
+		key := r.PathValue("key")
+		if h.changes != nil {
+			w.Header().Set(indexHeader, strconv.Itoa(h.changes.Applied()))
+		}
+		if h.hotkeys != nil {
+			h.hotkeys.Observe(key, false)
+		}
+		val, err := h.store.Get(key)
+		if err != nil && h.cache != nil {
+			v, found, ferr := h.cache.Fill(r.Context(), key)
+			if ferr != nil {
+				http.Error(w, ferr.Error(), http.StatusBadGateway)
+				return
+			}
+			if found {
+				val, err = v, nil
+			}
+		}
+		if err != nil {
+			http.Error(w, "key not found", http.StatusNotFound)
+			return
+		}
+		meta, _ := h.store.Stat(key)
+		res := KVResponse{Key: key, Value: val, Meta: meta}
+		if at, ok := h.store.ExpiresAt(key); ok {
+			res.ExpiresAt = at.UTC().Format(time.RFC3339Nano)
+			res.TTLMs = max(time.Until(at).Milliseconds(), 1) // 0 would read as no ttl
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	})
+
+	// PUT /kv/{key}?ttl=30s - writes the body as the value, expiring after the
+	// ttl (from the query or the X-KV-TTL header) if one is given.
+	mux.HandleFunc("PUT /kv/{key}", func(w http.ResponseWriter, r *http.Request) {
+		if h.batch == nil {
+			http.Error(w, "writes not enabled", http.StatusNotFound)
+			return
+		}
+		if h.redirectToLeader(w, r) {
+			return
+		}
+		value, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxPutBytes))
+		if err != nil {
+			http.Error(w, "reading the value: "+err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		ttl := r.URL.Query().Get("ttl")
+		if ttl == "" {
+			ttl = r.Header.Get(ttlHeader)
+		}
+		ctx, terr := idempotencyContext(r)
+		if terr != nil {
+			http.Error(w, terr.Error(), http.StatusBadRequest)
+			return
+		}
+		res, berr := h.batch(ctx, BatchRequest{Ops: []BatchOp{{Op: "put", Key: r.PathValue("key"), Value: string(value), TTL: ttl}}})
+		if berr != nil {
+			http.Error(w, berr.Error(), httpStatus(berr))
+			return
+		}
+		result := res.Results[0]
+		if !result.OK {
+			http.Error(w, result.Error, http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	})
+
+	// POST /kv/batch - {"atomic":true,"ops":[{"op":"put","key":"k","value":"v"},{"op":"delete","key":"k2"}]}.
+	mux.HandleFunc("POST /kv/batch", func(w http.ResponseWriter, r *http.Request) {
+		if h.batch == nil {
+			http.Error(w, "batch writes not enabled", http.StatusNotFound)
+			return
+		}
+		if h.redirectToLeader(w, r) {
+			return
+		}
+		var req BatchRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if r.URL.Query().Get("atomic") == "true" {
+			req.Atomic = true
+		}
+		ctx, terr := idempotencyContext(r)
+		if terr != nil {
+			http.Error(w, terr.Error(), http.StatusBadRequest)
+			return
+		}
+		res, err := h.batch(ctx, req)
+		if err != nil {
+			http.Error(w, err.Error(), httpStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	})
+
+	// GET /watch?key=|prefix=&fromRevision=&timeout=30s - long-polls for changes.
+	mux.HandleFunc("GET /watch", func(w http.ResponseWriter, r *http.Request) {
+		if h.changes == nil {
+			http.Error(w, "watch not enabled", http.StatusNotFound)
+			return
+		}
+		q, err := parseWatchQuery(r, h.changes.Applied())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		res, err := h.watch(r.Context(), q)
+		if errors.Is(err, errCompacted) {
+			http.Error(w, fmt.Sprintf("revision %d was compacted, the oldest left is %d", q.fromRevision, h.raft.FirstIndex()), http.StatusGone)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	})
+
+	// GET /info?section=replication - same key:value text as the INFO command.
+	mux.HandleFunc("/info", func(w http.ResponseWriter, r *http.Request) {
+		if h.info == nil {
+			http.Error(w, "info not enabled", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, line := range formatInfo(h.info(r.URL.Query().Get("section"))) {
+			fmt.Fprintln(w, line)
+		}
+	})
+
+	// GET /cdc - change data capture cursor and delivery counters.
+	mux.HandleFunc("/cdc", func(w http.ResponseWriter, r *http.Request) {
+		if h.cdc == nil {
+			http.Error(w, "cdc not enabled", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(h.cdc.Status())
+	})
+
+	// GET /cache - the write-behind cursor and read-through counters.
+	mux.HandleFunc("/cache", func(w http.ResponseWriter, r *http.Request) {
+		if h.cache == nil {
+			http.Error(w, "cache mode not enabled", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(h.cache.Status())
+	})
+
+	// GET /tenants - keys, bytes, quota and write counters of each namespace.
+	mux.HandleFunc("/tenants", func(w http.ResponseWriter, r *http.Request) {
+		if h.tenants == nil {
+			http.Error(w, "tenants not enabled", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(h.tenants())
+	})
+
+	// GET /locks - the locks ACQUIRE handed out that are still held, by key.
+	mux.HandleFunc("GET /locks", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(heldLocks(h.store))
+	})
+
+	// GET /clients - every open connection to the TCP port, like CLIENT LIST.
+	mux.HandleFunc("/clients", func(w http.ResponseWriter, r *http.Request) {
+		if h.clients == nil {
+			http.Error(w, "clients not enabled", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(h.clients())
+	})
+
+	// GET /crashes - the latest panics this node recovered from, oldest first, with their stacks.
+	mux.HandleFunc("GET /crashes", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(crash.Reports())
+	})
+
+	// GET /slowlog?n=10 - slowest recent commands, newest first (all of them without n).
+	mux.HandleFunc("/slowlog", func(w http.ResponseWriter, r *http.Request) {
+		if h.slowlog == nil {
+			http.Error(w, "slowlog not enabled", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(h.slowlog.Get(parseInt(r.URL.Query().Get("n"))))
+	})
+
+	// POST /slowlog/reset - empties the slowlog.
+	mux.HandleFunc("/slowlog/reset", func(w http.ResponseWriter, r *http.Request) {
+		if h.slowlog == nil {
+			http.Error(w, "slowlog not enabled", http.StatusNotFound)
+			return
+		}
+		h.slowlog.Reset()
+		w.Write([]byte("Slowlog reset"))
+	})
+
+	// GET /hotkeys?n=10 - the most read and written keys lately, like HOTKEYS.
+	mux.HandleFunc("/hotkeys", func(w http.ResponseWriter, r *http.Request) {
+		if h.hotkeys == nil {
+			http.Error(w, "hotkeys not enabled", http.StatusNotFound)
+			return
+		}
+		n := 10
+		if raw := r.URL.Query().Get("n"); raw != "" {
+			n = parseInt(raw)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(h.hotkeys.Top(n))
+	})
+
+	// POST /hotkeys/reset - forgets every count.
+	mux.HandleFunc("/hotkeys/reset", func(w http.ResponseWriter, r *http.Request) {
+		if h.hotkeys == nil {
+			http.Error(w, "hotkeys not enabled", http.StatusNotFound)
+			return
+		}
+		h.hotkeys.Reset()
+		w.Write([]byte("Hot keys reset"))
+	})
+
+	// POST /snapshot - SAVE from HTTP: snapshot the store on the leader now.
+	mux.HandleFunc("POST /snapshot", func(w http.ResponseWriter, r *http.Request) {
+		if h.save == nil {
+			http.Error(w, "snapshot not enabled", http.StatusNotFound)
+			return
+		}
+		if h.redirectToLeader(w, r) {
+			return
+		}
+		res, err := h.save()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	})
+
+	// POST /compact - compact this node's WAL and raft log up to the applied
+	// index now instead of waiting for a threshold; returns the run's results.
+	mux.HandleFunc("POST /compact", func(w http.ResponseWriter, r *http.Request) {
+		if h.compact == nil {
+			http.Error(w, "compaction not enabled", http.StatusNotFound)
+			return
+		}
+		if err := h.compact.Compact(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(h.compact.Status())
+	})
+
+	// POST /resync - rebuild this follower from the leader, transferring only
+	// the Merkle ranges that differ; returns what was compared and changed.
+	mux.HandleFunc("POST /resync", func(w http.ResponseWriter, r *http.Request) {
+		if h.resync == nil {
+			http.Error(w, "resync not enabled", http.StatusNotFound)
+			return
+		}
+		report, err := h.resync(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+	})
+
+	// GET /audit - the latest admin requests, newest first, refused ones included.
+	mux.HandleFunc("/audit", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(h.audit.list())
+	})
 
-		reqCount, _ := strconv.Atoi(r.URL.Query().Get("requests"))
-		concurrency, _ := strconv.Atoi(r.URL.Query().Get("concurrency"))
+	// POST /config/reload - same as SIGHUP: re-reads the -config file and
+	// says which settings took effect and which need a restart.
+	mux.HandleFunc("POST /config/reload", func(w http.ResponseWriter, r *http.Request) {
+		if h.reload == nil {
+			http.Error(w, "config reload not enabled", http.StatusNotFound)
+			return
+		}
+		res, err := h.reload()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	})
 
-		if reqCount <= 0 {
-			reqCount = 10000
+	mux.HandleFunc("/benchmark", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		opts, err := parseBenchmarkOptions(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
-		if concurrency <= 0 {
-			concurrency = 100
+		if opts.writesLocally() && h.redirectToLeader(w, r) {
+			return
 		}
 
-		// Direct benchmark - no TCP overhead
-		result := h.runDirectBenchmark(reqCount, concurrency)
+		var result BenchmarkResult
+		if opts.Mode == "network" {
+			result = h.runNetworkBenchmark(r.Context(), opts) // real client path over TCP
+		} else {
+			result = h.runDirectBenchmark(r.Context(), opts) // Direct benchmark - no TCP overhead
+		}
+		result.WALMode = string(h.store.WALMode())
+		if _, err := h.history.Append("node", h.raft.ID, opts, result); err != nil {
+			fmt.Printf("Failed to save benchmark result: %v\n", err)
+		}
 		json.NewEncoder(w).Encode(result)
 	})
 
-	fmt.Printf("HTTP status server on %s\n", port)
-	http.ListenAndServe(port, mux) // listens on port and serves requests using mux router.
-}
+	// GET /benchmark/cluster - leader writes, followers read, results merged.
+	mux.HandleFunc("/benchmark/cluster", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
 
-func (h *HTTPServer) runDirectBenchmark(numRequests int, concurrency int) BenchmarkResult {
-	// Must be leader to run benchmark
-	if h.raft.GetState() != "Leader" {
-		return BenchmarkResult{
-			TotalRequests: int64(numRequests),
-			Failed:        int64(numRequests),
+		opts, err := parseBenchmarkOptions(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
-	}
+		report, err := h.runClusterBenchmark(opts, r.Header.Get("Authorization")) // the other nodes want the same token
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if _, err := h.history.Append("cluster", h.raft.ID, opts, report.Combined); err != nil {
+			fmt.Printf("Failed to save benchmark result: %v\n", err)
+		}
+		json.NewEncoder(w).Encode(report)
+	})
+
+	// GET /benchmark/history - every stored benchmark run, oldest first.
+	mux.HandleFunc("/benchmark/history", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		records, err := h.history.All()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(records)
+	})
+
+	// GET /benchmark/compare?a=<id>&b=<id> - how run b moved relative to run a.
+	mux.HandleFunc("/benchmark/compare", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
 
-	var wg sync.WaitGroup
-	var successCount int64
-	var failCount int64
-	var latencies []time.Duration
-	var latencyMu sync.Mutex
-	var stopped int32 // Atomic flag to stop workers
-
-	requestsPerWorker := numRequests / concurrency
-	start := time.Now()
-
-	for w := 0; w < concurrency; w++ {
-		wg.Add(1)
-		go func(workerID int) {
-			defer wg.Done()
-
-			for i := 0; i < requestsPerWorker; i++ {
-				// Check if we should stop (no longer leader or paused)
-				if atomic.LoadInt32(&stopped) == 1 {
-					atomic.AddInt64(&failCount, int64(requestsPerWorker-i))
-					return
-				}
-
-				// Periodically check leadership (every 100 ops)
-				if i%100 == 0 {
-					if h.raft.IsPaused() || h.raft.GetState() != "Leader" {
-						atomic.StoreInt32(&stopped, 1)
-						atomic.AddInt64(&failCount, int64(requestsPerWorker-i))
-						return
-					}
-				}
-
-				key := fmt.Sprintf("bench_%d_%d", workerID, i)
-				value := fmt.Sprintf("value_%d_%d", workerID, i)
-
-				opStart := time.Now()
-				h.store.Set(key, value)
-				h.raft.AddLogEntry("SET " + key + " " + value)
-				latency := time.Since(opStart)
-
-				atomic.AddInt64(&successCount, 1)
-				latencyMu.Lock()
-				latencies = append(latencies, latency)
-				latencyMu.Unlock()
+		aID, errA := strconv.Atoi(r.URL.Query().Get("a"))
+		bID, errB := strconv.Atoi(r.URL.Query().Get("b"))
+		if errA != nil || errB != nil {
+			http.Error(w, "usage: /benchmark/compare?a=<id>&b=<id>", http.StatusBadRequest)
+			return
+		}
+		a, err := h.history.Get(aID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		b, err := h.history.Get(bID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(compareBenchmarks(a, b))
+	})
+
+	// GET /chaos - currently injected network faults.
+	mux.HandleFunc("/chaos", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(h.raft.Faults().State())
+	})
+
+	// POST /chaos/fault?peer=:8081&drop=30&delay=200ms&type=APPENDENTRIES - faults on messages to one peer.
+	mux.HandleFunc("/chaos/fault", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		peer := q.Get("peer")
+		if peer == "" {
+			http.Error(w, "peer is required", http.StatusBadRequest)
+			return
+		}
+		rule := raft.FaultRule{MessageType: q.Get("type")}
+		if d := q.Get("drop"); d != "" {
+			pct, err := strconv.Atoi(d)
+			if err != nil || pct < 0 || pct > 100 {
+				http.Error(w, "drop must be 0-100", http.StatusBadRequest)
+				return
 			}
-		}(w)
-	}
+			rule.DropPercent = pct
+		}
+		if d := q.Get("delay"); d != "" {
+			delay, err := time.ParseDuration(d)
+			if err != nil || delay < 0 {
+				http.Error(w, "delay must be a duration like 200ms", http.StatusBadRequest)
+				return
+			}
+			rule.Delay = delay
+		}
+		h.raft.Faults().SetRule(peer, rule)
+		w.Write([]byte("Fault set"))
+	})
 
-	wg.Wait()
-	elapsed := time.Since(start)
+	// POST /chaos/partition?groups=:8080,:8081|:8082 - nodes only reach their own group.
+	mux.HandleFunc("/chaos/partition", func(w http.ResponseWriter, r *http.Request) {
+		raw := r.URL.Query().Get("groups")
+		if raw == "" {
+			http.Error(w, "groups is required, e.g. :8080,:8081|:8082", http.StatusBadRequest)
+			return
+		}
+		var groups [][]string
+		for _, g := range strings.Split(raw, "|") {
+			groups = append(groups, strings.Split(g, ","))
+		}
+		h.raft.Faults().Partition(groups)
+		w.Write([]byte("Partition set"))
+	})
 
-	// Build result with whatever we completed
-	result := BenchmarkResult{
-		TotalRequests: int64(numRequests),
-		Successful:    successCount,
-		Failed:        failCount,
-		DurationMs:    float64(elapsed.Milliseconds()),
-		Throughput:    float64(successCount) / elapsed.Seconds(),
-	}
+	// POST /chaos/seed?seed=42 - makes the sequence of drops reproducible.
+	mux.HandleFunc("/chaos/seed", func(w http.ResponseWriter, r *http.Request) {
+		seed, err := strconv.ParseInt(r.URL.Query().Get("seed"), 10, 64)
+		if err != nil {
+			http.Error(w, "seed must be an integer", http.StatusBadRequest)
+			return
+		}
+		h.raft.Faults().Seed(seed)
+		w.Write([]byte("Seed set"))
+	})
 
-	// Calculate latencies only for successful ops
-	if len(latencies) > 0 {
-		sort.Slice(latencies, func(i, j int) bool {
-			return latencies[i] < latencies[j]
-		})
+	// POST /chaos/heal - removes every injected fault, failpoints too.
+	mux.HandleFunc("/chaos/heal", func(w http.ResponseWriter, r *http.Request) {
+		h.raft.Faults().Heal()
+		failpoint.Reset()
+		w.Write([]byte("Faults cleared"))
+	})
 
-		var total time.Duration
-		for _, l := range latencies {
-			total += l
+	// GET /chaos/failpoints - failpoints that are set.
+	// POST /chaos/failpoints?name=wal/before-fsync&action=crash - sets one, action=off clears it.
+	mux.HandleFunc("/chaos/failpoints", func(w http.ResponseWriter, r *http.Request) {
+		if !failpoint.Enabled {
+			http.Error(w, failpoint.ErrNotBuilt.Error(), http.StatusNotFound)
+			return
 		}
-		result.LatencyAvgMs = float64(total.Microseconds()) / float64(len(latencies)) / 1000.0
-		result.LatencyP50Ms = float64(latencies[len(latencies)*50/100].Microseconds()) / 1000.0
-		result.LatencyP95Ms = float64(latencies[len(latencies)*95/100].Microseconds()) / 1000.0
-		p99Idx := len(latencies) * 99 / 100
-		if p99Idx >= len(latencies) {
-			p99Idx = len(latencies) - 1
+		if r.Method != http.MethodPost {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]any{"points": failpoint.Points, "set": failpoint.List()})
+			return
 		}
-		result.LatencyP99Ms = float64(latencies[p99Idx].Microseconds()) / 1000.0
-	}
+		actions, err := failpoint.ParseList(r.URL.Query().Get("name") + "=" + r.URL.Query().Get("action"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for name, a := range actions {
+			failpoint.Enable(name, a)
+		}
+		w.Write([]byte("Failpoint set"))
+	})
 
-	return result
+	return h.requestIDs(h.cors(h.auth(mux, tracing.Middleware(mux))))
 }
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mathdee/KV-Store/internal/protocol"
+	"github.com/mathdee/KV-Store/internal/store"
+)
+
+// A client that got no answer to a write (a timeout, a dropped connection, a
+// leader change) can't tell whether it was applied. An idempotency token
+// makes retrying safe: the result of the first write carrying a token is
+// kept for the idempotency ttl, and a later write with the same token gets
+// that result back without being applied again. On TCP the token goes in
+// front of the write, "IDEM <token> SET key value", where it can't be taken
+// for part of a value; over HTTP it is the Idempotency-Key header of PUT
+// /kv/{key} and POST /kv/batch.
+//
+// The token travels through the log with the write, as
+//
+//	IDEM <token> <expires unix ms> <command>
+//
+// and every node keeps the first result under "idempotency <token>", a key
+// clients can't name as theirs have no spaces, expiring like any key with a
+// ttl. Results so survive restarts and reach followers in snapshots, and as
+// only replicated expires remove them, every node agrees on which entries
+// are retries. The write and its result are two WAL records, so a crash
+// between them forgets the token and a retry applies again.
+
+const (
+	DefaultIdempotencyTTL = time.Hour
+	idempotencyHeader     = "Idempotency-Key"
+	maxTokenLen           = 128
+	idempotencyPrefix     = "idempotency "
+)
+
+type idempotencyKey struct{}
+
+// withIdempotencyToken tags a write's ctx with the client's token.
+func withIdempotencyToken(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, idempotencyKey{}, token)
+}
+
+func idempotencyToken(ctx context.Context) (string, bool) {
+	token, ok := ctx.Value(idempotencyKey{}).(string)
+	return token, ok
+}
+
+func checkToken(token string) *Error {
+	if token == "" || len(token) > maxTokenLen || strings.ContainsAny(token, " \t\r\n") {
+		return newError(CodeSyntax, "idempotency tokens must be 1 to %d bytes without whitespace", maxTokenLen)
+	}
+	return nil
+}
+
+// takeToken takes an "IDEM <token>" prefix off a request line. The rest is
+// parsed again by p, so the command's words keep their place in the line
+// and a value comes through as sent.
+func takeToken(p *protocol.Parser, parts protocol.Command) (protocol.Command, string, *Error) {
+	if parts[0] != "IDEM" {
+		return parts, "", nil
+	}
+	if len(parts) < 3 {
+		return nil, "", newError(CodeSyntax, "usage: IDEM <token> <write command>")
+	}
+	token := parts[1]
+	if err := checkToken(token); err != nil {
+		return nil, "", err
+	}
+	rest, err := p.Parse([]byte(p.Rest(parts, 2)))
+	if err != nil {
+		return nil, "", newError(CodeSyntax, "usage: IDEM <token> <write command>")
+	}
+	return rest, token, nil
+}
+
+// idempotencyContext is r's context, carrying the Idempotency-Key header's
+// token if there is one.
+func idempotencyContext(r *http.Request) (context.Context, *Error) {
+	token := r.Header.Get(idempotencyHeader)
+	if token == "" {
+		return r.Context(), nil
+	}
+	if err := checkToken(token); err != nil {
+		return nil, err
+	}
+	return withIdempotencyToken(r.Context(), token), nil
+}
+
+// SetIdempotencyTTL sets how long a token's result is kept, for writes
+// from then on.
+func (s *Server) SetIdempotencyTTL(d time.Duration) {
+	s.idempotencyTTL.Store(int64(d))
+}
+
+func (s *Server) IdempotencyTTL() time.Duration {
+	return time.Duration(s.idempotencyTTL.Load())
+}
+
+// idempotent wraps command for the log when ctx carries a token.
+func (s *Server) idempotent(ctx context.Context, command string) (string, *Error) {
+	token, ok := idempotencyToken(ctx)
+	if !ok {
+		return command, nil
+	}
+	at := s.clock.Now().Add(s.IdempotencyTTL()).UnixMilli()
+	command = "IDEM " + token + " " + strconv.FormatInt(at, 10) + " " + command
+	if limit := s.Limits().lineLimit(); len(command) > limit {
+		return "", newError(CodeTooLarge, "command too large with its idempotency token (max=%d)", limit)
+	}
+	return command, nil
+}
+
+// innerCommand is the write an IDEM entry carries, or command itself.
+func innerCommand(command string) string {
+	if !strings.HasPrefix(command, "IDEM ") {
+		return command
+	}
+	if f := strings.SplitN(command, " ", 4); len(f) == 4 {
+		return f[3]
+	}
+	return command
+}
+
+// idempotencyResult is what is kept of a write's outcome.
+type idempotencyResult struct {
+	Reply string `json:"reply,omitempty"`
+	Code  Code   `json:"code,omitempty"` // set when the write refused, e.g. NOKEY
+	Text  string `json:"text,omitempty"`
+}
+
+// applyIdempotent applies an IDEM entry: the write it carries, unless an
+// earlier entry with the token did, in which case that one's result is
+// returned again.
+func (s *Server) applyIdempotent(ctx context.Context, command string) (string, error) {
+	f := strings.SplitN(command, " ", 4)
+	if len(f) != 4 {
+		return "", fmt.Errorf("malformed IDEM")
+	}
+	at, err := strconv.ParseInt(f[2], 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("malformed IDEM expiry %q", f[2])
+	}
+	key := idempotencyPrefix + f[1]
+	if raw, ok := s.store.Peek(key); ok {
+		var kept idempotencyResult
+		if err := json.Unmarshal([]byte(raw), &kept); err != nil {
+			return "", fmt.Errorf("idempotency result for %s: %v", f[1], err)
+		}
+		if kept.Code != "" {
+			return "", &Error{Code: kept.Code, Text: kept.Text}
+		}
+		return kept.Reply, nil
+	}
+
+	reply, applyErr := s.apply(ctx, f[3])
+	kept := idempotencyResult{Reply: reply}
+	var refused *Error
+	if errors.As(applyErr, &refused) {
+		kept = idempotencyResult{Code: refused.Code, Text: refused.Text}
+	} else if applyErr != nil {
+		return "", applyErr // not applied, or not durably: a retry should try again
+	}
+	data, _ := json.Marshal(kept)
+	if _, err := s.store.Batch(ctx, []store.BatchOp{{Key: key, Value: string(data), ExpiresAt: at}}); err != nil {
+		return "", err
+	}
+	return reply, applyErr
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIdempotencyTokens(t *testing.T) {
+	srv, addr := testServer(t)
+	c := dialTest(t, addr)
+	c.do("PROTOCOL 2")
+
+	// A retry gets the first result back and isn't applied again.
+	for range 2 {
+		if reply := c.do("IDEM t1 APPEND log x"); reply != "1" {
+			t.Fatalf("expected the first APPEND's length, got %q", reply)
+		}
+	}
+	if got, _ := srv.store.Get("log"); got != "x" {
+		t.Fatalf("expected the retry not to apply, got log=%q", got)
+	}
+	if reply := c.do("IDEM t2 APPEND log x"); reply != "2" {
+		t.Fatalf("expected another token to apply, got %q", reply)
+	}
+
+	// Only the front of the line is the token's, the value is all value.
+	c.do("IDEM t3 SET v IDEM t3 ID t3")
+	if got, _ := srv.store.Get("v"); got != "IDEM t3 ID t3" {
+		t.Errorf("expected the value kept as sent, got %q", got)
+	}
+
+	for _, bad := range []string{"IDEM t4", "IDEM t4 GET log", "IDEM " + strings.Repeat("t", maxTokenLen+1) + " SET k v"} {
+		if reply := c.do(bad); !strings.HasPrefix(reply, "ERR_SYNTAX ") {
+			t.Errorf("%s: expected a syntax error, got %q", bad, reply)
+		}
+	}
+}
+
+func TestValuesEndingInIDAreValues(t *testing.T) {
+	srv, addr := testServer(t)
+	c := dialTest(t, addr)
+	for _, line := range []string{"SET k hello ID world", "SET k2 see ID card", "SET k3 other ID card"} {
+		if reply := c.do(line); reply != "OK" {
+			t.Fatalf("%s: expected OK, got %q", line, reply)
+		}
+	}
+	for k, want := range map[string]string{"k": "hello ID world", "k2": "see ID card", "k3": "other ID card"} {
+		if got, _ := srv.store.Get(k); got != want {
+			t.Errorf("expected %s=%q, got %q", k, want, got)
+		}
+	}
+}
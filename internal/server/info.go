@@ -0,0 +1,196 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/mathdee/KV-Store/internal/wal"
+)
+
+// Version is reported by INFO; release builds set it with
+// -ldflags "-X github.com/mathdee/KV-Store/internal/server.Version=v1.2.3".
+var Version = "dev"
+
+// InfoSection is one "# Name" block of INFO output, fields in display order.
+type InfoSection struct {
+	Name   string
+	Fields [][2]string
+}
+
+func (sec *InfoSection) add(key string, value any) {
+	sec.Fields = append(sec.Fields, [2]string{key, fmt.Sprint(value)})
+}
+
+// SetWAL lets INFO report persistence stats.
+func (s *Server) SetWAL(w *wal.WAL) {
+	s.wal = w
+}
+
+// Info gathers the INFO sections, or just the one named (case-insensitive).
+func (s *Server) Info(only string) []InfoSection {
+	var sections []InfoSection
+	want := func(name string) bool { return only == "" || strings.EqualFold(only, name) }
+
+	if want("server") {
+		sec := InfoSection{Name: "Server"}
+		sec.add("version", Version)
+		sec.add("git_commit", buildRevision())
+		sec.add("go_version", runtime.Version())
+		sec.add("node_id", s.raft.ID)
+		sec.add("uptime_seconds", int64(s.clock.Since(s.started).Seconds()))
+		if s.tls != nil {
+			cert := s.tls.Status()
+			sec.add("tls_subject", cert.Subject)
+			sec.add("tls_not_after", cert.NotAfter.UTC().Format(time.RFC3339))
+			sec.add("tls_reloads", cert.Reloads)
+			sec.add("tls_last_error", cert.LastError)
+		}
+		sections = append(sections, sec)
+	}
+	if want("clients") {
+		sec := InfoSection{Name: "Clients"}
+		sec.add("connected_clients", s.clients.count())
+		sec.add("monitors", s.monitors.count.Load())
+		sections = append(sections, sec)
+	}
+	if want("memory") {
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		sec := InfoSection{Name: "Memory"}
+		sec.add("heap_alloc_bytes", m.HeapAlloc)
+		sec.add("heap_sys_bytes", m.HeapSys)
+		sec.add("sys_bytes", m.Sys)
+		sec.add("gc_runs", m.NumGC)
+		data := s.store.MemoryStats()
+		sec.add("used_memory_bytes", data.UsedBytes) // what the keys and values take, an estimate
+		sec.add("key_bytes", data.KeyBytes)
+		sec.add("value_bytes", data.ValueBytes)
+		sec.add("meta_bytes", data.MetaBytes)
+		sec.add("inline_values", data.InlineValues) // short values a compact engine holds in place
+		sec.add("inline_bytes", data.InlineBytes)
+		compression := s.store.CompressionStats()
+		sec.add("compression", compression.Codec)
+		sec.add("compression_ratio", fmt.Sprintf("%.2f", compression.Ratio))
+		interning := s.store.InternStats()
+		sec.add("interned_values", interning.Values)
+		sec.add("interned_saved_bytes", interning.SavedBytes)
+		sections = append(sections, sec)
+	}
+	if want("process") {
+		sec := InfoSection{Name: "Process"}
+		sec.add("goroutines", runtime.NumGoroutine())
+		sec.add("open_fds", openFDs())
+		sections = append(sections, sec)
+	}
+	if want("persistence") && s.wal != nil {
+		sec := InfoSection{Name: "Persistence"}
+		sec.add("wal_mode", s.wal.Mode())
+		sec.add("wal_size_bytes", s.wal.Size())
+		sec.add("wal_flushes", s.wal.Flushes())
+		sec.add("wal_pending_writes", s.wal.Pending())
+		batches := s.wal.CommitStats()
+		sec.add("wal_batch_avg_entries", fmt.Sprintf("%.1f", batches.AvgEntries))
+		sec.add("wal_batch_avg_bytes", fmt.Sprintf("%.0f", batches.AvgBytes))
+		sec.add("wal_batch_max_entries", batches.MaxBatchEntries)
+		sec.add("wal_batch_max_bytes", batches.MaxBatchBytes)
+		sec.add("wal_size_triggered_flushes", batches.SizeTriggered)
+		sections = append(sections, sec)
+	}
+	if want("replication") {
+		sec := InfoSection{Name: "Replication"}
+		sec.add("role", strings.ToLower(s.raft.GetState()))
+		sec.add("term", s.raft.GetTerm())
+		sec.add("log_length", s.raft.GetLogLength())
+		sec.add("commit_index", s.raft.GetCommitIndex())
+		sec.add("election_priority", s.raft.ElectionPriority())
+		sec.add("witness", s.raft.IsWitness())
+		sec.add("peers", len(s.raft.Peers))
+		for i, p := range s.raft.ReplicationStatus() {
+			state := "unknown" // only the leader tracks its followers
+			if p.NextIndex >= 0 {
+				state = fmt.Sprintf("next_index=%d,match_index=%d,lag=%d,bytes_in_flight=%d", p.NextIndex, p.MatchIndex, p.Lag, p.BytesInFlight)
+			}
+			sec.add(fmt.Sprintf("peer%d", i), "addr="+p.Peer+","+state)
+		}
+		sections = append(sections, sec)
+	}
+	if want("keyspace") {
+		sec := InfoSection{Name: "Keyspace"}
+		sec.add("keys", s.store.Len())
+		sections = append(sections, sec)
+	}
+	if want("tenants") {
+		sec := InfoSection{Name: "Tenants"}
+		for _, t := range s.Tenants() {
+			name := t.Namespace
+			if name == "" {
+				name = "(none)"
+			}
+			sec.add("ns_"+name, fmt.Sprintf("keys=%d,bytes=%d,writes=%d,over_quota=%d,rate_limited=%d,max_keys=%d,max_bytes=%d,max_qps=%g",
+				t.Keys, t.Bytes, t.Writes, t.OverQuota, t.RateLimited, t.Quota.MaxKeys, t.Quota.MaxBytes, t.Quota.MaxQPS))
+		}
+		sections = append(sections, sec)
+	}
+	return sections
+}
+
+// openFDs counts the files and sockets the process has open, -1 where
+// there is no /proc to count them in.
+func openFDs() int {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	return len(entries) - 1 // ReadDir's own
+}
+
+// formatInfo renders sections as "# Name" headers and "key:value" lines,
+// with a blank line between sections.
+func formatInfo(sections []InfoSection) []string {
+	var lines []string
+	for i, sec := range sections {
+		if i > 0 {
+			lines = append(lines, "")
+		}
+		lines = append(lines, "# "+sec.Name)
+		for _, f := range sec.Fields {
+			lines = append(lines, f[0]+":"+f[1])
+		}
+	}
+	return lines
+}
+
+// handleInfo serves INFO [section]: the number of lines, then the lines.
+func (s *Server) handleInfo(conn net.Conn, parts []string) {
+	if len(parts) > 2 {
+		writeError(conn, newError(CodeSyntax, "usage: INFO [section]"))
+		return
+	}
+	section := ""
+	if len(parts) == 2 {
+		section = parts[1]
+	}
+	lines := formatInfo(s.Info(section))
+	fmt.Fprintln(conn, len(lines))
+	for _, l := range lines {
+		fmt.Fprintln(conn, l)
+	}
+}
+
+func buildRevision() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" {
+			return setting.Value
+		}
+	}
+	return "unknown"
+}
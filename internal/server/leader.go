@@ -0,0 +1,56 @@
+package server
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/mathdee/KV-Store/internal/raft"
+)
+
+// Some admin operations only make sense on the leader: a benchmark that
+// writes would just count NOTLEADER failures on a follower. Those endpoints
+// answer followers' callers with a 307 to the leader, which keeps the method
+// and body, so curl -L and browsers end up in the right place.
+
+// redirectToLeader answers r unless this node is the leader: with a redirect
+// to the leader's HTTP port, or 503 while no leader is known. It reports
+// whether it answered.
+func (h *HTTPServer) redirectToLeader(w http.ResponseWriter, r *http.Request) bool {
+	if h.raft.GetState() == raft.Leader && !h.raft.IsPaused() {
+		return false
+	}
+	leader := h.raft.Leader()
+	if leader == "" || leader == h.raft.ID {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "no leader known yet, try again shortly", http.StatusServiceUnavailable)
+		return true
+	}
+	target := *r.URL
+	target.Scheme = "http"
+	target.Host = leaderHTTPHost(leader, r.Host)
+	http.Redirect(w, r, target.String(), http.StatusTemporaryRedirect)
+	return true
+}
+
+// leaderHTTPHost is the leader's HTTP address. Node IDs like ":8081" name no
+// host, so the one the caller used to reach us stands in.
+func leaderHTTPHost(leader, requestHost string) string {
+	addr := httpAddr(leader)
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host != "" {
+		return addr
+	}
+	if h, _, err := net.SplitHostPort(requestHost); err == nil {
+		host = h
+	} else {
+		host = requestHost
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// writesLocally reports whether a /benchmark run writes through this node,
+// which only the leader can do. Cluster-wide network runs find the leader
+// themselves.
+func (o BenchmarkOptions) writesLocally() bool {
+	return o.ReadPercent < 100 && !(o.Mode == "network" && o.Target == "cluster")
+}
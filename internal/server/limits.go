@@ -0,0 +1,60 @@
+package server
+
+import "github.com/mathdee/KV-Store/internal/protocol"
+
+// Limits bound the keys and values clients may write. They are enforced when
+// a command is read, before it reaches the raft log or the WAL, and they also
+// size the line buffer so an oversized line gets a clear error instead of a
+// dropped connection.
+type Limits struct {
+	MaxKeyLen    int // bytes
+	MaxValueSize int // bytes
+}
+
+var DefaultLimits = Limits{MaxKeyLen: 1024, MaxValueSize: 1 << 20}
+
+// lineLimit is the longest line we accept: the largest command (two keys or a
+// key and a value) plus room for the command name. Raft entries carry the
+// same commands, so it covers APPENDENTRIES lines too, and the 4/3 leaves
+// room for the base64 key/value lines of INSTALLSNAPSHOT.
+func (l Limits) lineLimit() int {
+	return (2*l.MaxKeyLen+l.MaxValueSize)*4/3 + 256
+}
+
+// SetLimits replaces DefaultLimits. Commands are checked against the new
+// limits right away; connections already open keep their line buffer size.
+func (s *Server) SetLimits(l Limits) {
+	s.limits.Store(&l)
+}
+
+// Limits returns the limits commands are checked against.
+func (s *Server) Limits() Limits {
+	return *s.limits.Load()
+}
+
+// checkLimits returns the error for a command that breaks the limits, or
+// nil. keys are the positions of its key arguments.
+func (s *Server) checkLimits(parts protocol.Command, keys []int) *Error {
+	limits := s.Limits()
+	for _, i := range keys {
+		if i < len(parts) && len(parts[i]) > limits.MaxKeyLen {
+			return newError(CodeTooLarge, "key too large (max=%d)", limits.MaxKeyLen)
+		}
+	}
+	size := 0
+	switch parts[0] {
+	case "SET", "SETNX", "GETSET":
+		size = parts.RestLen(2)
+	case "APPEND":
+		// The limit is on the value it produces, not just the suffix.
+		size = s.store.Strlen(parts[1]) + parts.RestLen(2)
+	case "SETBIT":
+		if len(parts) > 2 {
+			size = parseInt(parts[2])/8 + 1 // SETBIT grows the value to fit the offset
+		}
+	}
+	if size > limits.MaxValueSize {
+		return newError(CodeTooLarge, "value too large (max=%d)", limits.MaxValueSize)
+	}
+	return nil
+}
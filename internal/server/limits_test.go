@@ -0,0 +1,44 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLimits(t *testing.T) {
+	srv, addr := testServer(t)
+	srv.SetLimits(Limits{MaxKeyLen: 4, MaxValueSize: 8})
+	c := dialTest(t, addr)
+	c.do("PROTOCOL 2")
+
+	if reply := c.do("SET k 12345678"); reply != "OK" {
+		t.Fatalf("expected a value at the limit to be written, got %q", reply)
+	}
+	for _, line := range []string{
+		"SET longkey v",          // key over MaxKeyLen
+		"SET k 123456789",        // value over MaxValueSize
+		"SET k 1234 5678",        // the value with its space counts
+		"APPEND k 9",             // the value APPEND would leave
+		"SETBIT k 64 1",          // the value SETBIT would grow
+		"RENAME k longkey",       // every key argument
+		"COPY longkey k REPLACE", // source keys too
+	} {
+		if reply := c.do(line); !strings.HasPrefix(reply, "ERR_TOOLARGE ") {
+			t.Errorf("%s: expected ERR_TOOLARGE, got %q", line, reply)
+		}
+	}
+	if reply := c.do("GET k"); reply != "12345678" {
+		t.Fatalf("expected the refused writes to change nothing, got %q", reply)
+	}
+}
+
+func TestLimitsSizeTheLineBuffer(t *testing.T) {
+	srv, addr := testServer(t)
+	srv.SetLimits(Limits{MaxKeyLen: 4, MaxValueSize: 8})
+	c := dialTest(t, addr) // sized by the limits set before it connected
+	c.do("PROTOCOL 2")
+	long := "SET k " + strings.Repeat("x", Limits{MaxKeyLen: 4, MaxValueSize: 8}.lineLimit())
+	if reply := c.do(long); !strings.HasPrefix(reply, "ERR_TOOLARGE line too long") {
+		t.Fatalf("expected the over-long line refused with a reason, got %q", reply)
+	}
+}
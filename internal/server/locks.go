@@ -0,0 +1,158 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mathdee/KV-Store/internal/protocol"
+	"github.com/mathdee/KV-Store/internal/store"
+)
+
+// Locks are keys in the lock namespace that expire:
+//
+//	ACQUIRE key owner ttl   the lock's fencing token, or LOCKED if someone else holds it
+//	RELEASE key owner       1 if owner held the lock and now doesn't, 0 if not
+//
+// The lock on key is lock:key, holding "<token> <owner>" until the ttl
+// runs out. The fencing token is the raft index of the ACQUIRE that took
+// the lock, so it only ever grows: a resource that remembers the highest
+// token it has seen can refuse a holder whose lock expired while it
+// stalled. An owner that acquires a lock it holds extends it and keeps
+// its token.
+//
+// The leader puts the time it proposes an ACQUIRE in the entry,
+//
+//	ACQUIRE key owner <expires unix ms> <now unix ms>
+//
+// and every node judges whether a lock has expired by that time rather
+// than its own clock, so they all agree who gets it.
+
+// LockNamespace holds the locks, see ACQUIRE.
+const LockNamespace = "lock"
+
+// lockKey is where the lock on key lives.
+func lockKey(key string) string {
+	return LockNamespace + store.NamespaceSeparator + key
+}
+
+// Lock is a held lock, as /locks lists it.
+type Lock struct {
+	Key       string    `json:"key"`
+	Owner     string    `json:"owner"`
+	Token     int       `json:"token"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// parseLock reads the value of a lock key.
+func parseLock(value string) (token int, owner string, ok bool) {
+	rawToken, owner, ok := strings.Cut(value, " ")
+	if !ok {
+		return 0, "", false
+	}
+	token, err := strconv.Atoi(rawToken)
+	return token, owner, err == nil
+}
+
+func (s *Server) handleAcquire(r *request) outcome {
+	if len(r.parts) != 4 {
+		writeError(r.conn, newError(CodeSyntax, "usage: ACQUIRE key owner ttl"))
+		return answered
+	}
+	ttl, err := parseTTL(r.parts[3])
+	if err != nil {
+		writeError(r.conn, newError(CodeSyntax, "%v", err))
+		return answered
+	}
+	now := s.clock.Now()
+	return s.replicate(r, fmt.Sprintf("ACQUIRE %s %s %d %d", r.parts[1], r.parts[2], now.Add(ttl).UnixMilli(), now.UnixMilli()))
+}
+
+func (s *Server) handleRelease(r *request) outcome {
+	if len(r.parts) != 3 {
+		writeError(r.conn, newError(CodeSyntax, "usage: RELEASE key owner"))
+		return answered
+	}
+	return s.replicate(r, r.parts.String())
+}
+
+// applyAcquire runs an ACQUIRE entry.
+func (s *Server) applyAcquire(ctx context.Context, parts protocol.Command) (string, error) {
+	if len(parts) != 5 {
+		return "", fmt.Errorf("malformed ACQUIRE")
+	}
+	key, owner := lockKey(parts[1]), parts[2]
+	expires, err1 := strconv.ParseInt(parts[3], 10, 64)
+	now, err2 := strconv.ParseInt(parts[4], 10, 64)
+	if err1 != nil || err2 != nil {
+		return "", fmt.Errorf("malformed ACQUIRE times %q %q", parts[3], parts[4])
+	}
+	var token int
+	var refused *Error
+	err := s.store.Update(ctx, func(tx *store.Tx) error {
+		token = tx.Index()
+		if v, ok := tx.Get(key); ok {
+			held, holder, _ := parseLock(v)
+			at, expiring := tx.ExpiresAt(key)
+			if live := !expiring || at > now; live && holder != owner {
+				refused = newError(CodeLocked, "%s is held by %s until %s", parts[1], holder, time.UnixMilli(at).UTC().Format(time.RFC3339Nano))
+				return nil
+			} else if live {
+				token = held // extended, the holder keeps its token
+			}
+		}
+		tx.SetExpiring(key, strconv.Itoa(token)+" "+owner, expires)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if refused != nil {
+		return "", refused
+	}
+	return strconv.Itoa(token), nil
+}
+
+// applyRelease runs a RELEASE entry. It needs no time: an owner can
+// release a lock that expired until someone else takes it.
+func (s *Server) applyRelease(ctx context.Context, parts protocol.Command) (string, error) {
+	if len(parts) != 3 {
+		return "", fmt.Errorf("malformed RELEASE")
+	}
+	key := lockKey(parts[1])
+	released := false
+	err := s.store.Update(ctx, func(tx *store.Tx) error {
+		v, ok := tx.Get(key)
+		if _, holder, _ := parseLock(v); ok && holder == parts[2] {
+			tx.Delete(key)
+			released = true
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return existedReply([]bool{released}), nil
+}
+
+// heldLocks lists the locks held now, by key.
+func heldLocks(st Store) []Lock {
+	locks := []Lock{}
+	prefix := lockKey("")
+	st.Iterate(prefix, func(k, v string) bool {
+		token, owner, ok := parseLock(v)
+		if !ok {
+			return true // written by something other than ACQUIRE
+		}
+		l := Lock{Key: strings.TrimPrefix(k, prefix), Owner: owner, Token: token}
+		l.ExpiresAt, _ = st.ExpiresAt(k)
+		locks = append(locks, l)
+		return true
+	})
+	slices.SortFunc(locks, func(a, b Lock) int { return cmp.Compare(a.Key, b.Key) })
+	return locks
+}
@@ -4,6 +4,11 @@ import (
 	"sort"
 	"sync"
 	"time"
+
+	"github.com/mathdee/KV-Store/internal/clock"
+	"github.com/mathdee/KV-Store/internal/raft"
+	"github.com/mathdee/KV-Store/internal/store"
+	"github.com/mathdee/KV-Store/internal/wal"
 )
 
 // Metrics will collect performance data from the server.
@@ -16,15 +21,27 @@ type Metrics struct {
 	failCount     int64
 	latencies     []time.Duration
 	startTime     time.Time
+	clock         clock.Clock     // startTime, uptime and history samples, see SetClock
+	history       *MetricsHistory // nil until StartHistory is called
 }
 
 func NewMetrics() *Metrics {
 	return &Metrics{
 		latencies: make([]time.Duration, 0, 10000),
 		startTime: time.Now(),
+		clock:     clock.System,
 	}
 }
 
+// SetClock makes uptime and history samples run on clk, starting the
+// uptime again.
+func (m *Metrics) SetClock(clk clock.Clock) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.clock = clk
+	m.startTime = clk.Now()
+}
+
 func (m *Metrics) RecordSuccess(latency time.Duration) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -40,6 +57,13 @@ func (m *Metrics) RecordFailure() {
 	m.failCount++
 }
 
+// Counts returns the request counters without computing latency percentiles.
+func (m *Metrics) Counts() (total, success, fail int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.totalRequests, m.successCount, m.failCount
+}
+
 func (m *Metrics) Reset() {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -47,7 +71,7 @@ func (m *Metrics) Reset() {
 	m.successCount = 0
 	m.failCount = 0
 	m.latencies = make([]time.Duration, 0, 10000)
-	m.startTime = time.Now()
+	m.startTime = m.clock.Now()
 }
 
 // Send the data collected to the dashboard.
@@ -62,6 +86,14 @@ type MetricsSnapshot struct {
 	LatencyP95    float64 `json:"latencyP95Ms"`  // 95th percentile
 	LatencyP99    float64 `json:"latencyP99Ms"`  // 99th percentile
 	UptimeSeconds float64 `json:"uptimeSeconds"` // time since reset
+
+	Compression *store.CompressionStats `json:"compression,omitempty"` // filled in by /metrics
+	Interning   *store.InternStats      `json:"interning,omitempty"`   // shared small values and the bytes they save, filled in by /metrics
+	WAL         *wal.CommitStats        `json:"wal,omitempty"`         // group commit batch sizes, filled in by /metrics
+	Memory      *store.MemoryStats      `json:"memory,omitempty"`      // what the data takes, filled in by /metrics
+	Digest      *DigestStatus           `json:"digest,omitempty"`      // state digest checks, filled in by /metrics once SetDigests is called
+	Replication []raft.FlowStats        `json:"replication,omitempty"` // entries sent to each follower and how often the window held them back, filled in by /metrics
+	Apply       *ApplyStats             `json:"apply,omitempty"`       // apply lag and batches, filled in by /metrics
 }
 
 //Calculate all metrics and return a snapshot.
@@ -70,7 +102,7 @@ func (m *Metrics) GetSnapshot() MetricsSnapshot {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	uptime := time.Since(m.startTime).Seconds()
+	uptime := m.clock.Since(m.startTime).Seconds()
 
 	snap := MetricsSnapshot{
 		TotalRequests: m.totalRequests,
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MONITOR is a debugging aid: the connection that sends it gets a live line
+// for every client command the node handles, in the form
+//
+//	1791979449.430627 [127.0.0.1:34688] "SET" "key" "value"
+//
+// Every command pays for formatting while a monitor is attached, and values
+// are shown in the clear, so it is meant for reproducing client issues.
+// Each monitor gets at most monitorRate lines per second; the rest are
+// dropped and reported so a busy node can't be slowed down by a slow reader.
+// Nodes refuse MONITOR unless started with -monitor, and audit who attaches.
+
+const (
+	monitorRate   = 1000 // lines per second per monitor
+	monitorBuffer = 1024 // lines queued before we start dropping
+)
+
+// raftCommands are node-to-node messages, left out of the feed.
+var raftCommands = map[string]bool{"APPENDENTRIES": true, "VOTEREQUEST": true, "HEARTBEAT": true, "INSTALLSNAPSHOT": true, "HANDSHAKE": true}
+
+type monitor struct {
+	lines       chan string
+	windowStart time.Time
+	sent        int // lines queued in the current second
+	dropped     int // lines dropped since the last notice
+}
+
+type monitorHub struct {
+	mu       sync.Mutex
+	monitors map[*monitor]struct{}
+	count    atomic.Int32 // lets publish skip all work when nobody is watching
+	enabled  atomic.Bool  // MONITOR is refused while false, see SetMonitor
+}
+
+func newMonitorHub() *monitorHub {
+	return &monitorHub{monitors: make(map[*monitor]struct{})}
+}
+
+// SetMonitor turns MONITOR on or off; it is off by default.
+func (s *Server) SetMonitor(on bool) {
+	s.monitors.enabled.Store(on)
+}
+
+func (h *monitorHub) subscribe() *monitor {
+	m := &monitor{lines: make(chan string, monitorBuffer)}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.monitors[m] = struct{}{}
+	h.count.Add(1)
+	return m
+}
+
+func (h *monitorHub) unsubscribe(m *monitor) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.monitors, m)
+	h.count.Add(-1)
+}
+
+func (h *monitorHub) publish(client string, at time.Time, parts []string) {
+	if h.count.Load() == 0 || raftCommands[parts[0]] {
+		return
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d.%06d [%s]", at.Unix(), at.Nanosecond()/1000, client)
+	for _, p := range truncateArgs(parts) {
+		b.WriteString(" ")
+		b.WriteString(strconv.Quote(p))
+	}
+	line := b.String()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for m := range h.monitors {
+		if at.Sub(m.windowStart) >= time.Second {
+			if m.dropped > 0 && m.offer(fmt.Sprintf("(monitor dropped %d lines)", m.dropped)) {
+				m.dropped = 0
+			}
+			m.windowStart = at
+			m.sent = 0
+		}
+		if m.sent >= monitorRate || !m.offer(line) {
+			m.dropped++
+			continue
+		}
+		m.sent++
+	}
+}
+
+// offer queues a line without blocking the command that produced it.
+func (m *monitor) offer(line string) bool {
+	select {
+	case m.lines <- line:
+		return true
+	default:
+		return false
+	}
+}
+
+// runMonitor turns conn into a monitor until the client sends QUIT or hangs
+// up. It returns only once its reader is done with scanner, whose buffer the
+// connection's scratch lends it, and the caller hangs up.
+func (s *Server) runMonitor(conn net.Conn, scanner *bufio.Scanner) {
+	fmt.Printf("[%s] MONITOR attached by %s (debug only)\n", s.raft.ID, conn.RemoteAddr())
+	m := s.monitors.subscribe()
+	defer s.monitors.unsubscribe(m)
+	fmt.Fprintln(conn, "OK (debug only: every command and value is shown, send QUIT to stop)")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for scanner.Scan() {
+			if strings.EqualFold(strings.TrimSpace(scanner.Text()), "QUIT") {
+				return
+			}
+		}
+	}()
+	defer func() {
+		conn.SetReadDeadline(time.Now()) // wakes the reader if it's still scanning
+		<-done
+	}()
+	for {
+		select {
+		case line := <-m.lines:
+			if _, err := fmt.Fprintln(conn, line); err != nil {
+				return
+			}
+		case <-done:
+			fmt.Fprintln(conn, "OK")
+			return
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMonitorIsOffByDefault(t *testing.T) {
+	srv, addr := testServer(t)
+	c := dialTest(t, addr)
+	c.do("PROTOCOL 2")
+	if reply := c.do("MONITOR"); !strings.HasPrefix(reply, "ERR_DISABLED ") {
+		t.Fatalf("expected MONITOR refused, got %q", reply)
+	}
+	if reply := c.do("PING"); reply != "PONG" {
+		t.Fatalf("expected the connection to carry on as a client's, got %q", reply)
+	}
+
+	srv.SetMonitor(true)
+	m := dialTest(t, addr)
+	if reply := m.do("MONITOR"); !strings.HasPrefix(reply, "OK") {
+		t.Fatalf("expected MONITOR to attach once turned on, got %q", reply)
+	}
+	c.do("SET k v")
+	if line := m.read(); !strings.HasSuffix(line, `"SET" "k" "v"`) {
+		t.Fatalf("expected the monitor to see the SET, got %q", line)
+	}
+	if reply := m.do("QUIT"); reply != "OK" {
+		t.Fatalf("expected QUIT to detach, got %q", reply)
+	}
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mathdee/KV-Store/internal/raft"
+)
+
+// /cluster/overview saves the dashboard a round of requests per node: the
+// node that gets it asks every peer for /status and /metrics at once and
+// adds the leader's view of replication lag. A peer that doesn't answer in
+// time shows up as unreachable rather than holding up the rest.
+
+const overviewTimeout = 2 * time.Second
+
+// NodeOverview is one node in /cluster/overview.
+type NodeOverview struct {
+	ID        string           `json:"id"`
+	Reachable bool             `json:"reachable"`
+	Error     string           `json:"error,omitempty"`
+	Status    *StatusResponse  `json:"status,omitempty"`
+	Metrics   *MetricsSnapshot `json:"metrics,omitempty"`
+	Lag       int              `json:"lag"` // entries behind the leader, -1 if unknown
+	QPS       float64          `json:"qps"` // client requests per second since its metrics were reset
+}
+
+// ClusterOverview is what /cluster/overview returns.
+type ClusterOverview struct {
+	Leader    string         `json:"leader"` // "" while no reachable node leads
+	Term      int            `json:"term"`   // highest term any node is in
+	Reachable int            `json:"reachable"`
+	TotalQPS  float64        `json:"totalQps"`
+	MaxLag    int            `json:"maxLag"`
+	Warnings  []string       `json:"warnings,omitempty"` // e.g. two nodes claiming to lead
+	Nodes     []NodeOverview `json:"nodes"`              // this node first, then its peers
+}
+
+// overview gathers every node's status and metrics. authorization, the
+// caller's Authorization header, is sent along to the peers.
+func (h *HTTPServer) overview(ctx context.Context, authorization string) ClusterOverview {
+	ctx, cancel := context.WithTimeout(ctx, overviewTimeout)
+	defer cancel()
+
+	nodes := append([]string{h.raft.ID}, h.raft.Peers...)
+	out := ClusterOverview{Nodes: make([]NodeOverview, len(nodes))}
+	var wg sync.WaitGroup
+	for i, node := range nodes {
+		if i == 0 {
+			status, metrics := h.status(), h.metricsSnapshot()
+			out.Nodes[0] = NodeOverview{ID: node, Reachable: true, Status: &status, Metrics: &metrics}
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n := NodeOverview{ID: node}
+			var status StatusResponse
+			var metrics MetricsSnapshot
+			err := fetchJSON(ctx, node, "/status", authorization, &status)
+			if err == nil {
+				err = fetchJSON(ctx, node, "/metrics", authorization, &metrics)
+			}
+			if err != nil {
+				n.Error = err.Error()
+			} else {
+				n.Reachable, n.Status, n.Metrics = true, &status, &metrics
+			}
+			out.Nodes[i] = n
+		}()
+	}
+	wg.Wait()
+
+	var leaders []NodeOverview
+	for i := range out.Nodes {
+		n := &out.Nodes[i]
+		n.Lag = -1
+		if !n.Reachable {
+			out.Warnings = append(out.Warnings, fmt.Sprintf("%s unreachable: %s", n.ID, n.Error))
+			continue
+		}
+		out.Reachable++
+		n.QPS = n.Metrics.Throughput
+		out.TotalQPS += n.QPS
+		out.Term = max(out.Term, n.Status.Term)
+		if n.Status.State == raft.Leader && !n.Status.Paused {
+			leaders = append(leaders, *n)
+		}
+	}
+	for _, l := range leaders {
+		// A leader cut off from the others keeps its old term until it hears
+		// of the new one; the leader of the newest term is the real one.
+		if l.Status.Term == out.Term {
+			out.Leader = l.ID
+		}
+	}
+	if len(leaders) > 1 {
+		out.Warnings = append(out.Warnings, fmt.Sprintf("%d nodes claim to lead, %s is in the newest term", len(leaders), out.Leader))
+	}
+	if out.Leader == "" {
+		out.Warnings = append(out.Warnings, "no reachable node is leading")
+		return out
+	}
+	h.addLag(ctx, &out, authorization)
+	return out
+}
+
+// addLag fills in each follower's lag as the leader sees it.
+func (h *HTTPServer) addLag(ctx context.Context, out *ClusterOverview, authorization string) {
+	var peers []raft.PeerStatus
+	if out.Leader == h.raft.ID {
+		peers = h.raft.ReplicationStatus()
+	} else {
+		var cluster ClusterResponse
+		if err := fetchJSON(ctx, out.Leader, "/cluster", authorization, &cluster); err != nil {
+			out.Warnings = append(out.Warnings, fmt.Sprintf("no replication status from the leader: %v", err))
+			return
+		}
+		peers = cluster.Peers
+	}
+	lag := map[string]int{out.Leader: 0}
+	for _, p := range peers {
+		if p.NextIndex >= 0 { // -1 while the leader has no view of the peer
+			lag[p.Peer] = p.Lag
+		}
+	}
+	for i := range out.Nodes {
+		if l, ok := lag[out.Nodes[i].ID]; ok {
+			out.Nodes[i].Lag = l
+			out.MaxLag = max(out.MaxLag, l)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/mathdee/KV-Store/internal/protocol"
+)
+
+// Commands added with RegisterCommand are writes, handled like the
+// built-in ones: the leader proposes the line as the client sent it, and
+// every node applies it from the log by calling its CommandHandler with the
+// entry's raft index in ctx, so what the handler writes through the store
+// lands in the WAL like any other write. Argument 1 is taken to be the key,
+// for the key size limit, HOTKEYS, quotas and cache mode.
+//
+// The log keeps the command, not what it did, so every node, and kv-admin
+// replay, has to register the same commands with the same handlers before
+// NewServer, or it can't apply what the others did.
+
+// CommandHandler applies a registered command, parts being the whole line,
+// name included, and returns the reply. It runs on every node, in log
+// order, so it has to give the same result from the same store everywhere:
+// no clocks, no randomness, nothing outside the store.
+//
+// An *Error is the command's answer, like the NOKEY of RENAME: the entry
+// still commits and the client gets the error. Any other error means the
+// store failed, and the write isn't acked. A panic shuts the node down, as
+// it would in a built-in command.
+type CommandHandler func(ctx context.Context, st Store, parts protocol.Command) (string, error)
+
+var (
+	pluginsMu sync.Mutex
+	plugins   = map[string]CommandHandler{}
+)
+
+// entryCommands only ever arrive in log entries, never from clients, so
+// they can't be registered either. A client's IDEM prefix is taken off
+// before its command is looked up, see takeToken.
+var entryCommands = []string{"BATCH", "IDEM", "CACHEFLUSHED"}
+
+// RegisterCommand adds the write command name, applied by h. It fails for
+// a name that is taken or can't be sent in a request line.
+func RegisterCommand(name string, h CommandHandler) error {
+	if h == nil {
+		return fmt.Errorf("command %s: no handler", name)
+	}
+	if name == "" || strings.ContainsFunc(name, func(r rune) bool { return r <= ' ' || r == 0x7f }) {
+		return fmt.Errorf("command %q: names are one word", name)
+	}
+	if commandTaken(name) {
+		return fmt.Errorf("command %s is built in", name)
+	}
+	pluginsMu.Lock()
+	defer pluginsMu.Unlock()
+	if _, ok := plugins[name]; ok {
+		return fmt.Errorf("command %s is already registered", name)
+	}
+	plugins[name] = h
+	return nil
+}
+
+func commandTaken(name string) bool {
+	for _, c := range builtinCommands() {
+		if c.name == name {
+			return true
+		}
+	}
+	for _, c := range entryCommands {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// pluginCommands are the registered commands, for a new registry.
+func pluginCommands() []command {
+	pluginsMu.Lock()
+	defer pluginsMu.Unlock()
+	var commands []command
+	for name, h := range plugins {
+		commands = append(commands, command{name: name, kind: writeCommand, keys: []int{1}, handle: (*Server).handlePlugin, apply: h})
+	}
+	return commands
+}
+
+func (s *Server) handlePlugin(r *request) outcome {
+	return s.replicate(r, r.parts.String())
+}
+
+// applyPlugin applies an entry for a registered command; ok is false if
+// there is no such command.
+func (s *Server) applyPlugin(ctx context.Context, parts protocol.Command) (reply string, ok bool, err error) {
+	c, ok := s.commands[parts[0]]
+	if !ok || c.apply == nil {
+		return "", false, nil
+	}
+	reply, err = c.apply(ctx, s.store, parts)
+	return reply, true, err
+}
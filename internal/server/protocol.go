@@ -0,0 +1,87 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Clients may open with PROTOCOL <version> to agree on a protocol version
+// before sending anything else. We answer with the lower of theirs and ours,
+// which is what the connection speaks from then on; clients that never ask
+// get version 1. A client older than we support gets an ERR instead, so it
+// fails up front rather than misreading replies later. PROTOCOL without a
+// version reports what the connection currently speaks.
+//
+// Version 2 replaced free-text errors with coded ones, see Code.
+const (
+	ClientProtocolVersion    = 2
+	MinClientProtocolVersion = 1
+)
+
+// negotiateClientProtocol returns the version the connection speaks next.
+func negotiateClientProtocol(args []string, current int) (int, *Error) {
+	if len(args) == 0 {
+		return current, nil
+	}
+	if len(args) != 1 {
+		return 0, newError(CodeSyntax, "usage: PROTOCOL [version]")
+	}
+	theirs, err := strconv.Atoi(args[0])
+	if err != nil || theirs < 1 {
+		return 0, newError(CodeSyntax, "protocol version must be a positive integer")
+	}
+	if theirs < MinClientProtocolVersion {
+		return 0, newError(CodeProtocol, "protocol version %d not supported, this server speaks %d-%d", theirs, MinClientProtocolVersion, ClientProtocolVersion)
+	}
+	return min(theirs, ClientProtocolVersion), nil
+}
+
+// features are the optional capabilities HELLO advertises, so a client can
+// check for one before relying on it rather than probing with commands.
+// The list follows the node's configuration and what the connection
+// negotiated: a capability that is turned off, or that a witness has no
+// data for, isn't listed. Add a name here when adding such a capability.
+func (s *Server) features(protocol int) []string {
+	var f []string
+	if protocol >= 2 {
+		f = append(f, "errorcodes") // ERR_<CODE> replies
+	}
+	if s.monitors.enabled.Load() {
+		f = append(f, "monitor") // MONITOR, see SetMonitor
+	}
+	if s.raft.IsWitness() {
+		return f // everything below needs the data
+	}
+	f = append(f,
+		"bitmaps",      // SETBIT, GETBIT, BITCOUNT
+		"save",         // SAVE
+		"sessions",     // SESSION, MININDEX on reads
+		"idempotency",  // IDEM <token> in front of a write
+		"transactions", // TXN
+		"watch",        // GET /watch on the HTTP port, and client.Watch over it
+	)
+	if s.hotkeys.rate.Load() > 0 {
+		f = append(f, "hotkeys") // HOTKEYS, see SetHotKeys
+	}
+	return f
+}
+
+// hello answers HELLO [version]: it negotiates the protocol like PROTOCOL
+// does, then says who it is on one line:
+//
+//	HELLO version=dev protocol=2 node=:8080 role=leader features=errorcodes,bitmaps
+func (s *Server) hello(conn *clientConn, args []string) {
+	version, err := negotiateClientProtocol(args, conn.protocolVersion())
+	if err != nil {
+		writeError(conn, err)
+		return
+	}
+	conn.protocol.Store(int32(version))
+	role := strings.ToLower(s.raft.GetState())
+	if s.raft.IsWitness() {
+		role = "witness"
+	}
+	fmt.Fprintf(conn, "HELLO version=%s protocol=%d node=%s role=%s features=%s\n",
+		Version, version, s.raft.ID, role, strings.Join(s.features(version), ","))
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/mathdee/KV-Store/internal/raft"
+	"github.com/mathdee/KV-Store/internal/store"
+)
+
+// helloFeatures sends HELLO line and returns the features it lists.
+func helloFeatures(t *testing.T, c *testConn, line string) []string {
+	t.Helper()
+	reply := c.do(line)
+	_, list, ok := strings.Cut(reply, " features=")
+	if !strings.HasPrefix(reply, "HELLO ") || !ok {
+		t.Fatalf("%s: unexpected reply %q", line, reply)
+	}
+	return strings.Split(list, ",")
+}
+
+func TestHelloFeaturesFollowTheConfiguration(t *testing.T) {
+	srv, addr := testServer(t)
+	c := dialTest(t, addr)
+
+	got := helloFeatures(t, c, "HELLO 1")
+	for _, name := range []string{"bitmaps", "save", "sessions", "idempotency", "transactions", "watch", "hotkeys"} {
+		if !slices.Contains(got, name) {
+			t.Errorf("expected %s by default, got %v", name, got)
+		}
+	}
+	for _, name := range []string{"errorcodes", "monitor"} {
+		if slices.Contains(got, name) {
+			t.Errorf("expected no %s on protocol 1 with MONITOR off, got %v", name, got)
+		}
+	}
+
+	srv.SetMonitor(true)
+	srv.GetHotKeys().SetSampleRate(0)
+	got = helloFeatures(t, c, "HELLO 2")
+	if !slices.Contains(got, "errorcodes") || !slices.Contains(got, "monitor") || slices.Contains(got, "hotkeys") {
+		t.Errorf("expected errorcodes and monitor but no hotkeys, got %v", got)
+	}
+
+	witness := raft.NewConsensus(":1", nil)
+	witness.SetWitness(true)
+	if got := NewServer(store.NewStore(nil), witness).features(2); !slices.Equal(got, []string{"errorcodes"}) {
+		t.Errorf("expected a witness to offer nothing that needs data, got %v", got)
+	}
+}
@@ -0,0 +1,393 @@
+package server
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mathdee/KV-Store/internal/bitmap"
+	"github.com/mathdee/KV-Store/internal/protocol"
+	"github.com/mathdee/KV-Store/internal/raft"
+	"github.com/mathdee/KV-Store/internal/store"
+)
+
+// Tenants share a cluster through namespaces, the part of a key before its
+// first ':' (see store.Namespace). A quota bounds how many keys a namespace
+// may hold, how many bytes of keys and values, and how many write ops a
+// second it may make, so one application can't starve the others. The
+// leader checks every client write against the quotas of the namespaces it
+// touches before proposing it: a write that would take a namespace over its
+// keys or bytes is refused with QUOTA, and one over its rate with
+// RATELIMIT. Deletes are never refused for space, only counted towards the
+// rate. Usage is what the store has applied, so concurrent writes can
+// overshoot a limit by what they carry between them.
+
+// QuotaDefault names the quota of namespaces without one of their own.
+const QuotaDefault = "*"
+
+// Quota limits one namespace; zero means unlimited.
+type Quota struct {
+	MaxKeys  int     `json:"maxKeys,omitempty"`
+	MaxBytes int64   `json:"maxBytes,omitempty"` // keys plus values as stored
+	MaxQPS   float64 `json:"maxQPS,omitempty"`   // write ops a second, a batch counts each op
+}
+
+// ParseQuotas reads a -quotas flag value, namespaces separated by ';':
+//
+//	acme:keys=10000,bytes=67108864,qps=500;*:qps=1000
+func ParseQuotas(spec string) (map[string]Quota, error) {
+	quotas := map[string]Quota{}
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		ns, limits, ok := strings.Cut(entry, ":")
+		if !ok || ns == "" || strings.ContainsAny(ns, " \t") {
+			return nil, fmt.Errorf("bad quota %q, want namespace:keys=N,bytes=N,qps=N", entry)
+		}
+		if _, dup := quotas[ns]; dup {
+			return nil, fmt.Errorf("namespace %q has two quotas", ns)
+		}
+		var q Quota
+		for _, limit := range strings.Split(limits, ",") {
+			name, raw, _ := strings.Cut(strings.TrimSpace(limit), "=")
+			var err error
+			switch name {
+			case "keys":
+				q.MaxKeys, err = strconv.Atoi(raw)
+				err = nonNegative(err, q.MaxKeys < 0)
+			case "bytes":
+				q.MaxBytes, err = strconv.ParseInt(raw, 10, 64)
+				err = nonNegative(err, q.MaxBytes < 0)
+			case "qps":
+				q.MaxQPS, err = strconv.ParseFloat(raw, 64)
+				err = nonNegative(err, q.MaxQPS < 0 || math.IsNaN(q.MaxQPS) || math.IsInf(q.MaxQPS, 0))
+			default:
+				return nil, fmt.Errorf("quota of %q: unknown limit %q, want keys, bytes or qps", ns, name)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("quota of %q: bad %s %q", ns, name, raw)
+			}
+		}
+		quotas[ns] = q
+	}
+	return quotas, nil
+}
+
+func nonNegative(err error, negative bool) error {
+	if err == nil && negative {
+		return fmt.Errorf("negative")
+	}
+	return err
+}
+
+// tenant is what the leader counts for one namespace.
+type tenant struct {
+	tokens   float64 // write ops the rate allows right now, at most one second's worth
+	refilled time.Time
+	writes   int64 // write ops let through
+	rejected map[Code]int64
+}
+
+// Quotas holds the configured quotas and the per-namespace counters.
+type Quotas struct {
+	mu      sync.Mutex
+	limits  map[string]Quota
+	tenants map[string]*tenant
+}
+
+func NewQuotas(limits map[string]Quota) *Quotas {
+	q := &Quotas{tenants: map[string]*tenant{}}
+	q.Set(limits)
+	return q
+}
+
+// Set replaces the quotas, for writes from then on.
+func (q *Quotas) Set(limits map[string]Quota) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.limits = limits
+}
+
+// quota is ns's own quota or the default, callers hold q.mu.
+func (q *Quotas) quota(ns string) Quota {
+	if quota, ok := q.limits[ns]; ok {
+		return quota
+	}
+	return q.limits[QuotaDefault]
+}
+
+// tenant returns ns's counters, callers hold q.mu.
+func (q *Quotas) tenant(ns string) *tenant {
+	t, ok := q.tenants[ns]
+	if !ok {
+		t = &tenant{rejected: map[Code]int64{}}
+		q.tenants[ns] = t
+	}
+	return t
+}
+
+// refill tops t's tokens up for the time since the last refill.
+func (t *tenant) refill(qps float64, now time.Time) {
+	if t.refilled.IsZero() {
+		t.tokens = max(qps, 1)
+	} else {
+		t.tokens = min(t.tokens+qps*now.Sub(t.refilled).Seconds(), max(qps, 1))
+	}
+	t.refilled = now
+}
+
+// quotaChange is what a write does to one namespace.
+type quotaChange struct {
+	keys  int
+	bytes int64
+	ops   int
+}
+
+// quotaDelta works out what a write would change, namespace by namespace,
+// following several ops on the same key.
+type quotaDelta struct {
+	store   Store
+	sizes   map[string]int // entry size after the ops so far, -1 once deleted
+	changes map[string]*quotaChange
+}
+
+func newQuotaDelta(s Store) *quotaDelta {
+	return &quotaDelta{store: s, sizes: map[string]int{}, changes: map[string]*quotaChange{}}
+}
+
+func (d *quotaDelta) change(key string) *quotaChange {
+	ns := store.Namespace(key)
+	c, ok := d.changes[ns]
+	if !ok {
+		c = &quotaChange{}
+		d.changes[ns] = c
+	}
+	return c
+}
+
+// size is key's entry size as the ops so far leave it.
+func (d *quotaDelta) size(key string) (int, bool) {
+	if n, ok := d.sizes[key]; ok {
+		return n, n >= 0
+	}
+	return d.store.EntrySize(key)
+}
+
+// set counts one op that leaves key with an entry of size bytes, or
+// deletes it for a negative size.
+func (d *quotaDelta) set(key string, size int) {
+	c := d.change(key)
+	c.ops++
+	old, existed := d.size(key)
+	switch {
+	case size < 0 && existed:
+		c.keys--
+		c.bytes -= int64(old)
+	case size >= 0 && existed:
+		c.bytes += int64(size - old)
+	case size >= 0:
+		c.keys++
+		c.bytes += int64(size)
+	}
+	d.sizes[key] = size
+}
+
+// touch counts an op that leaves key as it is.
+func (d *quotaDelta) touch(key string) {
+	d.change(key).ops++
+}
+
+// addCommand adds a client write command, parts as checkLimits sees them.
+func (d *quotaDelta) addCommand(parts protocol.Command) {
+	if len(parts) < 2 {
+		return
+	}
+	key := parts[1]
+	valueLen := parts.RestLen(2)
+	switch parts[0] {
+	case "SET", "GETSET":
+		d.set(key, len(key)+valueLen)
+	case "SETNX":
+		if _, ok := d.size(key); ok {
+			d.touch(key)
+		} else {
+			d.set(key, len(key)+valueLen)
+		}
+	case "APPEND":
+		old, ok := d.size(key)
+		if !ok {
+			old = len(key)
+		}
+		d.set(key, old+valueLen)
+	case "SETBIT":
+		offset, err := bitmap.ParseOffset(parts[min(2, len(parts)-1)])
+		if err != nil {
+			return // refused before it is written
+		}
+		old, ok := d.size(key)
+		if grow := offset/8 + 1 - d.store.Strlen(key); !ok || grow > 0 {
+			d.set(key, max(old, len(key))+max(grow, 0))
+		} else {
+			d.touch(key)
+		}
+	case "GETDEL":
+		d.set(key, -1)
+	case "RENAME", "COPY":
+		if len(parts) < 3 {
+			return
+		}
+		src, dst := parts[1], parts[2]
+		n, ok := d.size(src)
+		if !ok {
+			d.touch(src) // refused with NOKEY, but still an op
+			return
+		}
+		if _, exists := d.size(dst); parts[0] == "COPY" && exists && len(parts) < 4 {
+			d.touch(dst) // COPY without REPLACE leaves dst alone
+			return
+		}
+		d.set(dst, n-len(src)+len(dst))
+		if parts[0] == "RENAME" && src != dst {
+			d.set(src, -1)
+		}
+	case "EVAL": // what a script writes isn't known up front
+		for _, i := range evalKeyArgs(parts) {
+			d.touch(parts[i])
+		}
+	case "ACQUIRE", "RELEASE":
+		d.touch(lockKey(key)) // counted as an op, a lock's few bytes aren't checked
+	case "TXN": // nor which of a transaction's branches runs
+		for _, i := range txnKeyArgs(parts) {
+			d.touch(parts[i])
+		}
+	default: // a registered command, whose writes can't be known up front
+		d.touch(key)
+	}
+}
+
+// addBatch adds the ops of a batch.
+func (d *quotaDelta) addBatch(ops []BatchOp) {
+	for _, op := range ops {
+		if op.Op == "delete" {
+			d.set(op.Key, -1)
+		} else {
+			d.set(op.Key, len(op.Key)+len(op.Value))
+		}
+	}
+}
+
+// SetQuotas replaces the namespace quotas.
+func (s *Server) SetQuotas(limits map[string]Quota) {
+	s.quotas.Set(limits)
+}
+
+// checkQuota refuses a write d describes if it takes a namespace over its
+// quota, and counts it towards the rate if not. Only the leader checks,
+// followers refuse writes anyway.
+func (s *Server) checkQuota(d *quotaDelta) *Error {
+	if len(d.changes) == 0 || s.raft.GetState() != raft.Leader {
+		return nil
+	}
+	q := s.quotas
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	for ns, c := range d.changes {
+		quota := q.quota(ns)
+		if quota.MaxKeys == 0 && quota.MaxBytes == 0 && quota.MaxQPS == 0 {
+			continue
+		}
+		var err *Error
+		if quota.MaxKeys > 0 || quota.MaxBytes > 0 {
+			used := s.store.NamespaceUsage(ns)
+			switch {
+			case quota.MaxKeys > 0 && c.keys > 0 && used.Keys+c.keys > quota.MaxKeys:
+				err = newError(CodeQuota, "namespace %q is over its key quota (max=%d, used=%d)", ns, quota.MaxKeys, used.Keys)
+			case quota.MaxBytes > 0 && c.bytes > 0 && used.Bytes+c.bytes > quota.MaxBytes:
+				err = newError(CodeQuota, "namespace %q is over its byte quota (max=%d, used=%d)", ns, quota.MaxBytes, used.Bytes)
+			}
+		}
+		t := q.tenant(ns)
+		if err == nil && quota.MaxQPS > 0 {
+			t.refill(quota.MaxQPS, now)
+			if t.tokens < 1 {
+				err = newError(CodeRateLimit, "namespace %q is over its write rate quota (max=%g/s), retry later", ns, quota.MaxQPS)
+			}
+		}
+		if err != nil {
+			t.rejected[err.Code] += int64(c.ops)
+			return err
+		}
+	}
+	// Every namespace has room, so the write goes ahead and counts for all.
+	for ns, c := range d.changes {
+		t := q.tenant(ns)
+		t.writes += int64(c.ops)
+		if quota := q.quota(ns); quota.MaxQPS > 0 {
+			t.refill(quota.MaxQPS, now)
+			t.tokens -= float64(c.ops) // a big batch may leave it owing
+		}
+	}
+	return nil
+}
+
+// TenantStatus is what /tenants and INFO tenants report for a namespace.
+type TenantStatus struct {
+	Namespace   string `json:"namespace"` // "" for keys without one
+	Quota       Quota  `json:"quota"`
+	Keys        int    `json:"keys"`
+	Bytes       int64  `json:"bytes"`
+	Writes      int64  `json:"writes"`      // write ops let through while this node led
+	OverQuota   int64  `json:"overQuota"`   // write ops refused with QUOTA
+	RateLimited int64  `json:"rateLimited"` // and with RATELIMIT
+}
+
+// Tenants reports every namespace that holds keys, has a quota of its own
+// or has written, by namespace.
+func (s *Server) Tenants() []TenantStatus {
+	usage := s.store.Namespaces()
+	q := s.quotas
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	byNS := map[string]*TenantStatus{}
+	get := func(ns string) *TenantStatus {
+		st, ok := byNS[ns]
+		if !ok {
+			st = &TenantStatus{Namespace: ns, Quota: q.quota(ns)}
+			byNS[ns] = st
+		}
+		return st
+	}
+	for ns, u := range usage {
+		st := get(ns)
+		st.Keys, st.Bytes = u.Keys, u.Bytes
+	}
+	for ns := range q.limits {
+		if ns != QuotaDefault {
+			get(ns)
+		}
+	}
+	for ns, t := range q.tenants {
+		st := get(ns)
+		st.Writes, st.OverQuota, st.RateLimited = t.writes, t.rejected[CodeQuota], t.rejected[CodeRateLimit]
+	}
+	out := make([]TenantStatus, 0, len(byNS))
+	for _, st := range byNS {
+		out = append(out, *st)
+	}
+	slices.SortFunc(out, func(a, b TenantStatus) int { return cmp.Compare(a.Namespace, b.Namespace) })
+	return out
+}
+
+// SetTenants serves per-namespace usage and quotas on /tenants, usually
+// Server.Tenants.
+func (h *HTTPServer) SetTenants(tenants func() []TenantStatus) {
+	h.tenants = tenants
+}
@@ -0,0 +1,315 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/mathdee/KV-Store/internal/protocol"
+	"github.com/mathdee/KV-Store/internal/raft"
+	"github.com/mathdee/KV-Store/internal/tracing"
+)
+
+// Every command the TCP port answers is registered in builtinCommands with
+// its kind, and the kind decides the middleware it runs through on the way
+// to its handler, outermost first:
+//
+//	reads   tracing, witness refusal, MININDEX, limits and hot keys, metrics and slowlog
+//	writes  tracing, witness refusal, idempotency tokens, limits and hot keys, quotas and rate limits, metrics and slowlog
+//	raft    the protocol version of the sender
+//	other   nothing, unless audited
+//
+// so adding a command is one entry, and a concern every command of a kind
+// shares is one middleware in chain. The key positions of an entry are what
+// limits, hot keys and cache mode read its keys from. Commands added with
+// RegisterCommand join them as writes, see plugin.go.
+
+type commandKind int
+
+const (
+	otherCommand commandKind = iota // PING, INFO, SAVE and the like
+	readCommand                     // client commands that only read their keys
+	writeCommand                    // client commands that go through raft
+	raftMessage                     // from peers, with a protocol version, see raft.SplitVersion
+)
+
+// outcome is how a handler went, for the middleware around it.
+type outcome int
+
+const (
+	answered  outcome = iota // replied, maybe with an error
+	succeeded                // did what was asked: counted in the metrics, audited
+	hangUp                   // the handler took the connection over, or the stream can't be trusted
+)
+
+// request is one command on its way through the middleware, which may strip
+// the arguments meant for it from parts and add to ctx.
+type request struct {
+	ctx      context.Context
+	conn     *clientConn
+	scanner  *bufio.Scanner // commands followed by more lines read them from here
+	cmd      *command
+	parts    protocol.Command
+	parser   *protocol.Parser // parts came from its last line, see rest
+	clientID string
+	reqID    string    // "" for raft messages
+	start    time.Time // when the line was read
+	replyTag string    // raft replies answer in the sender's protocol version
+	audit    func()    // logs the command as audited does, for a handler that won't return soon
+	token    string    // from an IDEM prefix, see idempotency.go
+}
+
+// rest is r.parts.Rest(i), sliced from the line the client sent where it
+// can be rather than joined.
+func (r *request) rest(i int) string {
+	return r.parser.Rest(r.parts, i)
+}
+
+type commandHandler func(s *Server, r *request) outcome
+
+type middleware func(next commandHandler) commandHandler
+
+type command struct {
+	name   string
+	kind   commandKind
+	keys   []int                              // positions of the key arguments
+	keysOf func(parts protocol.Command) []int // instead of keys, for commands whose keys move
+	audit  bool                               // log who ran it, without the confirmation token of those that take one
+	handle commandHandler
+	run    commandHandler // handle wrapped in the middleware
+	apply  CommandHandler // applies the entries of a command added with RegisterCommand
+}
+
+// builtinCommands is a function rather than a map literal because the
+// handlers reach the cache, which asks the registry for keys: a variable
+// would depend on itself.
+func builtinCommands() []command {
+	return []command{
+		{name: "SET", kind: writeCommand, keys: []int{1}, handle: (*Server).handleSet},
+		{name: "SETNX", kind: writeCommand, keys: []int{1}, handle: (*Server).handleSetValue},
+		{name: "GETSET", kind: writeCommand, keys: []int{1}, handle: (*Server).handleSetValue},
+		{name: "APPEND", kind: writeCommand, keys: []int{1}, handle: (*Server).handleSetValue},
+		{name: "SETBIT", kind: writeCommand, keys: []int{1}, handle: (*Server).handleSetBit},
+		{name: "GETDEL", kind: writeCommand, keys: []int{1}, handle: (*Server).handleGetDel},
+		{name: "RENAME", kind: writeCommand, keys: []int{1, 2}, handle: (*Server).handleRename},
+		{name: "COPY", kind: writeCommand, keys: []int{1, 2}, handle: (*Server).handleCopy},
+		{name: "EVAL", kind: writeCommand, keysOf: evalKeyArgs, handle: (*Server).handleEval},
+		{name: "TXN", kind: writeCommand, keysOf: txnKeyArgs, handle: (*Server).handleTxn},
+		{name: "ACQUIRE", kind: writeCommand, keys: []int{1}, handle: (*Server).handleAcquire},
+		{name: "RELEASE", kind: writeCommand, keys: []int{1}, handle: (*Server).handleRelease},
+
+		{name: "GET", kind: readCommand, keys: []int{1}, handle: (*Server).handleGet},
+		{name: "STRLEN", kind: readCommand, keys: []int{1}, handle: (*Server).handleStrlen},
+		{name: "GETBIT", kind: readCommand, keys: []int{1}, handle: (*Server).handleGetBit},
+		{name: "BITCOUNT", kind: readCommand, keys: []int{1}, handle: (*Server).handleBitCount},
+		{name: "STAT", kind: readCommand, keys: []int{1}, handle: (*Server).handleStat},
+		{name: "HISTORY", kind: readCommand, keys: []int{1}, handle: (*Server).handleHistory},
+
+		{name: "FLUSHALL", audit: true, handle: (*Server).handleFlushCommand},
+		{name: "FLUSHNS", audit: true, handle: (*Server).handleFlushCommand},
+		{name: "MONITOR", audit: true, handle: (*Server).handleMonitor},
+		{name: "PING", handle: (*Server).handlePing},
+		{name: "ECHO", handle: (*Server).handleEcho},
+		{name: "CLIENT", handle: withConn((*Server).handleClient)},
+		{name: "HELLO", handle: (*Server).handleHello},
+		{name: "PROTOCOL", handle: (*Server).handleProtocol},
+		{name: "SAVE", handle: (*Server).handleSave},
+		{name: "INFO", handle: withConn((*Server).handleInfo)},
+		{name: "SLOWLOG", handle: withConn((*Server).handleSlowlog)},
+		{name: "SESSION", handle: withConn((*Server).handleSession)},
+		{name: "HOTKEYS", handle: withConn((*Server).handleHotKeys)},
+		{name: "JOIN", handle: (*Server).handleJoin},
+
+		{name: "APPENDENTRIES", kind: raftMessage, handle: (*Server).handleAppendEntries},
+		{name: "INSTALLSNAPSHOT", kind: raftMessage, handle: (*Server).handleInstallSnapshot},
+		{name: "VOTEREQUEST", kind: raftMessage, handle: (*Server).handleVote},
+		{name: "PREVOTE", kind: raftMessage, handle: (*Server).handleVote},
+		{name: "HEARTBEAT", kind: raftMessage, handle: (*Server).handleHeartbeat},
+		{name: "HANDSHAKE", kind: raftMessage, handle: (*Server).handleHandshake},
+		{name: "SYNCSHARDS", kind: raftMessage, handle: (*Server).handleSyncShardsCommand},
+		{name: "MERKLE", kind: raftMessage, handle: (*Server).handleMerkle},
+	}
+}
+
+func newCommandRegistry() map[string]*command {
+	commands := map[string]*command{}
+	for _, c := range append(builtinCommands(), pluginCommands()...) {
+		c.run = chain(&c)
+		commands[c.name] = &c
+	}
+	return commands
+}
+
+// keyArgs are the positions of the keys in parts, a line of c.
+func (c *command) keyArgs(parts protocol.Command) []int {
+	if c.keysOf != nil {
+		return c.keysOf(parts)
+	}
+	return c.keys
+}
+
+// chain wraps c's handler in the middleware for its kind.
+func chain(c *command) commandHandler {
+	var stack []middleware
+	switch c.kind {
+	case readCommand:
+		stack = []middleware{traced, dataOnly, minIndex, limited, measured}
+	case writeCommand:
+		stack = []middleware{traced, dataOnly, idempotent, limited, quota, measured}
+	case raftMessage:
+		stack = []middleware{versioned}
+	}
+	if c.audit {
+		stack = append(stack, audited)
+	}
+	h := c.handle
+	for i := len(stack) - 1; i >= 0; i-- {
+		h = stack[i](h)
+	}
+	return h
+}
+
+// withConn adapts a handler that only needs the connection and the line.
+func withConn(h func(*Server, net.Conn, []string)) commandHandler {
+	return func(s *Server, r *request) outcome {
+		h(s, r.conn, r.parts)
+		return answered
+	}
+}
+
+// traced runs the command in a span of its own, the parse its first child.
+func traced(next commandHandler) commandHandler {
+	return func(s *Server, r *request) outcome {
+		if !tracing.Enabled() {
+			return next(s, r)
+		}
+		var span trace.Span
+		r.ctx, span = tracing.Start(r.ctx, "kv."+r.cmd.name, trace.WithTimestamp(r.start),
+			trace.WithAttributes(attribute.String("kv.remote", r.conn.addr), attribute.String("kv.request_id", r.reqID)))
+		defer span.End()
+		_, parseSpan := tracing.Start(r.ctx, "server.parse", trace.WithTimestamp(r.start))
+		parseSpan.End()
+		return next(s, r)
+	}
+}
+
+// dataOnly refuses the command on a witness, which has no data.
+func dataOnly(next commandHandler) commandHandler {
+	return func(s *Server, r *request) outcome {
+		if s.raft.IsWitness() {
+			writeError(r.conn, newError(CodeWitness, "witness node stores no data, ask a data node"))
+			return answered
+		}
+		return next(s, r)
+	}
+}
+
+// idempotent tags a write with its IDEM token, so retries of it get its
+// first result.
+func idempotent(next commandHandler) commandHandler {
+	return func(s *Server, r *request) outcome {
+		if r.token != "" {
+			r.ctx = withIdempotencyToken(r.ctx, r.token)
+		}
+		return next(s, r)
+	}
+}
+
+// minIndex holds a read with MININDEX until the node has applied that far.
+func minIndex(next commandHandler) commandHandler {
+	return func(s *Server, r *request) outcome {
+		rest, index, err := splitMinIndex(r.parts)
+		if err == nil && index >= 0 {
+			r.parts = rest
+			if err = s.WaitIndex(r.ctx, index); err == nil {
+				r.conn.sawIndex(index)
+			}
+		}
+		if err != nil {
+			writeError(r.conn, err)
+			return answered
+		}
+		return next(s, r)
+	}
+}
+
+// limited refuses keys and values over the limits, and counts the keys for
+// HOTKEYS.
+func limited(next commandHandler) commandHandler {
+	return func(s *Server, r *request) outcome {
+		keys := r.cmd.keyArgs(r.parts)
+		if err := s.checkLimits(r.parts, keys); err != nil {
+			writeError(r.conn, err)
+			return answered
+		}
+		s.hotkeys.observeCommand(r.parts, keys, r.cmd.kind == writeCommand)
+		return next(s, r)
+	}
+}
+
+// quota refuses a write that would take its namespace over its quotas or
+// its write rate.
+func quota(next commandHandler) commandHandler {
+	return func(s *Server, r *request) outcome {
+		d := newQuotaDelta(s.store)
+		d.addCommand(r.parts)
+		if err := s.checkQuota(d); err != nil {
+			writeError(r.conn, err)
+			return answered
+		}
+		return next(s, r)
+	}
+}
+
+// measured times the command for the metrics and the slowlog.
+func measured(next commandHandler) commandHandler {
+	return func(s *Server, r *request) outcome {
+		o := next(s, r)
+		if o == succeeded {
+			s.metrics.RecordSuccess(time.Since(r.start))
+		}
+		if o != hangUp {
+			s.slowlog.Record(r.conn.addr, r.parts, r.start, time.Since(r.start))
+		}
+		return o
+	}
+}
+
+// versioned takes the protocol version off a raft message. A version we
+// don't speak hangs up, whatever follows the header can't be trusted.
+func versioned(next commandHandler) commandHandler {
+	return func(s *Server, r *request) outcome {
+		var version int
+		r.parts, version = raft.SplitVersion(r.parts)
+		if err := raft.CheckVersion(version); err != nil {
+			writeError(r.conn, newError(CodeProtocol, "%v", err))
+			return hangUp
+		}
+		r.replyTag = raft.ReplyTag(version)
+		return next(s, r)
+	}
+}
+
+// audited logs who ran the command once it has, or when the handler calls
+// r.audit. The last argument, a FLUSH confirmation token, is left out.
+func audited(next commandHandler) commandHandler {
+	return func(s *Server, r *request) outcome {
+		logged := false
+		r.audit = func() {
+			if !logged {
+				logged = true
+				fmt.Printf("[%s] %s executed by %s\n", s.raft.ID, r.parts[:max(len(r.parts)-1, 1)].String(), r.conn.RemoteAddr())
+			}
+		}
+		o := next(s, r)
+		if o == succeeded {
+			r.audit()
+		}
+		return o
+	}
+}
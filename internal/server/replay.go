@@ -0,0 +1,33 @@
+package server
+
+import (
+	"context"
+	"errors"
+
+	"github.com/mathdee/KV-Store/internal/raft"
+	"github.com/mathdee/KV-Store/internal/store"
+)
+
+// ReplayFailure is an entry ReplayLog couldn't apply.
+type ReplayFailure struct {
+	Index   int    `json:"index"`
+	Command string `json:"command"`
+	Error   string `json:"error"`
+}
+
+// ReplayLog applies entries, the first at index first, to st the way a
+// follower applies them, for kv-admin replay. As on a live node an entry
+// that fails is reported and skipped; one that refuses, like a RENAME of a
+// missing key, just changes nothing.
+func ReplayLog(st Store, first int, entries []raft.LogEntry) []ReplayFailure {
+	s := NewServer(st, raft.NewConsensus("replay", nil))
+	var failed []ReplayFailure
+	for i, e := range entries {
+		ctx := store.WithIndex(context.Background(), first+i)
+		var refused *Error
+		if _, err := s.apply(ctx, e.Command); err != nil && !errors.As(err, &refused) {
+			failed = append(failed, ReplayFailure{Index: first + i, Command: e.Command, Error: err.Error()})
+		}
+	}
+	return failed
+}
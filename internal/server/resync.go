@@ -0,0 +1,384 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mathdee/KV-Store/internal/merkle"
+	"github.com/mathdee/KV-Store/internal/protocol"
+	"github.com/mathdee/KV-Store/internal/raft"
+	"github.com/mathdee/KV-Store/internal/store"
+)
+
+// Resync rebuilds a follower from the leader without copying everything:
+// both sides build a Merkle tree (see internal/merkle) of their state at
+// the same index, the follower walks down from the root asking only for
+// the children of nodes that differ, and then fetches the keys of the
+// leaves that differ. One connection carries the whole exchange, against a
+// snapshot the leader takes when it starts:
+//
+//	MERKLE                  MERKLE <index> <depth> <root> <keys>
+//	NODES <level> <i,...>   HASHES <n>, then the children of each node, one line each
+//	KEYS <leaf,...>         KEYS <count>, then count key/value lines as in INSTALLSNAPSHOT
+//	DONE
+//
+// The follower's state must stay at the leader's index until the repair is
+// in, so while a resync runs it stops applying past that index. It still
+// appends and acknowledges entries and applies them once the resync ends.
+
+// resyncTimeout bounds a whole resync, and so how long applying is held.
+const resyncTimeout = time.Minute
+
+// merkleLeafKeys is about how many keys the leader puts in each leaf.
+const merkleLeafKeys = 64
+
+// merkleBatch is how many nodes one NODES or KEYS request names.
+const merkleBatch = 1024
+
+// ResyncReport is what a resync found and changed.
+type ResyncReport struct {
+	Leader          string `json:"leader"`
+	Index           int    `json:"index"` // raft index both states were compared at
+	Depth           int    `json:"depth"`
+	LeaderKeys      int    `json:"leaderKeys"`
+	NodesCompared   int    `json:"nodesCompared"`
+	LeavesDiffered  int    `json:"leavesDiffered"`
+	KeysTransferred int    `json:"keysTransferred"`
+	KeysChanged     int    `json:"keysChanged"` // rewritten or removed here
+	RootMatch       bool   `json:"rootMatch"`   // our tree equals the leader's afterwards
+	DurationMs      int64  `json:"durationMs"`
+}
+
+// ResyncFunc runs a resync, see Server.Resync.
+type ResyncFunc func(context.Context) (ResyncReport, error)
+
+// applyHold stops followers applying past an index while a resync runs.
+type applyHold struct {
+	mu     sync.Mutex
+	index  int
+	lifted chan struct{} // nil when no hold is set
+}
+
+func (h *applyHold) set(index int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.index, h.lifted = index, make(chan struct{})
+}
+
+func (h *applyHold) lift() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.lifted != nil {
+		close(h.lifted)
+		h.lifted = nil
+	}
+}
+
+// blocks returns what to wait on before applying index, nil if nothing.
+func (h *applyHold) blocks(index int) <-chan struct{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.lifted != nil && index > h.index {
+		return h.lifted
+	}
+	return nil
+}
+
+// waitHold waits until index may be applied. Callers hold applyMu shared,
+// which is let go meanwhile so the resync can take it.
+func (s *Server) waitHold(index int) {
+	for lifted := s.hold.blocks(index); lifted != nil; lifted = s.hold.blocks(index) {
+		s.applyMu.RUnlock()
+		<-lifted
+		s.applyMu.RLock()
+	}
+}
+
+// Resync compares this follower's state with the leader's and fetches the
+// keys of every Merkle leaf that differs, as POST /resync does.
+func (s *Server) Resync(ctx context.Context) (ResyncReport, error) {
+	started := time.Now()
+	leader := s.raft.Leader()
+	report := ResyncReport{Leader: leader}
+	switch {
+	case s.raft.GetState() != raft.Follower:
+		return report, fmt.Errorf("only a follower resyncs, this node is %s", s.raft.GetState())
+	case s.raft.IsWitness():
+		return report, fmt.Errorf("a witness holds no data")
+	case leader == "":
+		return report, fmt.Errorf("no known leader")
+	}
+	ctx, cancel := context.WithTimeout(ctx, resyncTimeout)
+	defer cancel()
+
+	conn, err := s.raft.DialPeer(leader)
+	if err != nil {
+		return report, err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	m := &merkleClient{conn: conn, w: bufio.NewWriter(conn), scanner: bufio.NewScanner(conn)}
+	m.scanner.Buffer(make([]byte, 0, 64*1024), s.limits.Load().lineLimit())
+
+	header, err := m.call(fmt.Sprintf("MERKLE v%d", raft.ProtocolVersion), "MERKLE", 5)
+	if err != nil {
+		return report, err
+	}
+	index, err1 := strconv.Atoi(header[1])
+	depth, err2 := strconv.Atoi(header[2])
+	root, err3 := strconv.ParseUint(header[3], 16, 64)
+	keys, err4 := strconv.Atoi(header[4])
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil || depth < 1 || depth > merkle.MaxDepth {
+		return report, fmt.Errorf("malformed answer %q", strings.Join(header, " "))
+	}
+	report.Index, report.Depth, report.LeaderKeys = index, depth, keys
+
+	s.hold.set(index)
+	defer s.hold.lift()
+	var snap *store.Snapshot
+	if !s.atIndex(ctx, index, func() { snap = s.store.Snapshot() }) {
+		return report, fmt.Errorf("couldn't stop at the leader's index %d (applied %d), try again", index, s.Applied())
+	}
+	ours := buildTree(snap, depth)
+	snap.Close()
+
+	// Walk down through the nodes that differ, a level per round trip.
+	report.NodesCompared = 1
+	differ := []int{0}
+	if ours.Root() == root {
+		differ = nil
+	}
+	for level := 0; level < depth && len(differ) > 0; level++ {
+		var next []int
+		for start := 0; start < len(differ); start += merkleBatch {
+			batch := differ[start:min(start+merkleBatch, len(differ))]
+			children, err := m.nodes(level, batch)
+			if err != nil {
+				return report, err
+			}
+			for i, parent := range batch {
+				next = append(next, ours.DiffChildren(level, parent, children[i])...)
+			}
+			report.NodesCompared += len(batch) * merkle.Fanout
+		}
+		differ = next
+	}
+	report.LeavesDiffered = len(differ)
+
+	leaves := make(map[int]bool, len(differ))
+	data, expires := make(map[string]string), make(map[string]int64)
+	for start := 0; start < len(differ); start += merkleBatch {
+		batch := differ[start:min(start+merkleBatch, len(differ))]
+		for _, leaf := range batch {
+			leaves[leaf] = true
+		}
+		if err := m.keys(batch, data, expires); err != nil {
+			return report, err
+		}
+	}
+	report.KeysTransferred = len(data)
+
+	var repairErr error
+	done := s.atIndex(ctx, index, func() {
+		if len(leaves) > 0 {
+			in := func(key string) bool { return leaves[ours.Leaf(key)] }
+			report.KeysChanged, repairErr = s.store.RepairRange(ctx, in, data, expires)
+		}
+		snap = s.store.Snapshot()
+	})
+	m.send("DONE")
+	if !done {
+		return report, fmt.Errorf("applied past the leader's index %d while resyncing", index)
+	}
+	after := buildTree(snap, depth)
+	snap.Close()
+	report.RootMatch = after.Root() == root
+	report.DurationMs = time.Since(started).Milliseconds()
+	if repairErr != nil {
+		return report, fmt.Errorf("repairing %d leaves: %w", len(leaves), repairErr)
+	}
+	fmt.Printf("[%s] Resync from %s at index %d: %d of %d leaves differed, %d keys transferred, %d changed\n",
+		s.raft.ID, leader, index, len(leaves), 1<<(4*depth), report.KeysTransferred, report.KeysChanged)
+	if !report.RootMatch {
+		return report, fmt.Errorf("state still differs from the leader's after the resync")
+	}
+	return report, nil
+}
+
+// buildTree hashes every key of snap into a tree of the given depth.
+func buildTree(snap *store.Snapshot, depth int) *merkle.Tree {
+	t := merkle.New(depth)
+	snap.Range(func(k, v string) bool {
+		t.Add(k, v, snap.Expiry(k))
+		return true
+	})
+	t.Seal()
+	return t
+}
+
+// merkleClient is the follower's end of a resync connection.
+type merkleClient struct {
+	conn    net.Conn
+	w       *bufio.Writer
+	scanner *bufio.Scanner
+}
+
+func (m *merkleClient) send(line string) error {
+	m.w.WriteString(line + "\n")
+	return m.w.Flush()
+}
+
+// call sends line and reads an answer of fields fields starting with want.
+func (m *merkleClient) call(line string, want string, fields int) ([]string, error) {
+	if err := m.send(line); err != nil {
+		return nil, err
+	}
+	if !m.scanner.Scan() {
+		return nil, fmt.Errorf("no answer to %s: %v", strings.Fields(line)[0], m.scanner.Err())
+	}
+	answer, _ := raft.SplitVersion(strings.Fields(m.scanner.Text()))
+	if len(answer) != fields || answer[0] != want {
+		return nil, fmt.Errorf("unexpected answer %q", m.scanner.Text())
+	}
+	return answer, nil
+}
+
+// nodes fetches the leader's children of each node at level.
+func (m *merkleClient) nodes(level int, parents []int) ([][]uint64, error) {
+	answer, err := m.call(fmt.Sprintf("NODES %d %s", level, joinInts(parents)), "HASHES", 2)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := strconv.Atoi(answer[1]); err != nil || n != len(parents) {
+		return nil, fmt.Errorf("asked for %d nodes, got %q", len(parents), answer[1])
+	}
+	children := make([][]uint64, len(parents))
+	for i := range parents {
+		if !m.scanner.Scan() {
+			return nil, fmt.Errorf("hashes ended after %d of %d nodes", i, len(parents))
+		}
+		if children[i], err = merkle.ParseHashes(m.scanner.Text()); err != nil {
+			return nil, err
+		}
+	}
+	return children, nil
+}
+
+// keys fetches the leader's keys in leaves into data and expires.
+func (m *merkleClient) keys(leaves []int, data map[string]string, expires map[string]int64) error {
+	answer, err := m.call("KEYS "+joinInts(leaves), "KEYS", 2)
+	if err != nil {
+		return err
+	}
+	count, err := strconv.Atoi(answer[1])
+	if err != nil {
+		return fmt.Errorf("bad key count %q", answer[1])
+	}
+	got, gotExpires, err := raft.ReadSnapshotData(m.scanner, count)
+	if err != nil {
+		return err
+	}
+	for k, v := range got {
+		data[k] = v
+	}
+	for k, at := range gotExpires {
+		expires[k] = at
+	}
+	return nil
+}
+
+// serveMerkle answers a follower's resync on conn until it is done.
+func (s *Server) serveMerkle(conn net.Conn, scanner *bufio.Scanner, replyTag string) {
+	w := bufio.NewWriter(conn)
+	defer w.Flush()
+	if s.raft.GetState() != raft.Leader {
+		fmt.Fprintf(w, "ERR not the leader%s\n", replyTag)
+		return
+	}
+	s.applyMu.Lock() // the store matches the log up to Applied()
+	index := s.Applied()
+	snap := s.store.Snapshot()
+	s.applyMu.Unlock()
+	defer snap.Close()
+
+	tree := buildTree(snap, merkle.DepthFor(snap.Len(), merkleLeafKeys))
+	fmt.Fprintf(w, "MERKLE %d %d %x %d%s\n", index, tree.Depth(), tree.Root(), snap.Len(), replyTag)
+	w.Flush()
+	leaves := 1 << (4 * tree.Depth())
+
+	for conn.SetReadDeadline(time.Now().Add(resyncTimeout)); scanner.Scan(); conn.SetReadDeadline(time.Now().Add(resyncTimeout)) {
+		parts, _ := protocol.Parse(scanner.Text())
+		switch {
+		case len(parts) == 3 && parts[0] == "NODES":
+			level, err := strconv.Atoi(parts[1])
+			if err != nil || level < 0 || level >= tree.Depth() {
+				fmt.Fprintf(w, "ERR bad level %q\n", parts[1])
+				return
+			}
+			nodes, err := parseInts(parts[2], 1<<(4*level))
+			if err != nil {
+				fmt.Fprintf(w, "ERR %v\n", err)
+				return
+			}
+			fmt.Fprintf(w, "HASHES %d\n", len(nodes))
+			for _, i := range nodes {
+				w.WriteString(merkle.FormatHashes(tree.Children(level, i)) + "\n")
+			}
+		case len(parts) == 2 && parts[0] == "KEYS":
+			list, err := parseInts(parts[1], leaves)
+			if err != nil {
+				fmt.Fprintf(w, "ERR %v\n", err)
+				return
+			}
+			want := make(map[int]bool, len(list))
+			for _, leaf := range list {
+				want[leaf] = true
+			}
+			var keys, values []string
+			snap.Range(func(k, v string) bool {
+				if want[tree.Leaf(k)] {
+					keys = append(keys, k)
+					values = append(values, v)
+				}
+				return true
+			})
+			fmt.Fprintf(w, "KEYS %d\n", len(keys))
+			for i, k := range keys {
+				writeKeyLine(w, k, values[i], snap.Expiry(k))
+			}
+		default: // DONE, or a follower we don't understand
+			return
+		}
+		if w.Flush() != nil {
+			return
+		}
+	}
+}
+
+func joinInts(list []int) string {
+	parts := make([]string, len(list))
+	for i, n := range list {
+		parts[i] = strconv.Itoa(n)
+	}
+	return strings.Join(parts, ",")
+}
+
+// parseInts reads what joinInts wrote, each in [0, limit).
+func parseInts(text string, limit int) ([]int, error) {
+	var list []int
+	for _, field := range strings.Split(text, ",") {
+		n, err := strconv.Atoi(field)
+		if err != nil || n < 0 || n >= limit {
+			return nil, fmt.Errorf("bad node %q", field)
+		}
+		list = append(list, n)
+	}
+	return list, nil
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"io"
+	"sync"
+
+	"github.com/mathdee/KV-Store/internal/protocol"
+)
+
+// The command loop runs every request's line through the same few buffers,
+// so a GET or SET allocates for what it keeps and little else: the line is
+// read into the scanner's buffer, split by a protocol.Parser that reuses its
+// words, and the reply is written from a buffer of its own rather than by
+// fmt. The buffers belong to the connection and go back to scratchPool when
+// it closes, so a client connecting for a single command doesn't pay for a
+// fresh 64KiB line buffer either.
+
+// maxPooledReply is the largest reply buffer put back in the pool; one
+// grown by a big value is left to the GC.
+const maxPooledReply = 64 * 1024
+
+var scratchPool = sync.Pool{New: func() any { return new(connScratch) }}
+
+// connScratch is one connection's command loop buffers.
+type connScratch struct {
+	line   []byte // the scanner's buffer
+	parser protocol.Parser
+	reply  []byte
+	req    request // the command being handled, reset for each one
+}
+
+// lineBuffer is the scanner's buffer, at most limit long.
+func (sc *connScratch) lineBuffer(limit int) []byte {
+	if sc.line == nil {
+		sc.line = make([]byte, 0, min(64*1024, limit))
+	}
+	return sc.line[:0:min(cap(sc.line), limit)]
+}
+
+func (sc *connScratch) release() {
+	sc.req = request{}
+	if cap(sc.reply) > maxPooledReply {
+		sc.reply = nil
+	}
+	scratchPool.Put(sc)
+}
+
+// writeLine writes s and a line break to w in one Write. On a client's
+// connection that goes through its reply buffer; only the command loop may
+// use it there, the buffer isn't locked.
+func writeLine(w io.Writer, s string) {
+	cc, ok := w.(*clientConn)
+	if !ok || cc.scratch == nil {
+		io.WriteString(w, s+"\n")
+		return
+	}
+	cc.scratch.reply = append(append(cc.scratch.reply[:0], s...), '\n')
+	cc.Write(cc.scratch.reply)
+}
@@ -2,26 +2,98 @@ package server
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/mathdee/KV-Store/internal/bitmap"
+	"github.com/mathdee/KV-Store/internal/certs"
+	"github.com/mathdee/KV-Store/internal/clock"
+	"github.com/mathdee/KV-Store/internal/crash"
+	"github.com/mathdee/KV-Store/internal/history"
 	"github.com/mathdee/KV-Store/internal/raft"
-
-	"github.com/mathdee/KV-Store/internal/store"
+	"github.com/mathdee/KV-Store/internal/tracing"
+	"github.com/mathdee/KV-Store/internal/wal"
 )
 
 type Server struct {
-	store   *store.Store
+	store   Store
 	peers   []string // creates a slice of strings to store the addresses of the replicas.
 	raft    *raft.Consensus
 	metrics *Metrics
+	history *history.Recorder // nil unless linearizability recording is on
+
+	confirms *confirmTokens         // outstanding FLUSHALL/FLUSHNS confirmation tokens
+	limits   atomic.Pointer[Limits] // key and value size limits, DefaultLimits unless SetLimits is called
+	slowlog  *Slowlog               // client commands slower than the threshold
+	monitors *monitorHub            // connections in MONITOR mode
+	hotkeys  *HotKeys               // sampled key access counts for HOTKEYS
+	cache    *Cache                 // cache mode, nil unless SetCache is called
+	quotas   *Quotas                // per-namespace quotas and counters, none unless SetQuotas is called
+
+	wal            *wal.WAL            // for INFO persistence stats, nil until SetWAL
+	tls            *certs.Reloader     // serves the port over TLS, nil for plain TCP
+	requestTimeout atomic.Int64        // deadline of each write, see SetRequestTimeout
+	idempotencyTTL atomic.Int64        // how long token results are kept, see SetIdempotencyTTL
+	started        time.Time           // for INFO uptime
+	clock          clock.Clock         // TTLs, lock times and uptime, see SetClock
+	clients        *clientRegistry     // open connections, clients and peers alike
+	accessLog      *AccessLog          // nil unless -access-log is set
+	applied        atomic.Int64        // highest raft index applied to the store, for CDC and watches
+	appliedSignal  appliedSignal       // wakes watches when applied moves
+	applyMu        sync.RWMutex        // RunApply holds it shared for a batch, snapshots exclusively
+	applyBatch     int                 // most entries RunApply applies in a round, see SetApplyBatch
+	waiters        applyWaiters        // writes waiting for RunApply to apply their entry
+	applyBatches   atomic.Int64        // rounds RunApply applied entries in
+	applyEntries   atomic.Int64        // entries it applied
+	digests        *digestTracker      // samples of our state digest and the leader's, see digest.go
+	hold           applyHold           // keeps a follower at one index during a resync, see resync.go
+	disk           *DiskWatchdog       // refuses writes while the disk is nearly full, nil unless SetDiskWatchdog is called
+	commands       map[string]*command // what the TCP port answers, see registry.go
+}
+
+func NewServer(s Store, r *raft.Consensus) *Server {
+	srv := &Server{store: s, raft: r, metrics: NewMetrics(), confirms: newConfirmTokens(),
+		slowlog: NewSlowlog(10*time.Millisecond, 128), monitors: newMonitorHub(), clients: newClientRegistry(),
+		hotkeys: NewHotKeys(DefaultHotKeysSampleRate), quotas: NewQuotas(nil), started: time.Now(), clock: clock.System,
+		digests: newDigestTracker(r.ID, s.Len() == 0), commands: newCommandRegistry()}
+	srv.SetLimits(DefaultLimits)
+	srv.SetRequestTimeout(DefaultRequestTimeout)
+	srv.SetIdempotencyTTL(DefaultIdempotencyTTL)
+	srv.applied.Store(int64(s.Applied())) // -1 unless the store was recovered from a raft node's WAL
+	srv.applyBatch = DefaultApplyBatch
+	srv.waiters.byIndex = make(map[int]chan applyResult)
+	return srv
+}
+
+// SetHistoryRecorder turns on recording of every client GET/SET for
+// linearizability checking with kv-admin.
+func (s *Server) SetHistoryRecorder(r *history.Recorder) {
+	s.history = r
 }
 
-func NewServer(s *store.Store, r *raft.Consensus) *Server {
-	return &Server{store: s, raft: r, metrics: NewMetrics()}
+// SetClock replaces the clock TTLs, locks, expiry rounds, uptime and
+// metrics are read from, clock.System by default. The store and raft have
+// clocks of their own. Call it before Serve.
+func (s *Server) SetClock(clk clock.Clock) {
+	s.clock = clk
+	s.started = clk.Now()
+	s.metrics.SetClock(clk)
+}
+
+// SetSlowlog replaces the default slowlog (10ms threshold, 128 entries).
+func (s *Server) SetSlowlog(l *Slowlog) {
+	s.slowlog = l
+}
+
+func (s *Server) GetSlowlog() *Slowlog {
+	return s.slowlog
 }
 
 func parseInt(s string) int {
@@ -33,7 +105,7 @@ func parseInt(s string) int {
 func (s *Server) Start(port string) error {
 	//net.Listen creates a socket bound to a port (e,g., 8080)
 
-	ln, err := net.Listen("tcp", port)
+	ln, err := s.listen(port)
 
 	if err != nil {
 		return err
@@ -41,11 +113,18 @@ func (s *Server) Start(port string) error {
 	defer ln.Close()
 
 	fmt.Printf("Server listening on port %s -->  \n", port)
+	return s.Serve(ln)
+}
 
+// Serve handles the connections ln accepts until ln is closed.
+func (s *Server) Serve(ln net.Listener) error {
 	for {
 		// Accept() blocks until a client connects
 		// It returns a 'conn' object representing the connection to THAT sepcific client.
 		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return err
+		}
 		if err != nil {
 			fmt.Println("Connection error: ", err)
 			continue
@@ -64,156 +143,499 @@ func (s *Server) Join(peerAddress string) { //method that adds a peer to the ser
 	fmt.Printf("Added peer: %s\n", peerAddress) // prints the peer address
 }
 
-func (s *Server) handleConnection(conn net.Conn) {
-	defer conn.Close() // Makes sure connection closes when function finishes
+func (s *Server) handleConnection(raw net.Conn) {
+	// A panic drops this client, the node carries on.
+	defer crash.Recover("connection "+raw.RemoteAddr().String(), nil)
+	sc := scratchPool.Get().(*connScratch)
+	defer sc.release()         // last, once the connection is closed and nothing reads into the buffers
+	conn := s.clients.add(raw) // for CLIENT LIST, and lets a write notice the client hanging up
+	defer s.clients.remove(conn)
+	defer conn.Close()                                          // Makes sure connection closes when function finishes
+	connCtx, closed := context.WithCancel(context.Background()) // every command's context ends with the connection
+	defer closed()
 
 	//REad from the connection like a file
 	scanner := bufio.NewScanner(conn)
+	limits := *s.limits.Load() // the line buffer keeps this size even if the limits are reloaded
+	conn.scratch = sc
+	scanner.Buffer(sc.lineBuffer(limits.lineLimit()), limits.lineLimit())
+	clientID := s.raft.ID + "/" + conn.RemoteAddr().String() // unique across nodes for history files
 
 	//Loop over every line sent by the client
-	for scanner.Scan() {
-		text := scanner.Text()
-		parts := strings.Fields(text) // SPlit by whitespace
+	// The post statement runs after every command, continue included.
+	for ; scanner.Scan(); s.finished(conn) {
+		parseStart := time.Now()
+		parts, perr := sc.parser.Parse(scanner.Bytes()) // split into words, see the protocol package
+		if perr != nil {
+			continue // a blank line
+		}
+		parts, token, terr := takeToken(&sc.parser, parts)
+		if terr != nil {
+			writeError(conn, terr)
+			continue
+		}
 
-		if len(parts) == 0 {
+		c, known := s.commands[parts[0]]
+		peer := known && c.kind == raftMessage
+		ctx := connCtx
+		var reqID string
+		if !peer {
+			reqID = tracing.NewRequestID()
+			ctx = tracing.WithRequestID(ctx, reqID)
+		}
+		conn.started(parts[0], reqID, parseStart, peer)
+		s.monitors.publish(conn.addr, parseStart, parts)
+		if !known {
+			writeError(conn, newError(CodeUnknown, "unknown command"))
 			continue
 		}
+		if token != "" && c.kind != writeCommand {
+			writeError(conn, newError(CodeSyntax, "IDEM only goes in front of a write"))
+			continue
+		}
+		r := &sc.req
+		*r = request{ctx: ctx, conn: conn, scanner: scanner, cmd: c, parts: parts, parser: &sc.parser, clientID: clientID, reqID: reqID, start: parseStart, token: token}
+		if c.run(s, r) == hangUp {
+			return
+		}
+	}
+	if errors.Is(scanner.Err(), bufio.ErrTooLong) {
+		// We can't find the next command boundary anymore, so the connection has to go.
+		writeError(conn, newError(CodeTooLarge, "line too long (max=%d)", limits.lineLimit()))
+	}
+}
+
+// replicate proposes command for r and replies with its result.
+func (s *Server) replicate(r *request, command string) outcome {
+	if _, ok := s.replicateWrite(r.ctx, r.conn, command); ok {
+		return succeeded
+	}
+	return answered
+}
+
+func (s *Server) handleSet(r *request) outcome {
+	if len(r.parts) < 3 {
+		writeError(r.conn, newError(CodeSyntax, "Usage: SET key value"))
+		return hangUp
+	}
+	key, value := r.parts[1], r.rest(2)
+	if _, ok := s.replicateWrite(r.ctx, r.conn, r.rest(0)); !ok { // "SET key value"
+		return answered
+	}
+	if s.history != nil {
+		s.history.Record(r.clientID, history.Input{Op: "SET", Key: key, Value: value}, history.Output{}, r.start)
+	}
+	return succeeded
+}
+
+// handleSetValue runs SETNX -> 1/0, GETSET -> old value and APPEND -> new length.
+func (s *Server) handleSetValue(r *request) outcome {
+	if len(r.parts) < 3 {
+		writeError(r.conn, newError(CodeSyntax, "usage: %s key value", r.cmd.name))
+		return answered
+	}
+	return s.replicate(r, r.parts.String())
+}
+
+// handleSetBit runs SETBIT key offset 0|1 -> previous bit.
+func (s *Server) handleSetBit(r *request) outcome {
+	if len(r.parts) != 4 {
+		writeError(r.conn, newError(CodeSyntax, "usage: SETBIT key offset 0|1"))
+		return answered
+	}
+	// Reject bad arguments before they reach the log, followers would fail to apply them.
+	if _, err := bitmap.ParseOffset(r.parts[2]); err != nil {
+		writeError(r.conn, newError(CodeSyntax, "%v", err))
+		return answered
+	}
+	if _, err := bitmap.ParseBit(r.parts[3]); err != nil {
+		writeError(r.conn, newError(CodeSyntax, "%v", err))
+		return answered
+	}
+	return s.replicate(r, r.parts.String())
+}
 
-		cmd := parts[0]
-		//Start timing for GET and SET commands
-		var opStart time.Time
-		shouldRecord := cmd == "SET" || cmd == "GET"
-		if shouldRecord {
-			opStart = time.Now()
+// handleGetDel runs GETDEL key -> value that was removed.
+func (s *Server) handleGetDel(r *request) outcome {
+	if len(r.parts) != 2 {
+		writeError(r.conn, newError(CodeSyntax, "usage: GETDEL key"))
+		return answered
+	}
+	return s.replicate(r, r.parts.String())
+}
+
+// handleRename runs RENAME old new.
+func (s *Server) handleRename(r *request) outcome {
+	if len(r.parts) != 3 {
+		writeError(r.conn, newError(CodeSyntax, "usage: RENAME old new"))
+		return answered
+	}
+	return s.replicate(r, r.parts.String())
+}
+
+// handleCopy runs COPY src dst [REPLACE] -> 1 if copied.
+func (s *Server) handleCopy(r *request) outcome {
+	parts := r.parts
+	if len(parts) < 3 || len(parts) > 4 || (len(parts) == 4 && parts[3] != "REPLACE") {
+		writeError(r.conn, newError(CodeSyntax, "usage: COPY src dst [REPLACE]"))
+		return answered
+	}
+	return s.replicate(r, parts.String())
+}
+
+func (s *Server) handleGet(r *request) outcome {
+	if len(r.parts) < 2 {
+		writeError(r.conn, newError(CodeSyntax, "usage: GET key"))
+		return answered
+	}
+	key := r.parts[1]
+	val, err := s.store.Get(key)
+	var fillErr *Error
+	if err != nil && s.cache != nil { // read through to upstream
+		var found bool
+		if val, found, fillErr = s.cache.Fill(r.ctx, key); found {
+			err = nil
 		}
-		switch cmd {
-		case "SET":
-			if len(parts) < 3 {
-				fmt.Fprintln(conn, "ERR Usage: SET key value")
-				return
-			}
-			key := parts[1]
-			value := strings.Join(parts[2:], " ")
-			// Check if the server is the leader.
-			isLeader := s.raft.GetState() == "Leader"
-			if isLeader {
-				s.raft.Replicate("SET " + key + " " + value)
-				s.store.Set(key, value)
-				fmt.Fprintln(conn, "OK")
-				if shouldRecord {
-					s.metrics.RecordSuccess(time.Since(opStart))
-				}
-			} else {
-				// Tell client who the leader is so they can retry
-				// Format: "NOTLEADER <leader_port>"
-				// We don't track leader, so client must discover
-				fmt.Fprintln(conn, "NOTLEADER")
+	}
 
-			}
+	switch {
+	case fillErr != nil:
+		writeError(r.conn, fillErr)
+	case err != nil:
+		writeLine(r.conn, "(nil)")
+	default:
+		writeLine(r.conn, val)
+	}
+	if s.history != nil {
+		s.history.Record(r.clientID, history.Input{Op: "GET", Key: key}, history.Output{Value: val, Found: err == nil}, r.start)
+	}
+	return succeeded
+}
 
-		case "APPENDENTRIES":
-			if len(parts) < 5 {
-				continue
-			}
+// handleStrlen runs STRLEN key -> length of the value, 0 if missing.
+func (s *Server) handleStrlen(r *request) outcome {
+	if len(r.parts) != 2 {
+		writeError(r.conn, newError(CodeSyntax, "usage: STRLEN key"))
+		return answered
+	}
+	fmt.Fprintln(r.conn, s.store.Strlen(r.parts[1]))
+	return succeeded
+}
 
-			term := parseInt(parts[1])
-			leaderID := parts[2]
-			prevLogIndex := parseInt(parts[3]) // NEW: where to start appending
-			entryCount := parseInt(parts[4])
-
-			// Read the incoming entries
-			var newEntries []raft.LogEntry
-			for i := 0; i < entryCount; i++ {
-				if scanner.Scan() {
-					line := scanner.Text()
-					commaIdx := strings.Index(line, ",")
-					if commaIdx == -1 {
-						continue
-					}
-					entryTerm := parseInt(line[:commaIdx])
-					entryCmd := line[commaIdx+1:]
-					newEntries = append(newEntries, raft.LogEntry{
-						Term:    entryTerm,
-						Command: entryCmd,
-					})
-				}
-			}
+// handleGetBit runs GETBIT key offset -> 0/1.
+func (s *Server) handleGetBit(r *request) outcome {
+	if len(r.parts) != 3 {
+		writeError(r.conn, newError(CodeSyntax, "usage: GETBIT key offset"))
+		return answered
+	}
+	offset, err := bitmap.ParseOffset(r.parts[2])
+	if err != nil {
+		writeError(r.conn, newError(CodeSyntax, "%v", err))
+		return answered
+	}
+	fmt.Fprintln(r.conn, s.store.GetBit(r.parts[1], offset))
+	return succeeded
+}
 
-			// Call updated handler and get result
-			success := s.raft.HandleAppendEntriesIncremental(term, leaderID, prevLogIndex, newEntries)
-
-			if success {
-				fmt.Fprintln(conn, "SUCCESS")
-
-				// Apply new entries to store
-				unapplied := s.raft.GetUnappliedEntries()
-				for _, entry := range unapplied {
-					cmdParts := strings.Fields(entry.Command)
-					if len(cmdParts) >= 3 && cmdParts[0] == "SET" {
-						val := strings.Join(cmdParts[2:], " ")
-						s.store.Set(cmdParts[1], val)
-					}
-				}
-			} else {
-				fmt.Fprintln(conn, "CONFLICT")
-			}
-		case "GET":
-			if len(parts) < 2 {
-				fmt.Fprint(conn, "ERR usage: GET key")
-				continue
-			}
-			val, err := s.store.Get(parts[1])
+// handleBitCount runs BITCOUNT key [start end] -> set bits, range in bytes.
+func (s *Server) handleBitCount(r *request) outcome {
+	parts := r.parts
+	if len(parts) != 2 && len(parts) != 4 {
+		writeError(r.conn, newError(CodeSyntax, "usage: BITCOUNT key [start end]"))
+		return answered
+	}
+	start, end := 0, -1
+	if len(parts) == 4 {
+		var err1, err2 error
+		start, err1 = strconv.Atoi(parts[2])
+		end, err2 = strconv.Atoi(parts[3])
+		if err1 != nil || err2 != nil {
+			writeError(r.conn, newError(CodeSyntax, "start and end must be integers"))
+			return answered
+		}
+	}
+	fmt.Fprintln(r.conn, s.store.BitCount(parts[1], start, end))
+	return succeeded
+}
 
-			if err != nil {
-				fmt.Fprintln(conn, "(nil)")
-			} else {
-				fmt.Fprintln(conn, val)
-			}
-			if shouldRecord {
-				s.metrics.RecordSuccess(time.Since(opStart))
-			}
+// handleStat runs STAT key -> created=<time> updated=<time> index=<raft index>.
+func (s *Server) handleStat(r *request) outcome {
+	if len(r.parts) != 2 {
+		writeError(r.conn, newError(CodeSyntax, "usage: STAT key"))
+		return answered
+	}
+	meta, ok := s.store.Stat(r.parts[1])
+	if !ok {
+		fmt.Fprintln(r.conn, "(nil)")
+	} else {
+		fmt.Fprintf(r.conn, "created=%s updated=%s index=%d\n", formatStatTime(meta.CreatedAt), formatStatTime(meta.UpdatedAt), meta.RaftIndex)
+	}
+	return succeeded
+}
 
-		case "JOIN": // Handles JOIN command from client
-			if len(parts) != 2 { // Checks for address argument
-				fmt.Fprintln(conn, "ERR usage: JOIN address") // Prints usage error if missing
-				continue                                      // Skips rest, waits next input
-			}
-			s.Join(parts[1])         // Adds peer address to server
-			fmt.Fprintln(conn, "OK") // Acknowledges successful join
+// handleHistory runs HISTORY key: a line count, then the revisions of key
+// this node kept, oldest first, empty unless history is on (see
+// store.SetHistory).
+func (s *Server) handleHistory(r *request) outcome {
+	if len(r.parts) != 2 {
+		writeError(r.conn, newError(CodeSyntax, "usage: HISTORY key"))
+		return answered
+	}
+	revisions := s.store.History(r.parts[1])
+	fmt.Fprintln(r.conn, len(revisions))
+	for _, rev := range revisions {
+		if rev.Deleted {
+			fmt.Fprintf(r.conn, "index=%d time=%s deleted\n", rev.Revision, formatStatTime(rev.Time))
+		} else {
+			fmt.Fprintf(r.conn, "index=%d time=%s value=%s\n", rev.Revision, formatStatTime(rev.Time), rev.Value)
+		}
+	}
+	return succeeded
+}
 
-		case "VOTEREQUEST":
-			if len(parts) < 3 {
-				continue
-			}
-			term := parseInt(parts[1])
-			candidateID := parts[2]
-
-			granted := s.raft.HandleRequestVote(term, candidateID)
-			if granted {
-				fmt.Fprint(conn, "VOTEGRANTED\n")
-			} else {
-				fmt.Fprint(conn, "VOTEDENIED\n")
-			}
+// handleFlushCommand runs FLUSHALL and FLUSHNS, admin commands that wipe
+// everything or one namespace and need confirming.
+func (s *Server) handleFlushCommand(r *request) outcome {
+	if s.handleFlush(r.ctx, r.conn, r.parts) {
+		return succeeded
+	}
+	return answered
+}
+
+// handleMonitor streams every command this node handles, for debugging,
+// until the connection closes.
+func (s *Server) handleMonitor(r *request) outcome {
+	if !s.monitors.enabled.Load() {
+		writeError(r.conn, newError(CodeDisabled, "MONITOR is off on this node, see -monitor"))
+		return answered
+	}
+	r.audit() // now rather than once it detaches, which can be hours later
+	s.runMonitor(r.conn, r.scanner)
+	return hangUp
+}
+
+// handlePing runs PING [message] -> PONG, or the message; it never touches the store.
+func (s *Server) handlePing(r *request) outcome {
+	if len(r.parts) == 1 {
+		fmt.Fprintln(r.conn, "PONG")
+	} else {
+		fmt.Fprintln(r.conn, r.parts.Rest(1))
+	}
+	return answered
+}
+
+// handleEcho runs ECHO message -> message.
+func (s *Server) handleEcho(r *request) outcome {
+	if len(r.parts) < 2 {
+		writeError(r.conn, newError(CodeSyntax, "usage: ECHO message"))
+		return answered
+	}
+	fmt.Fprintln(r.conn, r.parts.Rest(1))
+	return answered
+}
+
+// handleHello runs HELLO [version], which negotiates like PROTOCOL, then
+// replies with the server version, role and features.
+func (s *Server) handleHello(r *request) outcome {
+	s.hello(r.conn, r.parts[1:])
+	return answered
+}
+
+// handleProtocol runs PROTOCOL [version] -> the version this connection will speak.
+func (s *Server) handleProtocol(r *request) outcome {
+	version, err := negotiateClientProtocol(r.parts[1:], r.conn.protocolVersion())
+	if err != nil {
+		writeError(r.conn, err)
+		return answered
+	}
+	r.conn.protocol.Store(int32(version))
+	fmt.Fprintf(r.conn, "PROTOCOL %d\n", version)
+	return answered
+}
+
+// handleSave runs SAVE, which snapshots the store to <wal>.snap without stopping writes.
+func (s *Server) handleSave(r *request) outcome {
+	res, err := s.Save()
+	if err != nil {
+		writeError(r.conn, newError(CodeIO, "save failed: %v", err))
+		return answered
+	}
+	fmt.Fprintf(r.conn, "OK saved %d keys at index %d to %s\n", res.Keys, res.Index, res.Path)
+	return answered
+}
+
+// handleJoin runs JOIN address, which adds a peer.
+func (s *Server) handleJoin(r *request) outcome {
+	if len(r.parts) != 2 {
+		writeError(r.conn, newError(CodeSyntax, "usage: JOIN address"))
+		return answered
+	}
+	s.Join(r.parts[1])
+	fmt.Fprintln(r.conn, "OK")
+	return answered
+}
+
+func (s *Server) handleAppendEntries(r *request) outcome {
+	parts, conn := r.parts, r.conn
+	if len(parts) < 5 {
+		return answered
+	}
+
+	term := parseInt(parts[1])
+	leaderID := parts[2]
+	prevLogIndex := parseInt(parts[3]) // NEW: where to start appending
+	entryCount := parseInt(parts[4])
+	leaderCommit := -1
+	if len(parts) >= 6 {
+		leaderCommit = parseInt(parts[5])
+	}
+	prevLogTerm := -1 // from version 5 leaders; older ones aren't checked
+	optional := parts[min(6, len(parts)):]
+	if len(optional) > 0 {
+		if t, err := strconv.Atoi(optional[0]); err == nil {
+			prevLogTerm, optional = t, optional[1:]
+		}
+	}
+	digestField := "" // from version 3 leaders, "<index>:<digest>", see digest.go
+	if len(optional) > 0 {
+		digestField = optional[0]
+	}
 
-		case "HEARTBEAT":
-			if len(parts) < 2 {
+	// Read the incoming entries
+	var newEntries []raft.LogEntry
+	for i := 0; i < entryCount; i++ {
+		if r.scanner.Scan() {
+			line := r.scanner.Text()
+			commaIdx := strings.Index(line, ",")
+			if commaIdx == -1 {
 				continue
 			}
-			term := parseInt(parts[1])
-			s.raft.HandleHeartbeat(term)
+			entryTerm := parseInt(line[:commaIdx])
+			entryCmd := line[commaIdx+1:]
+			newEntries = append(newEntries, raft.LogEntry{
+				Term:    entryTerm,
+				Command: entryCmd,
+			})
+		}
+	}
 
-		default: // Handles unknown commands from client
-			fmt.Fprintln(conn, "ERR unknown command") // Prints error for unknown command
+	// Call updated handler and get result
+	success, resume := s.raft.HandleAppendEntriesIncremental(term, leaderID, prevLogIndex, prevLogTerm, newEntries, leaderCommit)
 
-		}
+	// Replies carry our term so a stale leader learns it has been replaced.
+	if !success {
+		// Tell the leader where to resume (or that we need a snapshot).
+		fmt.Fprintf(conn, "CONFLICT %d %d%s\n", s.raft.GetTerm(), resume, r.replyTag)
+		return answered
+	}
+	fmt.Fprintf(conn, "SUCCESS %d%s\n", s.raft.GetTerm(), r.replyTag)
+
+	// The entries are applied by RunApply once they commit, see apply.go.
+	s.digests.heard(leaderID, digestField, leaderCommit)
+	s.sampleDigest()
+	return answered
+}
+
+// handleInstallSnapshot runs INSTALLSNAPSHOT term leader lastIndex lastTerm
+// count, followed by count key/value lines.
+func (s *Server) handleInstallSnapshot(r *request) outcome {
+	parts := r.parts
+	if len(parts) != 6 {
+		return answered
+	}
+	data, expires, err := raft.ReadSnapshotData(r.scanner, parseInt(parts[5]))
+	if err != nil {
+		fmt.Printf("Bad snapshot from %s: %v\n", parts[2], err)
+		return hangUp
+	}
+	if s.raft.HandleInstallSnapshot(parseInt(parts[1]), parts[2], parseInt(parts[3]), parseInt(parts[4]), data, expires) {
+		fmt.Fprintf(r.conn, "SUCCESS %d%s\n", s.raft.GetTerm(), r.replyTag)
+	} else {
+		fmt.Fprintf(r.conn, "FAILED %d%s\n", s.raft.GetTerm(), r.replyTag)
+	}
+	return answered
+}
+
+// handleHandshake runs HANDSHAKE id clusterID, a peer's greeting on boot.
+func (s *Server) handleHandshake(r *request) outcome {
+	if len(r.parts) != 3 {
+		return answered
+	}
+	clusterID := r.parts[2]
+	if clusterID == "-" {
+		clusterID = ""
 	}
+	id, ours := s.raft.HandleHandshake(r.parts[1], clusterID)
+	if ours == "" {
+		ours = "-"
+	}
+	fmt.Fprintf(r.conn, "HANDSHAKE %s %s%s\n", id, ours, r.replyTag)
+	return answered
+}
+
+// handleVote runs VOTEREQUEST and PREVOTE.
+func (s *Server) handleVote(r *request) outcome {
+	parts := r.parts
+	if len(parts) < 3 {
+		return answered
+	}
+	term := parseInt(parts[1])
+	candidateID := parts[2]
+	lastLogIndex, lastLogTerm := -1, 0 // a candidate that doesn't say counts as having an empty log
+	if len(parts) >= 5 {
+		lastLogIndex, lastLogTerm = parseInt(parts[3]), parseInt(parts[4])
+	}
+
+	decide := s.raft.HandleRequestVote
+	if r.cmd.name == "PREVOTE" {
+		decide = s.raft.HandlePreVote
+	}
+	granted, ourTerm, reason := decide(term, candidateID, lastLogIndex, lastLogTerm)
+	if granted {
+		fmt.Fprintf(r.conn, "VOTEGRANTED %d%s\n", ourTerm, r.replyTag)
+	} else {
+		fmt.Fprintf(r.conn, "VOTEDENIED %d %s%s\n", ourTerm, reason, r.replyTag)
+	}
+	return answered
+}
 
+func (s *Server) handleHeartbeat(r *request) outcome {
+	if len(r.parts) >= 2 {
+		s.raft.HandleHeartbeat(parseInt(r.parts[1]))
+	}
+	return answered
+}
+
+// handleSyncShardsCommand runs SYNCSHARDS shards, from a follower's anti-entropy.
+func (s *Server) handleSyncShardsCommand(r *request) outcome {
+	if len(r.parts) != 2 {
+		return answered
+	}
+	w := bufio.NewWriter(r.conn)
+	s.handleSyncShards(w, r.parts[1], r.replyTag)
+	w.Flush()
+	return answered
+}
+
+// handleMerkle serves a follower's resync, which then has the connection.
+func (s *Server) handleMerkle(r *request) outcome {
+	s.serveMerkle(r.conn, r.scanner, r.replyTag)
+	return hangUp
 }
 
 func (s *Server) GetMetrics() *Metrics {
 	return s.metrics
 }
 
+// formatStatTime renders a metadata timestamp for STAT; keys restored from
+// the WAL have no timestamps and report "unknown".
+func formatStatTime(t time.Time) string {
+	if t.IsZero() {
+		return "unknown"
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
 // net.Listen creates a new TCP socket that listens for incoming connections.
 // net.Dial creates a new TCP connection to the peer server.
 // replicate() the server becomes a client temporarily to send the SET command to the peer servers.
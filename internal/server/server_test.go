@@ -0,0 +1,132 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mathdee/KV-Store/internal/raft"
+	"github.com/mathdee/KV-Store/internal/store"
+	"github.com/mathdee/KV-Store/internal/wal"
+)
+
+// testServer starts a node of its own cluster serving TCP on a loopback
+// port, and waits for it to lead. It is shut down when the test ends.
+func testServer(t *testing.T) (*Server, string) {
+	t.Helper()
+	w, err := wal.NewWAL(filepath.Join(t.TempDir(), "wal.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	consensus := raft.NewConsensus(ln.Addr().String(), nil)
+	srv := NewServer(store.NewStore(w), consensus)
+	srv.SetWAL(w)
+	consensus.Start()
+	go srv.Serve(ln)
+	ctx, stop := context.WithCancel(context.Background())
+	go srv.RunApply(ctx)
+	t.Cleanup(func() {
+		ln.Close()
+		stop()
+		consensus.Stop()
+		w.Close()
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for consensus.GetState() != raft.Leader {
+		if time.Now().After(deadline) {
+			t.Fatal("the node didn't elect itself")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return srv, ln.Addr().String()
+}
+
+// testConn is a client connection to a testServer.
+type testConn struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialTest(t *testing.T, addr string) *testConn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &testConn{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+// do sends line and returns the reply line.
+func (c *testConn) do(line string) string {
+	c.t.Helper()
+	if _, err := fmt.Fprintln(c.conn, line); err != nil {
+		c.t.Fatal(err)
+	}
+	return c.read()
+}
+
+// read returns the next reply line.
+func (c *testConn) read() string {
+	c.t.Helper()
+	reply, err := c.r.ReadString('\n')
+	if err != nil {
+		c.t.Fatalf("reading the reply: %v", err)
+	}
+	return strings.TrimSuffix(reply, "\n")
+}
+
+// testHTTP is the HTTP API of a node that isn't running, enough for the
+// middleware and the endpoints that only report.
+func testHTTP() *HTTPServer {
+	return NewHTTPServer(raft.NewConsensus(":1", nil), NewMetrics(), store.NewStore(nil))
+}
+
+// serveHTTP sends h a request, made ready by prepare if it isn't nil.
+func serveHTTP(h http.Handler, method, path string, prepare func(*http.Request)) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, nil)
+	if prepare != nil {
+		prepare(r)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestPingAndEcho(t *testing.T) {
+	srv, addr := testServer(t)
+	c := dialTest(t, addr)
+	c.do("PROTOCOL 2")
+	entries := srv.raft.GetLogLength()
+
+	for line, want := range map[string]string{
+		"PING":             "PONG",
+		"PING are you up":  "are you up",
+		"ECHO hello":       "hello",
+		"ECHO hello world": "hello world",
+	} {
+		if reply := c.do(line); reply != want {
+			t.Errorf("%s: expected %q, got %q", line, want, reply)
+		}
+	}
+	if reply := c.do("ECHO"); !strings.HasPrefix(reply, "ERR_SYNTAX ") {
+		t.Errorf("expected ECHO without a message refused, got %q", reply)
+	}
+	if got := srv.raft.GetLogLength(); got != entries || srv.store.Len() != 0 {
+		t.Errorf("expected nothing written, the log went from %d to %d entries and the store holds %d keys", entries, got, srv.store.Len())
+	}
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// Sessions give clients read-your-writes on any node. A write's raft index
+// is its consistency token: HTTP writes return it as their revision, and on
+// TCP SESSION returns the highest index the connection has written or read
+// at. A read passing a token as its minimum index (a trailing
+// "MININDEX <n>" on TCP, ?minIndex= over HTTP) waits until the node serving
+// it has applied the log that far, up to the request timeout, so a follower
+// answers with the client's writes in. HTTP reads also say in X-KV-Index
+// which index they were served at, for clients that want monotonic reads.
+
+const indexHeader = "X-KV-Index"
+
+// splitMinIndex takes a trailing "MININDEX <n>" off a read's arguments,
+// returning -1 without one.
+func splitMinIndex(parts []string) ([]string, int, *Error) {
+	if len(parts) < 3 || parts[len(parts)-2] != "MININDEX" {
+		return parts, -1, nil
+	}
+	n, err := strconv.Atoi(parts[len(parts)-1])
+	if err != nil || n < 0 {
+		return nil, 0, newError(CodeSyntax, "MININDEX takes a raft index, got %q", parts[len(parts)-1])
+	}
+	return parts[:len(parts)-2], n, nil
+}
+
+// WaitIndex blocks until index is applied here, for at most the request
+// timeout.
+func (s *Server) WaitIndex(ctx context.Context, index int) *Error {
+	if s.Applied() >= index {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.RequestTimeout())
+	defer cancel()
+	if applied := s.WaitApplied(ctx, index-1); applied < index {
+		return newError(CodeTimeout, "applied only up to index %d, not %d yet, try another node", applied, index)
+	}
+	return nil
+}
+
+// sawIndex raises the connection's session token to index.
+func (c *clientConn) sawIndex(index int) {
+	for {
+		cur := c.session.Load()
+		if int64(index) <= cur || c.session.CompareAndSwap(cur, int64(index)) {
+			return
+		}
+	}
+}
+
+// handleSession answers SESSION with the connection's token, -1 before its
+// first write.
+func (s *Server) handleSession(conn net.Conn, parts []string) {
+	if len(parts) != 1 {
+		writeError(conn, newError(CodeSyntax, "usage: SESSION"))
+		return
+	}
+	index := int64(-1)
+	if cc, ok := conn.(*clientConn); ok {
+		index = cc.session.Load()
+	}
+	fmt.Fprintln(conn, index)
+}
+
+// waitMinIndex makes an HTTP read wait for ?minIndex=, writing the error
+// reply and returning false if it can't.
+func (h *HTTPServer) waitMinIndex(w http.ResponseWriter, r *http.Request) bool {
+	raw := r.URL.Query().Get("minIndex")
+	if raw == "" {
+		return true
+	}
+	index, err := strconv.Atoi(raw)
+	if err != nil || index < 0 {
+		http.Error(w, fmt.Sprintf("invalid minIndex: %q", raw), http.StatusBadRequest)
+		return false
+	}
+	if h.waitIndex == nil {
+		http.Error(w, "sessions not enabled", http.StatusNotFound)
+		return false
+	}
+	if err := h.waitIndex(r.Context(), index); err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return false
+	}
+	return true
+}
+
+// SetSessions enables ?minIndex= on reads, usually with Server.WaitIndex.
+func (h *HTTPServer) SetSessions(wait func(ctx context.Context, index int) *Error) {
+	h.waitIndex = wait
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessionTokens(t *testing.T) {
+	srv, addr := testServer(t)
+	srv.SetRequestTimeout(200 * time.Millisecond)
+	c := dialTest(t, addr)
+	c.do("PROTOCOL 2")
+	if reply := c.do("SESSION"); reply != "-1" {
+		t.Fatalf("expected no token before a write, got %q", reply)
+	}
+
+	c.do("SET k v")
+	index, err := strconv.Atoi(c.do("SESSION"))
+	if err != nil || index < 0 {
+		t.Fatalf("expected the write's raft index as the token, got %d %v", index, err)
+	}
+	if reply := c.do("GET k MININDEX " + strconv.Itoa(index)); reply != "v" {
+		t.Fatalf("expected the read at the token to see the write, got %q", reply)
+	}
+
+	// A read at a token the node hasn't reached yet gives up at the
+	// request timeout rather than answer without the write.
+	ahead := strconv.Itoa(index + 1000)
+	if reply := c.do("GET k MININDEX " + ahead); !strings.HasPrefix(reply, "ERR_TIMEOUT ") {
+		t.Fatalf("expected a timeout waiting for index %s, got %q", ahead, reply)
+	}
+	if reply := c.do("SESSION"); reply != strconv.Itoa(index) {
+		t.Fatalf("expected a read that timed out to leave the token at %d, got %q", index, reply)
+	}
+
+	for _, bad := range []string{"GET k MININDEX soon", "GET k MININDEX -1"} {
+		if reply := c.do(bad); !strings.HasPrefix(reply, "ERR_SYNTAX ") {
+			t.Errorf("%s: expected a syntax error, got %q", bad, reply)
+		}
+	}
+
+	// A fresh connection picks a token up from what it reads at.
+	d := dialTest(t, addr)
+	if reply := d.do("GET k MININDEX " + strconv.Itoa(index)); reply != "v" {
+		t.Fatalf("expected the read at the token to see the write, got %q", reply)
+	}
+	if reply := d.do("SESSION"); reply != strconv.Itoa(index) {
+		t.Fatalf("expected the token read at, %d, got %q", index, reply)
+	}
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Slowlog keeps the most recent commands whose handling took longer than a
+// threshold, in a fixed-size ring like MetricsHistory. Arguments are truncated
+// so one huge SET can't make the log itself big.
+
+const (
+	slowlogMaxArgs   = 32  // arguments kept per entry
+	slowlogMaxArgLen = 128 // bytes kept per argument
+)
+
+type SlowlogEntry struct {
+	ID         int64    `json:"id"`
+	Timestamp  int64    `json:"timestamp"` // unix microseconds when the command was read
+	DurationUs int64    `json:"durationUs"`
+	Client     string   `json:"client"`
+	Command    []string `json:"command"` // command and (truncated) arguments
+}
+
+type Slowlog struct {
+	mu        sync.Mutex
+	threshold atomic.Int64 // a time.Duration; negative disables the log, 0 records everything
+	entries   []SlowlogEntry
+	next      int  // slot the next entry goes into
+	full      bool // true once the ring has wrapped
+	nextID    int64
+}
+
+func NewSlowlog(threshold time.Duration, maxLen int) *Slowlog {
+	if maxLen < 1 {
+		maxLen = 1
+	}
+	l := &Slowlog{entries: make([]SlowlogEntry, maxLen)}
+	l.SetThreshold(threshold)
+	return l
+}
+
+// SetThreshold changes which commands are slow enough to record.
+func (l *Slowlog) SetThreshold(threshold time.Duration) {
+	l.threshold.Store(int64(threshold))
+}
+
+// Record adds the command if it took at least the threshold.
+func (l *Slowlog) Record(client string, parts []string, start time.Time, took time.Duration) {
+	if threshold := time.Duration(l.threshold.Load()); threshold < 0 || took < threshold {
+		return
+	}
+	entry := SlowlogEntry{
+		Timestamp:  start.UnixMicro(),
+		DurationUs: took.Microseconds(),
+		Client:     client,
+		Command:    truncateArgs(parts),
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entry.ID = l.nextID
+	l.nextID++
+	l.entries[l.next] = entry
+	l.next = (l.next + 1) % len(l.entries)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+func truncateArgs(parts []string) []string {
+	n := min(len(parts), slowlogMaxArgs)
+	out := make([]string, 0, n+1)
+	for _, p := range parts[:n] {
+		if len(p) > slowlogMaxArgLen {
+			p = fmt.Sprintf("%s... (%d more bytes)", p[:slowlogMaxArgLen], len(p)-slowlogMaxArgLen)
+		}
+		out = append(out, p)
+	}
+	if len(parts) > n {
+		out = append(out, fmt.Sprintf("... (%d more arguments)", len(parts)-n))
+	}
+	return out
+}
+
+// Get returns up to n entries, newest first; n <= 0 returns all of them.
+func (l *Slowlog) Get(n int) []SlowlogEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	size := l.next
+	if l.full {
+		size = len(l.entries)
+	}
+	if n <= 0 || n > size {
+		n = size
+	}
+	out := make([]SlowlogEntry, 0, n)
+	for i := 1; i <= n; i++ {
+		out = append(out, l.entries[(l.next-i+len(l.entries))%len(l.entries)])
+	}
+	return out
+}
+
+func (l *Slowlog) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.full {
+		return len(l.entries)
+	}
+	return l.next
+}
+
+func (l *Slowlog) Reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = make([]SlowlogEntry, len(l.entries))
+	l.next = 0
+	l.full = false
+}
+
+// handleSlowlog serves SLOWLOG GET [n] | LEN | RESET. GET replies with the
+// number of entries on one line followed by one line per entry:
+// "id timestamp-us duration-us client command args...".
+func (s *Server) handleSlowlog(conn net.Conn, parts []string) {
+	sub := ""
+	if len(parts) > 1 {
+		sub = strings.ToUpper(parts[1])
+	}
+	switch {
+	case sub == "GET" && len(parts) <= 3:
+		n := 10 // same default as Redis
+		if len(parts) == 3 {
+			n = parseInt(parts[2])
+		}
+		entries := s.slowlog.Get(n)
+		fmt.Fprintln(conn, len(entries))
+		for _, e := range entries {
+			fmt.Fprintf(conn, "%d %d %d %s %s\n", e.ID, e.Timestamp, e.DurationUs, e.Client, strings.Join(e.Command, " "))
+		}
+	case sub == "LEN" && len(parts) == 2:
+		fmt.Fprintln(conn, s.slowlog.Len())
+	case sub == "RESET" && len(parts) == 2:
+		s.slowlog.Reset()
+		fmt.Fprintln(conn, "OK")
+	default:
+		writeError(conn, newError(CodeSyntax, "usage: SLOWLOG GET [n] | LEN | RESET"))
+	}
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/mathdee/KV-Store/internal/store"
+	"github.com/mathdee/KV-Store/internal/wal"
+)
+
+// Store is the state machine the server applies the log to and answers
+// reads from. The server, the HTTP API and registered commands use only
+// this, never the concrete *store.Store, so another implementation can be
+// handed to NewServer and NewHTTPServer. The values it holds live in a
+// storage.Engine picked with -storage.
+type Store interface {
+	// Reads.
+	Get(key string) (string, error)
+	Peek(key string) (string, bool)
+	Stat(key string) (store.KeyMeta, bool)
+	ExpiresAt(key string) (time.Time, bool)
+	Strlen(key string) int
+	GetBit(key string, offset int) int
+	BitCount(key string, start int, end int) int
+	History(key string) []store.Revision
+	Iterate(prefix string, fn func(k, v string) bool)
+	Len() int
+
+	// Writes, applied in log order.
+	SetContext(ctx context.Context, key string, value string) error
+	SetNX(ctx context.Context, key string, value string) (bool, error)
+	GetSet(ctx context.Context, key string, value string) (string, bool, error)
+	Append(ctx context.Context, key string, value string) (int, error)
+	SetBit(ctx context.Context, key string, offset int, bit int) (int, error)
+	GetDel(ctx context.Context, key string) (string, bool, error)
+	Rename(ctx context.Context, oldKey string, newKey string) (bool, error)
+	Copy(ctx context.Context, src string, dst string, replace bool) (bool, error)
+	FlushAll(ctx context.Context) (int, error)
+	FlushNamespace(ctx context.Context, ns string) (int, error)
+	Batch(ctx context.Context, ops []store.BatchOp) ([]bool, error)
+	Update(ctx context.Context, fn func(tx *store.Tx) error) error
+	Expired(now time.Time, max int) []store.Expiry
+
+	// Where applying the log got to, and state transfer.
+	MarkApplied(ctx context.Context, index int) error
+	Applied() int
+	Snapshot() *store.Snapshot
+	InstallSnapshot(ctx context.Context, data map[string]string, expires map[string]int64) error
+	BeginCompaction() *store.Snapshot
+	FinishCompaction(snap *store.Snapshot) error
+	Digest() store.Digest
+	RepairShards(ctx context.Context, shards []int, data map[string]string, expires map[string]int64) (int, error)
+	RepairRange(ctx context.Context, in func(key string) bool, data map[string]string, expires map[string]int64) (int, error)
+
+	// Accounting, for quotas, INFO and /metrics.
+	EntrySize(key string) (int, bool)
+	NamespaceUsage(ns string) store.NamespaceUsage
+	Namespaces() map[string]store.NamespaceUsage
+	MemoryStats() store.MemoryStats
+	CompressionStats() store.CompressionStats
+	InternStats() store.InternStats
+	CommitStats() wal.CommitStats
+	WALMode() wal.Mode
+	WALSize() int64
+}
+
+var _ Store = (*store.Store)(nil)
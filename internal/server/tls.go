@@ -0,0 +1,34 @@
+package server
+
+import (
+	"net"
+	"time"
+
+	"github.com/mathdee/KV-Store/internal/certs"
+)
+
+// SetTLS serves the client and peer port over TLS, with whatever certificate
+// c currently holds. Call it before Start.
+func (s *Server) SetTLS(c *certs.Reloader) {
+	s.tls = c
+}
+
+func (s *Server) listen(addr string) (net.Listener, error) {
+	if s.tls == nil {
+		return net.Listen("tcp", addr)
+	}
+	return s.tls.Listen(addr)
+}
+
+// SetTLS makes the network benchmark reach nodes over TLS, as clients must
+// once the node port serves it.
+func (h *HTTPServer) SetTLS(c *certs.Reloader) {
+	h.tls = c
+}
+
+func (h *HTTPServer) dialNode(addr string) (net.Conn, error) {
+	if h.tls == nil {
+		return net.DialTimeout("tcp", addr, time.Second)
+	}
+	return h.tls.DialTimeout(addr, time.Second)
+}
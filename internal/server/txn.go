@@ -0,0 +1,192 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/mathdee/KV-Store/internal/protocol"
+	"github.com/mathdee/KV-Store/internal/store"
+)
+
+// TXN checks a list of guards and runs one of two lists of operations,
+// all in one step:
+//
+//	TXN guard... THEN op... [ELSE op...]
+//
+// where a guard is
+//
+//	VALUE key value  key holds value
+//	REV key n        key was last written before revision n, the raft index STAT reports
+//	EXISTS key       key exists
+//	MISSING key      key doesn't exist
+//
+// and an op is SET key value, DEL key or GET key, values one word each
+// since any of them can be followed by more. When every guard holds
+// (or there are none) the THEN ops run, otherwise the ELSE ones. The reply
+// is a line count, as for INFO, then 1 if the THEN ops ran and 0 if not,
+// then a line per op: OK for SET, 1 or 0 for whether DEL removed something,
+// the value or (nil) for GET.
+//
+// The entry in the raft log is the command itself and every node checks
+// the guards against its own store, under the store lock, so the writes
+// go to the WAL as one unit. A key that doesn't exist has revision 0. A
+// node only knows the revisions of keys it applied a write to since it
+// started, so one it only has from a snapshot has revision -1 there until
+// it is written again.
+
+// txnCommand is a TXN line taken apart.
+type txnCommand struct {
+	guards, then, els []txnStep
+	keys              []int // positions of every key, guards' and ops' alike
+}
+
+// txnStep is a guard or an op, with the position of its key.
+type txnStep struct {
+	name  string // VALUE, REV, EXISTS, MISSING, SET, DEL or GET
+	key   int
+	value string // VALUE's and SET's value
+	rev   int    // REV's bound
+}
+
+// txnGuards and txnOps are how many arguments each takes after its name.
+var (
+	txnGuards = map[string]int{"VALUE": 2, "REV": 2, "EXISTS": 1, "MISSING": 1}
+	txnOps    = map[string]int{"SET": 2, "DEL": 1, "GET": 1}
+)
+
+// txnKeyArgs are the positions of TXN's keys, none if the line is malformed.
+func txnKeyArgs(parts protocol.Command) []int {
+	t, err := parseTxn(parts)
+	if err != nil {
+		return nil
+	}
+	return t.keys
+}
+
+func parseTxn(parts protocol.Command) (txnCommand, *Error) {
+	var t txnCommand
+	list, guards := &t.guards, true
+	for i := 1; i < len(parts); {
+		name := parts[i]
+		switch {
+		case name == "THEN" && guards:
+			list, guards = &t.then, false
+			i++
+			continue
+		case name == "ELSE" && !guards && list == &t.then:
+			list = &t.els
+			i++
+			continue
+		}
+		arity := txnOps
+		if guards {
+			arity = txnGuards
+		}
+		n, ok := arity[name]
+		if !ok {
+			return txnCommand{}, newError(CodeSyntax, "TXN: unexpected %q at argument %d", name, i)
+		}
+		if i+n >= len(parts) {
+			return txnCommand{}, newError(CodeSyntax, "TXN: %s takes %d arguments", name, n)
+		}
+		step := txnStep{name: name, key: i + 1}
+		switch name {
+		case "VALUE", "SET":
+			step.value = parts[i+2]
+		case "REV":
+			rev, err := strconv.Atoi(parts[i+2])
+			if err != nil {
+				return txnCommand{}, newError(CodeSyntax, "TXN: REV wants a revision, got %q", parts[i+2])
+			}
+			step.rev = rev
+		}
+		*list = append(*list, step)
+		t.keys = append(t.keys, step.key)
+		i += 1 + n
+	}
+	if guards {
+		return txnCommand{}, newError(CodeSyntax, "usage: TXN guard... THEN op... [ELSE op...]")
+	}
+	return t, nil
+}
+
+func (s *Server) handleTxn(r *request) outcome {
+	if _, err := parseTxn(r.parts); err != nil {
+		writeError(r.conn, err)
+		return answered
+	}
+	return s.replicate(r, r.parts.String())
+}
+
+// applyTxn runs a TXN entry.
+func (s *Server) applyTxn(ctx context.Context, parts protocol.Command) (string, error) {
+	t, perr := parseTxn(parts)
+	if perr != nil {
+		return "", perr
+	}
+	var lines []string
+	err := s.store.Update(ctx, func(tx *store.Tx) error {
+		ops := t.then
+		lines = append(lines, "1")
+		if !t.holds(tx, parts) {
+			ops = t.els
+			lines[0] = "0"
+		}
+		for _, op := range ops {
+			key := parts[op.key]
+			switch op.name {
+			case "SET":
+				tx.Set(key, op.value)
+				lines = append(lines, "OK")
+			case "DEL":
+				_, existed := tx.Get(key)
+				tx.Delete(key)
+				lines = append(lines, existedReply([]bool{existed}))
+			case "GET":
+				v, ok := tx.Get(key)
+				if !ok {
+					v = "(nil)"
+				}
+				lines = append(lines, v)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d\n%s", len(lines), strings.Join(lines, "\n")), nil
+}
+
+// holds reports whether every guard of t holds in tx.
+func (t txnCommand) holds(tx *store.Tx, parts protocol.Command) bool {
+	for _, g := range t.guards {
+		key := parts[g.key]
+		v, exists := tx.Get(key)
+		switch g.name {
+		case "VALUE":
+			if !exists || v != g.value {
+				return false
+			}
+		case "REV":
+			rev := 0 // as for a key never written
+			if m, ok := tx.Meta(key); ok {
+				rev = m.RaftIndex
+			}
+			if rev >= g.rev {
+				return false
+			}
+		case "EXISTS":
+			if !exists {
+				return false
+			}
+		case "MISSING":
+			if exists {
+				return false
+			}
+		}
+	}
+	return true
+}
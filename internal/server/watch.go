@@ -0,0 +1,215 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mathdee/KV-Store/internal/cdc"
+	"github.com/mathdee/KV-Store/internal/protocol"
+	"github.com/mathdee/KV-Store/internal/raft"
+	"github.com/mathdee/KV-Store/internal/store"
+)
+
+// GET /watch long-polls for changes, for clients that can't keep a stream
+// open. Revisions are raft log indexes, as in CDC: a watch returns the
+// applied changes at or after fromRevision that touch the key or prefix,
+// waiting up to timeout for the first one, and says where to continue. Any
+// node can serve it, as followers apply the same log. Once compaction drops
+// the entries a revision names, asking for it fails with 410 Gone.
+
+const (
+	defaultWatchTimeout = 30 * time.Second
+	maxWatchTimeout     = 5 * time.Minute
+	maxWatchEvents      = 1000
+)
+
+// WatchResponse is what /watch returns.
+type WatchResponse struct {
+	Events       []cdc.Event `json:"events"`
+	NextRevision int         `json:"nextRevision"` // pass as fromRevision to carry on
+	TimedOut     bool        `json:"timedOut,omitempty"`
+}
+
+// errCompacted is a fromRevision the log no longer holds.
+var errCompacted = errors.New("revision compacted")
+
+// ChangeFeed is the applied log a watch reads, usually the TCP Server.
+type ChangeFeed interface {
+	Applied() int
+	Entries(from, max int) []raft.LogEntry
+	WaitApplied(ctx context.Context, after int) int
+}
+
+// SetChangeFeed enables /watch.
+func (h *HTTPServer) SetChangeFeed(f ChangeFeed) {
+	h.changes = f
+}
+
+type watchQuery struct {
+	key, prefix  string // both empty watches everything
+	fromRevision int
+	timeout      time.Duration
+}
+
+func parseWatchQuery(r *http.Request, applied int) (watchQuery, error) {
+	q := r.URL.Query()
+	w := watchQuery{key: q.Get("key"), prefix: q.Get("prefix"), fromRevision: applied + 1, timeout: defaultWatchTimeout}
+	if w.key != "" && w.prefix != "" {
+		return w, fmt.Errorf("key and prefix can't both be set")
+	}
+	if raw := q.Get("fromRevision"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			return w, fmt.Errorf("invalid fromRevision: %q", raw)
+		}
+		w.fromRevision = n
+	}
+	if raw := q.Get("timeout"); raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil || d < 0 {
+			return w, fmt.Errorf("invalid timeout: %q (e.g. 30s)", raw)
+		}
+		w.timeout = min(d, maxWatchTimeout)
+	}
+	return w, nil
+}
+
+// matches reports whether the change can have touched a watched key.
+func (w watchQuery) matches(e cdc.Event) bool {
+	if w.key == "" && w.prefix == "" {
+		return true
+	}
+	command := innerCommand(e.Command)
+	parts, _ := protocol.Parse(command) // nil for an empty one, which matches nothing below
+	switch e.Op {
+	case "FLUSHALL":
+		return true
+	case "CACHEFLUSHED":
+		return false // bookkeeping, no key changes
+	case "FLUSHNS":
+		if len(parts) < 2 {
+			return false
+		}
+		ns := parts[1] + store.NamespaceSeparator
+		if w.key != "" {
+			return strings.HasPrefix(w.key, ns)
+		}
+		return strings.HasPrefix(w.prefix, ns) || strings.HasPrefix(ns, w.prefix)
+	}
+	keys := parts[1:min(len(parts), 2)]
+	switch e.Op {
+	case "RENAME", "COPY":
+		keys = parts[1:min(len(parts), 3)] // the destination changes too
+	case "BATCH":
+		ops, _ := decodeBatch(command)
+		keys = make([]string, len(ops))
+		for i, op := range ops {
+			keys[i] = op.Key
+		}
+	case "ACQUIRE", "RELEASE":
+		if len(parts) > 1 {
+			keys = []string{lockKey(parts[1])}
+		}
+	case "EVAL", "TXN":
+		keyArgs := evalKeyArgs
+		if e.Op == "TXN" {
+			keyArgs = txnKeyArgs
+		}
+		keys = nil
+		for _, i := range keyArgs(parts) {
+			keys = append(keys, parts[i])
+		}
+	}
+	for _, k := range keys {
+		if k == w.key || (w.prefix != "" && strings.HasPrefix(k, w.prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// watch waits for changes matching w.
+func (h *HTTPServer) watch(ctx context.Context, w watchQuery) (WatchResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, w.timeout)
+	defer cancel()
+	res := WatchResponse{Events: []cdc.Event{}, NextRevision: w.fromRevision}
+	for {
+		if res.NextRevision < h.raft.FirstIndex() {
+			return res, errCompacted
+		}
+		applied := h.changes.Applied()
+		for res.NextRevision <= applied && len(res.Events) < maxWatchEvents {
+			entries := h.changes.Entries(res.NextRevision, min(maxWatchEvents, applied-res.NextRevision+1))
+			if len(entries) == 0 {
+				break // compacted in the meantime, caught above next time round
+			}
+			for i, e := range entries {
+				if ev := cdc.NewEvent(res.NextRevision+i, e, h.raft.ID); w.matches(ev) {
+					res.Events = append(res.Events, ev)
+				}
+			}
+			res.NextRevision += len(entries)
+		}
+		if len(res.Events) > 0 {
+			return res, nil
+		}
+		if h.changes.WaitApplied(ctx, res.NextRevision-1) < res.NextRevision {
+			res.TimedOut = ctx.Err() == context.DeadlineExceeded
+			return res, nil
+		}
+	}
+}
+
+// appliedSignal wakes watches when the applied index moves. Nothing is
+// allocated on the write path while nobody watches.
+type appliedSignal struct {
+	waiting atomic.Int32
+	mu      sync.Mutex
+	ch      chan struct{} // closed at the next move, nil until someone waits
+}
+
+func (a *appliedSignal) wait() <-chan struct{} {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.ch == nil {
+		a.ch = make(chan struct{})
+	}
+	return a.ch
+}
+
+func (a *appliedSignal) notify() {
+	if a.waiting.Load() == 0 {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.ch != nil {
+		close(a.ch)
+		a.ch = nil
+	}
+}
+
+// WaitApplied blocks until the applied index passes after or ctx ends, and
+// returns the applied index.
+func (s *Server) WaitApplied(ctx context.Context, after int) int {
+	s.appliedSignal.waiting.Add(1)
+	defer s.appliedSignal.waiting.Add(-1)
+	for {
+		moved := s.appliedSignal.wait()
+		if applied := s.Applied(); applied > after {
+			return applied
+		}
+		select {
+		case <-moved:
+		case <-ctx.Done():
+			return s.Applied()
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// watchHTTP is the HTTP API of srv with /watch enabled.
+func watchHTTP(srv *Server) http.Handler {
+	h := NewHTTPServer(srv.raft, NewMetrics(), srv.store)
+	h.SetChangeFeed(srv)
+	return h.Handler()
+}
+
+func getWatch(t *testing.T, api http.Handler, query string) WatchResponse {
+	t.Helper()
+	return decodeWatch(t, query, serveHTTP(api, "GET", "/watch?"+query, nil))
+}
+
+func decodeWatch(t *testing.T, query string, w *httptest.ResponseRecorder) WatchResponse {
+	t.Helper()
+	if w.Code != http.StatusOK {
+		t.Fatalf("/watch?%s: expected 200, got %d: %s", query, w.Code, w.Body)
+	}
+	var res WatchResponse
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestWatchWaitsForAChange(t *testing.T) {
+	srv, addr := testServer(t)
+	api := watchHTTP(srv)
+	c := dialTest(t, addr)
+	from := srv.Applied() + 1
+
+	query := fmt.Sprintf("key=a&fromRevision=%d&timeout=5s", from)
+	done := make(chan *httptest.ResponseRecorder, 1)
+	go func() { done <- serveHTTP(api, "GET", "/watch?"+query, nil) }()
+	deadline := time.Now().Add(5 * time.Second)
+	for srv.appliedSignal.waiting.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the watch to be waiting")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	// Someone else's key doesn't end the wait.
+	c.do("SET b 1")
+	c.do("SET a 1")
+
+	var res WatchResponse
+	select {
+	case w := <-done:
+		res = decodeWatch(t, query, w)
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the watch to return once a changed")
+	}
+	if res.TimedOut || len(res.Events) != 1 {
+		t.Fatalf("expected the one change to a, got %+v", res)
+	}
+	if e := res.Events[0]; e.Op != "SET" || e.Key != "a" || e.Index != from+1 {
+		t.Errorf("expected SET a at %d, got %+v", from+1, e)
+	}
+	if res.NextRevision != from+2 {
+		t.Errorf("expected to carry on from %d, got %d", from+2, res.NextRevision)
+	}
+}
+
+func TestWatchTimesOut(t *testing.T) {
+	srv, addr := testServer(t)
+	api := watchHTTP(srv)
+	dialTest(t, addr).do("SET b 1")
+
+	from := srv.Applied() + 1
+	start := time.Now()
+	res := getWatch(t, api, "key=a&timeout=50ms")
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("expected the watch to wait out its timeout, it returned after %v", elapsed)
+	}
+	if !res.TimedOut || len(res.Events) != 0 || res.NextRevision != from {
+		t.Errorf("expected a timed out watch with nothing in it, still at %d, got %+v", from, res)
+	}
+}
+
+func TestWatchCatchesUp(t *testing.T) {
+	srv, addr := testServer(t)
+	api := watchHTTP(srv)
+	c := dialTest(t, addr)
+	c.do("SET user:1 x")
+	c.do("SET order:1 y")
+	c.do("SET user:2 z")
+
+	// Changes already applied come back at once, filtered by prefix.
+	res := getWatch(t, api, "prefix=user:&fromRevision=0&timeout=5s")
+	if res.TimedOut || len(res.Events) != 2 || res.Events[0].Key != "user:1" || res.Events[1].Key != "user:2" {
+		t.Fatalf("expected both user: writes, got %+v", res)
+	}
+	if res.NextRevision != srv.Applied()+1 {
+		t.Errorf("expected to carry on after %d, got %d", srv.Applied(), res.NextRevision)
+	}
+}
+
+func TestWatchRequests(t *testing.T) {
+	srv, _ := testServer(t)
+	if w := serveHTTP(testHTTP().Handler(), "GET", "/watch", nil); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 before SetChangeFeed, got %d", w.Code)
+	}
+	api := watchHTTP(srv)
+	for _, query := range []string{"key=a&prefix=b", "fromRevision=-1", "fromRevision=x", "timeout=soon", "timeout=-1s"} {
+		if w := serveHTTP(api, "GET", "/watch?"+query, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("/watch?%s: expected 400, got %d", query, w.Code)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+// Package snapshot is the on-disk format for a point-in-time copy of the
+// store, as written by SAVE and read back by kv-admin.
+//
+// A file is a header, any number of blocks, an end block and a footer:
+//
+//	magic     "KVSNAP\r\n"
+//	version   uint16  format version the writer used
+//	minReader uint16  oldest reader version that can decode the file
+//	header    uint32 length, fields, uint32 CRC-32C of the fields
+//	block     uint8 kind, uint32 length, uint32 count, payload, uint32 CRC-32C
+//	...
+//	end       a block of kind 0 with no payload
+//	footer    uint32 length, fields, uint32 CRC-32C of the fields
+//
+// Integers are big-endian. Header and footer fields are (uvarint tag,
+// uvarint length, bytes), and a reader skips tags it doesn't know, as it
+// skips block kinds it doesn't know, so new fields and blocks can be added
+// without breaking older binaries. Only a change older readers would get
+// wrong raises minReader.
+//
+// An entries block holds count records of (uvarint key length, key,
+// uvarint value length, value).
+package snapshot
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"time"
+)
+
+const (
+	Version          = 1 // what this package writes
+	MinReaderVersion = 1 // oldest reader that understands what it writes
+
+	magic = "KVSNAP\r\n"
+
+	// BlockSize is roughly how many payload bytes go in one block; a record
+	// bigger than that gets a block of its own.
+	BlockSize = 64 << 10
+
+	blockEnd     = 0
+	blockEntries = 1
+
+	// Header fields.
+	tagIndex   = 1
+	tagTerm    = 2
+	tagEntries = 3
+	tagCreated = 4
+	tagNode    = 5
+
+	// Footer fields.
+	tagFooterEntries = 1
+	tagFooterBlocks  = 2
+
+	maxSection = 1 << 20  // header and footer are small, anything bigger is corrupt
+	maxBlock   = 64 << 20 // far above BlockSize plus the largest value the server accepts
+)
+
+var (
+	ErrCorrupt = errors.New("snapshot: corrupt file")
+	ErrVersion = errors.New("snapshot: written by a newer, incompatible version")
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Header describes what a snapshot holds.
+type Header struct {
+	Index   int       `json:"index"`   // raft index the snapshot covers, -1 if unknown
+	Term    int       `json:"term"`    // term of that entry
+	Entries int64     `json:"entries"` // number of keys
+	Created time.Time `json:"created"`
+	Node    string    `json:"node,omitempty"` // who wrote it
+
+	Version          int `json:"version"`          // format version of the file, set on read
+	MinReaderVersion int `json:"minReaderVersion"` // set on read
+}
+
+// fields is a header or footer being built.
+type fields []byte
+
+func (f *fields) add(tag uint64, value []byte) {
+	*f = binary.AppendUvarint(*f, tag)
+	*f = binary.AppendUvarint(*f, uint64(len(value)))
+	*f = append(*f, value...)
+}
+
+func (f *fields) addInt(tag uint64, v int64) {
+	f.add(tag, binary.AppendVarint(nil, v))
+}
+
+// parseFields calls fn with each field of a header or footer.
+func parseFields(b []byte, fn func(tag uint64, value []byte) error) error {
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return corrupt("bad field tag")
+		}
+		b = b[n:]
+		size, n := binary.Uvarint(b)
+		if n <= 0 || size > uint64(len(b)-n) {
+			return corrupt("bad field length")
+		}
+		b = b[n:]
+		if err := fn(tag, b[:size]); err != nil {
+			return err
+		}
+		b = b[size:]
+	}
+	return nil
+}
+
+func fieldInt(value []byte) (int64, error) {
+	v, n := binary.Varint(value)
+	if n <= 0 || n != len(value) {
+		return 0, corrupt("bad integer field")
+	}
+	return v, nil
+}
+
+func corrupt(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", ErrCorrupt, fmt.Sprintf(format, args...))
+}
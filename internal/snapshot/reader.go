@@ -0,0 +1,231 @@
+package snapshot
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+)
+
+// Reader decodes a snapshot, verifying every checksum on the way.
+type Reader struct {
+	r       *bufio.Reader
+	header  Header
+	block   []byte // rest of the current entries block
+	left    int    // records left in it
+	entries int64
+	blocks  int64
+	done    bool
+}
+
+// NewReader reads and checks the header.
+func NewReader(r io.Reader) (*Reader, error) {
+	sr := &Reader{r: bufio.NewReader(r)}
+	var pre [len(magic) + 4]byte
+	if _, err := io.ReadFull(sr.r, pre[:]); err != nil {
+		return nil, truncated(err)
+	}
+	if string(pre[:len(magic)]) != magic {
+		return nil, corrupt("not a snapshot file")
+	}
+	h := &sr.header
+	h.Version = int(binary.BigEndian.Uint16(pre[len(magic):]))
+	h.MinReaderVersion = int(binary.BigEndian.Uint16(pre[len(magic)+2:]))
+	if h.MinReaderVersion > Version {
+		return nil, ErrVersion
+	}
+
+	section, err := sr.readSection()
+	if err != nil {
+		return nil, err
+	}
+	h.Index = -1
+	err = parseFields(section, func(tag uint64, value []byte) error {
+		switch tag {
+		case tagIndex, tagTerm, tagEntries, tagCreated:
+			v, err := fieldInt(value)
+			if err != nil {
+				return err
+			}
+			switch tag {
+			case tagIndex:
+				h.Index = int(v)
+			case tagTerm:
+				h.Term = int(v)
+			case tagEntries:
+				h.Entries = v
+			case tagCreated:
+				h.Created = time.Unix(0, v)
+			}
+		case tagNode:
+			h.Node = string(value)
+		}
+		return nil // unknown fields come from newer writers
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sr, nil
+}
+
+// Header describes the snapshot.
+func (sr *Reader) Header() Header {
+	return sr.header
+}
+
+// Next returns the next key and value. After the last one it checks the
+// footer and returns io.EOF; ErrCorrupt means the file is damaged.
+func (sr *Reader) Next() (string, string, error) {
+	for sr.left == 0 {
+		if sr.done {
+			return "", "", io.EOF
+		}
+		if err := sr.nextBlock(); err != nil {
+			return "", "", err
+		}
+	}
+	key, err := sr.field()
+	if err != nil {
+		return "", "", err
+	}
+	value, err := sr.field()
+	if err != nil {
+		return "", "", err
+	}
+	sr.left--
+	if sr.left == 0 && len(sr.block) != 0 {
+		return "", "", corrupt("block %d has bytes past its records", sr.blocks)
+	}
+	return key, value, nil
+}
+
+func (sr *Reader) field() (string, error) {
+	size, n := binary.Uvarint(sr.block)
+	if n <= 0 || size > uint64(len(sr.block)-n) {
+		return "", corrupt("bad record in block %d", sr.blocks)
+	}
+	s := string(sr.block[n : n+int(size)])
+	sr.block = sr.block[n+int(size):]
+	return s, nil
+}
+
+// nextBlock loads the next entries block, skipping kinds it doesn't know,
+// and checks the footer once it reaches the end block.
+func (sr *Reader) nextBlock() error {
+	for {
+		var hdr [9]byte
+		if _, err := io.ReadFull(sr.r, hdr[:]); err != nil {
+			return truncated(err)
+		}
+		kind := hdr[0]
+		size := binary.BigEndian.Uint32(hdr[1:])
+		count := binary.BigEndian.Uint32(hdr[5:])
+		if size > maxBlock {
+			return corrupt("block of %d bytes", size)
+		}
+		payload := make([]byte, size+4)
+		if _, err := io.ReadFull(sr.r, payload); err != nil {
+			return truncated(err)
+		}
+		payload, sum := payload[:size], binary.BigEndian.Uint32(payload[size:])
+		if crc32.Checksum(payload, crcTable) != sum {
+			return corrupt("checksum mismatch in block %d", sr.blocks)
+		}
+		switch kind {
+		case blockEnd:
+			sr.done = true
+			return sr.checkFooter()
+		case blockEntries:
+			sr.blocks++
+			sr.block, sr.left = payload, int(count)
+			sr.entries += int64(count)
+			if count == 0 {
+				return corrupt("empty block %d", sr.blocks)
+			}
+			return nil
+		}
+	}
+}
+
+func (sr *Reader) checkFooter() error {
+	section, err := sr.readSection()
+	if err != nil {
+		return err
+	}
+	entries, blocks := int64(-1), int64(-1)
+	err = parseFields(section, func(tag uint64, value []byte) error {
+		var err error
+		switch tag {
+		case tagFooterEntries:
+			entries, err = fieldInt(value)
+		case tagFooterBlocks:
+			blocks, err = fieldInt(value)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if entries != sr.entries || blocks != sr.blocks || entries != sr.header.Entries {
+		return corrupt("footer says %d entries in %d blocks, read %d in %d (header said %d)",
+			entries, blocks, sr.entries, sr.blocks, sr.header.Entries)
+	}
+	return nil
+}
+
+// readSection reads a length-prefixed, checksummed header or footer.
+func (sr *Reader) readSection() ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(sr.r, size[:]); err != nil {
+		return nil, truncated(err)
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > maxSection {
+		return nil, corrupt("section of %d bytes", n)
+	}
+	buf := make([]byte, n+4)
+	if _, err := io.ReadFull(sr.r, buf); err != nil {
+		return nil, truncated(err)
+	}
+	section, sum := buf[:n], binary.BigEndian.Uint32(buf[n:])
+	if crc32.Checksum(section, crcTable) != sum {
+		return nil, corrupt("header or footer checksum mismatch")
+	}
+	return section, nil
+}
+
+func truncated(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return corrupt("truncated")
+	}
+	return err
+}
+
+// ReadFile decodes the snapshot at path, calling fn for every key. It
+// returns the header, and an error if the file is damaged anywhere.
+func ReadFile(path string, fn func(key, value string) error) (Header, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Header{}, err
+	}
+	defer f.Close()
+	sr, err := NewReader(f)
+	if err != nil {
+		return Header{}, err
+	}
+	for {
+		key, value, err := sr.Next()
+		if err == io.EOF {
+			return sr.Header(), nil
+		}
+		if err != nil {
+			return sr.Header(), err
+		}
+		if err := fn(key, value); err != nil {
+			return sr.Header(), err
+		}
+	}
+}
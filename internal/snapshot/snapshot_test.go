@@ -0,0 +1,126 @@
+package snapshot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"maps"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func encode(t *testing.T, h Header, data map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	h.Entries = int64(len(data))
+	w, err := NewWriter(&buf, h)
+	if err != nil {
+		t.Fatalf("Failed to write header: %v", err)
+	}
+	for k, v := range data {
+		if err := w.Add(k, v); err != nil {
+			t.Fatalf("Failed to add %q: %v", k, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func decode(b []byte) (Header, map[string]string, error) {
+	r, err := NewReader(bytes.NewReader(b))
+	if err != nil {
+		return Header{}, nil, err
+	}
+	data := make(map[string]string)
+	for {
+		k, v, err := r.Next()
+		if err == io.EOF {
+			return r.Header(), data, nil
+		}
+		if err != nil {
+			return r.Header(), data, err
+		}
+		data[k] = v
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	data := map[string]string{"empty": "", "with\nnewline": "a,b c", "big": strings.Repeat("x", 3*BlockSize)}
+	for i := 0; i < 5000; i++ {
+		data["key"+strconv.Itoa(i)] = strconv.Itoa(i)
+	}
+	b := encode(t, Header{Index: 42, Term: 3, Node: ":8080"}, data)
+
+	h, got, err := decode(b)
+	if err != nil {
+		t.Fatalf("Failed to decode: %v", err)
+	}
+	if !maps.Equal(got, data) {
+		t.Errorf("Decoded %d keys, want the %d written", len(got), len(data))
+	}
+	if h.Index != 42 || h.Term != 3 || h.Node != ":8080" || h.Entries != int64(len(data)) || h.Version != Version || h.Created.IsZero() {
+		t.Errorf("Unexpected header %+v", h)
+	}
+}
+
+func TestDamageIsDetected(t *testing.T) {
+	data := map[string]string{}
+	for i := 0; i < 20000; i++ {
+		data["key"+strconv.Itoa(i)] = "value"
+	}
+	b := encode(t, Header{Index: 7, Term: 1}, data)
+
+	for _, at := range []int{len(magic) + 6, len(b) / 2, len(b) - 3} {
+		bad := bytes.Clone(b)
+		bad[at] ^= 0x40
+		if _, _, err := decode(bad); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("Flipped byte %d of %d: expected ErrCorrupt, got %v", at, len(b), err)
+		}
+	}
+	if _, _, err := decode(b[:len(b)-10]); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("Truncated file: expected ErrCorrupt, got %v", err)
+	}
+}
+
+func TestNewerFilesStillDecode(t *testing.T) {
+	b := encode(t, Header{Index: 5, Term: 2}, map[string]string{"a": "1"})
+
+	// What a future writer might add: a header field and a block kind this
+	// version has never heard of, with a higher version number.
+	var f fields
+	f.addInt(tagIndex, 5)
+	f.addInt(tagTerm, 2)
+	f.addInt(tagEntries, 1)
+	f.add(99, []byte("future field"))
+	future := []byte(magic)
+	future = binary.BigEndian.AppendUint16(future, Version+1)
+	future = binary.BigEndian.AppendUint16(future, MinReaderVersion)
+	future = appendSection(future, f)
+	payload := []byte("future block")
+	future = append(future, 7)
+	future = binary.BigEndian.AppendUint32(future, uint32(len(payload)))
+	future = binary.BigEndian.AppendUint32(future, 1)
+	future = append(future, payload...)
+	future = binary.BigEndian.AppendUint32(future, crc32.Checksum(payload, crcTable))
+	headerEnd := len(magic) + 4 + 4 + int(binary.BigEndian.Uint32(b[len(magic)+4:])) + 4
+	future = append(future, b[headerEnd:]...) // the blocks and footer of the real file
+
+	h, got, err := decode(future)
+	if err != nil {
+		t.Fatalf("Failed to decode a newer file: %v", err)
+	}
+	if got["a"] != "1" || h.Index != 5 || h.Version != Version+1 {
+		t.Errorf("Expected a=1 at index 5 from version %d, got %v and %+v", Version+1, got, h)
+	}
+
+	incompatible := bytes.Clone(b)
+	binary.BigEndian.PutUint16(incompatible[len(magic)+2:], Version+1)
+	if _, _, err := decode(incompatible); !errors.Is(err, ErrVersion) {
+		t.Errorf("Expected ErrVersion when the minimum reader is newer, got %v", err)
+	}
+}
@@ -0,0 +1,170 @@
+package snapshot
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Writer encodes a snapshot. Call Add for every key, then Close.
+type Writer struct {
+	w       *bufio.Writer
+	want    int64 // entries the header promised
+	entries int64
+	blocks  int64
+	block   []byte // payload of the block being filled
+	count   int    // records in it
+	err     error
+}
+
+// NewWriter writes the header for h to w. h.Entries must be the number of
+// keys that will be added.
+func NewWriter(w io.Writer, h Header) (*Writer, error) {
+	sw := &Writer{w: bufio.NewWriter(w), want: h.Entries}
+	if h.Created.IsZero() {
+		h.Created = time.Now()
+	}
+	var f fields
+	f.addInt(tagIndex, int64(h.Index))
+	f.addInt(tagTerm, int64(h.Term))
+	f.addInt(tagEntries, h.Entries)
+	f.addInt(tagCreated, h.Created.UnixNano())
+	if h.Node != "" {
+		f.add(tagNode, []byte(h.Node))
+	}
+
+	buf := []byte(magic)
+	buf = binary.BigEndian.AppendUint16(buf, Version)
+	buf = binary.BigEndian.AppendUint16(buf, MinReaderVersion)
+	buf = appendSection(buf, f)
+	if _, err := sw.w.Write(buf); err != nil {
+		return nil, err
+	}
+	return sw, nil
+}
+
+// Add appends one key.
+func (sw *Writer) Add(key, value string) error {
+	if sw.err != nil {
+		return sw.err
+	}
+	sw.block = binary.AppendUvarint(sw.block, uint64(len(key)))
+	sw.block = append(sw.block, key...)
+	sw.block = binary.AppendUvarint(sw.block, uint64(len(value)))
+	sw.block = append(sw.block, value...)
+	sw.count++
+	sw.entries++
+	if len(sw.block) >= BlockSize {
+		sw.err = sw.flushBlock()
+	}
+	return sw.err
+}
+
+func (sw *Writer) flushBlock() error {
+	if sw.count == 0 {
+		return nil
+	}
+	if err := sw.writeBlock(blockEntries, sw.count, sw.block); err != nil {
+		return err
+	}
+	sw.blocks++
+	sw.block = sw.block[:0]
+	sw.count = 0
+	return nil
+}
+
+func (sw *Writer) writeBlock(kind byte, count int, payload []byte) error {
+	var hdr [9]byte
+	hdr[0] = kind
+	binary.BigEndian.PutUint32(hdr[1:], uint32(len(payload)))
+	binary.BigEndian.PutUint32(hdr[5:], uint32(count))
+	if _, err := sw.w.Write(hdr[:]); err != nil {
+		return err
+	}
+	if _, err := sw.w.Write(payload); err != nil {
+		return err
+	}
+	_, err := sw.w.Write(binary.BigEndian.AppendUint32(nil, crc32.Checksum(payload, crcTable)))
+	return err
+}
+
+// Close writes the last block, the end marker and the footer. It fails if
+// the number of keys added doesn't match the header.
+func (sw *Writer) Close() error {
+	if sw.err != nil {
+		return sw.err
+	}
+	if sw.entries != sw.want {
+		return fmt.Errorf("snapshot: header promised %d entries, %d were added", sw.want, sw.entries)
+	}
+	if err := sw.flushBlock(); err != nil {
+		return err
+	}
+	if err := sw.writeBlock(blockEnd, 0, nil); err != nil {
+		return err
+	}
+	var f fields
+	f.addInt(tagFooterEntries, sw.entries)
+	f.addInt(tagFooterBlocks, sw.blocks)
+	if _, err := sw.w.Write(appendSection(nil, f)); err != nil {
+		return err
+	}
+	return sw.w.Flush()
+}
+
+// appendSection frames a header or footer: length, fields, checksum.
+func appendSection(buf []byte, f fields) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(f)))
+	buf = append(buf, f...)
+	return binary.BigEndian.AppendUint32(buf, crc32.Checksum(f, crcTable))
+}
+
+// Source is what WriteFile snapshots, e.g. a *store.Snapshot.
+type Source interface {
+	Len() int
+	Range(fn func(key, value string) bool)
+}
+
+// WriteFile writes src to path atomically: it goes to a temporary file
+// that is synced and renamed into place only once complete.
+func WriteFile(path string, h Header, src Source) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+
+	h.Entries = int64(src.Len())
+	sw, err := NewWriter(tmp, h)
+	if err == nil {
+		src.Range(func(key, value string) bool {
+			err = sw.Add(key, value)
+			return err == nil
+		})
+	}
+	if err == nil {
+		err = sw.Close()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	if d, err := os.Open(filepath.Dir(path)); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+// Package storage holds the key/value data itself. The store layers the
+// WAL, compression and per-key metadata on top of an Engine, so how the
+// data is kept can change without touching any of that.
+package storage
+
+import "fmt"
+
+// Engine is a concurrency-safe map from keys to stored values. Values are
+// opaque here: compressed values come and go as the store encoded them.
+type Engine interface {
+	Get(key string) (string, bool)
+	Set(key, value string)
+	Delete(key string) bool // reports whether key was there
+	Len() int
+
+	// Scan calls fn for each key starting with prefix, in no particular
+	// order, until fn returns false. fn must not call back into the engine.
+	Scan(prefix string, fn func(key, value string) bool)
+
+	// Snapshot returns a point-in-time view of everything. It is cheap to
+	// take and writers carry on while it is read; Restore replaces
+	// everything with data, which the engine may keep.
+	Snapshot() Snapshot
+	Restore(data map[string]string)
+
+	// Usage is what the keys and values take up, kept current on every
+	// write rather than counted when asked.
+	Usage() Usage
+}
+
+// Usage is roughly how much memory an engine's data takes: the bytes of its
+// keys and of its values as stored, plus EntryOverhead for each key.
+type Usage struct {
+	Keys       int   `json:"keys"`
+	KeyBytes   int64 `json:"keyBytes"`
+	ValueBytes int64 `json:"valueBytes"`
+
+	// Values kept inside their map entry, see Options.CompactValues. Their
+	// bytes are in ValueBytes but take no allocation of their own.
+	InlineValues int   `json:"inlineValues"`
+	InlineBytes  int64 `json:"inlineBytes"`
+}
+
+// EntryOverhead is about what a map entry costs beyond its bytes: two
+// string headers and its share of a bucket.
+const EntryOverhead = 64
+
+// Bytes is the estimate as a single number.
+func (u Usage) Bytes() int64 {
+	return u.KeyBytes + u.ValueBytes - u.InlineBytes + int64(u.Keys)*EntryOverhead
+}
+
+// Snapshot is a consistent view of an engine as of one instant. Close it
+// when done, so writers stop preserving it.
+type Snapshot interface {
+	Len() int
+	Range(fn func(key, value string) bool) // until fn returns false
+	Close()
+}
+
+// SmallValueMax is the longest value a compact engine keeps inline.
+const SmallValueMax = 15
+
+// Options tune the engine Open returns.
+type Options struct {
+	// CompactValues keeps values of up to SmallValueMax bytes inside their
+	// map entry, in the 16 bytes a string header would take, instead of in
+	// an allocation of their own that the garbage collector has to follow.
+	// It suits many keys with short values, such as flags and counters, and
+	// costs a small allocation each time one of them is read.
+	CompactValues bool
+}
+
+// Open maps a -storage-engine flag value to a new, empty engine.
+func Open(name string, opts Options) (Engine, error) {
+	switch name {
+	case "", "map":
+		return newMap(opts.CompactValues), nil
+	case "sharded":
+		return newSharded(DefaultShards, opts.CompactValues), nil
+	}
+	return nil, fmt.Errorf("unknown storage engine %q (want map or sharded)", name)
+}
+
+// Compact reports whether e keeps short values inline, see Options.
+func Compact(e Engine) bool {
+	c, ok := e.(interface{ compactValues() bool })
+	return ok && c.compactValues()
+}
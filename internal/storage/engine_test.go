@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// engines is every engine Open makes, by name.
+var engines = map[string]func() (Engine, error){
+	"map":             func() (Engine, error) { return Open("map", Options{}) },
+	"sharded":         func() (Engine, error) { return Open("sharded", Options{}) },
+	"compact map":     func() (Engine, error) { return Open("map", Options{CompactValues: true}) },
+	"compact sharded": func() (Engine, error) { return Open("sharded", Options{CompactValues: true}) },
+}
+
+func TestEnginesAgree(t *testing.T) {
+	for name, open := range engines {
+		e, err := open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 100; i++ {
+			e.Set(fmt.Sprintf("ns:%d", i), fmt.Sprint(i))
+		}
+		e.Set("other", "x")
+		if !e.Delete("ns:0") || e.Delete("ns:0") {
+			t.Errorf("%s: Delete should report the key only the first time", name)
+		}
+		if v, ok := e.Get("ns:42"); !ok || v != "42" {
+			t.Errorf("%s: Get(ns:42) = %q, %v", name, v, ok)
+		}
+		if e.Len() != 100 {
+			t.Errorf("%s: expected 100 keys, got %d", name, e.Len())
+		}
+
+		seen := 0
+		e.Scan("ns:", func(k, v string) bool {
+			seen++
+			return true
+		})
+		if seen != 99 {
+			t.Errorf("%s: expected 99 keys under ns:, scanned %d", name, seen)
+		}
+		seen = 0
+		e.Scan("", func(k, v string) bool {
+			seen++
+			return seen < 5
+		})
+		if seen != 5 {
+			t.Errorf("%s: expected the scan to stop after 5 keys, got %d", name, seen)
+		}
+
+		e.Set("other", "xyz") // overwriting counts the new value only
+		if u := e.Usage(); u.Keys != 100 || u.ValueBytes != int64(len(valueBytes(e))) || u.KeyBytes != int64(len(keyBytes(e))) {
+			t.Errorf("%s: usage %+v doesn't match the data", name, u)
+		}
+
+		e.Restore(map[string]string{"a": "1"})
+		if e.Len() != 1 {
+			t.Errorf("%s: expected 1 key after restore, got %d", name, e.Len())
+		}
+		want := Usage{Keys: 1, KeyBytes: 1, ValueBytes: 1}
+		if Compact(e) {
+			want.InlineValues, want.InlineBytes = 1, 1
+		}
+		if u := e.Usage(); u != want || u.Bytes() != 1+want.ValueBytes-want.InlineBytes+EntryOverhead {
+			t.Errorf("%s: expected usage of one tiny key after restore, got %+v", name, u)
+		}
+	}
+	if _, err := Open("bolt", Options{}); err == nil {
+		t.Error("expected an unknown engine to be rejected")
+	}
+}
+
+// keyBytes and valueBytes concatenate what e holds, to count it the slow way.
+func keyBytes(e Engine) string {
+	var b strings.Builder
+	e.Scan("", func(k, _ string) bool {
+		b.WriteString(k)
+		return true
+	})
+	return b.String()
+}
+
+func valueBytes(e Engine) string {
+	var b strings.Builder
+	e.Scan("", func(_, v string) bool {
+		b.WriteString(v)
+		return true
+	})
+	return b.String()
+}
+
+func TestSnapshotIsPointInTime(t *testing.T) {
+	for name, open := range engines {
+		e, _ := open()
+		for i := 0; i < 50; i++ {
+			e.Set(fmt.Sprint(i), "old")
+		}
+		snap := e.Snapshot()
+		e.Set("0", "new")
+		e.Delete("1")
+		e.Set("extra", "new")
+
+		got := map[string]string{}
+		snap.Range(func(k, v string) bool {
+			got[k] = v
+			return true
+		})
+		if snap.Len() != 50 || len(got) != 50 || got["0"] != "old" || got["1"] != "old" {
+			t.Errorf("%s: snapshot saw later writes: %d keys, 0=%q 1=%q", name, snap.Len(), got["0"], got["1"])
+		}
+		snap.Close()
+		snap.Close() // closing twice is harmless
+
+		if v, _ := e.Get("0"); v != "new" || e.Len() != 50 {
+			t.Errorf("%s: expected the writes to stick, got 0=%q and %d keys", name, v, e.Len())
+		}
+	}
+}
+
+func TestCompactValues(t *testing.T) {
+	e, _ := Open("map", Options{CompactValues: true})
+	if !Compact(e) {
+		t.Fatal("expected the engine to say it is compact")
+	}
+	long := strings.Repeat("x", SmallValueMax+1)
+	e.Set("flag", "on")
+	e.Set("doc", long)
+	e.Set("edge", strings.Repeat("y", SmallValueMax))
+	if u := e.Usage(); u.InlineValues != 2 || u.InlineBytes != 2+SmallValueMax {
+		t.Errorf("expected flag and edge inline, got %+v", u)
+	}
+
+	// A value moves between the two as it grows and shrinks.
+	snap := e.Snapshot()
+	e.Set("flag", long)
+	e.Set("doc", "off")
+	for key, want := range map[string]string{"flag": long, "doc": "off"} {
+		if v, ok := e.Get(key); !ok || v != want {
+			t.Errorf("Get(%s) = %q, %v, expected %q", key, v, ok, want)
+		}
+	}
+	got := map[string]string{}
+	snap.Range(func(k, v string) bool {
+		got[k] = v
+		return true
+	})
+	snap.Close()
+	if got["flag"] != "on" || got["doc"] != long || len(got) != 3 {
+		t.Errorf("snapshot saw later writes: %v", got)
+	}
+
+	if !e.Delete("edge") || e.Delete("edge") || e.Len() != 2 {
+		t.Errorf("expected edge deleted once, leaving 2 keys, got %d", e.Len())
+	}
+	u := e.Usage()
+	if u.InlineValues != 1 || u.InlineBytes != 3 || u.ValueBytes != int64(len(valueBytes(e))) || u.KeyBytes != int64(len(keyBytes(e))) {
+		t.Errorf("usage %+v doesn't match the data", u)
+	}
+	if want := int64(len("flagdoc")+len(long)) + 2*EntryOverhead; u.Bytes() != want {
+		t.Errorf("expected the inline value to take no bytes of its own, %d in all, got %d", want, u.Bytes())
+	}
+
+	if plain, _ := Open("map", Options{}); Compact(plain) {
+		t.Error("expected engines to keep every value in a string by default")
+	}
+}
+
+func TestShardedConcurrentWrites(t *testing.T) {
+	e := NewSharded(8)
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				e.Set(fmt.Sprintf("%d-%d", w, i), "v")
+			}
+		}(w)
+	}
+	// Snapshots taken mid-write still have to agree with themselves.
+	for i := 0; i < 20; i++ {
+		snap := e.Snapshot()
+		n := 0
+		snap.Range(func(k, v string) bool {
+			n++
+			return true
+		})
+		if n != snap.Len() {
+			t.Errorf("snapshot ranged over %d keys but says it has %d", n, snap.Len())
+		}
+		snap.Close()
+	}
+	wg.Wait()
+	if e.Len() != 8000 {
+		t.Fatalf("expected 8000 keys, got %d", e.Len())
+	}
+}
@@ -0,0 +1,242 @@
+package storage
+
+import (
+	"maps"
+	"strings"
+	"sync"
+)
+
+// Map keeps everything in one Go map behind one lock. It is the default
+// engine and what the store always used.
+//
+// Snapshots are copy-on-write: a snapshot shares the current map, and the
+// first write after it copies the map before changing it, so nobody waits
+// while the snapshot is read.
+type Map struct {
+	mu     sync.RWMutex
+	data   map[string]string
+	small  map[string]smallValue // values of up to SmallValueMax bytes when compact, a key is in one map or the other
+	shared int                   // open snapshots of data; writes copy it first while this is set
+	gen    int                   // bumped whenever data is replaced, so snapshots know if they still share it
+
+	compact bool // see Options.CompactValues
+
+	keyBytes, valueBytes int64 // sizes of everything in data and small, see Usage
+	inlineBytes          int64 // of the values in small
+}
+
+// smallValue is a short value held in place, 16 bytes like the string
+// header it stands in for but with nothing for it to point at.
+type smallValue struct {
+	n uint8
+	b [SmallValueMax]byte
+}
+
+func makeSmall(v string) smallValue {
+	s := smallValue{n: uint8(len(v))}
+	copy(s.b[:], v)
+	return s
+}
+
+func (s smallValue) String() string {
+	return string(s.b[:s.n])
+}
+
+func NewMap() *Map {
+	return newMap(false)
+}
+
+func newMap(compact bool) *Map {
+	m := &Map{data: make(map[string]string), compact: compact}
+	if compact {
+		m.small = make(map[string]smallValue)
+	}
+	return m
+}
+
+func (m *Map) compactValues() bool { return m.compact }
+
+func (m *Map) Get(key string) (string, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if v, ok := m.data[key]; ok || !m.compact {
+		return v, ok
+	}
+	v, ok := m.small[key]
+	return v.String(), ok
+}
+
+func (m *Map) Set(key, value string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.own()
+	if old, ok := m.drop(key); ok {
+		m.valueBytes -= int64(old)
+	} else {
+		m.keyBytes += int64(len(key))
+	}
+	m.valueBytes += int64(len(value))
+	if m.compact && len(value) <= SmallValueMax {
+		m.small[key] = makeSmall(value)
+		m.inlineBytes += int64(len(value))
+		return
+	}
+	m.data[key] = value
+}
+
+func (m *Map) Delete(key string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.has(key) {
+		return false
+	}
+	m.own()
+	old, _ := m.drop(key)
+	m.keyBytes -= int64(len(key))
+	m.valueBytes -= int64(old)
+	return true
+}
+
+// has reports whether key is in either map. Callers hold m.mu.
+func (m *Map) has(key string) bool {
+	if _, ok := m.data[key]; ok {
+		return true
+	}
+	_, ok := m.small[key]
+	return ok
+}
+
+// drop removes key from whichever map holds it and returns the length of
+// its value. Callers hold m.mu and have called own.
+func (m *Map) drop(key string) (int, bool) {
+	if old, ok := m.data[key]; ok {
+		delete(m.data, key)
+		return len(old), true
+	}
+	if old, ok := m.small[key]; ok {
+		delete(m.small, key)
+		m.inlineBytes -= int64(old.n)
+		return int(old.n), true
+	}
+	return 0, false
+}
+
+// own makes data safe to change, copying it away from any snapshots.
+// Callers hold m.mu.
+func (m *Map) own() {
+	if m.shared > 0 {
+		m.data = maps.Clone(m.data)
+		m.small = maps.Clone(m.small)
+		m.shared = 0
+		m.gen++
+	}
+}
+
+func (m *Map) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.data) + len(m.small)
+}
+
+func (m *Map) Scan(prefix string, fn func(key, value string) bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for k, v := range m.data {
+		if strings.HasPrefix(k, prefix) && !fn(k, v) {
+			return
+		}
+	}
+	for k, v := range m.small {
+		if strings.HasPrefix(k, prefix) && !fn(k, v.String()) {
+			return
+		}
+	}
+}
+
+func (m *Map) Snapshot() Snapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.snapshot()
+}
+
+// snapshot shares data with a new snapshot. Callers hold m.mu.
+func (m *Map) snapshot() *mapSnapshot {
+	m.shared++
+	return &mapSnapshot{m: m, data: m.data, small: m.small, gen: m.gen}
+}
+
+func (m *Map) Restore(data map[string]string) {
+	if data == nil {
+		data = make(map[string]string)
+	}
+	var small map[string]smallValue
+	if m.compact {
+		small = make(map[string]smallValue)
+		for k, v := range data {
+			if len(v) <= SmallValueMax {
+				small[k] = makeSmall(v)
+				delete(data, k)
+			}
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.data, m.small = data, small
+	m.shared = 0
+	m.gen++
+	m.keyBytes, m.valueBytes, m.inlineBytes = 0, 0, 0
+	for k, v := range data {
+		m.keyBytes += int64(len(k))
+		m.valueBytes += int64(len(v))
+	}
+	for k, v := range small {
+		m.keyBytes += int64(len(k))
+		m.valueBytes += int64(v.n)
+		m.inlineBytes += int64(v.n)
+	}
+}
+
+func (m *Map) Usage() Usage {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return Usage{
+		Keys: len(m.data) + len(m.small), KeyBytes: m.keyBytes, ValueBytes: m.valueBytes,
+		InlineValues: len(m.small), InlineBytes: m.inlineBytes,
+	}
+}
+
+// mapSnapshot reads a map nobody changes any more.
+type mapSnapshot struct {
+	m     *Map
+	data  map[string]string
+	small map[string]smallValue
+	gen   int
+	once  sync.Once
+}
+
+func (s *mapSnapshot) Len() int { return len(s.data) + len(s.small) }
+
+func (s *mapSnapshot) Range(fn func(key, value string) bool) {
+	for k, v := range s.data {
+		if !fn(k, v) {
+			return
+		}
+	}
+	for k, v := range s.small {
+		if !fn(k, v.String()) {
+			return
+		}
+	}
+}
+
+// Close lets the next write change the map in place again, if no write
+// has copied it already and no other snapshot shares it.
+func (s *mapSnapshot) Close() {
+	s.once.Do(func() {
+		s.m.mu.Lock()
+		defer s.m.mu.Unlock()
+		if s.m.gen == s.gen {
+			s.m.shared--
+		}
+	})
+}
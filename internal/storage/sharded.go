@@ -0,0 +1,127 @@
+package storage
+
+import "hash/maphash"
+
+const DefaultShards = 32
+
+// Sharded spreads keys over several Maps by hash, so readers and writers of
+// different keys rarely wait on the same lock, and a scan only ever holds
+// one shard at a time. A write during a snapshot only copies its own shard.
+type Sharded struct {
+	seed   maphash.Seed
+	shards []*Map
+}
+
+func NewSharded(n int) *Sharded {
+	return newSharded(n, false)
+}
+
+func newSharded(n int, compact bool) *Sharded {
+	s := &Sharded{seed: maphash.MakeSeed(), shards: make([]*Map, max(n, 1))}
+	for i := range s.shards {
+		s.shards[i] = newMap(compact)
+	}
+	return s
+}
+
+func (s *Sharded) compactValues() bool { return s.shards[0].compact }
+
+func (s *Sharded) shard(key string) *Map {
+	return s.shards[maphash.String(s.seed, key)%uint64(len(s.shards))]
+}
+
+func (s *Sharded) Get(key string) (string, bool) { return s.shard(key).Get(key) }
+func (s *Sharded) Set(key, value string)         { s.shard(key).Set(key, value) }
+func (s *Sharded) Delete(key string) bool        { return s.shard(key).Delete(key) }
+
+func (s *Sharded) Len() int {
+	n := 0
+	for _, m := range s.shards {
+		n += m.Len()
+	}
+	return n
+}
+
+func (s *Sharded) Usage() Usage {
+	var u Usage
+	for _, m := range s.shards {
+		mu := m.Usage()
+		u.Keys += mu.Keys
+		u.KeyBytes += mu.KeyBytes
+		u.ValueBytes += mu.ValueBytes
+		u.InlineValues += mu.InlineValues
+		u.InlineBytes += mu.InlineBytes
+	}
+	return u
+}
+
+func (s *Sharded) Scan(prefix string, fn func(key, value string) bool) {
+	for _, m := range s.shards {
+		more := true
+		m.Scan(prefix, func(k, v string) bool {
+			more = fn(k, v)
+			return more
+		})
+		if !more {
+			return
+		}
+	}
+}
+
+// Snapshot freezes every shard at the same instant: all shard locks are
+// held just long enough to mark each one shared.
+func (s *Sharded) Snapshot() Snapshot {
+	for _, m := range s.shards {
+		m.mu.Lock()
+	}
+	snap := make(shardedSnapshot, len(s.shards))
+	for i, m := range s.shards {
+		snap[i] = m.snapshot()
+	}
+	for _, m := range s.shards {
+		m.mu.Unlock()
+	}
+	return snap
+}
+
+type shardedSnapshot []*mapSnapshot
+
+func (s shardedSnapshot) Len() int {
+	n := 0
+	for _, shard := range s {
+		n += shard.Len()
+	}
+	return n
+}
+
+func (s shardedSnapshot) Range(fn func(key, value string) bool) {
+	for _, shard := range s {
+		more := true
+		shard.Range(func(k, v string) bool {
+			more = fn(k, v)
+			return more
+		})
+		if !more {
+			return
+		}
+	}
+}
+
+func (s shardedSnapshot) Close() {
+	for _, shard := range s {
+		shard.Close()
+	}
+}
+
+func (s *Sharded) Restore(data map[string]string) {
+	parts := make([]map[string]string, len(s.shards))
+	for i := range parts {
+		parts[i] = make(map[string]string, len(data)/len(s.shards))
+	}
+	for k, v := range data {
+		parts[maphash.String(s.seed, k)%uint64(len(s.shards))][k] = v
+	}
+	for i, m := range s.shards {
+		m.Restore(parts[i])
+	}
+}
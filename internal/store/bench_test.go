@@ -0,0 +1,145 @@
+package store // Benchmarks for the store, run with go test -bench . ./internal/store.
+
+import ( // Import block starts here.
+	"path/filepath" // Puts each benchmark's WAL in its own temp directory.
+	"strconv"       // Builds the benchmark keys.
+	"sync/atomic"   // Hands each parallel goroutine its own starting key.
+	"testing"       // testing.B and RunParallel.
+
+	"github.com/mathdee/KV-Store/internal/storage" // The engines being compared.
+	"github.com/mathdee/KV-Store/internal/wal"     // The fsync policies being compared.
+) // Import block ends here.
+
+// Each benchmark runs once per engine and, where the WAL is in the way, once
+// per fsync policy: sync writers wait for their group commit's fsync, async
+// ones only for the queue, so the gap between the two is what the fsync costs.
+// Names come out as BenchmarkSet/sharded/sync and so on, e.g.
+//
+//	go test -bench 'Set/.*/async' -benchmem ./internal/store
+
+const benchKeys = 10000 // Keyspace the benchmarks spread over.
+
+var benchEngines = []string{"map", "sharded"}            // Every storage.Open name.
+var benchModes = []wal.Mode{wal.ModeSync, wal.ModeAsync} // Every fsync policy.
+
+var benchKeyNames = func() []string { // Keys built once, so formatting them isn't measured.
+	keys := make([]string, benchKeys) // One per slot of the keyspace.
+	for i := range keys {             // Fill them in order.
+		keys[i] = "bench:" + strconv.Itoa(i) // Namespaced like real keys.
+	} // End of key loop.
+	return keys // Shared by every benchmark.
+}() // End of benchKeyNames.
+
+var benchClients atomic.Int64 // Counts the goroutines RunParallel started.
+
+func benchStart() int { // Where a parallel goroutine starts in the keyspace, so they don't all hit the same keys in lockstep.
+	return int(benchClients.Add(1)) * 7919 // A prime stride spreads them out.
+} // End of benchStart function.
+
+func benchStore(b *testing.B, engine string, mode wal.Mode) *Store { // A store on engine whose WAL syncs per mode, filled with every benchmark key.
+	b.Helper()                                                        // Failures point at the benchmark.
+	w, err := wal.NewWAL(filepath.Join(b.TempDir(), "bench_wal.log")) // Removed with the temp directory.
+	if err != nil {                                                   // Stop if the WAL couldn't be created.
+		b.Fatalf("Failed to create WAL: %v", err)
+	} // End of error check block.
+	b.Cleanup(func() { w.Close() })                   // Runs before the temp directory goes.
+	e, err := storage.Open(engine, storage.Options{}) // The engine under test.
+	if err != nil {                                   // Only if benchEngines has a typo.
+		b.Fatal(err)
+	} // End of engine check.
+	s := NewStoreWithEngine(w, e) // Store under test.
+
+	w.SetMode(wal.ModeAsync)            // Filling doesn't need an fsync per key.
+	for _, key := range benchKeyNames { // Every key starts out present, so Get always hits.
+		if err := s.Set(key, "initial-value"); err != nil { // Same size as the values written below.
+			b.Fatalf("Failed to fill: %v", err)
+		} // End of error check block.
+	} // End of fill loop.
+	if err := w.Sync(); err != nil { // The fill is on disk before timing starts.
+		b.Fatalf("Failed to sync: %v", err)
+	} // End of error check block.
+	w.SetMode(mode) // The policy being measured.
+	return s        // Ready to benchmark.
+} // End of benchStore function.
+
+func BenchmarkSet(b *testing.B) { // One writer at a time, so sync mode pays a group commit per write.
+	for _, engine := range benchEngines { // Every engine.
+		for _, mode := range benchModes { // Every fsync policy.
+			b.Run(engine+"/"+string(mode), func(b *testing.B) { // e.g. BenchmarkSet/map/sync.
+				s := benchStore(b, engine, mode) // Fresh store per run.
+				b.ReportAllocs()                 // Allocations matter as much as time here.
+				b.ResetTimer()                   // Don't count the fill.
+				for i := 0; i < b.N; i++ {       // Walk the keyspace.
+					if err := s.Set(benchKeyNames[i%benchKeys], "updated-value"); err != nil { // Overwrites, the common case.
+						b.Fatal(err)
+					} // End of error check block.
+				} // End of write loop.
+			}) // End of sub-benchmark.
+		} // End of mode loop.
+	} // End of engine loop.
+} // End of BenchmarkSet function.
+
+func BenchmarkSetParallel(b *testing.B) { // Many writers, so group commits fill up and the fsync is shared.
+	for _, engine := range benchEngines { // Every engine.
+		for _, mode := range benchModes { // Every fsync policy.
+			b.Run(engine+"/"+string(mode), func(b *testing.B) { // e.g. BenchmarkSetParallel/sharded/sync.
+				s := benchStore(b, engine, mode)     // Fresh store per run.
+				b.SetParallelism(16)                 // Writers mostly wait on the fsync, more of them than CPUs is realistic.
+				b.ReportAllocs()                     // Allocations matter as much as time here.
+				b.ResetTimer()                       // Don't count the fill.
+				b.RunParallel(func(pb *testing.PB) { // One goroutine per writer.
+					for i := benchStart(); pb.Next(); i++ { // Each writer walks the keyspace from its own start.
+						if err := s.Set(benchKeyNames[i%benchKeys], "updated-value"); err != nil { // Overwrites, the common case.
+							b.Error(err) // Fatal isn't allowed off the benchmark goroutine.
+							return       // Stop this writer.
+						} // End of error check block.
+					} // End of write loop.
+				}) // End of RunParallel.
+			}) // End of sub-benchmark.
+		} // End of mode loop.
+	} // End of engine loop.
+} // End of BenchmarkSetParallel function.
+
+func BenchmarkGet(b *testing.B) { // Reads never touch the WAL, so only the engines are compared.
+	for _, engine := range benchEngines { // Every engine.
+		b.Run(engine, func(b *testing.B) { // e.g. BenchmarkGet/sharded.
+			s := benchStore(b, engine, wal.ModeSync) // The mode doesn't matter for reads.
+			b.ReportAllocs()                         // Allocations matter as much as time here.
+			b.ResetTimer()                           // Don't count the fill.
+			for i := 0; i < b.N; i++ {               // Walk the keyspace.
+				if _, err := s.Get(benchKeyNames[i%benchKeys]); err != nil { // Every key was filled.
+					b.Fatal(err)
+				} // End of error check block.
+			} // End of read loop.
+		}) // End of sub-benchmark.
+	} // End of engine loop.
+} // End of BenchmarkGet function.
+
+func BenchmarkMixedParallel(b *testing.B) { // Nine reads to a write from many goroutines, where lock contention shows.
+	for _, engine := range benchEngines { // Every engine.
+		for _, mode := range benchModes { // Every fsync policy.
+			b.Run(engine+"/"+string(mode), func(b *testing.B) { // e.g. BenchmarkMixedParallel/map/async.
+				s := benchStore(b, engine, mode)     // Fresh store per run.
+				b.SetParallelism(16)                 // Enough goroutines for writers waiting on the fsync not to idle the CPUs.
+				b.ReportAllocs()                     // Allocations matter as much as time here.
+				b.ResetTimer()                       // Don't count the fill.
+				b.RunParallel(func(pb *testing.PB) { // One goroutine per client.
+					for i := benchStart(); pb.Next(); i++ { // Each client walks the keyspace from its own start.
+						key := benchKeyNames[i%benchKeys] // The next key along.
+						if i%10 == 0 {                    // One op in ten writes.
+							if err := s.Set(key, "updated-value"); err != nil { // Overwrite.
+								b.Error(err) // Fatal isn't allowed off the benchmark goroutine.
+								return       // Stop this client.
+							} // End of error check block.
+							continue // Next op.
+						} // End of write.
+						if _, err := s.Get(key); err != nil { // The other nine read.
+							b.Error(err) // Fatal isn't allowed off the benchmark goroutine.
+							return       // Stop this client.
+						} // End of error check block.
+					} // End of op loop.
+				}) // End of RunParallel.
+			}) // End of sub-benchmark.
+		} // End of mode loop.
+	} // End of engine loop.
+} // End of BenchmarkMixedParallel function.
@@ -0,0 +1,49 @@
+package store // WAL compaction support for the store.
+
+import ( // Import block starts here.
+	"encoding/base64" // Compressed values are base64'd, same as queueSet.
+
+	"github.com/mathdee/KV-Store/internal/wal" // Record formatting.
+) // Import block ends here.
+
+func (s *Store) BeginCompaction() *Snapshot { // Starts a WAL compaction and returns the state the new WAL should start from.
+	s.mu.Lock()             // No write can queue between the snapshot and the WAL starting its tail.
+	defer s.mu.Unlock()     // Released when the function returns.
+	s.wal.BeginCompaction() // Everything queued so far is now on disk, everything after goes to the tail.
+	return s.snapshot()     // The state the flushed part of the WAL describes, without copying anything yet.
+} // End of BeginCompaction method.
+
+func (s *Store) FinishCompaction(snap *Snapshot) error { // Replaces the WAL with snap plus whatever was written since BeginCompaction.
+	defer snap.Close()                                     // Writers can stop preserving it afterwards.
+	records := make([]string, 0, snap.Len())               // One SET per key.
+	snap.data.Range(func(key string, stored string) bool { // Order doesn't matter, every key appears once.
+		records = append(records, setRecord(snap.packed, key, stored)) // Value in its stored form.
+		if at := snap.Expiry(key); at != 0 {                           // Written with a TTL.
+			records = append(records, expiryRecord(key, at)) // Right after its value.
+		} // End of expiry case.
+		return true // Every key.
+	}) // End of range.
+	if snap.applied >= 0 { // Written by a raft node.
+		records = append(records, appliedRecord(snap.applied)) // Last, so recovery keeps every key above.
+	} // End of applied case.
+	return s.wal.FinishCompaction(records) // The slow part runs without the store lock.
+} // End of FinishCompaction method.
+
+func (s *Store) CommitStats() wal.CommitStats { // Group commit batch sizes the WAL achieved, for /metrics.
+	return s.wal.CommitStats() // Tracked by the WAL.
+} // End of CommitStats method.
+
+func (s *Store) WALMode() wal.Mode { // Whether writes are acked on fsync or on queueing, recorded with benchmark results.
+	return s.wal.Mode() // Set on the WAL.
+} // End of WALMode method.
+
+func (s *Store) WALSize() int64 { // Bytes the WAL holds on disk, what compaction thresholds are checked against.
+	return s.wal.Size() // Known-good size tracked by the WAL.
+} // End of WALSize method.
+
+func setRecord(flags map[string]packedValue, key string, stored string) string { // The WAL record queueSet would log for key holding stored.
+	if p, ok := flags[key]; ok { // Compressed values stay compressed.
+		return wal.FormatOp("ZSET", key, p.codec.String(), base64.StdEncoding.EncodeToString([]byte(stored))) // Replay decodes it back.
+	} // End of compressed case.
+	return wal.FormatSet(key, stored) // Everything else keeps the plain SET format.
+} // End of setRecord method.
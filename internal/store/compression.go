@@ -0,0 +1,130 @@
+package store // Transparent value compression for the store.
+
+import ( // Import block starts here.
+	"encoding/base64" // Compressed bytes are base64'd in the WAL so records stay one line.
+	"fmt"             // Formats decode failures.
+	"maps"            // Copies the flags away from snapshots.
+
+	"github.com/mathdee/KV-Store/internal/compress" // Value codecs.
+) // Import block ends here.
+
+type packedValue struct { // Per-key flag for values held compressed in the engine.
+	codec  compress.Codec // Which codec the stored bytes use.
+	rawLen int            // Uncompressed length, so STRLEN and stats don't need to decode.
+} // End of packedValue struct.
+
+type CompressionStats struct { // What /metrics reports about compression.
+	Codec       string  `json:"codec"`       // Codec used for new writes.
+	Threshold   int     `json:"threshold"`   // Values shorter than this are stored as-is.
+	Keys        int     `json:"keys"`        // Keys currently held compressed.
+	RawBytes    int64   `json:"rawBytes"`    // Their total uncompressed size.
+	StoredBytes int64   `json:"storedBytes"` // Their total compressed size.
+	Ratio       float64 `json:"ratio"`       // RawBytes / StoredBytes, 0 with no compressed keys.
+} // End of CompressionStats struct.
+
+func (s *Store) SetCompression(codec compress.Codec, threshold int) { // Compresses values of at least threshold bytes written from now on.
+	s.mu.Lock()             // Settings are read under the lock by every write.
+	defer s.mu.Unlock()     // Released when the function returns.
+	s.codec = codec         // compress.None turns compression off for new writes.
+	s.threshold = threshold // Existing keys keep whatever codec they were stored with.
+} // End of SetCompression method.
+
+func (s *Store) load(key string) (string, bool) { // Uncompressed value of key; callers must hold s.mu.
+	v, ok := s.data.Get(key) // Raw or compressed bytes.
+	if !ok {                 // Missing key.
+		return "", false // Nothing to decode.
+	} // End of exists check.
+	return unpack(s.packed, key, v), true // Decoded value.
+} // End of load method.
+
+func unpack(flags map[string]packedValue, key string, stored string) string { // Uncompressed form of key's stored bytes, going by flags.
+	p, packed := flags[key] // Per-key flag.
+	if !packed {            // Stored as-is.
+		return stored // Nothing to decode.
+	} // End of flag check.
+	raw, err := p.codec.Decode(stored) // We wrote these bytes ourselves, so this can only fail on a bug.
+	if err != nil {                    // Corrupt in-memory value.
+		panic(fmt.Sprintf("store: decode %s value of %q: %v", p.codec, key, err)) // Better to crash than serve garbage.
+	} // End of error check.
+	return raw // Decoded value.
+} // End of unpack method.
+
+func (s *Store) save(key string, value string) { // Stores value, compressed if it is big enough; callers must hold s.mu.
+	s.ownPacked()                                              // About to change the flags.
+	s.account(key, -1)                                         // The old value no longer counts.
+	defer s.account(key, 1)                                    // The new one does, whichever way it is stored.
+	s.toggleValue(key)                                         // Takes the old value out of the digest while its flag is still set.
+	defer s.toggleValue(key)                                   // And puts the new one in, before account runs.
+	s.release(key)                                             // The old value no longer holds its shared copy either.
+	delete(s.packed, key)                                      // Start from "stored as-is".
+	s.clearExpiry(key)                                         // Writes without a TTL make the key permanent.
+	if s.codec != compress.None && len(value) >= s.threshold { // Worth trying to compress.
+		if packed := s.codec.Encode(value); len(packed) < len(value) { // Keep it only if it actually saves space.
+			s.data.Set(key, packed)                                         // Store the compressed bytes.
+			s.packed[key] = packedValue{codec: s.codec, rawLen: len(value)} // Flag the key.
+			return                                                          // Done.
+		} // End of size check.
+	} // End of threshold check.
+	s.data.Set(key, s.intern(value)) // Small or incompressible values are stored as they are, shared if interned.
+} // End of save method.
+
+func (s *Store) drop(key string) { // Removes key with its flags and metadata; callers must hold s.mu.
+	s.ownPacked()         // About to change the flags.
+	s.account(key, -1)    // Its namespace holds less.
+	s.toggleValue(key)    // Out of the digest.
+	s.release(key)        // Its shared copy, if it had one.
+	s.data.Delete(key)    // The value.
+	delete(s.packed, key) // Its compression flag.
+	delete(s.meta, key)   // A recreated key starts with fresh metadata.
+	s.clearExpiry(key)    // And doesn't expire unless written with a TTL again.
+} // End of drop method.
+
+func (s *Store) move(src string, dst string) { // Copies src's stored bytes and flag to dst without recompressing; callers must hold s.mu.
+	s.ownPacked()                    // About to change the flags.
+	v, _ := s.data.Get(src)          // Stored bytes, compressed or not.
+	s.account(dst, -1)               // dst's old value no longer counts.
+	s.toggleValue(dst)               // Nor is it in the digest.
+	s.release(dst)                   // Nor does it hold a shared copy.
+	if _, ok := s.packed[src]; !ok { // Stored as-is.
+		v = s.intern(v) // dst shares src's copy, if it is interned.
+	} // End of intern case.
+	s.data.Set(dst, v)              // Same bytes under the new key.
+	s.account(dst, 1)               // Its copy does.
+	s.clearExpiry(dst)              // The destination is permanent, like any write without a TTL.
+	if p, ok := s.packed[src]; ok { // Source is compressed.
+		s.packed[dst] = p // So is the destination.
+	} else { // Source is stored as-is.
+		delete(s.packed, dst) // Clear any flag left from dst's old value.
+	} // End of flag copy.
+	s.toggleValue(dst) // Hashed with its flag in place, so it decodes right.
+} // End of move method.
+
+func (s *Store) ownPacked() { // Copies the flags away from any snapshot before they change; callers must hold s.mu.
+	if s.packedShared { // A snapshot still reads this map.
+		s.packed = maps.Clone(s.packed) // Our own copy.
+		s.packedShared = false          // Until the next snapshot.
+	} // End of shared check.
+} // End of ownPacked method.
+
+func (s *Store) queueSet(key string) <-chan error { // Logs key's current value as a SET; callers must hold s.mu.
+	stored, _ := s.data.Get(key)    // What the engine holds, compressed or not.
+	if p, ok := s.packed[key]; ok { // Compressed values go to the WAL compressed as well.
+		return s.wal.QueueOp("ZSET", key, p.codec.String(), base64.StdEncoding.EncodeToString([]byte(stored))) // Replay decodes it back.
+	} // End of compressed case.
+	return s.wal.QueueEntry(key, stored) // Everything else keeps the plain SET format.
+} // End of queueSet method.
+
+func (s *Store) CompressionStats() CompressionStats { // Totals over the keys held compressed.
+	s.mu.RLock()                                                                                    // Shared lock, this only reads.
+	defer s.mu.RUnlock()                                                                            // Released when the function returns.
+	stats := CompressionStats{Codec: s.codec.String(), Threshold: s.threshold, Keys: len(s.packed)} // Settings and key count.
+	for k, p := range s.packed {                                                                    // Only compressed keys count towards the ratio.
+		stats.RawBytes += int64(p.rawLen)       // Size before compression.
+		stored, _ := s.data.Get(k)              // Compressed bytes.
+		stats.StoredBytes += int64(len(stored)) // Size in memory.
+	} // End of scan.
+	if stats.StoredBytes > 0 { // Avoid dividing by zero.
+		stats.Ratio = float64(stats.RawBytes) / float64(stats.StoredBytes) // e.g. 4.0 means values take a quarter of the space.
+	} // End of ratio check.
+	return stats // Copy for the caller.
+} // End of CompressionStats method.
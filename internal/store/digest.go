@@ -0,0 +1,161 @@
+package store // Rolling digest of the stored state, for spotting replicas that diverged.
+
+import ( // Import block starts here.
+	"context"         // Repairs wait for the WAL like any write.
+	"encoding/binary" // Length-prefixes keys and values so "ab"+"c" and "a"+"bc" hash apart.
+	"fmt"             // Formats digests for the wire and logs.
+	"hash/fnv"        // Fixed hash, so every node puts a key in the same shard.
+	"strconv"         // Formats expiry times for hashing.
+	"strings"         // Splits a formatted digest.
+
+	"github.com/mathdee/KV-Store/internal/wal" // Repairs are logged like a Batch.
+) // Import block ends here.
+
+// The digest is the XOR of a hash of every key's value and of every expiry,
+// kept per shard and updated under s.mu by every change. XOR is its own
+// inverse, so a change takes the old entry out and puts the new one in, and
+// two stores holding the same keys, values and expiries have the same
+// digest however they got there. Values are hashed uncompressed, so nodes
+// with different compression settings still agree; overwriting a compressed
+// value decodes the old one to take it out.
+
+const DigestShards = 16 // Keys are spread over this many shards by a fixed hash, the same on every node.
+
+type Digest [DigestShards]uint64 // One rolling hash per shard.
+
+func (s *Store) Digest() Digest { // Current digest of every shard.
+	s.mu.RLock()         // Shared lock, this only reads.
+	defer s.mu.RUnlock() // Released when the function returns.
+	return s.digest      // Copied by value.
+} // End of Digest method.
+
+func (d Digest) String() string { // Shards as hex, comma separated, what ParseDigest reads.
+	parts := make([]string, len(d)) // One per shard.
+	for i, h := range d {           // Every shard.
+		parts[i] = fmt.Sprintf("%016x", h) // Fixed width.
+	} // End of shard loop.
+	return strings.Join(parts, ",") // No spaces, so it travels as one field.
+} // End of String method.
+
+func ParseDigest(text string) (Digest, error) { // Reads back what Digest.String wrote.
+	var d Digest                      // Filled in shard by shard.
+	parts := strings.Split(text, ",") // One per shard.
+	if len(parts) != DigestShards {   // Another shard count can't be compared.
+		return d, fmt.Errorf("digest has %d shards, expected %d", len(parts), DigestShards) // Caller skips it.
+	} // End of count check.
+	for i, p := range parts { // Every shard.
+		h, err := strconv.ParseUint(p, 16, 64) // Hex, as written.
+		if err != nil {                        // Not ours.
+			return d, fmt.Errorf("digest shard %d: %w", i, err) // Caller skips it.
+		} // End of parse check.
+		d[i] = h // Stored in order.
+	} // End of shard loop.
+	return d, nil // Complete digest.
+} // End of ParseDigest function.
+
+func (d Digest) Diff(other Digest) []int { // Shards whose hashes differ, in order.
+	var shards []int   // Empty when the digests match.
+	for i := range d { // Every shard.
+		if d[i] != other[i] { // Different contents.
+			shards = append(shards, i) // Remember it.
+		} // End of compare.
+	} // End of shard loop.
+	return shards // Nil if equal.
+} // End of Diff method.
+
+func DigestShard(key string) int { // Digest shard key belongs to.
+	h := fnv.New64a()                    // Fixed, unlike the engine's per-process seed.
+	h.Write([]byte(key))                 // The key alone decides.
+	return int(h.Sum64() % DigestShards) // Same on every node.
+} // End of DigestShard function.
+
+func entryHash(kind byte, key string, value string) uint64 { // Hash of one value ('v') or expiry ('x') of key.
+	h := fnv.New64a()                                      // Cheap enough to run on every write.
+	var n [binary.MaxVarintLen64]byte                      // Scratch for the length prefixes.
+	h.Write([]byte{kind})                                  // Values and expiries never cancel out.
+	h.Write(n[:binary.PutUvarint(n[:], uint64(len(key)))]) // Key length.
+	h.Write([]byte(key))                                   // Key.
+	h.Write([]byte(value))                                 // Rest is the value.
+	x := h.Sum64()                                         // FNV alone is close to linear under XOR.
+	x ^= x >> 33                                           // So mix it (murmur3's finalizer).
+	x *= 0xff51afd7ed558ccd                                // Multiply.
+	x ^= x >> 33                                           // Shift.
+	x *= 0xc4ceb9fe1a85ec53                                // Multiply.
+	return x ^ x>>33                                       // Well spread bits.
+} // End of entryHash function.
+
+func (s *Store) toggleValue(key string) { // XORs key's current value in or out of the digest; callers must hold s.mu.
+	if v, ok := s.load(key); ok { // Missing keys contribute nothing.
+		s.digest[DigestShard(key)] ^= entryHash('v', key, v) // In if it wasn't, out if it was.
+	} // End of exists check.
+} // End of toggleValue method.
+
+func (s *Store) toggleExpiry(key string) { // XORs key's current expiry in or out of the digest; callers must hold s.mu.
+	if at, ok := s.expires[key]; ok { // Permanent keys contribute nothing.
+		s.digest[DigestShard(key)] ^= entryHash('x', key, strconv.FormatInt(at, 10)) // In or out, as above.
+	} // End of expiry check.
+} // End of toggleExpiry method.
+
+func (s *Store) rehash() { // Recomputes the digest from scratch; callers must hold s.mu.
+	s.digest = Digest{}                                    // Start from the empty store.
+	s.data.Scan("", func(key string, stored string) bool { // Every stored key.
+		s.digest[DigestShard(key)] ^= entryHash('v', key, unpack(s.packed, key, stored)) // Its value, without reading the engine mid-scan.
+		return true                                                                      // Keep scanning.
+	}) // End of scan.
+	for key := range s.expires { // Every expiry.
+		s.toggleExpiry(key) // Its time.
+	} // End of expiry loop.
+} // End of rehash method.
+
+func (s *Store) RepairShards(ctx context.Context, shards []int, data map[string]string, expires map[string]int64) (int, error) { // Makes the keys of the given digest shards exactly those in data, whose keys in expires expire then; returns how many keys changed.
+	repair := make(map[int]bool, len(shards)) // Shards being replaced.
+	for _, shard := range shards {            // Every shard asked for.
+		repair[shard] = true // Its keys are replaced.
+	} // End of shard loop.
+	return s.RepairRange(ctx, func(key string) bool { return repair[DigestShard(key)] }, data, expires) // The shards are the range.
+} // End of RepairShards method.
+
+func (s *Store) RepairRange(ctx context.Context, in func(key string) bool, data map[string]string, expires map[string]int64) (int, error) { // Makes the keys for which in is true exactly those in data, as RepairShards does for shards.
+	s.mu.Lock()                                       // Nobody sees the range half repaired.
+	var stale []string                                // Keys we hold that data doesn't.
+	s.data.Scan("", func(key string, _ string) bool { // Collected first, the engine can't be changed mid-scan.
+		if _, keep := data[key]; !keep && in(key) { // In the repaired range but not in data.
+			stale = append(stale, key) // Goes.
+		} // End of stale check.
+		return true // Keep scanning.
+	}) // End of scan.
+	var records []string        // WAL records, queued together below.
+	for _, key := range stale { // Every stale key.
+		records = append(records, wal.FormatOp("DEL", key)) // Log the removal.
+		s.drop(key)                                         // Remove it along with its flags and metadata.
+		s.remember(ctx, key, true)                          // A revision, if history is on.
+	} // End of delete loop.
+	changed := len(stale)          // Deletes count as changes.
+	for key, value := range data { // Every key the shards should hold.
+		if !in(key) { // Data outside the range.
+			continue // Left alone.
+		} // End of range check.
+		if old, ok := s.load(key); ok && old == value && s.expires[key] == expires[key] { // Already right, expiry included.
+			continue // Nothing to write.
+		} // End of equality check.
+		s.save(key, value)                                          // Apply to the map, making it permanent.
+		stored, _ := s.data.Get(key)                                // What the engine now holds.
+		records = append(records, setRecord(s.packed, key, stored)) // The record queueSet would log.
+		if at := expires[key]; at != 0 {                            // Written with a TTL.
+			s.setExpiry(key, at)                             // Put the expiry back.
+			records = append(records, expiryRecord(key, at)) // Right after the value.
+		} // End of expiry case.
+		s.touch(ctx, key) // Update (or create) the key's metadata.
+		changed++         // One more key fixed.
+	} // End of write loop.
+	if len(records) == 0 { // Nothing differed.
+		s.mu.Unlock() // Release before returning.
+		return 0, nil // Nothing changed.
+	} // End of empty check.
+	if s.applied >= 0 { // On a raft node, recovery only keeps records an APPLIED marker follows; it repairs between apply batches.
+		records = append(records, appliedRecord(s.applied)) // The index doesn't move, the repair just isn't dropped.
+	} // End of applied case.
+	done := s.wal.QueueBatch(records)   // One unit, so recovery never sees half a repair.
+	s.mu.Unlock()                       // Release before waiting on the group commit.
+	return changed, wal.Wait(ctx, done) // Keys changed, once the repair is durable.
+} // End of RepairRange method.
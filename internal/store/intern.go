@@ -0,0 +1,101 @@
+package store // Interning of small repeated values, such as feature flags and status fields.
+
+import "strings" // Clones a value so the table's copy holds nothing else in memory.
+
+// With interning on, every value up to internMax bytes stored as-is is kept
+// once however many keys hold it: keys share one string, counted so the last
+// key to let it go frees it. The shared copy is cut to size, where a value
+// otherwise remains a slice of the command or WAL line it arrived in, which
+// stays in memory as long as the value does. Compressed values are never
+// interned, the digest and the WAL see the same bytes either way. Neither
+// are values a compact engine keeps inside its entries, which a shared copy
+// would only add to.
+
+type internedValue struct { // One shared value.
+	value string // The copy every key holding it points at.
+	refs  int    // How many keys hold it.
+} // End of internedValue struct.
+
+type InternStats struct { // What /metrics and INFO report about interning.
+	MaxLen     int   `json:"maxLen"`     // Values up to this many bytes are interned, 0 with interning off.
+	Values     int   `json:"values"`     // Distinct values held once.
+	Refs       int64 `json:"refs"`       // Keys holding one of them.
+	Bytes      int64 `json:"bytes"`      // What the distinct values take.
+	SavedBytes int64 `json:"savedBytes"` // What a copy for every key sharing one would take on top.
+} // End of InternStats struct.
+
+func (s *Store) SetInterning(maxLen int) { // Interns values of up to maxLen bytes, 0 turns it off; the values already stored are interned again under the new setting.
+	s.mu.Lock()                  // Every write reads the setting and the table under the lock.
+	defer s.mu.Unlock()          // Released when the function returns.
+	s.internMax = max(maxLen, 0) // Negative means off too.
+	s.resetInterned()            // Counted again from what is stored.
+	if s.internMax == 0 {        // Nothing to intern.
+		return // Stored values keep sharing, untracked, until they are replaced.
+	} // End of off check.
+	var keys []string                                      // Collected first, the engine can't be changed mid-scan.
+	s.data.Scan("", func(key string, stored string) bool { // Every key.
+		if _, packed := s.packed[key]; !packed && s.internable(stored) { // Only values stored as-is, and short enough.
+			keys = append(keys, key) // Interned below.
+		} // End of candidate check.
+		return true // Keep scanning.
+	}) // End of scan.
+	for _, key := range keys { // Same value, same length, so the digest and namespaces don't change.
+		v, _ := s.data.Get(key)      // Stored as-is.
+		s.data.Set(key, s.intern(v)) // Now pointing at the shared copy.
+	} // End of intern loop.
+} // End of SetInterning method.
+
+func (s *Store) resetInterned() { // Forgets every shared value, for when everything is stored again; callers must hold s.mu.
+	s.interned = make(map[string]*internedValue)         // No shared values.
+	s.internRefs, s.internBytes, s.internSaved = 0, 0, 0 // Nothing counted.
+} // End of resetInterned method.
+
+func (s *Store) internable(value string) bool { // Whether value is short enough to intern; callers must hold s.mu.
+	return len(value) > s.inlineMax && len(value) <= s.internMax // The empty string, and values held inline, cost nothing to begin with.
+} // End of internable method.
+
+func (s *Store) intern(value string) string { // The shared copy of value, for a key about to hold it as-is; callers must hold s.mu.
+	if !s.internable(value) { // Off, or too long.
+		return value // Stored as it is.
+	} // End of size check.
+	s.internRefs++                      // One more key holds a shared value.
+	if e, ok := s.interned[value]; ok { // Held by another key already.
+		e.refs++                           // This one too.
+		s.internSaved += int64(len(value)) // The copy it would have had.
+		return e.value                     // Shared.
+	} // End of hit.
+	own := strings.Clone(value)                           // Cut loose from whatever line value is a slice of.
+	s.interned[own] = &internedValue{value: own, refs: 1} // First key to hold it.
+	s.internBytes += int64(len(own))                      // Held once from now on.
+	return own                                            // The copy the table keeps.
+} // End of intern method.
+
+func (s *Store) release(key string) { // Takes key's current value off the table, before it is replaced or dropped; callers must hold s.mu.
+	if len(s.interned) == 0 { // Interning off, or nothing shared yet.
+		return // Nothing to release.
+	} // End of empty check.
+	if _, packed := s.packed[key]; packed { // Compressed values are never interned.
+		return // Nothing to release.
+	} // End of packed check.
+	v, ok := s.data.Get(key)   // What key holds as-is.
+	e, shared := s.interned[v] // Interned when it was stored, if it is short enough.
+	if !ok || !shared {        // Missing key, or a value too long to intern.
+		return // Nothing to release.
+	} // End of lookup.
+	s.internRefs--            // One key fewer.
+	if e.refs--; e.refs > 0 { // Other keys still hold it.
+		s.internSaved -= int64(len(v)) // One copy fewer avoided.
+		return                         // The table keeps it.
+	} // End of shared case.
+	delete(s.interned, v)          // Last key gone.
+	s.internBytes -= int64(len(v)) // Freed.
+} // End of release method.
+
+func (s *Store) InternStats() InternStats { // Totals over the interned values, kept current on every write.
+	s.mu.RLock()         // Shared lock, this only reads.
+	defer s.mu.RUnlock() // Released when the function returns.
+	return InternStats{  // Counted as values came and went.
+		MaxLen: s.internMax, Values: len(s.interned), Refs: s.internRefs, // Setting and sizes.
+		Bytes: s.internBytes, SavedBytes: s.internSaved, // What they take and save.
+	} // End of stats.
+} // End of InternStats method.
@@ -0,0 +1,69 @@
+package store // Walking the keyspace without holding the store lock.
+
+import ( // Import block starts here.
+	"slices"  // Keeps a page's keys sorted as they are collected.
+	"strings" // Prefix matching.
+) // Import block ends here.
+
+// Iterate and IteratePage read from a snapshot, so they see the store as of
+// one instant and never block writers for longer than it takes to take it.
+// Keys whose expiry has passed are skipped, as reads skip them.
+
+type Entry struct { // One key and its uncompressed value.
+	Key   string `json:"key"`   // The key.
+	Value string `json:"value"` // Its value.
+} // End of Entry struct.
+
+type Page struct { // One page of IteratePage.
+	Entries []Entry `json:"entries"`        // In key order.
+	Next    string  `json:"next,omitempty"` // Pass as after for the next page, "" after the last one.
+} // End of Page struct.
+
+func (s *Store) Iterate(prefix string, fn func(k, v string) bool) { // Calls fn with every live key starting with prefix, in no particular order, until fn returns false.
+	snap := s.Snapshot()                                 // Point-in-time view, writers carry on.
+	defer snap.Close()                                   // Writers can stop preserving it afterwards.
+	now := s.clock.Now().UnixMilli()                     // One cutoff for the whole walk.
+	snap.data.Range(func(k string, stored string) bool { // fn may take its time, nothing here holds s.mu.
+		if !strings.HasPrefix(k, prefix) || snap.expiredAt(k, now) { // Not asked for, or already gone to readers.
+			return true // Keep going.
+		} // End of filter.
+		return fn(k, unpack(snap.packed, k, stored)) // Decompressed for the caller.
+	}) // End of range.
+} // End of Iterate method.
+
+func (s *Store) IteratePage(prefix string, after string, limit int) Page { // Up to limit live keys starting with prefix that sort after after, in key order.
+	if limit <= 0 { // Nothing asked for.
+		return Page{} // Empty page, no next.
+	} // End of limit check.
+	var keys []string                                 // The smallest limit+1 matching keys seen so far, sorted; the extra one says there is more.
+	values := map[string]string{}                     // Values of the keys in keys.
+	s.Iterate(prefix, func(k string, v string) bool { // Unordered, so every key is looked at.
+		if k <= after { // Returned on an earlier page.
+			return true // Skip.
+		} // End of cursor check.
+		if len(keys) > limit && k >= keys[limit] { // Can't make this page.
+			return true // Skip.
+		} // End of bound check.
+		i, _ := slices.BinarySearch(keys, k) // Where it goes.
+		keys = slices.Insert(keys, i, k)     // Keep them sorted.
+		values[k] = v                        // Its value, in case it stays.
+		if len(keys) > limit+1 {             // One too many.
+			delete(values, keys[limit+1]) // The largest drops out.
+			keys = keys[:limit+1]         // And its slot.
+		} // End of trim.
+		return true // Keep going.
+	}) // End of iterate.
+	page := Page{Entries: make([]Entry, 0, min(len(keys), limit))} // Exactly the entries returned.
+	for _, k := range keys[:min(len(keys), limit)] {               // The extra key, if any, isn't returned.
+		page.Entries = append(page.Entries, Entry{Key: k, Value: values[k]}) // In key order.
+	} // End of entry loop.
+	if len(keys) > limit { // More keys match.
+		page.Next = keys[limit-1] // The last one returned.
+	} // End of more check.
+	return page // Done.
+} // End of IteratePage method.
+
+func (sn *Snapshot) expiredAt(key string, now int64) bool { // Whether key's expiry had passed by now in unix ms.
+	at, ok := sn.expires[key] // Most keys have none.
+	return ok && at <= now    // Due.
+} // End of expiredAt method.
@@ -0,0 +1,60 @@
+package store // Recent revisions of each key, for HISTORY.
+
+import ( // Import block starts here.
+	"context" // The raft index of a write travels in the context.
+	"slices"  // Trims a key's history to the limit.
+	"time"    // When each revision was applied.
+) // Import block ends here.
+
+// With SetHistory(n) the store keeps the last n revisions of every key it
+// applies a write or a delete to, in memory only: what a node knows starts
+// when it does, and a restarted node that replays the raft log learns the
+// revisions again. Each revision holds a full copy of the value, and a
+// deleted key keeps its history, with the delete, so the cost is up to n
+// values per key ever written. Recovery from the WAL records nothing.
+
+type Revision struct { // One change to a key, see Store.History.
+	Revision int       `json:"revision"`          // Raft index of the write, -1 if it didn't come from the log.
+	Time     time.Time `json:"time"`              // When this node applied it.
+	Value    string    `json:"value,omitempty"`   // The value it left, uncompressed.
+	Deleted  bool      `json:"deleted,omitempty"` // The write removed the key.
+} // End of Revision struct.
+
+func (s *Store) SetHistory(n int) { // Keeps the last n revisions of every key from now on; 0 turns history off and forgets it.
+	s.mu.Lock()         // The write path reads the limit under the lock.
+	defer s.mu.Unlock() // Released when the function returns.
+	s.historyLen = n    // New limit.
+	if n <= 0 {         // Off.
+		s.history = nil // Forget everything.
+		return          // Nothing to trim.
+	} // End of off check.
+	if s.history == nil { // First time on.
+		s.history = make(map[string][]Revision) // Filled as keys are written.
+	} // End of init check.
+	for key, h := range s.history { // A smaller limit applies to what is kept already.
+		if len(h) > n { // Too long now.
+			s.history[key] = slices.Clone(h[len(h)-n:]) // The newest n, on an array of their own.
+		} // End of length check.
+	} // End of trim loop.
+} // End of SetHistory method.
+
+func (s *Store) History(key string) []Revision { // Revisions of key this node kept, oldest first; nil while history is off.
+	s.mu.RLock()                        // Shared lock, this only reads.
+	defer s.mu.RUnlock()                // Released when the function returns.
+	return slices.Clone(s.history[key]) // A copy, later writes append to the original.
+} // End of History method.
+
+func (s *Store) remember(ctx context.Context, key string, deleted bool) { // Adds key's current value, or its deletion, to its history; callers must hold s.mu.
+	if s.historyLen <= 0 { // History is off.
+		return // Nothing to do.
+	} // End of off check.
+	r := Revision{Revision: indexFrom(ctx), Time: s.clock.Now(), Deleted: deleted} // The change.
+	if !deleted {                                                                  // Writes record what they left.
+		r.Value, _ = s.load(key) // Uncompressed copy.
+	} // End of value check.
+	h := append(s.history[key], r) // Newest last.
+	if len(h) > s.historyLen {     // Over the limit.
+		h = slices.Delete(h, 0, len(h)-s.historyLen) // Drop the oldest.
+	} // End of limit check.
+	s.history[key] = h // Kept.
+} // End of remember method.
@@ -0,0 +1,36 @@
+package store // Approximate memory accounting for the store.
+
+// Rough costs of what the store keeps per key besides the engine entry,
+// including the map entry each lives in.
+const ( // Constant block starts here.
+	metaEntryBytes   = 128 // A KeyMeta: two times, an index and a pointer to it.
+	packedEntryBytes = 48  // A compression flag.
+	expiryEntryBytes = 40  // An expiry.
+	internEntryBytes = 64  // An interned value's table entry, besides the value.
+) // Constant block ends here.
+
+type MemoryStats struct { // What /metrics and INFO report about memory the data takes.
+	Keys       int   `json:"keys"`       // Keys in the store.
+	KeyBytes   int64 `json:"keyBytes"`   // Their total length.
+	ValueBytes int64 `json:"valueBytes"` // Total length of the values as stored, so compressed ones count compressed and interned ones once.
+	MetaBytes  int64 `json:"metaBytes"`  // Metadata, compression flags, expiries and the intern table.
+	UsedBytes  int64 `json:"usedBytes"`  // All of it plus the engine's per-key overhead, what a memory budget would be checked against.
+
+	InlineValues int   `json:"inlineValues"` // Values a compact engine keeps inside their entries, see storage.Options.
+	InlineBytes  int64 `json:"inlineBytes"`  // Their length, in ValueBytes but not in UsedBytes as it takes no allocation of its own.
+} // End of MemoryStats struct.
+
+func (s *Store) MemoryStats() MemoryStats { // Kept current on every write, so it is cheap to ask for.
+	s.mu.RLock()                                      // Shared lock, this only reads.
+	defer s.mu.RUnlock()                              // Released when the function returns.
+	u := s.data.Usage()                               // Engines track their keys and values as they change.
+	meta := int64(len(s.meta)) * metaEntryBytes       // Per-key metadata.
+	meta += int64(len(s.packed)) * packedEntryBytes   // Compression flags.
+	meta += int64(len(s.expires)) * expiryEntryBytes  // Expiries.
+	meta += int64(len(s.interned)) * internEntryBytes // Interned values.
+	return MemoryStats{                               // Engine usage plus the store's own.
+		Keys: u.Keys, KeyBytes: u.KeyBytes, ValueBytes: u.ValueBytes - s.internSaved, // The engine counts every key's value, shared or not.
+		MetaBytes: meta, UsedBytes: u.Bytes() - s.internSaved + meta, // All together.
+		InlineValues: u.InlineValues, InlineBytes: u.InlineBytes, // Short values kept in place.
+	} // End of stats.
+} // End of MemoryStats method.
@@ -0,0 +1,49 @@
+package store // Per-key metadata lives next to the data it describes.
+
+import ( // Import block starts here.
+	"context" // The raft index of a write travels in the context.
+	"time"    // Creation and update timestamps.
+) // Import block ends here.
+
+type KeyMeta struct { // What STAT reports about a key.
+	CreatedAt time.Time `json:"createdAt"` // When this node first applied a write that created the key, zero if it came from recovery.
+	UpdatedAt time.Time `json:"updatedAt"` // When this node last applied a write to the key, zero if it came from recovery.
+	RaftIndex int       `json:"raftIndex"` // Log index of the last write to the key, -1 if unknown.
+} // End of KeyMeta struct.
+
+type indexKey struct{} // Private context key type so nobody else can collide with it.
+
+func WithIndex(ctx context.Context, index int) context.Context { // Tags ctx with the raft log index of the write being applied.
+	return context.WithValue(ctx, indexKey{}, index) // Read back by indexFrom when the store records metadata.
+} // End of WithIndex function.
+
+func indexFrom(ctx context.Context) int { // Raft index carried in ctx, -1 for writes that didn't come from the log.
+	if index, ok := ctx.Value(indexKey{}).(int); ok { // Set by WithIndex.
+		return index // Known log position.
+	} // End of lookup.
+	return -1 // Direct store writes (tests, benchmarks) have no index.
+} // End of indexFrom function.
+
+func (s *Store) touch(ctx context.Context, key string) { // Records a write to key; callers must hold s.mu.
+	now := s.clock.Now() // Both timestamps use the same instant on creation.
+	m, ok := s.meta[key] // Existing metadata, if any.
+	if !ok {             // First write to this key.
+		m = &KeyMeta{CreatedAt: now} // Created now.
+		s.meta[key] = m              // Start tracking it.
+	} // End of creation check.
+	m.UpdatedAt = now            // Every write bumps the update time.
+	m.RaftIndex = indexFrom(ctx) // And the log position that produced it.
+	s.remember(ctx, key, false)  // A revision, if history is on.
+} // End of touch method.
+
+func (s *Store) Stat(key string) (KeyMeta, bool) { // Metadata for key, false if the key doesn't exist.
+	s.mu.RLock()                                                        // Shared lock, this only reads.
+	defer s.mu.RUnlock()                                                // Released when the function returns.
+	if _, ok := s.data.Get(key); !ok || s.expired(key, s.clock.Now()) { // Metadata is only reported for live keys.
+		return KeyMeta{}, false // Missing key.
+	} // End of exists check.
+	if m, ok := s.meta[key]; ok { // Written since startup.
+		return *m, true // Copy so the caller can't race later writes.
+	} // End of metadata check.
+	return KeyMeta{RaftIndex: -1}, true // Restored from the WAL, history unknown.
+} // End of Stat method.
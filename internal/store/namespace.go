@@ -0,0 +1,48 @@
+package store // Per-namespace usage, what tenant quotas are checked against.
+
+type NamespaceUsage struct { // Keys and bytes one namespace holds.
+	Keys  int   `json:"keys"`  // Keys in the namespace.
+	Bytes int64 `json:"bytes"` // Their keys plus their values as stored, so compressed ones count compressed.
+} // End of NamespaceUsage struct.
+
+func (s *Store) account(key string, sign int) { // Adds key's current entry to its namespace's usage, or takes it away for sign -1; callers must hold s.mu.
+	v, ok := s.data.Get(key) // Stored bytes, compressed or not.
+	if !ok {                 // Nothing stored, nothing counted.
+		return // Done.
+	} // End of existence check.
+	ns := Namespace(key)                            // Tenant the key belongs to.
+	u := s.namespaces[ns]                           // Zero for a namespace not seen yet.
+	u.Keys += sign                                  // One key more or less.
+	u.Bytes += int64(sign) * int64(len(key)+len(v)) // Its key and value.
+	if u.Keys <= 0 {                                // Last key of the namespace gone.
+		delete(s.namespaces, ns) // Keeps the map to namespaces that hold something.
+		return                   // Done.
+	} // End of empty check.
+	s.namespaces[ns] = u // Updated totals.
+} // End of account method.
+
+func (s *Store) NamespaceUsage(ns string) NamespaceUsage { // What namespace ns holds now, kept current on every write.
+	s.mu.RLock()            // Shared lock, this only reads.
+	defer s.mu.RUnlock()    // Released when the function returns.
+	return s.namespaces[ns] // Zero if it holds nothing.
+} // End of NamespaceUsage method.
+
+func (s *Store) Namespaces() map[string]NamespaceUsage { // Usage of every namespace holding a key, "" for keys without one.
+	s.mu.RLock()                                              // Shared lock, this only reads.
+	defer s.mu.RUnlock()                                      // Released when the function returns.
+	out := make(map[string]NamespaceUsage, len(s.namespaces)) // A copy the caller may keep.
+	for ns, u := range s.namespaces {                         // Every namespace.
+		out[ns] = u // Copied by value.
+	} // End of copy loop.
+	return out // Caller owns it.
+} // End of Namespaces method.
+
+func (s *Store) EntrySize(key string) (int, bool) { // Bytes key counts for in its namespace's usage, false if it doesn't exist.
+	s.mu.RLock()             // Shared lock, this only reads.
+	defer s.mu.RUnlock()     // Released when the function returns.
+	v, ok := s.data.Get(key) // Stored bytes, compressed or not.
+	if !ok {                 // Missing key.
+		return 0, false // Counts for nothing.
+	} // End of existence check.
+	return len(key) + len(v), true // Same as account adds.
+} // End of EntrySize method.
@@ -0,0 +1,122 @@
+package store // Streaming WAL recovery straight into the store.
+
+import ( // Import block starts here.
+	"context" // Callers' deadlines for the marker's group commit.
+	"strconv" // Formats and parses the APPLIED index.
+
+	"github.com/mathdee/KV-Store/internal/wal" // Record parsing and replay.
+) // Import block ends here.
+
+// A raft node follows each batch of entries it applies with an APPLIED
+// marker, so on restart it knows the last entry the WAL holds and raft
+// doesn't apply any of them a second time, which APPEND or SETBIT can't
+// take. Recovery only keeps what a marker follows: records after the last
+// one are from entries raft applies again anyway.
+
+const maxUnmarked = 1 << 16 // Records held back before any marker, past which the log is taken to be one written without raft.
+
+func (s *Store) Recover(filename string, opts wal.RecoverOptions) (wal.RecoverStats, error) { // Replaces everything with what the WAL at filename holds, without building the whole map first.
+	s.mu.Lock()                                                                // Start from an empty store.
+	s.reset()                                                                  // Same as after FLUSHALL.
+	s.applied = -1                                                             // Until a marker says otherwise.
+	s.mu.Unlock()                                                              // Not held while the next chunk is parsed.
+	var held []wal.Record                                                      // Records since the last marker.
+	marked := false                                                            // Whether any marker was seen.
+	stats, err := wal.RecoverInto(filename, opts, func(records []wal.Record) { // Called once per chunk, in log order.
+		s.mu.Lock()                 // One lock per chunk rather than per record.
+		defer s.mu.Unlock()         // Released when the chunk is applied.
+		for _, r := range records { // Every record of the chunk.
+			if index, ok := parseApplied(r); ok { // Everything held so far was applied.
+				s.replay(held)    // Values are compressed under the current settings as they land.
+				held = held[:0]   // Start holding again.
+				s.applied = index // Where raft resumes.
+				marked = true     // From now on the tail is only kept if a marker follows it.
+				continue          // Nothing to replay for the marker itself.
+			} // End of marker case.
+			held = append(held, r)                   // Kept until the next marker.
+			if !marked && len(held) >= maxUnmarked { // No marker so far, don't hold the whole log.
+				s.replay(held)  // Applied as an old log would be.
+				held = held[:0] // Reused.
+			} // End of flush case.
+		} // End of record loop.
+	}) // End of recovery.
+	if !marked { // Written without raft, every record counts.
+		s.mu.Lock()    // Same lock as the chunks.
+		s.replay(held) // The rest of the log.
+		s.mu.Unlock()  // Done.
+	} // End of unmarked case.
+	return stats, err // Records after the last marker, if any, are dropped.
+} // End of Recover method.
+
+func (s *Store) replay(records []wal.Record) { // Applies records in order; callers must hold s.mu.
+	for _, r := range records { // Every record.
+		wal.Replay(recoverState{s}, r) // Same as any replay.
+	} // End of record loop.
+} // End of replay method.
+
+func (s *Store) MarkApplied(ctx context.Context, index int) error { // Logs that raft entries up to index are applied, after their records.
+	s.mu.Lock()                                           // Queued under the lock so it lands after every record before it.
+	s.applied = index                                     // Kept for compaction and Applied.
+	done := s.wal.QueueOp("APPLIED", strconv.Itoa(index)) // The marker recovery looks for.
+	s.mu.Unlock()                                         // Release before waiting on the group commit.
+	return wal.Wait(ctx, done)                            // Once the marker is durable.
+} // End of MarkApplied method.
+
+func (s *Store) Applied() int { // Raft index of the last entry applied, as recovered or marked; -1 if none.
+	s.mu.RLock()         // Shared lock, this only reads.
+	defer s.mu.RUnlock() // Released when the function returns.
+	return s.applied     // Set by Recover and MarkApplied.
+} // End of Applied method.
+
+func appliedRecord(index int) string { // The marker MarkApplied logs, for batches written in one go.
+	return wal.FormatOp("APPLIED", strconv.Itoa(index)) // Same format as QueueOp.
+} // End of appliedRecord function.
+
+func parseApplied(r wal.Record) (int, bool) { // The index of an APPLIED marker, false for any other record.
+	if r.Op != "APPLIED" || len(r.Args) != 1 { // Not a marker.
+		return 0, false // Replayed as usual.
+	} // End of op check.
+	index, err := strconv.Atoi(r.Args[0]) // The last applied index.
+	return index, err == nil              // A malformed marker is ignored.
+} // End of parseApplied function.
+
+func (s *Store) reset() { // Drops every key, flag and bit of metadata; callers must hold s.mu.
+	s.data.Restore(nil)                            // Empty engine.
+	s.packed = make(map[string]packedValue)        // No compressed keys.
+	s.resetInterned()                              // No shared values.
+	s.meta = make(map[string]*KeyMeta)             // Nothing known about any key.
+	s.expires = make(map[string]int64)             // Nothing expires.
+	s.expiresShared = false                        // A fresh map no snapshot holds.
+	s.expiryOrder = nil                            // Nothing scheduled.
+	s.namespaces = make(map[string]NamespaceUsage) // No namespace holds anything.
+	s.digest = Digest{}                            // The empty store's digest.
+} // End of reset method.
+
+type recoverState struct{ s *Store } // wal.State over the store; every method runs with s.mu held.
+
+func (r recoverState) Get(key string) (string, bool) { // Uncompressed current value, for APPEND and friends.
+	return r.s.load(key) // Decodes if needed.
+} // End of Get method.
+
+func (r recoverState) Set(key string, value string) { // Stores a recovered value.
+	r.s.save(key, value) // Compressed if it is big enough.
+} // End of Set method.
+
+func (r recoverState) Delete(key string) { // Removes a key the log deleted.
+	r.s.drop(key) // Value, flag and metadata.
+} // End of Delete method.
+
+func (r recoverState) DeletePrefix(prefix string) { // Removes every key starting with prefix, for FLUSHNS.
+	var keys []string                                     // Collected first, the engine can't be changed mid-scan.
+	r.s.data.Scan(prefix, func(k string, _ string) bool { // Matching keys only.
+		keys = append(keys, k) // Remember it.
+		return true            // Keep scanning.
+	}) // End of scan.
+	for _, k := range keys { // Every matching key.
+		r.s.drop(k) // Remove it.
+	} // End of delete loop.
+} // End of DeletePrefix method.
+
+func (r recoverState) Clear() { // FLUSHALL marker, nothing before it survives.
+	r.s.reset() // Empty store.
+} // End of Clear method.
@@ -0,0 +1,69 @@
+package store // The order keys expire in, see Store.Expired.
+
+import ( // Import block starts here.
+	"container/heap" // The schedule is a min-heap.
+	"time"           // Expired takes the time to compare against.
+) // Import block ends here.
+
+// Every expiry a key is given is also pushed on a min-heap by time, so
+// finding what is due costs about as much as what is due rather than a
+// pass over every expiring key. Entries are never removed when a key is
+// rewritten, made permanent or deleted: the heap only drops an entry once
+// it reaches the top and no longer matches the key's expiry. Writers push
+// under s.mu; Expired takes entries off under the read lock, so it also
+// holds scheduleMu against other callers of Expired.
+
+const scheduleSlack = 1024 // Stale entries tolerated beyond twice the live expiries before the heap is rebuilt.
+
+type scheduled struct { // One expiry on the schedule.
+	key string // The key it was set on.
+	at  int64  // Unix milliseconds.
+} // End of scheduled struct.
+
+type expirySchedule []scheduled // Min-heap by at; implements heap.Interface.
+
+func (q expirySchedule) Len() int           { return len(q) }            // Entries, stale ones included.
+func (q expirySchedule) Less(i, j int) bool { return q[i].at < q[j].at } // Soonest on top.
+func (q expirySchedule) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }  // Moves entries around.
+
+func (q *expirySchedule) Push(x any) { *q = append(*q, x.(scheduled)) } // Used by heap.Push.
+
+func (q *expirySchedule) Pop() any { // Used by heap.Pop.
+	old := *q             // Current entries.
+	e := old[len(old)-1]  // heap.Pop moved the top here.
+	*q = old[:len(old)-1] // Shorter by one.
+	return e              // The entry taken off.
+} // End of Pop method.
+
+func (s *Store) schedule(key string, at int64) { // Puts key's new expiry on the schedule; callers must hold s.mu for writing.
+	heap.Push(&s.expiryOrder, scheduled{key: key, at: at})   // Older entries for key go stale.
+	if len(s.expiryOrder) > 2*len(s.expires)+scheduleSlack { // Mostly stale, e.g. keys whose ttl is refreshed often.
+		s.expiryOrder = s.expiryOrder[:0] // Start again from the live expiries.
+		for k, at := range s.expires {    // One entry each.
+			s.expiryOrder = append(s.expiryOrder, scheduled{key: k, at: at}) // Not in heap order yet.
+		} // End of rebuild loop.
+		heap.Init(&s.expiryOrder) // In order.
+	} // End of rebuild check.
+} // End of schedule method.
+
+func (s *Store) Expired(now time.Time, max int) []Expiry { // Up to max keys whose expiry has passed by now, soonest first, for the leader to expire.
+	s.mu.RLock()                                                                    // Expiries can't change meanwhile.
+	defer s.mu.RUnlock()                                                            // Released when the function returns.
+	s.scheduleMu.Lock()                                                             // The heap changes below.
+	defer s.scheduleMu.Unlock()                                                     // Released when the function returns.
+	cutoff := now.UnixMilli()                                                       // Compared in the stored unit.
+	var due []Expiry                                                                // Collected in expiry order.
+	taken := make(map[string]bool)                                                  // Keys already in due, a key set twice to the same expiry is on the heap twice.
+	for len(s.expiryOrder) > 0 && s.expiryOrder[0].at <= cutoff && len(due) < max { // Due entries, soonest first.
+		e := heap.Pop(&s.expiryOrder).(scheduled)                          // Off the top.
+		if at, ok := s.expires[e.key]; !ok || at != e.at || taken[e.key] { // Stale or a duplicate.
+			continue // Dropped for good.
+		} // End of stale check.
+		due = append(due, Expiry{Key: e.key, At: e.at}) // Remember it.
+		taken[e.key] = true                             // Once only.
+	} // End of due loop.
+	for _, e := range due { // Back on the heap until the expire is applied, in case it never is.
+		heap.Push(&s.expiryOrder, scheduled{key: e.Key, at: e.At}) // Goes stale once the key is gone.
+	} // End of push back loop.
+	return due // Possibly empty.
+} // End of Expired method.
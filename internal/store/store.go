@@ -1,53 +1,402 @@
 package store // Declares this file as part of the 'store' package, making it accessible to other packages that import it.
 
 import ( // Import block starts here, bringing in external packages needed by this file.
-	"errors" // Package for creating and handling error values in Go.
-	"sync"   // Package providing synchronization primitives like mutexes for concurrent programming.
+	"context" // Package for carrying deadlines and trace spans across API boundaries.
+	"errors"  // Package for creating and handling error values in Go.
+	"strconv" // Formats SETBIT arguments for the WAL record.
+	"strings" // Package for string helpers, used to split namespaces off keys.
+	"sync"    // Package providing synchronization primitives like mutexes for concurrent programming.
 
-	"github.com/mathdee/KV-Store/internal/wal" // Imports the WAL (Write-Ahead Log) package from the internal directory to use WAL functionality.
+	"github.com/mathdee/KV-Store/internal/bitmap"   // Bit helpers shared with WAL replay.
+	"github.com/mathdee/KV-Store/internal/clock"    // What reads compare expiries against.
+	"github.com/mathdee/KV-Store/internal/compress" // Codecs for values above the compression threshold.
+	"github.com/mathdee/KV-Store/internal/storage"  // Engines that hold the values themselves.
+	"github.com/mathdee/KV-Store/internal/tracing"  // Tracing helpers, spans are no-ops unless tracing is enabled.
+	"github.com/mathdee/KV-Store/internal/wal"      // Imports the WAL (Write-Ahead Log) package from the internal directory to use WAL functionality.
 ) // Import block ends here.
 
 var ErrorNotFound = errors.New("key not found") // custom error variable to return when key is not found.
 
+const NamespaceSeparator = ":" // Keys like "tenant:key" belong to namespace "tenant".
+
+func Namespace(key string) string { // Returns the namespace of a key, "" if it has none.
+	ns, _, found := strings.Cut(key, NamespaceSeparator) // Everything before the first separator.
+	if !found {                                          // No separator means no namespace.
+		return "" // Key lives in the default namespace.
+	} // End of separator check.
+	return ns // The prefix is the namespace.
+} // End of Namespace function.
+
 type Store struct { //Store struct to store data.
-	mu   sync.RWMutex      // a read-write mutex that allows multiple readers OR a single writer.
-	wal  *wal.WAL          // Pointer (*) to a WAL struct - the * means this field stores the memory address of a WAL instance, not the WAL itself. This allows sharing the same WAL instance across multiple Store instances if needed.
-	data map[string]string // a map of String keys to String values.
+	mu   sync.RWMutex        // a read-write mutex that allows multiple readers OR a single writer.
+	wal  *wal.WAL            // Pointer (*) to a WAL struct - the * means this field stores the memory address of a WAL instance, not the WAL itself. This allows sharing the same WAL instance across multiple Store instances if needed.
+	data storage.Engine      // Where the values live, compressed or not; see the storage package.
+	meta map[string]*KeyMeta // Created/updated/raft index for each key written since startup.
+
+	packed       map[string]packedValue // Keys whose value in data is compressed, and with what.
+	packedShared bool                   // A snapshot holds packed, so it's copied before the next change.
+	codec        compress.Codec         // Codec for new writes, compress.None by default.
+	threshold    int                    // Values shorter than this are never compressed.
+
+	expires       map[string]int64 // Keys written with a TTL and when they expire, see ttl.go.
+	expiresShared bool             // A snapshot holds expires, so it's copied before the next change.
+	expiryOrder   expirySchedule   // Every expiry set, soonest first, see schedule.go.
+	clock         clock.Clock      // Reads judge expiries by it, clock.System unless SetClock is called.
+	scheduleMu    sync.Mutex       // Held by Expired, which changes expiryOrder under the read lock.
+
+	namespaces map[string]NamespaceUsage // Keys and bytes per namespace, see namespace.go.
+	digest     Digest                    // Rolling hash of every value and expiry, see digest.go.
 
+	history    map[string][]Revision // Recent revisions of each key, nil unless SetHistory is called, see keyhistory.go.
+	historyLen int                   // How many revisions of a key history keeps, 0 for none.
+
+	interned    map[string]*internedValue // Values stored once for every key holding them, see intern.go.
+	internMax   int                       // Values up to this long are interned, 0 unless SetInterning is called.
+	internRefs  int64                     // Keys holding an interned value.
+	internBytes int64                     // Bytes of the interned values, each counted once.
+	internSaved int64                     // Bytes the keys sharing them don't take.
+	inlineMax   int                       // Values up to this long live inside the engine's entries, 0 unless it is compact.
+
+	applied int // Raft index of the last entry applied, -1 before any; see MarkApplied.
 } // End of Store struct definition.
 
 func NewStore(w *wal.WAL) *Store { // Constructor function: 'w *wal.WAL' means it takes a pointer to a WAL as a parameter (the * indicates a pointer type). The return type '*Store' means it returns a pointer to a Store instance (not the Store value itself).
-	return &Store{ // The & operator gets the memory address of the newly created Store struct literal, returning a pointer to it. This allows the caller to work with the same Store instance in memory.
-		data: make(map[string]string), //initialize the map with a size of 0 and capacity of 100.
-		wal:  w,                       // Assigns the WAL pointer parameter 'w' to the Store's wal field, storing the memory address of the WAL instance.
-	} // End of struct literal initialization.
+	return NewStoreWithEngine(w, storage.NewMap()) // The plain map engine is the default.
 } // End of NewStore function.
 
-func (s *Store) Set(key string, value string) error { // Method on Store: '(s *Store)' is a pointer receiver - the * means this method receives a pointer to a Store instance, allowing it to modify the Store's fields directly. Returns an error type to indicate success or failure.
-	if err := s.wal.WriteEntry(key, value); err != nil { // Calls WriteEntry on the WAL instance (accessed through the pointer s.wal) and checks if it returned an error.
-		return err // Returns the error immediately if WAL write failed, stopping further execution.
-	} // End of error check block.
+func NewStoreWithEngine(w *wal.WAL, e storage.Engine) *Store { // Store whose values live in e, which should start out empty.
+	s := &Store{ // The & operator gets the memory address of the newly created Store struct literal, returning a pointer to it. This allows the caller to work with the same Store instance in memory.
+		data:       e,                               // Values are kept by the engine.
+		meta:       make(map[string]*KeyMeta),       // Metadata is rebuilt as keys are written.
+		packed:     make(map[string]packedValue),    // Nothing is compressed until SetCompression is called.
+		expires:    make(map[string]int64),          // Nothing expires until written with a TTL.
+		clock:      clock.System,                    // The real time.
+		namespaces: make(map[string]NamespaceUsage), // Nothing stored yet.
+		interned:   make(map[string]*internedValue), // Nothing interned until SetInterning is called.
+		applied:    -1,                              // No raft entry applied yet.
+		wal:        w,                               // Assigns the WAL pointer parameter 'w' to the Store's wal field, storing the memory address of the WAL instance.
+	} // End of struct literal initialization.
+	if storage.Compact(e) { // Short values already cost next to nothing there.
+		s.inlineMax = storage.SmallValueMax // So they are never interned.
+	} // End of compact check.
+	return s // Ready for recovery.
+} // End of NewStoreWithEngine function.
 
-	s.mu.Lock()         // Locks out all readers and writers until finished.
-	s.data[key] = value // Stores the key-value pair in the in-memory map, using the key as the index and value as the stored data.
-	defer s.mu.Unlock() // Defers the unlock operation to execute when the function returns, ensuring the mutex is always released even if an error occurs.
-	return nil          // Returns nil to indicate the operation completed successfully without errors.
+func (s *Store) Set(key string, value string) error { // Method on Store: '(s *Store)' is a pointer receiver - the * means this method receives a pointer to a Store instance, allowing it to modify the Store's fields directly. Returns an error type to indicate success or failure.
+	return s.SetContext(context.Background(), key, value) // Same as SetContext without a caller trace.
 } // End of Set method.
 
+func (s *Store) SetContext(ctx context.Context, key string, value string) error { // Set variant that records the apply (and the WAL wait below it) as spans under ctx.
+	ctx, span := tracing.Start(ctx, "store.apply") // Opens the apply span, ended when the method returns.
+	defer span.End()                               // Ends the span on every return path.
+
+	s.mu.Lock()                // Locks out all readers and writers until finished.
+	s.save(key, value)         // Stores the key-value pair in the in-memory map, compressing it if it is big enough.
+	done := s.queueSet(key)    // Queues the WAL record under the lock so WAL order matches map order.
+	s.touch(ctx, key)          // Record when and from which log entry it changed.
+	s.mu.Unlock()              // Releases the lock before the group commit wait so other writers can join the batch.
+	return wal.Wait(ctx, done) // Only returns nil once the record is on disk.
+} // End of SetContext method.
+
+func (s *Store) SetNX(ctx context.Context, key string, value string) (bool, error) { // Sets key only if it is absent, reports whether it did.
+	s.mu.Lock()                       // Check and set under one lock so no other writer can slip in between.
+	if _, ok := s.data.Get(key); ok { // Key already exists, nothing to write.
+		s.mu.Unlock()     // Release before returning.
+		return false, nil // Not set, no error.
+	} // End of exists check.
+	s.save(key, value)               // Apply to the map.
+	done := s.queueSet(key)          // Log it as a plain SET, replay doesn't need to know it was conditional.
+	s.touch(ctx, key)                // The key is new, so this also sets its creation time.
+	s.mu.Unlock()                    // Release before waiting on the group commit.
+	return true, wal.Wait(ctx, done) // Set, once the record is durable.
+} // End of SetNX method.
+
+func (s *Store) GetSet(ctx context.Context, key string, value string) (string, bool, error) { // Swaps in a new value and returns the old one (and whether there was one).
+	s.mu.Lock()                              // Read and write under one lock so the swap is atomic.
+	old, existed := s.load(key)              // Remember what we are replacing.
+	s.save(key, value)                       // Apply to the map.
+	done := s.queueSet(key)                  // The WAL only needs the new value.
+	s.touch(ctx, key)                        // Update the key's metadata.
+	s.mu.Unlock()                            // Release before waiting on the group commit.
+	return old, existed, wal.Wait(ctx, done) // Old value, once the new one is durable.
+} // End of GetSet method.
+
+func (s *Store) Append(ctx context.Context, key string, value string) (int, error) { // Appends to the value (creating it if missing) and returns the new length.
+	s.mu.Lock()                                 // Read and write under one lock so concurrent appends don't lose data.
+	old, _ := s.load(key)                       // A missing key starts from "".
+	s.save(key, old+value)                      // Recompressed as a whole if it is compressed.
+	done := s.wal.QueueOp("APPEND", key, value) // Log only the suffix, not the whole new value.
+	s.touch(ctx, key)                           // Update (or create) the key's metadata.
+	n := len(old) + len(value)                  // Length to report back to the client.
+	s.mu.Unlock()                               // Release before waiting on the group commit.
+	return n, wal.Wait(ctx, done)               // New length, once the record is durable.
+} // End of Append method.
+
+func (s *Store) Strlen(key string) int { // Length of the value in bytes, 0 for a missing key.
+	s.mu.RLock()                    // Shared lock, this only reads.
+	defer s.mu.RUnlock()            // Released when the function returns.
+	if p, ok := s.packed[key]; ok { // Compressed values know their raw length.
+		return p.rawLen // No need to decode.
+	} // End of compressed check.
+	v, _ := s.data.Get(key) // Missing keys read as "".
+	return len(v)           // Which has length 0.
+} // End of Strlen method.
+
+func (s *Store) SetBit(ctx context.Context, key string, offset int, bit int) (int, error) { // Sets one bit of the value (growing it if needed), returns the old bit.
+	s.mu.Lock()                                                                   // Read and write under one lock so concurrent SETBITs don't lose bits.
+	current, _ := s.load(key)                                                     // A missing key starts as an empty bitmap.
+	value, old := bitmap.Set(current, offset, bit)                                // Flip the bit on a copy.
+	s.save(key, value)                                                            // Apply to the map.
+	done := s.wal.QueueOp("SETBIT", key, strconv.Itoa(offset), strconv.Itoa(bit)) // Log the bit, not the whole value.
+	s.touch(ctx, key)                                                             // Update (or create) the key's metadata.
+	s.mu.Unlock()                                                                 // Release before waiting on the group commit.
+	return old, wal.Wait(ctx, done)                                               // Old bit, once the record is durable.
+} // End of SetBit method.
+
+func (s *Store) GetBit(key string, offset int) int { // Bit at offset, 0 for a missing key or past the end.
+	s.mu.RLock()                     // Shared lock, this only reads.
+	defer s.mu.RUnlock()             // Released when the function returns.
+	value, _ := s.load(key)          // Missing keys read as an empty bitmap.
+	return bitmap.Get(value, offset) // The requested bit.
+} // End of GetBit method.
+
+func (s *Store) BitCount(key string, start int, end int) int { // Set bits in bytes start..end, negative indexes count from the end.
+	s.mu.RLock()                           // Shared lock, this only reads.
+	defer s.mu.RUnlock()                   // Released when the function returns.
+	value, _ := s.load(key)                // Counted under the lock so the value can't change midway.
+	return bitmap.Count(value, start, end) // Number of 1 bits in the range.
+} // End of BitCount method.
+
+func (s *Store) GetDel(ctx context.Context, key string) (string, bool, error) { // Reads and removes a key in one step.
+	s.mu.Lock()            // Read and delete under one lock so nobody sees the value after we took it.
+	val, ok := s.load(key) // The value we hand back.
+	if !ok {               // Nothing to delete.
+		s.mu.Unlock()         // Release before returning.
+		return "", false, nil // Missing key, no error.
+	} // End of exists check.
+	done := s.wal.QueueOp("DEL", key)     // Log the removal.
+	s.drop(key)                           // Remove from the map.
+	s.remember(ctx, key, true)            // A revision, if history is on.
+	s.mu.Unlock()                         // Release before waiting on the group commit.
+	return val, true, wal.Wait(ctx, done) // Old value, once the delete is durable.
+} // End of GetDel method.
+
+func (s *Store) Rename(ctx context.Context, oldKey string, newKey string) (bool, error) { // Moves a value and its expiry to a new key, overwriting it; false if oldKey is missing.
+	s.mu.Lock()                           // Both keys change under one lock.
+	if _, ok := s.data.Get(oldKey); !ok { // Nothing to rename.
+		s.mu.Unlock()     // Release before returning.
+		return false, nil // Missing source, no error.
+	} // End of exists check.
+	records := []string{wal.FormatOp("RENAME", oldKey, newKey)} // Replay moves the value and makes newKey permanent.
+	at, expiring := s.expires[oldKey]                           // A TTL goes with the value.
+	if expiring {                                               // Logged after the rename, in the same unit.
+		records = append(records, expiryRecord(newKey, at)) // So replay puts it back too.
+	} // End of expiry check.
+	done := s.wal.QueueBatch(records) // One unit, so recovery never sees half a rename.
+	s.move(oldKey, newKey)            // Store under the new key, still compressed if it was.
+	s.drop(oldKey)                    // Remove the old key and its metadata.
+	if expiring {                     // move made newKey permanent.
+		s.setExpiry(newKey, at) // Expires when oldKey would have.
+	} // End of expiry case.
+	s.remember(ctx, oldKey, true)    // Gone from under its old name.
+	delete(s.meta, newKey)           // The new key counts as created by the rename.
+	s.touch(ctx, newKey)             // Record the rename as its first write.
+	s.mu.Unlock()                    // Release before waiting on the group commit.
+	return true, wal.Wait(ctx, done) // Renamed, once the record is durable.
+} // End of Rename method.
+
+func (s *Store) Copy(ctx context.Context, src string, dst string, replace bool) (bool, error) { // Copies src to dst; without replace an existing dst is left alone.
+	s.mu.Lock()                         // Read src and write dst under one lock.
+	_, ok := s.data.Get(src)            // Whether there is a value to copy.
+	_, dstExists := s.data.Get(dst)     // Whether we'd overwrite something.
+	if !ok || (dstExists && !replace) { // Missing source, or destination taken.
+		s.mu.Unlock()     // Release before returning.
+		return false, nil // Not copied, no error.
+	} // End of precondition check.
+	done := s.wal.QueueOp("COPY", src, dst) // Log the copy, not the value.
+	s.move(src, dst)                        // Write the destination, still compressed if the source is.
+	s.touch(ctx, dst)                       // Only the destination changed.
+	s.mu.Unlock()                           // Release before waiting on the group commit.
+	return true, wal.Wait(ctx, done)        // Copied, once the record is durable.
+} // End of Copy method.
+
+func (s *Store) FlushAll(ctx context.Context) (int, error) { // Removes every key, returns how many there were.
+	s.mu.Lock()                       // Nobody reads or writes while the map is swapped.
+	n := s.data.Len()                 // Count before clearing.
+	done := s.wal.QueueOp("FLUSHALL") // Truncation marker, replay drops everything before it.
+	if s.historyLen > 0 {             // Every key's history records the flush.
+		s.data.Scan("", func(k string, _ string) bool { // Each key still there.
+			s.remember(ctx, k, true) // Deleted by the flush.
+			return true              // Keep scanning.
+		}) // End of scan.
+	} // End of history check.
+	s.reset()                     // Start over with an empty engine, no flags and no metadata.
+	s.mu.Unlock()                 // Release before waiting on the group commit.
+	return n, wal.Wait(ctx, done) // Number removed, once the marker is durable.
+} // End of FlushAll method.
+
+func (s *Store) FlushNamespace(ctx context.Context, ns string) (int, error) { // Removes every key in namespace ns, returns how many.
+	s.mu.Lock()                                                        // Scan and delete under one lock.
+	var keys []string                                                  // Collected first, the engine can't be changed mid-scan.
+	s.data.Scan(ns+NamespaceSeparator, func(k string, _ string) bool { // Keys in ns start with "ns:".
+		keys = append(keys, k) // Remember it.
+		return true            // Keep scanning.
+	}) // End of scan.
+	for _, k := range keys { // Every key of this namespace.
+		s.drop(k)                // Remove it along with its flags and metadata.
+		s.remember(ctx, k, true) // A revision, if history is on.
+	} // End of delete loop.
+	n := len(keys)                       // Number of keys removed.
+	done := s.wal.QueueOp("FLUSHNS", ns) // One marker for the whole namespace.
+	s.mu.Unlock()                        // Release before waiting on the group commit.
+	return n, wal.Wait(ctx, done)        // Number removed, once the marker is durable.
+} // End of FlushNamespace method.
+
+type BatchOp struct { // One write of a Batch.
+	Delete    bool   // Removes Key instead of setting it.
+	Key       string // The key written.
+	Value     string // New value, unused by deletes.
+	ExpiresAt int64  // Puts: when the key expires in unix ms, 0 for never. Deletes: only if the key still expires then, 0 for always.
+	IfAbsent  bool   // Puts: only if the key doesn't exist, expired or not.
+} // End of BatchOp struct definition.
+
+func (s *Store) Batch(ctx context.Context, ops []BatchOp) ([]bool, error) { // Applies ops in order as one write, reports for each whether its key existed just before it.
+	s.mu.Lock()                        // Nobody sees the batch half applied.
+	existed, done := s.batch(ctx, ops) // Applied and queued as one WAL unit.
+	s.mu.Unlock()                      // Release before waiting on the group commit.
+	if done == nil {                   // Nothing changed, nothing to log.
+		return existed, nil // Answers, no error.
+	} // End of empty check.
+	return existed, wal.Wait(ctx, done) // Answers, once the whole batch is durable.
+} // End of Batch method.
+
+func (s *Store) batch(ctx context.Context, ops []BatchOp) ([]bool, <-chan error) { // Batch without the locking or the wait, nil for done if nothing changed; callers must hold s.mu.
+	existed := make([]bool, len(ops))      // One answer per op.
+	records := make([]string, 0, len(ops)) // WAL records, queued together below.
+	for i, op := range ops {               // In order, so later ops see earlier ones.
+		_, existed[i] = s.data.Get(op.Key) // Whether this op replaces or removes something.
+		if op.Delete {                     // Removal.
+			if op.ExpiresAt != 0 && s.expires[op.Key] != op.ExpiresAt { // An expire the key outlived by being rewritten.
+				continue // Left alone.
+			} // End of expiry check.
+			if existed[i] { // Deleting a missing key changes nothing.
+				records = append(records, wal.FormatOp("DEL", op.Key)) // Log the removal.
+				s.drop(op.Key)                                         // Remove it along with its flags and metadata.
+				s.remember(ctx, op.Key, true)                          // A revision, if history is on.
+			} // End of exists check.
+			continue // Next op.
+		} // End of delete case.
+		if op.IfAbsent && existed[i] { // Someone wrote the key first.
+			continue // Their value stays.
+		} // End of absent check.
+		s.save(op.Key, op.Value)                                       // Apply to the map, compressing it if it is big enough.
+		stored, _ := s.data.Get(op.Key)                                // What the engine now holds.
+		records = append(records, setRecord(s.packed, op.Key, stored)) // The record queueSet would log.
+		if op.ExpiresAt != 0 {                                         // Written with a TTL.
+			s.setExpiry(op.Key, op.ExpiresAt)                             // save made it permanent, this puts the expiry back.
+			records = append(records, expiryRecord(op.Key, op.ExpiresAt)) // Right after the value, in the same unit.
+		} // End of expiry case.
+		s.touch(ctx, op.Key) // Update (or create) the key's metadata.
+	} // End of op loop.
+	if len(records) == 0 { // Nothing changed, nothing to log.
+		return existed, nil // Answers, nothing to wait for.
+	} // End of empty check.
+	return existed, s.wal.QueueBatch(records) // One unit, so recovery never sees half a batch.
+} // End of batch method.
+
+func (s *Store) Len() int { // Number of keys in the store.
+	s.mu.RLock()         // Shared lock, this only reads.
+	defer s.mu.RUnlock() // Released when the function returns.
+	return s.data.Len()  // One entry per key.
+} // End of Len method.
+
 func (s *Store) Get(key string) (string, error) { //Get method to find a value by its key.
 
 	s.mu.RLock()         //lock mutex when reading the data.
 	defer s.mu.RUnlock() // unlock mutex when the function returns.
 
-	val, ok := s.data[key] //this check if the key exists in the map.
-	if !ok {               // and if the key does not exist it return ErrorNotFound.
+	val, ok := s.load(key)                    //this check if the key exists in the map, decompressing the value if needed.
+	if !ok || s.expired(key, s.clock.Now()) { // and if the key does not exist (or has expired) it return ErrorNotFound.
 		return "", ErrorNotFound // if not exist, return empty string and ErrorNotFound.
 	} // End of error check block.
 	return val, nil // if key exists, returns value and nil error.
 } // End of Get method.
 
+type Snapshot struct { // Point-in-time view of the store, see Store.Snapshot.
+	data    storage.Snapshot       // Stored values as of the snapshot.
+	packed  map[string]packedValue // Compression flags as of the snapshot, shared until the store next changes them.
+	expires map[string]int64       // Expiries as of the snapshot, shared the same way.
+	applied int                    // Raft index applied as of the snapshot, -1 if none.
+} // End of Snapshot struct.
+
+func (s *Store) Snapshot() *Snapshot { // Consistent view of every key; writers carry on while it is read.
+	s.mu.Lock()         // Exclusive, but only for as long as it takes to mark things shared.
+	defer s.mu.Unlock() // Released when the function returns.
+	return s.snapshot() // Nothing is copied up front.
+} // End of Snapshot method.
+
+func (s *Store) snapshot() *Snapshot { // Shares the current state with a new snapshot; callers must hold s.mu exclusively.
+	s.packedShared = true                                                                               // The next flag change copies the map first.
+	s.expiresShared = true                                                                              // Same for the next expiry change.
+	return &Snapshot{data: s.data.Snapshot(), packed: s.packed, expires: s.expires, applied: s.applied} // Engine snapshots are copy-on-write too.
+} // End of snapshot method.
+
+func (sn *Snapshot) Len() int { // Number of keys in the snapshot.
+	return sn.data.Len() // Fixed when the snapshot was taken.
+} // End of Len method.
+
+func (sn *Snapshot) Range(fn func(key string, value string) bool) { // Calls fn with every key and its uncompressed value until fn returns false.
+	sn.data.Range(func(key string, stored string) bool { // No store lock needed, nothing here changes.
+		return fn(key, unpack(sn.packed, key, stored)) // Decompressed, so the receiver can use its own settings.
+	}) // End of range.
+} // End of Range method.
+
+func (sn *Snapshot) Expiry(key string) int64 { // When key expires in unix ms, 0 if it doesn't.
+	return sn.expires[key] // Missing means permanent.
+} // End of Expiry method.
+
+func (sn *Snapshot) Close() { // Releases the snapshot so writers stop preserving it.
+	sn.data.Close() // The engine may go back to writing in place.
+} // End of Close method.
+
+func (s *Store) InstallSnapshot(ctx context.Context, data map[string]string, expires map[string]int64) error { // Replaces everything with data, whose keys in expires expire then, and makes it durable.
+	s.mu.Lock()                                                // Nobody reads or writes while the state is swapped.
+	pending := []<-chan error{s.wal.QueueOp("FLUSHALL")}       // Truncation marker, then the snapshot as plain SETs.
+	s.data.Restore(nil)                                        // Empty engine.
+	s.packed = make(map[string]packedValue)                    // No compressed keys yet.
+	s.resetInterned()                                          // Nor shared values.
+	s.meta = make(map[string]*KeyMeta)                         // History before the snapshot is unknown.
+	s.expires, s.expiresShared = make(map[string]int64), false // Only the snapshot's expiries from now on.
+	s.expiryOrder = nil                                        // Scheduled again as they land.
+	s.namespaces = make(map[string]NamespaceUsage)             // Counted again as the snapshot's keys land.
+	s.digest = Digest{}                                        // Hashed again the same way.
+	for k, v := range data {                                   // Every key in the snapshot.
+		s.save(k, v)                             // Compressed under our own settings.
+		pending = append(pending, s.queueSet(k)) // Logged after the marker, so replay rebuilds the snapshot.
+		if at, ok := expires[k]; ok {            // Written with a TTL.
+			s.setExpiry(k, at)                                                                 // Keeps the leader's expiry.
+			pending = append(pending, s.wal.QueueOp("EXPIREAT", k, strconv.FormatInt(at, 10))) // After its value.
+		} // End of expiry case.
+	} // End of install loop.
+	s.mu.Unlock()                  // Release before waiting on the group commits.
+	for _, done := range pending { // The records may span several group commits.
+		if err := wal.Wait(ctx, done); err != nil { // Any failed batch means the snapshot isn't durable.
+			return err // Caller reports the install as failed.
+		} // End of error check.
+	} // End of wait loop.
+	return nil // Everything is on disk.
+} // End of InstallSnapshot method.
+
 func (s *Store) Restore(data map[string]string) { // Method with pointer receiver '(s *Store)' - allows modifying the Store's data field directly through the pointer.
-	s.mu.Lock()         // Acquires an exclusive write lock on the mutex to prevent other goroutines from reading or writing while we modify the data.
-	defer s.mu.Unlock() // Ensures the mutex is unlocked when the function exits, even if an error occurs.
-	s.data = data       // Replaces the entire data map with the provided map, restoring the Store's state from the WAL recovery process.
+	s.mu.Lock()                                    // Acquires an exclusive write lock on the mutex to prevent other goroutines from reading or writing while we modify the data.
+	defer s.mu.Unlock()                            // Ensures the mutex is unlocked when the function exits, even if an error occurs.
+	s.data.Restore(nil)                            // Empty engine, the recovered values are uncompressed.
+	s.packed = make(map[string]packedValue)        // Flags are rebuilt by save under the current settings.
+	s.resetInterned()                              // So is the intern table.
+	s.namespaces = make(map[string]NamespaceUsage) // Counted again as the keys land.
+	for k, v := range data {                       // Restoring the Store's state from the WAL recovery process.
+		s.save(k, v) // Compresses the value again if it is big enough.
+	} // End of restore loop.
+	s.rehash()                         // Expiries outlive a Restore, so the digest is recomputed as a whole.
+	s.meta = make(map[string]*KeyMeta) // The WAL doesn't keep metadata, Stat reports restored keys as unknown.
 } // End of Restore method.
@@ -1,10 +1,17 @@
 package store // Declares this file as part of the 'store' package, allowing it to test the store package's functionality.
 
 import ( // Import block starts here, bringing in external packages needed for testing.
+	"context" // Package for the context arguments of the store API.
+	"errors"  // The error a failing transaction returns.
 	"os"      // Package for operating system interface functions, used here to remove test files.
+	"strings" // Builds large values for the compression test.
 	"testing" // Package providing testing support and the testing.T type for writing test functions.
+	"time"    // Expiry times for the TTL test.
 
-	"github.com/mathdee/KV-Store/internal/wal" // Imports the WAL package to test integration between Store and WAL functionality.
+	"github.com/mathdee/KV-Store/internal/clock"
+	"github.com/mathdee/KV-Store/internal/compress" // Codecs for the compression test.
+	"github.com/mathdee/KV-Store/internal/storage"  // The compact engine for the small values test.
+	"github.com/mathdee/KV-Store/internal/wal"      // Imports the WAL package to test integration between Store and WAL functionality.
 ) // Import block ends here.
 
 func TestStore(t *testing.T) { // Test function: 't *testing.T' is a pointer to a testing.T struct - the * means we receive a pointer, allowing the test framework to track test state and report failures.
@@ -71,3 +78,1002 @@ func TestStore(t *testing.T) { // Test function: 't *testing.T' is a pointer to
 // 		t.Errorf("Expected ErrorNotFound, got %v", err)
 // 	}
 // }
+
+func TestSetNXAndGetSet(t *testing.T) { // Checks the conditional and swapping writes.
+	filename := "test_wal_setnx.log" // Separate WAL file so it doesn't clash with TestStore.
+	os.Remove(filename)              // clean up previous runs
+	defer os.Remove(filename)        // always clean up after test is run.
+
+	w, err := wal.NewWAL(filename) // Fresh WAL for this test.
+	if err != nil {                // Stop if the WAL couldn't be created.
+		t.Fatalf("Failed to create WAL: %v", err)
+	} // End of error check block.
+	defer w.Close() // Close the WAL when the test finishes.
+	s := NewStore(w)
+	ctx := context.Background() // No tracing needed in tests.
+
+	if set, err := s.SetNX(ctx, "lock", "a"); err != nil || !set { // First SETNX on a missing key must win.
+		t.Fatalf("Expected first SETNX to set, got %v %v", set, err)
+	} // End of first SETNX check.
+	if set, _ := s.SetNX(ctx, "lock", "b"); set { // Second SETNX must not overwrite.
+		t.Errorf("Expected second SETNX to be refused")
+	} // End of second SETNX check.
+
+	old, existed, err := s.GetSet(ctx, "lock", "c") // Swap in a new value.
+	if err != nil || !existed || old != "a" {       // Old value must be the one SETNX wrote.
+		t.Errorf("Expected GETSET to return a, got %q %v %v", old, existed, err)
+	} // End of GETSET check.
+	if val, _ := s.Get("lock"); val != "c" { // New value must be visible.
+		t.Errorf("Expected c after GETSET, got %s", val)
+	} // End of value check.
+} // End of TestSetNXAndGetSet function.
+
+func TestGetDelRenameCopy(t *testing.T) { // Checks the moving writes on missing and existing keys, and that replay ends up where they left the store.
+	filename := "test_wal_moves.log" // Separate WAL file so it doesn't clash with the other tests.
+	os.Remove(filename)              // clean up previous runs
+	defer os.Remove(filename)        // always clean up after test is run.
+
+	w, err := wal.NewWAL(filename) // Fresh WAL for this test.
+	if err != nil {                // Stop if the WAL couldn't be created.
+		t.Fatalf("Failed to create WAL: %v", err)
+	} // End of error check block.
+	s := NewStore(w)
+	ctx := context.Background() // No tracing needed in tests.
+
+	if v, ok, err := s.GetDel(ctx, "missing"); v != "" || ok || err != nil { // Nothing to take.
+		t.Errorf("Expected GETDEL of a missing key to find nothing, got %q %v %v", v, ok, err)
+	} // End of missing getdel check.
+	if ok, err := s.Rename(ctx, "missing", "dst"); ok || err != nil { // Nothing to move.
+		t.Errorf("Expected RENAME of a missing key to refuse, got %v %v", ok, err)
+	} // End of missing rename check.
+	if ok, err := s.Copy(ctx, "missing", "dst", true); ok || err != nil { // Nothing to copy, even with REPLACE.
+		t.Errorf("Expected COPY of a missing key to refuse, got %v %v", ok, err)
+	} // End of missing copy check.
+	if s.Len() != 0 { // None of them created anything.
+		t.Fatalf("Expected no keys after the refused writes, got %d", s.Len())
+	} // End of count check.
+
+	s.Set("taken", "t")
+	if v, ok, _ := s.GetDel(ctx, "taken"); v != "t" || !ok { // The value on its way out.
+		t.Errorf("Expected GETDEL to hand back t, got %q %v", v, ok)
+	} // End of getdel check.
+	if _, err := s.Get("taken"); err != ErrorNotFound { // And gone.
+		t.Errorf("Expected taken to be gone after GETDEL, got %v", err)
+	} // End of gone check.
+
+	s.Set("src", "a")
+	s.Set("dst", "b")
+	if ok, _ := s.Copy(ctx, "src", "dst", false); ok { // dst is taken.
+		t.Errorf("Expected COPY without REPLACE to leave an existing key alone")
+	} // End of no-replace check.
+	if v, _ := s.Get("dst"); v != "b" { // Still its own value.
+		t.Errorf("Expected dst=b after the refused COPY, got %q", v)
+	} // End of no-replace value check.
+	if ok, _ := s.Copy(ctx, "src", "dst", true); !ok { // Overwrites.
+		t.Errorf("Expected COPY with REPLACE to overwrite dst")
+	} // End of replace check.
+	if src, _ := s.Get("src"); src != "a" { // The source stays.
+		t.Errorf("Expected src to stay after a COPY, got %q", src)
+	} // End of source check.
+	if dst, _ := s.Get("dst"); dst != "a" { // The destination has its value.
+		t.Errorf("Expected dst=a after COPY REPLACE, got %q", dst)
+	} // End of replace value check.
+
+	later := time.Now().Add(time.Hour).UnixMilli() // Far enough out not to pass during the test.
+	s.Batch(ctx, []BatchOp{{Key: "session", Value: "s1", ExpiresAt: later}})
+	if ok, _ := s.Rename(ctx, "session", "dst"); !ok { // Onto an existing key.
+		t.Fatalf("Expected RENAME to move session onto dst")
+	} // End of rename check.
+	if at, ok := s.ExpiresAt("dst"); !ok || at.UnixMilli() != later { // The TTL went with the value.
+		t.Errorf("Expected dst to expire at %d after the RENAME, got %v %v", later, at, ok)
+	} // End of rename expiry check.
+	if _, ok := s.ExpiresAt("session"); ok { // Nothing left under the old name.
+		t.Errorf("Expected session to have no expiry after the RENAME")
+	} // End of old expiry check.
+	if due := s.Expired(time.UnixMilli(later), 10); len(due) != 1 || due[0].Key != "dst" { // Expires under its new name.
+		t.Errorf("Expected only dst to be due at the expiry, got %v", due)
+	} // End of due check.
+	if v, _ := s.Get("dst"); v != "s1" || s.Len() != 2 { // src and the renamed dst.
+		t.Errorf("Expected dst=s1 and 2 keys after the RENAME, got %q and %d", v, s.Len())
+	} // End of rename value check.
+	want := s.Digest() // What replay must end up with.
+	w.Close()          // simulates server shutdown
+
+	w2, err := wal.NewWAL(filename) // Reopened as on restart.
+	if err != nil {
+		t.Fatalf("Failed to reopen WAL: %v", err)
+	} // End of error check block.
+	defer w2.Close()
+	r := NewStore(w2)
+	if _, err := r.Recover(filename, wal.RecoverOptions{}); err != nil { // Stop if recovery failed.
+		t.Fatalf("Failed to recover: %v", err)
+	} // End of error check block.
+	if got := r.Digest(); got != want { // Same keys, values and expiries.
+		t.Errorf("Expected the digest %v after recovery, got %v", want, got)
+	} // End of digest check.
+	if at, ok := r.ExpiresAt("dst"); !ok || at.UnixMilli() != later { // The renamed key's TTL was logged with it.
+		t.Errorf("Expected dst to still expire at %d after recovery, got %v %v", later, at, ok)
+	} // End of recovered expiry check.
+	if v, _ := r.Get("src"); v != "a" || r.Len() != 2 { // The copy's source and nothing GETDEL took.
+		t.Errorf("Expected src=a and 2 keys after recovery, got %q and %d", v, r.Len())
+	} // End of recovered value check.
+} // End of TestGetDelRenameCopy function.
+
+func TestStat(t *testing.T) { // Checks per-key metadata across writes and renames.
+	filename := "test_wal_stat.log" // Separate WAL file so it doesn't clash with the other tests.
+	os.Remove(filename)             // clean up previous runs
+	defer os.Remove(filename)       // always clean up after test is run.
+
+	w, err := wal.NewWAL(filename) // Fresh WAL for this test.
+	if err != nil {                // Stop if the WAL couldn't be created.
+		t.Fatalf("Failed to create WAL: %v", err)
+	} // End of error check block.
+	defer w.Close() // Close the WAL when the test finishes.
+	s := NewStore(w)
+
+	s.SetContext(WithIndex(context.Background(), 3), "k", "v1")  // First write at log index 3.
+	first, ok := s.Stat("k")                                     // Metadata after creation.
+	if !ok || first.RaftIndex != 3 || first.CreatedAt.IsZero() { // Must have an index and a creation time.
+		t.Fatalf("Expected metadata at index 3, got %+v %v", first, ok)
+	} // End of creation check.
+
+	s.Append(WithIndex(context.Background(), 7), "k", "v2") // Later write at index 7.
+	second, _ := s.Stat("k")                                // Metadata after the update.
+	if second.RaftIndex != 7 || !second.CreatedAt.Equal(first.CreatedAt) || second.UpdatedAt.Before(first.UpdatedAt) {
+		t.Errorf("Expected update at index 7 keeping the creation time, got %+v", second)
+	} // End of update check.
+
+	s.Rename(context.Background(), "k", "k2") // Rename without a log index.
+	if _, ok := s.Stat("k"); ok {             // The old key is gone.
+		t.Errorf("Expected no metadata for renamed-away key")
+	} // End of old key check.
+	if m, _ := s.Stat("k2"); m.RaftIndex != -1 { // Writes outside the log have no index.
+		t.Errorf("Expected index -1 for a direct write, got %d", m.RaftIndex)
+	} // End of new key check.
+} // End of TestStat function.
+
+func TestCompression(t *testing.T) { // Checks compressed values read back and survive recovery.
+	filename := "test_wal_compress.log" // Separate WAL file so it doesn't clash with the other tests.
+	os.Remove(filename)                 // clean up previous runs
+	defer os.Remove(filename)           // always clean up after test is run.
+
+	w, err := wal.NewWAL(filename) // Fresh WAL for this test.
+	if err != nil {                // Stop if the WAL couldn't be created.
+		t.Fatalf("Failed to create WAL: %v", err)
+	} // End of error check block.
+	s := NewStore(w)
+	s.SetCompression(compress.Zstd, 64) // Compress anything of 64 bytes or more.
+
+	big := strings.Repeat("abcdef", 100)        // 600 very compressible bytes.
+	s.Set("big", big)                           // Stored compressed.
+	s.Set("small", "tiny")                      // Below the threshold, stored as-is.
+	s.Append(context.Background(), "big", "!")  // Appending to a compressed value.
+	if val, _ := s.Get("big"); val != big+"!" { // Reads must decode transparently.
+		t.Fatalf("Expected the appended value back, got %d bytes", len(val))
+	} // End of value check.
+	if n := s.Strlen("big"); n != len(big)+1 { // Length is of the uncompressed value.
+		t.Errorf("Expected STRLEN %d, got %d", len(big)+1, n)
+	} // End of length check.
+	if stats := s.CompressionStats(); stats.Keys != 1 || stats.Ratio <= 1 { // Only "big" is compressed, and it got smaller.
+		t.Errorf("Expected one compressed key with ratio > 1, got %+v", stats)
+	} // End of stats check.
+	w.Close() // Flush the WAL before recovering from it.
+
+	data, err := wal.Recover(filename) // Replays the compressed SET record.
+	if err != nil {                    // Stop if recovery failed.
+		t.Fatalf("Failed to recover: %v", err)
+	} // End of error check block.
+	if data["big"] != big+"!" || data["small"] != "tiny" { // Recovery returns plain values.
+		t.Errorf("Expected recovered values to match, got %d and %q", len(data["big"]), data["small"])
+	} // End of recovery check.
+} // End of TestCompression function.
+
+func TestSnapshotIsPointInTime(t *testing.T) { // Checks a snapshot keeps its values while the store moves on.
+	filename := "test_wal_snapshot.log" // Separate WAL file so it doesn't clash with the other tests.
+	os.Remove(filename)                 // clean up previous runs
+	defer os.Remove(filename)           // always clean up after test is run.
+
+	w, err := wal.NewWAL(filename) // Fresh WAL for this test.
+	if err != nil {                // Stop if the WAL couldn't be created.
+		t.Fatalf("Failed to create WAL: %v", err)
+	} // End of error check block.
+	defer w.Close()
+	s := NewStore(w)
+	s.SetCompression(compress.Zstd, 64) // Compress anything of 64 bytes or more.
+
+	big := strings.Repeat("abcdef", 100) // Stored compressed.
+	s.Set("big", big)
+	s.Set("small", "tiny")
+	snap := s.Snapshot() // Taken before any of the changes below.
+	defer snap.Close()
+
+	s.Set("big", "now small")                // Same key, no longer compressed.
+	s.Set("small", strings.Repeat("x", 200)) // Same key, now compressed.
+	s.Set("new", "added")                    // Not in the snapshot.
+
+	got := make(map[string]string) // What the snapshot holds.
+	snap.Range(func(key, value string) bool {
+		got[key] = value
+		return true
+	}) // End of range.
+	if snap.Len() != 2 || len(got) != 2 { // The later key must not show up.
+		t.Fatalf("Expected 2 keys in the snapshot, got Len %d and %d ranged", snap.Len(), len(got))
+	} // End of count check.
+	if got["big"] != big || got["small"] != "tiny" { // Values decode with the flags they had at the time.
+		t.Errorf("Expected the old values, got %d bytes and %q", len(got["big"]), got["small"])
+	} // End of value check.
+	if val, _ := s.Get("big"); val != "now small" { // The store itself has moved on.
+		t.Errorf("Expected the new value in the store, got %q", val)
+	} // End of store check.
+} // End of TestSnapshotIsPointInTime function.
+
+func TestRecoverStreamsIntoStore(t *testing.T) { // Checks Recover rebuilds the store, compressed values included.
+	filename := "test_wal_recover.log" // Separate WAL file so it doesn't clash with the other tests.
+	os.Remove(filename)                // clean up previous runs
+	defer os.Remove(filename)          // always clean up after test is run.
+
+	w, err := wal.NewWAL(filename) // Fresh WAL for this test.
+	if err != nil {                // Stop if the WAL couldn't be created.
+		t.Fatalf("Failed to create WAL: %v", err)
+	} // End of error check block.
+	s := NewStore(w)
+	s.SetCompression(compress.Zstd, 64) // Logged as ZSET records.
+	big := strings.Repeat("abcdef", 100)
+	s.Set("big", big)
+	s.Set("ns:a", "1")
+	s.Set("ns:b", "2")
+	s.FlushNamespace(context.Background(), "ns") // Replayed through DeletePrefix.
+	s.Set("kept", "yes")
+	w.Close() // Flush the WAL before recovering from it.
+
+	w2, err := wal.NewWAL(filename) // Reopened as on restart.
+	if err != nil {
+		t.Fatalf("Failed to reopen WAL: %v", err)
+	} // End of error check block.
+	defer w2.Close()
+	r := NewStore(w2)
+	r.SetCompression(compress.Zstd, 64) // Recovered values get compressed again.
+	stats, err := r.Recover(filename, wal.RecoverOptions{ChunkBytes: 128, Workers: 2})
+	if err != nil { // Stop if recovery failed.
+		t.Fatalf("Failed to recover: %v", err)
+	} // End of error check block.
+	if r.Len() != 2 || stats.Records != 5 { // big and kept; five records were logged.
+		t.Fatalf("Expected 2 keys from 5 records, got %d keys from %+v", r.Len(), stats)
+	} // End of count check.
+	if val, _ := r.Get("big"); val != big { // Decoded on the way in, compressed again in the store.
+		t.Errorf("Expected the big value back, got %d bytes", len(val))
+	} // End of value check.
+	if stats := r.CompressionStats(); stats.Keys != 1 { // Only "big" is compressed.
+		t.Errorf("Expected one compressed key after recovery, got %+v", stats)
+	} // End of stats check.
+} // End of TestRecoverStreamsIntoStore function.
+
+func TestRecoverAfterFlushes(t *testing.T) { // Checks only what was written after a FLUSHALL or FLUSHNS survives replay, one chunk or many.
+	filename := "test_wal_flushes.log" // Separate WAL file so it doesn't clash with the other tests.
+	os.Remove(filename)                // clean up previous runs
+	defer os.Remove(filename)          // always clean up after test is run.
+
+	w, err := wal.NewWAL(filename) // Fresh WAL for this test.
+	if err != nil {                // Stop if the WAL couldn't be created.
+		t.Fatalf("Failed to create WAL: %v", err)
+	} // End of error check block.
+	s := NewStore(w)
+	ctx := context.Background()
+	s.Set("gone", "before the flushall")
+	s.Set("acme:gone", "before the flushall")
+	s.Set("old", "before the flushall")   // Nothing later touches it, only the FLUSHALL removes it.
+	s.FlushAll(ctx)                       // Nothing above survives.
+	s.Set("plain", "after the flushall")  // Kept.
+	s.Set("acme:a", "before the flushns") // Flushed with its namespace.
+	s.Set("acme:b", "before the flushns") // Flushed with its namespace.
+	s.Set("acmes:c", "another namespace") // Shares the prefix but not the namespace, kept.
+	s.FlushNamespace(ctx, "acme")         // acme:a and acme:b go.
+	s.Set("acme:b", "after the flushns")  // Kept.
+	s.Set("gone", "back after both")      // Kept, written again.
+	want := s.Digest()                    // What every replay must end up with.
+	w.Close()                             // Flush the WAL before recovering from it.
+
+	wantKeys := map[string]string{"plain": "after the flushall", "acmes:c": "another namespace", "acme:b": "after the flushns", "gone": "back after both"}
+	for _, opts := range []wal.RecoverOptions{ // The whole log as one chunk, then split across workers.
+		{Workers: 1},                 // One chunk, parsed and applied in turn.
+		{ChunkBytes: 32, Workers: 4}, // Every few records a chunk, parsed in parallel.
+	} { // The flushes land in whichever chunk holds them, and must still cut everything before.
+		r := NewStore(nil) // Nothing is logged while recovering.
+		if _, err := r.Recover(filename, opts); err != nil {
+			t.Fatalf("Failed to recover with %+v: %v", opts, err)
+		} // End of error check block.
+		if r.Len() != len(wantKeys) { // Nothing flushed came back.
+			t.Errorf("Expected %d keys recovering with %+v, got %d", len(wantKeys), opts, r.Len())
+		} // End of count check.
+		for k, v := range wantKeys { // Every post-flush write, with its last value.
+			if got, _ := r.Get(k); got != v {
+				t.Errorf("Expected %s=%q recovering with %+v, got %q", k, v, opts, got)
+			} // End of value check.
+		} // End of key loop.
+		if got := r.Digest(); got != want { // Same contents as the store the log came from.
+			t.Errorf("Expected the digest %v recovering with %+v, got %v", want, opts, got)
+		} // End of digest check.
+	} // End of options loop.
+
+	data, err := wal.Recover(filename) // The plain map replay agrees.
+	if err != nil {
+		t.Fatalf("Failed to recover: %v", err)
+	} // End of error check block.
+	if len(data) != len(wantKeys) || data["acme:b"] != "after the flushns" || data["gone"] != "back after both" {
+		t.Errorf("Expected only the post-flush writes from wal.Recover, got %v", data)
+	} // End of map check.
+} // End of TestRecoverAfterFlushes function.
+
+func TestRecoverResumesAfterTheLastMarker(t *testing.T) { // Checks recovery keeps what an APPLIED marker follows and drops the rest.
+	filename := "test_wal_applied.log" // Separate WAL file so it doesn't clash with the other tests.
+	os.Remove(filename)                // clean up previous runs
+	defer os.Remove(filename)          // always clean up after test is run.
+
+	w, err := wal.NewWAL(filename) // Fresh WAL for this test.
+	if err != nil {                // Stop if the WAL couldn't be created.
+		t.Fatalf("Failed to create WAL: %v", err)
+	} // End of error check block.
+	s := NewStore(w)
+	ctx := context.Background()
+	s.Append(ctx, "k", "a") // Entry 0.
+	s.MarkApplied(ctx, 0)   // Applied.
+	s.Append(ctx, "k", "b") // Entry 1.
+	s.Set("other", "1")     // Entry 1 wrote two records.
+	s.MarkApplied(ctx, 1)   // Applied.
+	repair := map[string]string{"repaired": "yes"}
+	if _, err := s.RepairRange(ctx, func(key string) bool { return key == "repaired" }, repair, nil); err != nil { // Not a raft entry, between two batches.
+		t.Fatalf("RepairRange failed: %v", err)
+	} // End of error check block.
+	s.Append(ctx, "k", "c") // Entry 2, whose marker never made it to disk.
+	if got := s.Applied(); got != 1 {
+		t.Fatalf("Expected applied 1, got %d", got)
+	} // End of applied check.
+	w.Close() // Flush the WAL before recovering from it.
+
+	for _, opts := range []wal.RecoverOptions{{Workers: 1}, {ChunkBytes: 32, Workers: 4}} { // The markers land in whichever chunk holds them.
+		r := NewStore(nil) // Nothing is logged while recovering.
+		if _, err := r.Recover(filename, opts); err != nil {
+			t.Fatalf("Failed to recover with %+v: %v", opts, err)
+		} // End of error check block.
+		if got, _ := r.Get("k"); got != "ab" { // Raft applies entry 2 again, so it mustn't be here already.
+			t.Errorf("Expected k=ab recovering with %+v, got %q", opts, got)
+		} // End of value check.
+		if got, _ := r.Get("repaired"); got != "yes" || r.Len() != 3 { // The repair is marked as well.
+			t.Errorf("Expected the repair and 3 keys recovering with %+v, got %q and %d keys", opts, got, r.Len())
+		} // End of repair check.
+		if got := r.Applied(); got != 1 { // Where raft resumes.
+			t.Errorf("Expected applied 1 recovering with %+v, got %d", opts, got)
+		} // End of applied check.
+	} // End of options loop.
+
+	w, err = wal.NewWAL(filename) // Compacting keeps the marker.
+	if err != nil {
+		t.Fatalf("Failed to reopen WAL: %v", err)
+	} // End of error check block.
+	s = NewStore(w)
+	if _, err := s.Recover(filename, wal.RecoverOptions{}); err != nil {
+		t.Fatalf("Failed to recover: %v", err)
+	} // End of error check block.
+	if err := s.FinishCompaction(s.BeginCompaction()); err != nil {
+		t.Fatalf("Compaction failed: %v", err)
+	} // End of error check block.
+	w.Close()
+	r := NewStore(nil)
+	if _, err := r.Recover(filename, wal.RecoverOptions{}); err != nil {
+		t.Fatalf("Failed to recover after compacting: %v", err)
+	} // End of error check block.
+	if got, _ := r.Get("k"); got != "ab" || r.Applied() != 1 || r.Len() != 3 {
+		t.Errorf("Expected k=ab applied to 1 after compacting, got %q applied to %d with %d keys", got, r.Applied(), r.Len())
+	} // End of compaction check.
+} // End of TestRecoverResumesAfterTheLastMarker function.
+
+func TestBatch(t *testing.T) { // Checks a batch applies in order and recovers as a whole.
+	filename := "test_wal_batch.log" // Separate WAL file so it doesn't clash with the other tests.
+	os.Remove(filename)              // clean up previous runs
+	defer os.Remove(filename)        // always clean up after test is run.
+
+	w, err := wal.NewWAL(filename) // Fresh WAL for this test.
+	if err != nil {                // Stop if the WAL couldn't be created.
+		t.Fatalf("Failed to create WAL: %v", err)
+	} // End of error check block.
+	s := NewStore(w)
+	ctx := context.Background() // No tracing needed in tests.
+	s.Set("old", "x")           // Something for the batch to delete.
+
+	existed, err := s.Batch(ctx, []BatchOp{ // Set, overwrite within the batch, delete, delete a missing key, put-if-absent an existing one.
+		{Key: "a", Value: "1"},
+		{Key: "a", Value: "2 with spaces"},
+		{Delete: true, Key: "old"},
+		{Delete: true, Key: "missing"},
+		{Key: "a", Value: "ignored", IfAbsent: true},
+	})
+	if err != nil || len(existed) != 5 { // One answer per op.
+		t.Fatalf("Expected 5 answers, got %v %v", existed, err)
+	} // End of error check block.
+	if existed[0] || !existed[1] || !existed[2] || existed[3] || !existed[4] { // Later ops see earlier ones.
+		t.Errorf("Expected existed [false true true false true], got %v", existed)
+	} // End of existed check.
+	w.Close() // simulates server shutdown
+
+	recovered, err := wal.Recover(filename) // Replay the log from disk.
+	if err != nil {                         // Stop if recovery failed.
+		t.Fatalf("Failed to recover: %v", err)
+	} // End of error check block.
+	if recovered["a"] != "2 with spaces" || len(recovered) != 1 { // Only the batch's final state survives, the IfAbsent put skipped.
+		t.Errorf("Expected only a=2 with spaces after recovery, got %v", recovered)
+	} // End of recovery check.
+} // End of TestBatch function.
+
+func TestUpdate(t *testing.T) { // Checks a transaction sees its own writes, applies all or nothing and recovers as a whole.
+	filename := "test_wal_update.log" // Separate WAL file so it doesn't clash with the other tests.
+	os.Remove(filename)               // clean up previous runs
+	defer os.Remove(filename)         // always clean up after test is run.
+
+	w, err := wal.NewWAL(filename) // Fresh WAL for this test.
+	if err != nil {                // Stop if the WAL couldn't be created.
+		t.Fatalf("Failed to create WAL: %v", err)
+	} // End of error check block.
+	s := NewStore(w)
+	ctx := context.Background() // No tracing needed in tests.
+	s.Set("counter", "1")       // Something to read and modify.
+
+	err = s.Update(WithIndex(ctx, 7), func(tx *Tx) error { // Increment, move and delete in one go.
+		v, _ := tx.Get("counter")                         // Read before writing.
+		tx.Set("counter", v+"1")                          // "11".
+		if v, ok := tx.Get("counter"); !ok || v != "11" { // Reads see earlier writes.
+			t.Errorf("Expected the transaction to read its own write, got %q %v", v, ok)
+		} // End of overlay check.
+		if tx.Index() != 7 { // The entry's index from ctx.
+			t.Errorf("Expected index 7, got %d", tx.Index())
+		} // End of index check.
+		tx.SetExpiring("lease", "me", 4102444800000) // Expires in 2100.
+		tx.Set("tmp", "x")                           // Written and then deleted.
+		tx.Delete("tmp")                             // Gone again.
+		if _, ok := tx.Get("tmp"); ok {              // Deletes hide the key.
+			t.Error("Expected the deleted key to be gone")
+		} // End of delete check.
+		return nil // Commit.
+	}) // End of transaction.
+	if err != nil { // Committed writes must reach the WAL.
+		t.Fatalf("Update failed: %v", err)
+	} // End of error check block.
+	s.Update(ctx, func(tx *Tx) error { // Read the expiry back.
+		if at, ok := tx.ExpiresAt("lease"); !ok || at != 4102444800000 { // Kept by the batch.
+			t.Errorf("Expected the lease to expire in 2100, got %d %v", at, ok)
+		} // End of expiry check.
+		return nil // Nothing written.
+	}) // End of transaction.
+
+	failed := errors.New("abort")            // What the failing transaction returns.
+	err = s.Update(ctx, func(tx *Tx) error { // Writes, then fails.
+		tx.Set("counter", "lost") // Must not be applied.
+		return failed             // Abort.
+	}) // End of transaction.
+	if err != failed { // The error is handed back as is.
+		t.Errorf("Expected the transaction's error, got %v", err)
+	} // End of error check block.
+	if v, _ := s.Get("counter"); v != "11" { // Nothing of the failed transaction applied.
+		t.Errorf("Expected counter=11, got %q", v)
+	} // End of value check.
+	w.Close() // simulates server shutdown
+
+	recovered, err := wal.Recover(filename) // Replay the log from disk.
+	if err != nil {                         // Stop if recovery failed.
+		t.Fatalf("Failed to recover: %v", err)
+	} // End of error check block.
+	if recovered["counter"] != "11" || recovered["lease"] != "me" || len(recovered) != 2 { // The committed transaction's final state only.
+		t.Errorf("Expected only counter=11 and lease=me after recovery, got %v", recovered)
+	} // End of recovery check.
+} // End of TestUpdate function.
+
+func TestHistory(t *testing.T) { // Checks history keeps the newest revisions of each key, deletes included, and only while on.
+	filename := "test_wal_history.log" // Separate WAL file so it doesn't clash with the other tests.
+	os.Remove(filename)                // clean up previous runs
+	defer os.Remove(filename)          // always clean up after test is run.
+
+	w, err := wal.NewWAL(filename) // Fresh WAL for this test.
+	if err != nil {                // Stop if the WAL couldn't be created.
+		t.Fatalf("Failed to create WAL: %v", err)
+	} // End of error check block.
+	defer w.Close() // Closed once the test ends.
+	s := NewStore(w)
+	ctx := context.Background()        // No tracing needed in tests.
+	s.Set("k", "before")               // Written while history is off.
+	if h := s.History("k"); h != nil { // Nothing was kept.
+		t.Errorf("Expected no history while it is off, got %v", h)
+	} // End of off check.
+
+	s.SetHistory(3)                             // The newest three revisions.
+	for i, v := range []string{"1", "2", "3"} { // Written from log entries 10, 11 and 12.
+		s.SetContext(WithIndex(ctx, 10+i), "k", v) // One revision each.
+	} // End of write loop.
+	s.Append(WithIndex(ctx, 13), "k", "4") // Pushes out the first.
+	s.GetDel(WithIndex(ctx, 14), "k")      // Deletes are revisions too.
+	h := s.History("k")                    // Oldest first.
+
+	if len(h) != 3 || h[0].Value != "3" || h[1].Value != "34" || h[1].Revision != 13 || !h[2].Deleted || h[2].Revision != 14 { // The last three changes.
+		t.Errorf("Expected 3, 34 and a delete at 14, got %+v", h)
+	} // End of history check.
+
+	s.Set("other", "x")               // Another key.
+	s.FlushAll(ctx)                   // Every key's history records it.
+	s.SetHistory(1)                   // Shrinks what is kept.
+	h = s.History("other")            // Only the flush is left.
+	if len(h) != 1 || !h[0].Deleted { // The newest revision.
+		t.Errorf("Expected the flush as the only revision of other, got %+v", h)
+	} // End of flush check.
+	s.SetHistory(0)                    // Off again.
+	if h := s.History("k"); h != nil { // Forgotten.
+		t.Errorf("Expected history to be forgotten when turned off, got %v", h)
+	} // End of forget check.
+} // End of TestHistory function.
+
+func TestExpiry(t *testing.T) { // Checks expiring keys vanish from reads, survive recovery and compaction, and go permanent on rewrite.
+	filename := "test_wal_expiry.log" // Separate WAL file so it doesn't clash with the other tests.
+	os.Remove(filename)               // clean up previous runs
+	defer os.Remove(filename)         // always clean up after test is run.
+
+	w, err := wal.NewWAL(filename) // Fresh WAL for this test.
+	if err != nil {                // Stop if the WAL couldn't be created.
+		t.Fatalf("Failed to create WAL: %v", err)
+	} // End of error check block.
+	s := NewStore(w)
+	ctx := context.Background()                    // No tracing needed in tests.
+	later := time.Now().Add(time.Hour).UnixMilli() // Far enough out not to pass during the test.
+	past := time.Now().Add(-time.Second).UnixMilli()
+	s.Batch(ctx, []BatchOp{
+		{Key: "session", Value: "s1", ExpiresAt: later},
+		{Key: "gone", Value: "g", ExpiresAt: past},
+		{Key: "rewritten", Value: "r1", ExpiresAt: later},
+	})
+	s.Set("rewritten", "r2") // A write without a ttl makes it permanent.
+
+	if _, err := s.Get("gone"); err != ErrorNotFound { // Past its expiry, even before an expire removed it.
+		t.Errorf("Expected an expired key to read as missing, got %v", err)
+	} // End of expired check.
+	if _, ok := s.Peek("gone"); !ok { // Still there until an expire removes it.
+		t.Errorf("Expected Peek to see an expired key nothing has removed")
+	} // End of peek check.
+	if at, ok := s.ExpiresAt("session"); !ok || at.UnixMilli() != later { // Kept exactly.
+		t.Errorf("Expected session to expire at %d, got %v %v", later, at, ok)
+	} // End of expiry check.
+	if _, ok := s.ExpiresAt("rewritten"); ok { // Permanent again.
+		t.Errorf("Expected the rewrite to clear the expiry")
+	} // End of rewrite check.
+	existed, _ := s.Batch(ctx, []BatchOp{{Delete: true, Key: "session", ExpiresAt: past}}) // An expire for an older expiry.
+	if _, err := s.Get("session"); err != nil || !existed[0] {                             // Must leave the key alone.
+		t.Errorf("Expected a stale expire to keep the key, got %v", err)
+	} // End of stale expire check.
+	if due := s.Expired(time.Now(), 10); len(due) != 1 || due[0].Key != "gone" { // Only the one that ran out.
+		t.Errorf("Expected only gone to be due, got %v", due)
+	} // End of due check.
+
+	snap := s.BeginCompaction()                      // Expiries must be rewritten with their values.
+	if err := s.FinishCompaction(snap); err != nil { // Stop if compaction failed.
+		t.Fatalf("Failed to compact: %v", err)
+	} // End of error check block.
+	w.Close() // Flush the WAL before recovering from it.
+
+	w2, err := wal.NewWAL(filename) // Reopened as on restart.
+	if err != nil {
+		t.Fatalf("Failed to reopen WAL: %v", err)
+	} // End of error check block.
+	defer w2.Close()
+	r := NewStore(w2)
+	if _, err := r.Recover(filename, wal.RecoverOptions{}); err != nil { // Stop if recovery failed.
+		t.Fatalf("Failed to recover: %v", err)
+	} // End of error check block.
+	if at, ok := r.ExpiresAt("session"); !ok || at.UnixMilli() != later { // The expiry came back with the value.
+		t.Errorf("Expected session to still expire at %d after recovery, got %v %v", later, at, ok)
+	} // End of recovered expiry check.
+	if _, ok := r.ExpiresAt("rewritten"); ok { // Still permanent.
+		t.Errorf("Expected rewritten to stay permanent after recovery")
+	} // End of recovered rewrite check.
+} // End of TestExpiry function.
+
+func TestExpiredInOrder(t *testing.T) { // Checks Expired hands out due keys soonest first, skips stale expiries and keeps them until expired.
+	filename := "test_wal_expired.log" // Separate WAL file so it doesn't clash with the other tests.
+	os.Remove(filename)                // clean up previous runs
+	defer os.Remove(filename)          // always clean up after test is run.
+
+	w, err := wal.NewWAL(filename) // Fresh WAL for this test.
+	if err != nil {                // Stop if the WAL couldn't be created.
+		t.Fatalf("Failed to create WAL: %v", err)
+	} // End of error check block.
+	defer w.Close()
+	s := NewStore(w)
+	ctx := context.Background() // No tracing needed in tests.
+	now := time.Now()
+	at := func(ago int) int64 { return now.Add(-time.Duration(ago) * time.Second).UnixMilli() } // Expiries in the past.
+	s.Batch(ctx, []BatchOp{
+		{Key: "c", Value: "1", ExpiresAt: at(1)},
+		{Key: "a", Value: "1", ExpiresAt: at(3)},
+		{Key: "b", Value: "1", ExpiresAt: at(2)},
+		{Key: "later", Value: "1", ExpiresAt: now.Add(time.Hour).UnixMilli()},
+		{Key: "refreshed", Value: "1", ExpiresAt: at(4)},
+	})
+	s.Batch(ctx, []BatchOp{{Key: "refreshed", Value: "2", ExpiresAt: now.Add(time.Hour).UnixMilli()}}) // Its old expiry goes stale.
+	s.Batch(ctx, []BatchOp{{Key: "c", Value: "2", ExpiresAt: at(1)}})                                  // Same expiry twice.
+
+	if due := s.Expired(now, 2); len(due) != 2 || due[0].Key != "a" || due[1].Key != "b" { // Soonest first, at most max.
+		t.Fatalf("Expected a then b, got %v", due)
+	} // End of order check.
+	due := s.Expired(now, 10) // Nothing was expired, so the same keys again.
+	if len(due) != 3 || due[0].Key != "a" || due[1].Key != "b" || due[2].Key != "c" {
+		t.Fatalf("Expected a, b and c once each, got %v", due)
+	} // End of repeat check.
+	ops := make([]BatchOp, len(due)) // Expire them as the leader would.
+	for i, e := range due {
+		ops[i] = BatchOp{Delete: true, Key: e.Key, ExpiresAt: e.At}
+	} // End of ops loop.
+	s.Batch(ctx, ops)
+	if due := s.Expired(now, 10); len(due) != 0 { // Gone, and the rest aren't due.
+		t.Errorf("Expected nothing due after the expire, got %v", due)
+	} // End of empty check.
+	if due := s.Expired(now.Add(2*time.Hour), 10); len(due) != 2 { // later and the refreshed key.
+		t.Errorf("Expected 2 keys due in two hours, got %v", due)
+	} // End of future check.
+} // End of TestExpiredInOrder function.
+
+func TestClockDecidesExpiry(t *testing.T) { // Checks reads judge expiries by the store's clock, not the machine's.
+	filename := "test_wal_clock.log" // Separate WAL file so it doesn't clash with the other tests.
+	os.Remove(filename)              // clean up previous runs
+	defer os.Remove(filename)        // always clean up after test is run.
+
+	w, err := wal.NewWAL(filename) // Fresh WAL for this test.
+	if err != nil {                // Stop if the WAL couldn't be created.
+		t.Fatalf("Failed to create WAL: %v", err)
+	} // End of error check block.
+	defer w.Close()
+	s := NewStore(w)
+	clk := clock.NewFake(time.Now()) // Only moves when told to.
+	s.SetClock(clk)
+	ctx := context.Background()                                                                               // No tracing needed in tests.
+	s.Batch(ctx, []BatchOp{{Key: "session", Value: "s1", ExpiresAt: clk.Now().Add(time.Minute).UnixMilli()}}) // A minute to live.
+
+	if _, err := s.Get("session"); err != nil { // Still live.
+		t.Fatalf("Expected session before its expiry, got %v", err)
+	} // End of live check.
+	clk.Advance(time.Minute)                              // Exactly at its expiry.
+	if _, err := s.Get("session"); err != ErrorNotFound { // Gone to readers.
+		t.Errorf("Expected session expired on the store's clock, got %v", err)
+	} // End of expired check.
+	if m, ok := s.Stat("session"); ok { // No metadata for an expired key either.
+		t.Errorf("Expected no metadata for an expired key, got %+v", m)
+	} // End of meta check.
+} // End of TestClockDecidesExpiry function.
+
+func TestIterate(t *testing.T) { // Checks iteration sees one instant, skips expired keys and pages in key order.
+	filename := "test_wal_iterate.log" // Separate WAL file so it doesn't clash with the other tests.
+	os.Remove(filename)                // clean up previous runs
+	defer os.Remove(filename)          // always clean up after test is run.
+
+	w, err := wal.NewWAL(filename) // Fresh WAL for this test.
+	if err != nil {                // Stop if the WAL couldn't be created.
+		t.Fatalf("Failed to create WAL: %v", err)
+	} // End of error check block.
+	defer w.Close() // Close the WAL when the test finishes.
+	s := NewStore(w)
+	for _, k := range []string{"a:3", "a:1", "a:5", "a:2", "a:4", "b:1"} { // Out of order on purpose.
+		s.Set(k, "v"+k)
+	} // End of setup loop.
+	s.Batch(context.Background(), []BatchOp{{Key: "a:0", Value: "old", ExpiresAt: 1}}) // Expired long ago.
+
+	seen := 0
+	s.Iterate("a:", func(k string, v string) bool { // Writes during the walk must not show up in it.
+		if v != "v"+k { // Values come back uncompressed and matching.
+			t.Errorf("Expected v%s for %s, got %s", k, k, v)
+		} // End of value check.
+		s.Set("a:9", "new") // Doesn't deadlock, and isn't seen.
+		seen++
+		return true
+	}) // End of iterate.
+	if seen != 5 { // a:1..a:5, not a:0, a:9 or b:1.
+		t.Errorf("Expected 5 keys, saw %d", seen)
+	} // End of count check.
+
+	var got []string
+	after := ""
+	for range 10 { // Bounded in case Next never ends.
+		page := s.IteratePage("a:", after, 2)
+		for _, e := range page.Entries {
+			got = append(got, e.Key)
+		} // End of entry loop.
+		if page.Next == "" { // Last page.
+			break
+		} // End of next check.
+		after = page.Next
+	} // End of page loop.
+	if strings.Join(got, ",") != "a:1,a:2,a:3,a:4,a:5,a:9" { // Sorted, each key once, a:9 now visible.
+		t.Errorf("Expected pages in key order, got %v", got)
+	} // End of page check.
+} // End of TestIterate function.
+
+func TestMemoryStats(t *testing.T) { // Checks the memory estimate follows writes and deletes.
+	filename := "test_wal_memory.log" // Separate WAL file so it doesn't clash with the other tests.
+	os.Remove(filename)               // clean up previous runs
+	defer os.Remove(filename)         // always clean up after test is run.
+
+	w, err := wal.NewWAL(filename) // Fresh WAL for this test.
+	if err != nil {                // Stop if the WAL couldn't be created.
+		t.Fatalf("Failed to create WAL: %v", err)
+	} // End of error check block.
+	defer w.Close() // Close the WAL when the test finishes.
+	s := NewStore(w)
+	if m := s.MemoryStats(); m.Keys != 0 || m.UsedBytes != 0 { // Empty store takes nothing.
+		t.Fatalf("Expected an empty store to use nothing, got %+v", m)
+	} // End of empty check.
+
+	s.Set("alpha", "12345")
+	s.Set("beta", "xy")
+	s.Set("alpha", "1") // Overwrites count the new value only.
+	m := s.MemoryStats()
+	if m.Keys != 2 || m.KeyBytes != 9 || m.ValueBytes != 3 { // alpha+beta, 1+xy.
+		t.Errorf("Expected 2 keys, 9 key bytes and 3 value bytes, got %+v", m)
+	} // End of count check.
+	if m.UsedBytes <= m.KeyBytes+m.ValueBytes+m.MetaBytes { // Per-key overhead comes on top.
+		t.Errorf("Expected overhead in UsedBytes, got %+v", m)
+	} // End of overhead check.
+
+	s.GetDel(context.Background(), "alpha")
+	if m := s.MemoryStats(); m.Keys != 1 || m.KeyBytes != 4 || m.ValueBytes != 2 { // Only beta is left.
+		t.Errorf("Expected only beta after the delete, got %+v", m)
+	} // End of delete check.
+} // End of TestMemoryStats function.
+
+func TestNamespaceUsage(t *testing.T) { // Checks per-namespace usage follows writes, renames, deletes and flushes.
+	filename := "test_wal_namespaces.log" // Separate WAL file so it doesn't clash with the other tests.
+	os.Remove(filename)                   // clean up previous runs
+	defer os.Remove(filename)             // always clean up after test is run.
+
+	w, err := wal.NewWAL(filename) // Fresh WAL for this test.
+	if err != nil {                // Stop if the WAL couldn't be created.
+		t.Fatalf("Failed to create WAL: %v", err)
+	} // End of error check block.
+	defer w.Close() // Close the WAL when the test finishes.
+	s := NewStore(w)
+	ctx := context.Background()
+
+	s.Set("acme:a", "12345")
+	s.Set("acme:b", "xy")
+	s.Set("acme:a", "1")                                             // Overwrites count the new value only.
+	s.Set("plain", "v")                                              // No namespace.
+	if u := s.NamespaceUsage("acme"); u.Keys != 2 || u.Bytes != 15 { // acme:a+1, acme:b+xy.
+		t.Errorf("Expected acme to hold 2 keys and 15 bytes, got %+v", u)
+	} // End of write check.
+	if u := s.NamespaceUsage(""); u.Keys != 1 || u.Bytes != 6 { // plain+v.
+		t.Errorf("Expected the default namespace to hold plain, got %+v", u)
+	} // End of default check.
+
+	s.Rename(ctx, "acme:b", "other:b") // Moves a key across namespaces.
+	if u := s.NamespaceUsage("other"); u.Keys != 1 || u.Bytes != 9 {
+		t.Errorf("Expected other to hold the renamed key, got %+v", u)
+	} // End of rename check.
+	if n, ok := s.EntrySize("other:b"); !ok || n != 9 { // What the key counts for.
+		t.Errorf("Expected other:b to count 9 bytes, got %d %v", n, ok)
+	} // End of size check.
+	s.GetDel(ctx, "acme:a")
+	if _, ok := s.Namespaces()["acme"]; ok { // An emptied namespace isn't listed.
+		t.Errorf("Expected acme to be gone, got %+v", s.Namespaces())
+	} // End of delete check.
+
+	s.FlushNamespace(ctx, "other")
+	s.Set("acme:c", "z")
+	if got := s.Namespaces(); len(got) != 2 || got["acme"].Keys != 1 { // The default namespace and acme:c.
+		t.Errorf("Expected only acme and the default namespace after the flush, got %+v", got)
+	} // End of flush check.
+	s.FlushAll(ctx)
+	if got := s.Namespaces(); len(got) != 0 {
+		t.Errorf("Expected nothing after FLUSHALL, got %+v", got)
+	} // End of flushall check.
+} // End of TestNamespaceUsage function.
+
+func TestDigest(t *testing.T) { // Checks stores with the same contents agree on the digest however they got there.
+	filename := "test_wal_digest.log" // Separate WAL files so they don't clash with the other tests.
+	other := "test_wal_digest_other.log"
+	os.Remove(filename)       // clean up previous runs
+	os.Remove(other)          // same for the second store
+	defer os.Remove(filename) // always clean up after test is run.
+	defer os.Remove(other)
+
+	w, err := wal.NewWAL(filename) // Fresh WAL for this test.
+	if err != nil {                // Stop if the WAL couldn't be created.
+		t.Fatalf("Failed to create WAL: %v", err)
+	} // End of error check block.
+	s := NewStore(w)
+	s.SetCompression(compress.Zstd, 64) // Compressed values hash like plain ones.
+	ctx := context.Background()
+	big := strings.Repeat("abcdef", 100)
+	expiry := time.Now().Add(time.Hour).UnixMilli()
+
+	s.Set("a", "old")
+	s.Set("a", "1")
+	s.Set("big", big)
+	s.Append(ctx, "big", "!")
+	s.Set("gone", "x")
+	s.GetDel(ctx, "gone")
+	s.Rename(ctx, "big", "moved")
+	s.Batch(ctx, []BatchOp{{Key: "ttl", Value: "t", ExpiresAt: expiry}})
+
+	w2, err := wal.NewWAL(other)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	} // End of error check block.
+	defer w2.Close()
+	plain := NewStore(w2) // Same contents written directly, uncompressed.
+	plain.Set("moved", big+"!")
+	plain.Set("a", "1")
+	plain.Batch(ctx, []BatchOp{{Key: "ttl", Value: "t", ExpiresAt: expiry}})
+	if s.Digest() != plain.Digest() {
+		t.Fatalf("Expected equal digests, got\n%v\n%v", s.Digest(), plain.Digest())
+	} // End of equality check.
+
+	w.Close() // Flush the WAL before recovering from it.
+	w3, _ := wal.NewWAL(filename + ".replay")
+	defer os.Remove(filename + ".replay")
+	defer w3.Close()
+	recovered := NewStore(w3)
+	if _, err := recovered.Recover(filename, wal.RecoverOptions{}); err != nil {
+		t.Fatalf("Failed to recover: %v", err)
+	} // End of error check block.
+	if recovered.Digest() != plain.Digest() { // Replay goes through the same hooks.
+		t.Errorf("Expected the recovered store to match, got\n%v\n%v", recovered.Digest(), plain.Digest())
+	} // End of recovery check.
+
+	plain.Set("a", "2") // One different value.
+	if diff := plain.Digest().Diff(recovered.Digest()); len(diff) != 1 || diff[0] != DigestShard("a") {
+		t.Errorf("Expected only a's shard %d to differ, got %v", DigestShard("a"), diff)
+	} // End of diff check.
+	if d, err := ParseDigest(plain.Digest().String()); err != nil || d != plain.Digest() {
+		t.Errorf("Expected the digest to round trip, got %v %v", d, err)
+	} // End of parse check.
+	plain.FlushAll(ctx)
+	if plain.Digest() != (Digest{}) { // The empty store hashes to zero.
+		t.Errorf("Expected an empty digest after FLUSHALL, got %v", plain.Digest())
+	} // End of flush check.
+} // End of TestDigest function.
+
+func TestRepairShards(t *testing.T) { // Checks a repair makes a shard match and is logged.
+	filename := "test_wal_repair.log" // Separate WAL file so it doesn't clash with the other tests.
+	os.Remove(filename)               // clean up previous runs
+	defer os.Remove(filename)         // always clean up after test is run.
+
+	w, err := wal.NewWAL(filename) // Fresh WAL for this test.
+	if err != nil {                // Stop if the WAL couldn't be created.
+		t.Fatalf("Failed to create WAL: %v", err)
+	} // End of error check block.
+	s := NewStore(w)
+	ctx := context.Background()
+	expiry := time.Now().Add(time.Hour).UnixMilli()
+	s.Set("a", "wrong")
+	s.Set("stale", "x")
+	shards := []int{DigestShard("a"), DigestShard("stale"), DigestShard("ttl")}
+	n, err := s.RepairShards(ctx, shards, map[string]string{"a": "right", "ttl": "t"}, map[string]int64{"ttl": expiry})
+	if err != nil || n != 3 { // a rewritten, stale removed, ttl added.
+		t.Fatalf("Expected 3 keys repaired, got %d %v", n, err)
+	} // End of repair check.
+	if n, _ := s.RepairShards(ctx, shards, map[string]string{"a": "right", "ttl": "t"}, map[string]int64{"ttl": expiry}); n != 0 {
+		t.Errorf("Expected a second repair to change nothing, got %d", n)
+	} // End of idempotence check.
+	w.Close() // Flush the WAL before recovering from it.
+
+	w2, _ := wal.NewWAL(filename + ".replay")
+	defer os.Remove(filename + ".replay")
+	defer w2.Close()
+	recovered := NewStore(w2)
+	if _, err := recovered.Recover(filename, wal.RecoverOptions{}); err != nil {
+		t.Fatalf("Failed to recover: %v", err)
+	} // End of error check block.
+	if got, _ := recovered.Get("a"); got != "right" {
+		t.Errorf("Expected the repair to survive recovery, got %q", got)
+	} // End of value check.
+	if _, err := recovered.Get("stale"); err == nil {
+		t.Error("Expected stale to stay removed")
+	} // End of delete check.
+	if at, ok := recovered.ExpiresAt("ttl"); !ok || at.UnixMilli() != expiry {
+		t.Errorf("Expected ttl's expiry back, got %v %v", at, ok)
+	} // End of expiry check.
+	if recovered.Digest() != s.Digest() {
+		t.Error("Expected the recovered store to hash the same")
+	} // End of digest check.
+} // End of TestRepairShards function.
+
+func TestInterning(t *testing.T) { // Checks shared values are counted as keys take them and let them go.
+	filename := "test_wal_intern.log" // Separate WAL file so it doesn't clash with the other tests.
+	os.Remove(filename)               // clean up previous runs
+	defer os.Remove(filename)         // always clean up after test is run.
+
+	w, err := wal.NewWAL(filename) // Fresh WAL for this test.
+	if err != nil {                // Stop if the WAL couldn't be created.
+		t.Fatalf("Failed to create WAL: %v", err)
+	} // End of error check block.
+	s := NewStore(w)
+	ctx := context.Background() // No deadlines in this test.
+
+	s.Set("flag:a", "enabled") // Stored before interning is on, interned by SetInterning.
+	s.SetInterning(16)
+	s.Set("flag:b", "enabled")
+	s.Set("flag:c", "disabled")
+	s.Set("blob", strings.Repeat("x", 17))                                         // Too long to intern.
+	s.Copy(ctx, "flag:a", "flag:d", false)                                         // Shares flag:a's copy.
+	want := InternStats{MaxLen: 16, Values: 2, Refs: 4, Bytes: 15, SavedBytes: 14} // enabled three times, disabled once.
+	if got := s.InternStats(); got != want {
+		t.Fatalf("Expected %+v, got %+v", want, got)
+	} // End of stats check.
+	if m := s.MemoryStats(); m.ValueBytes != 15+17 { // Each distinct value once, and the blob.
+		t.Errorf("Expected 32 value bytes, got %+v", m)
+	} // End of memory check.
+
+	s.Rename(ctx, "flag:d", "flag:c") // flag:c lets disabled go, the last key holding it.
+	s.GetDel(ctx, "flag:a")
+	s.Set("flag:b", "disabled")
+	want = InternStats{MaxLen: 16, Values: 2, Refs: 2, Bytes: 15} // flag:c enabled, flag:b disabled.
+	if got := s.InternStats(); got != want {
+		t.Fatalf("Expected %+v after the changes, got %+v", want, got)
+	} // End of stats check.
+	if v, _ := s.Get("flag:c"); v != "enabled" { // Reads don't notice the sharing.
+		t.Errorf("Expected flag:c to be enabled, got %q", v)
+	} // End of value check.
+	w.Close() // Flush the WAL before recovering from it.
+
+	if _, err := s.Recover(filename, wal.RecoverOptions{}); err != nil { // Replays into the same store, interning as values land.
+		t.Fatalf("Failed to recover: %v", err)
+	} // End of error check block.
+	if got := s.InternStats(); got != want { // Counted again from scratch.
+		t.Errorf("Expected %+v after recovery, got %+v", want, got)
+	} // End of recovery check.
+	s.SetInterning(0)
+	if got := s.InternStats(); got != (InternStats{}) { // Off means nothing is counted.
+		t.Errorf("Expected no interning stats, got %+v", got)
+	} // End of off check.
+} // End of TestInterning function.
+
+func TestCompactValues(t *testing.T) { // Checks a compact engine holds short values in place, and they are not interned as well.
+	filename := "test_wal_compact.log" // Separate WAL file so it doesn't clash with the other tests.
+	os.Remove(filename)                // clean up previous runs
+	defer os.Remove(filename)          // always clean up after test is run.
+
+	w, err := wal.NewWAL(filename) // Fresh WAL for this test.
+	if err != nil {                // Stop if the WAL couldn't be created.
+		t.Fatalf("Failed to create WAL: %v", err)
+	} // End of error check block.
+	e, _ := storage.Open("map", storage.Options{CompactValues: true}) // Values of up to 15 bytes kept inline.
+	s := NewStoreWithEngine(w, e)
+	s.SetInterning(32)
+
+	long := strings.Repeat("x", 20) // Too long to keep inline, short enough to intern.
+	s.Set("flag:a", "enabled")
+	s.Set("flag:b", "enabled")
+	s.Set("doc:1", long)
+	s.Set("doc:2", long)
+	want := InternStats{MaxLen: 32, Values: 1, Refs: 2, Bytes: 20, SavedBytes: 20} // Only the long value is shared.
+	if got := s.InternStats(); got != want {
+		t.Fatalf("Expected %+v, got %+v", want, got)
+	} // End of stats check.
+	m := s.MemoryStats()
+	if m.InlineValues != 2 || m.InlineBytes != 14 || m.ValueBytes != 14+20 { // Both flags in place, the long value once.
+		t.Errorf("Expected the flags inline and the long value counted once, got %+v", m)
+	} // End of inline check.
+	keys := int64(len("flag:a") + len("flag:b") + len("doc:1") + len("doc:2"))
+	used := keys + 20 + 4*storage.EntryOverhead + 4*metaEntryBytes + internEntryBytes // The inline values take nothing of their own.
+	if m.UsedBytes != used {
+		t.Errorf("Expected %d bytes used, got %d", used, m.UsedBytes)
+	} // End of used check.
+	if v, _ := s.Get("flag:b"); v != "enabled" { // Reads don't notice where it is kept.
+		t.Errorf("Expected flag:b to be enabled, got %q", v)
+	} // End of value check.
+	w.Close() // Flush the WAL before recovering from it.
+
+	e, _ = storage.Open("sharded", storage.Options{CompactValues: true}) // Recovered into a fresh compact engine.
+	recovered := NewStoreWithEngine(nil, e)
+	recovered.SetInterning(32)
+	if _, err := recovered.Recover(filename, wal.RecoverOptions{}); err != nil {
+		t.Fatalf("Failed to recover: %v", err)
+	} // End of error check block.
+	if got := recovered.MemoryStats(); got.InlineValues != 2 || got.InlineBytes != 14 || got.ValueBytes != m.ValueBytes { // Kept the same way again.
+		t.Errorf("Expected the values kept as before after recovery, got %+v", got)
+	} // End of recovery check.
+	if recovered.Digest() != s.Digest() {
+		t.Error("Expected the recovered store to hash the same")
+	} // End of digest check.
+} // End of TestCompactValues function.
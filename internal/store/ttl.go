@@ -0,0 +1,84 @@
+package store // Key expiry for the store.
+
+import ( // Import block starts here.
+	"maps"    // Copies the expiries away from snapshots.
+	"strconv" // Formats expiry times for the WAL record.
+	"time"    // Expiry times are wall-clock instants.
+
+	"github.com/mathdee/KV-Store/internal/clock" // Tests move the time reads see.
+	"github.com/mathdee/KV-Store/internal/wal"   // Record formatting.
+) // Import block ends here.
+
+// A key written with a TTL carries an expiry, an absolute time in unix
+// milliseconds chosen by the leader, so every node holds the same one. Any
+// later write to the key without a TTL makes it permanent again, though a
+// RENAME takes the expiry along to the new key. Reads stop seeing a key once
+// its expiry passes, but only a replicated expire removes it, so writes on
+// every node keep agreeing on what exists. The WAL logs an expiry as a record
+// right after the value it belongs to:
+//
+//	!EXPIREAT "key" "<unix ms>"
+
+type Expiry struct { // A key and when it expires, see Store.Expired.
+	Key string // The expiring key.
+	At  int64  // Unix milliseconds.
+} // End of Expiry struct.
+
+func expiryRecord(key string, at int64) string { // The WAL record for key expiring at at.
+	return wal.FormatOp("EXPIREAT", key, strconv.FormatInt(at, 10)) // Replayed by wal.Replay.
+} // End of expiryRecord function.
+
+func (s *Store) ownExpires() { // Copies the expiries away from any snapshot before they change; callers must hold s.mu.
+	if s.expiresShared { // A snapshot still reads this map.
+		s.expires = maps.Clone(s.expires) // Our own copy.
+		s.expiresShared = false           // Until the next snapshot.
+	} // End of shared check.
+} // End of ownExpires method.
+
+func (s *Store) setExpiry(key string, at int64) { // Makes key expire at at; callers must hold s.mu.
+	s.ownExpires()      // About to change the map.
+	s.toggleExpiry(key) // Any earlier expiry leaves the digest.
+	s.expires[key] = at // Replaces any earlier expiry.
+	s.toggleExpiry(key) // This one joins it.
+	s.schedule(key, at) // So Expired finds it when it is due.
+} // End of setExpiry method.
+
+func (s *Store) clearExpiry(key string) { // Makes key permanent; callers must hold s.mu.
+	if _, ok := s.expires[key]; !ok { // Most keys never expire, and then nothing is copied.
+		return // Already permanent.
+	} // End of expiry check.
+	s.ownExpires()         // About to change the map.
+	s.toggleExpiry(key)    // Out of the digest.
+	delete(s.expires, key) // Gone.
+} // End of clearExpiry method.
+
+func (s *Store) SetClock(clk clock.Clock) { // Makes reads judge expiries, and metadata take its times, by clk; call it before the store is used.
+	s.clock = clk // Read without the lock from then on.
+} // End of SetClock method.
+
+func (s *Store) expired(key string, now time.Time) bool { // Whether key's expiry has passed; callers must hold s.mu.
+	at, ok := s.expires[key]           // Most keys have none.
+	return ok && at <= now.UnixMilli() // Due, even if the expire entry hasn't been applied yet.
+} // End of expired method.
+
+func (s *Store) Peek(key string) (string, bool) { // Like Get, but also sees keys whose expiry passed that no expire has removed yet, so every node applying the log answers alike.
+	s.mu.RLock()         // Shared lock, this only reads.
+	defer s.mu.RUnlock() // Released when the function returns.
+	return s.load(key)   // No clock involved.
+} // End of Peek method.
+
+func (s *Store) ExpiresAt(key string) (time.Time, bool) { // When key expires, false if it is permanent or missing.
+	s.mu.RLock()             // Shared lock, this only reads.
+	defer s.mu.RUnlock()     // Released when the function returns.
+	at, ok := s.expires[key] // Only keys written with a TTL have one.
+	if !ok {                 // Permanent key.
+		return time.Time{}, false // No expiry.
+	} // End of expiry check.
+	return time.UnixMilli(at), true // As a time for callers.
+} // End of ExpiresAt method.
+
+func (r recoverState) Expire(key string, at int64) { // Restores an expiry the log recorded, implements wal.Expirer.
+	if _, ok := r.s.data.Get(key); ok { // Only for a key that exists.
+		r.s.setExpiry(key, at) // Same as when it was written.
+	} // End of exists check.
+} // End of Expire method.
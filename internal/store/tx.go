@@ -0,0 +1,73 @@
+package store // Read-modify-write transactions for EVAL and the like.
+
+import ( // Import block starts here.
+	"context" // Carries the raft index of the entry being applied.
+
+	"github.com/mathdee/KV-Store/internal/wal" // Waits for the transaction's WAL unit.
+) // Import block ends here.
+
+type Tx struct { // A read-modify-write under the store lock, see Store.Update.
+	s      *Store             // The store being read and written.
+	ops    []BatchOp          // Writes in order, applied as one batch once fn returns.
+	writes map[string]*string // What the transaction wrote so far, nil for a delete, so its reads see its writes.
+	index  int                // Raft index of the entry being applied, -1 outside the log.
+} // End of Tx struct.
+
+func (s *Store) Update(ctx context.Context, fn func(tx *Tx) error) error { // Runs fn with the store locked and applies its writes as one WAL unit; an error from fn applies nothing. fn must not call other Store methods, the lock is held.
+	s.mu.Lock()                                                              // Nobody reads or writes between fn's reads and its writes.
+	tx := &Tx{s: s, writes: make(map[string]*string), index: indexFrom(ctx)} // Empty transaction.
+	if err := fn(tx); err != nil || len(tx.ops) == 0 {                       // Failed, or only read.
+		s.mu.Unlock() // Release before returning.
+		return err    // nil for a read-only transaction.
+	} // End of error check.
+	_, done := s.batch(ctx, tx.ops) // Applied like an atomic Batch, so recovery never sees half of it.
+	s.mu.Unlock()                   // Release before waiting on the group commit.
+	if done == nil {                // Deletes of missing keys, nothing changed.
+		return nil // Nothing to wait for.
+	} // End of empty check.
+	return wal.Wait(ctx, done) // Only returns nil once the unit is on disk.
+} // End of Update method.
+
+func (t *Tx) Get(key string) (string, bool) { // Value of key as the transaction sees it. Like Peek it ignores expiries no expire has applied yet, so every node applying the log reads alike.
+	if v, ok := t.writes[key]; ok { // Written by this transaction.
+		if v == nil { // Deleted by it.
+			return "", false // Gone.
+		} // End of delete check.
+		return *v, true // Its own write.
+	} // End of overlay check.
+	return t.s.load(key) // As the store holds it.
+} // End of Get method.
+
+func (t *Tx) Meta(key string) (KeyMeta, bool) { // Metadata of key as it was before the transaction, false if it doesn't exist.
+	if _, ok := t.s.data.Get(key); !ok { // Missing key.
+		return KeyMeta{}, false // No metadata.
+	} // End of exists check.
+	if m, ok := t.s.meta[key]; ok { // Written since startup.
+		return *m, true // Copy, the batch updates the original.
+	} // End of metadata check.
+	return KeyMeta{RaftIndex: -1}, true // Restored from the WAL, history unknown.
+} // End of Meta method.
+
+func (t *Tx) ExpiresAt(key string) (int64, bool) { // Unix ms expiry key had before the transaction, false if it is permanent or missing.
+	at, ok := t.s.expires[key] // Only keys written with a TTL have one.
+	return at, ok              // Compared against a time the entry carries, never the clock.
+} // End of ExpiresAt method.
+
+func (t *Tx) Index() int { // Raft index of the entry the transaction applies, -1 outside the log; the same on every node.
+	return t.index // Taken from ctx by Update.
+} // End of Index method.
+
+func (t *Tx) Set(key string, value string) { // Writes value to key once the transaction commits.
+	t.ops = append(t.ops, BatchOp{Key: key, Value: value}) // Applied in order.
+	t.writes[key] = &value                                 // Later reads see it.
+} // End of Set method.
+
+func (t *Tx) SetExpiring(key string, value string, at int64) { // Writes value to key, expiring at unix ms at, once the transaction commits.
+	t.ops = append(t.ops, BatchOp{Key: key, Value: value, ExpiresAt: at}) // As a put with a ttl in a Batch.
+	t.writes[key] = &value                                                // Later reads see it.
+} // End of SetExpiring method.
+
+func (t *Tx) Delete(key string) { // Removes key once the transaction commits.
+	t.ops = append(t.ops, BatchOp{Delete: true, Key: key}) // Deleting a missing key is a no-op.
+	t.writes[key] = nil                                    // Later reads miss it.
+} // End of Delete method.
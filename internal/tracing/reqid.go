@@ -0,0 +1,54 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"sync/atomic"
+)
+
+// A request ID names one client command or HTTP request. It rides along in
+// the context, so the raft and WAL log lines a request causes can carry it
+// and be matched up with its access log entry. IDs only live on the node
+// that took the request: followers apply the entry without one.
+
+type requestIDKey struct{}
+
+var (
+	idPrefix  = newIDPrefix() // tells apart IDs from different nodes and restarts
+	idCounter atomic.Uint64
+)
+
+func newIDPrefix() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// NewRequestID returns an ID no other request on any node is likely to have.
+func NewRequestID() string {
+	var buf [32]byte // prefix, dash and counter fit, so the string is the one allocation
+	b := append(append(buf[:0], idPrefix...), '-')
+	return string(strconv.AppendUint(b, idCounter.Add(1), 10))
+}
+
+// WithRequestID returns ctx carrying the request ID id.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request ID ctx carries, or "".
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// LogTag is " req=<id>" for appending to a log line, or "" if ctx carries no
+// request ID.
+func LogTag(ctx context.Context) string {
+	if id := RequestID(ctx); id != "" {
+		return " req=" + id
+	}
+	return ""
+}
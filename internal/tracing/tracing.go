@@ -0,0 +1,69 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/mathdee/KV-Store"
+
+// Tracing is optional. Until Init installs a provider, otel's global provider
+// is a no-op, so the spans below cost next to nothing: a few small
+// allocations, which the command loop skips, see Enabled.
+
+var enabled atomic.Bool
+
+// Init installs a tracer provider for the given exporter ("" disables tracing,
+// "stdout" pretty-prints finished spans). The returned func flushes and stops it.
+func Init(exporter, serviceID string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	switch exporter {
+	case "":
+		return func(context.Context) error { return nil }, nil
+	case "stdout":
+		exp, err := stdouttrace.New(stdouttrace.WithPrettyPrint())
+		if err != nil {
+			return nil, err
+		}
+		tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exp))
+		otel.SetTracerProvider(tp)
+		enabled.Store(true)
+		fmt.Printf("[%s] Tracing enabled (exporter=%s)\n", serviceID, exporter)
+		return tp.Shutdown, nil
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", exporter)
+	}
+}
+
+// Enabled reports whether Init installed a provider that records spans.
+func Enabled() bool {
+	return enabled.Load()
+}
+
+// Start opens a span named after the step of the command path it covers.
+func Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, opts...)
+}
+
+// Middleware picks up W3C trace context from incoming HTTP headers and wraps
+// each request in a server span, so callers can stitch our spans into theirs.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := otel.Tracer(tracerName).Start(ctx, "http "+r.URL.Path,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(attribute.String("http.method", r.Method), attribute.String("http.request_id", RequestID(ctx))))
+		defer span.End()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
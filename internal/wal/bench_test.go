@@ -0,0 +1,91 @@
+package wal
+
+import (
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+// The fsync policies the benchmarks compare: the default group commit, one
+// fsync per write (a batch goes out as soon as it holds one entry), and
+// async mode, which acks before the fsync. Run them with e.g.
+//
+//	go test -bench WriteEntry -benchmem ./internal/wal
+var benchPolicies = []struct {
+	name   string
+	mode   Mode
+	commit CommitOptions
+}{
+	{"sync", ModeSync, DefaultCommitOptions},
+	{"sync-per-write", ModeSync, CommitOptions{Interval: DefaultCommitOptions.Interval, MaxEntries: 1}},
+	{"async", ModeAsync, DefaultCommitOptions},
+}
+
+const benchKeys = 10000
+
+var benchKeyNames = func() []string {
+	keys := make([]string, benchKeys)
+	for i := range keys {
+		keys[i] = "bench:" + strconv.Itoa(i)
+	}
+	return keys
+}()
+
+// benchWAL opens a WAL in a temp directory with the given policy.
+func benchWAL(b *testing.B, mode Mode, commit CommitOptions) *WAL {
+	b.Helper()
+	w, err := NewWAL(filepath.Join(b.TempDir(), "bench_wal.log"))
+	if err != nil {
+		b.Fatalf("Failed to create WAL: %v", err)
+	}
+	b.Cleanup(func() { w.Close() })
+	w.SetMode(mode)
+	w.SetCommitOptions(commit)
+	return w
+}
+
+// BenchmarkWriteEntry has one writer, so each write waits out a whole group
+// commit in the sync policies.
+func BenchmarkWriteEntry(b *testing.B) {
+	for _, p := range benchPolicies {
+		b.Run(p.name, func(b *testing.B) {
+			w := benchWAL(b, p.mode, p.commit)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := w.WriteEntry(benchKeyNames[i%benchKeys], "updated-value"); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			w.Sync() // async writes still queued count too
+			b.ReportMetric(float64(w.CommitStats().Entries)/float64(max(w.flushes.Load(), 1)), "writes/flush")
+		})
+	}
+}
+
+// BenchmarkWriteEntryParallel has many writers, which is where group commit
+// shares one fsync between them.
+func BenchmarkWriteEntryParallel(b *testing.B) {
+	for _, p := range benchPolicies {
+		b.Run(p.name, func(b *testing.B) {
+			w := benchWAL(b, p.mode, p.commit)
+			var writers atomic.Int64
+			b.SetParallelism(16) // writers mostly wait on the fsync
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for i := int(writers.Add(1)) * 7919; pb.Next(); i++ {
+					if err := w.WriteEntry(benchKeyNames[i%benchKeys], "updated-value"); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+			b.StopTimer()
+			w.Sync() // async writes still queued count too
+			b.ReportMetric(float64(w.CommitStats().Entries)/float64(max(w.flushes.Load(), 1)), "writes/flush")
+		})
+	}
+}
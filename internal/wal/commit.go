@@ -0,0 +1,175 @@
+package wal
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// A group commit used to happen only on the 5ms ticker, so a lone write
+// always waited for the tick and a burst could pile up into one huge batch.
+// Now a batch is also flushed as soon as it reaches MaxEntries or MaxBytes,
+// and no batch takes more than that; the rest goes in the next one.
+
+// Mode is when a queued write is acknowledged.
+//
+// In the default sync mode a writer waits for its group commit's fsync. In
+// async mode it is told the write is durable as soon as it is queued, so a
+// crash can lose acked writes: at most what is queued, which is bounded by
+// the size triggers (a writer finding the queue full waits for the flush
+// like in sync mode), and at most one Interval plus one fsync old. It exists
+// to measure what the fsync costs, not for data anyone wants to keep.
+type Mode string
+
+const (
+	ModeSync  Mode = "sync"
+	ModeAsync Mode = "async"
+)
+
+// ParseMode maps a -wal-mode flag value to a Mode.
+func ParseMode(s string) (Mode, error) {
+	switch Mode(s) {
+	case "", ModeSync:
+		return ModeSync, nil
+	case ModeAsync:
+		return ModeAsync, nil
+	}
+	return "", fmt.Errorf("unknown WAL mode %q (want sync or async)", s)
+}
+
+// ackedNow is what async mode hands writers instead of their batch's channel.
+var ackedNow = func() chan error {
+	c := make(chan error)
+	close(c)
+	return c
+}()
+
+// CommitOptions decides when queued writes are group committed.
+type CommitOptions struct {
+	Interval   time.Duration // flush whatever is queued this often
+	MaxEntries int           // flush early once this many writes are queued, 0 for no limit
+	MaxBytes   int           // or once they add up to this many bytes, 0 for no limit
+}
+
+var DefaultCommitOptions = CommitOptions{
+	Interval:   5 * time.Millisecond,
+	MaxEntries: 1000,
+	MaxBytes:   1 << 20,
+}
+
+// CommitStats describes the group commits that carried writes so far.
+type CommitStats struct {
+	Flushes         int64   `json:"flushes"`
+	Entries         int64   `json:"entries"`
+	Bytes           int64   `json:"bytes"`
+	SizeTriggered   int64   `json:"sizeTriggered"` // flushes started by MaxEntries or MaxBytes rather than the interval
+	AsyncLost       int64   `json:"asyncLost"`     // writes async mode acked whose group commit then failed
+	LastEntries     int     `json:"lastEntries"`
+	LastBytes       int     `json:"lastBytes"`
+	MaxBatchEntries int     `json:"maxBatchEntries"`
+	MaxBatchBytes   int     `json:"maxBatchBytes"`
+	AvgEntries      float64 `json:"avgEntries"`
+	AvgBytes        float64 `json:"avgBytes"`
+}
+
+type commitStats struct {
+	mu sync.Mutex
+	CommitStats
+}
+
+func (c *commitStats) record(entries, bytes int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Flushes++
+	c.Entries += int64(entries)
+	c.Bytes += int64(bytes)
+	c.LastEntries, c.LastBytes = entries, bytes
+	c.MaxBatchEntries = max(c.MaxBatchEntries, entries)
+	c.MaxBatchBytes = max(c.MaxBatchBytes, bytes)
+}
+
+func (c *commitStats) lost(batch []pendingWrite) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, pw := range batch {
+		if pw.acked {
+			c.AsyncLost++
+		}
+	}
+}
+
+func (c *commitStats) sizeTriggered() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.SizeTriggered++
+}
+
+// SetCommitOptions changes when group commits happen. A zero Interval keeps
+// the current one.
+func (w *WAL) SetCommitOptions(o CommitOptions) {
+	if o.Interval <= 0 {
+		o.Interval = w.CommitOptions().Interval
+	}
+	w.pendingMu.Lock()
+	w.commit = o
+	w.pendingMu.Unlock()
+	w.flushTicker.Reset(o.Interval)
+}
+
+// SetMode switches between acking writes on fsync and on queueing.
+func (w *WAL) SetMode(m Mode) {
+	w.pendingMu.Lock()
+	defer w.pendingMu.Unlock()
+	w.mode = m
+}
+
+// Mode returns when writes are acknowledged.
+func (w *WAL) Mode() Mode {
+	w.pendingMu.Lock()
+	defer w.pendingMu.Unlock()
+	return w.mode
+}
+
+// CommitOptions returns the current group commit triggers.
+func (w *WAL) CommitOptions() CommitOptions {
+	w.pendingMu.Lock()
+	defer w.pendingMu.Unlock()
+	return w.commit
+}
+
+// CommitStats returns batch sizes achieved so far.
+func (w *WAL) CommitStats() CommitStats {
+	w.stats.mu.Lock()
+	defer w.stats.mu.Unlock()
+	st := w.stats.CommitStats
+	if st.Flushes > 0 {
+		st.AvgEntries = float64(st.Entries) / float64(st.Flushes)
+		st.AvgBytes = float64(st.Bytes) / float64(st.Flushes)
+	}
+	return st
+}
+
+// full reports whether the queued writes have reached a size trigger.
+// Callers hold pendingMu.
+func (w *WAL) full() bool {
+	return (w.commit.MaxEntries > 0 && len(w.pending) >= w.commit.MaxEntries) ||
+		(w.commit.MaxBytes > 0 && w.pendingBytes >= w.commit.MaxBytes)
+}
+
+// take removes the next batch from the queue: everything, or as much as
+// the size triggers allow (at least one write). Callers hold pendingMu.
+func (w *WAL) take() []pendingWrite {
+	n, bytes := 0, 0
+	for n < len(w.pending) {
+		if n > 0 && ((w.commit.MaxEntries > 0 && n >= w.commit.MaxEntries) ||
+			(w.commit.MaxBytes > 0 && bytes+len(w.pending[n].entry) > w.commit.MaxBytes)) {
+			break
+		}
+		bytes += len(w.pending[n].entry)
+		n++
+	}
+	batch := w.pending[:n:n]
+	w.pending = append(make([]pendingWrite, 0, max(len(w.pending)-n, 1000)), w.pending[n:]...)
+	w.pendingBytes -= bytes
+	return batch
+}
@@ -0,0 +1,141 @@
+package wal
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Compaction replaces the log with one record per live key without stopping
+// writes for the whole rewrite:
+//
+//  1. BeginCompaction flushes everything queued so far and starts keeping a
+//     copy of every later group commit (the tail). The caller takes its
+//     snapshot at the same moment, under its own lock, so the snapshot and
+//     the tail never overlap.
+//  2. FinishCompaction writes the snapshot records to a new file (or over
+//     the spare one the last compaction retired), appends the tail, and
+//     renames it over the old log.
+//
+// A crash before the rename leaves the old log untouched; after it, the new
+// log holds the same state.
+
+// FormatSet renders a SET the way QueueEntry logs it.
+func FormatSet(key, value string) string {
+	if containsComma(key) {
+		return FormatOp("SET", key, value)
+	}
+	return key + "," + value + "\n"
+}
+
+// FormatOp renders an operation record the way QueueOp logs it.
+func FormatOp(op string, args ...string) string {
+	return formatOp(op, args)
+}
+
+// BeginCompaction flushes pending writes and starts capturing the tail.
+func (w *WAL) BeginCompaction() {
+	w.drain()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.capturing = true
+	w.tail = nil
+}
+
+// AbortCompaction stops capturing after a failed compaction; the old log stays in use.
+func (w *WAL) AbortCompaction() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.capturing = false
+	w.tail = nil
+}
+
+// FinishCompaction swaps in a log made of records plus the captured tail.
+func (w *WAL) FinishCompaction(records []string) error {
+	tmp := w.path + ".compact"
+	f, err := w.compactionTarget(tmp)
+	if err != nil {
+		w.AbortCompaction()
+		return err
+	}
+	fail := func(err error) error {
+		f.Close()
+		os.Remove(tmp)
+		w.AbortCompaction()
+		return err
+	}
+
+	// The bulk of the work happens while writes carry on into the old log.
+	bw := bufio.NewWriter(f)
+	for _, r := range records {
+		bw.WriteString(r)
+	}
+	if err := bw.Flush(); err != nil {
+		return fail(err)
+	}
+
+	// No group commit may run while the tail is copied and the files swapped.
+	w.flushMu.Lock()
+	defer w.flushMu.Unlock()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, e := range w.tail {
+		if _, err := f.WriteString(e); err != nil {
+			return fail(err)
+		}
+	}
+	// A recycled file may be longer than what was just written.
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fail(err)
+	}
+	if err := f.Truncate(size); err != nil {
+		return fail(err)
+	}
+	if err := f.Sync(); err != nil {
+		return fail(err)
+	}
+	if w.recycle {
+		// The old log stays reachable as the spare once the rename below
+		// replaces it; without the link the rename would free it.
+		os.Remove(w.path + spareSuffix)
+		os.Link(w.path, w.path+spareSuffix)
+	}
+	if err := os.Rename(tmp, w.path); err != nil {
+		return fail(err)
+	}
+	syncDir(filepath.Dir(w.path))
+
+	w.file.Close()
+	w.file = f
+	w.size = size
+	w.allocated = size
+	w.reserve(0)
+	w.capturing = false
+	w.tail = nil
+	return nil
+}
+
+// compactionTarget opens the file a compaction writes to: the spare, if
+// recycling kept one, or a new empty file.
+func (w *WAL) compactionTarget(tmp string) (*os.File, error) {
+	w.mu.Lock()
+	recycle := w.recycle
+	w.mu.Unlock()
+	if recycle {
+		if err := os.Rename(w.path+spareSuffix, tmp); err == nil {
+			return os.OpenFile(tmp, os.O_WRONLY, 0644)
+		}
+	}
+	return os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+}
+
+// syncDir makes a rename durable; failures only weaken crash safety, so they're ignored.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
@@ -0,0 +1,114 @@
+//go:build failpoints
+
+package wal
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/mathdee/KV-Store/internal/failpoint"
+)
+
+func TestFailpointBeforeFsyncIsNotAcked(t *testing.T) {
+	filename := "test_wal_failpoint.log"
+	os.Remove(filename)
+	defer os.Remove(filename)
+	defer failpoint.Reset()
+
+	w, err := NewWAL(filename)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	if err := w.WriteEntry("kept", "1"); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	failpoint.Enable(failpoint.WALBeforeFsync, failpoint.Action{Kind: "error", Count: 1})
+	if err := w.WriteEntry("lost", "2"); err == nil {
+		t.Fatal("Write went through the failpoint")
+	}
+	if err := w.WriteEntry("after", "3"); err != nil {
+		t.Fatalf("Failed to write once the failpoint ran out: %v", err)
+	}
+	w.Close()
+
+	data, err := Recover(filename)
+	if err != nil {
+		t.Fatalf("Failed to recover: %v", err)
+	}
+	if _, ok := data["lost"]; ok || data["kept"] != "1" || data["after"] != "3" || len(data) != 2 {
+		t.Errorf("Expected only the acked writes, got %v", data)
+	}
+}
+
+// TestFlusherSurvivesPanic panics in the middle of a group commit, with
+// the file lock held, and checks the batch fails and the next one goes
+// through the restarted flusher.
+func TestFlusherSurvivesPanic(t *testing.T) {
+	filename := "test_wal_panic.log"
+	os.Remove(filename)
+	defer os.Remove(filename)
+	defer failpoint.Reset()
+
+	w, err := NewWAL(filename)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	failpoint.Enable(failpoint.WALBeforeFsync, failpoint.Action{Kind: "panic", Count: 1})
+	if err := w.WriteEntry("lost", "1"); !errors.Is(err, ErrFlushPanicked) {
+		t.Fatalf("Expected ErrFlushPanicked, got %v", err)
+	}
+	if err := w.WriteEntry("after", "2"); err != nil {
+		t.Fatalf("Failed to write after the panic: %v", err)
+	}
+	w.Close()
+
+	data, err := Recover(filename)
+	if err != nil {
+		t.Fatalf("Failed to recover: %v", err)
+	}
+	if data["after"] != "2" || len(data) != 1 {
+		t.Errorf("Expected only the write after the panic, got %v", data)
+	}
+}
+
+// TestCrashBeforeFsync crashes a child process in the middle of a group
+// commit and checks everything it acked before that recovers.
+func TestCrashBeforeFsync(t *testing.T) {
+	filename := "test_wal_crash.log"
+	if os.Getenv("WAL_CRASH_CHILD") == "1" {
+		w, err := NewWAL(filename)
+		if err != nil {
+			os.Exit(1)
+		}
+		for _, key := range []string{"a", "b", "c"} {
+			if w.WriteEntry(key, "acked") != nil {
+				os.Exit(1)
+			}
+		}
+		failpoint.Enable(failpoint.WALBeforeFsync, failpoint.Action{Kind: "crash"})
+		w.WriteEntry("d", "never acked")
+		os.Exit(0) // not reached
+	}
+	os.Remove(filename)
+	defer os.Remove(filename)
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestCrashBeforeFsync$")
+	cmd.Env = append(os.Environ(), "WAL_CRASH_CHILD=1")
+	err := cmd.Run()
+	var exit *exec.ExitError
+	if !errors.As(err, &exit) || exit.ExitCode() != failpoint.CrashExitCode {
+		t.Fatalf("Expected the child to crash with %d, got %v", failpoint.CrashExitCode, err)
+	}
+
+	data, err := Recover(filename)
+	if err != nil {
+		t.Fatalf("Failed to recover after the crash: %v", err)
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		if data[key] != "acked" {
+			t.Errorf("Acked key %s lost in the crash: %v", key, data)
+		}
+	}
+}
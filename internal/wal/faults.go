@@ -0,0 +1,89 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Faults simulates a misbehaving disk so tests and operators can check that
+// failed writes come back as errors instead of being acknowledged.
+type Faults struct {
+	SyncErrorPercent    int           `json:"syncErrorPercent"`    // chance a group commit's fsync fails
+	PartialWritePercent int           `json:"partialWritePercent"` // chance a group commit stops half way through an entry
+	SyncDelay           time.Duration `json:"syncDelayNs"`         // slow disk: added to every fsync
+}
+
+var (
+	ErrInjectedSync    = errors.New("injected fsync failure")
+	ErrInjectedPartial = errors.New("injected partial write")
+)
+
+// ParseFaults reads the -wal-faults flag, e.g. "sync-error=10,partial=5,delay=20ms".
+func ParseFaults(spec string) (Faults, error) {
+	var f Faults
+	if spec == "" {
+		return f, nil
+	}
+	for _, part := range strings.Split(spec, ",") {
+		name, val, ok := strings.Cut(part, "=")
+		if !ok {
+			return f, fmt.Errorf("wal faults: %q is not name=value", part)
+		}
+		var err error
+		switch name {
+		case "sync-error":
+			f.SyncErrorPercent, err = strconv.Atoi(val)
+		case "partial":
+			f.PartialWritePercent, err = strconv.Atoi(val)
+		case "delay":
+			f.SyncDelay, err = time.ParseDuration(val)
+		default:
+			return f, fmt.Errorf("wal faults: unknown fault %q", name)
+		}
+		if err != nil {
+			return f, fmt.Errorf("wal faults: %s: %v", name, err)
+		}
+	}
+	return f, nil
+}
+
+// faultState holds the active faults and the RNG that decides when they fire.
+type faultState struct {
+	mu     sync.Mutex
+	faults Faults
+	rng    *rand.Rand
+}
+
+func (s *faultState) get() Faults {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.faults
+}
+
+func (s *faultState) roll(percent int) bool {
+	if percent <= 0 {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.rng == nil {
+		s.rng = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return s.rng.Intn(100) < percent
+}
+
+// SetFaults replaces the injected disk faults; the zero value turns them off.
+func (w *WAL) SetFaults(f Faults) {
+	w.faults.mu.Lock()
+	defer w.faults.mu.Unlock()
+	w.faults.faults = f
+}
+
+func (w *WAL) Faults() Faults {
+	return w.faults.get()
+}
@@ -0,0 +1,12 @@
+package wal
+
+import (
+	"os"
+	"syscall"
+)
+
+const fallocKeepSize = 0x1 // FALLOC_FL_KEEP_SIZE: allocate blocks, leave the size alone
+
+func preallocate(f *os.File, off, n int64) error {
+	return syscall.Fallocate(int(f.Fd()), fallocKeepSize, off, n)
+}
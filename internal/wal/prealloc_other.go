@@ -0,0 +1,12 @@
+//go:build !linux
+
+package wal
+
+import (
+	"errors"
+	"os"
+)
+
+func preallocate(f *os.File, off, n int64) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,138 @@
+package wal
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/mathdee/KV-Store/internal/bitmap"
+)
+
+// Besides the original "key,value" SET lines, the WAL holds operation
+// records for writes that aren't a plain overwrite:
+//
+//	!ZSET "key" "zstd" "<base64 compressed value>"
+//	!APPEND "key" "value"
+//	!SETBIT "key" "offset" "bit"
+//	!DEL "key"
+//	!RENAME "old" "new"
+//	!COPY "src" "dst"
+//	!FLUSHALL
+//	!FLUSHNS "namespace"
+//	!EXPIREAT "key" "unix ms"
+//	!APPLIED "raft index"
+//
+// Arguments are Go-quoted so keys and values may contain commas or spaces.
+// An old SET line can never look like this: its key has no whitespace, so
+// its first comma comes before any space, while a record's op is followed by
+// a space, or ends the line as FLUSHALL does, before any comma.
+
+// QueueOp adds an operation record to the next group commit without waiting for it.
+func (w *WAL) QueueOp(op string, args ...string) <-chan error {
+	return w.queue(formatOp(op, args))
+}
+
+func formatOp(op string, args []string) string {
+	var b strings.Builder
+	b.WriteString("!")
+	b.WriteString(op)
+	for _, a := range args {
+		b.WriteString(" ")
+		b.WriteString(strconv.Quote(a))
+	}
+	b.WriteString("\n")
+	return b.String()
+}
+
+// parseOp decodes an operation record, ok is false for anything else.
+func parseOp(line string) (op string, args []string, ok bool) {
+	if !strings.HasPrefix(line, "!") {
+		return "", nil, false
+	}
+	space := strings.IndexByte(line, ' ')
+	if space == -1 {
+		space = len(line) // no arguments, as in "!FLUSHALL"
+	}
+	if comma := strings.IndexByte(line, ','); comma != -1 && comma < space {
+		return "", nil, false // an old-style SET whose key starts with "!"
+	}
+	if space == 1 {
+		return "", nil, false
+	}
+	op = line[1:space]
+	rest := line[space:]
+	for {
+		rest = strings.TrimLeft(rest, " ")
+		if rest == "" {
+			return op, args, true
+		}
+		quoted, err := strconv.QuotedPrefix(rest)
+		if err != nil {
+			return "", nil, false // torn or corrupt record
+		}
+		arg, err := strconv.Unquote(quoted)
+		if err != nil {
+			return "", nil, false
+		}
+		args = append(args, arg)
+		rest = rest[len(quoted):]
+	}
+}
+
+// Replay applies one record to st.
+func Replay(st State, r Record) {
+	args := r.Args
+	switch r.Op {
+	case "SET":
+		if len(args) == 2 {
+			st.Set(args[0], args[1])
+		}
+	case "APPEND":
+		if len(args) == 2 {
+			v, _ := st.Get(args[0])
+			st.Set(args[0], v+args[1])
+		}
+	case "SETBIT":
+		if len(args) == 3 {
+			offset, err1 := bitmap.ParseOffset(args[1])
+			bit, err2 := bitmap.ParseBit(args[2])
+			if err1 == nil && err2 == nil {
+				v, _ := st.Get(args[0])
+				v, _ = bitmap.Set(v, offset, bit)
+				st.Set(args[0], v)
+			}
+		}
+	case "DEL":
+		if len(args) == 1 {
+			st.Delete(args[0])
+		}
+	case "RENAME":
+		if len(args) != 2 {
+			return
+		}
+		if v, ok := st.Get(args[0]); ok {
+			st.Delete(args[0])
+			st.Set(args[1], v)
+		}
+	case "COPY":
+		if len(args) != 2 {
+			return
+		}
+		if v, ok := st.Get(args[0]); ok {
+			st.Set(args[1], v)
+		}
+	case "FLUSHALL": // truncation marker, nothing before it survives
+		st.Clear()
+	case "FLUSHNS":
+		if len(args) == 1 {
+			st.DeletePrefix(args[0] + ":")
+		}
+	case "EXPIREAT":
+		e, ok := st.(Expirer)
+		if !ok || len(args) != 2 {
+			return
+		}
+		if at, err := strconv.ParseInt(args[1], 10, 64); err == nil {
+			e.Expire(args[0], at)
+		}
+	}
+}
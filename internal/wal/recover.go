@@ -0,0 +1,263 @@
+package wal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/mathdee/KV-Store/internal/compress"
+)
+
+// Recovery used to scan the log line by line into a map and hand the whole
+// map to the store, so a big log cost one core's worth of parsing plus a
+// second full copy of the data. RecoverInto streams instead: the file is
+// cut into chunks at line boundaries, workers parse (and decompress) chunks
+// in parallel, and the records are applied in log order one chunk at a
+// time.
+
+// Record is one decoded WAL line. Plain "key,value" lines and compressed
+// ZSET records both come back as SET with the uncompressed value.
+type Record struct {
+	Op   string
+	Args []string
+}
+
+// State is what Replay applies records to.
+type State interface {
+	Get(key string) (string, bool)
+	Set(key, value string)
+	Delete(key string)
+	DeletePrefix(prefix string)
+	Clear()
+}
+
+// Expirer is a State that keeps key expiries, see EXPIREAT. Others replay
+// expiring keys as permanent ones.
+type Expirer interface {
+	Expire(key string, at int64) // at is in unix milliseconds
+}
+
+// RecoverOptions tunes RecoverInto. The zero value is usable.
+type RecoverOptions struct {
+	ChunkBytes    int                // bytes parsed per chunk, 4 MiB if 0
+	Workers       int                // chunks parsed at once, GOMAXPROCS if 0
+	Progress      func(RecoverStats) // called every ProgressEvery while recovering
+	ProgressEvery time.Duration      // 1s if 0
+}
+
+const defaultChunkBytes = 4 << 20
+
+// RecoverStats reports how far recovery got.
+type RecoverStats struct {
+	Bytes      int64 // bytes of the log read so far
+	TotalBytes int64 // size of the log
+	Records    int64 // records applied so far
+	Elapsed    time.Duration
+}
+
+// Recover replays filename into a map. A missing file is an empty log.
+func Recover(filename string) (map[string]string, error) {
+	data := make(map[string]string)
+	_, err := RecoverInto(filename, RecoverOptions{}, func(records []Record) {
+		for _, r := range records {
+			Replay(mapState(data), r)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+type chunk struct {
+	data    []byte
+	records chan []Record // receives the parsed chunk, buffered
+}
+
+// RecoverInto parses filename and calls apply with its records, chunk by
+// chunk, in log order. apply runs on the calling goroutine.
+func RecoverInto(filename string, opts RecoverOptions, apply func([]Record)) (RecoverStats, error) {
+	start := time.Now()
+	var stats RecoverStats
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return stats, nil
+	}
+	if err != nil {
+		return stats, err
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err == nil {
+		stats.TotalBytes = info.Size()
+	}
+
+	chunkBytes := opts.ChunkBytes
+	if chunkBytes <= 0 {
+		chunkBytes = defaultChunkBytes
+	}
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	every := opts.ProgressEvery
+	if every <= 0 {
+		every = time.Second
+	}
+
+	// The reader hands chunks to the workers and, in the same order, to
+	// us. ordered is bounded, so at most a few chunks per worker are held
+	// in memory at once.
+	jobs := make(chan chunk)
+	ordered := make(chan chunk, 2*workers)
+	readErr := make(chan error, 1)
+	go func() {
+		defer close(jobs)
+		defer close(ordered)
+		readErr <- readChunks(f, chunkBytes, func(data []byte) {
+			c := chunk{data: data, records: make(chan []Record, 1)}
+			ordered <- c
+			jobs <- c
+		})
+	}()
+	for range workers {
+		go func() {
+			for c := range jobs {
+				c.records <- parseChunk(c.data)
+			}
+		}()
+	}
+
+	lastReport := start
+	for c := range ordered {
+		records := <-c.records
+		apply(records)
+		stats.Bytes += int64(len(c.data))
+		stats.Records += int64(len(records))
+		if opts.Progress != nil && time.Since(lastReport) >= every {
+			lastReport = time.Now()
+			stats.Elapsed = lastReport.Sub(start)
+			opts.Progress(stats)
+		}
+	}
+	stats.Elapsed = time.Since(start)
+	return stats, <-readErr
+}
+
+// readChunks calls emit with consecutive pieces of r that each end at a
+// line boundary (or at EOF).
+func readChunks(r io.Reader, size int, emit func([]byte)) error {
+	var carry []byte // start of a line the previous chunk cut off
+	for {
+		buf := make([]byte, len(carry), max(size, 2*len(carry)))
+		copy(buf, carry)
+		n, err := io.ReadFull(r, buf[len(carry):cap(buf)])
+		buf = buf[:len(carry)+n]
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			if len(buf) > 0 {
+				emit(buf) // a torn last line is kept, parseLine decides
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		cut := bytes.LastIndexByte(buf, '\n')
+		if cut == -1 {
+			if len(buf) >= maxRecordSize {
+				return bufio.ErrTooLong
+			}
+			carry = buf // one line bigger than a chunk, read on
+			continue
+		}
+		carry = buf[cut+1:]
+		emit(buf[:cut+1])
+	}
+}
+
+func parseChunk(data []byte) []Record {
+	records := make([]Record, 0, bytes.Count(data, []byte{'\n'})+1)
+	for len(data) > 0 {
+		line := data
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line, data = data[:i], data[i+1:]
+		} else {
+			data = nil
+		}
+		line = bytes.TrimSuffix(line, []byte{'\r'})
+		if r, ok := parseLine(string(line)); ok {
+			records = append(records, r)
+		}
+	}
+	return records
+}
+
+// ParseLine decodes one WAL line the way recovery does, for tools that
+// need to see the lines recovery skips.
+func ParseLine(line string) (Record, bool) {
+	return parseLine(line)
+}
+
+// parseLine decodes one line, ok is false for blank, corrupt or
+// undecodable ones, which recovery has always skipped.
+func parseLine(line string) (Record, bool) {
+	if op, args, ok := parseOp(line); ok {
+		if op == "ZSET" {
+			return decodeZSet(args)
+		}
+		return Record{Op: op, Args: args}, true
+	}
+	key, value, ok := strings.Cut(line, ",") // values may contain commas
+	if !ok {
+		return Record{}, false
+	}
+	return Record{Op: "SET", Args: []string{key, value}}, true
+}
+
+// decodeZSet turns a value the store kept compressed back into a plain SET.
+func decodeZSet(args []string) (Record, bool) {
+	if len(args) != 3 {
+		return Record{}, false
+	}
+	codec, err := compress.Parse(args[1])
+	if err != nil {
+		return Record{}, false
+	}
+	packed, err := base64.StdEncoding.DecodeString(args[2])
+	if err != nil {
+		return Record{}, false
+	}
+	v, err := codec.Decode(string(packed))
+	if err != nil {
+		return Record{}, false
+	}
+	return Record{Op: "SET", Args: []string{args[0], v}}, true
+}
+
+// mapState lets Replay rebuild a plain map.
+type mapState map[string]string
+
+func (m mapState) Get(key string) (string, bool) {
+	v, ok := m[key]
+	return v, ok
+}
+
+func (m mapState) Set(key, value string) { m[key] = value }
+func (m mapState) Delete(key string)     { delete(m, key) }
+func (m mapState) Clear()                { clear(m) }
+
+func (m mapState) DeletePrefix(prefix string) {
+	for k := range m {
+		if strings.HasPrefix(k, prefix) {
+			delete(m, k)
+		}
+	}
+}
+
+// maxRecordSize bounds one WAL line during recovery; it is far above any
+// value the server accepts, even quoted or base64'd.
+const maxRecordSize = 64 << 20
@@ -1,45 +1,91 @@
 package wal
 
 import (
-	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/mathdee/KV-Store/internal/crash"
+	"github.com/mathdee/KV-Store/internal/failpoint"
+	"github.com/mathdee/KV-Store/internal/tracing"
 )
 
+// ErrFlushPanicked fails the writes of a group commit that panicked. The
+// flusher is restarted and carries on with the next batch.
+var ErrFlushPanicked = errors.New("group commit panicked, see the CRASH report")
+
 type pendingWrite struct {
 	entry string
 	done  chan error
+	acked bool // async mode already told the writer it was durable
 }
 
 type WAL struct {
 	file *os.File
+	path string
 	mu   sync.Mutex
 
 	// Group commit
-	pending     []pendingWrite
-	pendingMu   sync.Mutex
-	flushTicker *time.Ticker
-	closeCh     chan struct{}
+	pending      []pendingWrite
+	pendingBytes int
+	pendingMu    sync.Mutex
+	commit       CommitOptions // guarded by pendingMu
+	mode         Mode          // guarded by pendingMu
+	flushTicker  *time.Ticker
+	kick         chan struct{} // a size trigger was reached
+	closeCh      chan struct{}
+	stats        commitStats
+
+	flushes atomic.Int64 // number of group commits written so far
+	size    int64        // bytes of the file known to be good, a failed flush is cut back to this
+	faults  faultState   // injected disk failures, off by default
+
+	flushMu   sync.Mutex // one group commit at a time, so batches hit the file in order
+	capturing bool       // compaction in progress: keep a copy of what gets flushed
+	tail      []string   // entries flushed since BeginCompaction
+
+	barrier func() error // runs before every group commit, an error fails the batch
+
+	prealloc  int64 // reserve disk space this far ahead of size, 0 disables; guarded by mu
+	allocated int64 // end of the space reserved so far
+	recycle   bool  // keep the log compaction retires for the next one to overwrite
+	syncErr   error // first group commit failure since the last Sync
 }
 
 func NewWAL(filename string) (*WAL, error) {
-	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	// Writes go to explicit offsets rather than O_APPEND, so a recycled
+	// file can be overwritten from the start.
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		return nil, err
 	}
 
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
 	w := &WAL{
 		file:        f,
+		path:        filename,
+		size:        info.Size(),
+		allocated:   info.Size(),
 		pending:     make([]pendingWrite, 0, 1000),
-		flushTicker: time.NewTicker(5 * time.Millisecond), // Flush every 5ms
+		commit:      DefaultCommitOptions,
+		mode:        ModeSync,
+		flushTicker: time.NewTicker(DefaultCommitOptions.Interval),
+		kick:        make(chan struct{}, 1),
 		closeCh:     make(chan struct{}),
 	}
 
-	// Start background flusher
-	go w.flushLoop()
+	// Start background flusher, again if a batch makes it panic
+	go crash.Supervise("wal flusher", w.flushLoop, nil)
 
 	return w, nil
 }
@@ -50,31 +96,81 @@ func (w *WAL) flushLoop() {
 		select {
 		case <-w.flushTicker.C:
 			w.flush()
+		case <-w.kick:
+			w.stats.sizeTriggered()
+			w.flush()
 		case <-w.closeCh:
-			w.flush() // Final flush before close
+			w.drain() // Final flush before close
 			return
 		}
 	}
 }
 
-// flush writes all pending entries in ONE fsync
+// flush writes the next batch of pending entries in ONE fsync
 func (w *WAL) flush() {
+	w.flushMu.Lock()
+	defer w.flushMu.Unlock()
+
 	w.pendingMu.Lock()
 	if len(w.pending) == 0 {
 		w.pendingMu.Unlock()
 		return
 	}
 
-	// Grab all pending writes
-	toFlush := w.pending
-	w.pending = make([]pendingWrite, 0, 1000)
+	// Grab the next batch; if that leaves another full one, flush it right after
+	toFlush := w.take()
+	if w.full() {
+		w.signal()
+	}
 	w.pendingMu.Unlock()
 
+	// A panic must still answer the batch, or its writers wait forever.
+	answered, locked := false, false
+	defer func() {
+		if answered {
+			return
+		}
+		if locked {
+			w.file.Truncate(w.size) // as for a failed write, see below
+			w.allocated = w.size
+			w.mu.Unlock()
+		}
+		w.fail(toFlush, ErrFlushPanicked)
+	}()
+
+	if w.barrier != nil {
+		if err := w.barrier(); err != nil {
+			answered = true
+			w.fail(toFlush, err)
+			return
+		}
+	}
+
+	faults := w.faults.get()
+	partialAt := -1 // entry that gets torn in half, if the fault fires
+	if w.faults.roll(faults.PartialWritePercent) {
+		partialAt = len(toFlush) - 1
+	}
+
 	// Write all entries to file (one syscall per entry, but no sync yet)
 	w.mu.Lock()
-	var writeErr error
+	locked = true
+	batchBytes := 0
 	for _, pw := range toFlush {
-		if _, err := w.file.WriteString(pw.entry); err != nil {
+		batchBytes += len(pw.entry)
+	}
+	w.reserve(int64(batchBytes))
+	var writeErr error
+	written := int64(0)
+	for i, pw := range toFlush {
+		if i == partialAt {
+			w.file.WriteAt([]byte(pw.entry[:len(pw.entry)/2]), w.size+written)
+			writeErr = ErrInjectedPartial
+			break
+		}
+		n, err := w.file.WriteAt([]byte(pw.entry), w.size+written)
+		written += int64(n)
+		if err != nil {
 			writeErr = err
 			break
 		}
@@ -82,56 +178,248 @@ func (w *WAL) flush() {
 
 	// ONE fsync for ALL entries
 	if writeErr == nil {
-		writeErr = w.file.Sync()
+		if faults.SyncDelay > 0 {
+			time.Sleep(faults.SyncDelay)
+		}
+		if writeErr = failpoint.Inject(failpoint.WALBeforeFsync); writeErr == nil {
+			writeErr = w.file.Sync()
+		}
+		if writeErr == nil && w.faults.roll(faults.SyncErrorPercent) {
+			writeErr = ErrInjectedSync
+		}
 	}
+	if writeErr != nil {
+		w.stats.lost(toFlush)
+		// Nobody in this batch gets an OK, so don't leave their bytes (or a torn
+		// line) behind for recovery to replay.
+		w.file.Truncate(w.size)
+		w.allocated = w.size // truncating drops the reserved space too
+		if w.syncErr == nil {
+			w.syncErr = writeErr
+		}
+	} else {
+		w.size += written
+		if w.capturing {
+			for _, pw := range toFlush {
+				w.tail = append(w.tail, pw.entry)
+			}
+		}
+	}
+	locked = false
 	w.mu.Unlock()
+	w.flushes.Add(1)
+	entries := 0
+	for _, pw := range toFlush {
+		if pw.entry != "" { // Sync's marker isn't a write
+			entries++
+		}
+	}
+	if entries > 0 {
+		w.stats.record(entries, int(written))
+	}
 
 	// Notify all waiting goroutines
+	answered = true
 	for _, pw := range toFlush {
 		pw.done <- writeErr
 		close(pw.done)
 	}
 }
 
+// fail rejects a batch that was never written.
+func (w *WAL) fail(toFlush []pendingWrite, err error) {
+	w.stats.lost(toFlush)
+	w.mu.Lock()
+	if w.syncErr == nil {
+		w.syncErr = err
+	}
+	w.mu.Unlock()
+	for _, pw := range toFlush {
+		pw.done <- err
+		close(pw.done)
+	}
+}
+
+// SetBarrier makes every group commit call f first and fail if it does.
+// The durability layer uses it to keep this log behind another one.
+func (w *WAL) SetBarrier(f func() error) {
+	w.flushMu.Lock()
+	defer w.flushMu.Unlock()
+	w.barrier = f
+}
+
+// Sync flushes everything queued so far without waiting for the ticker. It
+// also reports any group commit that failed since the last Sync, so a
+// barrier can't miss a batch the ticker flushed (and lost) on its own.
+func (w *WAL) Sync() error {
+	err := w.drain()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err == nil {
+		err = w.syncErr
+	}
+	w.syncErr = nil
+	return err
+}
+
+// QueueBatch adds records to the next group commit as one unit: they all
+// make it to disk or none do.
+func (w *WAL) QueueBatch(records []string) <-chan error {
+	return w.queue(strings.Join(records, ""))
+}
+
 // WriteEntry queues a write and waits for group commit
 func (w *WAL) WriteEntry(key, value string) error {
-	entry := fmt.Sprintf("%s,%s\n", key, value)
+	return w.WriteEntryContext(context.Background(), key, value)
+}
+
+// WriteEntryContext is WriteEntry with the flush wait recorded as a span.
+func (w *WAL) WriteEntryContext(ctx context.Context, key, value string) error {
+	return Wait(ctx, w.QueueEntry(key, value))
+}
+
+// QueueEntry adds a write to the next group commit without waiting for it.
+// Callers that need WAL order to match their own order (the store does)
+// queue while holding their lock and Wait after releasing it.
+func (w *WAL) QueueEntry(key, value string) <-chan error {
+	return w.queue(FormatSet(key, value)) // keys with commas get a SET op record, the old format can't hold them
+}
+
+func containsComma(key string) bool {
+	return strings.ContainsRune(key, ',')
+}
+
+func (w *WAL) queue(entry string) <-chan error {
+	return w.add(entry, false)
+}
+
+// add queues entry. Unless wait is set, async mode acks it right away
+// as long as it doesn't fill the queue up to its size triggers.
+func (w *WAL) add(entry string, wait bool) <-chan error {
 	done := make(chan error, 1)
 
 	// Add to pending batch
 	w.pendingMu.Lock()
 	w.pending = append(w.pending, pendingWrite{entry: entry, done: done})
+	w.pendingBytes += len(entry)
+	full := w.full()
+	acked := w.mode == ModeAsync && !wait && !full
+	w.pending[len(w.pending)-1].acked = acked
+	if full {
+		w.signal()
+	}
 	w.pendingMu.Unlock()
-
-	// Wait for flush
-	return <-done
+	if acked {
+		return ackedNow
+	}
+	return done
 }
 
-func (w *WAL) Close() error {
-	close(w.closeCh)
-	w.flushTicker.Stop()
-	return w.file.Close()
+// signal wakes the flush loop without waiting for the ticker.
+func (w *WAL) signal() {
+	select {
+	case w.kick <- struct{}{}:
+	default: // already woken
+	}
 }
 
-func Recover(filename string) (map[string]string, error) {
-	data := make(map[string]string)
+// drain flushes batch after batch until everything queued before the call
+// is on disk, and returns the error of the last batch.
+func (w *WAL) drain() error {
+	done := w.add("", true)
+	for {
+		w.flush()
+		select {
+		case err := <-done:
+			return err
+		default:
+		}
+	}
+}
 
-	f, err := os.Open(filename)
-	if os.IsNotExist(err) {
-		return data, nil
+// Wait blocks until a queued entry's group commit is on disk, recording the
+// wait as a span. It returns ctx's error if ctx ends first; the entry stays
+// queued and may still be written. Failed waits of client requests are
+// logged with the request ID.
+func Wait(ctx context.Context, done <-chan error) error {
+	if d, ok := ctx.Value(deferredKey{}).(*deferredWaits); ok {
+		d.mu.Lock()
+		d.done = append(d.done, done)
+		d.mu.Unlock()
+		return nil
 	}
-	if err != nil {
-		return nil, err
+	_, span := tracing.Start(ctx, "wal.flush_wait")
+	defer span.End()
+	tag := tracing.LogTag(ctx)
+	select {
+	case err := <-done:
+		if err != nil && tag != "" {
+			fmt.Printf("WAL group commit failed: %v%s\n", err, tag)
+		}
+		return err
+	case <-ctx.Done():
+		if tag != "" {
+			fmt.Printf("Stopped waiting for the WAL: %v%s\n", ctx.Err(), tag)
+		}
+		return ctx.Err()
 	}
-	defer f.Close()
+}
+
+type deferredKey struct{}
 
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		line := scanner.Text()
-		parts := strings.Split(line, ",")
-		if len(parts) == 2 {
-			data[parts[0]] = parts[1]
+type deferredWaits struct {
+	mu   sync.Mutex
+	done []<-chan error
+}
+
+// DeferWaits returns a context under which Wait doesn't block: the entry is
+// set aside and Wait returns nil. The function returned waits for every
+// entry set aside so far, as Wait would, and returns the first error. A
+// caller that has to make several writes in order, one after the other,
+// can so wait for the group commits of all of them at once.
+func DeferWaits(ctx context.Context) (context.Context, func() error) {
+	d := &deferredWaits{}
+	return context.WithValue(ctx, deferredKey{}, d), func() error {
+		d.mu.Lock()
+		done := d.done
+		d.done = nil
+		d.mu.Unlock()
+		var first error
+		for _, c := range done {
+			if err := Wait(ctx, c); err != nil && first == nil {
+				first = err
+			}
 		}
+		return first
 	}
-	return data, nil
+}
+
+// Flushes returns how many group commits have been written.
+func (w *WAL) Flushes() int64 {
+	return w.flushes.Load()
+}
+
+// Size is the number of bytes in the log file known to be on disk.
+func (w *WAL) Size() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.size
+}
+
+// Path is the file the log is written to.
+func (w *WAL) Path() string {
+	return w.path
+}
+
+// Pending is the number of writes waiting for the next group commit.
+func (w *WAL) Pending() int {
+	w.pendingMu.Lock()
+	defer w.pendingMu.Unlock()
+	return len(w.pending)
+}
+
+func (w *WAL) Close() error {
+	close(w.closeCh)
+	w.flushTicker.Stop()
+	return w.file.Close()
 }
@@ -0,0 +1,336 @@
+package wal
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInjectedFaultsAreNotAcked(t *testing.T) {
+	filename := "test_wal_faults.log"
+	os.Remove(filename)
+	defer os.Remove(filename)
+
+	w, err := NewWAL(filename)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	if err := w.WriteEntry("kept", "1"); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+
+	w.SetFaults(Faults{SyncErrorPercent: 100})
+	if err := w.WriteEntry("lost", "2"); !errors.Is(err, ErrInjectedSync) {
+		t.Fatalf("Expected injected fsync error, got %v", err)
+	}
+	w.SetFaults(Faults{PartialWritePercent: 100})
+	if err := w.WriteEntry("torn", "3"); !errors.Is(err, ErrInjectedPartial) {
+		t.Fatalf("Expected injected partial write, got %v", err)
+	}
+	w.SetFaults(Faults{})
+	if err := w.WriteEntry("after", "4"); err != nil {
+		t.Fatalf("Failed to write after clearing faults: %v", err)
+	}
+	w.Close()
+
+	data, err := Recover(filename)
+	if err != nil {
+		t.Fatalf("Failed to recover: %v", err)
+	}
+	if data["kept"] != "1" || data["after"] != "4" {
+		t.Errorf("Expected acked writes to survive, got %v", data)
+	}
+	if _, ok := data["lost"]; ok {
+		t.Errorf("Write that failed fsync was recovered: %v", data)
+	}
+	if len(data) != 2 {
+		t.Errorf("Expected exactly the 2 acked keys, got %v", data)
+	}
+}
+
+func TestDeferWaitsWaitsOnceForAll(t *testing.T) {
+	filename := "test_wal_deferred.log"
+	os.Remove(filename)
+	defer os.Remove(filename)
+
+	w, err := NewWAL(filename)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer w.Close()
+	ctx, flushed := DeferWaits(context.Background())
+	for i := range 3 {
+		if err := w.WriteEntryContext(ctx, "k"+strconv.Itoa(i), "v"); err != nil {
+			t.Fatalf("Expected a deferred write not to wait, got %v", err)
+		}
+	}
+	if err := flushed(); err != nil {
+		t.Fatalf("Expected the deferred writes flushed, got %v", err)
+	}
+	if w.Pending() != 0 {
+		t.Errorf("Expected nothing pending once flushed, got %d", w.Pending())
+	}
+
+	w.SetFaults(Faults{SyncErrorPercent: 100})
+	if err := w.WriteEntryContext(ctx, "lost", "v"); err != nil {
+		t.Fatalf("Expected a deferred write not to wait, got %v", err)
+	}
+	if err := flushed(); !errors.Is(err, ErrInjectedSync) {
+		t.Errorf("Expected the failed fsync from the wait, got %v", err)
+	}
+	w.SetFaults(Faults{})
+}
+
+func TestRecoverOperationRecords(t *testing.T) {
+	filename := "test_wal_ops.log"
+	os.Remove(filename)
+	defer os.Remove(filename)
+
+	w, err := NewWAL(filename)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	w.WriteEntry("greeting", "hello")
+	Wait(context.Background(), w.QueueOp("APPEND", "greeting", ", world"))
+	w.WriteEntry("a,b", "comma key")
+	w.WriteEntry("!bang", "old style")
+	Wait(context.Background(), w.QueueOp("SETBIT", "flags", "9", "1"))
+	w.Close()
+
+	data, err := Recover(filename)
+	if err != nil {
+		t.Fatalf("Failed to recover: %v", err)
+	}
+	want := map[string]string{"greeting": "hello, world", "a,b": "comma key", "!bang": "old style", "flags": "\x00\x40"}
+	for k, v := range want {
+		if data[k] != v {
+			t.Errorf("Expected %q=%q, got %q", k, v, data[k])
+		}
+	}
+}
+
+func TestCompactionKeepsTailWrites(t *testing.T) {
+	filename := "test_wal_compact.log"
+	os.Remove(filename)
+	defer os.Remove(filename)
+
+	w, err := NewWAL(filename)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		w.WriteEntry("counter", strconv.Itoa(i))
+	}
+	w.WriteEntry("gone", "soon")
+	before := w.Size()
+
+	w.BeginCompaction()
+	// Written while the snapshot is being rewritten: must land after it.
+	w.WriteEntry("counter", "100")
+	Wait(context.Background(), w.QueueOp("DEL", "gone"))
+	if err := w.FinishCompaction([]string{FormatSet("counter", "99"), FormatSet("gone", "soon")}); err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+	if w.Size() >= before {
+		t.Errorf("Expected compaction to shrink the WAL, %d -> %d bytes", before, w.Size())
+	}
+	w.WriteEntry("after", "1")
+	w.Close()
+
+	data, err := Recover(filename)
+	if err != nil {
+		t.Fatalf("Failed to recover: %v", err)
+	}
+	if data["counter"] != "100" || data["after"] != "1" || len(data) != 2 {
+		t.Errorf("Expected counter=100 and after=1, got %v", data)
+	}
+}
+
+func TestRecoverIntoSmallChunks(t *testing.T) {
+	filename := "test_wal_chunks.log"
+	os.Remove(filename)
+	defer os.Remove(filename)
+
+	w, err := NewWAL(filename)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	ctx := context.Background()
+	for i := 0; i < 500; i++ {
+		w.QueueEntry("k"+strconv.Itoa(i%50), strconv.Itoa(i))
+		if i%7 == 0 {
+			w.QueueOp("APPEND", "log", strconv.Itoa(i)+";")
+		}
+	}
+	Wait(ctx, w.QueueOp("DEL", "k3"))
+	Wait(ctx, w.QueueOp("RENAME", "k4", "renamed"))
+	w.WriteEntry("long", strings.Repeat("x", 300)) // longer than a chunk
+	w.Close()
+
+	want, err := Recover(filename)
+	if err != nil {
+		t.Fatalf("Failed to recover: %v", err)
+	}
+	got := make(map[string]string)
+	var reports int
+	stats, err := RecoverInto(filename, RecoverOptions{
+		ChunkBytes:    64,
+		Workers:       4,
+		Progress:      func(RecoverStats) { reports++ },
+		ProgressEvery: time.Nanosecond,
+	}, func(records []Record) {
+		for _, r := range records {
+			Replay(mapState(got), r)
+		}
+	})
+	if err != nil {
+		t.Fatalf("Failed to recover in chunks: %v", err)
+	}
+	if !maps.Equal(got, want) {
+		t.Errorf("Chunked recovery disagrees with Recover:\n got %v\nwant %v", got, want)
+	}
+	if stats.Bytes != stats.TotalBytes || reports == 0 {
+		t.Errorf("Expected the whole file read with progress reports, got %+v after %d reports", stats, reports)
+	}
+	if _, ok := got["k3"]; ok || got["renamed"] != want["renamed"] || len(got["long"]) != 300 {
+		t.Errorf("Expected DEL, RENAME and the long line to replay, got %v", got)
+	}
+}
+
+func TestCommitTriggersOnSize(t *testing.T) {
+	filename := "test_wal_commit.log"
+	os.Remove(filename)
+	defer os.Remove(filename)
+
+	w, err := NewWAL(filename)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer w.Close()
+	w.SetCommitOptions(CommitOptions{Interval: time.Hour, MaxEntries: 10})
+
+	var dones []<-chan error
+	for i := 0; i < 25; i++ {
+		dones = append(dones, w.QueueEntry("k"+strconv.Itoa(i), "v"))
+	}
+	// Two full batches go out without waiting for the interval, the last
+	// five stay queued.
+	select {
+	case err := <-dones[19]:
+		if err != nil {
+			t.Fatalf("Failed to flush: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected a full batch to flush before the interval")
+	}
+	if n := w.Pending(); n != 5 {
+		t.Errorf("Expected the last 5 writes still queued, got %d", n)
+	}
+	if err := w.Sync(); err != nil {
+		t.Fatalf("Failed to sync: %v", err)
+	}
+
+	st := w.CommitStats()
+	if st.Entries != 25 || st.MaxBatchEntries != 10 || st.SizeTriggered < 2 {
+		t.Errorf("Expected 25 writes in batches of at most 10, two of them size-triggered, got %+v", st)
+	}
+}
+
+func TestAsyncModeAcksBeforeFlush(t *testing.T) {
+	filename := "test_wal_async.log"
+	os.Remove(filename)
+	defer os.Remove(filename)
+
+	w, err := NewWAL(filename)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	w.SetCommitOptions(CommitOptions{Interval: time.Hour, MaxEntries: 3})
+	w.SetMode(ModeAsync)
+
+	for i := 0; i < 2; i++ {
+		if err := w.WriteEntry("k"+strconv.Itoa(i), "v"); err != nil {
+			t.Fatalf("Failed to write: %v", err)
+		}
+	}
+	if w.Size() != 0 {
+		t.Errorf("Expected nothing on disk before the interval, got %d bytes", w.Size())
+	}
+	// This one fills the queue, so its writer waits for the flush.
+	if err := w.WriteEntry("k2", "v"); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	if w.Size() == 0 {
+		t.Error("Expected the writer that filled the queue to wait for the flush")
+	}
+
+	w.SetFaults(Faults{SyncErrorPercent: 100})
+	w.WriteEntry("lost", "v")
+	if err := w.Sync(); !errors.Is(err, ErrInjectedSync) {
+		t.Fatalf("Expected Sync to report the failed flush, got %v", err)
+	}
+	if st := w.CommitStats(); st.AsyncLost != 1 {
+		t.Errorf("Expected one acked write lost, got %+v", st)
+	}
+	w.Close()
+}
+
+func TestCompactionRecyclesRetiredLog(t *testing.T) {
+	filename := "test_wal_recycle.log"
+	spare := filename + spareSuffix
+	for _, f := range []string{filename, spare} {
+		os.Remove(f)
+		defer os.Remove(f)
+	}
+
+	w, err := NewWAL(filename)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	w.SetPrealloc(1 << 20)
+	w.SetRecycle(true)
+	for i := 0; i < 100; i++ {
+		w.WriteEntry("counter", strconv.Itoa(i))
+	}
+	compact := func(records ...string) {
+		t.Helper()
+		w.BeginCompaction()
+		if err := w.FinishCompaction(records); err != nil {
+			t.Fatalf("Failed to compact: %v", err)
+		}
+	}
+
+	compact(FormatSet("counter", "99"))
+	retired, err := os.Stat(spare)
+	if err != nil {
+		t.Fatalf("Expected the retired log kept as a spare: %v", err)
+	}
+	w.WriteEntry("after", "1")
+	compact(FormatSet("counter", "99"), FormatSet("after", "1"))
+	current, err := os.Stat(filename)
+	if err != nil {
+		t.Fatalf("Failed to stat the log: %v", err)
+	}
+	if !os.SameFile(retired, current) {
+		t.Error("Expected the second compaction to overwrite the spare rather than create a file")
+	}
+	// The spare held 100 records; only the two new ones may be left.
+	if want := int64(len(FormatSet("counter", "99") + FormatSet("after", "1"))); current.Size() != want || w.Size() != want {
+		t.Errorf("Expected the recycled log cut to %d bytes, got %d on disk and %d tracked", want, current.Size(), w.Size())
+	}
+	w.WriteEntry("last", "2")
+	w.Close()
+
+	data, err := Recover(filename)
+	if err != nil {
+		t.Fatalf("Failed to recover: %v", err)
+	}
+	if data["counter"] != "99" || data["after"] != "1" || data["last"] != "2" || len(data) != 3 {
+		t.Errorf("Expected counter=99, after=1 and last=2, got %v", data)
+	}
+}
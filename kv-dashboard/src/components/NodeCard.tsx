@@ -20,6 +20,7 @@ export default function NodeCard({ node, onKill, onRevive }: Props) {
       <div className="flex items-center gap-3 mb-4">
         <div className={`w-4 h-4 rounded-full ${stateColors[node.state]} shadow-lg`} />
         <span className="text-zinc-400 font-mono">:{node.port}</span>
+        {node.witness && <span className="text-xs text-zinc-500 font-mono">witness</span>}
       </div>
 
       {/* State */}
@@ -31,6 +32,17 @@ export default function NodeCard({ node, onKill, onRevive }: Props) {
       <div className="space-y-1 text-sm text-zinc-500 font-mono">
         <p>Term: {node.term}</p>
         <p>Log: {node.logLength} entries</p>
+        {node.election && (
+          <p>
+            Election (term {node.election.term}): {node.election.won ? "won" : node.election.preVote ? "pre-vote failed" : "lost"}, {node.election.votes} votes
+          </p>
+        )}
+        {node.election?.denials &&
+          Object.entries(node.election.denials).map(([peer, reason]) => (
+            <p key={peer} className="text-amber-500/80">
+              {peer} said no: {reason}
+            </p>
+          ))}
       </div>
 
       {/* Kill or Revive button based on state */}
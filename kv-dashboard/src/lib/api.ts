@@ -12,10 +12,29 @@ const NODES = [
     term: number;
     logLength: number;
     paused: boolean; // true when node is paused
+    witness?: boolean; // votes but stores no data and never leads
+    election?: Election; // latest candidacy, if the node ever stood
+  }
+
+  export interface Election {
+    term: number;
+    votes: number;
+    won: boolean;
+    preVote?: boolean; // stopped at the pre-vote, the term never changed
+    denials?: Record<string, string>; // peer -> why it voted no
   }
   
-  // Fetch status from all nodes
+  // Fetch status from all nodes: one /cluster/overview from whichever node
+  // answers, or each node's /status if none does.
   export async function getClusterStatus(): Promise<NodeStatus[]> {
+    for (const node of NODES) {
+      try {
+        const res = await fetch(`http://localhost:${node.http}/cluster/overview`, { cache: "no-store" });
+        if (res.ok) return fromOverview(await res.json());
+      } catch {
+        // try the next node
+      }
+    }
     const results = await Promise.all(
       NODES.map(async (node) => {
         try {
@@ -31,6 +50,8 @@ const NODES = [
             term: data.term,
             logLength: data.logLength,
             paused: data.paused || false, // include paused state from server
+            witness: data.witness || false,
+            election: data.election,
           };
         } catch {
           return {
@@ -48,6 +69,33 @@ const NODES = [
     return results;
   }
   
+  interface OverviewNode {
+    id: string; // node ID, e.g. ":8080"
+    reachable: boolean;
+    status?: { state: NodeStatus["state"]; term: number; logLength: number; paused: boolean; witness?: boolean; election?: Election };
+  }
+
+  function fromOverview(overview: { nodes: OverviewNode[] }): NodeStatus[] {
+    return NODES.map((node) => {
+      const n = overview.nodes.find((o) => o.id.endsWith(`:${node.tcp}`));
+      const data = n?.reachable ? n.status : undefined;
+      if (!data) {
+        return { id: node.id, port: node.tcp, alive: false, state: "Dead" as const, term: 0, logLength: 0, paused: false };
+      }
+      return {
+        id: node.id,
+        port: node.tcp,
+        alive: !data.paused,
+        state: data.paused ? "Dead" as const : data.state,
+        term: data.term,
+        logLength: data.logLength,
+        paused: data.paused || false,
+        witness: data.witness || false,
+        election: data.election,
+      };
+    });
+  }
+
   // Pause a node - simulates failure
   export async function pauseNode(port: number): Promise<void> {
     const httpPort = port + 1000; // HTTP port is TCP + 1000